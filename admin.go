@@ -0,0 +1,284 @@
+package terrarium
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// The admin socket lets tools on the server's machine, such as terrarium-ctl,
+// control it (see admin-socket in the config). It is a Unix socket. Whoever
+// may connect to it may do what an operator may, so only its owner may read
+// and write it.
+//
+// A tool sends commands formatted like IRC messages, one per line, such as:
+//
+//	KLINE 60 *@192.0.2.1 :Spamming
+//
+// We reply with any number of lines and then a line saying OK, or saying
+// ERROR and why the command failed. The commands are:
+//
+//	STATUS                               How the server is doing
+//	USERS                                Every user on the network
+//	HISTORY [<samples>]                  User, channel, and server counts over time
+//	KLINE [<minutes>] <user@host> :<reason>  Add a K-Line on this server
+//	ADMIT <nick or UID>                  Let a challenged user join channels
+//	REHASH                               Reload the configuration
+//	STOP                                 Shut down
+//
+// The tool may send several commands on one connection.
+
+// startAdminSocket listens on the admin socket.
+func (cb *Catbox) startAdminSocket() error {
+	path := cb.config().AdminSocket
+
+	// A server that didn't shut down cleanly may have left its socket behind.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return err
+	}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !cb.isShuttingDown() {
+					log.Printf("Admin socket stopped: %s", err)
+				}
+				return
+			}
+			cb.WG.Add(1)
+			go cb.handleAdminConn(conn)
+		}
+	}()
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		<-cb.ShutdownChan
+		_ = ln.Close()
+	}()
+
+	return nil
+}
+
+// adminReply is what we reply to a command on the admin socket: lines to
+// send, and if the command failed, why.
+type adminReply struct {
+	lines []string
+	err   error
+}
+
+// handleAdminConn reads commands from a connection to the admin socket and
+// replies to each.
+func (cb *Catbox) handleAdminConn(conn net.Conn) {
+	defer cb.WG.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Don't hold up shutting down waiting for the tool to send something.
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		select {
+		case <-done:
+		case <-cb.ShutdownChan:
+		}
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		m, err := irc.ParseMessage(line)
+		if err != nil {
+			if !writeAdminReply(conn, adminReply{err: err}) {
+				return
+			}
+			continue
+		}
+
+		command := strings.ToUpper(m.Command)
+		log.Printf("Admin socket: %s", command)
+
+		if command == "STOP" {
+			writeAdminReply(conn, adminReply{})
+			cb.RequestShutdown()
+			return
+		}
+
+		replyChan := make(chan adminReply, 1)
+		cb.newEvent(Event{
+			Type: CallEvent,
+			Func: func() { replyChan <- cb.adminCommand(command, m.Params) },
+		})
+
+		var reply adminReply
+		select {
+		case reply = <-replyChan:
+		case <-cb.ShutdownChan:
+			return
+		}
+
+		if !writeAdminReply(conn, reply) {
+			return
+		}
+	}
+}
+
+// writeAdminReply sends a reply to a command on the admin socket. It returns
+// false if we couldn't.
+func writeAdminReply(conn net.Conn, reply adminReply) bool {
+	w := bufio.NewWriter(conn)
+	for _, line := range reply.lines {
+		_, _ = w.WriteString(line + "\n")
+	}
+	if reply.err != nil {
+		_, _ = w.WriteString(fmt.Sprintf("ERROR %s\n", reply.err))
+	} else {
+		_, _ = w.WriteString("OK\n")
+	}
+	return w.Flush() == nil
+}
+
+// adminCommand runs a command from the admin socket. It runs on the server
+// goroutine.
+func (cb *Catbox) adminCommand(command string, params []string) adminReply {
+	switch command {
+	case "STATUS":
+		return cb.adminStatus()
+	case "USERS":
+		return cb.adminUsers()
+	case "HISTORY":
+		return cb.adminHistory(params)
+	case "KLINE":
+		return cb.adminKLine(params)
+	case "ADMIT":
+		if len(params) != 1 {
+			return adminReply{err: fmt.Errorf("usage: ADMIT <nick or UID>")}
+		}
+		if !cb.admitUserByName(params[0]) {
+			return adminReply{err: fmt.Errorf("no challenged user %s", params[0])}
+		}
+		return adminReply{}
+	case "REHASH":
+		if err := cb.rehash(nil); err != nil {
+			return adminReply{err: err}
+		}
+		return adminReply{}
+	default:
+		return adminReply{err: fmt.Errorf("unknown command %s", command)}
+	}
+}
+
+// adminStatus describes how the server is doing.
+func (cb *Catbox) adminStatus() adminReply {
+	return adminReply{lines: []string{
+		fmt.Sprintf("Server %s (%s) running %s", cb.Config.ServerName,
+			cb.Config.TS6SID, cb.version()),
+		fmt.Sprintf("Users %d (%d local), servers %d (%d linked to us), channels %d",
+			len(cb.Users), len(cb.LocalUsers), len(cb.Servers)+1,
+			len(cb.LocalServers), len(cb.Channels)),
+		fmt.Sprintf("Unregistered clients %d, K-Lines %d, operators %d",
+			len(cb.LocalClients), len(cb.KLines), len(cb.Opers)),
+	}}
+}
+
+// adminUsers lists every user on the network by nick: their nick, user@host,
+// IP, and server.
+func (cb *Catbox) adminUsers() adminReply {
+	var lines []string
+	for _, user := range cb.Users {
+		server := cb.Config.ServerName
+		if !user.isLocal() {
+			server = user.Server.Name
+		}
+		lines = append(lines, fmt.Sprintf("%s %s@%s %s %s", user.DisplayNick,
+			user.Username, user.Hostname, cb.publicIP(user), server))
+	}
+	sort.Strings(lines)
+	return adminReply{lines: lines}
+}
+
+// adminHistory lists the counts of users, channels, and servers we've taken,
+// oldest first. By default all of them.
+//
+// Parameters: [<samples>]
+func (cb *Catbox) adminHistory(params []string) adminReply {
+	samples := historySize
+	if len(params) > 0 {
+		n, err := strconv.Atoi(params[0])
+		if err != nil || n < 1 {
+			return adminReply{err: fmt.Errorf("usage: HISTORY [<samples>]")}
+		}
+		samples = n
+	}
+	return adminReply{lines: cb.historyLines(samples)}
+}
+
+// adminKLine adds a K-Line on this server. Unlike KLINE from an operator, we
+// don't tell other servers about it.
+//
+// Parameters: [<minutes>] <user@host> <reason>
+func (cb *Catbox) adminKLine(params []string) adminReply {
+	var duration time.Duration
+	if len(params) > 0 {
+		if minutes, err := strconv.ParseUint(params[0], 10, 31); err == nil {
+			duration = time.Duration(minutes) * time.Minute
+			params = params[1:]
+		}
+	}
+
+	if len(params) < 2 || params[1] == "" {
+		return adminReply{err: fmt.Errorf("usage: KLINE [<minutes>] <user@host> :<reason>")}
+	}
+
+	pieces := strings.Split(params[0], "@")
+	if len(pieces) != 2 || !isValidUserMask(pieces[0]) ||
+		!isValidHostMask(pieces[1]) {
+		return adminReply{err: fmt.Errorf("bad mask: %s", params[0])}
+	}
+
+	if cb.hasKLine(pieces[0], pieces[1]) {
+		return adminReply{err: fmt.Errorf("there is already a K-Line for [%s]",
+			params[0])}
+	}
+
+	kline := KLine{UserMask: pieces[0], HostMask: pieces[1]}
+	if duration > 0 {
+		kline.Expires = cb.now().Add(duration)
+	}
+
+	local, _ := cb.countKLineMatches(kline.UserMask, kline.HostMask)
+	cb.addAndApplyKLine(kline, "admin socket", params[1])
+
+	return adminReply{lines: []string{
+		fmt.Sprintf("K-Line for [%s@%s] matched %d local users", kline.UserMask,
+			kline.HostMask, local),
+	}}
+}
@@ -0,0 +1,103 @@
+package terrarium
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tools may check on the server and K-Line users through the admin socket.
+func TestAdminSocket(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.AdminSocket = path
+		a.cb.setConfig(&cfg)
+	})
+	if err := a.cb.startAdminSocket(); err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	alice := a.connectUser("alice", "alice")
+	a.makeOper("alice")
+	a.connectUser("bob", "bob")
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("connecting: %s", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// command sends a command and returns the lines of the reply, including
+	// the final OK or ERROR.
+	command := func(line string) []string {
+		t.Helper()
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("setting deadline: %s", err)
+		}
+		if _, err := fmt.Fprintf(conn, "%s\r\n", line); err != nil {
+			t.Fatalf("sending %s: %s", line, err)
+		}
+		var lines []string
+		for {
+			reply, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading reply to %s: %s", line, err)
+			}
+			reply = strings.TrimSuffix(reply, "\n")
+			lines = append(lines, reply)
+			if reply == "OK" || strings.HasPrefix(reply, "ERROR ") {
+				return lines
+			}
+		}
+	}
+
+	status := command("STATUS")
+	if len(status) != 4 || !strings.HasPrefix(status[1], "Users 2 (2 local)") {
+		t.Errorf("STATUS = %q", status)
+	}
+
+	users := command("USERS")
+	if len(users) != 3 || !strings.HasPrefix(users[0], "alice ~alice@") ||
+		!strings.HasPrefix(users[1], "bob ~bob@") || users[2] != "OK" {
+		t.Errorf("USERS = %q", users)
+	}
+
+	kline := command("KLINE 60 *bob@* :Go away")
+	if len(kline) != 2 || kline[0] != "K-Line for [*bob@*] matched 1 local users" {
+		t.Errorf("KLINE = %q", kline)
+	}
+	n.waitFor("bob to be K-Lined", func() bool {
+		return a.userServer("bob") == ""
+	})
+	if !alice.hasMessageContaining("NOTICE", "admin socket added K-Line for [*bob@*]") {
+		t.Errorf("alice did not hear about the K-Line")
+	}
+
+	if reply := command("KLINE *bob@* :Again"); len(reply) != 1 ||
+		!strings.HasPrefix(reply[0], "ERROR there is already a K-Line") {
+		t.Errorf("duplicate KLINE = %q", reply)
+	}
+
+	n.advance(historyInterval)
+	n.waitFor("counts to be taken", func() bool {
+		return len(command("HISTORY")) == 2
+	})
+	if history := command("HISTORY 1"); len(history) != 2 ||
+		!strings.HasPrefix(history[0], "2020-01-01 00:05 UTC users ") {
+		t.Errorf("HISTORY 1 = %q", history)
+	}
+
+	if reply := command("BOGUS"); len(reply) != 1 ||
+		reply[0] != "ERROR unknown command BOGUS" {
+		t.Errorf("BOGUS = %q", reply)
+	}
+}
@@ -5,21 +5,111 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Args are command line arguments.
 type Args struct {
 	ConfigFile string
 	ListenFD   int
+
+	// Listening sockets to take over. Listener name to file descriptor. We pass
+	// these to ourselves when we restart.
+	ListenFDs map[string]int
+
+	// If set, rather than run, write a new configuration. See init.go.
+	Init *InitOptions
+
+	// If set, rather than run, generate a certificate. See cert.go.
+	GenCert *CertificateOptions
 }
 
 func GetArgs() *Args {
 	configFile := flag.String("conf", "", "Configuration file.")
 	fd := flag.Int("listen-fd", -1,
 		"File descriptor with listening port to use (optional).")
+	fds := flag.String("listen-fds", "",
+		"Named file descriptors with listening ports to use, as name=fd,... (optional).")
+	initDir := flag.String("init", "",
+		"Write a new configuration to this directory rather than run.")
+	initServerName := flag.String("init-server-name", "",
+		"Server name for -init. We ask if it's not given.")
+	initNetworkName := flag.String("init-network-name", "",
+		"Network name for -init. We ask if it's not given.")
+	initOperName := flag.String("init-oper-name", "",
+		"Operator name for -init. We ask if it's not given.")
+	initOperPassword := flag.String("init-oper-password", "",
+		"Operator password for -init. We make one up if it's not given.")
+	genCert := flag.String("gencert", "",
+		"Generate a certificate for these hostnames (comma separated) rather than run.")
+	genCertFile := flag.String("gencert-cert", "certificate.pem",
+		"File to write the certificate from -gencert to.")
+	genCertKeyFile := flag.String("gencert-key", "key.pem",
+		"File to write the key from -gencert to.")
+	genCertCAFile := flag.String("gencert-ca-cert", "",
+		"CA certificate to sign the certificate from -gencert with. If not given, it is self-signed.")
+	genCertCAKeyFile := flag.String("gencert-ca-key", "",
+		"Key of the CA certificate to sign with.")
+	genCertNewCA := flag.Bool("gencert-new-ca", false,
+		"Make -gencert generate a CA certificate for signing servers' certificates.")
+	genCertDays := flag.Int("gencert-days", 365,
+		"How many days the certificate from -gencert is good for.")
 
 	flag.Parse()
 
+	if *genCert != "" {
+		if *genCertDays <= 0 {
+			printUsage(fmt.Errorf("-gencert-days must be positive"))
+			return nil
+		}
+		if (*genCertCAFile == "") != (*genCertCAKeyFile == "") {
+			printUsage(fmt.Errorf("-gencert-ca-cert and -gencert-ca-key go together"))
+			return nil
+		}
+
+		var hostnames []string
+		for _, hostname := range strings.Split(*genCert, ",") {
+			if hostname = strings.TrimSpace(hostname); hostname != "" {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+
+		return &Args{
+			GenCert: &CertificateOptions{
+				Hostnames:  hostnames,
+				ValidFor:   time.Duration(*genCertDays) * 24 * time.Hour,
+				CertFile:   *genCertFile,
+				KeyFile:    *genCertKeyFile,
+				CACertFile: *genCertCAFile,
+				CAKeyFile:  *genCertCAKeyFile,
+				NewCA:      *genCertNewCA,
+			},
+		}
+	}
+
+	if *initDir != "" {
+		// Only ask if someone is there to answer.
+		interactive := false
+		if fi, err := os.Stdin.Stat(); err == nil &&
+			fi.Mode()&os.ModeCharDevice != 0 {
+			interactive = true
+		}
+
+		return &Args{
+			Init: &InitOptions{
+				Dir:          *initDir,
+				ServerName:   *initServerName,
+				NetworkName:  *initNetworkName,
+				OperName:     *initOperName,
+				OperPassword: *initOperPassword,
+				Interactive:  interactive,
+			},
+		}
+	}
+
 	if len(*configFile) == 0 {
 		printUsage(fmt.Errorf("you must provide a configuration file"))
 		return nil
@@ -32,10 +122,53 @@ func GetArgs() *Args {
 		return nil
 	}
 
+	listenFDs, err := ParseListenFDs(*fds)
+	if err != nil {
+		printUsage(err)
+		return nil
+	}
+
 	return &Args{
 		ConfigFile: configPath,
 		ListenFD:   *fd,
+		ListenFDs:  listenFDs,
+	}
+}
+
+// ParseListenFDs parses the -listen-fds argument. It is a comma separated list
+// of name=fd.
+func ParseListenFDs(s string) (map[string]int, error) {
+	fds := map[string]int{}
+	if s == "" {
+		return fds, nil
+	}
+
+	for _, piece := range strings.Split(s, ",") {
+		idx := strings.LastIndex(piece, "=")
+		if idx < 1 {
+			return nil, fmt.Errorf("invalid listen fd: %s", piece)
+		}
+
+		fd, err := strconv.Atoi(piece[idx+1:])
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid listen fd: %s", piece)
+		}
+
+		fds[piece[:idx]] = fd
+	}
+
+	return fds, nil
+}
+
+// FormatListenFDs builds a -listen-fds argument. It is the reverse of
+// ParseListenFDs.
+func FormatListenFDs(fds map[string]int) string {
+	var pieces []string
+	for name, fd := range fds {
+		pieces = append(pieces, fmt.Sprintf("%s=%d", name, fd))
 	}
+	sort.Strings(pieces)
+	return strings.Join(pieces, ",")
 }
 
 func printUsage(err error) {
@@ -0,0 +1,261 @@
+package terrarium
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Systems such as CI and monitoring may post to channels over HTTP rather than
+// run a bot. They POST JSON such as this to the bridge (see bridge-listen in
+// the config):
+//
+//	{"channel": "#ops", "text": "Build 12 failed", "notice": true}
+//
+// They give the configured token as a bearer token. We send each line of the
+// text to the channel from the bridge user, as a NOTICE if notice is true and a
+// PRIVMSG otherwise.
+//
+// The bridge user is a virtual user (see virtual.go), so the rest of the
+// network sees an ordinary user. It joins channels when it first posts to
+// them. If it gets disconnected, we connect it again on the next request.
+
+// bridgeMaxBody is the largest request we accept, in bytes.
+const bridgeMaxBody = 64 * 1024
+
+// bridgeMaxLines is how many lines one request may post.
+const bridgeMaxLines = 10
+
+// bridgeMaxLineLength is how long a line may be, in bytes. This leaves room
+// for the prefix and the channel in the message.
+const bridgeMaxLineLength = 400
+
+// bridgeRequest is what a request to the bridge holds.
+type bridgeRequest struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+	Notice  bool   `json:"notice"`
+}
+
+// bridgeResult is how posting to a channel went. It is an HTTP status and,
+// if we failed, why.
+type bridgeResult struct {
+	status int
+	reason string
+}
+
+// startBridge listens for requests to the bridge and connects the bridge
+// user.
+func (cb *Catbox) startBridge() error {
+	ln, err := net.Listen("tcp", cb.Config.BridgeListen)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           cb.bridgeHandler(),
+		ReadHeaderTimeout: WebhookTimeout,
+	}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("Bridge stopped: %s", err)
+		}
+	}()
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		<-cb.ShutdownChan
+		_ = srv.Close()
+	}()
+
+	cb.connectBridge()
+	return nil
+}
+
+// bridgeHandler handles requests to the bridge.
+func (cb *Catbox) bridgeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cfg := cb.config()
+
+		auth := []byte(r.Header.Get("Authorization"))
+		if cfg.BridgeToken == "" ||
+			subtle.ConstantTimeCompare(auth, []byte("Bearer "+cfg.BridgeToken)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		var req bridgeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+			bridgeMaxBody)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		channelName := canonicalizeChannel(req.Channel)
+		if !isValidChannel(channelName) {
+			http.Error(w, "Invalid channel", http.StatusBadRequest)
+			return
+		}
+
+		_, all := cfg.BridgeChannels["*"]
+		_, allowed := cfg.BridgeChannels[channelName]
+		if !all && !allowed {
+			http.Error(w, "The bridge may not post to that channel",
+				http.StatusForbidden)
+			return
+		}
+
+		lines := bridgeLines(req.Text)
+		if len(lines) == 0 || len(lines) > bridgeMaxLines {
+			http.Error(w, fmt.Sprintf("Text must have between 1 and %d lines",
+				bridgeMaxLines), http.StatusBadRequest)
+			return
+		}
+		for _, line := range lines {
+			if len(line) > bridgeMaxLineLength {
+				http.Error(w, "Line too long", http.StatusBadRequest)
+				return
+			}
+		}
+
+		command := "PRIVMSG"
+		if req.Notice {
+			command = "NOTICE"
+		}
+
+		result := cb.bridgePost(command, channelName, lines)
+		if result.status != http.StatusNoContent {
+			http.Error(w, result.reason, result.status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// bridgeLines splits text into lines to post. It drops blank ones.
+func bridgeLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// bridgePost sends the lines to the channel from the bridge user.
+func (cb *Catbox) bridgePost(command, channelName string,
+	lines []string) bridgeResult {
+	cb.bridgeMutex.Lock()
+	uid := cb.bridgeUID
+	cb.bridgeMutex.Unlock()
+
+	if uid == "" {
+		cb.connectBridge()
+		return bridgeResult{status: http.StatusServiceUnavailable,
+			reason: "The bridge user is connecting. Try again shortly."}
+	}
+
+	resultChan := make(chan bridgeResult, 1)
+	cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() {
+			resultChan <- cb.deliverBridgeMessages(uid, command, channelName, lines)
+		},
+	})
+
+	select {
+	case result := <-resultChan:
+		return result
+	case <-cb.ShutdownChan:
+		return bridgeResult{status: http.StatusServiceUnavailable,
+			reason: "Shutting down"}
+	}
+}
+
+// deliverBridgeMessages has the bridge user join the channel if necessary and
+// send the lines to it.
+//
+// The bridge user's messages go through the same checks as anyone's, such as
+// for +m. We don't find out if those refuse them.
+func (cb *Catbox) deliverBridgeMessages(uid TS6UID, command,
+	channelName string, lines []string) bridgeResult {
+	u, exists := cb.Users[uid]
+	if !exists || !u.isLocal() {
+		return bridgeResult{status: http.StatusServiceUnavailable,
+			reason: "The bridge user is not connected. Try again shortly."}
+	}
+
+	channel, exists := cb.Channels[channelName]
+	if !exists {
+		return bridgeResult{status: http.StatusNotFound, reason: "No such channel"}
+	}
+
+	if !u.onChannel(channel) {
+		u.LocalUser.handleMessage(irc.Message{Command: "JOIN",
+			Params: []string{channel.Name}})
+		if !u.onChannel(channel) {
+			return bridgeResult{status: http.StatusForbidden,
+				reason: "The bridge user can't join that channel"}
+		}
+	}
+
+	for _, line := range lines {
+		u.LocalUser.handleMessage(irc.Message{Command: command,
+			Params: []string{channel.Name, line}})
+	}
+
+	return bridgeResult{status: http.StatusNoContent}
+}
+
+// connectBridge connects the bridge user unless it is connected or connecting.
+func (cb *Catbox) connectBridge() {
+	cb.bridgeMutex.Lock()
+	if cb.bridgeConnecting || cb.bridgeUID != "" {
+		cb.bridgeMutex.Unlock()
+		return
+	}
+	cb.bridgeConnecting = true
+	cb.bridgeMutex.Unlock()
+
+	v := cb.NewVirtualUser(cb.config().BridgeNick, "bridge", "HTTP bridge", nil)
+
+	// Track the bridge user until it goes away.
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		select {
+		case <-v.Registered():
+			cb.bridgeMutex.Lock()
+			cb.bridgeUID = v.UID()
+			cb.bridgeConnecting = false
+			cb.bridgeMutex.Unlock()
+		case <-v.Done():
+		}
+
+		<-v.Done()
+
+		cb.bridgeMutex.Lock()
+		cb.bridgeUID = ""
+		cb.bridgeConnecting = false
+		cb.bridgeMutex.Unlock()
+	}()
+}
@@ -0,0 +1,138 @@
+package terrarium
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// The bridge posts to allowed channels as the bridge user, who the rest of the
+// network sees.
+func TestBridge(t *testing.T) {
+	testBridge(t, func(cfg *Config) {}, nil)
+}
+
+// The bridge user is virtual, so it neither needs the client password nor
+// gets challenged.
+func TestBridgeClientPasswordAndChallenge(t *testing.T) {
+	testBridge(t, func(cfg *Config) {
+		cfg.ClientPassword = "letmein"
+	}, challengeFunc(func(ChallengeInfo) (string, error) {
+		return "Prove you're human", nil
+	}))
+}
+
+func testBridge(t *testing.T, configure func(*Config), challenger Challenger) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	// The oper connects before configure() may set a client password.
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.BridgeToken = "secret"
+		cfg.BridgeNick = "ci"
+		cfg.BridgeChannels = map[string]struct{}{"#builds": {}}
+		configure(&cfg)
+		a.cb.setConfig(&cfg)
+		a.cb.Challenger = challenger
+	})
+
+	srv := httptest.NewServer(a.cb.bridgeHandler())
+	defer srv.Close()
+
+	post := func(token, body string) int {
+		req, err := http.NewRequest(http.MethodPost, srv.URL,
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	bob := b.connectUser("bob", "bob")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	joinAll("#builds", bob)
+	joinAll("#other", bob)
+	n.waitFor("bob to join", func() bool {
+		return len(a.channelMembers("#builds")) == 1 &&
+			len(a.channelMembers("#other")) == 1
+	})
+
+	msg := `{"channel": "#builds", "text": "build 1 failed\nsee the log"}`
+
+	// The bridge user connects on the first request.
+	if status := post("secret", msg); status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d before the bridge user connected, wanted 503", status)
+	}
+	n.waitFor("the bridge user to connect", func() bool {
+		return b.userServer("ci") == "a.example.com"
+	})
+	n.waitFor("the bridge user to be ready", func() bool {
+		a.cb.bridgeMutex.Lock()
+		defer a.cb.bridgeMutex.Unlock()
+		return a.cb.bridgeUID != ""
+	})
+
+	if status := post("wrong", msg); status != http.StatusUnauthorized {
+		t.Errorf("got %d with a bad token, wanted 401", status)
+	}
+	if status := post("secret", `{"channel": "#other", "text": "hi"}`); status !=
+		http.StatusForbidden {
+		t.Errorf("got %d for a channel not allowed, wanted 403", status)
+	}
+	if status := post("secret", `{"channel": "#builds"}`); status !=
+		http.StatusBadRequest {
+		t.Errorf("got %d without text, wanted 400", status)
+	}
+
+	if status := post("secret", msg); status != http.StatusNoContent {
+		t.Fatalf("got %d posting, wanted 204", status)
+	}
+	if status := post("secret",
+		`{"channel": "#builds", "text": "build 2 passed", "notice": true}`); status !=
+		http.StatusNoContent {
+		t.Fatalf("got %d posting a notice, wanted 204", status)
+	}
+
+	n.waitFor("bob to see the messages", func() bool {
+		return bob.hasMessageContaining("PRIVMSG", "build 1 failed") &&
+			bob.hasMessageContaining("PRIVMSG", "see the log") &&
+			bob.hasMessageContaining("NOTICE", "build 2 passed")
+	})
+
+	m := bob.lastMessage("NOTICE")
+	if !strings.HasPrefix(m.Prefix, "ci!") || m.Params[0] != "#builds" {
+		t.Errorf("notice is %s, wanted it from ci to #builds", m)
+	}
+
+	// If the bridge user is killed, it connects again.
+	oper.send(irc.Message{Command: "KILL", Params: []string{"ci", "bye"}})
+	n.waitFor("the bridge user to be killed", func() bool {
+		a.cb.bridgeMutex.Lock()
+		defer a.cb.bridgeMutex.Unlock()
+		return a.cb.bridgeUID == ""
+	})
+	if status := post("secret", msg); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d after the bridge user was killed, wanted 503", status)
+	}
+	n.waitFor("the bridge user to reconnect", func() bool {
+		a.cb.bridgeMutex.Lock()
+		defer a.cb.bridgeMutex.Unlock()
+		return a.cb.bridgeUID != ""
+	})
+}
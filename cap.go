@@ -0,0 +1,270 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// We support IRCv3 capability negotiation (CAP) so clients may turn on
+// capabilities that change what we send them. A client that sends CAP LS or
+// CAP REQ before registering must send CAP END before we register it.
+//
+// What we offer may change while we run, such as when a rehash disables a
+// capability. Clients with cap-notify hear about it with CAP NEW and CAP DEL.
+//
+// Some capabilities have a value, which we only show clients that ask for CAP
+// LS 302.
+
+// supportedCaps are the capabilities we know.
+var supportedCaps = map[string]struct{}{
+	// Clients hear when we offer new capabilities or stop offering some. See
+	// updateCaps().
+	"cap-notify": {},
+
+	// Chanops hear about invites to their channels. See inviteNotify().
+	"invite-notify": {},
+
+	// Clients may get message tags, such as the bot tag. See tags.go.
+	"message-tags": {},
+}
+
+// offeredCaps are the capabilities we offer the client now, with their
+// values. disabled-capabilities may leave some out.
+func (c *LocalClient) offeredCaps() map[string]string {
+	caps := map[string]string{}
+	for capab := range supportedCaps {
+		if _, disabled := c.Catbox.Config.DisabledCaps[capab]; !disabled {
+			caps[capab] = ""
+		}
+	}
+
+	// sts means nothing without its value.
+	if value := c.stsValue(); value != "" && c.CapVersion >= 302 {
+		caps["sts"] = value
+	}
+
+	return caps
+}
+
+// stsValue is the value of the sts capability for the client, if we have a
+// Strict Transport Security policy. Without TLS, it's the port to reconnect to
+// with TLS. With TLS, it's how long they should keep to using it. Blank if we
+// have no policy, or if they connected through I2P, where our ports mean
+// nothing.
+func (c *LocalClient) stsValue() string {
+	cfg := c.Catbox.Config
+	if cfg.STSDuration == 0 {
+		return ""
+	}
+	if kind := listenerKind(c.Listener); kind == "i2p" || kind == "i2p-tls" {
+		return ""
+	}
+
+	if c.isTLS() {
+		return fmt.Sprintf("duration=%d", int64(cfg.STSDuration.Seconds()))
+	}
+	return "port=" + cfg.STSPort
+}
+
+// capCommand handles CAP from a client, before or after they register. nick
+// is who we address replies to.
+//
+// Parameters: <subcommand> [<capabilities>]
+func (c *LocalClient) capCommand(m irc.Message, nick string, registered bool) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.capNumeric(nick, "461", "CAP", "Not enough parameters")
+		return
+	}
+
+	subCommand := strings.ToUpper(m.Params[0])
+	switch subCommand {
+	case "LS":
+		if !registered {
+			c.CapNegotiating = true
+		}
+		// Clients that know version 302 know cap-notify. It's on for them
+		// without asking.
+		if len(m.Params) > 1 {
+			if version, err := strconv.Atoi(m.Params[1]); err == nil &&
+				version >= 302 {
+				c.CapVersion = version
+				c.Caps["cap-notify"] = struct{}{}
+			}
+		}
+		c.AdvertisedCaps = c.offeredCaps()
+		c.capReply(nick, "LS", capList(c.AdvertisedCaps, c.CapVersion >= 302))
+	case "LIST":
+		c.capReply(nick, "LIST", sortedCaps(c.Caps))
+	case "REQ":
+		if len(m.Params) < 2 {
+			// 461 ERR_NEEDMOREPARAMS
+			c.capNumeric(nick, "461", "CAP", "Not enough parameters")
+			return
+		}
+		if !registered {
+			c.CapNegotiating = true
+		}
+		c.capRequest(nick, m.Params[1])
+	case "END":
+		if registered || !c.CapNegotiating {
+			return
+		}
+		c.CapNegotiating = false
+		if len(c.PreRegDisplayNick) > 0 && len(c.PreRegUser) > 0 {
+			c.maybeRegisterUser()
+		}
+	default:
+		// 410 ERR_INVALIDCAPCMD
+		c.capNumeric(nick, "410", subCommand, "Invalid CAP command")
+	}
+}
+
+// capRequest turns on or off the capabilities a client asked for. We change
+// all of them or none.
+func (c *LocalClient) capRequest(nick, request string) {
+	offered := c.offeredCaps()
+	fields := strings.Fields(request)
+	for _, capab := range fields {
+		// sts only tells clients about our policy. They don't turn it on.
+		name := strings.TrimPrefix(capab, "-")
+		if _, ok := offered[name]; !ok || name == "sts" {
+			c.capReply(nick, "NAK", request)
+			return
+		}
+	}
+
+	for _, capab := range fields {
+		if strings.HasPrefix(capab, "-") {
+			delete(c.Caps, capab[1:])
+			continue
+		}
+		c.Caps[capab] = struct{}{}
+	}
+	c.capReply(nick, "ACK", strings.Join(fields, " "))
+}
+
+// capReply sends a CAP reply.
+//
+// CAP <nick> <subcommand> :<capabilities>
+func (c *LocalClient) capReply(nick, subCommand, caps string) {
+	c.maybeQueueMessage(irc.Message{
+		Prefix:  c.Catbox.Config.ServerName,
+		Command: "CAP",
+		Params:  []string{nick, subCommand, caps},
+	})
+}
+
+// capNumeric sends a numeric reply to CAP. We don't use messageFromServer()
+// since the user's nick may have changed since they registered.
+func (c *LocalClient) capNumeric(nick, numeric string, params ...string) {
+	c.maybeQueueMessage(irc.Message{
+		Prefix:  c.Catbox.Config.ServerName,
+		Command: numeric,
+		Params:  append([]string{nick}, params...),
+	})
+}
+
+// hasCap checks if the client turned on the capability.
+func (c *LocalClient) hasCap(capab string) bool {
+	_, ok := c.Caps[capab]
+	return ok
+}
+
+// sortedCaps lists capabilities in order, space separated.
+func sortedCaps(caps map[string]struct{}) string {
+	var names []string
+	for capab := range caps {
+		names = append(names, capab)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// capList lists capabilities in order, space separated, with their values if
+// we show them.
+func capList(caps map[string]string, values bool) string {
+	var names []string
+	for capab, value := range caps {
+		if values && value != "" {
+			capab += "=" + value
+		}
+		names = append(names, capab)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// updateCaps tells clients with cap-notify about capabilities we started or
+// stopped offering, or whose values changed, since we told them what we offer.
+// Clients lose those we stopped offering.
+func (cb *Catbox) updateCaps() {
+	notify := func(c *LocalClient, nick string) {
+		offered := c.offeredCaps()
+		for capab := range c.Caps {
+			if _, ok := offered[capab]; !ok {
+				delete(c.Caps, capab)
+			}
+		}
+
+		added := map[string]string{}
+		for capab, value := range offered {
+			if old, ok := c.AdvertisedCaps[capab]; !ok || old != value {
+				added[capab] = value
+			}
+		}
+		removed := map[string]string{}
+		for capab := range c.AdvertisedCaps {
+			if _, ok := offered[capab]; !ok {
+				removed[capab] = ""
+			}
+		}
+		c.AdvertisedCaps = offered
+
+		if !c.hasCap("cap-notify") {
+			return
+		}
+		if len(added) > 0 {
+			c.capReply(nick, "NEW", capList(added, c.CapVersion >= 302))
+		}
+		if len(removed) > 0 {
+			c.capReply(nick, "DEL", capList(removed, false))
+		}
+	}
+
+	for _, client := range cb.LocalClients {
+		nick := "*"
+		if len(client.PreRegDisplayNick) > 0 {
+			nick = client.PreRegDisplayNick
+		}
+		notify(client, nick)
+	}
+	for _, user := range cb.LocalUsers {
+		notify(user.LocalClient, user.User.DisplayNick)
+	}
+}
+
+// inviteNotify tells the channel's local chanops who have invite-notify that
+// someone was invited. Servers pass an INVITE only toward the user invited,
+// so chanops hear about it if they're on the inviter's server, the invited
+// user's server, or one in between.
+func (cb *Catbox) inviteNotify(channel *Channel, source, target *User) {
+	for uid := range channel.Members {
+		member := cb.Users[uid]
+		if !member.isLocal() || member == source || member == target ||
+			!member.LocalUser.hasCap("invite-notify") ||
+			!channel.userHasHalfopsOrOps(member) {
+			continue
+		}
+
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  channel.sourceFor(source),
+			Command: "INVITE",
+			Params:  []string{target.DisplayNick, channel.Name},
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package terrarium
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Users negotiating capabilities register once they end negotiation. Chanops
+// with invite-notify hear about invites to their channel, whether the inviter
+// is on their server or another.
+func TestMemNetworkInviteNotify(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	ours, theirs := net.Pipe()
+	op := &memClient{conn: ours}
+	go op.readLoop()
+	a.cb.introduceClient(theirs, "")
+
+	op.send(irc.Message{Command: "CAP", Params: []string{"LS", "302"}})
+	op.send(irc.Message{Command: "NICK", Params: []string{"op"}})
+	op.send(irc.Message{Command: "USER", Params: []string{"op", "0", "*", "op"}})
+	op.send(irc.Message{Command: "CAP",
+		Params: []string{"REQ", "invite-notify server-time"}})
+	n.waitFor("the CAP NAK", func() bool {
+		m := op.lastMessage("CAP")
+		return m != nil && m.Params[1] == "NAK"
+	})
+	if m := op.lastMessage("CAP"); m.Params[2] != "invite-notify server-time" {
+		t.Errorf("CAP NAK was for %q", m.Params[2])
+	}
+
+	op.send(irc.Message{Command: "CAP", Params: []string{"REQ", "invite-notify"}})
+	n.waitFor("the CAP ACK", func() bool {
+		m := op.lastMessage("CAP")
+		return m != nil && m.Params[1] == "ACK" && m.Params[2] == "invite-notify"
+	})
+	if op.hasMessage(irc.ReplyWelcome) {
+		t.Fatalf("op registered before CAP END")
+	}
+	op.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+	n.waitFor("op to register", func() bool {
+		return op.hasMessage(irc.ReplyWelcome)
+	})
+
+	local := a.connectUser("local", "local")
+	remote := b.connectUser("remote", "remote")
+	guest := a.connectUser("guest", "guest")
+	other := b.connectUser("other", "other")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(5)
+
+	joinAll("#test", op)
+	n.waitFor("op to join", func() bool { return op.hasMessage("JOIN") })
+	joinAll("#test", local, remote)
+	n.waitFor("both JOINs to reach a", func() bool {
+		members := 0
+		a.call(func() {
+			members = len(a.cb.Channels[canonicalizeChannel("#test")].Members)
+		})
+		return members == 3
+	})
+	op.send(irc.Message{Command: "MODE",
+		Params: []string{"#test", "+oo", "local", "remote"}})
+	n.waitFor("the ops to reach b", func() bool {
+		ops := 0
+		b.call(func() {
+			ops = len(b.cb.Channels[canonicalizeChannel("#test")].Ops)
+		})
+		return ops == 3
+	})
+
+	local.send(irc.Message{Command: "INVITE", Params: []string{"guest", "#test"}})
+	n.waitFor("op to hear of the local invite", func() bool {
+		m := op.lastMessage("INVITE")
+		return m != nil && m.Params[0] == "guest" &&
+			strings.HasPrefix(m.Prefix, "local!")
+	})
+	n.waitFor("guest to be invited", func() bool {
+		return guest.hasMessage("INVITE")
+	})
+
+	remote.send(irc.Message{Command: "INVITE", Params: []string{"guest", "#test"}})
+	n.waitFor("op to hear of the remote invite", func() bool {
+		m := op.lastMessage("INVITE")
+		return m != nil && m.Params[0] == "guest" &&
+			strings.HasPrefix(m.Prefix, "remote!")
+	})
+
+	local.send(irc.Message{Command: "INVITE", Params: []string{"other", "#test"}})
+	n.waitFor("other to be invited", func() bool {
+		return other.hasMessage("INVITE")
+	})
+	if local.hasMessage("INVITE") || remote.hasMessage("INVITE") {
+		t.Errorf("chanops without invite-notify heard of an invite")
+	}
+	if m := op.lastMessage("INVITE"); m.Params[0] != "other" {
+		t.Errorf("op did not hear of the invite to other")
+	}
+}
+
+// Clients with cap-notify hear when we stop offering a capability and when we
+// offer it again.
+func TestMemNetworkCapNotify(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	ours, theirs := net.Pipe()
+	notified := &memClient{conn: ours}
+	go notified.readLoop()
+	a.cb.introduceClient(theirs, "")
+
+	notified.send(irc.Message{Command: "CAP", Params: []string{"LS", "302"}})
+	notified.send(irc.Message{Command: "CAP", Params: []string{"REQ", "invite-notify"}})
+	notified.send(irc.Message{Command: "NICK", Params: []string{"notified"}})
+	notified.send(irc.Message{Command: "USER",
+		Params: []string{"notified", "0", "*", "notified"}})
+	notified.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+	n.waitFor("notified to register", func() bool {
+		return notified.hasMessage(irc.ReplyWelcome)
+	})
+	if m := notified.lastMessage("CAP"); m.Params[1] != "ACK" ||
+		m.Params[2] != "invite-notify" {
+		t.Fatalf("CAP REQ got %v", m)
+	}
+
+	other := a.connectUser("other", "other")
+
+	setDisabled := func(caps ...string) {
+		a.call(func() {
+			cfg := *a.cb.Config
+			cfg.DisabledCaps = map[string]struct{}{}
+			for _, capab := range caps {
+				cfg.DisabledCaps[capab] = struct{}{}
+			}
+			a.cb.setConfig(&cfg)
+			a.cb.updateCaps()
+		})
+	}
+
+	setDisabled("invite-notify")
+	n.waitFor("CAP DEL", func() bool {
+		m := notified.lastMessage("CAP")
+		return m != nil && m.Params[1] == "DEL" && m.Params[2] == "invite-notify"
+	})
+
+	notified.send(irc.Message{Command: "CAP", Params: []string{"LIST"}})
+	n.waitFor("CAP LIST", func() bool {
+		m := notified.lastMessage("CAP")
+		return m != nil && m.Params[1] == "LIST"
+	})
+	if m := notified.lastMessage("CAP"); m.Params[2] != "cap-notify" {
+		t.Errorf("CAP LIST after CAP DEL was %q, wanted cap-notify", m.Params[2])
+	}
+
+	setDisabled()
+	n.waitFor("CAP NEW", func() bool {
+		m := notified.lastMessage("CAP")
+		return m != nil && m.Params[1] == "NEW" && m.Params[2] == "invite-notify"
+	})
+	if other.hasMessage("CAP") {
+		t.Errorf("client without cap-notify heard about capabilities")
+	}
+}
+
+func TestMemNetworkSTS(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	setSTS := func(port string) {
+		a.call(func() {
+			cfg := *a.cb.Config
+			cfg.STSDuration = 30 * 24 * time.Hour
+			cfg.STSPort = port
+			a.cb.setConfig(&cfg)
+			a.cb.updateCaps()
+		})
+	}
+	setSTS("6697")
+
+	capLS := func(listener string, params ...string) *memClient {
+		ours, theirs := net.Pipe()
+		c := &memClient{conn: ours}
+		go c.readLoop()
+		a.cb.introduceClient(theirs, listener)
+		c.send(irc.Message{Command: "CAP", Params: params})
+		n.waitFor("CAP LS", func() bool { return c.hasMessage("CAP") })
+		return c
+	}
+
+	tests := []struct {
+		listener string
+		params   []string
+		caps     string
+	}{
+		{"tcp/127.0.0.1:6667", []string{"LS", "302"},
+			"cap-notify invite-notify message-tags sts=port=6697"},
+		{"tcp/127.0.0.1:6667", []string{"LS"},
+			"cap-notify invite-notify message-tags"},
+		{"i2p/example.b32.i2p", []string{"LS", "302"},
+			"cap-notify invite-notify message-tags"},
+	}
+	for _, test := range tests {
+		c := capLS(test.listener, test.params...)
+		if m := c.lastMessage("CAP"); m.Params[2] != test.caps {
+			t.Errorf("CAP %v on %s got %q, wanted %q", test.params, test.listener,
+				m.Params[2], test.caps)
+		}
+	}
+
+	c := capLS("tcp/127.0.0.1:6667", "LS", "302")
+	c.send(irc.Message{Command: "CAP", Params: []string{"REQ", "sts"}})
+	n.waitFor("CAP NAK", func() bool {
+		m := c.lastMessage("CAP")
+		return m.Params[1] == "NAK" && m.Params[2] == "sts"
+	})
+
+	setSTS("7000")
+	n.waitFor("CAP NEW", func() bool {
+		m := c.lastMessage("CAP")
+		return m.Params[1] == "NEW" && m.Params[2] == "sts=port=7000"
+	})
+}
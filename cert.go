@@ -0,0 +1,219 @@
+package terrarium
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// Servers verify the certificates of servers they link to. A network may use
+// certificates from a public CA, or run its own CA: make one with
+// terrarium -gencert -gencert-new-ca, sign each server's certificate with it,
+// and give it to each server as link-ca-file.
+//
+// We check our certificate once a day. If it expires within
+// certificateWarnTime, we tell opers so they replace it before clients and
+// servers start refusing it.
+
+// certificateWarnTime is how long before our certificate expires we start
+// telling opers.
+const certificateWarnTime = 30 * 24 * time.Hour
+
+// certificateCheckInterval is how often we check when our certificate
+// expires.
+const certificateCheckInterval = 24 * time.Hour
+
+// CertificateOptions describe a certificate to generate.
+type CertificateOptions struct {
+	// Names (or IPs) it is for. The first is its common name.
+	Hostnames []string
+
+	// How long it is good for.
+	ValidFor time.Duration
+
+	// Files to write it and its key to. We don't overwrite existing files.
+	CertFile string
+	KeyFile  string
+
+	// A CA certificate and key to sign it with. If not set, it is self-signed.
+	CACertFile string
+	CAKeyFile  string
+
+	// Make a CA certificate, for signing servers' certificates, rather than a
+	// server certificate.
+	NewCA bool
+}
+
+// GenerateCertificate makes a certificate and writes it and its key, PEM
+// encoded. A server certificate is good for serving clients and for linking,
+// both ways.
+func GenerateCertificate(opts CertificateOptions) error {
+	if len(opts.Hostnames) == 0 {
+		return fmt.Errorf("no hostnames given")
+	}
+	if opts.NewCA && opts.CACertFile != "" {
+		return fmt.Errorf("a new CA can't be signed by another CA")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("unable to generate key: %s", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("unable to generate serial number: %s", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: opts.Hostnames[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(opts.ValidFor),
+		BasicConstraintsValid: true,
+	}
+
+	if opts.NewCA {
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth}
+		for _, hostname := range opts.Hostnames {
+			if ip := net.ParseIP(hostname); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+				continue
+			}
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+
+	// Self-signed unless we have a CA.
+	parent := template
+	var signer crypto.Signer = key
+	if opts.CACertFile != "" {
+		ca, err := tls.LoadX509KeyPair(opts.CACertFile, opts.CAKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load CA: %s", err)
+		}
+		parent, err = x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("unable to parse CA certificate: %s", err)
+		}
+		if !parent.IsCA {
+			return fmt.Errorf("%s is not a CA certificate", opts.CACertFile)
+		}
+		var ok bool
+		signer, ok = ca.PrivateKey.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("unable to sign with the CA's key")
+		}
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, signer)
+	if err != nil {
+		return fmt.Errorf("unable to create certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("unable to encode key: %s", err)
+	}
+
+	if err := writePEMFile(opts.KeyFile, 0600, "EC PRIVATE KEY",
+		keyDER); err != nil {
+		return err
+	}
+	if err := writePEMFile(opts.CertFile, 0644, "CERTIFICATE", der); err != nil {
+		_ = os.Remove(opts.KeyFile)
+		return err
+	}
+	return nil
+}
+
+// writePEMFile writes a PEM block to a new file.
+func writePEMFile(file string, mode os.FileMode, blockType string,
+	der []byte) error {
+	fh, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(fh, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("unable to write %s: %s", file, err)
+	}
+	return fh.Close()
+}
+
+// readCAFile reads PEM encoded CA certificates to verify servers with.
+func readCAFile(file string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// checkCertificateExpiry tells opers if our certificate expires soon. We look
+// once per certificateCheckInterval.
+func (cb *Catbox) checkCertificateExpiry() {
+	if cb.CertificateMutex == nil {
+		return
+	}
+
+	now := cb.now()
+	if !cb.CertificateCheckedAt.IsZero() &&
+		now.Sub(cb.CertificateCheckedAt) < certificateCheckInterval {
+		return
+	}
+	cb.CertificateCheckedAt = now
+
+	cb.CertificateMutex.RLock()
+	cert := cb.Certificate
+	cb.CertificateMutex.RUnlock()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+
+	left := leaf.NotAfter.Sub(now)
+	if left <= 0 {
+		cb.noticeOpers(fmt.Sprintf(
+			"TLS certificate of %s expired on %s. Replace it and REHASH.",
+			cb.Config.ServerName, leaf.NotAfter.Format(time.RFC1123)))
+		return
+	}
+	if left < certificateWarnTime {
+		cb.noticeOpers(fmt.Sprintf(
+			"TLS certificate of %s expires on %s (in %d days). Replace it and REHASH.",
+			cb.Config.ServerName, leaf.NotAfter.Format(time.RFC1123),
+			int(left.Hours()/24)))
+	}
+}
@@ -0,0 +1,135 @@
+package terrarium
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A certificate signed by a CA we made verifies against that CA.
+func TestGenerateCertificateWithCA(t *testing.T) {
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.pem")
+	caKey := filepath.Join(dir, "ca-key.pem")
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+
+	if err := GenerateCertificate(CertificateOptions{
+		Hostnames: []string{"Test CA"},
+		ValidFor:  24 * time.Hour,
+		CertFile:  caCert,
+		KeyFile:   caKey,
+		NewCA:     true,
+	}); err != nil {
+		t.Fatalf("generating the CA: %s", err)
+	}
+
+	if err := GenerateCertificate(CertificateOptions{
+		Hostnames:  []string{"irc1.example.com", "192.0.2.1"},
+		ValidFor:   365 * 24 * time.Hour,
+		CertFile:   cert,
+		KeyFile:    key,
+		CACertFile: caCert,
+		CAKeyFile:  caKey,
+	}); err != nil {
+		t.Fatalf("generating the certificate: %s", err)
+	}
+
+	pool, err := readCAFile(caCert)
+	if err != nil {
+		t.Fatalf("reading the CA: %s", err)
+	}
+
+	pair, err := readCertificate(cert, key)
+	if err != nil {
+		t.Fatalf("reading the certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing the certificate: %s", err)
+	}
+
+	for _, name := range []string{"irc1.example.com", "192.0.2.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   pool,
+		}); err != nil {
+			t.Errorf("verifying for %s: %s", name, err)
+		}
+	}
+
+	// It can't outlive the CA.
+	if leaf.NotAfter.After(time.Now().Add(25 * time.Hour)) {
+		t.Errorf("certificate expires after the CA: %s", leaf.NotAfter)
+	}
+
+	// A server certificate can't sign others.
+	if err := GenerateCertificate(CertificateOptions{
+		Hostnames:  []string{"irc2.example.com"},
+		ValidFor:   time.Hour,
+		CertFile:   filepath.Join(dir, "cert2.pem"),
+		KeyFile:    filepath.Join(dir, "key2.pem"),
+		CACertFile: cert,
+		CAKeyFile:  key,
+	}); err == nil {
+		t.Errorf("signed with a certificate that is not a CA")
+	}
+}
+
+// We tell opers when our certificate is about to expire, once a day.
+func TestMemNetworkCertificateExpiry(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	a.makeOper("alice")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    n.clock.Now().Add(-time.Hour),
+		NotAfter:     n.clock.Now().Add(10*24*time.Hour + time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+
+	a.call(func() {
+		a.cb.CertificateMutex = &sync.RWMutex{}
+		a.cb.setCertificate(&tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		})
+	})
+
+	n.advance(time.Minute)
+	n.waitFor("the expiry notice", func() bool {
+		return alice.hasMessageContaining("NOTICE",
+			"TLS certificate of a.example.com expires on")
+	})
+	if !alice.hasMessageContaining("NOTICE", "(in 10 days)") {
+		t.Errorf("we were not told how long is left")
+	}
+
+	// Not again until a day has passed.
+	alice.mutex.Lock()
+	alice.messages = nil
+	alice.mutex.Unlock()
+	n.advance(time.Minute)
+	a.call(func() {})
+	if alice.hasMessageContaining("NOTICE", "TLS certificate") {
+		t.Errorf("we were told again right away")
+	}
+}
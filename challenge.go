@@ -0,0 +1,190 @@
+package terrarium
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// We may challenge users when they connect, such as to message a code to a bot
+// or to solve a captcha on a web page. Until they pass, they may not join
+// channels. This slows down drones, which matters most when users connect
+// through an anonymity network and we can't ban them by IP.
+//
+// We don't decide who to challenge or check answers ourselves. A Challenger
+// does. Programs embedding the server may set Catbox.Challenger. Otherwise, if
+// challenge-webhook is set, we ask it (see webhookChallenger). Either way,
+// whatever checks the answer admits the user: through AdmitUser, or ADMIT on
+// the admin socket.
+
+// ChallengeInfo describes a user who just connected, for a Challenger.
+type ChallengeInfo struct {
+	UID      string `json:"uid"`
+	Nick     string `json:"nick"`
+	Username string `json:"user"`
+	Hostname string `json:"host"`
+	IP       string `json:"ip"`
+
+	// The kind of listener they connected on, such as tcp or i2p.
+	Listener string `json:"listener"`
+}
+
+// A Challenger decides whether to challenge users who connect.
+type Challenger interface {
+	// Challenge returns what to tell the user to do to pass, or "" to let them
+	// in. It runs on its own goroutine, so it may take its time. If it fails,
+	// we let the user in.
+	Challenge(info ChallengeInfo) (string, error)
+}
+
+// webhookChallenger asks a URL whether to challenge users. We POST the
+// ChallengeInfo as JSON and it answers with JSON like:
+//
+//	{"challenge": "Message the code 1234 to Gatekeeper"}
+//
+// A blank challenge, or an empty body, lets the user in.
+type webhookChallenger struct {
+	client *http.Client
+	url    string
+}
+
+// Challenge asks the webhook.
+func (w *webhookChallenger) Challenge(info ChallengeInfo) (string, error) {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	var answer struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil &&
+		err != io.EOF {
+		return "", fmt.Errorf("unable to decode answer: %s", err)
+	}
+	return answer.Challenge, nil
+}
+
+// challenger finds who decides whether to challenge users, if anyone.
+func (cb *Catbox) challenger() Challenger {
+	if cb.Challenger != nil {
+		return cb.Challenger
+	}
+	if cb.Config.ChallengeWebhook != "" {
+		return &webhookChallenger{
+			client: &http.Client{Timeout: WebhookTimeout},
+			url:    cb.Config.ChallengeWebhook,
+		}
+	}
+	return nil
+}
+
+// maybeChallenge asks whether to challenge a user who just registered. They
+// can't join channels until we know. We never challenge virtual users.
+func (cb *Catbox) maybeChallenge(u *LocalUser) {
+	challenger := cb.challenger()
+	if challenger == nil || u.isVirtual() {
+		return
+	}
+
+	u.Challenged = true
+	info := ChallengeInfo{
+		UID:      string(u.User.UID),
+		Nick:     u.User.DisplayNick,
+		Username: u.User.Username,
+		Hostname: u.User.Hostname,
+		IP:       cb.publicIP(u.User),
+		Listener: listenerKind(u.Listener),
+	}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		challenge, err := challenger.Challenge(info)
+
+		cb.newEvent(Event{
+			Type: CallEvent,
+			Func: func() {
+				// They may have left or already been admitted.
+				user, exists := cb.Users[TS6UID(info.UID)]
+				if !exists || !user.isLocal() || !user.LocalUser.Challenged {
+					return
+				}
+				if err != nil {
+					log.Printf("Unable to challenge %s: %s. Letting them in.",
+						user.DisplayNick, err)
+					cb.admitUser(user.LocalUser)
+					return
+				}
+				if challenge == "" {
+					cb.admitUser(user.LocalUser)
+					return
+				}
+				user.LocalUser.serverNotice(challenge)
+			},
+		})
+	}()
+}
+
+// admitUser lets a challenged user join channels.
+func (cb *Catbox) admitUser(u *LocalUser) {
+	if !u.Challenged {
+		return
+	}
+	u.Challenged = false
+	u.serverNotice("You may now join channels.")
+}
+
+// AdmitUser lets a user who was challenged join channels, such as once they
+// answer the challenge. The user is given by UID or nick. It returns whether
+// there was such a user waiting.
+//
+// It is safe to call from any goroutine.
+func (cb *Catbox) AdmitUser(user string) bool {
+	replyChan := make(chan bool, 1)
+	cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() { replyChan <- cb.admitUserByName(user) },
+	})
+
+	select {
+	case admitted := <-replyChan:
+		return admitted
+	case <-cb.ShutdownChan:
+		return false
+	}
+}
+
+// admitUserByName admits a challenged user given by UID or nick.
+func (cb *Catbox) admitUserByName(name string) bool {
+	user, exists := cb.Users[TS6UID(name)]
+	if !exists {
+		uid, exists := cb.Nicks[canonicalizeNick(name)]
+		if !exists {
+			return false
+		}
+		user = cb.Users[uid]
+	}
+
+	if !user.isLocal() || !user.LocalUser.Challenged {
+		return false
+	}
+	cb.admitUser(user.LocalUser)
+	return true
+}
@@ -0,0 +1,55 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// challengeFunc is a Challenger made from a function.
+type challengeFunc func(ChallengeInfo) (string, error)
+
+func (f challengeFunc) Challenge(info ChallengeInfo) (string, error) {
+	return f(info)
+}
+
+// Users we challenge may not join channels until admitted. Users we don't
+// challenge may join right away.
+func TestMemNetworkChallenge(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		a.cb.Challenger = challengeFunc(func(info ChallengeInfo) (string, error) {
+			if info.Nick == "drone" {
+				return "Message the code 1234 to Gatekeeper", nil
+			}
+			return "", nil
+		})
+	})
+
+	alice := a.connectUser("alice", "alice")
+	n.waitFor("alice to be admitted", func() bool {
+		return alice.hasMessageContaining("NOTICE", "You may now join channels")
+	})
+	alice.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	n.waitFor("alice to join", func() bool { return alice.hasMessage("JOIN") })
+
+	drone := a.connectUser("drone", "drone")
+	n.waitFor("drone to be challenged", func() bool {
+		return drone.hasMessageContaining("NOTICE", "Message the code 1234")
+	})
+	drone.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	n.waitFor("drone to be refused", func() bool {
+		return drone.hasMessage("477")
+	})
+
+	if a.cb.AdmitUser("alice") {
+		t.Errorf("admitted alice, who was not challenged")
+	}
+	if !a.cb.AdmitUser("drone") {
+		t.Fatalf("unable to admit drone")
+	}
+	drone.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	n.waitFor("drone to join", func() bool { return drone.hasMessage("JOIN") })
+}
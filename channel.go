@@ -1,6 +1,118 @@
 package terrarium
 
-import "github.com/horgh/irc"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// MaxChannelListEntries is how many masks a channel list such as the invite
+// exception list (+I) may hold.
+const MaxChannelListEntries = 100
+
+// simpleChannelModes are the channel modes we support that have no parameter.
+// Channels store them in Modes. Users and servers may set and unset any of
+// them, and we send them in bursts.
+//
+// To support a new one, add it here and check for it with hasMode() where it
+// matters.
+var simpleChannelModes = map[byte]string{
+	// Only members may send to the channel.
+	'n': "no external messages",
+	// Hidden from users not in the channel.
+	's': "secret",
+	// Users must be invited to join.
+	'i': "invite only",
+	// No colors or formatting in messages. See filterMessage().
+	'c': "no colors",
+	// No CTCPs other than ACTION. See filterMessage().
+	'C': "no CTCP",
+	// Only users logged in to an account may join.
+	'r': "registered users only",
+	// Left out of the channels export. See export.go.
+	'U': "unlisted",
+}
+
+// sjoinParamChannelModes are modes other servers may send in SJOIN and TMODE
+// that take a parameter. We keep the key and limit (see Channel.Key) but don't
+// support the others. We must know to skip their parameters all the same.
+// Mode to description.
+var sjoinParamChannelModes = map[byte]string{
+	'k': "key",
+	'l': "limit",
+	// charybdis
+	'f': "forward",
+	'j': "join throttle",
+}
+
+// sjoinUserList finds the member list in SJOIN parameters:
+// <channel TS> <channel name> <modes> [mode params] <UIDs>
+//
+// Each mode in sjoinParamChannelModes has a parameter before the member list.
+// If there are more parameters than we expect, such as for a mode we don't
+// know, we trust that the member list is last.
+func sjoinUserList(params []string) (string, error) {
+	if len(params) < 4 {
+		return "", fmt.Errorf("not enough parameters")
+	}
+
+	modeParams := 0
+	for _, mode := range params[2] {
+		if _, exists := sjoinParamChannelModes[byte(mode)]; exists {
+			modeParams++
+		}
+	}
+
+	if len(params) < 4+modeParams {
+		return "", fmt.Errorf("modes %s need %d parameters, have %d", params[2],
+			modeParams, len(params)-4)
+	}
+
+	return params[len(params)-1], nil
+}
+
+// DefaultChannelModes are the simple modes a channel starts with when a user
+// creates it.
+const DefaultChannelModes = "ns"
+
+// isSimpleChannelMode checks if we support the mode as a simple channel mode.
+func isSimpleChannelMode(mode byte) bool {
+	_, exists := simpleChannelModes[mode]
+	return exists
+}
+
+// localChannelModes are simple modes we keep to this server. We never tell
+// other servers about them. Users may set them only if the config enables
+// them. Mode to description.
+var localChannelModes = map[byte]string{
+	// Members don't see who each other are. See isAnonymous().
+	'a': "anonymous",
+}
+
+// isLocalChannelMode checks if the mode is one we keep to this server.
+func isLocalChannelMode(mode byte) bool {
+	_, exists := localChannelModes[mode]
+	return exists
+}
+
+// anonymousPrefix is who users in anonymous (+a) channels appear to be. This
+// is what RFC 2811 section 4.2.1 says to use.
+const anonymousPrefix = "anonymous!anonymous@anonymous"
+
+// supportedChannelModes returns every channel mode we support as a string, as
+// sent in RPL_MYINFO.
+func supportedChannelModes() string {
+	// Modes with parameters.
+	modes := []string{"h", "o", "v", "I"}
+	for mode := range simpleChannelModes {
+		modes = append(modes, string(mode))
+	}
+	sort.Strings(modes)
+	return strings.Join(modes, "")
+}
 
 // Channel holds everything to do with a channel.
 type Channel struct {
@@ -14,6 +126,14 @@ type Channel struct {
 	// Ops tracks users who have ops in the channel.
 	Ops map[TS6UID]*User
 
+	// Halfops tracks users who have halfops (+h) in the channel. Halfops may
+	// invite users, kick members without ops or halfops, and voice and devoice
+	// users. They may not change the channel's other modes.
+	Halfops map[TS6UID]*User
+
+	// Voiced tracks users who have voice (+v) in the channel.
+	Voiced map[TS6UID]*User
+
 	// Current topic. May be blank.
 	Topic string
 
@@ -26,9 +146,100 @@ type Channel struct {
 	// Modes set on the channel.
 	Modes map[byte]struct{}
 
+	// Invite exception masks (+I). Users matching one may join while the
+	// channel is invite only (+i). Canonicalized mask to entry.
+	InviteExceptions map[string]*ListEntry
+
 	// Channel TS. Changes on channel creation (or if another server tells us
 	// a different TS).
 	TS int64
+
+	// Simple modes services lock, such as "ns". No one but services may change
+	// them. Services tell us this with MLOCK.
+	ModeLock string
+
+	// Whether services lock the topic. No one but services may change it.
+	// Services tell us this with ENCAP TOPICLOCK.
+	TopicLocked bool
+
+	// The key (+k) and user limit (+l) other servers set. We enforce them when
+	// our users join, but our users can't set them. Limit is 0 if there is
+	// none.
+	Key   string
+	Limit int
+}
+
+// ListEntry is a mask in one of a channel's lists, such as the invite exception
+// list.
+type ListEntry struct {
+	Mask string
+
+	// Who added it. A nick!user@host or a server name.
+	Setter string
+
+	// When it was added. Unix time.
+	TS int64
+}
+
+// modeChange is a channel mode change we applied. We describe the parameter
+// differently to users and to servers. For example, for +o users see a nick
+// and servers see a UID.
+type modeChange struct {
+	action      rune
+	mode        rune
+	userParam   string
+	serverParam string
+}
+
+// formatModeChanges builds a mode string (such as +iI-o) and its parameters
+// from the changes. forServer says which form of the parameters to use.
+func formatModeChanges(changes []modeChange, forServer bool) (string,
+	[]string) {
+	modeStr := ""
+	action := ' '
+	var params []string
+
+	for _, change := range changes {
+		if change.action != action {
+			action = change.action
+			modeStr += string(action)
+		}
+		modeStr += string(change.mode)
+
+		param := change.userParam
+		if forServer {
+			param = change.serverParam
+		}
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+
+	return modeStr, params
+}
+
+// modeChangesForServer drops changes the server should not hear about. Servers
+// only know about invite exceptions (+I) if they have the IE capability, and
+// halfops (+h) if they have the HOPS capability. No server hears about local
+// modes.
+func modeChangesForServer(changes []modeChange, server *Server) []modeChange {
+	ie := server.hasCapability("IE")
+	hops := server.hasCapability("HOPS")
+
+	var kept []modeChange
+	for _, change := range changes {
+		if change.mode == 'I' && !ie {
+			continue
+		}
+		if change.mode == 'h' && !hops {
+			continue
+		}
+		if isLocalChannelMode(byte(change.mode)) {
+			continue
+		}
+		kept = append(kept, change)
+	}
+	return kept
 }
 
 // Check if a user has operator status in the channel.
@@ -37,6 +248,95 @@ func (c *Channel) userHasOps(u *User) bool {
 	return exists
 }
 
+// Check if a user has halfop status in the channel.
+func (c *Channel) userHasHalfops(u *User) bool {
+	_, exists := c.Halfops[u.UID]
+	return exists
+}
+
+// Check if a user has halfop status or better in the channel.
+func (c *Channel) userHasHalfopsOrOps(u *User) bool {
+	return c.userHasOps(u) || c.userHasHalfops(u)
+}
+
+// Check if a user has voice in the channel.
+func (c *Channel) userHasVoice(u *User) bool {
+	_, exists := c.Voiced[u.UID]
+	return exists
+}
+
+// canKick checks if the user may kick the target from the channel. Channel
+// operators may kick anyone. Halfops may kick members without ops or halfops.
+func (c *Channel) canKick(u, target *User) bool {
+	if c.userHasOps(u) {
+		return true
+	}
+	return c.userHasHalfops(u) && !c.userHasHalfopsOrOps(target)
+}
+
+// canChangeModes checks if the user may make the mode changes to the channel.
+// Channel operators may make any. Halfops may only voice and devoice.
+func (c *Channel) canChangeModes(u *User, modes string) bool {
+	if c.userHasOps(u) {
+		return true
+	}
+	return c.userHasHalfops(u) && strings.Trim(modes, "+-v") == ""
+}
+
+// memberPrefix returns the prefix for a member's statuses, as sent in NAMES
+// and WHO. We show only the highest status.
+func (c *Channel) memberPrefix(u *User) string {
+	if c.userHasOps(u) {
+		return "@"
+	}
+	if c.userHasHalfops(u) {
+		return "%"
+	}
+	if c.userHasVoice(u) {
+		return "+"
+	}
+	return ""
+}
+
+// memberPrefixes returns the prefixes for all of a member's statuses, as sent
+// in SJOIN. Halfop status is only included if halfops is true. Servers without
+// the HOPS capability don't know it.
+func (c *Channel) memberPrefixes(u *User, halfops bool) string {
+	prefixes := ""
+	if c.userHasOps(u) {
+		prefixes += "@"
+	}
+	if halfops && c.userHasHalfops(u) {
+		prefixes += "%"
+	}
+	if c.userHasVoice(u) {
+		prefixes += "+"
+	}
+	return prefixes
+}
+
+// sjoinForServer returns the SJOIN to send the server. If the server doesn't
+// have the HOPS capability we drop the halfop prefix from each member. They
+// join without it, as when we burst to it.
+func sjoinForServer(m irc.Message, server *Server) irc.Message {
+	userList := m.Params[len(m.Params)-1]
+	if server.hasCapability("HOPS") || !strings.Contains(userList, "%") {
+		return m
+	}
+
+	var members []string
+	for _, member := range strings.Fields(userList) {
+		uid := strings.TrimLeft(member, "@%+")
+		prefixes := strings.Replace(member[:len(member)-len(uid)], "%", "", -1)
+		members = append(members, prefixes+uid)
+	}
+
+	params := append([]string{}, m.Params...)
+	params[len(params)-1] = strings.Join(members, " ")
+	m.Params = params
+	return m
+}
+
 // Remove a user from the channel.
 func (c *Channel) removeUser(u *User) {
 	_, exists := c.Members[u.UID]
@@ -49,6 +349,16 @@ func (c *Channel) removeUser(u *User) {
 		delete(c.Ops, u.UID)
 	}
 
+	_, exists = c.Halfops[u.UID]
+	if exists {
+		delete(c.Halfops, u.UID)
+	}
+
+	_, exists = c.Voiced[u.UID]
+	if exists {
+		delete(c.Voiced, u.UID)
+	}
+
 	_, exists = u.Channels[c.Name]
 	if exists {
 		delete(u.Channels, c.Name)
@@ -68,7 +378,288 @@ func (c *Channel) removeOps(u *User) {
 	}
 }
 
-// Remove all modes from the channel, and all ops/voices.
+// Grant a user halfops.
+func (c *Channel) grantHalfops(u *User) {
+	c.Halfops[u.UID] = u
+}
+
+// Grant a user voice.
+func (c *Channel) grantVoice(u *User) {
+	c.Voiced[u.UID] = u
+}
+
+// applyStatusMode grants (+) or removes (-) the membership status (o, h or v)
+// from the user. It returns whether anything changed.
+func (c *Channel) applyStatusMode(action rune, mode rune, u *User) bool {
+	users := c.Ops
+	if mode == 'h' {
+		users = c.Halfops
+	}
+	if mode == 'v' {
+		users = c.Voiced
+	}
+
+	_, exists := users[u.UID]
+	if action == '+' {
+		if exists {
+			return false
+		}
+		users[u.UID] = u
+		return true
+	}
+
+	if !exists {
+		return false
+	}
+	delete(users, u.UID)
+	return true
+}
+
+// hasMode checks if the channel has the simple mode set.
+func (c *Channel) hasMode(mode byte) bool {
+	_, exists := c.Modes[mode]
+	return exists
+}
+
+// setMode sets a simple mode. It returns false if the channel already had it.
+func (c *Channel) setMode(mode byte) bool {
+	if c.hasMode(mode) {
+		return false
+	}
+	c.Modes[mode] = struct{}{}
+	return true
+}
+
+// unsetMode unsets a simple mode. It returns false if the channel did not have
+// it.
+func (c *Channel) unsetMode(mode byte) bool {
+	if !c.hasMode(mode) {
+		return false
+	}
+	delete(c.Modes, mode)
+	return true
+}
+
+// applySimpleMode sets (action +) or unsets (action -) a simple mode. It
+// returns false if this changed nothing.
+func (c *Channel) applySimpleMode(action rune, mode byte) bool {
+	if action == '+' {
+		return c.setMode(mode)
+	}
+	return c.unsetMode(mode)
+}
+
+// modesString returns the channel's simple modes (such as +ins) as a mode
+// string.
+func (c *Channel) modesString() string {
+	var modes []string
+	for mode := range c.Modes {
+		modes = append(modes, string(mode))
+	}
+	sort.Strings(modes)
+	return "+" + strings.Join(modes, "")
+}
+
+// serverModesString is like modesString but leaves out local modes. This is
+// what we tell servers.
+func (c *Channel) serverModesString() string {
+	var modes []string
+	for mode := range c.Modes {
+		if isLocalChannelMode(mode) {
+			continue
+		}
+		modes = append(modes, string(mode))
+	}
+	sort.Strings(modes)
+	return "+" + strings.Join(modes, "")
+}
+
+// sjoinModes returns the modes we tell servers about in SJOIN, followed by the
+// key and limit if we have them.
+func (c *Channel) sjoinModes() []string {
+	return c.modesWithParams(c.serverModesString())
+}
+
+// modesWithParams adds the key and limit, if we have them, to the modes. The
+// parameters follow the modes.
+func (c *Channel) modesWithParams(modes string) []string {
+	var params []string
+	if c.Key != "" {
+		modes += "k"
+		params = append(params, c.Key)
+	}
+	if c.Limit > 0 {
+		modes += "l"
+		params = append(params, strconv.Itoa(c.Limit))
+	}
+	return append([]string{modes}, params...)
+}
+
+// setModeParam records the key or limit from another server. It returns
+// false if it isn't one we keep.
+func (c *Channel) setModeParam(action rune, mode byte, param string) bool {
+	switch mode {
+	case 'k':
+		if action == '-' {
+			c.Key = ""
+			return true
+		}
+		c.Key = param
+		return true
+	case 'l':
+		if action == '-' {
+			c.Limit = 0
+			return true
+		}
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			return false
+		}
+		c.Limit = limit
+		return true
+	}
+	return false
+}
+
+// isAnonymous checks if the channel is +a. In anonymous channels we show local
+// members anonymousPrefix rather than who is talking, joining, or leaving, and
+// NAMES and WHO list only the user asking. Messages from our users don't leave
+// this server, as other servers would show who sent them.
+func (c *Channel) isAnonymous() bool {
+	return c.hasMode('a')
+}
+
+// sourceFor returns the prefix to show local members for something the user
+// did in the channel.
+func (c *Channel) sourceFor(u *User) string {
+	if c.isAnonymous() {
+		return anonymousPrefix
+	}
+	return u.nickUhost()
+}
+
+// relaySourceFor is the prefix members see on a message a relay sent as nick.
+// It has the relay's user and host so members can tell who relayed it.
+func (c *Channel) relaySourceFor(relay *User, nick string) string {
+	if c.isAnonymous() {
+		return anonymousPrefix
+	}
+	return fmt.Sprintf("%s!%s@%s", nick, relay.Username, relay.Hostname)
+}
+
+// isModeLocked checks if services lock the simple mode.
+func (c *Channel) isModeLocked(mode byte) bool {
+	return strings.IndexByte(c.ModeLock, mode) != -1
+}
+
+// setModeLock records the modes services lock. It keeps only simple modes we
+// know, sorted.
+func (c *Channel) setModeLock(modes string) {
+	locked := map[string]struct{}{}
+	for _, mode := range modes {
+		if isSimpleChannelMode(byte(mode)) {
+			locked[string(mode)] = struct{}{}
+		}
+	}
+
+	var sorted []string
+	for mode := range locked {
+		sorted = append(sorted, mode)
+	}
+	sort.Strings(sorted)
+	c.ModeLock = strings.Join(sorted, "")
+}
+
+// isInviteOnly checks if the channel is +i.
+func (c *Channel) isInviteOnly() bool {
+	return c.hasMode('i')
+}
+
+// filterMessage applies the channel's modes restricting messages to the text
+// of a PRIVMSG or NOTICE sent to it. It returns the text to deliver. If the
+// channel refuses the message, it returns the mode refusing it instead.
+func (c *Channel) filterMessage(cb *Catbox, text string) (string, byte) {
+	if c.hasMode('C') {
+		if command, ok := ctcpCommand(text); ok && command != "ACTION" {
+			return "", 'C'
+		}
+	}
+
+	if c.hasMode('c') && hasFormatting(text) {
+		if cb.Config.ChannelColorAction == ColorActionReject {
+			return "", 'c'
+		}
+		text = stripFormatting(text)
+	}
+
+	return text, 0
+}
+
+// namesFlag returns the channel's flag for RPL_NAMREPLY: @ if it is secret and
+// = if it is public.
+func (c *Channel) namesFlag() string {
+	if c.hasMode('s') {
+		return "@"
+	}
+	return "="
+}
+
+// matchesInviteException checks if the user matches one of the channel's
+// invite exception masks.
+func (c *Channel) matchesInviteException(u *User) bool {
+	uhost := canonicalizeNick(u.nickUhost())
+	for mask := range c.InviteExceptions {
+		if matchMask(mask, uhost) {
+			return true
+		}
+	}
+	return false
+}
+
+// addInviteException adds a mask to the invite exception list. The mask must
+// be canonicalized.
+//
+// It returns false if the mask is already present or the list is full.
+func (c *Channel) addInviteException(mask, setter string, ts int64) bool {
+	if _, exists := c.InviteExceptions[mask]; exists {
+		return false
+	}
+
+	if len(c.InviteExceptions) >= MaxChannelListEntries {
+		return false
+	}
+
+	c.InviteExceptions[mask] = &ListEntry{
+		Mask:   mask,
+		Setter: setter,
+		TS:     ts,
+	}
+	return true
+}
+
+// removeInviteException removes a mask from the invite exception list. The
+// mask must be canonicalized.
+//
+// It returns false if the mask was not present.
+func (c *Channel) removeInviteException(mask string) bool {
+	if _, exists := c.InviteExceptions[mask]; !exists {
+		return false
+	}
+	delete(c.InviteExceptions, mask)
+	return true
+}
+
+// sortedInviteExceptions returns the invite exception masks in order.
+func (c *Channel) sortedInviteExceptions() []string {
+	var masks []string
+	for mask := range c.InviteExceptions {
+		masks = append(masks, mask)
+	}
+	sort.Strings(masks)
+	return masks
+}
+
+// Remove all modes from the channel, and all ops/halfops/voices.
 //
 // This informs local users about the mode changes, but no one else.
 func (c *Channel) clearModes(cb *Catbox) {
@@ -77,62 +668,104 @@ func (c *Channel) clearModes(cb *Catbox) {
 
 	// Clear things like +ns
 
-	modeStr := ""
-	for k := range c.Modes {
-		delete(c.Modes, k)
-		modeStr += string(k)
-	}
-	if len(modeStr) > 0 {
+	if len(c.Modes) > 0 {
 		msgs = append(msgs, irc.Message{
 			Prefix:  cb.Config.ServerName,
 			Command: "MODE",
-			Params:  []string{c.Name, "-" + modeStr},
+			Params:  []string{c.Name, "-" + c.modesString()[1:]},
 		})
+		c.Modes = make(map[byte]struct{})
 	}
 
-	// Clear ops.
-
-	var ops []string
-	for _, op := range c.Ops {
-		ops = append(ops, op.DisplayNick)
+	// Clear the key and limit. -k takes the key.
+	if c.Key != "" {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{c.Name, "-k", c.Key},
+		})
+		c.Key = ""
+	}
+	if c.Limit > 0 {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{c.Name, "-l"},
+		})
+		c.Limit = 0
+	}
 
-		if len(ops) == ChanModesPerCommand {
-			modeStr := "-"
-			for i := 0; i < ChanModesPerCommand; i++ {
-				modeStr += "o"
-			}
+	// Clear invite exceptions.
 
-			params := []string{c.Name, modeStr}
-			params = append(params, ops...)
+	var masks []string
+	for _, mask := range c.sortedInviteExceptions() {
+		delete(c.InviteExceptions, mask)
+		masks = append(masks, mask)
 
+		if len(masks) == ChanModesPerCommand {
 			msgs = append(msgs, irc.Message{
 				Prefix:  cb.Config.ServerName,
 				Command: "MODE",
-				Params:  params,
+				Params: append([]string{c.Name,
+					"-" + strings.Repeat("I", len(masks))}, masks...),
 			})
-
-			ops = nil
+			masks = nil
 		}
 	}
 
-	if len(ops) > 0 {
-		modeStr := "-"
-		for range ops {
-			modeStr += "o"
-		}
-
-		params := []string{c.Name, modeStr}
-		params = append(params, ops...)
-
+	if len(masks) > 0 {
 		msgs = append(msgs, irc.Message{
 			Prefix:  cb.Config.ServerName,
 			Command: "MODE",
-			Params:  params,
+			Params: append([]string{c.Name,
+				"-" + strings.Repeat("I", len(masks))}, masks...),
 		})
 	}
 
+	// Clear ops, halfops and voices.
+
+	msgs = append(msgs, c.clearStatus(cb, 'o', c.Ops)...)
+	msgs = append(msgs, c.clearStatus(cb, 'h', c.Halfops)...)
+	msgs = append(msgs, c.clearStatus(cb, 'v', c.Voiced)...)
+
 	// Fire off the messages.
 	for _, msg := range msgs {
 		cb.messageLocalUsersOnChannel(c, msg)
 	}
 }
+
+// clearStatus removes a membership status (such as ops) from everyone in the
+// channel who has it. users is the map tracking the status.
+//
+// It returns the MODE messages to tell local users about the change.
+func (c *Channel) clearStatus(cb *Catbox, mode byte,
+	users map[TS6UID]*User) []irc.Message {
+	var msgs []irc.Message
+
+	var nicks []string
+	for uid, user := range users {
+		delete(users, uid)
+		nicks = append(nicks, user.DisplayNick)
+
+		if len(nicks) == ChanModesPerCommand {
+			msgs = append(msgs, irc.Message{
+				Prefix:  cb.Config.ServerName,
+				Command: "MODE",
+				Params: append([]string{c.Name,
+					"-" + strings.Repeat(string(mode), len(nicks))}, nicks...),
+			})
+			nicks = nil
+		}
+	}
+
+	if len(nicks) > 0 {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params: append([]string{c.Name,
+				"-" + strings.Repeat(string(mode), len(nicks))}, nicks...),
+		})
+	}
+
+	return msgs
+}
@@ -0,0 +1,716 @@
+package terrarium
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Channel modes can be turned off, and servers tell each other the modes a
+// channel really has when they link.
+func TestMemNetworkChannelModes(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	op := a.connectUser("op", "op")
+	outsider := a.connectUser("outsider", "outsider")
+
+	joinAll("#test", op)
+	op.send(irc.Message{Command: "MODE", Params: []string{"#test", "-n+i"}})
+	n.waitFor("modes to change", func() bool {
+		return a.channelModes("#test") == "+is"
+	})
+
+	// With -n, people outside may send to the channel.
+	outsider.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "hi"}})
+	n.waitFor("op to get the message", func() bool {
+		return op.hasMessage("PRIVMSG")
+	})
+	if outsider.hasMessage("404") {
+		t.Errorf("outsider could not send to the channel")
+	}
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+	if got := b.channelModes("#test"); got != "+is" {
+		t.Errorf("b has #test with modes %s after burst, wanted +is", got)
+	}
+
+	// Changes after the burst reach the other server too.
+	op.send(irc.Message{Command: "MODE", Params: []string{"#test", "-si"}})
+	n.waitFor("b to see the modes change", func() bool {
+		return b.channelModes("#test") == "+"
+	})
+}
+
+// Halfops may voice and devoice, and kick members without ops or halfops,
+// whichever server they are on. They may not change other modes or kick ops.
+func TestMemNetworkHalfops(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	op := a.connectUser("op", "op")
+	halfop := a.connectUser("halfop", "halfop")
+	member := b.connectUser("member", "member")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	joinAll("#test", op)
+	n.waitFor("b to see op create #test", func() bool {
+		return len(b.channelMembers("#test")) == 1
+	})
+	joinAll("#test", halfop, member)
+	n.waitFor("b to see everyone join", func() bool {
+		return len(b.channelMembers("#test")) == 3
+	})
+
+	hasStatus := func(s *memServer, nick string, mode rune) bool {
+		has := false
+		s.call(func() {
+			channel, exists := s.cb.Channels["#test"]
+			if !exists {
+				return
+			}
+			user := s.cb.Users[s.cb.Nicks[canonicalizeNick(nick)]]
+			switch mode {
+			case 'h':
+				has = channel.userHasHalfops(user)
+			case 'v':
+				has = channel.userHasVoice(user)
+			}
+		})
+		return has
+	}
+
+	op.send(irc.Message{Command: "MODE", Params: []string{"#test", "+h",
+		"halfop"}})
+	n.waitFor("b to see halfop get halfops", func() bool {
+		return hasStatus(b, "halfop", 'h')
+	})
+
+	halfop.send(irc.Message{Command: "MODE", Params: []string{"#test", "+v",
+		"member"}})
+	n.waitFor("b to see member get voice", func() bool {
+		return hasStatus(b, "member", 'v')
+	})
+	n.waitFor("member to see the voice", func() bool {
+		m := member.lastMessage("MODE")
+		return m != nil && m.Params[1] == "+v" && m.Params[2] == "member"
+	})
+
+	halfop.send(irc.Message{Command: "MODE", Params: []string{"#test", "-v",
+		"member"}})
+	n.waitFor("b to see member lose voice", func() bool {
+		return !hasStatus(b, "member", 'v')
+	})
+
+	halfop.send(irc.Message{Command: "MODE", Params: []string{"#test", "+i"}})
+	n.waitFor("halfop to be refused +i", func() bool {
+		return halfop.hasMessage("482")
+	})
+	if got := a.channelModes("#test"); got != "+ns" {
+		t.Errorf("#test has modes %s after halfop set +i, wanted +ns", got)
+	}
+
+	// The kick of op is refused. member's goes through.
+	halfop.send(irc.Message{Command: "KICK", Params: []string{"#test",
+		"op,member", "bye"}})
+	n.waitFor("member to be kicked", func() bool {
+		m := member.lastMessage("KICK")
+		return m != nil && m.Params[1] == "member" && m.Params[2] == "bye"
+	})
+	n.waitFor("b to see member leave", func() bool {
+		return len(b.channelMembers("#test")) == 2
+	})
+	if got := sortStrings(a.channelMembers("#test")); !reflect.DeepEqual(got,
+		[]string{"halfop", "op"}) {
+		t.Errorf("a has #test members %v, wanted halfop and op", got)
+	}
+
+	// Without a reason, the reason is who kicked them.
+	op.send(irc.Message{Command: "KICK", Params: []string{"#test", "halfop"}})
+	n.waitFor("halfop to be kicked", func() bool {
+		m := halfop.lastMessage("KICK")
+		return m != nil && m.Params[1] == "halfop" && m.Params[2] == "op"
+	})
+	n.waitFor("b to see halfop leave", func() bool {
+		return len(b.channelMembers("#test")) == 1
+	})
+}
+
+// Colors are stripped from messages to +c channels whichever server they come
+// from. Or, if configured, the message is refused.
+func TestMemNetworkNoColors(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	userA := a.connectUser("usera", "usera")
+	userB := b.connectUser("userb", "userb")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	joinAll("#test", userA)
+	userA.send(irc.Message{Command: "MODE", Params: []string{"#test", "+c"}})
+	n.waitFor("b to see +c", func() bool {
+		return b.channelModes("#test") == "+cns"
+	})
+	joinAll("#test", userB)
+	n.waitFor("userb to join", func() bool {
+		return len(a.channelMembers("#test")) == 2
+	})
+
+	userB.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "\x034red\x03 from b"}})
+	n.waitFor("usera to get the message", func() bool {
+		return userA.hasMessage("PRIVMSG")
+	})
+	if m := userA.lastMessage("PRIVMSG"); m.Params[1] != "red from b" {
+		t.Errorf("usera got %q, wanted the message without colors", m.Params[1])
+	}
+
+	userA.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "\x02bold\x02 from a"}})
+	n.waitFor("userb to get the message", func() bool {
+		return userB.hasMessage("PRIVMSG")
+	})
+	if m := userB.lastMessage("PRIVMSG"); m.Params[1] != "bold from a" {
+		t.Errorf("userb got %q, wanted the message without colors", m.Params[1])
+	}
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ChannelColorAction = ColorActionReject
+		a.cb.setConfig(&cfg)
+	})
+	userA.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "\x02bold\x02 again"}})
+	n.waitFor("usera to be refused", func() bool {
+		return userA.hasMessage("404")
+	})
+}
+
+// CTCPs other than ACTION don't reach +C channels. A user on another server
+// learns about +C from the TMODE and is refused by their own server.
+func TestMemNetworkNoCTCP(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	userA := a.connectUser("usera", "usera")
+	userB := n.servers["b.example.com"].connectUser("userb", "userb")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	joinAll("#test", userA)
+	userA.send(irc.Message{Command: "MODE", Params: []string{"#test", "+C"}})
+	n.waitFor("b to see +C", func() bool {
+		return n.servers["b.example.com"].channelModes("#test") == "+Cns"
+	})
+	joinAll("#test", userB)
+	n.waitFor("userb to join", func() bool {
+		return len(a.channelMembers("#test")) == 2
+	})
+
+	userB.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "\x01VERSION\x01"}})
+	n.waitFor("userb to be refused", func() bool {
+		return userB.hasMessage("404")
+	})
+
+	// ACTION is fine. Since messages arrive in order, once usera has the ACTION
+	// we know the VERSION did not get through.
+	userB.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "\x01ACTION waves\x01"}})
+	n.waitFor("usera to get the ACTION", func() bool {
+		return userA.hasMessage("PRIVMSG")
+	})
+	if m := userA.lastMessage("PRIVMSG"); m.Params[1] != "\x01ACTION waves\x01" {
+		t.Errorf("usera got %q, wanted the ACTION", m.Params[1])
+	}
+}
+
+// Only users logged in to an account may join +r channels. Servers tell each
+// other about accounts in burst, and services change them with SU.
+func TestMemNetworkRegisteredOnly(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	account := func(s *memServer, nick string) string {
+		var account string
+		s.call(func() {
+			if u := s.cb.Users[s.cb.Nicks[canonicalizeNick(nick)]]; u != nil {
+				account = u.Account
+			}
+		})
+		return account
+	}
+
+	userA := a.connectUser("usera", "usera")
+	userB := b.connectUser("userb", "userb")
+	userC := b.connectUser("userc", "userc")
+	b.call(func() {
+		b.cb.Users[b.cb.Nicks["userc"]].Account = "carol"
+	})
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	n.waitFor("a to have userc logged in to carol", func() bool {
+		return account(a, "userc") == "carol"
+	})
+
+	joinAll("#reg", userA)
+	userA.send(irc.Message{Command: "MODE", Params: []string{"#reg", "+r"}})
+	n.waitFor("b to see +r", func() bool {
+		return b.channelModes("#reg") == "+nrs"
+	})
+
+	userB.send(irc.Message{Command: "JOIN", Params: []string{"#reg"}})
+	n.waitFor("userb to be refused", func() bool {
+		return userB.hasMessage("477")
+	})
+
+	joinAll("#reg", userC)
+	n.waitFor("userc to join", func() bool {
+		return len(a.channelMembers("#reg")) == 2
+	})
+
+	// Pretend to be services logging userc out.
+	a.call(func() {
+		for _, server := range a.cb.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(a.cb.Config.TS6SID),
+				Command: "ENCAP",
+				Params:  []string{"*", "SU", string(a.cb.Nicks["userc"])},
+			})
+		}
+	})
+	n.waitFor("b to log userc out", func() bool {
+		return account(b, "userc") == ""
+	})
+}
+
+// In anonymous channels local members see each other as anonymous. Other
+// servers never hear about the mode or about messages our users send to it.
+func TestMemNetworkAnonymousChannel(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.AnonymousChannels = true
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	bob := a.connectUser("bob", "bob")
+	carol := b.connectUser("carol", "carol")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	alice.send(irc.Message{Command: "JOIN", Params: []string{"#anon"}})
+	alice.send(irc.Message{Command: "MODE", Params: []string{"#anon", "+a"}})
+	n.waitFor("#anon to be anonymous", func() bool {
+		return a.channelModes("#anon") == "+ans"
+	})
+
+	bob.send(irc.Message{Command: "JOIN", Params: []string{"#anon"}})
+	carol.send(irc.Message{Command: "JOIN", Params: []string{"#anon"}})
+	n.waitFor("everyone to join", func() bool {
+		return len(a.channelMembers("#anon")) == 3
+	})
+	// Alice sees her own JOIN, from before the channel was anonymous, and then
+	// the others'.
+	n.waitFor("alice and bob to see the JOINs", func() bool {
+		alice.mutex.Lock()
+		defer alice.mutex.Unlock()
+		joins := 0
+		for _, m := range alice.messages {
+			if m.Command == "JOIN" {
+				joins++
+			}
+		}
+		return joins == 3 && bob.hasMessage("366")
+	})
+	if m := bob.lastMessage("353"); m == nil || m.Params[len(m.Params)-1] != "bob" {
+		t.Errorf("bob's NAMES was %v, wanted only bob", m)
+	}
+	if m := alice.lastMessage("JOIN"); m.Prefix != anonymousPrefix {
+		t.Errorf("alice saw a JOIN from %s", m.Prefix)
+	}
+	if modes := b.channelModes("#anon"); modes != "+ns" {
+		t.Errorf("b has #anon modes %s, wanted +ns", modes)
+	}
+
+	bob.send(irc.Message{Command: "PRIVMSG", Params: []string{"#anon", "from bob"}})
+	n.waitFor("alice to hear bob", func() bool {
+		return alice.hasMessageContaining("PRIVMSG", "from bob")
+	})
+	if m := alice.lastMessage("PRIVMSG"); m.Prefix != anonymousPrefix {
+		t.Errorf("alice heard bob's message from %s", m.Prefix)
+	}
+
+	carol.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#anon", "from carol"}})
+	n.waitFor("alice to hear carol", func() bool {
+		return alice.hasMessageContaining("PRIVMSG", "from carol")
+	})
+	if m := alice.lastMessage("PRIVMSG"); m.Prefix != anonymousPrefix {
+		t.Errorf("alice heard carol's message from %s", m.Prefix)
+	}
+
+	alice.send(irc.Message{Command: "PRIVMSG", Params: []string{"carol", "hi"}})
+	n.waitFor("carol to hear alice", func() bool {
+		return carol.hasMessageContaining("PRIVMSG", "hi")
+	})
+	if carol.hasMessageContaining("PRIVMSG", "from bob") {
+		t.Errorf("carol heard bob's message to the anonymous channel")
+	}
+
+	// Changes to the channel don't say who made them either.
+	alice.send(irc.Message{Command: "MODE", Params: []string{"#anon", "+c"}})
+	n.waitFor("bob to see +c", func() bool {
+		return bob.hasMessageContaining("MODE", "+c")
+	})
+	if m := bob.lastMessage("MODE"); m.Prefix != anonymousPrefix {
+		t.Errorf("bob saw alice's MODE from %s", m.Prefix)
+	}
+	alice.send(irc.Message{Command: "TOPIC", Params: []string{"#anon", "leaks"}})
+	n.waitFor("bob to see the TOPIC", func() bool { return bob.hasMessage("TOPIC") })
+	if m := bob.lastMessage("TOPIC"); m.Prefix != anonymousPrefix {
+		t.Errorf("bob saw alice's TOPIC from %s", m.Prefix)
+	}
+	bob.send(irc.Message{Command: "TOPIC", Params: []string{"#anon"}})
+	n.waitFor("bob to see who set the topic", func() bool {
+		return bob.hasMessage("333")
+	})
+	if m := bob.lastMessage("333"); m.Params[2] != anonymousPrefix {
+		t.Errorf("bob saw the topic set by %s", m.Params[2])
+	}
+
+	// Nor do nick changes of those who share only anonymous channels.
+	bob.send(irc.Message{Command: "NICK", Params: []string{"bobby"}})
+	carol.send(irc.Message{Command: "NICK", Params: []string{"caroline"}})
+	n.waitFor("the nick changes", func() bool {
+		return a.userServer("bobby") != "" && a.userServer("caroline") != ""
+	})
+	alice.send(irc.Message{Command: "PING", Params: []string{"sync"}})
+	n.waitFor("alice's PONG", func() bool { return alice.hasMessage("PONG") })
+	if alice.hasMessage("NICK") {
+		t.Errorf("alice saw a nick change in an anonymous channel: %v",
+			alice.lastMessage("NICK"))
+	}
+}
+
+// NAMES lists the channels asked for, or every visible channel and the users
+// in none of them. Secret channels stay hidden from non-members.
+func TestMemNetworkNames(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	bob := a.connectUser("bob", "bob")
+	carol := b.connectUser("carol", "carol")
+	b.connectUser("dave", "dave")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(4)
+
+	carol.send(irc.Message{Command: "MODE", Params: []string{"carol", "-i"}})
+	alice.send(irc.Message{Command: "JOIN", Params: []string{"#open,#secret"}})
+	alice.send(irc.Message{Command: "MODE", Params: []string{"#open", "-s"}})
+	n.waitFor("#open to not be secret and carol to be visible", func() bool {
+		return a.channelModes("#open") == "+n" &&
+			carol.hasMessageContaining("MODE", "-i")
+	})
+
+	names := func(c *memClient, channel string) []string {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		var lists []string
+		for _, m := range c.messages {
+			if m.Command == "353" && m.Params[2] == channel {
+				lists = append(lists, m.Params[3])
+			}
+		}
+		return lists
+	}
+
+	bob.send(irc.Message{Command: "NAMES", Params: []string{"#open,#secret"}})
+	n.waitFor("bob's NAMES for both channels to end", func() bool {
+		return bob.hasMessageContaining("366", "End of NAMES") &&
+			len(names(bob, "#open")) == 1 &&
+			bob.lastMessage("366").Params[1] == "#secret"
+	})
+	if got := names(bob, "#open"); got[0] != "@alice" {
+		t.Errorf("bob saw #open as %v, wanted @alice", got)
+	}
+	if got := names(bob, "#secret"); len(got) != 0 {
+		t.Errorf("bob saw into #secret: %v", got)
+	}
+
+	bob.send(irc.Message{Command: "NAMES"})
+	n.waitFor("bob's NAMES for everything to end", func() bool {
+		return bob.lastMessage("366").Params[1] == "*"
+	})
+	if got := names(bob, "#open"); len(got) != 2 {
+		t.Errorf("bob saw #open %d times, wanted 2", len(got))
+	}
+	if got := names(bob, "*"); len(got) != 1 || got[0] != "bob carol" {
+		t.Errorf("bob saw users in no channel as %v, wanted bob carol", got)
+	}
+}
+
+// Services may lock a channel's modes and topic. Our users may not change
+// them, and we revert changes made on other servers.
+func TestMemNetworkModeLock(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com",
+		"services.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	services := n.servers["services.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ServicesServer = "services.example.com"
+		a.cb.setConfig(&cfg)
+	})
+
+	op := a.connectUser("op", "op")
+	joinAll("#test", op)
+
+	n.link("a.example.com", "services.example.com")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(1)
+
+	var channelTS string
+	a.call(func() {
+		channelTS = fmt.Sprintf("%d", a.cb.Channels["#test"].TS)
+	})
+	services.call(func() {
+		for _, server := range services.cb.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(services.cb.Config.TS6SID),
+				Command: "MLOCK",
+				Params:  []string{channelTS, "#test", "n"},
+			})
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(services.cb.Config.TS6SID),
+				Command: "ENCAP",
+				Params:  []string{"*", "TOPICLOCK", channelTS, "#test", "1"},
+			})
+		}
+	})
+	n.waitFor("b to hear the locks", func() bool {
+		locked := false
+		b.call(func() {
+			channel, exists := b.cb.Channels["#test"]
+			locked = exists && channel.ModeLock == "n" && channel.TopicLocked
+		})
+		return locked
+	})
+
+	op.send(irc.Message{Command: "MODE", Params: []string{"#test", "-n+i"}})
+	n.waitFor("op to be refused -n", func() bool { return op.hasMessage("742") })
+	n.waitFor("+i to apply", func() bool {
+		return a.channelModes("#test") == "+ins"
+	})
+
+	op.send(irc.Message{Command: "TOPIC", Params: []string{"#test", "hi"}})
+	n.waitFor("op to be refused the topic", func() bool {
+		return op.hasMessage("482")
+	})
+
+	// b doesn't refuse its users, as if it didn't know the lock. a puts the
+	// mode back.
+	b.connectUser("bob", "bob")
+	b.call(func() {
+		b.cb.Channels["#test"].unsetMode('n')
+		b.cb.Channels["#test"].unsetMode('i')
+		for _, server := range b.cb.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(b.cb.Nicks["bob"]),
+				Command: "TMODE",
+				Params:  []string{channelTS, "#test", "-ni"},
+			})
+		}
+	})
+	n.waitFor("a to take -i", func() bool {
+		return a.channelModes("#test") == "+ns"
+	})
+	n.waitFor("b to have +n again", func() bool {
+		return b.channelModes("#test") == "+ns"
+	})
+	if got := services.channelModes("#test"); got != "+ns" {
+		t.Errorf("services has #test with modes %s, wanted +ns", got)
+	}
+}
+
+// Invites expire. Users may list theirs and operators may list everyone's.
+func TestMemNetworkInviteExpiry(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.InviteExpiry = time.Minute
+		a.cb.setConfig(&cfg)
+	})
+
+	op := a.connectUser("op", "op")
+	guest := a.connectUser("guest", "guest")
+
+	joinAll("#test", op)
+	op.send(irc.Message{Command: "MODE", Params: []string{"#test", "+i"}})
+	n.waitFor("+i to apply", func() bool {
+		return a.channelModes("#test") == "+ins"
+	})
+
+	op.send(irc.Message{Command: "INVITE", Params: []string{"guest", "#test"}})
+	n.waitFor("guest to be invited", func() bool {
+		return guest.hasMessage("INVITE")
+	})
+
+	guest.send(irc.Message{Command: "INVITE"})
+	n.waitFor("guest to list invites", func() bool {
+		return guest.hasMessage("337")
+	})
+	if m := guest.lastMessage("336"); m == nil || m.Params[1] != "#test" {
+		t.Errorf("guest's invites were %v, wanted #test", m)
+	}
+
+	a.makeOper("op")
+	op.send(irc.Message{Command: "INVITES", Params: []string{"#test"}})
+	n.waitFor("op to list invites", func() bool {
+		return op.hasMessageContaining("NOTICE", "INVITES: 1 pending")
+	})
+	if !op.hasMessageContaining("NOTICE",
+		"#test guest invited by op!~op@") {
+		t.Errorf("INVITES did not show guest's invite")
+	}
+
+	n.advance(2 * time.Minute)
+	guest.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	n.waitFor("guest to be refused", func() bool {
+		return guest.hasMessage("473")
+	})
+}
+
+// We keep the key and limit other servers tell us about, enforce them, and
+// pass them on in our burst.
+func TestMemNetworkKeyAndLimit(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	c := n.servers["c.example.com"]
+
+	userA := a.connectUser("usera", "usera")
+	joinAll("#keyed", userA)
+
+	keyAndLimit := func(s *memServer) (string, int) {
+		var key string
+		var limit int
+		s.call(func() {
+			if channel, exists := s.cb.Channels["#keyed"]; exists {
+				key, limit = channel.Key, channel.Limit
+			}
+		})
+		return key, limit
+	}
+
+	// Pretend a is a server that supports +k and +l.
+	a.call(func() {
+		channel := a.cb.Channels["#keyed"]
+		channel.Key = "secret"
+		channel.Limit = 10
+	})
+
+	n.link("a.example.com", "b.example.com")
+	n.waitFor("b to learn the key and limit", func() bool {
+		key, limit := keyAndLimit(b)
+		return key == "secret" && limit == 10
+	})
+
+	n.link("b.example.com", "c.example.com")
+	n.waitFor("c to learn the key and limit from b", func() bool {
+		key, limit := keyAndLimit(c)
+		return key == "secret" && limit == 10
+	})
+
+	// c makes its users give the key.
+	userC := c.connectUser("userc", "userc")
+	userC.send(irc.Message{Command: "JOIN", Params: []string{"#keyed"}})
+	n.waitFor("userc to need the key", func() bool {
+		return userC.hasMessage("475")
+	})
+	userC.send(irc.Message{Command: "JOIN",
+		Params: []string{"#other,#keyed", "x,secret"}})
+	n.waitFor("userc to join with the key", func() bool {
+		return userC.hasMessageContaining("366", "End of NAMES list") &&
+			len(c.channelMembers("#keyed")) == 2
+	})
+
+	tmode := func(modes ...string) {
+		a.call(func() {
+			channel := a.cb.Channels["#keyed"]
+			params := append([]string{fmt.Sprintf("%d", channel.TS), channel.Name},
+				modes...)
+			for _, server := range a.cb.LocalServers {
+				server.maybeQueueMessage(irc.Message{
+					Prefix:  string(a.cb.Config.TS6SID),
+					Command: "TMODE",
+					Params:  params,
+				})
+			}
+		})
+	}
+
+	// We skip the parameters of modes we don't support, and tell our users
+	// about the limit.
+	tmode("+fjl", "#overflow", "3:5", "2")
+	n.waitFor("c to learn the new limit", func() bool {
+		key, limit := keyAndLimit(c)
+		return key == "secret" && limit == 2
+	})
+	n.waitFor("userc to hear of the limit", func() bool {
+		m := userC.lastMessage("MODE")
+		return m != nil && len(m.Params) == 3 && m.Params[1] == "+l" &&
+			m.Params[2] == "2"
+	})
+
+	userC2 := c.connectUser("userc2", "userc2")
+	userC2.send(irc.Message{Command: "JOIN", Params: []string{"#keyed",
+		"secret"}})
+	n.waitFor("the channel to be full", func() bool {
+		return userC2.hasMessage("471")
+	})
+
+	a.call(func() {
+		channel := a.cb.Channels["#keyed"]
+		for _, server := range a.cb.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(a.cb.Config.TS6SID),
+				Command: "TMODE",
+				Params: []string{fmt.Sprintf("%d", channel.TS), channel.Name, "-kl",
+					"secret"},
+			})
+		}
+	})
+	n.waitFor("c to drop the key and limit", func() bool {
+		key, limit := keyAndLimit(c)
+		return key == "" && limit == 0
+	})
+}
@@ -0,0 +1,354 @@
+package terrarium
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Scenarios that break up a network of servers in memory (see memnet_test.go)
+// and check the survivors agree on the state of the network afterwards. These
+// exercise splitting (serverSplitCleanUp) and the TS rules applied when servers
+// link again.
+
+// networkView is a server's view of the network. Servers that agree have equal
+// views.
+type networkView struct {
+	// Server names, including the server itself.
+	Servers []string
+
+	// nick@server for each user.
+	Users []string
+
+	// Name, TS, modes, and members of each channel. Ops have an @ prefix.
+	Channels []string
+}
+
+func (v networkView) String() string {
+	return fmt.Sprintf("servers: %s\nusers: %s\nchannels: %s",
+		strings.Join(v.Servers, " "), strings.Join(v.Users, " "),
+		strings.Join(v.Channels, "; "))
+}
+
+// view finds the server's view of the network.
+func (s *memServer) view() networkView {
+	var v networkView
+
+	s.call(func() {
+		cb := s.cb
+
+		v.Servers = append(v.Servers, cb.Config.ServerName)
+		for _, server := range cb.Servers {
+			v.Servers = append(v.Servers, server.Name)
+		}
+
+		for _, user := range cb.Users {
+			serverName := cb.Config.ServerName
+			if !user.isLocal() {
+				serverName = user.Server.Name
+			}
+			v.Users = append(v.Users, user.DisplayNick+"@"+serverName)
+		}
+
+		for _, channel := range cb.Channels {
+			var members []string
+			for uid := range channel.Members {
+				nick := cb.Users[uid].DisplayNick
+				if _, isOp := channel.Ops[uid]; isOp {
+					nick = "@" + nick
+				}
+				members = append(members, nick)
+			}
+			sort.Strings(members)
+
+			v.Channels = append(v.Channels, fmt.Sprintf("%s %d %s %s",
+				channel.Name, channel.TS, channel.modesString(),
+				strings.Join(members, ",")))
+		}
+	})
+
+	sort.Strings(v.Servers)
+	sort.Strings(v.Users)
+	sort.Strings(v.Channels)
+	return v
+}
+
+// waitForAgreement waits until the servers in each group of linked servers
+// agree on the state of the network. They must know exactly the servers in
+// their group, and only users on those servers.
+func (n *memNetwork) waitForAgreement() {
+	n.t.Helper()
+
+	for _, group := range n.components() {
+		var names []string
+		inGroup := map[string]struct{}{}
+		for _, s := range group {
+			names = append(names, s.cb.Config.ServerName)
+			inGroup[s.cb.Config.ServerName] = struct{}{}
+		}
+
+		var views []networkView
+		agree := func() bool {
+			views = nil
+			for _, s := range group {
+				views = append(views, s.view())
+			}
+
+			if !reflect.DeepEqual(views[0].Servers, names) {
+				return false
+			}
+
+			for _, user := range views[0].Users {
+				serverName := user[strings.Index(user, "@")+1:]
+				if _, ok := inGroup[serverName]; !ok {
+					return false
+				}
+			}
+
+			for _, v := range views[1:] {
+				if !reflect.DeepEqual(v, views[0]) {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for !agree() {
+			if time.Now().After(deadline) {
+				var b strings.Builder
+				for i, v := range views {
+					fmt.Fprintf(&b, "\n%s:\n%s", names[i], v)
+				}
+				n.t.Fatalf("servers %s do not agree:%s", strings.Join(names, " "),
+					b.String())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+// joinAll has each client join the channel.
+func joinAll(channel string, clients ...*memClient) {
+	for _, c := range clients {
+		c.send(irc.Message{Command: "JOIN", Params: []string{channel}})
+	}
+}
+
+// Sever a link while one side is still bursting to the other. Neither side
+// should keep anything from the partial burst.
+func TestChaosSplitMidBurst(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	c := n.servers["c.example.com"]
+
+	// Enough state that the burst takes a while.
+	var clients []*memClient
+	for i := 0; i < 30; i++ {
+		clients = append(clients, a.connectUser(fmt.Sprintf("a%d", i), "a"))
+	}
+	for i, client := range clients {
+		joinAll(fmt.Sprintf("#chan%d", i%5), client)
+	}
+	userC := c.connectUser("c0", "c")
+	joinAll("#chan0", userC)
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForAgreement()
+
+	n.link("b.example.com", "c.example.com")
+	n.waitFor("c to see part of the burst", func() bool {
+		return c.userServer("a0") != "" || c.userServer("a29") != ""
+	})
+	n.split("b.example.com", "c.example.com")
+
+	n.waitForAgreement()
+
+	if got := c.view().Users; !reflect.DeepEqual(got,
+		[]string{"c0@c.example.com"}) {
+		t.Errorf("c has users %v after the split, wanted only c0", got)
+	}
+
+	n.link("c.example.com", "b.example.com")
+	n.waitForAgreement()
+
+	if got := len(a.view().Users); got != 31 {
+		t.Errorf("a has %d users after relinking, wanted 31", got)
+	}
+}
+
+// Kill the hub of a network. The leaves lose everyone behind it but keep their
+// own users and channels. Then link the leaves directly.
+func TestChaosKillHub(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	c := n.servers["c.example.com"]
+
+	userA := a.connectUser("usera", "usera")
+	userB := b.connectUser("userb", "userb")
+	userC := c.connectUser("userc", "userc")
+
+	n.link("a.example.com", "b.example.com")
+	n.link("c.example.com", "b.example.com")
+	n.waitForAgreement()
+
+	joinAll("#shared", userB, userA, userC)
+	joinAll("#hub", userB)
+	n.waitFor("everyone to be in #shared", func() bool {
+		return len(a.channelMembers("#shared")) == 3 &&
+			len(c.channelMembers("#shared")) == 3
+	})
+	n.waitForAgreement()
+
+	n.kill("b.example.com")
+	n.waitForAgreement()
+
+	for _, s := range []*memServer{a, c} {
+		v := s.view()
+		if len(v.Users) != 1 {
+			t.Errorf("%s has users %v, wanted only its own",
+				s.cb.Config.ServerName, v.Users)
+		}
+		if len(v.Channels) != 1 || !strings.HasPrefix(v.Channels[0], "#shared ") {
+			t.Errorf("%s has channels %v, wanted only #shared",
+				s.cb.Config.ServerName, v.Channels)
+		}
+	}
+
+	n.link("a.example.com", "c.example.com")
+	n.waitForAgreement()
+
+	if got := a.channelMembers("#shared"); len(got) != 2 {
+		t.Errorf("#shared has members %v after relinking, wanted usera and userc",
+			got)
+	}
+}
+
+// Split and link servers at random, with users in channels on each. After
+// each change the servers in each group must agree. The seed is fixed so a
+// failure can be reproduced.
+func TestChaosRandomSplits(t *testing.T) {
+	names := []string{"a.example.com", "b.example.com", "c.example.com",
+		"d.example.com"}
+	n := newMemNetwork(t, names...)
+	rng := rand.New(rand.NewSource(1))
+
+	for i, name := range names {
+		s := n.servers[name]
+		for j := 0; j < 3; j++ {
+			client := s.connectUser(fmt.Sprintf("u%d%d", i, j), "user")
+			joinAll(fmt.Sprintf("#chan%d", rng.Intn(3)), client)
+			joinAll(fmt.Sprintf("#chan%d", rng.Intn(3)), client)
+		}
+	}
+
+	// Link everything up in a line.
+	var links [][2]string
+	for i := 1; i < len(names); i++ {
+		n.link(names[i], names[i-1])
+		links = append(links, [2]string{names[i], names[i-1]})
+	}
+	n.waitForAgreement()
+
+	for round := 0; round < 10; round++ {
+		// Break a random link.
+		idx := rng.Intn(len(links))
+		pair := links[idx]
+		links = append(links[:idx], links[idx+1:]...)
+		n.split(pair[0], pair[1])
+		n.waitForAgreement()
+
+		// Join the two groups again, choosing a server from each at random.
+		groups := n.components()
+		if len(groups) != 2 {
+			t.Fatalf("round %d: have %d groups, wanted 2", round, len(groups))
+		}
+		from := groups[0][rng.Intn(len(groups[0]))].cb.Config.ServerName
+		to := groups[1][rng.Intn(len(groups[1]))].cb.Config.ServerName
+		if rng.Intn(2) == 0 {
+			from, to = to, from
+		}
+		n.link(from, to)
+		links = append(links, [2]string{from, to})
+		n.waitForAgreement()
+	}
+
+	if got := len(n.servers["a.example.com"].view().Users); got != 12 {
+		t.Errorf("have %d users at the end, wanted 12", got)
+	}
+}
+
+// Clients connect and quit while servers link, split, and rehash, all at once.
+// This is for running with -race. CheckOwnership catches server state touched
+// from the wrong goroutine.
+func TestMemNetworkConcurrentChurn(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	c := n.servers["c.example.com"]
+
+	n.link("a.example.com", "b.example.com")
+	n.link("b.example.com", "c.example.com")
+	n.waitForConverged(0)
+
+	var wg sync.WaitGroup
+
+	for i, s := range []*memServer{a, b, c} {
+		wg.Add(1)
+		go func(i int, s *memServer) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ours, theirs := net.Pipe()
+				client := &memClient{conn: ours}
+				go client.readLoop()
+				s.cb.introduceClient(theirs, "")
+
+				nick := fmt.Sprintf("u%d_%d", i, j)
+				client.send(irc.Message{Command: "NICK", Params: []string{nick}})
+				client.send(irc.Message{Command: "USER",
+					Params: []string{"user", "0", "*", nick}})
+				client.send(irc.Message{Command: "JOIN", Params: []string{"#churn"}})
+				client.send(irc.Message{Command: "QUIT", Params: []string{"bye"}})
+			}
+		}(i, s)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 5; j++ {
+			n.split("b.example.com", "c.example.com")
+			n.link("c.example.com", "b.example.com")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 5; j++ {
+			for _, s := range []*memServer{a, b, c} {
+				s.call(func() { s.cb.rehash(nil) })
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	n.waitForConverged(0)
+	for _, s := range []*memServer{a, b, c} {
+		if got := s.channelMembers("#churn"); len(got) != 0 {
+			t.Errorf("%s has %v in #churn, wanted nobody", s.cb.config().ServerName,
+				got)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package terrarium
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Operators may log what users say, such as to meet a compliance requirement.
+// This is off unless the config turns it on. The config says which channels to
+// log (or all of them) and whether to log private messages. We write each
+// channel to a file per day, so the files rotate daily. We may also POST each
+// message to a webhook.
+//
+// We log what our users send and what they receive from other servers. Each
+// server logs for its own users.
+//
+// Writing a file or making a request could hold up the server goroutine, so
+// the chat logger goroutine does it. If it falls behind we drop messages
+// rather than wait.
+
+// ChatLogQueueSize is how many messages may wait for the chat logger.
+const ChatLogQueueSize = 1024
+
+// chatLogPrivate is the file name we log private messages under.
+const chatLogPrivate = "private"
+
+// chatLogEntry is a message to log. We send the exported fields to the webhook.
+type chatLogEntry struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Source  string    `json:"source"`
+	Target  string    `json:"target"`
+	Text    string    `json:"text"`
+
+	// Where to log it, from the config when we queued it.
+	dir     string
+	webhook string
+}
+
+// logChat logs a PRIVMSG or NOTICE if the config says to. The target is a
+// channel, or a nick for a private message. The source is who the recipients
+// see it from.
+func (cb *Catbox) logChat(command, source, target, text string) {
+	if cb.Config.ChatLogDir == "" && cb.Config.ChatLogWebhook == "" {
+		return
+	}
+
+	if target[0] == '#' {
+		_, all := cb.Config.ChatLogChannels["*"]
+		_, logged := cb.Config.ChatLogChannels[canonicalizeChannel(target)]
+		if !all && !logged {
+			return
+		}
+	} else if !cb.Config.ChatLogPrivate {
+		return
+	}
+
+	if cb.chatLogChan == nil {
+		cb.startChatLogger()
+	}
+
+	entry := chatLogEntry{
+		Time:    cb.now().UTC(),
+		Command: command,
+		Source:  source,
+		Target:  target,
+		Text:    text,
+		dir:     cb.Config.ChatLogDir,
+		webhook: cb.Config.ChatLogWebhook,
+	}
+
+	select {
+	case cb.chatLogChan <- entry:
+	default:
+		cb.ChatLogDropped++
+		log.Printf("Chat logger is behind. Dropping a message to %s.", target)
+	}
+}
+
+// startChatLogger starts the chat logger. It runs until shutdown, then logs
+// anything still queued.
+func (cb *Catbox) startChatLogger() {
+	cb.chatLogChan = make(chan chatLogEntry, ChatLogQueueSize)
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		client := &http.Client{Timeout: WebhookTimeout}
+
+		for {
+			select {
+			case entry := <-cb.chatLogChan:
+				entry.write(client)
+			case <-cb.ShutdownChan:
+				for {
+					select {
+					case entry := <-cb.chatLogChan:
+						entry.write(client)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// write logs the entry to its file and its webhook.
+func (e chatLogEntry) write(client *http.Client) {
+	if e.dir != "" {
+		if err := e.writeFile(); err != nil {
+			log.Printf("Unable to write chat log: %s", err)
+		}
+	}
+
+	if e.webhook != "" {
+		if err := postJSON(client, e.webhook, e); err != nil {
+			log.Printf("Unable to send chat log to webhook: %s", err)
+		}
+	}
+}
+
+// writeFile appends the entry to the day's file for its target.
+func (e chatLogEntry) writeFile() error {
+	name := chatLogPrivate
+	if e.Target[0] == '#' {
+		name = canonicalizeChannel(e.Target)
+	}
+	path := filepath.Join(e.dir,
+		fmt.Sprintf("%s-%s.log", name, e.Time.Format("2006-01-02")))
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s <%s> %s %s :%s\n", e.Time.Format(time.RFC3339),
+		e.Source, e.Command, e.Target, e.Text)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
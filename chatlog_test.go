@@ -0,0 +1,114 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// Messages to logged channels and private messages go to the day's file and
+// to the webhook. Others don't.
+func TestChatLog(t *testing.T) {
+	var mutex sync.Mutex
+	var posted []chatLogEntry
+	webhook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var entry chatLogEntry
+			if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+				t.Errorf("webhook got bad JSON: %s", err)
+			}
+			mutex.Lock()
+			posted = append(posted, entry)
+			mutex.Unlock()
+		}))
+	defer webhook.Close()
+
+	dir, err := ioutil.TempDir("", "terrarium-chatlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ChatLogChannels = map[string]struct{}{"#logged": {}}
+		cfg.ChatLogPrivate = true
+		cfg.ChatLogDir = dir
+		cfg.ChatLogWebhook = webhook.URL
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	bob := b.connectUser("bob", "bob")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	joinAll("#logged", alice, bob)
+	joinAll("#quiet", alice, bob)
+	n.waitFor("everyone to join", func() bool {
+		return len(a.channelMembers("#logged")) == 2 &&
+			len(a.channelMembers("#quiet")) == 2 &&
+			len(b.channelMembers("#logged")) == 2 &&
+			len(b.channelMembers("#quiet")) == 2
+	})
+
+	alice.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#quiet", "not logged"}})
+	alice.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#logged", "hello channel"}})
+	bob.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#logged", "hello back"}})
+	bob.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"alice", "hello alice"}})
+
+	n.waitFor("the webhook to get 3 messages", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(posted) == 3
+	})
+
+	mutex.Lock()
+	for _, entry := range posted {
+		if entry.Text == "not logged" {
+			t.Errorf("logged a message to #quiet")
+		}
+	}
+	mutex.Unlock()
+
+	day := a.cb.now().UTC().Format("2006-01-02")
+	channelLog, err := ioutil.ReadFile(filepath.Join(dir, "#logged-"+day+".log"))
+	if err != nil {
+		t.Fatalf("reading channel log: %s", err)
+	}
+	for _, want := range []string{
+		"<alice!~alice@localhost> PRIVMSG #logged :hello channel",
+		"<bob!~bob@localhost> PRIVMSG #logged :hello back",
+	} {
+		if !strings.Contains(string(channelLog), want) {
+			t.Errorf("channel log %q is missing %q", channelLog, want)
+		}
+	}
+
+	privateLog, err := ioutil.ReadFile(filepath.Join(dir, "private-"+day+".log"))
+	if err != nil {
+		t.Fatalf("reading private log: %s", err)
+	}
+	if !strings.Contains(string(privateLog), "PRIVMSG alice :hello alice") {
+		t.Errorf("private log %q is missing bob's message", privateLog)
+	}
+}
@@ -0,0 +1,111 @@
+package terrarium
+
+import (
+	"fmt"
+	"time"
+)
+
+// Each client gets an ID that becomes its TS6 ID (see makeTS6ID()). There are
+// 26*36**5 (1,572,120,576) TS6 IDs. Real clients get those below
+// virtualClientIDBase and virtual users the rest. Normally we never reuse an
+// ID, so a server that runs long enough would run out. We track how many we
+// have issued and tell operators as we get close. If recycle-client-ids is on,
+// we reuse the IDs of clients that left.
+
+// clientIDReuseDelay is how long we hold on to a departed client's ID before
+// we reuse it. Until then other servers may still know its UID, and its
+// reader may still tell us about it.
+const clientIDReuseDelay = 10 * time.Minute
+
+// clientIDWarnPercents are how much of the client ID space we tell operators
+// we have used, as we pass each.
+var clientIDWarnPercents = []int{75, 90, 95, 99}
+
+// freeClientID is a departed client's ID, waiting to be reused.
+type freeClientID struct {
+	id       uint64
+	released time.Time
+}
+
+// releaseClientID tells us a client left so we may reuse its ID, if
+// recycle-client-ids is on. Only the server goroutine may call this.
+func (cb *Catbox) releaseClientID(id uint64) {
+	if !cb.Config.RecycleClientIDs || id >= virtualClientIDBase {
+		return
+	}
+
+	cb.NextClientIDLock.Lock()
+	defer cb.NextClientIDLock.Unlock()
+
+	cb.freeClientIDs = append(cb.freeClientIDs,
+		freeClientID{id: id, released: cb.now()})
+}
+
+// reuseClientID takes the ID of a client that left long enough ago, if there
+// is one. Hold NextClientIDLock.
+func (cb *Catbox) reuseClientID() (uint64, bool) {
+	if len(cb.freeClientIDs) == 0 ||
+		cb.now().Sub(cb.freeClientIDs[0].released) < clientIDReuseDelay {
+		return 0, false
+	}
+
+	id := cb.freeClientIDs[0].id
+	cb.freeClientIDs = cb.freeClientIDs[1:]
+	return id, true
+}
+
+// clientIDsInUse says how many client IDs real clients have, and how many we
+// have waiting to be reused.
+func (cb *Catbox) clientIDsInUse() (uint64, int) {
+	cb.NextClientIDLock.Lock()
+	defer cb.NextClientIDLock.Unlock()
+
+	free := uint64(len(cb.freeClientIDs))
+	return cb.NextClientID - free, len(cb.freeClientIDs)
+}
+
+// clientIDReport describes how many client IDs we've used for STATS z.
+func (cb *Catbox) clientIDReport() []string {
+	used, free := cb.clientIDsInUse()
+
+	cb.NextClientIDLock.Lock()
+	virtual := cb.NextVirtualClientID
+	cb.NextClientIDLock.Unlock()
+
+	return []string{
+		fmt.Sprintf("Client IDs used %d of %d (%.2f%%), %d waiting to be reused",
+			used, uint64(virtualClientIDBase),
+			100*float64(used)/float64(virtualClientIDBase), free),
+		fmt.Sprintf("Virtual user IDs used %d of %d", virtual,
+			uint64(maxTS6IDs-virtualClientIDBase)),
+	}
+}
+
+// checkClientIDs tells operators when we pass each of clientIDWarnPercents of
+// the client ID space.
+func (cb *Catbox) checkClientIDs() {
+	used, _ := cb.clientIDsInUse()
+	percent := int(100 * used / virtualClientIDBase)
+
+	level := 0
+	for _, warnPercent := range clientIDWarnPercents {
+		if percent >= warnPercent {
+			level = warnPercent
+		}
+	}
+
+	// We may drop below a level by reusing IDs. Warn again if we pass it again.
+	if level <= cb.clientIDWarnPercent {
+		cb.clientIDWarnPercent = level
+		return
+	}
+	cb.clientIDWarnPercent = level
+
+	advice := ""
+	if !cb.Config.RecycleClientIDs {
+		advice = " Restart the server or turn on recycle-client-ids."
+	}
+	cb.noticeLocalOpers(fmt.Sprintf(
+		"Used %d%% of client IDs (%d of %d).%s", percent, used,
+		uint64(virtualClientIDBase), advice))
+}
@@ -0,0 +1,108 @@
+package terrarium
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecycleClientIDs(t *testing.T) {
+	clock := newFakeClock()
+	cb := &Catbox{
+		Config: &Config{RecycleClientIDs: true},
+		Clock:  clock,
+	}
+
+	for i := uint64(0); i < 3; i++ {
+		if id := cb.getClientID(); id != i {
+			t.Fatalf("got client ID %d, wanted %d", id, i)
+		}
+	}
+
+	cb.releaseClientID(1)
+
+	// Not until it's been long enough.
+	if id := cb.getClientID(); id != 3 {
+		t.Fatalf("got client ID %d, wanted 3", id)
+	}
+
+	clock.advance(clientIDReuseDelay)
+	if id := cb.getClientID(); id != 1 {
+		t.Fatalf("got client ID %d, wanted 1 again", id)
+	}
+	if id := cb.getClientID(); id != 4 {
+		t.Fatalf("got client ID %d, wanted 4", id)
+	}
+
+	// Virtual users' IDs we don't reuse.
+	cb.releaseClientID(virtualClientIDBase)
+	if used, free := cb.clientIDsInUse(); used != 5 || free != 0 {
+		t.Errorf("have %d client IDs used and %d free, wanted 5 and 0", used, free)
+	}
+
+	// Nor do we reuse any with recycling off.
+	cb.Config.RecycleClientIDs = false
+	cb.releaseClientID(2)
+	if used, free := cb.clientIDsInUse(); used != 5 || free != 0 {
+		t.Errorf("have %d client IDs used and %d free, wanted 5 and 0", used, free)
+	}
+}
+
+func TestCheckClientIDs(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName:    "irc.example.com",
+			TS6SID:        "000",
+			MaxNickLength: 9,
+		},
+		Clock:        newFakeClock(),
+		LocalUsers:   map[uint64]*LocalUser{},
+		Opers:        map[TS6UID]*User{},
+		Users:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		Channels:     map[string]*Channel{},
+		HostUsers:    map[string]map[uint64]*LocalUser{},
+		Strings:      newStringTable(),
+		NextClientID: virtualClientIDBase / 2,
+	}
+
+	oper := newTestLocalUser(cb, 0, "oper", "~oper", "host.example.com")
+	oper.User.Modes['o'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+
+	notices := func() []string {
+		var got []string
+		for len(oper.WriteChan) > 0 {
+			m := <-oper.WriteChan
+			got = append(got, m.Params[len(m.Params)-1])
+		}
+		return got
+	}
+
+	cb.checkClientIDs()
+	if got := notices(); len(got) != 0 {
+		t.Fatalf("got notices at 50%%: %q", got)
+	}
+
+	cb.NextClientID = virtualClientIDBase / 100 * 91
+	cb.checkClientIDs()
+	got := notices()
+	if len(got) != 1 || !strings.Contains(got[0], "Used 91% of client IDs") {
+		t.Fatalf("got notices %q at 91%%, wanted one saying so", got)
+	}
+
+	// We say so only once per level.
+	cb.checkClientIDs()
+	if got := notices(); len(got) != 0 {
+		t.Fatalf("got notices %q the second time at 91%%", got)
+	}
+
+	// Once reusing IDs takes us below a level, we say so again next time we
+	// pass it.
+	cb.NextClientID = virtualClientIDBase / 100 * 89
+	cb.checkClientIDs()
+	cb.NextClientID = virtualClientIDBase / 100 * 91
+	cb.checkClientIDs()
+	if got := notices(); len(got) != 1 {
+		t.Fatalf("got notices %q passing 90%% again, wanted one", got)
+	}
+}
@@ -0,0 +1,29 @@
+package terrarium
+
+import "time"
+
+// Clock tells the current time.
+//
+// The server asks its Clock for the time rather than calling time.Now()
+// directly. Tests substitute a clock they control so that things depending on
+// time (nick TS, ping timeouts, connect attempts) happen when they choose.
+//
+// Deadlines on connections still use the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is a Clock that uses the system's time.
+type systemClock struct{}
+
+// Now returns the current local time.
+func (systemClock) Now() time.Time { return time.Now() }
+
+// now returns the current time according to our clock. If we have no clock,
+// we use the system's.
+func (cb *Catbox) now() time.Time {
+	if cb.Clock == nil {
+		return time.Now()
+	}
+	return cb.Clock.Now()
+}
@@ -0,0 +1,146 @@
+// terrarium-ctl controls a running terrarium server through its admin socket
+// (admin-socket in the server's config).
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func main() {
+	socket := flag.String("socket", "/var/run/terrarium/admin.sock",
+		"Path to the server's admin socket")
+	timeout := flag.Duration("timeout", 30*time.Second,
+		"How long to wait for the server")
+	flag.Usage = usage
+	flag.Parse()
+
+	m, err := buildCommand(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(*socket, *timeout, m); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [options] <command>
+
+Commands:
+  status                               How the server is doing
+  users                                List every user on the network
+  history [<samples>]                  User, channel, and server counts over time
+  kline [<minutes>] <user@host> <reason>  Add a K-Line on the server
+  admit <nick or UID>                  Let a challenged user join channels
+  rehash                               Reload the server's configuration
+  stop                                 Shut the server down
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// buildCommand turns our arguments into a command for the server.
+func buildCommand(args []string) (irc.Message, error) {
+	if len(args) == 0 {
+		return irc.Message{}, fmt.Errorf("no command given")
+	}
+
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch command {
+	case "STATUS", "USERS", "REHASH", "STOP":
+		if len(args) != 0 {
+			return irc.Message{}, fmt.Errorf("%s takes no arguments",
+				strings.ToLower(command))
+		}
+		return irc.Message{Command: command}, nil
+	case "KLINE":
+		var params []string
+		if len(args) > 0 && isNumber(args[0]) {
+			params = append(params, args[0])
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			return irc.Message{}, fmt.Errorf("kline needs a user@host and a reason")
+		}
+		params = append(params, args[0], strings.Join(args[1:], " "))
+		return irc.Message{Command: command, Params: params}, nil
+	case "HISTORY":
+		if len(args) > 1 || (len(args) == 1 && !isNumber(args[0])) {
+			return irc.Message{}, fmt.Errorf("history takes a number of samples")
+		}
+		return irc.Message{Command: command, Params: args}, nil
+	case "ADMIT":
+		if len(args) != 1 {
+			return irc.Message{}, fmt.Errorf("admit needs a nick or UID")
+		}
+		return irc.Message{Command: command, Params: args}, nil
+	default:
+		return irc.Message{}, fmt.Errorf("unknown command: %s",
+			strings.ToLower(command))
+	}
+}
+
+func isNumber(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// run sends the command to the server and prints its reply.
+func run(socket string, timeout time.Duration, m irc.Message) error {
+	buf, err := m.Encode()
+	if err != nil {
+		return fmt.Errorf("unable to encode command: %s", err)
+	}
+
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write([]byte(buf)); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading the reply: %s", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "OK" {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERROR ") {
+			return fmt.Errorf("%s", strings.TrimPrefix(line, "ERROR "))
+		}
+		fmt.Println(line)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"syscall"
 
 	"i2pgit.org/idk/terrarium"
 )
@@ -18,6 +17,22 @@ func main() {
 		os.Exit(1)
 	}
 
+	if args.Init != nil {
+		if err := terrarium.InitConfig(*args.Init, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if args.GenCert != nil {
+		if err := terrarium.GenerateCertificate(*args.GenCert); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote %s and %s.", args.GenCert.CertFile,
+			args.GenCert.KeyFile)
+		return
+	}
+
 	binPath, err := filepath.Abs(os.Args[0])
 	if err != nil {
 		log.Fatalf("Unable to determine absolute path to binary: %s: %s",
@@ -29,6 +44,8 @@ func main() {
 		log.Fatal(err)
 	}
 
+	cb.ListenFDs = args.ListenFDs
+
 	if err := cb.Start(args.ListenFD); err != nil {
 		log.Fatal(err)
 	}
@@ -36,15 +53,19 @@ func main() {
 	if cb.Restart {
 		log.Printf("Shutdown completed. Restarting...")
 
-		if err := syscall.Exec( // nolint: gas
+		argv := []string{
 			binPath,
-			[]string{
-				binPath,
-				"-conf",
-				cb.ConfigFile,
-			},
-			nil,
-		); err != nil {
+			"-conf",
+			cb.ConfigFile,
+		}
+
+		// Hand our listening sockets to the new process.
+		if len(cb.RestartListenFDs) > 0 {
+			argv = append(argv, "-listen-fds",
+				terrarium.FormatListenFDs(cb.RestartListenFDs))
+		}
+
+		if err := restart(binPath, argv); err != nil {
 			log.Fatalf("Restart failed: %s", err)
 		}
 
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// restart replaces our process with a new one. It only returns if it fails.
+func restart(binPath string, argv []string) error {
+	return syscall.Exec(binPath, argv, nil) // nolint: gas
+}
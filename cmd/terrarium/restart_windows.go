@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restart starts a new process and exits. Windows can't replace a running
+// process the way exec does elsewhere. It only returns if it fails.
+func restart(binPath string, argv []string) error {
+	cmd := exec.Command(binPath, argv[1:]...) // nolint: gas
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	os.Exit(0)
+	return nil
+}
@@ -2,6 +2,10 @@ package terrarium
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -26,7 +30,17 @@ type Config struct {
 	// Description of server. This shows in WHOIS, etc.
 	ServerInfo string
 
-	MOTD string
+	// The message of the day. It may have several lines. If MOTDFile is set,
+	// it's what we read from it.
+	MOTD     string
+	MOTDFile string
+
+	// The MOTD we show operators when they OPER, and the server's rules for
+	// RULES. We read them from files. They may have several lines.
+	OperMOTD     string
+	OperMOTDFile string
+	Rules        string
+	RulesFile    string
 
 	MaxNickLength int
 
@@ -36,24 +50,275 @@ type Config struct {
 	// Period of time a client can be idle before we consider it dead.
 	DeadTime time.Duration
 
+	// Period of time a client has to finish sending a line once it starts
+	// sending it.
+	LineTime time.Duration
+
+	// Period of time a client has to register as a user or server.
+	RegistrationTime time.Duration
+
 	// Time to wait between attempts connecting to servers (minimum).
 	ConnectAttemptTime time.Duration
 
+	// If a server delinks from us LinkFlapLimit times within LinkFlapWindow,
+	// we stop connecting to it automatically for LinkFlapSuspendTime. 0 means
+	// no limit.
+	LinkFlapLimit       int
+	LinkFlapWindow      time.Duration
+	LinkFlapSuspendTime time.Duration
+
+	// Servers may be at most this many hops from us. 0 means no limit.
+	MaxHopCount int
+
+	// How long after a server splits we refuse it if it links through a
+	// different server. 0 to not. See relink.go.
+	RelinkGraceTime time.Duration
+
+	// How many different users a user may message in TargetChangeTime. 0 means
+	// no limit. CPRIVMSG and CNOTICE don't count.
+	MaxTargets       int
+	TargetChangeTime time.Duration
+
+	// How many unknown commands a user may send in a minute before we stop
+	// replying to them. 0 means no limit.
+	UnknownCommandLimit int
+
+	// Commands we don't know that we accept and do nothing with, such as those
+	// meant for bouncers. Uppercase.
+	IgnoreCommands map[string]struct{}
+
+	// How long an invite lets a user join an invite only channel. 0 means
+	// until they join.
+	InviteExpiry time.Duration
+
+	// Nick masks our users may not take, such as those services use. They're
+	// canonicalized.
+	ResvNicks []string
+
+	// How long we hold the nicks of users lost in a netsplit. 0 means we don't.
+	NickDelay time.Duration
+
+	// What to do when a client asks for a nick in use before registering.
+	// NickInUseReject, NickInUseSuggest, or NickInUseGuest.
+	NickInUseAction string
+
 	// TS6 SID. Must be unique in the network. Format: [0-9][A-Z0-9]{2}
 	TS6SID TS6SID
 
-	AdminEmail string
+	// Who runs the server, for ADMIN. AdminEmail also shows in some errors.
+	AdminLocation string
+	AdminName     string
+	AdminEmail    string
 
 	// Oper name to password.
 	Opers map[string]string
 
+	// Oper name to the privileges it grants beyond being an operator. See
+	// operPrivileges.
+	OperPrivileges map[string]map[string]struct{}
+
 	// Server name to its link information.
 	Servers map[string]*ServerDefinition
 
+	// Whether we never link with other servers. We don't connect to servers and
+	// no one may register as one. Otherwise we run as we would with no links.
+	// Changing it needs a restart.
+	Standalone bool
+
+	// Local address to bind when we connect to servers. host or host:port. A
+	// server's link information may override this.
+	LinkBindAddress string
+
+	// Network interface to connect to servers from. We bind to one of its
+	// addresses. A server's link information may override this.
+	LinkBindInterface string
+
+	// How long to wait for each address of a server we connect to to answer.
+	LinkConnectTimeout time.Duration
+
+	// Whether to try a server's IPv4 addresses before its IPv6 ones.
+	LinkPreferIPv4 bool
+
+	// How long to wait for an address of a server to answer before we start
+	// trying the next as well.
+	LinkFallbackDelay time.Duration
+
+	// File with CA certificates (PEM encoded) to verify servers we link to
+	// with, rather than the system's. Blank to use the system's.
+	LinkCAFile string
+
 	// User configuration info.
 	UserConfigs []UserConfig
+
+	// Web gateways that may tell us where their users connect from with
+	// WEBIRC.
+	WebIRCGateways []WebIRCGateway
+
+	// If set, the user and group to switch to once we have opened our listeners
+	// and read our certificate. This is so we can start as root to bind low
+	// ports.
+	RunAsUser  string
+	RunAsGroup string
+
+	// If set, a directory to chroot to when we drop privileges.
+	Chroot string
+
+	// What to do with colored messages sent to channels that are +c. Either
+	// ColorActionStrip or ColorActionReject.
+	ChannelColorAction string
+
+	// Whether channel operators may make their channels anonymous (+a). See
+	// Channel.isAnonymous().
+	AnonymousChannels bool
+
+	// User modes we set on users when they register, such as "i".
+	// DefaultUserModesByKind overrides it for a kind of listener. A user config
+	// may override both.
+	DefaultUserModes       string
+	DefaultUserModesByKind map[string]string
+
+	// Text of messages we send users. Message name to text. See messages.go.
+	Messages map[string]string
+
+	// Translations of the messages. Language code to message name to text.
+	// Each has every message. Those not translated are as in Messages.
+	Languages map[string]map[string]string
+
+	// The language we send messages in to users who didn't choose one with
+	// LANGUAGE. English is "en", which is Messages.
+	Language string
+
+	// Settings about the network as a whole. These should be the same on every
+	// server.
+	//
+	// The network's name. We advertise it in ISUPPORT. Messages may use it.
+	NetworkName string
+
+	// A description of the network. Messages may use it.
+	NetworkDescription string
+
+	// Hostnames we cloak end with this.
+	CloakSuffix string
+
+	// The name of the services server. Only it may log users in to accounts, and
+	// we count its users as services.
+	ServicesServer string
+
+	// If a K-Line an oper sets matches more users than this, they must force
+	// it. 0 means no limit.
+	KLineForceThreshold int
+
+	// How much we reveal about where users connect from. PrivacyProfileDefault
+	// or PrivacyProfileAnonymous.
+	PrivacyProfile string
+
+	// Chat logging. See chatlog.go.
+	//
+	// Channels (canonicalized) whose messages we log. * means all of them.
+	ChatLogChannels map[string]struct{}
+
+	// Whether we log private messages.
+	ChatLogPrivate bool
+
+	// Directory to write chat logs to. Blank to not write them.
+	ChatLogDir string
+
+	// URL to POST each logged message to. Blank to not.
+	ChatLogWebhook string
+
+	// URL to POST server events to, such as users connecting. Blank to not. See
+	// events.go.
+	EventWebhook string
+
+	// URL to ask whether to challenge users who connect. Blank to not. See
+	// challenge.go.
+	ChallengeWebhook string
+
+	// The bridge for posting to channels over HTTP. See bridge.go.
+	//
+	// Address to listen for HTTP on (host:port). Blank to not.
+	BridgeListen string
+
+	// Token requests must give as a bearer token.
+	BridgeToken string
+
+	// Nick of the user the bridge posts as.
+	BridgeNick string
+
+	// Path of the Unix socket tools such as terrarium-ctl use to control us.
+	// Blank to not listen on one. See admin.go.
+	AdminSocket string
+
+	// File to write statistics about public channels to every
+	// ChannelsExportInterval. Blank to not. See export.go.
+	ChannelsExportFile     string
+	ChannelsExportInterval time.Duration
+
+	// File to keep the notices each operator chose to get in. Blank to keep
+	// them only while we run. See notices.go.
+	OperNoticesFile string
+
+	// Capabilities we don't offer clients. See cap.go.
+	DisabledCaps map[string]struct{}
+
+	// Our Strict Transport Security policy: how long clients should keep to
+	// connecting with TLS, and the port to connect to. No policy if the
+	// duration is 0.
+	STSDuration time.Duration
+	STSPort     string
+
+	// Channels (canonicalized) the bridge may post to. * means all of them.
+	BridgeChannels map[string]struct{}
+
+	// Prefixes and suffixes users connecting on each kind of listener must have
+	// in their nicks, such as |i2p for users coming through I2P. Listener kind
+	// to prefix or suffix.
+	NickPrefixes map[string]string
+	NickSuffixes map[string]string
+
+	// Password users must give with PASS to connect, if any. ClientPasswords
+	// overrides it for a kind of listener. A matching users.conf entry with a
+	// password overrides both.
+	ClientPassword  string
+	ClientPasswords map[string]string
+
+	// Kinds of listener whose clients we register as guests as soon as they
+	// connect. See guest.go.
+	GuestListeners map[string]bool
+
+	// Whether users must answer a PING with a random cookie before they may
+	// register.
+	PingCookie bool
+
+	// Whether we reuse the client IDs (and so the UIDs) of clients that left.
+	// See clientid.go.
+	RecycleClientIDs bool
+
+	// Whether we check the hostnames, IPs, and nick!user@host strings servers
+	// send us, and delink them if they're invalid. See strict.go.
+	StrictLinks bool
 }
 
+// What to do with colored messages sent to +c channels.
+const (
+	// Remove the colors and formatting and deliver the rest.
+	ColorActionStrip = "strip"
+
+	// Refuse the message.
+	ColorActionReject = "reject"
+)
+
+// How much we reveal about where users connect from.
+const (
+	// Look up hostnames and show IPs.
+	PrivacyProfileDefault = "default"
+
+	// For anonymity networks such as I2P and Tor. We don't look up hostnames,
+	// we cloak every host, we send other servers 0 as the IP, and we show
+	// addresses only to operators with the admin privilege.
+	PrivacyProfileAnonymous = "anonymous"
+)
+
 // ServerDefinition defines how to link to a server.
 type ServerDefinition struct {
 	Name     string
@@ -61,6 +326,24 @@ type ServerDefinition struct {
 	Port     int
 	Pass     string
 	TLS      bool
+
+	// Whether to find the server's addresses and ports with SRV records rather
+	// than use Hostname and Port. If so, Port is 0.
+	SRV bool
+
+	// Optional. Local address (host or host:port) and network interface to use
+	// when we connect to the server. These override the global settings.
+	BindAddress   string
+	BindInterface string
+
+	// Whether the server is an observer. It gets our burst and everything we
+	// propagate, but it may not introduce users, servers, or channels, or
+	// change anything on the network. For logging or monitoring nodes.
+	Observer bool
+
+	// Whether we don't trust the server to act on the rest of the network, such
+	// as to kill our users. See trust.go.
+	Untrusted bool
 }
 
 // UserConfig defines settings about users. Matched by usermask and hostmask.
@@ -75,6 +358,17 @@ type UserConfig struct {
 
 	// If non-blank, a spoof to set instead of their host.
 	Spoof string
+
+	// If set, the user modes to set at registration instead of the default.
+	UserModes    string
+	HasUserModes bool
+
+	// Whether they may relay messages for users of another network with
+	// RELAYMSG.
+	Relay bool
+
+	// If non-blank, the password they must give with PASS to connect.
+	Password string
 }
 
 // checkAndParseConfig checks configuration keys are present and in an
@@ -143,6 +437,29 @@ func checkAndParseConfig(file string) (*Config, error) {
 	if m["motd"] != "" {
 		c.MOTD = m["motd"]
 	}
+	if m["motd-file"] != "" {
+		c.MOTDFile = m["motd-file"]
+		c.MOTD, err = readTextFile("MOTD", c.MOTDFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m["oper-motd-file"] != "" {
+		c.OperMOTDFile = m["oper-motd-file"]
+		c.OperMOTD, err = readTextFile("oper MOTD", c.OperMOTDFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m["rules-file"] != "" {
+		c.RulesFile = m["rules-file"]
+		c.Rules, err = readTextFile("rules", c.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	c.MaxNickLength = 9
 	if m["max-nick-length"] != "" {
@@ -169,6 +486,23 @@ func checkAndParseConfig(file string) (*Config, error) {
 		}
 	}
 
+	c.LineTime = 30 * time.Second
+	if m["line-time"] != "" {
+		c.LineTime, err = time.ParseDuration(m["line-time"])
+		if err != nil {
+			return nil, fmt.Errorf("line time is in invalid format: %s", err)
+		}
+	}
+
+	c.RegistrationTime = 60 * time.Second
+	if m["registration-time"] != "" {
+		c.RegistrationTime, err = time.ParseDuration(m["registration-time"])
+		if err != nil {
+			return nil, fmt.Errorf("registration time is in invalid format: %s",
+				err)
+		}
+	}
+
 	c.ConnectAttemptTime = 60 * time.Second
 	if m["connect-attempt-time"] != "" {
 		c.ConnectAttemptTime, err = time.ParseDuration(m["connect-attempt-time"])
@@ -178,22 +512,199 @@ func checkAndParseConfig(file string) (*Config, error) {
 		}
 	}
 
+	c.LinkFlapLimit = 3
+	if m["link-flap-limit"] != "" {
+		limit, err := strconv.Atoi(m["link-flap-limit"])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("link flap limit is not valid: %s",
+				m["link-flap-limit"])
+		}
+		c.LinkFlapLimit = limit
+	}
+
+	c.LinkFlapWindow = 10 * time.Minute
+	if m["link-flap-window"] != "" {
+		c.LinkFlapWindow, err = time.ParseDuration(m["link-flap-window"])
+		if err != nil {
+			return nil, fmt.Errorf("link flap window is in invalid format: %s", err)
+		}
+	}
+
+	c.LinkFlapSuspendTime = 30 * time.Minute
+	if m["link-flap-suspend-time"] != "" {
+		c.LinkFlapSuspendTime, err = time.ParseDuration(
+			m["link-flap-suspend-time"])
+		if err != nil {
+			return nil, fmt.Errorf("link flap suspend time is in invalid format: %s",
+				err)
+		}
+	}
+
+	if m["max-hop-count"] != "" {
+		maxHopCount, err := strconv.Atoi(m["max-hop-count"])
+		if err != nil || maxHopCount < 0 {
+			return nil, fmt.Errorf("max hop count is not valid: %s",
+				m["max-hop-count"])
+		}
+		c.MaxHopCount = maxHopCount
+	}
+
+	if m["relink-grace-time"] != "" {
+		c.RelinkGraceTime, err = time.ParseDuration(m["relink-grace-time"])
+		if err != nil {
+			return nil, fmt.Errorf("relink grace time is in invalid format: %s",
+				err)
+		}
+	}
+
+	c.MaxTargets = 10
+	if m["max-targets"] != "" {
+		maxTargets, err := strconv.Atoi(m["max-targets"])
+		if err != nil || maxTargets < 0 {
+			return nil, fmt.Errorf("max targets is not valid: %s", m["max-targets"])
+		}
+		c.MaxTargets = maxTargets
+	}
+
+	c.TargetChangeTime = 60 * time.Second
+	if m["target-change-time"] != "" {
+		c.TargetChangeTime, err = time.ParseDuration(m["target-change-time"])
+		if err != nil {
+			return nil, fmt.Errorf("target change time is in invalid format: %s",
+				err)
+		}
+	}
+
+	c.UnknownCommandLimit = 10
+	if m["unknown-command-limit"] != "" {
+		limit, err := strconv.Atoi(m["unknown-command-limit"])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("unknown command limit is not valid: %s",
+				m["unknown-command-limit"])
+		}
+		c.UnknownCommandLimit = limit
+	}
+
+	c.IgnoreCommands = map[string]struct{}{}
+	if m["ignore-commands"] != "" {
+		for _, command := range strings.Split(m["ignore-commands"], ",") {
+			command = strings.ToUpper(strings.TrimSpace(command))
+			if command == "" {
+				continue
+			}
+			c.IgnoreCommands[command] = struct{}{}
+		}
+	}
+
+	c.InviteExpiry = time.Hour
+	if m["invite-expiry"] != "" {
+		c.InviteExpiry, err = time.ParseDuration(m["invite-expiry"])
+		if err != nil || c.InviteExpiry < 0 {
+			return nil, fmt.Errorf("invite expiry is in invalid format: %s",
+				m["invite-expiry"])
+		}
+	}
+
+	if m["resv-nicks"] != "" {
+		c.ResvNicks, err = parseResvNicks(m["resv-nicks"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m["nick-delay"] != "" {
+		c.NickDelay, err = time.ParseDuration(m["nick-delay"])
+		if err != nil || c.NickDelay < 0 {
+			return nil, fmt.Errorf("nick delay is in invalid format: %s",
+				m["nick-delay"])
+		}
+	}
+
+	c.NickInUseAction = NickInUseReject
+	if m["nick-in-use-action"] != "" {
+		if m["nick-in-use-action"] != NickInUseReject &&
+			m["nick-in-use-action"] != NickInUseSuggest &&
+			m["nick-in-use-action"] != NickInUseGuest {
+			return nil, fmt.Errorf("nick in use action must be %s, %s, or %s",
+				NickInUseReject, NickInUseSuggest, NickInUseGuest)
+		}
+		c.NickInUseAction = m["nick-in-use-action"]
+	}
+
+	if m["link-bind-address"] != "" {
+		if err := checkBindAddress(m["link-bind-address"]); err != nil {
+			return nil, fmt.Errorf("link bind address is invalid: %s", err)
+		}
+		c.LinkBindAddress = m["link-bind-address"]
+	}
+
+	if m["link-bind-interface"] != "" {
+		c.LinkBindInterface = m["link-bind-interface"]
+	}
+
+	c.LinkConnectTimeout = 30 * time.Second
+	if m["link-connect-timeout"] != "" {
+		c.LinkConnectTimeout, err = time.ParseDuration(m["link-connect-timeout"])
+		if err != nil {
+			return nil, fmt.Errorf("link connect timeout is in invalid format: %s",
+				err)
+		}
+		if c.LinkConnectTimeout <= 0 {
+			return nil, fmt.Errorf("link connect timeout must be positive")
+		}
+	}
+
+	c.LinkPreferIPv4 = m["link-prefer-ipv4"] == "1"
+
+	c.LinkFallbackDelay = 300 * time.Millisecond
+	if m["link-fallback-delay"] != "" {
+		c.LinkFallbackDelay, err = time.ParseDuration(m["link-fallback-delay"])
+		if err != nil {
+			return nil, fmt.Errorf("link fallback delay is in invalid format: %s",
+				err)
+		}
+		if c.LinkFallbackDelay <= 0 {
+			return nil, fmt.Errorf("link fallback delay must be positive")
+		}
+	}
+
+	if m["link-ca-file"] != "" {
+		if _, err := readCAFile(m["link-ca-file"]); err != nil {
+			return nil, fmt.Errorf("unable to read link CA file: %s", err)
+		}
+		c.LinkCAFile = m["link-ca-file"]
+	}
+
 	// opers.conf.
 
+	c.Opers = map[string]string{}
+	c.OperPrivileges = map[string]map[string]struct{}{}
+
 	if m["opers-config"] != "" {
 		opers, err := config.ReadStringMap(m["opers-config"])
 		if err != nil {
 			return nil, fmt.Errorf("unable to load opers config: %s", err)
 		}
-		c.Opers = opers
-	} else {
-		c.Opers = map[string]string{}
+
+		for name, value := range opers {
+			pass, privileges, err := parseOperConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse oper config %s: %s", name, err)
+			}
+			c.Opers[name] = pass
+			c.OperPrivileges[name] = privileges
+		}
 	}
 
 	// servers.conf.
 
 	c.Servers = make(map[string]*ServerDefinition)
 
+	c.Standalone = m["standalone"] == "1"
+	if c.Standalone && m["servers-config"] != "" {
+		return nil, fmt.Errorf("standalone servers can't have a servers-config")
+	}
+
 	if m["servers-config"] != "" {
 		servers, err := config.ReadStringMap(m["servers-config"])
 		if err != nil {
@@ -228,6 +739,79 @@ func checkAndParseConfig(file string) (*Config, error) {
 		}
 	}
 
+	// webirc.conf.
+
+	if m["webirc-config"] != "" {
+		gateways, err := config.ReadStringMap(m["webirc-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load webirc config: %s", err)
+		}
+
+		for name, value := range gateways {
+			gateway, err := parseWebIRCGateway(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse webirc gateway %s: %s", name,
+					err)
+			}
+			c.WebIRCGateways = append(c.WebIRCGateways, gateway)
+		}
+	}
+
+	if m["network-name"] != "" {
+		if strings.ContainsAny(m["network-name"], " ,=") {
+			return nil, fmt.Errorf("network name may not contain spaces, commas, or =")
+		}
+		c.NetworkName = m["network-name"]
+	}
+
+	c.NetworkDescription = m["network-description"]
+
+	if m["network-cloak-suffix"] != "" {
+		if !isValidHostname(m["network-cloak-suffix"]) {
+			return nil, fmt.Errorf("invalid network cloak suffix")
+		}
+		c.CloakSuffix = m["network-cloak-suffix"]
+	}
+
+	if m["network-services-server"] != "" {
+		if !isValidHostname(m["network-services-server"]) {
+			return nil, fmt.Errorf("invalid network services server")
+		}
+		c.ServicesServer = m["network-services-server"]
+	}
+
+	// messages.conf.
+
+	messages := map[string]string{}
+	if m["messages-config"] != "" {
+		messages, err = config.ReadStringMap(m["messages-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load messages config: %s", err)
+		}
+	}
+	c.Messages, err = parseMessages(messages)
+	if err != nil {
+		return nil, fmt.Errorf("messages config: %s", err)
+	}
+
+	c.Languages = map[string]map[string]string{}
+	if m["languages-dir"] != "" {
+		c.Languages, err = loadLanguages(m["languages-dir"], c.Messages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.Language = "en"
+	if m["language"] != "" {
+		if _, exists := c.Languages[m["language"]]; !exists &&
+			m["language"] != "en" {
+			return nil, fmt.Errorf("language %s is not in languages-dir",
+				m["language"])
+		}
+		c.Language = m["language"]
+	}
+
 	c.TS6SID = TS6SID("000")
 
 	if m["ts6-sid"] != "" {
@@ -237,17 +821,297 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.TS6SID = TS6SID(m["ts6-sid"])
 	}
 
+	c.AdminLocation = m["admin-location"]
+	c.AdminName = m["admin-name"]
 	c.AdminEmail = m["admin-email"]
 
+	c.RunAsUser = m["user"]
+	c.RunAsGroup = m["group"]
+
+	if m["chroot"] != "" {
+		if !filepath.IsAbs(m["chroot"]) {
+			return nil, fmt.Errorf("chroot must be an absolute path")
+		}
+		c.Chroot = m["chroot"]
+	}
+
+	c.ChannelColorAction = ColorActionStrip
+	if m["channel-color-action"] != "" {
+		if m["channel-color-action"] != ColorActionStrip &&
+			m["channel-color-action"] != ColorActionReject {
+			return nil, fmt.Errorf("channel color action must be %s or %s",
+				ColorActionStrip, ColorActionReject)
+		}
+		c.ChannelColorAction = m["channel-color-action"]
+	}
+
+	if m["anonymous-channels"] != "" {
+		if m["anonymous-channels"] != "1" && m["anonymous-channels"] != "0" {
+			return nil, fmt.Errorf("anonymous channels must be 1 or 0")
+		}
+		c.AnonymousChannels = m["anonymous-channels"] == "1"
+	}
+
+	c.DefaultUserModes = "ip"
+	if modes, exists := m["default-user-modes"]; exists {
+		c.DefaultUserModes, err = parseRegistrationUserModes(modes)
+		if err != nil {
+			return nil, fmt.Errorf("default user modes: %s", err)
+		}
+	}
+	c.DefaultUserModesByKind = map[string]string{}
+	for _, kind := range listenerKinds {
+		modes, exists := m["default-user-modes-"+kind]
+		if !exists {
+			continue
+		}
+		c.DefaultUserModesByKind[kind], err = parseRegistrationUserModes(modes)
+		if err != nil {
+			return nil, fmt.Errorf("default user modes for %s: %s", kind, err)
+		}
+	}
+
+	c.KLineForceThreshold = 50
+	if m["kline-force-threshold"] != "" {
+		threshold, err := strconv.ParseInt(m["kline-force-threshold"], 10, 32)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("kline force threshold is not valid")
+		}
+		c.KLineForceThreshold = int(threshold)
+	}
+
+	c.ChatLogChannels = map[string]struct{}{}
+	if m["chat-log-channels"] != "" {
+		for _, name := range strings.Split(m["chat-log-channels"], ",") {
+			name = canonicalizeChannel(strings.TrimSpace(name))
+			if name != "*" && !isValidChannel(name) {
+				return nil, fmt.Errorf("invalid chat log channel: %s", name)
+			}
+			c.ChatLogChannels[name] = struct{}{}
+		}
+	}
+
+	if m["chat-log-private"] != "" {
+		if m["chat-log-private"] != "1" && m["chat-log-private"] != "0" {
+			return nil, fmt.Errorf("chat log private must be 1 or 0")
+		}
+		c.ChatLogPrivate = m["chat-log-private"] == "1"
+	}
+
+	if m["chat-log-dir"] != "" {
+		if !filepath.IsAbs(m["chat-log-dir"]) {
+			return nil, fmt.Errorf("chat log dir must be an absolute path")
+		}
+		c.ChatLogDir = m["chat-log-dir"]
+	}
+
+	if m["chat-log-webhook"] != "" {
+		u, err := url.Parse(m["chat-log-webhook"])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("chat log webhook must be an http or https URL")
+		}
+		c.ChatLogWebhook = m["chat-log-webhook"]
+	}
+
+	if m["event-webhook"] != "" {
+		u, err := url.Parse(m["event-webhook"])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("event webhook must be an http or https URL")
+		}
+		c.EventWebhook = m["event-webhook"]
+	}
+
+	if m["challenge-webhook"] != "" {
+		u, err := url.Parse(m["challenge-webhook"])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("challenge webhook must be an http or https URL")
+		}
+		c.ChallengeWebhook = m["challenge-webhook"]
+	}
+
+	if m["bridge-listen"] != "" {
+		if _, _, err := net.SplitHostPort(m["bridge-listen"]); err != nil {
+			return nil, fmt.Errorf("bridge listen must be host:port: %s", err)
+		}
+		if m["bridge-token"] == "" {
+			return nil, fmt.Errorf("bridge token must be set to use the bridge")
+		}
+		c.BridgeListen = m["bridge-listen"]
+	}
+	c.BridgeToken = m["bridge-token"]
+
+	c.BridgeNick = "bridge"
+	if m["bridge-nick"] != "" {
+		if !isValidNick(c.MaxNickLength, m["bridge-nick"]) {
+			return nil, fmt.Errorf("bridge nick is not valid")
+		}
+		c.BridgeNick = m["bridge-nick"]
+	}
+
+	if m["admin-socket"] != "" {
+		if !filepath.IsAbs(m["admin-socket"]) {
+			return nil, fmt.Errorf("admin socket must be an absolute path")
+		}
+		c.AdminSocket = m["admin-socket"]
+	}
+
+	c.ChannelsExportFile = m["channels-export-file"]
+	c.OperNoticesFile = m["oper-notices-file"]
+
+	c.DisabledCaps = map[string]struct{}{}
+	if m["disabled-capabilities"] != "" {
+		for _, capab := range strings.Split(m["disabled-capabilities"], ",") {
+			capab = strings.TrimSpace(capab)
+			if _, exists := supportedCaps[capab]; !exists {
+				return nil, fmt.Errorf("unknown capability: %s", capab)
+			}
+			if capab == "cap-notify" {
+				return nil, fmt.Errorf("cap-notify may not be disabled")
+			}
+			c.DisabledCaps[capab] = struct{}{}
+		}
+	}
+
+	if m["sts-duration"] != "" {
+		c.STSDuration, err = time.ParseDuration(m["sts-duration"])
+		if err != nil {
+			return nil, fmt.Errorf("sts duration is in invalid format: %s", err)
+		}
+		if c.STSDuration < 0 {
+			return nil, fmt.Errorf("sts duration may not be negative")
+		}
+	}
+	c.STSPort = m["sts-port"]
+	if c.STSPort == "" && c.ListenPortTLS != "-1" {
+		c.STSPort = c.ListenPortTLS
+	}
+	if c.STSDuration > 0 {
+		if _, err := strconv.ParseUint(c.STSPort, 10, 16); err != nil {
+			return nil, fmt.Errorf(
+				"sts-duration needs a TLS port. Set listen-port-tls or sts-port")
+		}
+	}
+	c.ChannelsExportInterval = 5 * time.Minute
+	if m["channels-export-interval"] != "" {
+		c.ChannelsExportInterval, err = time.ParseDuration(
+			m["channels-export-interval"])
+		if err != nil {
+			return nil, fmt.Errorf(
+				"channels export interval is in invalid format: %s", err)
+		}
+		if c.ChannelsExportInterval < time.Second {
+			return nil, fmt.Errorf("channels export interval must be at least 1s")
+		}
+	}
+
+	c.NickPrefixes = map[string]string{}
+	c.NickSuffixes = map[string]string{}
+	for _, kind := range listenerKinds {
+		prefix := m["nick-prefix-"+kind]
+		suffix := m["nick-suffix-"+kind]
+		if prefix != "" && !isValidNick(c.MaxNickLength, prefix) {
+			return nil, fmt.Errorf("nick prefix for %s is not valid", kind)
+		}
+		if suffix != "" && !isValidNick(c.MaxNickLength, "a"+suffix) {
+			return nil, fmt.Errorf("nick suffix for %s is not valid", kind)
+		}
+		if len(prefix)+len(suffix) >= c.MaxNickLength {
+			return nil, fmt.Errorf("nick prefix and suffix for %s leave no room",
+				kind)
+		}
+		if prefix != "" {
+			c.NickPrefixes[kind] = prefix
+		}
+		if suffix != "" {
+			c.NickSuffixes[kind] = suffix
+		}
+	}
+
+	c.ClientPassword = m["client-password"]
+	c.ClientPasswords = map[string]string{}
+	for _, kind := range listenerKinds {
+		if m["client-password-"+kind] != "" {
+			c.ClientPasswords[kind] = m["client-password-"+kind]
+		}
+	}
+
+	c.GuestListeners = map[string]bool{}
+	for _, kind := range listenerKinds {
+		if m["guest-listener-"+kind] == "1" {
+			c.GuestListeners[kind] = true
+		}
+	}
+
+	c.PingCookie = m["ping-cookie"] == "1"
+
+	c.RecycleClientIDs = m["recycle-client-ids"] == "1"
+
+	c.StrictLinks = m["strict-links"] == "1"
+
+	c.BridgeChannels = map[string]struct{}{}
+	if m["bridge-channels"] != "" {
+		for _, name := range strings.Split(m["bridge-channels"], ",") {
+			name = canonicalizeChannel(strings.TrimSpace(name))
+			if name != "*" && !isValidChannel(name) {
+				return nil, fmt.Errorf("invalid bridge channel: %s", name)
+			}
+			c.BridgeChannels[name] = struct{}{}
+		}
+	}
+
+	c.PrivacyProfile = PrivacyProfileDefault
+	if m["privacy-profile"] != "" {
+		if m["privacy-profile"] != PrivacyProfileDefault &&
+			m["privacy-profile"] != PrivacyProfileAnonymous {
+			return nil, fmt.Errorf("privacy profile must be %s or %s",
+				PrivacyProfileDefault, PrivacyProfileAnonymous)
+		}
+		c.PrivacyProfile = m["privacy-profile"]
+	}
+
 	return c, nil
 }
 
+// readTextFile reads text we show users, such as the message of the day,
+// from a file. We drop trailing blank lines and carriage returns. What says
+// what the file is for errors.
+func readTextFile(what, file string) (string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s file: %s", what, err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// parseRegistrationUserModes checks a list of user modes to set when users
+// register, such as "+iC". Users may set these on themselves. It may be blank.
+func parseRegistrationUserModes(s string) (string, error) {
+	modes := strings.TrimPrefix(s, "+")
+	for _, mode := range modes {
+		if mode != 'g' && mode != 'i' && mode != 'p' && mode != 'B' &&
+			mode != 'C' {
+			return "", fmt.Errorf("unsupported user mode: %c", mode)
+		}
+	}
+	return modes, nil
+}
+
 // Parse the value side of a server definition from the servers config.
 // Format:
-// <hostname>,<port>,<password>,<tls: 1 or 0>
+// <hostname>,<port>,<password>,<tls: 1 or 0>[,<bind address>[,<bind interface>]]
+//
+// The port may be srv to find the server with SRV records.
 func parseLink(name, s string) (*ServerDefinition, error) {
 	pieces := strings.Split(s, ",")
-	if len(pieces) != 4 {
+	if len(pieces) < 4 || len(pieces) > 7 {
 		return nil, fmt.Errorf("unexpected number of fields")
 	}
 
@@ -257,9 +1121,18 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 	}
 	// We could format check hostname. But when we try to listen we'll fail.
 
-	port, err := strconv.ParseInt(strings.TrimSpace(pieces[1]), 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("invalid port: %s: %s", pieces[1], err)
+	srv := strings.TrimSpace(pieces[1]) == "srv"
+	var port int64
+	if srv {
+		if strings.HasSuffix(hostname, ".i2p") {
+			return nil, fmt.Errorf("I2P servers don't have SRV records")
+		}
+	} else {
+		var err error
+		port, err = strconv.ParseInt(strings.TrimSpace(pieces[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s: %s", pieces[1], err)
+		}
 	}
 
 	pass := strings.TrimSpace(pieces[2])
@@ -267,19 +1140,111 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 		return nil, fmt.Errorf("you must specify a password")
 	}
 
+	bindAddress := ""
+	if len(pieces) > 4 {
+		bindAddress = strings.TrimSpace(pieces[4])
+		if bindAddress != "" {
+			if err := checkBindAddress(bindAddress); err != nil {
+				return nil, fmt.Errorf("invalid bind address: %s: %s", bindAddress,
+					err)
+			}
+		}
+	}
+
+	bindInterface := ""
+	if len(pieces) > 5 {
+		bindInterface = strings.TrimSpace(pieces[5])
+	}
+
+	observer, untrusted := false, false
+	if len(pieces) > 6 {
+		switch strings.TrimSpace(pieces[6]) {
+		case "observer":
+			observer = true
+		case "untrusted":
+			untrusted = true
+		case "", "trusted":
+		default:
+			return nil, fmt.Errorf("invalid link type: %s", pieces[6])
+		}
+	}
+
 	return &ServerDefinition{
-		Name:     name,
-		Hostname: hostname,
-		Port:     int(port),
-		Pass:     pass,
-		TLS:      pieces[3] == "1",
+		Name:          name,
+		Hostname:      hostname,
+		Port:          int(port),
+		Pass:          pass,
+		TLS:           strings.TrimSpace(pieces[3]) == "1",
+		SRV:           srv,
+		BindAddress:   bindAddress,
+		BindInterface: bindInterface,
+		Observer:      observer,
+		Untrusted:     untrusted,
 	}, nil
 }
 
+// checkBindAddress checks a local address to bind to is in a format we
+// understand. It may be a host or host:port. The host must be an IP.
+func checkBindAddress(s string) error {
+	host, port := splitBindAddress(s)
+
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("host must be an IP: %s", host)
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+
+	return nil
+}
+
+// splitBindAddress splits a host or host:port into its host and port. If there
+// is no port, the port is 0 meaning any.
+func splitBindAddress(s string) (string, string) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return strings.Trim(s, "[]"), "0"
+	}
+	return host, port
+}
+
+// operPrivileges are the privileges an oper may have, and what they allow.
+var operPrivileges = map[string]string{
+	"remote-kill": "KILL users on other servers",
+	"admin":       "see addresses hidden by the anonymous privacy profile",
+}
+
+// Parse the value part of an oper config line.
+// A line looks like so:
+// <name> = <password>[,<privilege>...]
+//
+// This function takes the portion after the equals sign and parses it. The
+// password may not contain a comma.
+func parseOperConfig(s string) (string, map[string]struct{}, error) {
+	pieces := strings.Split(s, ",")
+
+	pass := strings.TrimSpace(pieces[0])
+	if len(pass) == 0 {
+		return "", nil, fmt.Errorf("password is blank")
+	}
+
+	privileges := map[string]struct{}{}
+	for _, piece := range pieces[1:] {
+		privilege := strings.TrimSpace(piece)
+		if _, exists := operPrivileges[privilege]; !exists {
+			return "", nil, fmt.Errorf("unknown privilege: %s", privilege)
+		}
+		privileges[privilege] = struct{}{}
+	}
+
+	return pass, privileges, nil
+}
+
 // Parse the value part of a user config line.
 // This is a comma separated value.
 // A line looks like so:
-// <name> = <user mask>,<host mask>,<flood exempt = 1|0>,<spoof>
+// <name> = <user mask>,<host mask>,<flood exempt = 1|0>,<spoof>[,<user modes>[,<relay = 1|0>[,<password>]]]
 //
 // This function takes the portion after the equals sign and parses it.
 //
@@ -290,9 +1255,15 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 // host. If they both match, the user falls under this config.
 //
 // Spoof may be empty.
+//
+// User modes are optional. If given, they replace the default user modes. They
+// may be empty to set no modes.
+//
+// The password is optional. If given, users must send it with PASS. It can't
+// contain commas.
 func parseUserConfig(s string) (UserConfig, error) {
 	piecesUntrimmed := strings.Split(s, ",")
-	if len(piecesUntrimmed) != 4 {
+	if len(piecesUntrimmed) < 4 || len(piecesUntrimmed) > 7 {
 		return UserConfig{}, fmt.Errorf("unexpected number of fields")
 	}
 
@@ -323,10 +1294,32 @@ func parseUserConfig(s string) (UserConfig, error) {
 		}
 	}
 
-	return UserConfig{
+	userConfig := UserConfig{
 		UserMask:    userMask,
 		HostMask:    hostMask,
 		FloodExempt: floodExempt,
 		Spoof:       spoof,
-	}, nil
+	}
+
+	if len(pieces) >= 5 {
+		modes, err := parseRegistrationUserModes(pieces[4])
+		if err != nil {
+			return UserConfig{}, err
+		}
+		userConfig.UserModes = modes
+		userConfig.HasUserModes = true
+	}
+
+	if len(pieces) >= 6 {
+		if pieces[5] != "1" && pieces[5] != "0" {
+			return UserConfig{}, fmt.Errorf("relay flag must be 1 or 0")
+		}
+		userConfig.Relay = pieces[5] == "1"
+	}
+
+	if len(pieces) == 7 {
+		userConfig.Password = pieces[6]
+	}
+
+	return userConfig, nil
 }
@@ -0,0 +1,218 @@
+package terrarium
+
+import (
+	"fmt"
+	"time"
+)
+
+// The server goroutine takes events from ToServerChan one at a time. If events
+// arrive faster than it handles them, such as during a big burst or a flood of
+// new connections, they wait in the queue. Once the queue is full, the readers
+// sending events block.
+//
+// To keep the queue from filling, when it is mostly full (overloaded()) we put
+// off low priority commands from users, such as WHO. These only produce replies
+// and are often expensive. Once the queue is below that again we run them,
+// taking turns with new events. We also run any that have waited
+// MaxDeferredWait, overloaded or not. If we have too many put off, we refuse
+// more with RPL_TRYAGAIN.
+
+// EventQueueSize is how many events may wait for the server goroutine.
+const EventQueueSize = 1024
+
+// MaxDeferredEvents is how many low priority events we hold on to while
+// overloaded.
+const MaxDeferredEvents = 1024
+
+// MaxDeferredWait is the longest an event waits after we put it off. We put off
+// everything from a client after its first low priority command, so this
+// bounds how long its other commands wait too.
+const MaxDeferredWait = 10 * time.Second
+
+// lowPriorityCommands are the user commands we put off while overloaded.
+var lowPriorityCommands = map[string]struct{}{
+	"ADMIN":    {},
+	"FINDUSER": {},
+	"LINKS":    {},
+	"LUSERS":   {},
+	"MAP":      {},
+	"MOTD":     {},
+	"RULES":    {},
+	"STATS":    {},
+	"TIME":     {},
+	"VERSION":  {},
+	"WHO":      {},
+	"WHOIS":    {},
+	"WHOWAS":   {},
+}
+
+// EventQueueStats describes how the event queue is doing.
+type EventQueueStats struct {
+	// How many events we handled.
+	Handled uint64
+
+	// The most events we saw waiting at once.
+	HighestDepth int
+
+	// How long events waited in the queue, in total and at most.
+	TotalWait   time.Duration
+	HighestWait time.Duration
+
+	// How many events we put off, and how many we refused.
+	Deferred uint64
+	Refused  uint64
+
+	// Whether we were overloaded when we last looked.
+	Overloaded bool
+}
+
+// overloaded checks if the event queue is mostly full.
+func (cb *Catbox) overloaded() bool {
+	return cap(cb.ToServerChan) > 0 &&
+		len(cb.ToServerChan) >= cap(cb.ToServerChan)*3/4
+}
+
+// receiveEvent records an event taken from the queue and then handles it,
+// unless it is one to put off.
+func (cb *Catbox) receiveEvent(evt Event) {
+	cb.recordEvent(evt)
+
+	if cb.shouldDefer(evt) {
+		cb.deferEvent(evt)
+		return
+	}
+
+	cb.handleEvent(evt)
+}
+
+// recordEvent updates the queue statistics for an event taken from the queue.
+func (cb *Catbox) recordEvent(evt Event) {
+	stats := &cb.EventStats
+	stats.Handled++
+
+	// Include the event we just took.
+	depth := len(cb.ToServerChan) + 1
+	if depth > stats.HighestDepth {
+		stats.HighestDepth = depth
+	}
+
+	if !evt.Queued.IsZero() {
+		wait := cb.now().Sub(evt.Queued)
+		stats.TotalWait += wait
+		if wait > stats.HighestWait {
+			stats.HighestWait = wait
+		}
+	}
+
+	overloaded := cb.overloaded()
+	if overloaded && !stats.Overloaded {
+		cb.noticeOpers(fmt.Sprintf(
+			"Event queue is overloaded (%d/%d). Putting off low priority commands.",
+			len(cb.ToServerChan), cap(cb.ToServerChan)))
+	}
+	stats.Overloaded = overloaded
+}
+
+// shouldDefer decides whether to put off an event.
+//
+// We put off low priority commands from users while overloaded. Once we put off
+// one of a user's messages we put off the rest until we catch up so they get
+// replies in order.
+func (cb *Catbox) shouldDefer(evt Event) bool {
+	if evt.Type != MessageFromClientEvent {
+		return false
+	}
+
+	if _, exists := cb.LocalUsers[evt.Client.ID]; !exists {
+		return false
+	}
+
+	if cb.deferredClients[evt.Client.ID] > 0 {
+		return true
+	}
+
+	if _, ok := lowPriorityCommands[evt.Message.Command]; !ok {
+		return false
+	}
+
+	return cb.overloaded()
+}
+
+// deferEvent puts off an event until we're no longer overloaded. If we've put
+// off too many already, we refuse low priority commands and handle anything
+// else now.
+func (cb *Catbox) deferEvent(evt Event) {
+	if len(cb.deferredEvents) >= MaxDeferredEvents {
+		if _, ok := lowPriorityCommands[evt.Message.Command]; !ok {
+			cb.handleEvent(evt)
+			return
+		}
+
+		cb.EventStats.Refused++
+		if lu, exists := cb.LocalUsers[evt.Client.ID]; exists {
+			// 263 RPL_TRYAGAIN
+			lu.messageFromServer("263", []string{evt.Message.Command,
+				"Server load is temporarily too heavy. Please wait a while and try again."})
+		}
+		return
+	}
+
+	if cb.deferredClients == nil {
+		cb.deferredClients = make(map[uint64]int)
+	}
+
+	cb.deferredEvents = append(cb.deferredEvents, evt)
+	cb.deferredClients[evt.Client.ID]++
+	cb.EventStats.Deferred++
+}
+
+// shouldRunDeferredEvent decides whether to handle the oldest event we put off
+// now. We do once we're no longer overloaded, or if it has waited too long.
+func (cb *Catbox) shouldRunDeferredEvent() bool {
+	if len(cb.deferredEvents) == 0 {
+		return false
+	}
+
+	if !cb.overloaded() {
+		return true
+	}
+
+	queued := cb.deferredEvents[0].Queued
+	return !queued.IsZero() && cb.now().Sub(queued) >= MaxDeferredWait
+}
+
+// runDeferredEvent handles the oldest event we put off.
+func (cb *Catbox) runDeferredEvent() {
+	evt := cb.deferredEvents[0]
+	cb.deferredEvents[0] = Event{}
+	cb.deferredEvents = cb.deferredEvents[1:]
+
+	cb.deferredClients[evt.Client.ID]--
+	if cb.deferredClients[evt.Client.ID] == 0 {
+		delete(cb.deferredClients, evt.Client.ID)
+	}
+
+	// The client may be gone by now. handleEvent ignores events for clients
+	// we don't know.
+	cb.handleEvent(evt)
+}
+
+// eventQueueReport describes the event queue for STATS.
+func (cb *Catbox) eventQueueReport() []string {
+	stats := cb.EventStats
+
+	var averageWait time.Duration
+	if stats.Handled > 0 {
+		averageWait = stats.TotalWait / time.Duration(stats.Handled)
+	}
+
+	return []string{
+		fmt.Sprintf("Event queue %d/%d (highest %d). Handled %d",
+			len(cb.ToServerChan), cap(cb.ToServerChan), stats.HighestDepth,
+			stats.Handled),
+		fmt.Sprintf("Event wait average %s, highest %s", averageWait,
+			stats.HighestWait),
+		fmt.Sprintf("Deferred %d (%d waiting), refused %d", stats.Deferred,
+			len(cb.deferredEvents), stats.Refused),
+	}
+}
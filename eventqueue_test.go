@@ -0,0 +1,122 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestEventQueueDefersWhenOverloaded(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName:    "irc.example.com",
+			TS6SID:        "000",
+			MaxNickLength: 9,
+		},
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		Opers:        map[TS6UID]*User{},
+		Users:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		Channels:     map[string]*Channel{},
+		HostUsers:    map[string]map[uint64]*LocalUser{},
+		Strings:      newStringTable(),
+		ToServerChan: make(chan Event, 4),
+	}
+
+	user := newTestLocalUser(cb, 0, "user", "~user", "host1.example.com")
+	user.User.FloodExempt = true
+
+	message := func(command string, params ...string) Event {
+		return Event{
+			Type:    MessageFromClientEvent,
+			Client:  user.LocalClient,
+			Message: irc.Message{Command: command, Params: params},
+		}
+	}
+
+	// Fill the queue so we're overloaded.
+	for i := 0; i < 3; i++ {
+		cb.ToServerChan <- Event{Type: NullEvent}
+	}
+	if !cb.overloaded() {
+		t.Fatalf("not overloaded with %d/%d events queued", len(cb.ToServerChan),
+			cap(cb.ToServerChan))
+	}
+
+	// WHO waits. So does PING as it comes after the WHO.
+	cb.receiveEvent(message("WHO", "user"))
+	cb.receiveEvent(message("PING", "token"))
+	if len(cb.deferredEvents) != 2 {
+		t.Fatalf("have %d deferred events, wanted 2", len(cb.deferredEvents))
+	}
+	if len(user.WriteChan) != 0 {
+		t.Fatalf("user got a reply before we caught up: %s", <-user.WriteChan)
+	}
+
+	// Catch up. The replies come in order.
+	for len(cb.deferredEvents) > 0 {
+		cb.runDeferredEvent()
+	}
+
+	var commands []string
+	for len(user.WriteChan) > 0 {
+		commands = append(commands, (<-user.WriteChan).Command)
+	}
+	want := []string{"315", "PONG"}
+	if len(commands) != len(want) {
+		t.Fatalf("got replies %v, wanted %v", commands, want)
+	}
+	for i := range want {
+		if commands[i] != want[i] {
+			t.Fatalf("got replies %v, wanted %v", commands, want)
+		}
+	}
+
+	if len(cb.deferredClients) != 0 {
+		t.Errorf("still tracking deferred clients: %v", cb.deferredClients)
+	}
+	if cb.EventStats.Deferred != 2 || cb.EventStats.Handled != 2 {
+		t.Errorf("deferred %d and handled %d, wanted 2 and 2",
+			cb.EventStats.Deferred, cb.EventStats.Handled)
+	}
+
+	// Not overloaded, WHO runs right away.
+	for len(cb.ToServerChan) > 0 {
+		<-cb.ToServerChan
+	}
+	cb.receiveEvent(message("WHO", "user"))
+	if len(cb.deferredEvents) != 0 || len(user.WriteChan) == 0 {
+		t.Errorf("WHO did not run right away")
+	}
+}
+
+// We catch up on events we put off once we're below the threshold, even with
+// new events waiting, and after MaxDeferredWait even if we're not.
+func TestEventQueueRunsDeferredEvents(t *testing.T) {
+	clock := newFakeClock()
+	cb := &Catbox{ToServerChan: make(chan Event, 4), Clock: clock}
+
+	if cb.shouldRunDeferredEvent() {
+		t.Errorf("would run a deferred event with none")
+	}
+
+	cb.deferredEvents = []Event{{Type: NullEvent, Queued: clock.Now()}}
+	cb.ToServerChan <- Event{Type: NullEvent}
+	if !cb.shouldRunDeferredEvent() {
+		t.Errorf("would not run a deferred event below the threshold")
+	}
+
+	for i := 0; i < 2; i++ {
+		cb.ToServerChan <- Event{Type: NullEvent}
+	}
+	if cb.shouldRunDeferredEvent() {
+		t.Errorf("would run a new deferred event while overloaded")
+	}
+
+	clock.advance(MaxDeferredWait)
+	if !cb.shouldRunDeferredEvent() {
+		t.Errorf("would not run a deferred event that waited too long")
+	}
+}
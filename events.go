@@ -0,0 +1,120 @@
+package terrarium
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// We may tell a webhook about things that happen on the server, such as users
+// connecting and operators setting K-Lines. This is for moderation tools and
+// statistics. See event-webhook in the config.
+//
+// Each server reports what happens to its own users and links, and what its
+// own operators do. Collect from every server to see the whole network.
+//
+// Like the chat logger, a goroutine makes the requests, and we drop events if
+// it falls behind.
+
+// EventWebhookQueueSize is how many events may wait for the event sender.
+const EventWebhookQueueSize = 1024
+
+// WebhookTimeout is how long we wait for a webhook to answer.
+const WebhookTimeout = 10 * time.Second
+
+// serverEvent is something that happened. We send it to the webhook as JSON.
+type serverEvent struct {
+	Time   time.Time         `json:"time"`
+	Server string            `json:"server"`
+	Type   string            `json:"type"`
+	Fields map[string]string `json:"fields"`
+
+	// Where to send it, from the config when we queued it.
+	webhook string
+}
+
+// emitEvent tells the event webhook, if there is one, that something happened.
+// fields holds details about it, as name then value.
+func (cb *Catbox) emitEvent(eventType string, fields ...string) {
+	if cb.Config.EventWebhook == "" {
+		return
+	}
+
+	if cb.eventChan == nil {
+		cb.startEventSender()
+	}
+
+	evt := serverEvent{
+		Time:    cb.now().UTC(),
+		Server:  cb.Config.ServerName,
+		Type:    eventType,
+		Fields:  map[string]string{},
+		webhook: cb.Config.EventWebhook,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		evt.Fields[fields[i]] = fields[i+1]
+	}
+
+	select {
+	case cb.eventChan <- evt:
+	default:
+		cb.EventsDropped++
+		log.Printf("Event sender is behind. Dropping a %s event.", eventType)
+	}
+}
+
+// startEventSender starts the goroutine that sends events to the webhook. It
+// runs until shutdown, then sends anything still queued.
+func (cb *Catbox) startEventSender() {
+	cb.eventChan = make(chan serverEvent, EventWebhookQueueSize)
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		client := &http.Client{Timeout: WebhookTimeout}
+		send := func(evt serverEvent) {
+			if err := postJSON(client, evt.webhook, evt); err != nil {
+				log.Printf("Unable to send %s event to webhook: %s", evt.Type, err)
+			}
+		}
+
+		for {
+			select {
+			case evt := <-cb.eventChan:
+				send(evt)
+			case <-cb.ShutdownChan:
+				for {
+					select {
+					case evt := <-cb.eventChan:
+						send(evt)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// postJSON POSTs v to the URL as JSON.
+func postJSON(client *http.Client, url string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// Connects, links, new channels, kills, quits, and splits go to the event
+// webhook.
+func TestEventWebhook(t *testing.T) {
+	var mutex sync.Mutex
+	var posted []serverEvent
+	webhook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var evt serverEvent
+			if err := json.NewDecoder(r.Body).Decode(&evt); err != nil {
+				t.Errorf("webhook got bad JSON: %s", err)
+			}
+			mutex.Lock()
+			posted = append(posted, evt)
+			mutex.Unlock()
+		}))
+	defer webhook.Close()
+
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.EventWebhook = webhook.URL
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	carol := a.connectUser("carol", "carol")
+	_ = b.connectUser("bob", "bob")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	alice.send(irc.Message{Command: "JOIN", Params: []string{"#new"}})
+	n.waitFor("alice to join", func() bool {
+		return len(a.channelMembers("#new")) == 1
+	})
+
+	a.makeOper("alice")
+	alice.send(irc.Message{Command: "KILL", Params: []string{"carol", "bye"}})
+	n.waitFor("carol to be killed", func() bool {
+		return carol.hasMessage("ERROR")
+	})
+
+	n.split("a.example.com", "b.example.com")
+
+	n.waitFor("the webhook to get the split", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, evt := range posted {
+			if evt.Type == "split" {
+				return true
+			}
+		}
+		return false
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var types []string
+	for _, evt := range posted {
+		if evt.Server != "a.example.com" {
+			t.Errorf("%s event is from %s, wanted a.example.com", evt.Type,
+				evt.Server)
+		}
+		types = append(types, evt.Type)
+	}
+
+	want := []string{"connect", "connect", "link", "channel-create", "kill",
+		"quit", "split"}
+	if len(types) != len(want) {
+		t.Fatalf("got events %v, wanted %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("got events %v, wanted %v", types, want)
+		}
+	}
+
+	if posted[0].Fields["nick"] != "alice" ||
+		posted[0].Fields["user"] != "~alice" {
+		t.Errorf("connect event has fields %v", posted[0].Fields)
+	}
+	if posted[4].Fields["oper"] != "alice" ||
+		posted[4].Fields["nick"] != "carol" ||
+		posted[4].Fields["reason"] != "bye" {
+		t.Errorf("kill event has fields %v", posted[4].Fields)
+	}
+	if posted[6].Fields["server"] != "b.example.com" {
+		t.Errorf("split event has fields %v", posted[6].Fields)
+	}
+}
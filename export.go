@@ -0,0 +1,119 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// We may write statistics about the network's channels to a JSON file every
+// so often (see channels-export-file), such as for a web page listing them. It
+// has what LIST shows anyone: each channel's name, how many members it has,
+// and its topic. We leave out secret channels (+s) and those that ask not to
+// be listed (+U), and we never say who is in a channel.
+
+// channelsExport is what we write to the channels export file.
+type channelsExport struct {
+	Server   string                `json:"server"`
+	Network  string                `json:"network,omitempty"`
+	Time     time.Time             `json:"time"`
+	Users    int                   `json:"users"`
+	Channels []channelExportRecord `json:"channels"`
+}
+
+// channelExportRecord describes one channel in the export.
+type channelExportRecord struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Topic   string `json:"topic,omitempty"`
+}
+
+// channelsExportData gathers what to export. Only the server goroutine may
+// call this.
+func (cb *Catbox) channelsExportData() channelsExport {
+	export := channelsExport{
+		Server:   cb.Config.ServerName,
+		Network:  cb.Config.NetworkName,
+		Time:     cb.now().UTC(),
+		Users:    len(cb.Users),
+		Channels: []channelExportRecord{},
+	}
+
+	for _, channel := range cb.Channels {
+		if channel.hasMode('s') || channel.hasMode('U') {
+			continue
+		}
+		export.Channels = append(export.Channels, channelExportRecord{
+			Name:    channel.Name,
+			Members: len(channel.Members),
+			Topic:   channel.Topic,
+		})
+	}
+
+	sort.Slice(export.Channels, func(i, j int) bool {
+		return export.Channels[i].Name < export.Channels[j].Name
+	})
+
+	return export
+}
+
+// exportChannels writes the channels export file if it's time to. We gather
+// the data here, and write it in another goroutine so a slow disk doesn't hold
+// us up.
+func (cb *Catbox) exportChannels() {
+	file := cb.Config.ChannelsExportFile
+	if file == "" {
+		return
+	}
+
+	now := cb.now()
+	if !cb.ChannelsExportedAt.IsZero() &&
+		now.Sub(cb.ChannelsExportedAt) < cb.Config.ChannelsExportInterval {
+		return
+	}
+	cb.ChannelsExportedAt = now
+
+	buf, err := json.MarshalIndent(cb.channelsExportData(), "", "  ")
+	if err != nil {
+		log.Printf("Unable to encode channels export: %s", err)
+		return
+	}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		if err := writeFileAtomic(file, buf); err != nil {
+			log.Printf("Unable to write channels export: %s", err)
+		}
+	}()
+}
+
+// writeFileAtomic replaces the file's contents so that readers see either the
+// old contents or the new, never part of them.
+func writeFileAtomic(file string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(append(buf, '\n')); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,50 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// We export public channels, but not secret ones or those that opt out.
+func TestMemNetworkChannelsExport(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	file := filepath.Join(t.TempDir(), "channels.json")
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ChannelsExportFile = file
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	for _, channel := range []string{"#public", "#secret", "#unlisted"} {
+		alice.send(irc.Message{Command: "JOIN", Params: []string{channel}})
+	}
+	alice.send(irc.Message{Command: "MODE", Params: []string{"#public", "-s"}})
+	alice.send(irc.Message{Command: "TOPIC", Params: []string{"#public", "hi"}})
+	alice.send(irc.Message{Command: "MODE", Params: []string{"#unlisted", "-s+U"}})
+	n.waitFor("the modes to change", func() bool {
+		return a.channelModes("#unlisted") == "+Un"
+	})
+
+	n.advance(time.Second)
+
+	var export channelsExport
+	n.waitFor("the export", func() bool {
+		buf, err := ioutil.ReadFile(file)
+		return err == nil && json.Unmarshal(buf, &export) == nil
+	})
+
+	want := []channelExportRecord{{Name: "#public", Members: 1, Topic: "hi"}}
+	if export.Server != "a.example.com" || export.Users != 1 ||
+		!reflect.DeepEqual(export.Channels, want) {
+		t.Errorf("exported %+v, wanted %+v", export, want)
+	}
+}
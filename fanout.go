@@ -0,0 +1,173 @@
+package terrarium
+
+import (
+	"sync/atomic"
+
+	"github.com/horgh/irc"
+)
+
+// Sending a message to a channel means queueing it for each local member.
+// With thousands of members this takes the server goroutine a while. For big
+// channels we encode the message once and hand the lines to fan-out workers.
+// They queue them for the members while the server goroutine moves on. The
+// members' writers send the lines as they are.
+//
+// Each worker looks after a fixed share of the clients, by ID, and does its
+// jobs in order. While a client has fan-out jobs waiting, we send anything
+// else for it through its worker too (see maybeQueueMessage()). This way each
+// client still gets messages in order. For the same reason, its worker closes
+// its send queue if it has jobs waiting when it quits (see closeWriteChan()).
+//
+// The workers don't touch the server's state. A client's FanOutPending and
+// FanOutExceeded are how they tell the server goroutine what they did.
+
+// FanOutThreshold is how many local recipients a message needs before we use
+// the fan-out workers.
+const FanOutThreshold = 1000
+
+// FanOutWorkers is how many fan-out workers we run.
+const FanOutWorkers = 4
+
+// fanOutQueueSize is how many jobs may wait for each worker. If a worker falls
+// this far behind, the server goroutine waits for it.
+const fanOutQueueSize = 256
+
+// fanOutJob is a message to queue for some clients, or if closing is true,
+// clients whose send queues to close.
+type fanOutJob struct {
+	clients []*LocalClient
+	message outMessage
+	closing bool
+}
+
+func (j fanOutJob) run() {
+	for _, c := range j.clients {
+		if j.closing {
+			close(c.WriteChan)
+		} else {
+			c.queueFromFanOut(j.message)
+		}
+		atomic.AddInt32(&c.FanOutPending, -1)
+	}
+}
+
+// queueFromFanOut queues a message for the client from a fan-out worker. Like
+// maybeQueueMessage(), it won't block. If the queue is full we flag it for the
+// server goroutine to see.
+func (c *LocalClient) queueFromFanOut(m outMessage) {
+	if atomic.LoadInt32(&c.FanOutExceeded) != 0 {
+		return
+	}
+
+	select {
+	case c.WriteChan <- m:
+		atomic.AddInt64(&c.SendQueueBytes, int64(messageLength(m.Message)))
+	default:
+		atomic.StoreInt32(&c.FanOutExceeded, 1)
+	}
+}
+
+// fanOut queues the message for each of the clients.
+func (cb *Catbox) fanOut(clients []*LocalClient, m irc.Message) {
+	cb.fanOutFrom(nil, clients, m)
+}
+
+// fanOutFrom queues the message from the user for each of the clients, with
+// the tags each should have. The user may be nil.
+func (cb *Catbox) fanOutFrom(source *User, clients []*LocalClient,
+	m irc.Message) {
+	if len(clients) < FanOutThreshold {
+		for _, c := range clients {
+			c.maybeQueueMessageFrom(source, m)
+		}
+		return
+	}
+
+	// Encode once for everyone. If we can't, their writers will try and tell
+	// us what went wrong. Clients get it with tags or without, so we share it
+	// out by both.
+	out := outMessage{Message: m}
+	if lines, err := encodeMessage(m, true); err == nil {
+		out.lines = lines
+	}
+
+	type share struct {
+		shard uint64
+		tags  string
+	}
+	shares := map[share][]*LocalClient{}
+	for _, c := range clients {
+		if c.sendQueueExceeded() {
+			continue
+		}
+		key := share{shard: c.ID % FanOutWorkers, tags: c.messageTagsFrom(source)}
+		shares[key] = append(shares[key], c)
+	}
+
+	for key, clients := range shares {
+		message := out
+		message.tags = key.tags
+		cb.sendFanOutJob(int(key.shard), fanOutJob{clients: clients,
+			message: message})
+	}
+}
+
+// fanOutToClient queues a message for a client that has fan-out jobs waiting.
+// It goes to the client's worker so it arrives after them.
+func (cb *Catbox) fanOutToClient(c *LocalClient, m outMessage) {
+	cb.sendFanOutJob(int(c.ID%FanOutWorkers), fanOutJob{
+		clients: []*LocalClient{c},
+		message: m,
+	})
+}
+
+// fanOutClose has the client's worker close its send queue once it has queued
+// what's waiting.
+func (cb *Catbox) fanOutClose(c *LocalClient) {
+	cb.sendFanOutJob(int(c.ID%FanOutWorkers), fanOutJob{
+		clients: []*LocalClient{c},
+		closing: true,
+	})
+}
+
+// sendFanOutJob gives the job to the worker for the shard.
+func (cb *Catbox) sendFanOutJob(shard int, job fanOutJob) {
+	if cb.fanOutChans == nil {
+		cb.startFanOutWorkers()
+	}
+
+	for _, c := range job.clients {
+		atomic.AddInt32(&c.FanOutPending, 1)
+	}
+
+	select {
+	case cb.fanOutChans[shard] <- job:
+	case <-cb.ShutdownChan:
+		// The workers may be gone.
+		job.run()
+	}
+}
+
+// startFanOutWorkers starts the fan-out workers. They run until shutdown.
+func (cb *Catbox) startFanOutWorkers() {
+	cb.fanOutChans = make([]chan fanOutJob, FanOutWorkers)
+
+	for i := range cb.fanOutChans {
+		jobs := make(chan fanOutJob, fanOutQueueSize)
+		cb.fanOutChans[i] = jobs
+
+		cb.WG.Add(1)
+		go func() {
+			defer cb.WG.Done()
+
+			for {
+				select {
+				case job := <-jobs:
+					job.run()
+				case <-cb.ShutdownChan:
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,134 @@
+package terrarium
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestFanOut(t *testing.T) {
+	cb := &Catbox{ShutdownChan: make(chan struct{})}
+	defer func() {
+		close(cb.ShutdownChan)
+		cb.WG.Wait()
+	}()
+
+	// Wait for the workers to finish with the clients.
+	waitForWorkers := func(clients []*LocalClient) {
+		deadline := time.Now().Add(10 * time.Second)
+		for _, c := range clients {
+			for atomic.LoadInt32(&c.FanOutPending) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("fan-out workers did not finish")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	for _, count := range []int{10, FanOutThreshold, 3*FanOutThreshold + 1} {
+		var clients []*LocalClient
+		for i := 0; i < count; i++ {
+			clients = append(clients, &LocalClient{
+				ID:        uint64(i),
+				WriteChan: make(chan outMessage, 2),
+				Catbox:    cb,
+			})
+		}
+
+		// This one's queue is already full.
+		clients[0].WriteChan <- outMessage{Message: irc.Message{Command: "PING"}}
+		clients[0].WriteChan <- outMessage{Message: irc.Message{Command: "PING"}}
+
+		cb.fanOut(clients, irc.Message{Command: "PRIVMSG",
+			Params: []string{"#big", "hi"}})
+		// This comes after the PRIVMSG even if the workers have yet to queue it.
+		for _, c := range clients[1:] {
+			c.maybeQueueMessage(irc.Message{Command: "NOTICE",
+				Params: []string{"#big", "after"}})
+		}
+		waitForWorkers(clients)
+
+		if !clients[0].sendQueueExceeded() {
+			t.Errorf("%d clients: full send queue was not noticed", count)
+		}
+
+		for _, c := range clients[1:] {
+			if len(c.WriteChan) != 2 {
+				t.Fatalf("%d clients: client %d has %d messages, wanted 2", count,
+					c.ID, len(c.WriteChan))
+			}
+			m := <-c.WriteChan
+			if m.Command != "PRIVMSG" {
+				t.Fatalf("%d clients: client %d got %s, wanted the PRIVMSG", count,
+					c.ID, m)
+			}
+			// Big channels share the encoded line.
+			if count >= FanOutThreshold &&
+				(len(m.lines) != 1 || m.lines[0] != "PRIVMSG #big hi\r\n") {
+				t.Fatalf("%d clients: client %d got lines %q", count, c.ID, m.lines)
+			}
+			if m := <-c.WriteChan; m.Command != "NOTICE" {
+				t.Fatalf("%d clients: client %d got %s, wanted the NOTICE", count,
+					c.ID, m)
+			}
+		}
+	}
+
+	if cb.fanOutChans == nil {
+		t.Errorf("fan-out workers did not start")
+	}
+
+	// A client that quits with fan-out jobs waiting gets them before its queue
+	// closes.
+	var clients []*LocalClient
+	for i := 0; i < FanOutThreshold; i++ {
+		clients = append(clients, &LocalClient{
+			ID:        uint64(i),
+			WriteChan: make(chan outMessage, 2),
+			Catbox:    cb,
+		})
+	}
+	cb.fanOut(clients, irc.Message{Command: "PRIVMSG",
+		Params: []string{"#big", "bye"}})
+	clients[0].closeWriteChan()
+	waitForWorkers(clients)
+	if m, ok := <-clients[0].WriteChan; !ok || m.Command != "PRIVMSG" {
+		t.Errorf("quitting client got %v, %v, wanted the PRIVMSG", m, ok)
+	}
+	if _, ok := <-clients[0].WriteChan; ok {
+		t.Errorf("quitting client's queue is still open")
+	}
+
+	// Those with message-tags get messages from bots with the bot tag.
+	bot := &User{Modes: map[byte]struct{}{'B': {}}}
+	clients = nil
+	for i := 0; i < FanOutThreshold; i++ {
+		c := &LocalClient{
+			ID:        uint64(i),
+			WriteChan: make(chan outMessage, 1),
+			Catbox:    cb,
+			Caps:      map[string]struct{}{},
+		}
+		if i%2 == 0 {
+			c.Caps["message-tags"] = struct{}{}
+		}
+		clients = append(clients, c)
+	}
+	cb.fanOutFrom(bot, clients, irc.Message{Command: "PRIVMSG",
+		Params: []string{"#big", "beep"}})
+	waitForWorkers(clients)
+	for i, c := range clients {
+		m := <-c.WriteChan
+		want := ""
+		if i%2 == 0 {
+			want = botTag
+		}
+		if m.tags != want || len(m.lines) != 1 {
+			t.Fatalf("client %d got tags %q and lines %q, wanted tags %q", i,
+				m.tags, m.lines, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// FINDUSER lets operators search the users on the network by part of their
+// nick, username, hostname, real name, or account. WHO takes masks and
+// matches few fields, which is awkward for finding someone by what they put in
+// their real name, say.
+
+// findUserPageSize is how many users FINDUSER shows at once.
+const findUserPageSize = 20
+
+// findUserFields are the fields FINDUSER may search, and how to get each
+// from a user.
+var findUserFields = map[string]func(*User) []string{
+	"NICK":    func(u *User) []string { return []string{u.DisplayNick} },
+	"USER":    func(u *User) []string { return []string{u.Username} },
+	"HOST":    func(u *User) []string { return []string{u.Hostname} },
+	"REAL":    func(u *User) []string { return []string{u.RealName} },
+	"ACCOUNT": func(u *User) []string { return []string{u.Account} },
+	"ANY": func(u *User) []string {
+		return []string{u.DisplayNick, u.Username, u.Hostname, u.RealName,
+			u.Account}
+	},
+}
+
+// FINDUSER lists users with the text in the field, ignoring case. We show a
+// page of them at a time.
+//
+// Parameters: <NICK|USER|HOST|REAL|ACCOUNT|ANY> <text> [<page>]
+func (u *LocalUser) findUserCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) < 2 || m.Params[1] == "" {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"FINDUSER", "Not enough parameters"})
+		return
+	}
+
+	field := strings.ToUpper(m.Params[0])
+	fieldValues, exists := findUserFields[field]
+	if !exists {
+		u.serverNotice(
+			"Usage: FINDUSER <NICK|USER|HOST|REAL|ACCOUNT|ANY> <text> [<page>]")
+		return
+	}
+	text := m.Params[1]
+
+	page := 1
+	if len(m.Params) > 2 {
+		n, err := strconv.Atoi(m.Params[2])
+		if err != nil || n < 1 {
+			u.serverNotice(fmt.Sprintf("Invalid page: %s", m.Params[2]))
+			return
+		}
+		page = n
+	}
+
+	matches := u.Catbox.findUsers(fieldValues, text)
+
+	pages := (len(matches) + findUserPageSize - 1) / findUserPageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		u.serverNotice(fmt.Sprintf("FINDUSER %s [%s] has %d pages", field, text,
+			pages))
+		return
+	}
+
+	start := (page - 1) * findUserPageSize
+	end := start + findUserPageSize
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	for _, user := range matches[start:end] {
+		account := user.Account
+		if account == "" {
+			account = "*"
+		}
+		serverName := u.Catbox.Config.ServerName
+		if user.isRemote() {
+			serverName = user.Server.Name
+		}
+		u.serverNotice(fmt.Sprintf("%s [%s] (%s): %s", user.nickUhost(), account,
+			serverName, user.RealName))
+	}
+
+	u.serverNotice(fmt.Sprintf("FINDUSER %s [%s] matches %d users. Page %d of %d",
+		field, text, len(matches), page, pages))
+	if page < pages {
+		u.serverNotice(fmt.Sprintf("Use FINDUSER %s %s %d for more", field, text,
+			page+1))
+	}
+}
+
+// findUsers finds the users on the network with the text in one of the values
+// fieldValues gives, ignoring case. They're in order by nick.
+func (cb *Catbox) findUsers(fieldValues func(*User) []string,
+	text string) []*User {
+	text = strings.ToLower(text)
+
+	var matches []*User
+	for _, user := range cb.Users {
+		for _, value := range fieldValues(user) {
+			if value != "" && strings.Contains(strings.ToLower(value), text) {
+				matches = append(matches, user)
+				break
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return canonicalizeNick(matches[i].DisplayNick) <
+			canonicalizeNick(matches[j].DisplayNick)
+	})
+
+	return matches
+}
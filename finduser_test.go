@@ -0,0 +1,47 @@
+package terrarium
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// FINDUSER finds users on any server, a page at a time.
+func TestMemNetworkFindUser(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	for i := 0; i <= findUserPageSize; i++ {
+		a.connectUser(fmt.Sprintf("bot%d", i), "bot")
+	}
+	b.connectUser("Alice", "alice")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(findUserPageSize + 3)
+
+	oper.send(irc.Message{Command: "FINDUSER", Params: []string{"nick", "ALI"}})
+	n.waitFor("alice to be found", func() bool {
+		return oper.hasMessageContaining("NOTICE", "matches 1 users")
+	})
+	if !oper.hasMessageContaining("NOTICE", "Alice!~alice@") {
+		t.Errorf("FINDUSER did not show alice")
+	}
+
+	oper.send(irc.Message{Command: "FINDUSER", Params: []string{"user", "bot"}})
+	n.waitFor("the first page", func() bool {
+		return oper.hasMessageContaining("NOTICE", "Page 1 of 2")
+	})
+	if !oper.hasMessageContaining("NOTICE", "FINDUSER USER bot 2 for more") {
+		t.Errorf("FINDUSER did not say how to see more")
+	}
+
+	oper.send(irc.Message{Command: "FINDUSER",
+		Params: []string{"user", "bot", "2"}})
+	n.waitFor("the second page", func() bool {
+		return oper.hasMessageContaining("NOTICE", "Page 2 of 2")
+	})
+}
@@ -0,0 +1,64 @@
+package terrarium
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// When a user registers, we tell local operators with +C more about how they
+// connected than the CLICONN notice does: the listener, the TLS version and
+// cipher, the fingerprint of any client certificate, and the capabilities
+// they turned on. Clients of the same kind tend to look alike in these, which
+// helps to spot a flood of drones or someone evading a ban with another nick.
+
+// certFingerprint is the SHA-256 fingerprint of the certificate the client
+// gave when connecting with TLS, in hex. Blank if they gave none.
+func (c *LocalClient) certFingerprint() string {
+	tlsConn, ok := c.Conn.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// connectionFingerprint describes how the client connected.
+func (c *LocalClient) connectionFingerprint() string {
+	listener := c.Listener
+	if listener == "" {
+		listener = "none"
+	}
+
+	security := "plaintext"
+	if c.isTLS() {
+		tlsVersion, tlsCipherSuite, err := c.getTLSState()
+		if err != nil {
+			log.Printf("Client %s: Unable to determine TLS state: %s", c, err)
+			security = "TLS unknown"
+		} else {
+			security = fmt.Sprintf("%s (%s)", tlsVersion, tlsCipherSuite)
+		}
+	}
+
+	certfp := c.certFingerprint()
+	if certfp == "" {
+		certfp = "none"
+	}
+
+	caps := sortedCaps(c.Caps)
+	if caps == "" {
+		caps = "none"
+	}
+
+	return fmt.Sprintf("listener %s, %s, certfp %s, caps %s", listener,
+		security, certfp, caps)
+}
@@ -0,0 +1,36 @@
+package terrarium
+
+import (
+	"net"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// Operators with +C hear how users connect.
+func TestMemNetworkConnectionFingerprint(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	a.call(func() {
+		a.cb.Users[a.cb.Nicks["oper"]].Modes['C'] = struct{}{}
+	})
+
+	ours, theirs := net.Pipe()
+	user := &memClient{conn: ours}
+	go user.readLoop()
+	a.cb.introduceClient(theirs, "i2p/example")
+
+	user.send(irc.Message{Command: "CAP", Params: []string{"REQ", "invite-notify"}})
+	user.send(irc.Message{Command: "NICK", Params: []string{"user"}})
+	user.send(irc.Message{Command: "USER",
+		Params: []string{"user", "0", "*", "user"}})
+	user.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+
+	n.waitFor("the connection notice", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"CLICONN user details: listener i2p/example, plaintext, certfp none, caps invite-notify")
+	})
+}
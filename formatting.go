@@ -0,0 +1,114 @@
+package terrarium
+
+import "strings"
+
+// mIRC style formatting codes. See https://modern.ircdocs.horse/formatting
+const (
+	formatBold          = '\x02'
+	formatColor         = '\x03'
+	formatHexColor      = '\x04'
+	formatReset         = '\x0f'
+	formatMonospace     = '\x11'
+	formatReverse       = '\x16'
+	formatItalic        = '\x1d'
+	formatStrikethrough = '\x1e'
+	formatUnderline     = '\x1f'
+)
+
+// isFormattingCode checks if the byte starts a formatting code.
+func isFormattingCode(b byte) bool {
+	switch b {
+	case formatBold, formatColor, formatHexColor, formatReset, formatMonospace,
+		formatReverse, formatItalic, formatStrikethrough, formatUnderline:
+		return true
+	}
+	return false
+}
+
+// hasFormatting checks if the text has any color or formatting codes.
+func hasFormatting(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if isFormattingCode(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripFormatting removes color and formatting codes from the text.
+//
+// Colors may have a foreground and background: \x03<fg>[,<bg>] where each is
+// up to two digits, or \x04<fg>[,<bg>] where each is six hex digits. We only
+// take a comma as part of the code if a color follows it.
+func stripFormatting(s string) string {
+	if !hasFormatting(s) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isFormattingCode(c) {
+			b.WriteByte(c)
+			continue
+		}
+
+		var isColorChar func(byte) bool
+		maxLen := 0
+		if c == formatColor {
+			isColorChar, maxLen = isDigit, 2
+		}
+		if c == formatHexColor {
+			isColorChar, maxLen = isHexDigit, 6
+		}
+		if isColorChar == nil {
+			continue
+		}
+
+		n := colorLength(s[i+1:], isColorChar, maxLen)
+		if n == 0 {
+			continue
+		}
+		i += n
+
+		if i+1 < len(s) && s[i+1] == ',' {
+			if n := colorLength(s[i+2:], isColorChar, maxLen); n > 0 {
+				i += 1 + n
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// colorLength counts how many of the leading bytes of s make up a color.
+func colorLength(s string, isColorChar func(byte) bool, maxLen int) int {
+	n := 0
+	for n < len(s) && n < maxLen && isColorChar(s[n]) {
+		n++
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// ctcpCommand finds the command of a CTCP message, such as VERSION in
+// "\x01VERSION\x01". It returns false if the text is not a CTCP message. The
+// closing \x01 is optional.
+func ctcpCommand(text string) (string, bool) {
+	if len(text) == 0 || text[0] != '\x01' {
+		return "", false
+	}
+
+	command := strings.TrimSuffix(text[1:], "\x01")
+	if idx := strings.IndexByte(command, ' '); idx != -1 {
+		command = command[:idx]
+	}
+	return strings.ToUpper(command), true
+}
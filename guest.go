@@ -0,0 +1,59 @@
+package terrarium
+
+import (
+	"strings"
+	"time"
+)
+
+// On a guest listener, clients need not send NICK or USER. We register them
+// with a nick such as Guest1234 and an ident to match, so kiosk style web
+// clients may connect without asking anything. Guests are otherwise like any
+// user: K-Lines, listener passwords, the PING cookie, and flood control apply
+// to them, and they may change nick once connected.
+//
+// A guest may still send PASS, CAP, and WEBIRC first, as well as NICK and USER
+// if they want to choose. We register them once they send anything else, or
+// once they've been connected GuestRegisterDelay without finishing. What they
+// didn't give we fill in.
+
+// GuestRegisterDelay is how long we give a client on a guest listener to
+// register before we register it as a guest.
+const GuestRegisterDelay = 2 * time.Second
+
+// guestPreRegisterCommands are the commands a guest may send before we
+// register them.
+var guestPreRegisterCommands = map[string]bool{
+	"CAP":    true,
+	"PASS":   true,
+	"WEBIRC": true,
+	"NICK":   true,
+	"USER":   true,
+	"PONG":   true,
+}
+
+// registerGuest registers a client on a guest listener.
+func (c *LocalClient) registerGuest() {
+	c.Guest = false
+
+	if c.PreRegDisplayNick == "" {
+		nick := c.guestNick()
+		if nick == "" {
+			c.quit("No guest nicknames available")
+			return
+		}
+		c.PreRegDisplayNick = nick
+	}
+
+	if c.PreRegUser == "" {
+		// We don't check ident, so it has ~ as with USER.
+		c.PreRegUser = "~" + strings.ToLower(c.PreRegDisplayNick)
+		if len(c.PreRegUser) > maxUsernameLength {
+			c.PreRegUser = c.PreRegUser[:maxUsernameLength]
+		}
+	}
+	if c.PreRegRealName == "" {
+		c.PreRegRealName = "Guest"
+	}
+
+	c.maybeRegisterUser()
+}
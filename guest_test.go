@@ -0,0 +1,97 @@
+package terrarium
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestMemNetworkGuestListener(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.GuestListeners = map[string]bool{"tls": true}
+		a.cb.setConfig(&cfg)
+	})
+
+	connect := func(listener string) *memClient {
+		ours, theirs := net.Pipe()
+		c := &memClient{conn: ours}
+		go c.readLoop()
+		a.cb.introduceClient(theirs, listener)
+		return c
+	}
+
+	// A guest who sends nothing we register after a moment.
+	guest := connect("tls/127.0.0.1:6697")
+	n.waitFor("guest to connect", func() bool {
+		ok := false
+		a.call(func() { ok = len(a.cb.LocalClients) == 1 })
+		return ok
+	})
+	n.advance(GuestRegisterDelay)
+	n.waitFor("guest to register", func() bool {
+		return guest.hasMessage(irc.ReplyWelcome)
+	})
+	nick := guest.lastMessage(irc.ReplyWelcome).Params[0]
+	if !strings.HasPrefix(nick, "Guest") {
+		t.Fatalf("guest registered as %s", nick)
+	}
+	a.call(func() {
+		user := a.cb.Users[a.cb.Nicks[canonicalizeNick(nick)]]
+		if user.Username != "~"+strings.ToLower(nick) || user.RealName != "Guest" {
+			t.Errorf("guest is %s!%s (%s)", nick, user.Username, user.RealName)
+		}
+	})
+
+	plain := connect("tcp/127.0.0.1:6667")
+	plain.send(irc.Message{Command: "PING", Params: []string{"x"}})
+	n.waitFor("PING reply", func() bool {
+		return plain.hasMessage("451") ||
+			plain.hasMessage("PONG")
+	})
+	if plain.hasMessage(irc.ReplyWelcome) {
+		t.Errorf("client on a listener without guests registered")
+	}
+
+	a.call(func() {
+		a.cb.KLines = append(a.cb.KLines, KLine{UserMask: "~guest*",
+			HostMask: "*", Reason: "no guests"})
+	})
+	banned := connect("tls/127.0.0.1:6697")
+	banned.send(irc.Message{Command: "LUSERS"})
+	n.waitFor("guest to be refused", func() bool {
+		return banned.hasMessage("465")
+	})
+
+	// Guests may give the listener's password and negotiate capabilities
+	// before we register them.
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ClientPassword = "secret"
+		a.cb.KLines = nil
+		a.cb.setConfig(&cfg)
+	})
+	capGuest := connect("tls/127.0.0.1:6697")
+	capGuest.send(irc.Message{Command: "PASS", Params: []string{"secret"}})
+	capGuest.send(irc.Message{Command: "CAP", Params: []string{"LS", "302"}})
+	n.waitFor("CAP LS", func() bool { return capGuest.hasMessage("CAP") })
+	n.advance(GuestRegisterDelay)
+	capGuest.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+	capGuest.send(irc.Message{Command: "VERSION"})
+	n.waitFor("guest to register and see VERSION", func() bool {
+		return capGuest.hasMessage(irc.ReplyWelcome) && capGuest.hasMessage("351")
+	})
+	if capGuest.hasMessage("464") {
+		t.Errorf("guest who gave the password got 464")
+	}
+
+	noPass := connect("tls/127.0.0.1:6697")
+	noPass.send(irc.Message{Command: "LUSERS"})
+	n.waitFor("guest without the password to be refused", func() bool {
+		return noPass.hasMessage("464")
+	})
+}
@@ -0,0 +1,350 @@
+package terrarium
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// helpTopic is what HELP says about a command.
+type helpTopic struct {
+	// Whether only operators may see it.
+	oper bool
+
+	lines []string
+}
+
+// helpTopics holds the help for each command, by command.
+var helpTopics = map[string]helpTopic{
+	"ACCEPT": {lines: []string{
+		"ACCEPT <nick>[,<nick>...]",
+		"While you are +g (caller ID), only users you ACCEPT may message you.",
+		"A nick starting with - removes them. ACCEPT * lists who you accept.",
+	}},
+	"ADMIN": {lines: []string{
+		"ADMIN [<server or nick>]",
+		"Shows who runs the server, or the server the user is on.",
+	}},
+	"AWAY": {lines: []string{
+		"AWAY [<message>]",
+		"Marks you away with the message. Those who message you see it.",
+		"Without a message, marks you back.",
+	}},
+	"CAP": {lines: []string{
+		"CAP LS|LIST|REQ|END [:<capabilities>]",
+		"Negotiates IRCv3 capabilities. LS lists those we offer and LIST those",
+		"you have. REQ turns them on, or off with a - before one.",
+	}},
+	"CNOTICE": {lines: []string{
+		"CNOTICE <nick> <channel> :<text>",
+		"Like CPRIVMSG, but sends a NOTICE.",
+	}},
+	"CPRIVMSG": {lines: []string{
+		"CPRIVMSG <nick> <channel> :<text>",
+		"Sends a PRIVMSG to a user on a channel where you are an operator or",
+		"halfop. It doesn't count toward how many users you may message.",
+	}},
+	"HELP": {lines: []string{
+		"HELP [<command>]",
+		"Explains a command. Without one, lists the commands.",
+	}},
+	"INVITE": {lines: []string{
+		"INVITE <nick> <channel>",
+		"Invites a user to a channel you are on, letting them join if it is +i.",
+		"Invites expire. Without parameters, lists the channels you're invited",
+		"to.",
+	}},
+	"ISON": {lines: []string{
+		"ISON <nick> [<nick>...]",
+		"Tells which of the nicks are online. Nicks no one may take, such as",
+		"reserved ones, count as online.",
+	}},
+	"JOIN": {lines: []string{
+		"JOIN <channel>[,<channel>...] [<key>[,<key>...]]",
+		"Joins channels. If a channel doesn't exist, you create it. A channel",
+		"with a key (+k) needs it.",
+	}},
+	"KICK": {lines: []string{
+		"KICK <channel> <nick>[,<nick>...] [:<reason>]",
+		"Removes users from a channel. Channel operators may kick anyone.",
+		"Halfops may kick those without ops or halfops.",
+	}},
+	"LINKS": {lines: []string{
+		"LINKS",
+		"Lists the servers in the network.",
+	}},
+	"LANGUAGE": {lines: []string{
+		"LANGUAGE [<language>[,<language>...]]",
+		"Chooses the language of some of the messages the server sends you. We",
+		"take the first we have. Without a language, lists those we have.",
+	}},
+	"LUSERS": {lines: []string{
+		"LUSERS [<mask> <server or nick>]",
+		"Shows how many users and servers there are. With a server, that",
+		"server answers. The mask is ignored.",
+	}},
+	"MAP": {lines: []string{
+		"MAP",
+		"Shows how the servers in the network link and how many users each has.",
+	}},
+	"MODE": {lines: []string{
+		"MODE <nick> [<modes>]",
+		"MODE <channel> [<modes> [<parameters>]]",
+		"Shows or changes your user modes or a channel's modes.",
+	}},
+	"MONITOR": {lines: []string{
+		"MONITOR +<nick>[,<nick>...]",
+		"MONITOR -<nick>[,<nick>...]",
+		"MONITOR C|L|S",
+		"Tells you when nicks come online or go offline. + adds nicks and - removes",
+		"them. C clears your list, L lists it, and S shows each nick's status.",
+		"Nicks no one may take, such as reserved ones, count as online.",
+	}},
+	"MOTD": {lines: []string{
+		"MOTD",
+		"Shows the message of the day.",
+	}},
+	"NAMES": {lines: []string{
+		"NAMES <channel>",
+		"Lists who is on a channel.",
+	}},
+	"NICK": {lines: []string{
+		"NICK <nick>",
+		"Changes your nick.",
+	}},
+	"NOTICE": {lines: []string{
+		"NOTICE <nick or channel> :<text>",
+		"Like PRIVMSG, but nothing replies to it automatically.",
+	}},
+	"OPER": {lines: []string{
+		"OPER <name> <password>",
+		"Makes you an IRC operator.",
+	}},
+	"PART": {lines: []string{
+		"PART <channel>[,<channel>...] [:<message>]",
+		"Leaves channels.",
+	}},
+	"PING": {lines: []string{
+		"PING <token> [<server>]",
+		"The server answers with a PONG with the token. With a server, that",
+		"server answers.",
+	}},
+	"PRIVMSG": {lines: []string{
+		"PRIVMSG <nick or channel> :<text>",
+		"Sends a message to a user or a channel.",
+	}},
+	"QUIT": {lines: []string{
+		"QUIT [:<message>]",
+		"Disconnects you.",
+	}},
+	"RELAYMSG": {lines: []string{
+		"RELAYMSG <channel> <name/network> :<text>",
+		"Sends a message to a channel as a user of another network. Only",
+		"relays, such as bridges, may use it.",
+	}},
+	"RULES": {lines: []string{
+		"RULES",
+		"Shows the server's rules.",
+	}},
+	"TIME": {lines: []string{
+		"TIME [<server or nick>]",
+		"Shows the time on the server, or on the server the user is on.",
+	}},
+	"TOPIC": {lines: []string{
+		"TOPIC <channel> [:<topic>]",
+		"Shows or changes a channel's topic.",
+	}},
+	"VERSION": {lines: []string{
+		"VERSION",
+		"Shows the server's version.",
+	}},
+	"WHO": {lines: []string{
+		"WHO <mask>",
+		"Lists users matching the mask, or on the channel.",
+	}},
+	"WHOIS": {lines: []string{
+		"WHOIS <nick>",
+		"Shows information about a user.",
+	}},
+	"WHOWAS": {lines: []string{
+		"WHOWAS <nick>",
+		"We don't remember users who left, so this always says there's no one.",
+	}},
+
+	"ALLOWRELINK": {oper: true, lines: []string{
+		"ALLOWRELINK [<server>]",
+		"Lets a server that split lately link through a different server than",
+		"before. Without a server, lists those that may not. See",
+		"relink-grace-time.",
+	}},
+	"CHECK": {oper: true, lines: []string{
+		"CHECK <nick or server>",
+		"Shows the state of a local user's or server's queues.",
+	}},
+	"CONNECT": {oper: true, lines: []string{
+		"CONNECT <server>",
+		"Connects to a server in servers.conf, even if its link is flapping.",
+	}},
+	"DIE": {oper: true, lines: []string{
+		"DIE",
+		"Shuts down the server.",
+	}},
+	"ETRACE": {oper: true, lines: []string{
+		"ETRACE [<nick>]",
+		"Lists the users on this server with their class, user, host, IP,",
+		"whether they use TLS, and real name.",
+	}},
+	"FINDUSER": {oper: true, lines: []string{
+		"FINDUSER <NICK|USER|HOST|REAL|ACCOUNT|ANY> <text> [<page>]",
+		"Lists users on the network with the text in their nick, username,",
+		"hostname, real name, account, or any of them. Shows 20 at a time.",
+	}},
+	"INVITES": {oper: true, lines: []string{
+		"INVITES [<nick or channel>]",
+		"Lists the invites users on this server have, or a user's or channel's.",
+	}},
+	"KILL": {oper: true, lines: []string{
+		"KILL <nick> [:<reason>]",
+		"Disconnects a user. Users on other servers need remote-kill.",
+	}},
+	"KLINE": {oper: true, lines: []string{
+		"KLINE [FORCE] [<minutes>] <user@host> [ON <server mask>] :<reason>",
+		"Bans matching users and disconnects them. Minutes make it temporary.",
+		"If it matches many users, it says how many. Give FORCE to apply it.",
+	}},
+	"MASSKILL": {oper: true, lines: []string{
+		"MASSKILL [CONFIRM] <user@host or user@CIDR> [:<reason>]",
+		"Disconnects local users matching the mask. Without CONFIRM, it shows",
+		"who matches. Then give CONFIRM with the same mask.",
+	}},
+	"OPERMOTD": {oper: true, lines: []string{
+		"OPERMOTD",
+		"Shows the message of the day for operators.",
+	}},
+	"OPME": {oper: true, lines: []string{
+		"OPME <channel>",
+		"Gives you operator status on a channel.",
+	}},
+	"REHASH": {oper: true, lines: []string{
+		"REHASH",
+		"Reloads the configuration.",
+	}},
+	"RESTART": {oper: true, lines: []string{
+		"RESTART",
+		"Restarts the server.",
+	}},
+	"SET": {oper: true, lines: []string{
+		"SET DEBUG [<subsystem> <ON|OFF>]",
+		"SET NOTICES [<category> <ON|OFF>]",
+		"Turns verbose logging for a subsystem (dns, flood, or s2s) on or off.",
+		"Without a subsystem, shows which are on. NOTICES turns the notices you",
+		"get about connects, klines, links, or spam on or off, and remembers",
+		"your choice for when you next OPER.",
+	}},
+	"SQUIT": {oper: true, lines: []string{
+		"SQUIT <server> [:<reason>]",
+		"Delinks a server.",
+	}},
+	"STATS": {oper: true, lines: []string{
+		"STATS <query>",
+		"c: The servers we connect to and how linking to each is going.",
+		"h: How many users, channels, and servers there were over the last hour.",
+		"k: K-lines.",
+		"z: Memory use, the event queue, and how many client IDs we've used.",
+	}},
+	"TRACE": {oper: true, lines: []string{
+		"TRACE [<server or nick>]",
+		"Lists the connections to a server, or shows a user. Shows each server",
+		"on the way there.",
+	}},
+	"UNKLINE": {oper: true, lines: []string{
+		"UNKLINE <user@host> [ON <server mask>]",
+		"Removes a K-line.",
+	}},
+	"VERSIONSURVEY": {oper: true, lines: []string{
+		"VERSIONSURVEY [START|STOP]",
+		"Asks the users on this server what client they use, a few at a time,",
+		"and counts the answers by client. Without START or STOP, shows the",
+		"counts.",
+	}},
+	"WALLOPS": {oper: true, lines: []string{
+		"WALLOPS :<text>",
+		"Sends a message to all operators on the network.",
+	}},
+}
+
+// helpIndexWidth is how many commands we list per line of the index.
+const helpIndexWidth = 8
+
+// HELP explains a command. Operator commands are only for operators. Without
+// a command, we list the commands.
+//
+// Parameters: [<command>]
+func (u *LocalUser) helpCommand(m irc.Message) {
+	subject := "*"
+	if len(m.Params) > 0 && m.Params[0] != "" {
+		subject = strings.ToUpper(m.Params[0])
+	}
+
+	var lines []string
+	if subject == "*" {
+		lines = u.helpIndex()
+	} else {
+		topic, exists := helpTopics[subject]
+		if !exists || (topic.oper && !u.User.isOperator()) {
+			// 524 ERR_HELPNOTFOUND
+			u.messageFromServer("524", []string{subject,
+				"No help available on this topic"})
+			return
+		}
+		lines = topic.lines
+	}
+
+	// 704 RPL_HELPSTART
+	u.messageFromServer("704", []string{subject, lines[0]})
+	for _, line := range lines[1:] {
+		// 705 RPL_HELPTXT
+		u.messageFromServer("705", []string{subject, line})
+	}
+	// 706 RPL_ENDOFHELP
+	u.messageFromServer("706", []string{subject, "End of /HELP"})
+}
+
+// helpIndex lists the commands the user may ask about.
+func (u *LocalUser) helpIndex() []string {
+	var commands, operCommands []string
+	for command, topic := range helpTopics {
+		if !topic.oper {
+			commands = append(commands, command)
+			continue
+		}
+		if u.User.isOperator() {
+			operCommands = append(operCommands, command)
+		}
+	}
+	sort.Strings(commands)
+	sort.Strings(operCommands)
+
+	lines := []string{"HELP <command> explains a command. Commands:"}
+	lines = append(lines, helpIndexLines(commands)...)
+	if len(operCommands) > 0 {
+		lines = append(lines, "Operator commands:")
+		lines = append(lines, helpIndexLines(operCommands)...)
+	}
+	return lines
+}
+
+// helpIndexLines lays out commands a few to a line.
+func helpIndexLines(commands []string) []string {
+	var lines []string
+	for len(commands) > 0 {
+		n := len(commands)
+		if n > helpIndexWidth {
+			n = helpIndexWidth
+		}
+		lines = append(lines, strings.Join(commands[:n], " "))
+		commands = commands[n:]
+	}
+	return lines
+}
@@ -0,0 +1,41 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// HELP explains commands. Only operators get help on operator commands.
+func TestMemNetworkHelp(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+
+	alice.send(irc.Message{Command: "HELP"})
+	n.waitFor("alice to get the index", func() bool {
+		return alice.hasMessage("706")
+	})
+	if alice.hasMessageContaining("705", "KLINE") {
+		t.Errorf("alice saw operator commands in the index")
+	}
+
+	alice.send(irc.Message{Command: "HELP", Params: []string{"privmsg"}})
+	n.waitFor("alice to get help on PRIVMSG", func() bool {
+		m := alice.lastMessage("704")
+		return m != nil && m.Params[1] == "PRIVMSG"
+	})
+
+	alice.send(irc.Message{Command: "HELP", Params: []string{"KLINE"}})
+	n.waitFor("alice to be refused help on KLINE", func() bool {
+		return alice.hasMessage("524")
+	})
+
+	a.makeOper("alice")
+	alice.send(irc.Message{Command: "HELP", Params: []string{"KLINE"}})
+	n.waitFor("alice to get help on KLINE", func() bool {
+		m := alice.lastMessage("704")
+		return m != nil && m.Params[1] == "KLINE"
+	})
+}
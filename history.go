@@ -0,0 +1,101 @@
+package terrarium
+
+import (
+	"fmt"
+	"time"
+)
+
+// We count the users, channels, and servers every historyInterval and keep
+// the counts for a while, so operators can see how the network grows and when
+// something happened to it, such as a split or a flood of clients, without
+// running their own monitoring. STATS h and HISTORY on the admin socket show
+// them.
+
+// historyInterval is how often we count.
+const historyInterval = 5 * time.Minute
+
+// historySize is how many counts we keep. A day's worth.
+const historySize = 288
+
+// historyStatsSamples is how many counts STATS h shows. An hour's worth.
+const historyStatsSamples = 12
+
+// historySample is what we counted at one time.
+type historySample struct {
+	Time         time.Time
+	Users        int
+	LocalUsers   int
+	Channels     int
+	Servers      int
+	LocalServers int
+}
+
+// String describes the sample.
+func (s historySample) String() string {
+	return fmt.Sprintf("%s users %d (%d local) channels %d servers %d (%d linked to us)",
+		s.Time.UTC().Format("2006-01-02 15:04 MST"), s.Users, s.LocalUsers,
+		s.Channels, s.Servers, s.LocalServers)
+}
+
+// history holds the most recent historySize samples, overwriting the oldest
+// once it's full.
+type history struct {
+	samples [historySize]historySample
+
+	// Where the next sample goes.
+	next int
+
+	// How many samples we have, up to historySize.
+	count int
+}
+
+// add records a sample.
+func (h *history) add(s historySample) {
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % historySize
+	if h.count < historySize {
+		h.count++
+	}
+}
+
+// recent returns up to n of the latest samples, oldest first.
+func (h *history) recent(n int) []historySample {
+	if n > h.count {
+		n = h.count
+	}
+
+	samples := make([]historySample, 0, n)
+	for i := n; i > 0; i-- {
+		samples = append(samples, h.samples[(h.next-i+historySize)%historySize])
+	}
+	return samples
+}
+
+// recordHistory counts the users, channels, and servers if it's been
+// historyInterval since we last did.
+func (cb *Catbox) recordHistory() {
+	now := cb.now()
+	if !cb.HistoryRecordedAt.IsZero() &&
+		now.Sub(cb.HistoryRecordedAt) < historyInterval {
+		return
+	}
+	cb.HistoryRecordedAt = now
+
+	cb.History.add(historySample{
+		Time:         now,
+		Users:        len(cb.Users),
+		LocalUsers:   len(cb.LocalUsers),
+		Channels:     len(cb.Channels),
+		Servers:      len(cb.Servers) + 1,
+		LocalServers: len(cb.LocalServers),
+	})
+}
+
+// historyLines describes up to n of the latest samples, oldest first.
+func (cb *Catbox) historyLines(n int) []string {
+	var lines []string
+	for _, sample := range cb.History.recent(n) {
+		lines = append(lines, sample.String())
+	}
+	return lines
+}
@@ -0,0 +1,33 @@
+package terrarium
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	var h history
+	if got := h.recent(5); len(got) != 0 {
+		t.Fatalf("empty history has %d samples", len(got))
+	}
+
+	start := time.Unix(0, 0)
+	for i := 0; i < historySize+3; i++ {
+		h.add(historySample{Time: start.Add(time.Duration(i) * historyInterval),
+			Users: i})
+	}
+
+	got := h.recent(2)
+	if len(got) != 2 || got[0].Users != historySize+1 ||
+		got[1].Users != historySize+2 {
+		t.Errorf("recent(2) = %+v, wanted the last two", got)
+	}
+
+	// We keep only the latest historySize.
+	got = h.recent(historySize + 10)
+	if len(got) != historySize || got[0].Users != 3 ||
+		got[historySize-1].Users != historySize+2 {
+		t.Errorf("recent(all) has %d samples from %d to %d", len(got),
+			got[0].Users, got[len(got)-1].Users)
+	}
+}
@@ -0,0 +1,250 @@
+package terrarium
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// terrarium -init writes a configuration to start from: terrarium.conf,
+// opers.conf, servers.conf (with no servers), and a self-signed certificate
+// for TLS. It asks for the few settings that matter, unless given them as
+// flags. The rest keep their defaults. See conf/catbox.conf for every setting.
+
+// initCertificateValidity is how long the certificate we generate is good
+// for.
+const initCertificateValidity = 365 * 24 * time.Hour
+
+// InitOptions are the settings for a new configuration. We ask for those that
+// are blank if Interactive is set, and otherwise use defaults. We make up an
+// operator password if there isn't one.
+type InitOptions struct {
+	// Directory to write the configuration to.
+	Dir string
+
+	ServerName   string
+	NetworkName  string
+	OperName     string
+	OperPassword string
+
+	// Whether to ask for settings.
+	Interactive bool
+}
+
+// InitConfig writes a new configuration. It won't overwrite existing files.
+// We ask for settings on in and tell what we did on out.
+func InitConfig(opts InitOptions, in io.Reader, out io.Writer) error {
+	dir, err := filepath.Abs(opts.Dir)
+	if err != nil {
+		return fmt.Errorf("unable to determine path to %s: %s", opts.Dir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"conf":    filepath.Join(dir, "terrarium.conf"),
+		"opers":   filepath.Join(dir, "opers.conf"),
+		"servers": filepath.Join(dir, "servers.conf"),
+		"cert":    filepath.Join(dir, "certificate.pem"),
+		"key":     filepath.Join(dir, "key.pem"),
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists", file)
+		}
+	}
+
+	defaultServerName := "irc.example.com"
+	if hostname, err := os.Hostname(); err == nil && strings.Contains(hostname,
+		".") {
+		defaultServerName = hostname
+	}
+
+	r := bufio.NewReader(in)
+	settings := []struct {
+		value    *string
+		question string
+		def      string
+		valid    func(string) bool
+	}{
+		{&opts.ServerName, "Server name", defaultServerName, isValidInitServerName},
+		{&opts.NetworkName, "Network name", "terrarium", isValidInitWord},
+		{&opts.OperName, "Operator name", "admin", isValidInitWord},
+	}
+	for _, setting := range settings {
+		if *setting.value == "" {
+			*setting.value = setting.def
+			if opts.Interactive {
+				answer, err := askInit(r, out, setting.question, setting.def)
+				if err != nil {
+					return err
+				}
+				*setting.value = answer
+			}
+		}
+		if !setting.valid(*setting.value) {
+			return fmt.Errorf("%s is not a valid %s", *setting.value,
+				strings.ToLower(setting.question))
+		}
+	}
+
+	generatedPassword := false
+	if opts.OperPassword == "" {
+		password, err := randomInitString(initPasswordChars, 16)
+		if err != nil {
+			return err
+		}
+		opts.OperPassword = password
+		generatedPassword = true
+	}
+	if strings.ContainsAny(opts.OperPassword, ", \t") {
+		return fmt.Errorf("the operator password may not contain commas or spaces")
+	}
+
+	sid, err := randomSID()
+	if err != nil {
+		return err
+	}
+
+	if err := GenerateCertificate(CertificateOptions{
+		Hostnames: []string{opts.ServerName},
+		ValidFor:  initCertificateValidity,
+		CertFile:  files["cert"],
+		KeyFile:   files["key"],
+	}); err != nil {
+		return err
+	}
+
+	conf := fmt.Sprintf(`# Generated by terrarium -init on %s.
+#
+# See conf/catbox.conf in terrarium's source for every setting.
+
+server-name = %s
+server-info = IRC
+network-name = %s
+
+# Must be unique in the network. We picked this at random.
+ts6-sid = %s
+
+listen-host = 0.0.0.0
+listen-port = 6667
+listen-port-tls = 6697
+certificate-file = %s
+key-file = %s
+
+opers-config = %s
+servers-config = %s
+`, time.Now().Format("2006-01-02"), opts.ServerName, opts.NetworkName, sid,
+		files["cert"], files["key"], files["opers"], files["servers"])
+
+	opers := fmt.Sprintf(`# Format: name = password[,privilege...]
+#
+# See conf/opers.conf in terrarium's source for the privileges.
+%s = %s
+`, opts.OperName, opts.OperPassword)
+
+	servers := `# Format: Name = host,port,password,TLS (0 or 1)
+#
+# See conf/servers.conf in terrarium's source for more.
+#irc2.example.com = 192.0.2.10,6697,password,1
+`
+
+	for _, f := range []struct {
+		file, content string
+		mode          os.FileMode
+	}{
+		{files["conf"], conf, 0644},
+		{files["opers"], opers, 0600},
+		{files["servers"], servers, 0600},
+	} {
+		if err := writeNewFile(f.file, f.content, f.mode); err != nil {
+			return err
+		}
+	}
+
+	_, _ = fmt.Fprintf(out, "Wrote a configuration to %s.\n", dir)
+	if generatedPassword {
+		_, _ = fmt.Fprintf(out, "Operator %s's password is %s\n", opts.OperName,
+			opts.OperPassword)
+	}
+	_, _ = fmt.Fprintf(out, "Start the server with: terrarium -conf %s\n",
+		files["conf"])
+	return nil
+}
+
+// askInit asks a question and returns the answer, or def if the answer is
+// blank.
+func askInit(r *bufio.Reader, out io.Writer, question,
+	def string) (string, error) {
+	_, _ = fmt.Fprintf(out, "%s [%s]: ", question, def)
+	answer, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", fmt.Errorf("unable to read answer: %s", err)
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// isValidInitServerName checks a server name. It must have a dot so it can't
+// be a nick.
+func isValidInitServerName(s string) bool {
+	return isValidHostname(s) && strings.Contains(s, ".")
+}
+
+// isValidInitWord checks a network or operator name: one word that is fine
+// in a config file.
+func isValidInitWord(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "=,# \t")
+}
+
+// initPasswordChars are the characters in passwords we make up.
+const initPasswordChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// randomSID makes up a TS6 SID.
+func randomSID() (TS6SID, error) {
+	first, err := randomInitString("0123456789", 1)
+	if err != nil {
+		return "", err
+	}
+	rest, err := randomInitString("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ", 2)
+	if err != nil {
+		return "", err
+	}
+	return TS6SID(first + rest), nil
+}
+
+// randomInitString makes up a string of n of the characters.
+func randomInitString(chars string, n int) (string, error) {
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// writeNewFile writes content to a file that must not exist yet.
+func writeNewFile(file, content string, mode os.FileMode) error {
+	fh, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.WriteString(content); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("unable to write %s: %s", file, err)
+	}
+	return fh.Close()
+}
@@ -0,0 +1,69 @@
+package terrarium
+
+import (
+	"bytes"
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// -init writes a configuration we can run with, asking for what it wasn't
+// given.
+func TestInitConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	// We're asked for the server name and then the network name. We take the
+	// default network name.
+	in := strings.NewReader("irc.test.example\n\n")
+	var out bytes.Buffer
+	if err := InitConfig(InitOptions{
+		Dir:         dir,
+		OperName:    "root",
+		Interactive: true,
+	}, in, &out); err != nil {
+		t.Fatalf("InitConfig: %s", err)
+	}
+
+	if !strings.Contains(out.String(), "Operator root's password is ") {
+		t.Errorf("we weren't told the password we made up: %q", out.String())
+	}
+
+	cfg, err := checkAndParseConfig(filepath.Join(dir, "terrarium.conf"))
+	if err != nil {
+		t.Fatalf("parsing the configuration: %s", err)
+	}
+	if cfg.ServerName != "irc.test.example" {
+		t.Errorf("server name is %s", cfg.ServerName)
+	}
+	if cfg.NetworkName != "terrarium" {
+		t.Errorf("network name is %s", cfg.NetworkName)
+	}
+	if _, exists := cfg.Opers["root"]; !exists {
+		t.Errorf("there's no operator root")
+	}
+	if !isValidSID(string(cfg.TS6SID)) {
+		t.Errorf("SID %s is not valid", cfg.TS6SID)
+	}
+	if cfg.ListenPortTLS != "6697" {
+		t.Errorf("TLS port is %s", cfg.ListenPortTLS)
+	}
+
+	cert, err := readCertificate(cfg.CertificateFile, cfg.KeyFile)
+	if err != nil {
+		t.Fatalf("reading the certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing the certificate: %s", err)
+	}
+	if err := leaf.VerifyHostname("irc.test.example"); err != nil {
+		t.Errorf("certificate is not for the server: %s", err)
+	}
+
+	// We don't overwrite a configuration.
+	if err := InitConfig(InitOptions{Dir: dir}, strings.NewReader(""),
+		&out); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("InitConfig over an existing configuration = %v", err)
+	}
+}
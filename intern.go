@@ -0,0 +1,97 @@
+package terrarium
+
+// stringTable interns strings so that many references to equal strings share
+// a single backing allocation. For example, thousands of users may share the
+// same hostname.
+//
+// Entries are reference counted. When the last reference to a string is
+// released we forget it so the table does not grow without bound.
+//
+// It is not safe for concurrent use. Only the server goroutine should use it.
+//
+// We intern what many users share but each arrives with its own copy of:
+// hostnames, IPs, and real names. Server and channel names need no table.
+// Users refer to their Server rather than holding its name, and we key each
+// user's channels by the Channel's own Name, so each name is held once however
+// many refer to it.
+type stringTable struct {
+	strings map[string]*internedString
+
+	// Total length in bytes of the strings in the table.
+	bytes int
+}
+
+type internedString struct {
+	s    string
+	refs int
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{
+		strings: make(map[string]*internedString),
+	}
+}
+
+// intern returns the canonical copy of s and records a reference to it.
+//
+// Every call must be paired with a call to release once the caller no longer
+// holds the string.
+func (t *stringTable) intern(s string) string {
+	if s == "" {
+		return s
+	}
+
+	if is, exists := t.strings[s]; exists {
+		is.refs++
+		return is.s
+	}
+
+	t.strings[s] = &internedString{s: s, refs: 1}
+	t.bytes += len(s)
+	return s
+}
+
+// release drops a reference to s. If it was the last reference, we forget the
+// string.
+func (t *stringTable) release(s string) {
+	is, exists := t.strings[s]
+	if !exists {
+		return
+	}
+
+	is.refs--
+	if is.refs > 0 {
+		return
+	}
+
+	delete(t.strings, s)
+	t.bytes -= len(s)
+}
+
+// refs returns the total number of references held to strings in the table.
+func (t *stringTable) refs() int {
+	n := 0
+	for _, is := range t.strings {
+		n += is.refs
+	}
+	return n
+}
+
+// internUser replaces the user's frequently duplicated strings with interned
+// copies.
+//
+// Call this once the user's hostname is final (i.e., after applying any
+// spoof).
+func (cb *Catbox) internUser(u *User) {
+	u.Hostname = cb.Strings.intern(u.Hostname)
+	u.IP = cb.Strings.intern(u.IP)
+	// Web clients and guests often share a real name.
+	u.RealName = cb.Strings.intern(u.RealName)
+}
+
+// releaseUser drops the references internUser took.
+func (cb *Catbox) releaseUser(u *User) {
+	cb.Strings.release(u.Hostname)
+	cb.Strings.release(u.IP)
+	cb.Strings.release(u.RealName)
+}
@@ -1,8 +1,19 @@
 package terrarium
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/horgh/irc"
 )
 
 func TestCanonicalizeNick(t *testing.T) {
@@ -171,6 +182,45 @@ func TestUserMatchesMask(t *testing.T) {
 	}
 }
 
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask   string
+		input  string
+		output bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"?", "", false},
+		{"?", "a", true},
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"abc", "xabc", false},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"*.example.com", "irc.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"127.0.0.?", "127.0.0.1", true},
+		{"127.0.0.?", "127.0.0.10", false},
+		{"1.2.3.4", "11.2.3.45", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b*", "xxbxxaxx", false},
+		{"**", "abc", true},
+		{"a*b*c", "abcbc", true},
+		{"a*?", "a", false},
+		{"a*?", "ab", true},
+	}
+
+	for _, test := range tests {
+		output := matchMask(test.mask, test.input)
+		if output != test.output {
+			t.Errorf("matchMask(%q, %q) = %v, wanted %v", test.mask, test.input,
+				output, test.output)
+		}
+	}
+}
+
 func TestParseAndResolveUmodeChanges(t *testing.T) {
 	tests := []struct {
 		inputModes         string
@@ -196,6 +246,14 @@ func TestParseAndResolveUmodeChanges(t *testing.T) {
 			outputUnknownModes: map[byte]struct{}{},
 			success:            true,
 		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'i': {}},
+			inputModes:         "+p",
+			outputSetModes:     map[byte]struct{}{'p': {}},
+			outputUnsetModes:   map[byte]struct{}{},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
 		{
 			inputCurrentModes:  map[byte]struct{}{'o': {}},
 			inputModes:         "+C-C",
@@ -738,3 +796,1142 @@ func TestIssueKillToAllServers(t *testing.T) {
 		}
 	}
 }
+
+func TestAddAndApplyKLines(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName: "irc.example.com",
+			TS6SID:     "000",
+		},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		Opers:        map[TS6UID]*User{},
+		Users:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		HostUsers:    map[string]map[uint64]*LocalUser{},
+		Strings:      newStringTable(),
+	}
+
+	users := []*LocalUser{
+		newTestLocalUser(cb, 0, "one", "~one", "host1.example.com"),
+		newTestLocalUser(cb, 1, "two", "~two", "host1.example.com"),
+		newTestLocalUser(cb, 2, "three", "~three", "host2.example.com"),
+		newTestLocalUser(cb, 3, "four", "~four", "host3.example.org"),
+	}
+
+	cb.addAndApplyKLines([]KLine{
+		{UserMask: "~one", HostMask: "host1.example.com", Reason: "exact"},
+		{UserMask: "*", HostMask: "*.example.org", Reason: "wildcard"},
+		{UserMask: "~one", HostMask: "host1.example.com", Reason: "duplicate"},
+	}, "test")
+
+	if len(cb.KLines) != 2 {
+		t.Errorf("have %d K-Lines, wanted %d", len(cb.KLines), 2)
+	}
+
+	for _, test := range []struct {
+		user      *LocalUser
+		connected bool
+	}{
+		{users[0], false},
+		{users[1], true},
+		{users[2], true},
+		{users[3], false},
+	} {
+		_, connected := cb.LocalUsers[test.user.ID]
+		if connected != test.connected {
+			t.Errorf("user %s connected = %v, wanted %v", test.user.User.DisplayNick,
+				connected, test.connected)
+		}
+
+		_, indexed := cb.HostUsers[test.user.User.Hostname][test.user.ID]
+		if indexed != test.connected {
+			t.Errorf("user %s indexed = %v, wanted %v", test.user.User.DisplayNick,
+				indexed, test.connected)
+		}
+	}
+
+	if _, exists := cb.HostUsers["host3.example.org"]; exists {
+		t.Errorf("empty host index entry was not removed")
+	}
+
+	if _, exists := cb.Strings.strings["host3.example.org"]; exists {
+		t.Errorf("interned hostname of disconnected user was not released")
+	}
+}
+
+func TestStringTable(t *testing.T) {
+	table := newStringTable()
+
+	a := table.intern("example.com")
+	b := table.intern("example.com")
+
+	if len(table.strings) != 1 || table.bytes != len("example.com") ||
+		table.refs() != 2 {
+		t.Errorf("table has %d strings, %d bytes, %d refs, wanted 1, %d, 2",
+			len(table.strings), table.bytes, table.refs(), len("example.com"))
+	}
+
+	table.release(a)
+	if len(table.strings) != 1 {
+		t.Errorf("string released while still referenced")
+	}
+
+	table.release(b)
+	if len(table.strings) != 0 || table.bytes != 0 {
+		t.Errorf("string not forgotten after last release")
+	}
+
+	table.release("unknown")
+	if table.intern("") != "" || len(table.strings) != 0 {
+		t.Errorf("empty string was interned")
+	}
+}
+
+func TestInternUser(t *testing.T) {
+	cb := &Catbox{Strings: newStringTable()}
+
+	one := &User{Hostname: "gateway.example.com", IP: "192.0.2.1",
+		RealName: "Guest"}
+	two := &User{Hostname: "gateway.example.com", IP: "192.0.2.1",
+		RealName: "Guest"}
+	cb.internUser(one)
+	cb.internUser(two)
+
+	if len(cb.Strings.strings) != 3 || cb.Strings.refs() != 6 {
+		t.Errorf("have %d strings with %d references, wanted 3 with 6",
+			len(cb.Strings.strings), cb.Strings.refs())
+	}
+
+	cb.releaseUser(one)
+	if _, exists := cb.Strings.strings["Guest"]; !exists {
+		t.Errorf("real name was released while a user still has it")
+	}
+
+	cb.releaseUser(two)
+	if len(cb.Strings.strings) != 0 || cb.Strings.bytes != 0 {
+		t.Errorf("have %d strings (%d bytes) after releasing every user",
+			len(cb.Strings.strings), cb.Strings.bytes)
+	}
+}
+
+func TestCanonicalizeChannelMask(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"Nick", "nick!*@*"},
+		{"~User@Host.Example.com", "*!~user@host.example.com"},
+		{"nick!user", "nick!user@*"},
+		{"[Nick]!*@*", "{nick}!*@*"},
+		{"*!*@*.example.com", "*!*@*.example.com"},
+		{"", ""},
+		{":nick", ""},
+		{"a b", ""},
+	}
+
+	for _, test := range tests {
+		output := canonicalizeChannelMask(test.input)
+		if output != test.output {
+			t.Errorf("canonicalizeChannelMask(%q) = %q, wanted %q", test.input,
+				output, test.output)
+		}
+	}
+}
+
+func TestCanJoinInviteOnly(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName: "irc.example.com",
+			TS6SID:     "000",
+		},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		Opers:        map[TS6UID]*User{},
+		Users:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		HostUsers:    map[string]map[uint64]*LocalUser{},
+		Strings:      newStringTable(),
+	}
+
+	excepted := newTestLocalUser(cb, 0, "One", "~one", "host1.example.com")
+	invited := newTestLocalUser(cb, 1, "two", "~two", "host2.example.com")
+	other := newTestLocalUser(cb, 2, "three", "~three", "host2.example.com")
+
+	channel := &Channel{
+		Name:             "#test",
+		Members:          map[TS6UID]struct{}{},
+		Ops:              map[TS6UID]*User{},
+		Halfops:          map[TS6UID]*User{},
+		Voiced:           map[TS6UID]*User{},
+		Modes:            map[byte]struct{}{},
+		InviteExceptions: map[string]*ListEntry{},
+	}
+
+	if !other.canJoinInviteOnly(channel) {
+		t.Errorf("user cannot join channel that is not +i")
+	}
+
+	channel.Modes['i'] = struct{}{}
+	channel.addInviteException(canonicalizeChannelMask("one!*@*.example.com"),
+		"irc.example.com", 0)
+	invited.addInvite(channel.Name, "One!~one@host1.example.com")
+
+	if !excepted.canJoinInviteOnly(channel) {
+		t.Errorf("user matching invite exception cannot join")
+	}
+	if !invited.canJoinInviteOnly(channel) {
+		t.Errorf("invited user cannot join")
+	}
+	if other.canJoinInviteOnly(channel) {
+		t.Errorf("user can join +i channel without invite or exception")
+	}
+
+	cb.Config.InviteExpiry = time.Minute
+	invited.Invites[channel.Name].Time = time.Now().Add(-2 * time.Minute)
+	if invited.canJoinInviteOnly(channel) {
+		t.Errorf("user can join with an expired invite")
+	}
+
+	if !channel.removeInviteException("one!*@*.example.com") {
+		t.Errorf("unable to remove invite exception")
+	}
+	if excepted.canJoinInviteOnly(channel) {
+		t.Errorf("user can join after removing invite exception")
+	}
+}
+
+func TestChannelStatus(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName: "irc.example.com",
+			TS6SID:     "000",
+		},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		Opers:        map[TS6UID]*User{},
+		Users:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		HostUsers:    map[string]map[uint64]*LocalUser{},
+		Strings:      newStringTable(),
+	}
+
+	op := newTestLocalUser(cb, 0, "op", "~op", "host1.example.com")
+	halfop := newTestLocalUser(cb, 1, "halfop", "~halfop", "host1.example.com")
+	both := newTestLocalUser(cb, 2, "both", "~both", "host1.example.com")
+	member := newTestLocalUser(cb, 3, "member", "~member", "host1.example.com")
+	voiced := newTestLocalUser(cb, 4, "voiced", "~voiced", "host1.example.com")
+
+	channel := &Channel{
+		Name:             "#test",
+		Members:          map[TS6UID]struct{}{},
+		Ops:              map[TS6UID]*User{},
+		Halfops:          map[TS6UID]*User{},
+		Voiced:           map[TS6UID]*User{},
+		Modes:            map[byte]struct{}{},
+		InviteExceptions: map[string]*ListEntry{},
+	}
+	cb.Channels = map[string]*Channel{channel.Name: channel}
+
+	for _, u := range []*LocalUser{op, halfop, both, member, voiced} {
+		channel.Members[u.User.UID] = struct{}{}
+		u.User.Channels[channel.Name] = channel
+	}
+	channel.grantOps(op.User)
+	channel.grantHalfops(halfop.User)
+	channel.grantOps(both.User)
+	channel.grantHalfops(both.User)
+	channel.grantVoice(voiced.User)
+
+	tests := []struct {
+		user           *LocalUser
+		prefix         string
+		prefixes       string
+		prefixesNoHOPS string
+		canAct         bool
+		canKickMember  bool
+		canKickHalfop  bool
+		canVoice       bool
+		canSetModes    bool
+	}{
+		{op, "@", "@", "@", true, true, true, true, true},
+		{halfop, "%", "%", "", true, true, false, true, false},
+		{both, "@", "@%", "@", true, true, true, true, true},
+		{member, "", "", "", false, false, false, false, false},
+		{voiced, "+", "+", "+", false, false, false, false, false},
+	}
+
+	for _, test := range tests {
+		if got := channel.memberPrefix(test.user.User); got != test.prefix {
+			t.Errorf("memberPrefix(%s) = %q, wanted %q", test.user.User.DisplayNick,
+				got, test.prefix)
+		}
+		if got := channel.memberPrefixes(test.user.User, true); got != test.prefixes {
+			t.Errorf("memberPrefixes(%s, true) = %q, wanted %q",
+				test.user.User.DisplayNick, got, test.prefixes)
+		}
+		if got := channel.memberPrefixes(test.user.User, false); got !=
+			test.prefixesNoHOPS {
+			t.Errorf("memberPrefixes(%s, false) = %q, wanted %q",
+				test.user.User.DisplayNick, got, test.prefixesNoHOPS)
+		}
+		if got := channel.userHasHalfopsOrOps(test.user.User); got != test.canAct {
+			t.Errorf("userHasHalfopsOrOps(%s) = %v, wanted %v",
+				test.user.User.DisplayNick, got, test.canAct)
+		}
+		if got := channel.canKick(test.user.User, member.User); got !=
+			test.canKickMember {
+			t.Errorf("canKick(%s, member) = %v, wanted %v",
+				test.user.User.DisplayNick, got, test.canKickMember)
+		}
+		if got := channel.canKick(test.user.User, halfop.User); got !=
+			test.canKickHalfop {
+			t.Errorf("canKick(%s, halfop) = %v, wanted %v",
+				test.user.User.DisplayNick, got, test.canKickHalfop)
+		}
+		if got := channel.canChangeModes(test.user.User, "+v-v"); got !=
+			test.canVoice {
+			t.Errorf("canChangeModes(%s, +v-v) = %v, wanted %v",
+				test.user.User.DisplayNick, got, test.canVoice)
+		}
+		if got := channel.canChangeModes(test.user.User, "+vi"); got !=
+			test.canSetModes {
+			t.Errorf("canChangeModes(%s, +vi) = %v, wanted %v",
+				test.user.User.DisplayNick, got, test.canSetModes)
+		}
+	}
+
+	// Losing a TS battle clears all statuses.
+	channel.clearModes(cb)
+	if len(channel.Ops) != 0 || len(channel.Halfops) != 0 ||
+		len(channel.Voiced) != 0 {
+		t.Errorf("statuses remain after clearing modes: %d ops, %d halfops, %d voiced",
+			len(channel.Ops), len(channel.Halfops), len(channel.Voiced))
+	}
+
+	// Everyone was told.
+	m := <-member.WriteChan
+	if m.Command != "MODE" || m.Params[1] != "-oo" {
+		t.Errorf("unexpected message clearing ops: %s", m)
+	}
+	m = <-member.WriteChan
+	if m.Command != "MODE" || m.Params[1] != "-hh" {
+		t.Errorf("unexpected message clearing halfops: %s", m)
+	}
+	m = <-member.WriteChan
+	if m.Command != "MODE" || m.Params[1] != "-v" || m.Params[2] != "voiced" {
+		t.Errorf("unexpected message clearing voices: %s", m)
+	}
+}
+
+func TestChannelSimpleModes(t *testing.T) {
+	channel := &Channel{Modes: map[byte]struct{}{}}
+
+	tests := []struct {
+		action  rune
+		mode    byte
+		changed bool
+		modes   string
+	}{
+		{'+', 'n', true, "+n"},
+		{'+', 'n', false, "+n"},
+		{'+', 's', true, "+ns"},
+		{'-', 'n', true, "+s"},
+		{'-', 'n', false, "+s"},
+		{'-', 's', true, "+"},
+	}
+
+	for _, test := range tests {
+		if got := channel.applySimpleMode(test.action, test.mode); got !=
+			test.changed {
+			t.Errorf("applySimpleMode(%c, %c) = %v, wanted %v", test.action,
+				test.mode, got, test.changed)
+		}
+		if got := channel.modesString(); got != test.modes {
+			t.Errorf("after %c%c modes are %s, wanted %s", test.action, test.mode,
+				got, test.modes)
+		}
+	}
+
+	for _, mode := range DefaultChannelModes {
+		if !isSimpleChannelMode(byte(mode)) {
+			t.Errorf("default mode %c is not a simple mode", mode)
+		}
+	}
+
+	if got := supportedChannelModes(); got != "CIUchinorsv" {
+		t.Errorf("supportedChannelModes() = %s, wanted CIUchinorsv", got)
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"hello", "hello"},
+		{"\x02bold\x02 text", "bold text"},
+		{"\x034red\x03 text", "red text"},
+		{"\x0304,12red on blue\x0f", "red on blue"},
+		{"\x034,nope", ",nope"},
+		{"\x031234", "34"},
+		{"\x04FF0000,00ff00hex", "hex"},
+		{"\x1ditalic\x1d \x1funder\x1f \x16rev\x11mono\x1estrike", "italic under revmonostrike"},
+		{"\x03", ""},
+		{"\x01ACTION waves\x01", "\x01ACTION waves\x01"},
+	}
+
+	for _, test := range tests {
+		if got := stripFormatting(test.input); got != test.output {
+			t.Errorf("stripFormatting(%q) = %q, wanted %q", test.input, got,
+				test.output)
+		}
+	}
+}
+
+// Make a LocalUser that is registered with the given Catbox. Its connection
+// goes nowhere.
+func newTestLocalUser(cb *Catbox, id uint64, nick, username,
+	hostname string) *LocalUser {
+	conn, _ := net.Pipe()
+
+	lc := &LocalClient{
+		Conn:      Conn{conn: conn},
+		ID:        id,
+		WriteChan: make(chan outMessage, 32),
+		Catbox:    cb,
+	}
+
+	lu := NewLocalUser(lc)
+
+	uid, err := lu.makeTS6UID(id)
+	if err != nil {
+		panic(err)
+	}
+
+	lu.User = &User{
+		DisplayNick: nick,
+		Modes:       map[byte]struct{}{},
+		Username:    username,
+		Hostname:    hostname,
+		UID:         uid,
+		Channels:    map[string]*Channel{},
+		LocalUser:   lu,
+	}
+
+	cb.internUser(lu.User)
+	cb.LocalUsers[lu.ID] = lu
+	cb.addHostUser(lu)
+	cb.Nicks[canonicalizeNick(nick)] = uid
+	cb.Users[uid] = lu.User
+
+	return lu
+}
+
+func TestFilterMessage(t *testing.T) {
+	cb := &Catbox{Config: &Config{ChannelColorAction: ColorActionStrip}}
+
+	tests := []struct {
+		modes     string
+		text      string
+		output    string
+		refusedBy byte
+	}{
+		{"", "\x01VERSION\x01", "\x01VERSION\x01", 0},
+		{"C", "hello", "hello", 0},
+		{"C", "\x01VERSION\x01", "", 'C'},
+		{"C", "\x01version", "", 'C'},
+		{"C", "\x01ACTION waves\x01", "\x01ACTION waves\x01", 0},
+		{"Cc", "\x01ACTION \x02waves\x02\x01", "\x01ACTION waves\x01", 0},
+		{"c", "\x02hi\x02", "hi", 0},
+	}
+
+	for _, test := range tests {
+		channel := &Channel{Modes: map[byte]struct{}{}}
+		for _, mode := range test.modes {
+			channel.setMode(byte(mode))
+		}
+
+		output, refusedBy := channel.filterMessage(cb, test.text)
+		if output != test.output || refusedBy != test.refusedBy {
+			t.Errorf("+%s filterMessage(%q) = %q, %q, wanted %q, %q", test.modes,
+				test.text, output, refusedBy, test.output, test.refusedBy)
+		}
+	}
+}
+
+func TestSplitListMessage(t *testing.T) {
+	var items []string
+	for i := 0; i < 200; i++ {
+		items = append(items, fmt.Sprintf("nick%d", i))
+	}
+
+	m := irc.Message{
+		Prefix:  "irc.example.com",
+		Command: "353",
+		Params:  []string{"me", "@", "#test", ""},
+	}
+
+	msgs, err := splitListMessage(m, items)
+	if err != nil {
+		t.Fatalf("splitListMessage: %s", err)
+	}
+
+	if len(msgs) < 2 {
+		t.Fatalf("got %d messages, wanted several", len(msgs))
+	}
+
+	var got []string
+	for _, msg := range msgs {
+		buf, err := msg.Encode()
+		if err != nil {
+			t.Errorf("encoding split message: %s", err)
+		}
+		if len(buf) > irc.MaxLineLength {
+			t.Errorf("split message is %d bytes", len(buf))
+		}
+		got = append(got, strings.Fields(msg.Params[3])...)
+	}
+
+	if strings.Join(got, " ") != strings.Join(items, " ") {
+		t.Errorf("split messages did not carry all items in order")
+	}
+}
+
+func TestSplitTrailingMessage(t *testing.T) {
+	text := strings.Repeat("héllo wörld ", 100)
+
+	m := irc.Message{
+		Prefix:  "irc.example.com",
+		Command: "332",
+		Params:  []string{"me", "#test", text},
+	}
+
+	msgs, err := splitTrailingMessage(m)
+	if err != nil {
+		t.Fatalf("splitTrailingMessage: %s", err)
+	}
+
+	var got []string
+	for _, msg := range msgs {
+		buf, err := msg.Encode()
+		if err != nil {
+			t.Errorf("encoding split message: %s", err)
+		}
+		if len(buf) > irc.MaxLineLength {
+			t.Errorf("split message is %d bytes", len(buf))
+		}
+		if !utf8.ValidString(msg.Params[2]) {
+			t.Errorf("split message has invalid UTF-8: %q", msg.Params[2])
+		}
+		got = append(got, msg.Params[2])
+	}
+
+	if strings.Join(got, " ") != text {
+		t.Errorf("split messages did not carry all text")
+	}
+
+	// We split text to users. RPL_TOPIC we truncate as it isn't a list.
+	privmsg := irc.Message{
+		Prefix:  "nick!user@host",
+		Command: "PRIVMSG",
+		Params:  []string{"#test", text},
+	}
+	msgs, err = splitTrailingMessage(privmsg)
+	if err != nil {
+		t.Fatalf("splitTrailingMessage(PRIVMSG): %s", err)
+	}
+	bufs, err := encodeMessage(privmsg, true)
+	if err != nil {
+		t.Fatalf("encodeMessage: %s", err)
+	}
+	if len(bufs) != len(msgs) || len(bufs) < 2 {
+		t.Errorf("encodeMessage gave %d lines, wanted %d", len(bufs), len(msgs))
+	}
+
+	// Servers would see each line as a separate message, so we truncate.
+	bufs, err = encodeMessage(privmsg, false)
+	if err != irc.ErrTruncated || len(bufs) != 1 {
+		t.Errorf("encodeMessage to a server gave %d lines (%v), wanted 1 truncated",
+			len(bufs), err)
+	}
+
+	bufs, err = encodeMessage(m, true)
+	if err != irc.ErrTruncated || len(bufs) != 1 {
+		t.Errorf("encodeMessage(RPL_TOPIC) gave %d lines (%v), wanted 1 truncated",
+			len(bufs), err)
+	}
+}
+
+func TestIsValidLineLength(t *testing.T) {
+	tests := []struct {
+		line  string
+		valid bool
+	}{
+		{"PING :hi\r\n", true},
+		{strings.Repeat("a", irc.MaxLineLength-2) + "\r\n", true},
+		{strings.Repeat("a", irc.MaxLineLength-1) + "\r\n", false},
+		{"@a=b PING :hi\r\n", true},
+		{"@" + strings.Repeat("a", maxTagsLength-2) + " PING :hi\r\n", true},
+		{"@" + strings.Repeat("a", maxTagsLength-1) + " PING :hi\r\n", false},
+		{"@a=b " + strings.Repeat("a", irc.MaxLineLength-1) + "\r\n", false},
+	}
+
+	for _, test := range tests {
+		valid := isValidLineLength(test.line)
+		if valid != test.valid {
+			t.Errorf("isValidLineLength(%d byte line) = %v, wanted %v",
+				len(test.line), valid, test.valid)
+		}
+	}
+}
+
+func TestConnReadLineTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+
+	conn := Conn{
+		conn: server,
+		rw: bufio.NewReadWriter(
+			bufio.NewReaderSize(server, maxTagsLength+irc.MaxLineLength),
+			bufio.NewWriter(server),
+		),
+		ioWait:   time.Second,
+		lineWait: time.Second,
+	}
+
+	go func() {
+		_, _ = client.Write([]byte(strings.Repeat("a", 20000) + "\r\n"))
+		_, _ = client.Write([]byte(strings.Repeat("a", 1000) + "\r\n"))
+		_, _ = client.Write([]byte("PING :hi\r\n"))
+	}()
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Read(); err != ErrLineTooLong {
+			t.Fatalf("read %d: got error %v, wanted %v", i, err, ErrLineTooLong)
+		}
+	}
+
+	line, err := conn.Read()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if line != "PING :hi\r\n" {
+		t.Errorf("read %q, wanted PING", line)
+	}
+}
+
+func TestConnReadPartialLineTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+
+	conn := Conn{
+		conn: server,
+		rw: bufio.NewReadWriter(
+			bufio.NewReaderSize(server, maxTagsLength+irc.MaxLineLength),
+			bufio.NewWriter(server),
+		),
+		ioWait:   time.Minute,
+		lineWait: 50 * time.Millisecond,
+	}
+
+	go func() {
+		_, _ = client.Write([]byte("PRIVMSG #test :partial"))
+	}()
+
+	start := time.Now()
+	line, err := conn.Read()
+	if err == nil {
+		t.Fatalf("read %q without error, wanted timeout", line)
+	}
+	if line != "PRIVMSG #test :partial" {
+		t.Errorf("read %q, wanted the partial line", line)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("took %s to time out", time.Since(start))
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		input   string
+		success bool
+		output  ServerDefinition
+	}{
+		{"127.0.0.1,6697,pass,1", true, ServerDefinition{
+			Hostname: "127.0.0.1", Port: 6697, Pass: "pass", TLS: true,
+		}},
+		{"127.0.0.1,6697,pass,0,10.0.0.1", true, ServerDefinition{
+			Hostname: "127.0.0.1", Port: 6697, Pass: "pass",
+			BindAddress: "10.0.0.1",
+		}},
+		{"127.0.0.1,6697,pass,1,[::1]:7000,eth1", true, ServerDefinition{
+			Hostname: "127.0.0.1", Port: 6697, Pass: "pass", TLS: true,
+			BindAddress: "[::1]:7000", BindInterface: "eth1",
+		}},
+		{"127.0.0.1,6697,pass,1,,eth1", true, ServerDefinition{
+			Hostname: "127.0.0.1", Port: 6697, Pass: "pass", TLS: true,
+			BindInterface: "eth1",
+		}},
+		{"irc.example.com,srv,pass,1", true, ServerDefinition{
+			Hostname: "irc.example.com", Pass: "pass", TLS: true, SRV: true,
+		}},
+		{"irc.i2p,srv,pass,1", false, ServerDefinition{}},
+		{"127.0.0.1,6697,pass,1,example.com", false, ServerDefinition{}},
+		{"127.0.0.1,6697,pass,1,10.0.0.1:x", false, ServerDefinition{}},
+		{"127.0.0.1,6697,pass", false, ServerDefinition{}},
+		{"127.0.0.1,6697,pass,1,10.0.0.1,eth1,x", false, ServerDefinition{}},
+		{"127.0.0.1,6697,pass,1,,,observer", true, ServerDefinition{
+			Hostname: "127.0.0.1", Port: 6697, Pass: "pass", TLS: true,
+			Observer: true,
+		}},
+		{"127.0.0.1,6697,pass,1,,,untrusted", true, ServerDefinition{
+			Hostname: "127.0.0.1", Port: 6697, Pass: "pass", TLS: true,
+			Untrusted: true,
+		}},
+		{"127.0.0.1,6697,pass,1,,,observer,x", false, ServerDefinition{}},
+	}
+
+	for _, test := range tests {
+		link, err := parseLink("irc.example.com", test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseLink(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseLink(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+
+		test.output.Name = "irc.example.com"
+		if *link != test.output {
+			t.Errorf("parseLink(%s) = %+v, wanted %+v", test.input, *link,
+				test.output)
+		}
+	}
+}
+
+func TestSJOINUserList(t *testing.T) {
+	tests := []struct {
+		params   []string
+		success  bool
+		userList string
+	}{
+		{[]string{"1", "#test", "+nt", "@8ZZAAAAAB"}, true, "@8ZZAAAAAB"},
+		{[]string{"1", "#test", "+ntk", "key", "@8ZZAAAAAB 8ZZAAAAAC"}, true,
+			"@8ZZAAAAAB 8ZZAAAAAC"},
+		{[]string{"1", "#test", "+kl", "key", "10", "8ZZAAAAAB"}, true,
+			"8ZZAAAAAB"},
+		// A mode with a parameter we don't know about. The list is last.
+		{[]string{"1", "#test", "+nX", "x", "8ZZAAAAAB"}, true, "8ZZAAAAAB"},
+		// The key would be taken as the member list.
+		{[]string{"1", "#test", "+kl", "key", "8ZZAAAAAB"}, false, ""},
+		{[]string{"1", "#test", "+n"}, false, ""},
+	}
+
+	for _, test := range tests {
+		userList, err := sjoinUserList(test.params)
+		if err != nil {
+			if test.success {
+				t.Errorf("sjoinUserList(%v) failed: %s", test.params, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("sjoinUserList(%v) succeeded, wanted failure", test.params)
+			continue
+		}
+
+		if userList != test.userList {
+			t.Errorf("sjoinUserList(%v) = %s, wanted %s", test.params, userList,
+				test.userList)
+		}
+	}
+}
+
+func TestSJOINForServer(t *testing.T) {
+	hops := &Server{Capabs: map[string]struct{}{"HOPS": {}}}
+	noHOPS := &Server{Capabs: map[string]struct{}{}}
+
+	tests := []struct {
+		server   *Server
+		userList string
+		output   string
+	}{
+		{hops, "@%8ZZAAAAAB %8ZZAAAAAC 8ZZAAAAAD", "@%8ZZAAAAAB %8ZZAAAAAC 8ZZAAAAAD"},
+		{noHOPS, "@%8ZZAAAAAB %8ZZAAAAAC 8ZZAAAAAD", "@8ZZAAAAAB 8ZZAAAAAC 8ZZAAAAAD"},
+		{noHOPS, "@8ZZAAAAAB 8ZZAAAAAC", "@8ZZAAAAAB 8ZZAAAAAC"},
+	}
+
+	for _, test := range tests {
+		m := irc.Message{
+			Prefix:  "8ZZ",
+			Command: "SJOIN",
+			Params:  []string{"1", "#test", "+nt", test.userList},
+		}
+		got := sjoinForServer(m, test.server)
+		if got.Params[3] != test.output {
+			t.Errorf("sjoinForServer(%s) = %s, wanted %s", test.userList,
+				got.Params[3], test.output)
+		}
+		if m.Params[3] != test.userList {
+			t.Errorf("sjoinForServer(%s) changed the original message",
+				test.userList)
+		}
+	}
+}
+
+func TestParseOperConfig(t *testing.T) {
+	tests := []struct {
+		input      string
+		success    bool
+		pass       string
+		privileges int
+	}{
+		{"testing", true, "testing", 0},
+		{"testing, remote-kill", true, "testing", 1},
+		{"", false, "", 0},
+		{"testing,fly", false, "", 0},
+	}
+
+	for _, test := range tests {
+		pass, privileges, err := parseOperConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseOperConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseOperConfig(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+
+		if pass != test.pass || len(privileges) != test.privileges {
+			t.Errorf("parseOperConfig(%s) = %s, %v, wanted %s and %d privileges",
+				test.input, pass, privileges, test.pass, test.privileges)
+		}
+	}
+}
+
+func TestLinkDialer(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			LinkConnectTimeout: time.Minute,
+			LinkBindAddress:    "10.0.0.1",
+		},
+	}
+
+	dialer, err := cb.linkDialer(&ServerDefinition{})
+	if err != nil {
+		t.Fatalf("linkDialer: %s", err)
+	}
+	if dialer.LocalAddr.String() != "10.0.0.1:0" {
+		t.Errorf("bound to %s, wanted global address", dialer.LocalAddr)
+	}
+
+	dialer, err = cb.linkDialer(&ServerDefinition{BindAddress: "10.0.0.2:7000"})
+	if err != nil {
+		t.Fatalf("linkDialer: %s", err)
+	}
+	if dialer.LocalAddr.String() != "10.0.0.2:7000" {
+		t.Errorf("bound to %s, wanted server's address", dialer.LocalAddr)
+	}
+
+	cb.Config.LinkBindAddress = ""
+	dialer, err = cb.linkDialer(&ServerDefinition{})
+	if err != nil {
+		t.Fatalf("linkDialer: %s", err)
+	}
+	if dialer.LocalAddr != nil {
+		t.Errorf("bound to %s, wanted no binding", dialer.LocalAddr)
+	}
+
+	if _, err := cb.linkDialer(&ServerDefinition{
+		BindInterface: "no-such-interface",
+	}); err == nil {
+		t.Errorf("linkDialer succeeded with unknown interface")
+	}
+}
+
+// fakeResolver answers lookups from maps.
+type fakeResolver struct {
+	ips map[string][]string
+	srv map[string][]*net.SRV
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context,
+	host string) ([]net.IPAddr, error) {
+	ips, exists := r.ips[host]
+	if !exists {
+		return nil, fmt.Errorf("no such host: %s", host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto,
+	name string) (string, []*net.SRV, error) {
+	records, exists := r.srv["_"+service+"._"+proto+"."+name]
+	if !exists {
+		return "", nil, fmt.Errorf("no SRV records for %s", name)
+	}
+	return "", records, nil
+}
+
+func TestLinkAddresses(t *testing.T) {
+	r := fakeResolver{
+		ips: map[string][]string{
+			"irc.example.com":  {"192.0.2.1", "2001:db8::1"},
+			"irc1.example.com": {"192.0.2.2"},
+			"irc2.example.com": {"192.0.2.3"},
+		},
+		srv: map[string][]*net.SRV{
+			"_ircs._tcp.irc.example.com": {
+				{Target: "irc1.example.com.", Port: 7000},
+				{Target: "missing.example.com.", Port: 7000},
+				{Target: "irc2.example.com.", Port: 7001},
+			},
+			"_irc._tcp.irc.example.com": {{Target: ".", Port: 0}},
+		},
+	}
+
+	tests := []struct {
+		link    ServerDefinition
+		success bool
+		output  []string
+	}{
+		{ServerDefinition{Hostname: "irc.example.com", Port: 6697}, true,
+			[]string{"192.0.2.1:6697", "[2001:db8::1]:6697"}},
+		{ServerDefinition{Hostname: "10.0.0.1", Port: 6697}, true,
+			[]string{"10.0.0.1:6697"}},
+		{ServerDefinition{Hostname: "irc.example.com", TLS: true, SRV: true},
+			true, []string{"192.0.2.2:7000", "192.0.2.3:7001"}},
+		{ServerDefinition{Hostname: "irc.example.com", SRV: true}, false, nil},
+		{ServerDefinition{Hostname: "missing.example.com", Port: 6697}, false,
+			nil},
+	}
+
+	for _, test := range tests {
+		addrs, err := linkAddresses(context.Background(), r, &test.link, true)
+		if err != nil {
+			if test.success {
+				t.Errorf("linkAddresses(%+v) failed: %s", test.link, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("linkAddresses(%+v) succeeded, wanted failure", test.link)
+			continue
+		}
+
+		if !reflect.DeepEqual(addrs, test.output) {
+			t.Errorf("linkAddresses(%+v) = %v, wanted %v", test.link, addrs,
+				test.output)
+		}
+	}
+}
+
+// If an address doesn't answer, we try the next one.
+func TestDialLinkAddresses(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	conn, err := dialLinkAddresses(dialer,
+		[]string{closedAddr, ln.Addr().String()}, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("dialLinkAddresses failed: %s", err)
+	}
+	if conn.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("connected to %s, wanted %s", conn.RemoteAddr(), ln.Addr())
+	}
+	_ = conn.Close()
+
+	if _, err := dialLinkAddresses(dialer, []string{closedAddr}, nil,
+		time.Minute); err == nil {
+		t.Errorf("dialLinkAddresses succeeded with no one listening")
+	}
+}
+
+// If an address is slow to answer, we start on the next before it times out.
+func TestDialLinkAddressesFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	// Connecting to a blackhole address hangs until the timeout.
+	dialer := &net.Dialer{Timeout: time.Minute}
+
+	start := time.Now()
+	conn, err := dialLinkAddresses(dialer,
+		[]string{"192.0.2.1:6697", ln.Addr().String()}, nil,
+		10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("dialLinkAddresses failed: %s", err)
+	}
+	if conn.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("connected to %s, wanted %s", conn.RemoteAddr(), ln.Addr())
+	}
+	_ = conn.Close()
+
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("took %s, wanted the fallback to win quickly", elapsed)
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	var ips []net.IPAddr
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3",
+		"2001:db8::1", "2001:db8::2"} {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	tests := []struct {
+		preferIPv4 bool
+		output     []string
+	}{
+		{false, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2",
+			"192.0.2.3"}},
+		{true, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2",
+			"192.0.2.3"}},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, ip := range interleaveFamilies(ips, test.preferIPv4) {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, test.output) {
+			t.Errorf("interleaveFamilies(%v) = %v, wanted %v", test.preferIPv4,
+				got, test.output)
+		}
+	}
+}
+
+// PING and PONG go ahead of a long send queue.
+func TestWriteLoopPriority(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+
+	cb := &Catbox{
+		Config:       &Config{ServerName: "irc.example.com"},
+		ShutdownChan: make(chan struct{}),
+		ToServerChan: make(chan Event, 1),
+	}
+	lc := &LocalClient{
+		Conn:              NewConn(server, time.Second, time.Second),
+		WriteChan:         make(chan outMessage, 100),
+		PriorityWriteChan: make(chan irc.Message, 1),
+		Catbox:            cb,
+	}
+
+	for i := 0; i < 100; i++ {
+		lc.maybeQueueMessage(irc.Message{Command: "PRIVMSG",
+			Params: []string{"#flood", fmt.Sprintf("line %d", i)}})
+	}
+	lc.maybeQueuePriorityMessage(irc.Message{Command: "PING",
+		Params: []string{"irc.example.com"}})
+
+	// The priority queue is full so this falls back to the send queue. That's
+	// full too.
+	lc.maybeQueuePriorityMessage(irc.Message{Command: "PONG",
+		Params: []string{"irc.example.com"}})
+	if !lc.SendQueueExceeded {
+		t.Fatalf("send queue is not exceeded")
+	}
+
+	cb.WG.Add(1)
+	go lc.writeLoop()
+	defer func() {
+		close(lc.WriteChan)
+		cb.WG.Wait()
+	}()
+
+	r := bufio.NewReader(client)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading: %s", err)
+	}
+	if line != "PING irc.example.com\r\n" {
+		t.Errorf("first line is %q, wanted PING", line)
+	}
+
+	line, err = r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading: %s", err)
+	}
+	if line != "PRIVMSG #flood :line 0\r\n" {
+		t.Errorf("second line is %q, wanted the first PRIVMSG", line)
+	}
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, r)
+	}()
+}
+
+// Control messages to a server wait behind its burst, and go ahead of the send
+// queue after.
+func TestServerControlMessagePriority(t *testing.T) {
+	tests := []struct {
+		bursting bool
+		command  string
+		priority bool
+	}{
+		{true, "PONG", false},
+		{true, "ERROR", false},
+		{false, "PONG", true},
+		{false, "PING", true},
+		{false, "ERROR", true},
+		{false, "SQUIT", false},
+	}
+
+	for _, test := range tests {
+		s := &LocalServer{
+			LocalClient: &LocalClient{
+				WriteChan:         make(chan outMessage, 1),
+				PriorityWriteChan: make(chan irc.Message, 1),
+			},
+			Bursting: test.bursting,
+		}
+
+		s.maybeQueueControlMessage(irc.Message{Command: test.command})
+
+		if got := len(s.PriorityWriteChan) == 1; got != test.priority {
+			t.Errorf("%s while bursting=%v went to the priority queue = %v, wanted %v",
+				test.command, test.bursting, got, test.priority)
+		}
+	}
+}
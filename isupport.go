@@ -0,0 +1,70 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxISupportTokens is how many tokens we put in one 005 message.
+const maxISupportTokens = 13
+
+// isupportTokens lists what we tell clients about ourself with 005
+// RPL_ISUPPORT. See https://modern.ircdocs.horse/#rplisupport-005
+func (cb *Catbox) isupportTokens() []string {
+	// Channel modes by type: lists, always with a parameter, with a parameter
+	// when set, and never with a parameter.
+	var simpleModes []string
+	for mode := range simpleChannelModes {
+		simpleModes = append(simpleModes, string(mode))
+	}
+	// Anonymous channels (+a) are local to this server. We advertise the mode
+	// only if the config lets users set it.
+	if cb.Config.AnonymousChannels {
+		simpleModes = append(simpleModes, "a")
+	}
+	sort.Strings(simpleModes)
+
+	tokens := []string{
+		"BOT=B",
+		"CASEMAPPING=strict-rfc1459",
+		"CHANMODES=I,k,l," + strings.Join(simpleModes, ""),
+		fmt.Sprintf("CHANNELLEN=%d", maxChannelLength),
+		"CHANTYPES=#",
+		"CNOTICE",
+		"CPRIVMSG",
+		fmt.Sprintf("MONITOR=%d", MaxMonitorTargets),
+		fmt.Sprintf("NICKLEN=%d", cb.Config.MaxNickLength),
+		"PREFIX=(ohv)@%+",
+	}
+
+	if cb.Config.NetworkName != "" {
+		tokens = append(tokens, "NETWORK="+cb.Config.NetworkName)
+	}
+
+	// Users may choose one language at a time.
+	if len(cb.Config.Languages) > 0 {
+		tokens = append(tokens,
+			"LANGUAGE=1,"+strings.Join(cb.languageNames(), ","))
+	}
+
+	sort.Strings(tokens)
+	return tokens
+}
+
+// sendISupport sends the user 005 RPL_ISUPPORT messages.
+func (u *LocalUser) sendISupport() {
+	tokens := u.Catbox.isupportTokens()
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > maxISupportTokens {
+			n = maxISupportTokens
+		}
+
+		params := append([]string{}, tokens[:n]...)
+		params = append(params, "are supported by this server")
+		u.messageFromServer("005", params)
+
+		tokens = tokens[n:]
+	}
+}
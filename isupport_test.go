@@ -0,0 +1,31 @@
+package terrarium
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestISupportTokens(t *testing.T) {
+	cb := &Catbox{Config: &Config{MaxNickLength: 12}}
+
+	tokens := strings.Join(cb.isupportTokens(), " ")
+	for _, want := range []string{"CHANMODES=I,k,l,CUcinrs", "NICKLEN=12",
+		"PREFIX=(ohv)@%+", "CPRIVMSG", "CNOTICE"} {
+		if !strings.Contains(tokens, want) {
+			t.Errorf("ISUPPORT %q is missing %s", tokens, want)
+		}
+	}
+	if strings.Contains(tokens, "NETWORK=") {
+		t.Errorf("ISUPPORT %q has a network without one configured", tokens)
+	}
+
+	cb.Config.NetworkName = "ExampleNet"
+	cb.Config.AnonymousChannels = true
+	tokens = strings.Join(cb.isupportTokens(), " ")
+	if !strings.Contains(tokens, "NETWORK=ExampleNet") {
+		t.Errorf("ISUPPORT %q is missing the network", tokens)
+	}
+	if !strings.Contains(tokens, "CHANMODES=I,k,l,CUacinrs") {
+		t.Errorf("ISUPPORT %q is missing anonymous channels", tokens)
+	}
+}
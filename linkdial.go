@@ -0,0 +1,279 @@
+package terrarium
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A server we link to may have several addresses, such as A and AAAA records,
+// and some may be unreachable. We try them until one answers. Each attempt has
+// its own timeout (link-connect-timeout) so one dead address doesn't use up
+// the time for the rest.
+//
+// We don't wait for an attempt to time out before starting the next. We use
+// Happy Eyeballs (RFC 8305): We alternate between IPv6 and IPv4 addresses,
+// starting with the preferred family (link-prefer-ipv4), and start the next
+// attempt each time one fails or link-fallback-delay passes. The first to
+// connect wins. This way a server with a broken family still links quickly.
+//
+// If a server's port in servers.conf is srv, we find its addresses with SRV
+// records (_irc._tcp, or _ircs._tcp with TLS) for its hostname instead. We
+// try the targets in the order the records say to.
+
+// linkResolver looks up the addresses of servers we link to. *net.Resolver is
+// one. Tests use others.
+type linkResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto,
+		name string) (string, []*net.SRV, error)
+}
+
+// dialLink connects to a server. If it uses TLS, we complete the handshake
+// before returning.
+func (cb *Catbox) dialLink(linkInfo *ServerDefinition) (net.Conn, error) {
+	cfg := cb.config()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		cfg.LinkConnectTimeout)
+	addrs, err := linkAddresses(ctx, net.DefaultResolver, linkInfo,
+		cfg.LinkPreferIPv4)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := cb.linkDialer(linkInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if linkInfo.TLS {
+		tlsConfig = &tls.Config{}
+		if cb.TLSConfig != nil {
+			tlsConfig = cb.TLSConfig.Clone()
+		}
+		// We verify against the name in servers.conf, even if we found the
+		// address through SRV records.
+		tlsConfig.ServerName = linkInfo.Hostname
+
+		if cfg.LinkCAFile != "" {
+			pool, err := readCAFile(cfg.LinkCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read link CA file: %s", err)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	return dialLinkAddresses(dialer, addrs, tlsConfig, cfg.LinkFallbackDelay)
+}
+
+// linkAddresses finds the addresses (host:port) to try to connect to a server
+// at, in the order to try them.
+//
+// We interleave each host's IPv6 and IPv4 addresses, starting with IPv4 if
+// preferIPv4 is true. We keep SRV targets in their order.
+func linkAddresses(ctx context.Context, r linkResolver,
+	linkInfo *ServerDefinition, preferIPv4 bool) ([]string, error) {
+	type target struct {
+		host string
+		port int
+	}
+
+	targets := []target{{host: linkInfo.Hostname, port: linkInfo.Port}}
+
+	if linkInfo.SRV {
+		service := "irc"
+		if linkInfo.TLS {
+			service = "ircs"
+		}
+
+		// These come sorted by priority and weight.
+		_, records, err := r.LookupSRV(ctx, service, "tcp", linkInfo.Hostname)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up SRV records: %s", err)
+		}
+
+		targets = nil
+		for _, record := range records {
+			// A target of . means there is no such service.
+			if record.Target == "." {
+				continue
+			}
+			targets = append(targets, target{
+				host: strings.TrimSuffix(record.Target, "."),
+				port: int(record.Port),
+			})
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no SRV records for %s", linkInfo.Hostname)
+		}
+	}
+
+	var addrs []string
+	var problems []string
+	for _, t := range targets {
+		port := strconv.Itoa(t.port)
+
+		if ip := net.ParseIP(t.host); ip != nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			continue
+		}
+
+		ips, err := r.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, ip := range interleaveFamilies(ips, preferIPv4) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("unable to resolve %s: %s", linkInfo.Hostname,
+			strings.Join(problems, "; "))
+	}
+	return addrs, nil
+}
+
+// interleaveFamilies orders addresses so IPv6 and IPv4 ones alternate,
+// starting with the preferred family. Within each family, it keeps their
+// order.
+func interleaveFamilies(ips []net.IPAddr, preferIPv4 bool) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v6, v4
+	if preferIPv4 {
+		first, second = v4, v6
+	}
+
+	var ordered []net.IPAddr
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			ordered = append(ordered, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			ordered = append(ordered, second[0])
+			second = second[1:]
+		}
+	}
+	return ordered
+}
+
+// linkAttempt is how an attempt to connect to an address went.
+type linkAttempt struct {
+	conn net.Conn
+	err  error
+}
+
+// dialLinkAddresses races connecting to the addresses, in order. It starts
+// with the first and starts the next each time an attempt fails or
+// fallbackDelay passes. It returns the first connection made and closes any
+// others. If tlsConfig is set, the TLS handshake must succeed too.
+//
+// Each attempt may take up to the dialer's timeout.
+func dialLinkAddresses(dialer *net.Dialer, addrs []string,
+	tlsConfig *tls.Config, fallbackDelay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Buffered so attempts finishing after we're done don't block.
+	attempts := make(chan linkAttempt, len(addrs))
+
+	next := 0
+	pending := 0
+	var delay <-chan time.Time
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+
+		go func() {
+			conn, err := dialLinkAddress(ctx, dialer, addr, tlsConfig)
+			attempts <- linkAttempt{conn: conn, err: err}
+		}()
+
+		delay = nil
+		if next < len(addrs) {
+			delay = time.After(fallbackDelay)
+		}
+	}
+
+	start()
+
+	var problems []string
+	for pending > 0 {
+		select {
+		case a := <-attempts:
+			pending--
+			if a.err == nil {
+				cancel()
+				go closeLinkAttempts(attempts, pending)
+				return a.conn, nil
+			}
+			problems = append(problems, a.err.Error())
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+
+	return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// closeLinkAttempts waits for attempts to connect that lost the race and
+// closes any connections they made.
+func closeLinkAttempts(attempts <-chan linkAttempt, pending int) {
+	for ; pending > 0; pending-- {
+		if a := <-attempts; a.conn != nil {
+			_ = a.conn.Close()
+		}
+	}
+}
+
+// dialLinkAddress connects to one address of a server.
+func dialLinkAddress(ctx context.Context, dialer *net.Dialer, addr string,
+	tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if dialer.Timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(dialer.Timeout)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s: TLS handshake failed: %s", addr, err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
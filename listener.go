@@ -0,0 +1,224 @@
+package terrarium
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Listener is a socket we accept connections on.
+//
+// Each has a name describing what it listens on, such as tcp/0.0.0.0:6667.
+// The name lets us match listeners up across a rehash (to see which to open
+// and which to close) and across a restart (to find sockets we inherit).
+//
+// Other than at startup, only the server goroutine should open or close
+// listeners.
+type Listener struct {
+	net.Listener
+
+	Name string
+
+	// Whether we wrap connections in TLS.
+	TLS bool
+
+	// Fixed listeners are ones that do not come from the listen options in the
+	// config, such as one given to us with -listen-fd, or the I2P listeners. We
+	// leave them alone on rehash.
+	Fixed bool
+
+	// The socket underneath. For TLS listeners, Listener wraps this.
+	raw net.Listener
+
+	// Closed when we deliberately stop the listener. This tells the goroutine
+	// accepting connections to stop.
+	closed chan struct{}
+}
+
+// The name we give the listener given with -listen-fd.
+const listenFDName = "fd"
+
+// listenerKinds are the kinds of listener. A listener's name starts with its
+// kind.
+var listenerKinds = []string{"tcp", "tls", "i2p", "i2p-tls", listenFDName}
+
+// listenerKind finds the kind of listener from its name, such as tcp from
+// tcp/0.0.0.0:6667.
+func listenerKind(name string) string {
+	if i := strings.Index(name, "/"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// listenerNames determines the listeners the config asks for. Listener name to
+// whether it is TLS.
+func listenerNames(cfg *Config) map[string]bool {
+	names := map[string]bool{}
+
+	if cfg.ListenPort != "-1" {
+		names["tcp/"+net.JoinHostPort(cfg.ListenHost, cfg.ListenPort)] = false
+	}
+
+	if cfg.ListenPortTLS != "-1" {
+		names["tls/"+net.JoinHostPort(cfg.ListenHost, cfg.ListenPortTLS)] = true
+	}
+
+	return names
+}
+
+// openListener opens a listener and starts accepting connections on it.
+//
+// If we inherited a socket by this name from our parent process, we use it
+// rather than binding a new one.
+func (cb *Catbox) openListener(name string, isTLS, fixed bool) (*Listener,
+	error) {
+	var ln net.Listener
+
+	if fd, exists := cb.ListenFDs[name]; exists {
+		// We only use an inherited socket once.
+		delete(cb.ListenFDs, name)
+
+		f := os.NewFile(uintptr(fd), name)
+		fileLN, err := net.FileListener(f)
+		_ = f.Close() // nolint: gosec
+		if err != nil {
+			return nil, fmt.Errorf("unable to use inherited listener %s: %s", name,
+				err)
+		}
+		ln = fileLN
+	} else {
+		if fixed {
+			return nil, fmt.Errorf("no socket inherited for listener %s", name)
+		}
+
+		addr := name[strings.Index(name, "/")+1:]
+		tcpLN, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen on %s: %s", addr, err)
+		}
+		ln = tcpLN
+	}
+
+	l := &Listener{
+		Listener: ln,
+		Name:     name,
+		TLS:      isTLS,
+		Fixed:    fixed,
+		raw:      ln,
+		closed:   make(chan struct{}),
+	}
+
+	if isTLS {
+		l.Listener = tls.NewListener(ln, cb.TLSConfig)
+	}
+
+	cb.addListener(l)
+	return l, nil
+}
+
+// addListener records the listener and starts accepting connections on it.
+func (cb *Catbox) addListener(l *Listener) {
+	cb.Listeners[l.Name] = l
+
+	cb.WG.Add(1)
+	go cb.acceptConnections(l)
+}
+
+// closeListener stops accepting connections on the listener. Clients that
+// connected through it are unaffected.
+func (cb *Catbox) closeListener(l *Listener) {
+	delete(cb.Listeners, l.Name)
+
+	close(l.closed)
+	if err := l.Close(); err != nil {
+		log.Printf("Error closing listener %s: %s", l.Name, err)
+	}
+}
+
+// updateListeners makes our listeners match those the config asks for.
+//
+// We open new listeners before closing any. If we can't open one, we close
+// the ones we opened and leave things as they were.
+func (cb *Catbox) updateListeners(cfg *Config) error {
+	wanted := listenerNames(cfg)
+
+	var remove []*Listener
+	for name, l := range cb.Listeners {
+		if l.Fixed {
+			continue
+		}
+		if _, exists := wanted[name]; !exists {
+			remove = append(remove, l)
+		}
+	}
+
+	var add []string
+	for name, isTLS := range wanted {
+		if _, exists := cb.Listeners[name]; exists {
+			continue
+		}
+		if isTLS && cb.TLSConfig == nil {
+			return fmt.Errorf("TLS was not set up at startup, so we can't add %s",
+				name)
+		}
+		add = append(add, name)
+	}
+	sort.Strings(add)
+
+	var added []*Listener
+	for _, name := range add {
+		l, err := cb.openListener(name, wanted[name], false)
+		if err != nil {
+			for _, l := range added {
+				cb.closeListener(l)
+			}
+			return err
+		}
+		added = append(added, l)
+		cb.noticeOpers(fmt.Sprintf("Now listening on %s", l.Name))
+	}
+
+	for _, l := range remove {
+		cb.closeListener(l)
+		cb.noticeOpers(fmt.Sprintf("No longer listening on %s", l.Name))
+	}
+
+	return nil
+}
+
+// keepListenersForRestart makes a copy of each listener's socket that our
+// process will keep across exec. This is so that when we restart we can keep
+// listening on the same sockets without refusing connections in between.
+//
+// We record listener name to file descriptor in RestartListenFDs. Listeners we
+// can't copy (such as I2P ones) are left out.
+func (cb *Catbox) keepListenersForRestart() {
+	cb.RestartListenFDs = map[string]int{}
+	for name, l := range cb.Listeners {
+		tcpLN, ok := l.raw.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+
+		f, err := tcpLN.File()
+		if err != nil {
+			log.Printf("Unable to copy listener %s: %s", name, err)
+			continue
+		}
+
+		if err := clearCloseOnExec(f.Fd()); err != nil {
+			log.Printf("Unable to keep listener %s across exec: %s", name, err)
+			_ = f.Close() // nolint: gosec
+			continue
+		}
+
+		// Hold on to the file. If it were garbage collected it would close.
+		cb.restartFiles = append(cb.restartFiles, f)
+		cb.RestartListenFDs[name] = int(f.Fd())
+	}
+}
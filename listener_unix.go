@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package terrarium
+
+import "syscall"
+
+// clearCloseOnExec makes the file descriptor stay open across exec.
+func clearCloseOnExec(fd uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package terrarium
+
+import "fmt"
+
+// clearCloseOnExec makes the file descriptor stay open across exec. We can't
+// do this on Windows.
+func clearCloseOnExec(fd uintptr) error {
+	return fmt.Errorf("not supported on Windows")
+}
@@ -1,12 +1,16 @@
 package terrarium
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/horgh/irc"
@@ -16,21 +20,59 @@ import (
 // All connections are in this state until they register as either a user client
 // or as a server.
 type LocalClient struct { // nolint: maligned
+	// About how many bytes are waiting in the send queue (WriteChan). The
+	// server goroutine adds and the writer subtracts. Use sync/atomic. This is
+	// first so it is 64-bit aligned on 32-bit platforms.
+	SendQueueBytes int64
+
+	// Whether this is a link to a server. We don't split long messages to
+	// servers. The server goroutine sets it when the server registers and the
+	// writer reads it. Use sync/atomic.
+	ServerLink int32
+
+	// How many fan-out jobs for the client wait for a worker, and whether a
+	// worker found its send queue full. The server goroutine adds jobs and the
+	// workers finish them. Use sync/atomic. See fanout.go.
+	FanOutPending  int32
+	FanOutExceeded int32
+
 	// Conn is the TCP connection to the client.
 	Conn Conn
 
 	// Their hostname. May be blank if we can't look it up.
 	Hostname string
 
+	// The name of the listener they connected on. Blank if they didn't connect
+	// on one.
+	Listener string
+
+	// The name of the server we connected to, if we connected to them.
+	LinkTo string
+
 	// Locally unique identifier.
 	ID uint64
 
 	// WriteChan is the channel to send to to write to the client.
-	WriteChan chan irc.Message
+	WriteChan chan outMessage
+
+	// PriorityWriteChan is for messages to write ahead of those waiting in
+	// WriteChan. See maybeQueuePriorityMessage().
+	PriorityWriteChan chan irc.Message
 
 	// The time they connected.
 	ConnectionStartTime time.Time
 
+	// The last time we heard anything from the client.
+	LastActivityTime time.Time
+
+	// The last time we sent the client a PING.
+	LastPingTime time.Time
+
+	// Whether we're waiting for them to answer the PING we last sent, and how
+	// long they took to answer the one before.
+	PingPending bool
+	Lag         time.Duration
+
 	// A reference to the main server.
 	Catbox *Catbox
 
@@ -41,6 +83,24 @@ type LocalClient struct { // nolint: maligned
 	// If we hit a defined threshold, kill the connection.
 	PreRegisterMessageCount int
 
+	// The web gateway that told us where they connect from with WEBIRC, if
+	// any, and the IP it gave. Only the server goroutine uses these. Conn
+	// belongs to the reader and writer. See webirc.go.
+	WebIRCGateway string
+	WebIRCIP      net.IP
+
+	// Whether we're looking up the hostname for the IP the gateway gave. We
+	// don't register them until we know it.
+	WebIRCLookup bool
+
+	// Whether they connected on a guest listener and we haven't yet tried to
+	// register them as a guest. See guest.go.
+	Guest bool
+
+	// How many times we told them a nick they asked for is in use before they
+	// registered. See nickinuse.go.
+	NickInUseReplies int
+
 	// Info client may send us before we complete its registration and promote it
 	// to a user or server.
 
@@ -53,12 +113,35 @@ type LocalClient struct { // nolint: maligned
 	PreRegUser     string
 	PreRegRealName string
 
+	// User modes asked for in the USER mode bitmask.
+	PreRegUserModes string
+
 	// Server info
 
 	// PASS arguments.
 	PreRegPass   string
 	PreRegTS6SID string
 
+	// Password a user gave with PASS. Servers give theirs in PreRegPass.
+	PreRegClientPass string
+
+	// The cookie we sent a user in a PING, if ping-cookie is on, and whether
+	// they answered it with a PONG. They must before they may register.
+	PingCookie    string
+	GotPingCookie bool
+
+	// Whether a user is negotiating capabilities with CAP. We don't register
+	// them until they finish with CAP END.
+	CapNegotiating bool
+
+	// Capabilities the client turned on with CAP REQ. See cap.go.
+	Caps map[string]struct{}
+
+	// The CAP LS version they asked for, if 302 or later, and the capabilities
+	// we last told them we offer, with their values.
+	CapVersion     int
+	AdvertisedCaps map[string]string
+
 	// CAPAB arguments.
 	PreRegCapabs map[string]struct{}
 
@@ -84,21 +167,32 @@ const MaxAllowedPreRegisterMessageCount = 10
 // NewLocalClient creates a LocalClient
 func NewLocalClient(cb *Catbox, id uint64, conn net.Conn) *LocalClient {
 	return &LocalClient{
-		Conn: NewConn(conn, cb.Config.DeadTime),
+		Conn: NewConn(conn, cb.config().DeadTime, cb.config().LineTime),
 		ID:   id,
 
 		// Buffered channel. We don't want to block sending to the client from the
 		// server. The client may be stuck. Make the buffer large enough that it
 		// should only max out in case of connection issues.
-		WriteChan: make(chan irc.Message, 32768),
+		WriteChan: make(chan outMessage, 32768),
+
+		// Only a few messages ever need to jump the queue.
+		PriorityWriteChan: make(chan irc.Message, 64),
 
-		ConnectionStartTime: time.Now(),
+		ConnectionStartTime: cb.now(),
+		LastActivityTime:    cb.now(),
+		LastPingTime:        cb.now(),
 		Catbox:              cb,
+		Caps:                make(map[string]struct{}),
 		PreRegCapabs:        make(map[string]struct{}),
 	}
 }
 
+// String describes the client in logs and notices to operators. Under the
+// anonymous privacy profile we leave out their address.
 func (c *LocalClient) String() string {
+	if c.Catbox.config().PrivacyProfile == PrivacyProfileAnonymous {
+		return fmt.Sprintf("%d", c.ID)
+	}
 	return fmt.Sprintf("%d %s", c.ID, c.Conn.RemoteAddr())
 }
 
@@ -142,17 +236,101 @@ func (c *LocalClient) getTLSState() (string, string, error) {
 // Not blocking is important because the server sends the client messages this
 // way, and if we block on a problem client, everything would grind to a halt.
 func (c *LocalClient) maybeQueueMessage(m irc.Message) {
-	if c.SendQueueExceeded {
+	c.maybeQueueOutMessage(outMessage{Message: m})
+}
+
+// maybeQueueMessageFrom sends a message from the user to the client, with the
+// tags it should have. See maybeQueueMessage().
+func (c *LocalClient) maybeQueueMessageFrom(source *User, m irc.Message) {
+	c.maybeQueueOutMessage(outMessage{Message: m,
+		tags: c.messageTagsFrom(source)})
+}
+
+func (c *LocalClient) maybeQueueOutMessage(m outMessage) {
+	if c.sendQueueExceeded() {
+		return
+	}
+
+	// Wait behind what the fan-out workers have for the client.
+	if atomic.LoadInt32(&c.FanOutPending) > 0 {
+		c.Catbox.fanOutToClient(c, m)
 		return
 	}
 
 	select {
 	case c.WriteChan <- m:
+		atomic.AddInt64(&c.SendQueueBytes, int64(messageLength(m.Message)))
 	default:
 		c.SendQueueExceeded = true
 	}
 }
 
+// outMessage is a message in a client's send queue. If we sent the message to
+// many clients, we encoded it once and lines holds the result. tags are the
+// message tags to send with it, if any, without the leading @.
+type outMessage struct {
+	irc.Message
+	lines []string
+	tags  string
+}
+
+// sendQueueExceeded checks if the client's send queue is full, including if a
+// fan-out worker found it so.
+func (c *LocalClient) sendQueueExceeded() bool {
+	if atomic.LoadInt32(&c.FanOutExceeded) != 0 {
+		c.SendQueueExceeded = true
+	}
+	return c.SendQueueExceeded
+}
+
+// closeWriteChan closes the client's send queue. Its writer ends once it sends
+// what's waiting. If a fan-out worker has messages for it, the worker closes it
+// after queueing them.
+func (c *LocalClient) closeWriteChan() {
+	if atomic.LoadInt32(&c.FanOutPending) > 0 {
+		c.Catbox.fanOutClose(c)
+		return
+	}
+	close(c.WriteChan)
+}
+
+// messageLength estimates how many bytes the message takes to send. It does
+// not account for splitting long messages.
+func messageLength(m irc.Message) int {
+	// Command and CRLF.
+	n := len(m.Command) + 2
+	if m.Prefix != "" {
+		// :prefix and space.
+		n += 2 + len(m.Prefix)
+	}
+	for _, param := range m.Params {
+		// Space, and perhaps a colon.
+		n += 2 + len(param)
+	}
+	return n
+}
+
+// maybeQueuePriorityMessage queues a message to write ahead of any waiting in
+// the client's send queue. This is for PING and PONG, which keep the
+// connection alive, and for servers, other control messages of our own (see
+// maybeQueueControlMessage()). If the send queue is long, such as from a flood
+// in a busy channel, they would otherwise wait behind it and the client or server could
+// time out.
+//
+// Only use this for messages that may arrive before messages queued earlier.
+func (c *LocalClient) maybeQueuePriorityMessage(m irc.Message) {
+	if c.SendQueueExceeded {
+		return
+	}
+
+	select {
+	case c.PriorityWriteChan <- m:
+	default:
+		// Wait with everything else.
+		c.maybeQueueMessage(m)
+	}
+}
+
 // readLoop endlessly reads from the client's TCP connection. It parses each
 // IRC protocol message and passes it to the server through the server's
 // channel.
@@ -165,21 +343,31 @@ func (c *LocalClient) readLoop() {
 		}
 
 		buf, err := c.Conn.Read()
+		if err == ErrLineTooLong {
+			if c.Catbox.clientLogAllowed(c) {
+				c.Catbox.queueOperNoticeAbout("spam", fmt.Sprintf(
+					"Client %s sent a line that is too long", c.String()))
+			}
+			// We discarded the line. The client may keep going.
+			continue
+		}
 		if err != nil {
 			log.Printf("Client %s: Read problem: %s", c, err)
 			// Debug concerns with missing quit messages.
 			if buf != "" {
-				c.Catbox.noticeOpers(fmt.Sprintf("Read error but have [%s]",
+				c.Catbox.queueOperNotice(fmt.Sprintf("Read error but have [%s]",
 					strings.TrimSpace(buf)))
 			}
 			c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c, Error: err})
 			break
 		}
 
-		message, err := irc.ParseMessage(buf)
+		message, err := irc.ParseMessage(stripTags(buf))
 		if err != nil {
-			c.Catbox.noticeOpers(fmt.Sprintf("Invalid message from client %s: %s", c,
-				err))
+			if c.Catbox.clientLogAllowed(c) {
+				c.Catbox.queueOperNoticeAbout("spam", fmt.Sprintf(
+					"Invalid message from client %s: %s", c.String(), err))
+			}
 
 			if err != irc.ErrTruncated {
 				// Should we reply to the client? This silently ignores malformed
@@ -222,29 +410,31 @@ func (c *LocalClient) writeLoop() {
 	// messages on the write channel (and so inform the client about shutdown)
 	// when we are shutting down. But it is an improvement on leaking the
 	// goroutine.
+	//
+	// Messages on the priority channel go first.
 Loop:
 	for {
 		select {
-		case message, ok := <-c.WriteChan:
-			if !ok {
+		case message := <-c.PriorityWriteChan:
+			if !c.writeMessage(message) {
 				break Loop
 			}
+			continue
+		default:
+		}
 
-			buf, err := message.Encode()
-			if err != nil {
-				c.Catbox.noticeOpers(fmt.Sprintf(
-					"Trying to send invalid message to client %s: %s", c, err))
-				if err != irc.ErrTruncated {
-					continue
-				}
+		select {
+		case message := <-c.PriorityWriteChan:
+			if !c.writeMessage(message) {
+				break Loop
 			}
-
-			if err := c.Conn.Write(buf); err != nil {
-				log.Printf("Client %s: Write problem: %s: %s", c, buf, err)
-				// Don't kill the client immediately. Give a chance for us to read
-				// anything from it.
-				time.Sleep(5 * time.Second)
-				c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c, Error: err})
+		case message, ok := <-c.WriteChan:
+			if !ok {
+				break Loop
+			}
+			atomic.AddInt64(&c.SendQueueBytes,
+				-int64(messageLength(message.Message)))
+			if !c.writeLines(message) {
 				break Loop
 			}
 		case <-c.Catbox.ShutdownChan:
@@ -259,6 +449,66 @@ Loop:
 	log.Printf("Client %s: Writer shutting down.", c)
 }
 
+// writeMessage encodes a message and writes it to the client's connection. It
+// returns false if we had a write error. In that case we've told the server
+// the client is dead.
+func (c *LocalClient) writeMessage(message irc.Message) bool {
+	bufs, ok := c.encodeMessage(message)
+	if !ok {
+		return true
+	}
+	return c.write(bufs)
+}
+
+// encodeMessage encodes a message to the client. It returns false if we can't
+// send it at all.
+func (c *LocalClient) encodeMessage(message irc.Message) ([]string, bool) {
+	// Messages to users that are too long are split into several lines where
+	// possible.
+	bufs, err := encodeMessage(message, atomic.LoadInt32(&c.ServerLink) == 0)
+	if err != nil {
+		c.Catbox.queueOperNotice(fmt.Sprintf(
+			"Trying to send invalid message to client %s: %s", c.String(), err))
+		if err != irc.ErrTruncated {
+			return nil, false
+		}
+	}
+	return bufs, true
+}
+
+// writeLines writes a message from the send queue, using the lines we encoded
+// it to if we did already.
+func (c *LocalClient) writeLines(message outMessage) bool {
+	lines := message.lines
+	if lines == nil {
+		var ok bool
+		if lines, ok = c.encodeMessage(message.Message); !ok {
+			return true
+		}
+	}
+	return c.write(addTags(message.tags, lines))
+}
+
+// write writes the encoded lines to the client's connection. It returns false
+// if we had a write error.
+func (c *LocalClient) write(bufs []string) bool {
+	for _, buf := range bufs {
+		if err := c.Conn.Write(buf); err != nil {
+			log.Printf("Client %s: Write problem: %s: %s", c, buf, err)
+			// Don't kill the client immediately. Give a chance for us to read
+			// anything from it. Don't hold up shutting down though.
+			select {
+			case <-time.After(5 * time.Second):
+			case <-c.Catbox.ShutdownChan:
+			}
+			c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c, Error: err})
+			return false
+		}
+	}
+
+	return true
+}
+
 // quit means the client is quitting. Tell it why and clean up.
 func (c *LocalClient) quit(msg string) {
 	// May already be cleaning up.
@@ -272,6 +522,51 @@ func (c *LocalClient) quit(msg string) {
 	close(c.WriteChan)
 
 	delete(c.Catbox.LocalClients, c.ID)
+	c.Catbox.releaseClientID(c.ID)
+}
+
+// checkIdle looks at how long it's been since we heard from the client. If
+// it's been idle pingTime and we haven't pinged it in that long, we send it
+// the PING. It returns false if it's been idle longer than deadTime, meaning
+// we consider it dead.
+func (c *LocalClient) checkIdle(now time.Time, pingTime,
+	deadTime time.Duration, ping irc.Message) bool {
+	timeIdle := now.Sub(c.LastActivityTime)
+
+	// Was it active recently enough that we don't need to do anything?
+	if timeIdle < pingTime {
+		return true
+	}
+
+	// Has it been idle long enough that we consider it dead?
+	if timeIdle > deadTime {
+		return false
+	}
+
+	// Should we ping it? We might have pinged it recently.
+	if now.Sub(c.LastPingTime) < pingTime {
+		return true
+	}
+
+	c.maybeQueuePriorityMessage(ping)
+	c.LastPingTime = now
+	c.PingPending = true
+	return true
+}
+
+// gotPong records that the client answered our PING, and how long it took.
+func (c *LocalClient) gotPong() {
+	if !c.PingPending {
+		return
+	}
+	c.PingPending = false
+	c.Lag = c.Catbox.now().Sub(c.LastPingTime)
+}
+
+// isLinking tells whether the client is a server part way through linking
+// with us.
+func (c *LocalClient) isLinking() bool {
+	return c.LinkTo != "" || c.GotPASS || c.GotCAPAB || c.GotSERVER
 }
 
 // Upgrade a LocalClient to a LocalUser.
@@ -281,10 +576,7 @@ func (c *LocalClient) registerUser() {
 	// Check NICK is still available. I'm no longer reserving it in the Nicks map
 	// until registration completes, so check now.
 	_, exists := c.Catbox.Nicks[canonicalizeNick(c.PreRegDisplayNick)]
-	if exists {
-		// 433 ERR_NICKNAMEINUSE
-		c.messageFromServer("433", []string{c.PreRegDisplayNick,
-			"Nickname is already in use"})
+	if exists && !c.nickInUse(c.PreRegDisplayNick) {
 		return
 	}
 
@@ -296,7 +588,7 @@ func (c *LocalClient) registerUser() {
 	// sure it does not start with ":" as that cannot be encoded. Consider IPv6
 	// IPs such as "::1". TS6 specifies that with these we prepend a "0". e.g.,
 	// "0::1".
-	ip := c.Conn.IP.String()
+	ip := c.ip().String()
 	if ip[0] == ':' {
 		ip = "0" + ip
 	}
@@ -306,10 +598,16 @@ func (c *LocalClient) registerUser() {
 		hostname = c.Hostname
 	}
 
+	// Keep where they connect from to ourself. We keep their IP to match
+	// K-Lines against, but show others 0 (see publicIP()).
+	if c.Catbox.Config.PrivacyProfile == PrivacyProfileAnonymous {
+		hostname = c.Catbox.cloakedHostname()
+	}
+
 	u := &User{
 		DisplayNick: c.PreRegDisplayNick,
 		HopCount:    0,
-		NickTS:      time.Now().Unix(),
+		NickTS:      c.Catbox.now().Unix(),
 		Modes:       make(map[byte]struct{}),
 		Username:    c.PreRegUser,
 		Hostname:    hostname,
@@ -321,37 +619,59 @@ func (c *LocalClient) registerUser() {
 
 	lu.User = u
 
+	userModes := c.Catbox.defaultUserModes(c.Listener)
+	password := c.Catbox.clientPassword(c.Listener)
+	spoofed := false
+
 	// Apply any user configuration that matches them.
 	// This may flag the user flood exempt.
 	// This may give the user a spoof.
+	// This may change the user modes we set.
 	for _, userConfig := range c.Catbox.Config.UserConfigs {
 		if !u.matchesMask(userConfig.UserMask, userConfig.HostMask) {
 			continue
 		}
 
 		u.FloodExempt = userConfig.FloodExempt
-		if u.FloodExempt {
-			lu.serverNotice("Congratulations. You're exempt from flood protection.")
-		}
 
 		if len(userConfig.Spoof) > 0 {
 			u.Hostname = userConfig.Spoof
-			lu.serverNotice(fmt.Sprintf("Spoofing your hostname as %s", u.Hostname))
+			spoofed = true
+		}
+
+		if userConfig.HasUserModes {
+			userModes = userConfig.UserModes
+		}
+
+		u.Relay = userConfig.Relay
+
+		if userConfig.Password != "" {
+			password = userConfig.Password
 		}
 
 		// Match the first only.
 		break
 	}
 
+	if password != "" && !c.isVirtual() &&
+		subtle.ConstantTimeCompare([]byte(c.PreRegClientPass),
+			[]byte(password)) != 1 {
+		// 464 ERR_PASSWDMISMATCH
+		lu.messageFromServer("464", []string{"Password incorrect"})
+		c.quit("Bad password")
+		return
+	}
+
 	// Check if they're klined. Don't accept further if so.
 	for _, kline := range c.Catbox.KLines {
 		if !u.matchesMask(kline.UserMask, kline.HostMask) {
 			continue
 		}
 		// 465 ERR_YOUREBANNEDCREEP
-		lu.messageFromServer("465", []string{"You are banned from this server"})
+		lu.messageFromServer("465", []string{c.Catbox.userMessageText(u,
+			"banned", "reason", kline.Reason)})
 
-		c.quit(fmt.Sprintf("Connection closed: %s", kline.Reason))
+		c.quit(c.Catbox.userMessageText(u, "kline-quit", "reason", kline.Reason))
 
 		c.Catbox.noticeLocalOpers(fmt.Sprintf(
 			"Rejecting user registration for %s!%s@%s. KLined: %s",
@@ -359,33 +679,43 @@ func (c *LocalClient) registerUser() {
 		return
 	}
 
+	// Only tell them what their configuration gives them once we accept them.
+	if u.FloodExempt {
+		lu.serverNotice("Congratulations. You're exempt from flood protection.")
+	}
+	if spoofed {
+		lu.serverNotice(fmt.Sprintf("Spoofing your hostname as %s", u.Hostname))
+	}
+
 	uid, err := lu.makeTS6UID(lu.ID)
 	if err != nil {
 		log.Fatal(err)
 	}
 	u.UID = uid
 
+	c.Catbox.internUser(u)
+
 	delete(c.Catbox.LocalClients, c.ID)
 	c.Catbox.LocalUsers[lu.ID] = lu
+	c.Catbox.addHostUser(lu)
 	c.Catbox.Nicks[canonicalizeNick(u.DisplayNick)] = u.UID
 	c.Catbox.Users[u.UID] = u
+	c.Catbox.nickOnline(u)
 
 	// 001 RPL_WELCOME
 	lu.messageFromServer("001", []string{
-		fmt.Sprintf("Welcome to the Internet Relay Network %s", u.nickUhost()),
+		c.Catbox.userMessageText(u, "welcome", "user", u.Username, "host",
+			u.Hostname),
 	})
 
 	// 002 RPL_YOURHOST
 	lu.messageFromServer("002", []string{
-		fmt.Sprintf("Your host is %s, running version %s",
-			lu.Catbox.Config.ServerName,
-			lu.Catbox.version(),
-		),
+		c.Catbox.userMessageText(u, "your-host", "version", lu.Catbox.version()),
 	})
 
 	// 003 RPL_CREATED
 	lu.messageFromServer("003", []string{
-		fmt.Sprintf("This server was created %s", CreatedDate),
+		c.Catbox.userMessageText(u, "created", "created", CreatedDate),
 	})
 
 	// 004 RPL_MYINFO
@@ -395,20 +725,38 @@ func (c *LocalClient) registerUser() {
 		lu.Catbox.Config.ServerName,
 		lu.Catbox.version(),
 		// User modes we support.
-		"ioC",
+		"giopBC",
 		// Channel modes we support.
-		"nos",
+		supportedChannelModes(),
 	})
 
+	lu.sendISupport()
+
+	// 042 RPL_YOURID. Non standard. IRCnet uses it. It helps match up what a
+	// user reports with our logs and server to server traffic.
+	lu.messageFromServer("042", []string{string(u.UID), "your unique ID"})
+
 	c.Catbox.updateCounters()
 	c.Catbox.ConnectionCount++
 
-	lu.lusersCommand()
+	c.Catbox.emitEvent("connect", "nick", u.DisplayNick, "uid", string(u.UID),
+		"user", u.Username, "host", u.Hostname, "ip", c.Catbox.publicIP(u))
+
+	lu.lusersCommand(irc.Message{Command: "LUSERS"})
 	lu.motdCommand()
 
-	// Set user mode +i automatically.
-	lu.messageUser(u, "MODE", []string{u.DisplayNick, "+i"})
-	u.Modes['i'] = struct{}{}
+	// Set the configured user modes and any asked for in USER automatically.
+	modeString := "+"
+	for _, mode := range userModes + c.PreRegUserModes {
+		if _, exists := u.Modes[byte(mode)]; exists {
+			continue
+		}
+		u.Modes[byte(mode)] = struct{}{}
+		modeString += string(mode)
+	}
+	if len(modeString) > 1 {
+		lu.messageUser(u, "MODE", []string{u.DisplayNick, modeString})
+	}
 
 	// Tell linked servers about this new client.
 	for _, server := range c.Catbox.LocalServers {
@@ -423,7 +771,7 @@ func (c *LocalClient) registerUser() {
 				u.modesString(),
 				u.Username,
 				u.Hostname,
-				u.IP,
+				c.Catbox.publicIP(u),
 				string(u.UID),
 				u.RealName,
 			},
@@ -440,13 +788,22 @@ func (c *LocalClient) registerUser() {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.UID),
 			Command: "CLICONN",
-			Params:  []string{c.Catbox.Config.ServerName, u.IP},
+			Params:  []string{c.Catbox.Config.ServerName, c.Catbox.publicIP(u)},
 		})
+
+		if u.Relay {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "RELAY"},
+			})
+		}
 	}
 
 	// Tell local operators.
 	// Remote operators can know as their server will receive a UID command, so
 	// their server can tell them upon receipt of that.
+	fingerprint := c.connectionFingerprint()
 	for _, oper := range c.Catbox.Opers {
 		if !oper.isLocal() {
 			continue
@@ -456,9 +813,13 @@ func (c *LocalClient) registerUser() {
 			continue
 		}
 		oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s %s %s %s %s (%s)",
-			u.DisplayNick, u.Username, u.Hostname, u.IP, u.RealName,
-			c.Catbox.Config.ServerName))
+			u.DisplayNick, u.Username, u.Hostname, c.Catbox.publicIP(u),
+			u.RealName, c.Catbox.Config.ServerName))
+		oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s details: %s",
+			u.DisplayNick, fingerprint))
 	}
+
+	c.Catbox.maybeChallenge(lu)
 }
 
 // Send an IRC message to a client. Appears to be from the server.
@@ -477,10 +838,16 @@ func (c *LocalClient) messageFromServer(command string, params []string) {
 		newParams := []string{nick}
 		newParams = append(newParams, params...)
 		params = newParams
+
+		// We don't know the client's language yet. Use the server's.
+		last := len(params) - 1
+		if name, ok := replyMessageName(command, params[last]); ok {
+			params[last] = c.Catbox.messageText(name, nick)
+		}
 	}
 
 	c.maybeQueueMessage(irc.Message{
-		Prefix:  c.Catbox.Config.ServerName,
+		Prefix:  c.Catbox.config().ServerName,
 		Command: command,
 		Params:  params,
 	})
@@ -488,7 +855,7 @@ func (c *LocalClient) messageFromServer(command string, params []string) {
 
 func (c *LocalClient) sendSVINFO() {
 	// SVINFO <TS version> <min TS version> 0 <current time>
-	epoch := time.Now().Unix()
+	epoch := c.Catbox.now().Unix()
 	c.maybeQueueMessage(irc.Message{
 		Command: "SVINFO",
 		Params: []string{
@@ -514,6 +881,11 @@ func (c *LocalClient) registerServer() {
 
 	newLS.Server = newServer
 
+	if linkInfo, exists := c.Catbox.Config.Servers[c.PreRegServerName]; exists {
+		newLS.Observer = linkInfo.Observer
+		newLS.Untrusted = linkInfo.Untrusted
+	}
+
 	delete(c.Catbox.LocalClients, c.ID)
 	c.Catbox.LocalServers[newLS.ID] = newLS
 	c.Catbox.Servers[newServer.SID] = newServer
@@ -532,10 +904,17 @@ func (c *LocalClient) registerServer() {
 		linkNotice = fmt.Sprintf("Established link to %s (PLAINTEXT).",
 			c.PreRegServerName)
 	}
+	if newLS.Observer {
+		linkNotice += " It is an observer."
+	}
+	if newLS.Untrusted {
+		linkNotice += " It is untrusted."
+	}
 
 	c.Catbox.ConnectionCount++
 
-	newLS.Catbox.noticeOpers(linkNotice)
+	newLS.Catbox.noticeOpersAbout("links", linkNotice)
+	newLS.Catbox.emitEvent("link", "server", newServer.Name)
 
 	newLS.sendBurst()
 
@@ -576,11 +955,13 @@ func (c *LocalClient) registerServer() {
 }
 
 func (c *LocalClient) sendServerIntro(pass string) {
+	cfg := c.Catbox.config()
+
 	// PASS <password>, TS, <ts version>, <SID>
 	c.maybeQueueMessage(irc.Message{
 		Command: "PASS",
 		Params: []string{
-			pass, "TS", "6", string(c.Catbox.Config.TS6SID)},
+			pass, "TS", "6", string(cfg.TS6SID)},
 	})
 
 	// CAPAB <space separated list>
@@ -593,16 +974,22 @@ func (c *LocalClient) sendServerIntro(pass string) {
 		// http://www.leeh.co.uk/ircd/encap.txt
 		// TB means support for topic burst. We send/receive TB commands during
 		// burst which tells the topics in channels.
-		Params: []string{"QS ENCAP TB"},
+		// IE means support for invite exceptions (+I). We send/receive them in
+		// BMASK commands during burst and in TMODE.
+		// MLOCK means support for the MLOCK command. Services tell us the modes
+		// they lock on channels with it.
+		// HOPS means support for halfops (+h). We send/receive them as the %
+		// prefix in SJOIN and in TMODE.
+		Params: []string{"QS ENCAP TB IE MLOCK HOPS"},
 	})
 
 	// SERVER <name> <hopcount> <description>
 	c.maybeQueueMessage(irc.Message{
 		Command: "SERVER",
 		Params: []string{
-			c.Catbox.Config.ServerName,
+			cfg.ServerName,
 			"1",
-			c.Catbox.Config.ServerInfo,
+			cfg.ServerInfo,
 		},
 	})
 	c.SentSERVER = true
@@ -610,6 +997,9 @@ func (c *LocalClient) sendServerIntro(pass string) {
 
 // The client sent us a message. Deal with it.
 func (c *LocalClient) handleMessage(m irc.Message) {
+	// Record that client said something to us just now.
+	c.LastActivityTime = c.Catbox.now()
+
 	// Clients SHOULD NOT (section 2.3) send a prefix.
 	if m.Prefix != "" {
 		c.quit("No prefix permitted")
@@ -624,9 +1014,34 @@ func (c *LocalClient) handleMessage(m irc.Message) {
 		return
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
+	// Standalone servers don't link, so no one may register as a server.
+	if c.Catbox.Config.Standalone && (m.Command == "CAPAB" ||
+		m.Command == "SERVER" || m.Command == "SVINFO" ||
+		(m.Command == "PASS" && len(m.Params) > 1)) {
+		c.quit("This server does not link with other servers")
+		return
+	}
+
+	// A guest sending anything other than what may come before registering
+	// means they're not going to register themselves.
+	if c.Guest && !guestPreRegisterCommands[m.Command] {
+		c.registerGuest()
+
+		if lu, exists := c.Catbox.LocalUsers[c.ID]; exists {
+			lu.handleMessage(m)
+			return
+		}
+		if _, exists := c.Catbox.LocalClients[c.ID]; !exists {
+			return
+		}
+	}
+
 	if m.Command == "CAP" {
+		nick := "*"
+		if len(c.PreRegDisplayNick) > 0 {
+			nick = c.PreRegDisplayNick
+		}
+		c.capCommand(m, nick, false)
 		return
 	}
 
@@ -649,6 +1064,16 @@ func (c *LocalClient) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "WEBIRC" {
+		c.webircCommand(m)
+		return
+	}
+
+	if m.Command == "PONG" {
+		c.pongCommand(m)
+		return
+	}
+
 	// To register as a server (using TS6):
 
 	// If incoming client is initiator, they send this:
@@ -728,7 +1153,7 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 		c.messageFromServer("431", []string{"No nickname given"})
 		return
 	}
-	nick := m.Params[0]
+	nick := c.applyNickAffixes(m.Params[0])
 
 	if len(nick) > c.Catbox.Config.MaxNickLength {
 		nick = nick[0:c.Catbox.Config.MaxNickLength]
@@ -745,8 +1170,14 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 	// Nick must be unique.
 	_, exists := c.Catbox.Nicks[nickCanon]
 	if exists {
-		// 433 ERR_NICKNAMEINUSE
-		c.messageFromServer("433", []string{nick, "Nickname is already in use"})
+		if c.nickInUse(nick) && len(c.PreRegUser) > 0 {
+			c.maybeRegisterUser()
+		}
+		return
+	}
+
+	if numeric, text := c.Catbox.nickRefusal(nick); numeric != "" {
+		c.messageFromServer(numeric, []string{nick, text})
 		return
 	}
 
@@ -760,8 +1191,58 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 
 	// If we have USER done already, then we're done registration.
 	if len(c.PreRegUser) > 0 {
-		c.registerUser()
+		c.maybeRegisterUser()
+	}
+}
+
+// clientPassword finds the password users connecting on a listener must give,
+// if any. A matching users.conf entry may override it.
+func (cb *Catbox) clientPassword(listener string) string {
+	kind := listenerKind(listener)
+	if password, exists := cb.Config.ClientPasswords[kind]; exists {
+		return password
+	}
+	return cb.Config.ClientPassword
+}
+
+// defaultUserModes finds the user modes we set on users connecting on a
+// listener when they register. A matching users.conf entry may override them.
+func (cb *Catbox) defaultUserModes(listener string) string {
+	kind := listenerKind(listener)
+	if modes, exists := cb.Config.DefaultUserModesByKind[kind]; exists {
+		return modes
 	}
+	return cb.Config.DefaultUserModes
+}
+
+// applyNickAffixes adds the prefix and suffix the config says nicks must have
+// for the listener the client connected on. We shorten the rest of the nick
+// to make room. If nothing is left, we return a blank nick.
+func (c *LocalClient) applyNickAffixes(nick string) string {
+	kind := listenerKind(c.Listener)
+	prefix := c.Catbox.Config.NickPrefixes[kind]
+	suffix := c.Catbox.Config.NickSuffixes[kind]
+	if c.Listener == "" || (prefix == "" && suffix == "") {
+		return nick
+	}
+
+	// They may give the nick with them already.
+	if strings.HasPrefix(canonicalizeNick(nick), canonicalizeNick(prefix)) {
+		nick = nick[len(prefix):]
+	}
+	if strings.HasSuffix(canonicalizeNick(nick), canonicalizeNick(suffix)) {
+		nick = nick[:len(nick)-len(suffix)]
+	}
+
+	room := c.Catbox.Config.MaxNickLength - len(prefix) - len(suffix)
+	if len(nick) > room {
+		nick = nick[:room]
+	}
+	if nick == "" {
+		return ""
+	}
+
+	return prefix + nick + suffix
 }
 
 func (c *LocalClient) userCommand(m irc.Message) {
@@ -792,7 +1273,13 @@ func (c *LocalClient) userCommand(m irc.Message) {
 	}
 	c.PreRegUser = user
 
-	// We could do something with user mode here.
+	// RFC 2812 says the mode is a bitmask of modes to set. Bit 2 is +w and bit 3
+	// is +i. We don't have +w. RFC 1459 clients send a hostname here instead.
+	// Ignore anything not a number.
+	c.PreRegUserModes = ""
+	if modeMask, err := strconv.Atoi(m.Params[1]); err == nil && modeMask&8 != 0 {
+		c.PreRegUserModes = "i"
+	}
 
 	realName := m.Params[3]
 	if len(realName) > maxRealNameLength {
@@ -807,15 +1294,75 @@ func (c *LocalClient) userCommand(m irc.Message) {
 
 	// If we have a nick, then we're done registration.
 	if len(c.PreRegDisplayNick) > 0 {
+		c.maybeRegisterUser()
+	}
+}
+
+// maybeRegisterUser registers a user who sent NICK and USER. If ping-cookie is
+// on, they must first answer a PING with a cookie they can only know if they
+// read what we send them. This stops drones that don't and those spoofing
+// their address.
+func (c *LocalClient) maybeRegisterUser() {
+	if c.CapNegotiating || c.WebIRCLookup {
+		return
+	}
+
+	if !c.Catbox.Config.PingCookie || c.GotPingCookie {
+		c.registerUser()
+		return
+	}
+
+	if c.PingCookie != "" {
+		return
+	}
+
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		c.quit(fmt.Sprintf("Unable to generate PING cookie: %s", err))
+		return
+	}
+	c.PingCookie = strings.ToUpper(hex.EncodeToString(buf))
+
+	c.maybeQueueMessage(irc.Message{
+		Command: "PING",
+		Params:  []string{c.PingCookie},
+	})
+}
+
+// A user answers the PING we sent with a cookie. See maybeRegisterUser().
+//
+// Parameters: <cookie>
+func (c *LocalClient) pongCommand(m irc.Message) {
+	if c.PingCookie == "" || c.GotPingCookie {
+		return
+	}
+
+	if len(m.Params) == 0 || m.Params[len(m.Params)-1] != c.PingCookie {
+		// 513 ERR_WRONGPONG
+		c.messageFromServer("513", []string{fmt.Sprintf(
+			"To connect type /QUOTE PONG %s", c.PingCookie)})
+		return
+	}
+
+	c.GotPingCookie = true
+	if len(c.PreRegDisplayNick) > 0 && len(c.PreRegUser) > 0 &&
+		!c.CapNegotiating {
 		c.registerUser()
 	}
 }
 
 func (c *LocalClient) passCommand(m irc.Message) {
+	// For user registration:
+	// PASS <password>
+	// We check it when they finish registering.
+	if len(m.Params) == 1 {
+		c.PreRegClientPass = m.Params[0]
+		return
+	}
+
 	// For server registration:
 	// PASS <password>, TS, <ts version>, <SID>
 	if len(m.Params) < 4 {
-		// For now I only recognise this form of PASS.
 		// 461 ERR_NEEDMOREPARAMS
 		c.messageFromServer("461", []string{"PASS", "Not enough parameters"})
 		return
@@ -953,6 +1500,14 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 		return
 	}
 
+	if reason, ok := c.Catbox.checkRelink(TS6SID(c.PreRegTS6SID), serverName,
+		serverName); !ok {
+		c.Catbox.noticeLocalOpersAbout("links", fmt.Sprintf("Refused link from %s: %s",
+			serverName, reason))
+		c.quit(reason)
+		return
+	}
+
 	c.PreRegServerName = serverName
 	c.PreRegServerDesc = m.Params[2]
 
@@ -1005,7 +1560,7 @@ func (c *LocalClient) svinfoCommand(m irc.Message) {
 		return
 	}
 
-	epoch := time.Now().Unix()
+	epoch := c.Catbox.now().Unix()
 
 	delta := epoch - theirEpoch
 	if delta < 0 {
@@ -1034,5 +1589,9 @@ func (c *LocalClient) svinfoCommand(m irc.Message) {
 }
 
 func (c *LocalClient) errorCommand(m irc.Message) {
+	// The server we connected to refused us.
+	if c.LinkTo != "" && len(m.Params) > 0 {
+		c.Catbox.linkStatus(c.LinkTo).LastFailure = m.Params[0]
+	}
 	c.quit("Bye")
 }
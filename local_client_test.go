@@ -0,0 +1,420 @@
+package terrarium
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// We ping clients that go quiet while registering, drop those that don't
+// answer, and drop those that answer but never register.
+func TestMemNetworkRegistrationPing(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.RegistrationTime = 5 * time.Minute
+		a.cb.setConfig(&cfg)
+	})
+	pingTime := a.cb.Config.PingTime
+
+	connect := func() *memClient {
+		ours, theirs := net.Pipe()
+		c := &memClient{conn: ours}
+		go c.readLoop()
+		a.cb.introduceClient(theirs, "")
+		return c
+	}
+
+	silent := connect()
+	answers := connect()
+	n.waitFor("the clients to connect", func() bool {
+		count := 0
+		a.call(func() { count = len(a.cb.LocalClients) })
+		return count == 2
+	})
+
+	n.advance(pingTime + time.Second)
+	n.waitFor("the PINGs", func() bool {
+		return silent.hasMessage("PING") && answers.hasMessage("PING")
+	})
+	answers.send(irc.Message{Command: "PONG",
+		Params: []string{a.cb.Config.ServerName}})
+	n.waitFor("the PONG", func() bool {
+		answered := false
+		a.call(func() {
+			for _, c := range a.cb.LocalClients {
+				if c.LastActivityTime.After(c.ConnectionStartTime) {
+					answered = true
+				}
+			}
+		})
+		return answered
+	})
+
+	n.advance(pingTime)
+	n.waitFor("the silent client to time out", func() bool {
+		return silent.hasMessageContaining("ERROR", "Ping timeout")
+	})
+	if answers.hasMessage("ERROR") {
+		t.Fatalf("client that answered the PING was dropped")
+	}
+
+	n.advance(5 * time.Minute)
+	n.waitFor("the other client to be dropped", func() bool {
+		return answers.hasMessageContaining("ERROR", "Idle too long")
+	})
+}
+
+// Under the anonymous privacy profile users' hosts are cloaked, other servers
+// get 0 as their IP, and only admins see their address.
+func TestMemNetworkAnonymousProfile(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.PrivacyProfile = PrivacyProfileAnonymous
+		cfg.CloakSuffix = "example.net"
+		cfg.OperPrivileges = map[string]map[string]struct{}{
+			"admin": {"admin": {}},
+		}
+		a.cb.setConfig(&cfg)
+	})
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	a.connectUser("hidden", "hidden")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	userHost := func(s *memServer, nick string) (string, string) {
+		host, ip := "", ""
+		s.call(func() {
+			u := s.cb.Users[s.cb.Nicks[canonicalizeNick(nick)]]
+			host, ip = u.Hostname, u.IP
+		})
+		return host, ip
+	}
+	// We keep the IP to ourself.
+	for s, wantIP := range map[*memServer]string{a: "127.0.0.1", b: "0"} {
+		host, ip := userHost(s, "hidden")
+		if host != "anonymous.example.net" || ip != wantIP {
+			t.Errorf("%s has hidden at host %s and IP %s, wanted anonymous.example.net and %s",
+				s.cb.Config.ServerName, host, ip, wantIP)
+		}
+	}
+
+	// Logs leave out the address.
+	a.call(func() {
+		lu := a.cb.Users[a.cb.Nicks["hidden"]].LocalUser
+		if got := lu.String(); strings.Contains(got, "127.0.0.1") ||
+			strings.Contains(got, "pipe") {
+			t.Errorf("hidden is logged as %s, wanted no address", got)
+		}
+	})
+
+	oper.send(irc.Message{Command: "CHECK", Params: []string{"hidden"}})
+	n.waitFor("CHECK hidden to end", func() bool {
+		return oper.hasMessageContaining("NOTICE", "End of CHECK hidden")
+	})
+	if !oper.hasMessageContaining("NOTICE", "from a hidden address") {
+		t.Errorf("oper without admin saw hidden's address")
+	}
+
+	a.call(func() {
+		a.cb.Users[a.cb.Nicks["oper"]].LocalUser.OperName = "admin"
+	})
+	oper.send(irc.Message{Command: "CHECK", Params: []string{"hidden"}})
+	n.waitFor("admin to see hidden's address", func() bool {
+		return oper.hasMessageContaining("NOTICE", "from 127.0.0.1")
+	})
+
+	// K-Lines on their IP still match them.
+	oper.send(irc.Message{Command: "KLINE",
+		Params: []string{"~hidden@127.0.0.1", "go away"}})
+	n.waitFor("hidden to be cut off", func() bool {
+		return a.userServer("hidden") == ""
+	})
+}
+
+// Users get the configured user modes when they register, plus +i if they ask
+// for it in USER. A listener kind or a user config may replace the default.
+// Other servers learn the modes.
+func TestMemNetworkRegistrationUserModes(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(0)
+
+	userModes := func(s *memServer, nick string) string {
+		var modes string
+		s.call(func() {
+			if u := s.cb.Users[s.cb.Nicks[canonicalizeNick(nick)]]; u != nil {
+				modes = u.modesString()
+			}
+		})
+		return modes
+	}
+
+	a.connectUser("default", "default")
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.DefaultUserModes = ""
+		cfg.DefaultUserModesByKind = map[string]string{"i2p": "i"}
+		cfg.UserConfigs = []UserConfig{{UserMask: "~classy", HostMask: "*",
+			UserModes: "C", HasUserModes: true}}
+		a.cb.setConfig(&cfg)
+	})
+
+	a.connectUser("plain", "plain")
+	a.connectUserWithModes("asked", "asked", "8")
+	a.connectUserWithModes("classy", "classy", "rfc1459.host")
+	a.connectUserOn("i2p/irc", "hidden", "hidden", "0")
+
+	n.waitForConverged(5)
+
+	for nick, want := range map[string]string{
+		"default": "+ip",
+		"plain":   "+",
+		"asked":   "+i",
+		"classy":  "+C",
+		"hidden":  "+i",
+	} {
+		if got := userModes(a, nick); got != want {
+			t.Errorf("%s has modes %s, wanted %s", nick, got, want)
+		}
+		if got := userModes(b, nick); got != want {
+			t.Errorf("%s has modes %s on b, wanted %s", nick, got, want)
+		}
+	}
+}
+
+// Users connecting on a listener with a nick suffix get it at registration
+// and keep it when they change nick. Others don't.
+func TestMemNetworkNickAffixes(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.NickSuffixes = map[string]string{"i2p": "|i2p"}
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUserOn("i2p/irc", "alice", "alice", "0")
+	a.connectUserOn("i2p/irc", "bob|I2P", "bob", "0")
+	a.connectUserOn("i2p/irc", "verylongnick", "long", "0")
+	a.connectUserOn("tcp/0.0.0.0:6667", "dave", "dave", "0")
+
+	if m := alice.lastMessage(irc.ReplyWelcome); m.Params[0] != "alice|i2p" {
+		t.Errorf("alice registered as %s, wanted alice|i2p", m.Params[0])
+	}
+
+	alice.send(irc.Message{Command: "NICK", Params: []string{"carol"}})
+	n.waitFor("alice to become carol|i2p", func() bool {
+		return a.userServer("carol|i2p") == "a.example.com"
+	})
+
+	for _, nick := range []string{"bob|I2P", "veryl|i2p", "dave"} {
+		if a.userServer(nick) != "a.example.com" {
+			t.Errorf("%s is not registered", nick)
+		}
+	}
+}
+
+// Users must give the password for the listener they connect on, or the one
+// for their users.conf entry.
+func TestMemNetworkClientPassword(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ClientPassword = "secret"
+		cfg.ClientPasswords = map[string]string{"tls": "tlspass"}
+		cfg.UserConfigs = []UserConfig{
+			{UserMask: "~bot*", HostMask: "*", Password: "botpass",
+				FloodExempt: true, Spoof: "bot.example.com"},
+		}
+		a.cb.setConfig(&cfg)
+	})
+
+	tests := []struct {
+		listener string
+		nick     string
+		pass     string
+		reply    string
+	}{
+		{"", "alice", "", "464"},
+		{"", "alice", "wrong", "464"},
+		{"", "alice", "secret", irc.ReplyWelcome},
+		{"tls/127.0.0.1:6697", "bob", "secret", "464"},
+		{"tls/127.0.0.1:6697", "bob", "tlspass", irc.ReplyWelcome},
+		{"", "bot", "secret", "464"},
+		{"", "bot", "botpass", irc.ReplyWelcome},
+	}
+	for _, test := range tests {
+		ours, theirs := net.Pipe()
+		c := &memClient{conn: ours}
+		go c.readLoop()
+		a.cb.introduceClient(theirs, test.listener)
+
+		if test.pass != "" {
+			c.send(irc.Message{Command: "PASS", Params: []string{test.pass}})
+		}
+		c.send(irc.Message{Command: "NICK", Params: []string{test.nick}})
+		c.send(irc.Message{Command: "USER",
+			Params: []string{test.nick, "0", "*", test.nick}})
+
+		n.waitFor("a reply to registering", func() bool {
+			return c.hasMessage("464") || c.hasMessage(irc.ReplyWelcome)
+		})
+		if !c.hasMessage(test.reply) {
+			t.Errorf("%s on %q with PASS %q: wanted %s", test.nick, test.listener,
+				test.pass, test.reply)
+		}
+
+		// Only those we accept hear what their configuration gives them.
+		spoofed := c.hasMessageContaining("NOTICE", "Spoofing your hostname")
+		if wanted := test.nick == "bot" && test.reply == irc.ReplyWelcome; spoofed !=
+			wanted {
+			t.Errorf("%s with PASS %q: told of spoof %v, wanted %v", test.nick,
+				test.pass, spoofed, wanted)
+		}
+	}
+}
+
+// With ping-cookie on, users must answer our PING before they register.
+func TestMemNetworkPingCookie(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.PingCookie = true
+		a.cb.setConfig(&cfg)
+	})
+
+	ours, theirs := net.Pipe()
+	c := &memClient{conn: ours}
+	go c.readLoop()
+	a.cb.introduceClient(theirs, "")
+
+	c.send(irc.Message{Command: "NICK", Params: []string{"alice"}})
+	c.send(irc.Message{Command: "USER",
+		Params: []string{"alice", "0", "*", "alice"}})
+	n.waitFor("the PING cookie", func() bool { return c.hasMessage("PING") })
+
+	c.send(irc.Message{Command: "PONG", Params: []string{"wrong"}})
+	n.waitFor("the wrong PONG to be refused", func() bool {
+		return c.hasMessage("513")
+	})
+	if c.hasMessage(irc.ReplyWelcome) {
+		t.Fatalf("alice registered without answering the PING")
+	}
+
+	c.send(irc.Message{Command: "PONG",
+		Params: []string{c.lastMessage("PING").Params[0]}})
+	n.waitFor("alice to register", func() bool {
+		return c.hasMessage(irc.ReplyWelcome)
+	})
+}
+
+// We stop answering users who send too many unknown commands, and don't
+// answer those we ignore at all.
+func TestMemNetworkUnknownCommands(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.UnknownCommandLimit = 2
+		cfg.IgnoreCommands = map[string]struct{}{"ZNC": {}}
+		a.cb.setConfig(&cfg)
+	})
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	user := a.connectUser("user", "user")
+
+	user.send(irc.Message{Command: "ZNC", Params: []string{"help"}})
+	for _, command := range []string{"FOO1", "FOO2", "FOO3", "FOO4"} {
+		user.send(irc.Message{Command: command})
+	}
+	n.waitFor("operators to hear about it", func() bool {
+		return oper.hasMessageContaining("NOTICE", "more than 2 unknown commands")
+	})
+
+	// Make sure we've seen all the replies.
+	user.send(irc.Message{Command: "PING", Params: []string{"done"}})
+	n.waitFor("the PONG", func() bool { return user.hasMessage("PONG") })
+
+	var unknown []string
+	user.mutex.Lock()
+	for _, m := range user.messages {
+		if m.Command == "421" {
+			unknown = append(unknown, m.Params[1])
+		}
+	}
+	user.mutex.Unlock()
+	if strings.Join(unknown, " ") != "FOO1 FOO2" {
+		t.Errorf("user got 421 for %q, wanted FOO1 and FOO2", unknown)
+	}
+}
+
+// Users may PING other servers, and we measure how long users take to answer
+// our PINGs.
+func TestMemNetworkClientPing(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	user := a.connectUser("user", "user")
+	a.makeOper("user")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(1)
+
+	user.send(irc.Message{Command: "PING", Params: []string{"token"}})
+	n.waitFor("our PONG", func() bool {
+		m := user.lastMessage("PONG")
+		return m != nil && m.Params[1] == "token"
+	})
+
+	user.send(irc.Message{Command: "PING",
+		Params: []string{"token", "b.example.com"}})
+	n.waitFor("b's PONG", func() bool {
+		m := user.lastMessage("PONG")
+		return m != nil && m.Prefix == "b.example.com" &&
+			m.Params[0] == "b.example.com" && m.Params[1] == "user"
+	})
+
+	user.send(irc.Message{Command: "PING",
+		Params: []string{"token", "c.example.com"}})
+	n.waitFor("no such server", func() bool {
+		return user.hasMessage("402")
+	})
+
+	n.advance(a.cb.Config.PingTime + time.Second)
+	n.waitFor("our PING", func() bool {
+		return user.hasMessage("PING")
+	})
+	user.send(irc.Message{Command: "CHECK", Params: []string{"user"}})
+	n.waitFor("CHECK while we wait", func() bool {
+		return user.hasMessageContaining("NOTICE", "Lag 0s, waiting for PONG")
+	})
+
+	n.advance(2 * time.Second)
+	user.send(irc.Message{Command: "PONG", Params: []string{"a.example.com"}})
+	user.send(irc.Message{Command: "CHECK", Params: []string{"user"}})
+	n.waitFor("CHECK to show the lag", func() bool {
+		return user.hasMessageContaining("NOTICE", "Lag 2s")
+	})
+}
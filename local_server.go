@@ -3,8 +3,10 @@ package terrarium
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/horgh/irc"
@@ -16,31 +18,38 @@ type LocalServer struct {
 
 	Server *Server
 
-	// The last time we heard anything from it.
-	LastActivityTime time.Time
-
-	// The last time we sent it a PING.
-	LastPingTime time.Time
-
 	// Flags to know about our bursting state.
 	GotPING  bool
 	GotPONG  bool
 	Bursting bool
+
+	// Notices for local opers we held back during the burst, counted by what
+	// they say happened. See burstNotice().
+	BurstNotices map[string]int
+
+	// Whether the server links as an observer. See observerAllows().
+	Observer bool
+
+	// Whether we don't trust the server. See trustAllows().
+	Untrusted bool
 }
 
 // NewLocalServer upgrades a LocalClient to a LocalServer.
 func NewLocalServer(c *LocalClient) *LocalServer {
-	now := time.Now()
+	now := c.Catbox.now()
 
 	s := &LocalServer{
-		LocalClient:      c,
-		LastActivityTime: now,
-		LastPingTime:     now,
-		GotPING:          false,
-		GotPONG:          false,
-		Bursting:         true,
+		LocalClient:  c,
+		GotPING:      false,
+		GotPONG:      false,
+		Bursting:     true,
+		BurstNotices: map[string]int{},
 	}
 
+	s.LastActivityTime = now
+	s.LastPingTime = now
+	atomic.StoreInt32(&c.ServerLink, 1)
+
 	return s
 }
 
@@ -76,7 +85,11 @@ func (s *LocalServer) quit(msg string) {
 	// But we don't. Or ircd-ratbox does not. Do the same.
 	// Just send it to our local servers, they propagate it.
 
-	s.messageFromServer("ERROR", []string{msg})
+	s.maybeQueueControlMessage(irc.Message{
+		Prefix:  s.Catbox.Config.ServerName,
+		Command: "ERROR",
+		Params:  []string{msg},
+	})
 
 	close(s.WriteChan)
 
@@ -91,8 +104,12 @@ func (s *LocalServer) quit(msg string) {
 		})
 	}
 
-	s.Catbox.noticeLocalOpers(fmt.Sprintf("Server %s delinked: %s",
+	s.Catbox.noticeLocalOpersAbout("links", fmt.Sprintf("Server %s delinked: %s",
 		s.Server.Name, msg))
+	s.Catbox.emitEvent("split", "server", s.Server.Name, "from",
+		s.Catbox.Config.ServerName, "reason", msg)
+
+	s.Catbox.recordDelink(s.Server.Name)
 }
 
 // lostServer is departing the network.
@@ -117,7 +134,19 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 	// Include the one we're losing with its links.
 	lostServers = append(lostServers, lostServer)
 
+	// Quit message format is important. It tells that there was a netsplit,
+	// and between which two servers.
+	var quitMessage string
+	if lostServer.isLocal() {
+		quitMessage = fmt.Sprintf("%s %s", s.Catbox.Config.ServerName,
+			lostServer.Name)
+	} else {
+		quitMessage = fmt.Sprintf("%s %s", lostServer.LinkedTo.Name,
+			lostServer.Name)
+	}
+
 	// Look for users we are losing.
+	lostUsers := 0
 	for _, user := range s.Catbox.Users {
 		if user.isLocal() {
 			continue
@@ -137,35 +166,100 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 			continue
 		}
 
-		log.Printf("Losing user %s", user)
-
-		// This user is gone.
+		// This user is gone. Hold their nick in case they come back.
+		s.Catbox.delayNick(user.DisplayNick)
 
 		// Tell local users about them quitting.
 		// Remote users will be told by their own servers.
-
-		// Quit message format is important. It tells that there was a netsplit,
-		// and between which two servers.
-		var quitMessage string
-		if lostServer.isLocal() {
-			quitMessage = fmt.Sprintf("%s %s", s.Catbox.Config.ServerName,
-				lostServer.Name)
-		} else {
-			quitMessage = fmt.Sprintf("%s %s", lostServer.LinkedTo.Name,
-				lostServer.Name)
-		}
-
 		s.Catbox.quitRemoteUser(user, quitMessage)
+		lostUsers++
 	}
 
 	// Forget all lost servers.
 	for _, server := range lostServers {
-		log.Printf("Losing server %s", server)
+		s.Catbox.recordSplit(server, s.Server.Name)
 		if server.isLocal() {
 			delete(s.Catbox.LocalServers, server.LocalServer.ID)
+			s.Catbox.releaseClientID(server.LocalServer.ID)
 		}
 		delete(s.Catbox.Servers, server.SID)
 	}
+
+	// A large split can lose thousands of users. Say how many in one notice
+	// rather than one per user.
+	s.Catbox.noticeLocalOpersAbout("links", fmt.Sprintf(
+		"Netsplit %s: Lost %d users and %d servers",
+		quitMessage, lostUsers, len(lostServers)))
+}
+
+// burstNotice tells local opers about something the server told us, such as a
+// user becoming an operator. During the burst it tells us about everything on
+// its side, so there may be thousands of these. While it bursts we count them
+// by kind instead, and say how many of each there were when the burst ends.
+//
+// kind describes what happened in the plural, such as "users became
+// operators".
+func (s *LocalServer) burstNotice(kind, msg string) {
+	if !s.Bursting {
+		s.Catbox.noticeLocalOpers(msg)
+		return
+	}
+
+	log.Printf("Local oper notice (during burst with %s): %s", s.Server.Name,
+		msg)
+	s.BurstNotices[kind]++
+}
+
+// serverControlCommands are the messages of our own we send servers ahead of
+// others once the link is up. They keep the link alive or say why it's ending.
+//
+// This is only for those we send or answer ourselves. PING and PONG we relay
+// between other servers wait their turn: a server that just linked behind us
+// takes its peer's PONG as the end of that peer's burst, which we may still be
+// relaying.
+var serverControlCommands = map[string]struct{}{
+	"ERROR": {},
+	"PING":  {},
+	"PONG":  {},
+}
+
+// maybeQueueControlMessage queues a message of our own to the server. Control
+// messages such as PING and PONG go ahead of others, so the link doesn't time out
+// behind a flood. During the burst they wait their turn: the server takes our
+// PONG to its PING as the end of our burst, so it must come after it.
+func (s *LocalServer) maybeQueueControlMessage(m irc.Message) {
+	if _, ok := serverControlCommands[m.Command]; ok && !s.Bursting {
+		s.maybeQueuePriorityMessage(m)
+		return
+	}
+	s.maybeQueueMessage(m)
+}
+
+// endBurst records that the server's burst is over. We tell opers, including
+// how many of each notice we held back during it.
+func (s *LocalServer) endBurst() {
+	s.Bursting = false
+	s.Catbox.noticeOpersAbout("links", fmt.Sprintf("Burst with %s over.",
+		s.Server.Name))
+
+	if len(s.BurstNotices) == 0 {
+		return
+	}
+
+	var kinds []string
+	for kind := range s.BurstNotices {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var counts []string
+	for _, kind := range kinds {
+		counts = append(counts, fmt.Sprintf("%d %s", s.BurstNotices[kind], kind))
+	}
+	s.Catbox.noticeLocalOpersAbout("links", fmt.Sprintf("During burst with %s: %s",
+		s.Server.Name, strings.Join(counts, ", ")))
+
+	s.BurstNotices = map[string]int{}
 }
 
 // Send the burst. This tells the server about the state of the world as we see
@@ -220,11 +314,17 @@ func (s *LocalServer) sendBurst() {
 
 		// Tell it about the capabilities of each server too. ratbox does this
 		// during server link.
-		s.maybeQueueMessage(irc.Message{
-			Prefix:  string(server.SID),
-			Command: "ENCAP",
-			Params:  []string{"*", "GCAP", server.capabsString()},
-		})
+		//
+		// We may not have heard them yet if the server is linking elsewhere in the
+		// network right now. Its GCAP reaches us after its SID. We propagate that
+		// GCAP to this server when it arrives, so don't send an empty one now.
+		if server.Capabs != nil {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(server.SID),
+				Command: "ENCAP",
+				Params:  []string{"*", "GCAP", server.capabsString()},
+			})
+		}
 	}
 
 	// Tell it about all users we know about. Use the UID command.
@@ -232,38 +332,7 @@ func (s *LocalServer) sendBurst() {
 	// Parameters: <nick> <hopcount> <nick TS> <umodes> <username> <hostname> <IP> <UID> :<real name>
 	// :8ZZ UID will 1 1475024621 +i will blashyrkh. 0 8ZZAAAAAB :will
 	for _, user := range s.Catbox.Users {
-		var onServer TS6SID
-		if user.isLocal() {
-			onServer = s.Catbox.Config.TS6SID
-		} else {
-			onServer = user.Server.SID
-		}
-		s.maybeQueueMessage(irc.Message{
-			Prefix:  string(onServer),
-			Command: "UID",
-			Params: []string{
-				user.DisplayNick,
-				// Hop count increases for them by one.
-				fmt.Sprintf("%d", user.HopCount+1),
-				fmt.Sprintf("%d", user.NickTS),
-				user.modesString(),
-				user.Username,
-				user.Hostname,
-				user.IP,
-				string(user.UID),
-				user.RealName,
-			},
-		})
-
-		// Send AWAY if they are away.
-		if len(user.AwayMessage) == 0 {
-			continue
-		}
-		s.maybeQueueMessage(irc.Message{
-			Prefix:  string(user.UID),
-			Command: "AWAY",
-			Params:  []string{user.AwayMessage},
-		})
+		s.sendUser(user)
 	}
 
 	// Send channels and the users in them with SJOIN commands.
@@ -276,65 +345,79 @@ func (s *LocalServer) sendBurst() {
 
 		// First make a message with what is common to all messages so that we can
 		// determine the base length.
+		params := []string{fmt.Sprintf("%d", channel.TS), channel.Name}
+		params = append(params, channel.sjoinModes()...)
 		sjoinMessage := irc.Message{
 			Prefix:  string(s.Catbox.Config.TS6SID),
 			Command: "SJOIN",
-			Params: []string{
-				fmt.Sprintf("%d", channel.TS),
-				channel.Name,
-				// Currently we only support +ns.
-				"+ns",
-				// UIDs go in the last parameter. As it is blank, encoding will turn it
-				// into " :" for us. This is acceptable.
-				"",
-			},
+			// UIDs go in the last parameter.
+			Params: append(params, ""),
+		}
+
+		var uids []string
+		for uid := range channel.Members {
+			member := s.Catbox.Users[uid]
+
+			// Send with ops and/or halfops prefix.
+			uidStr := channel.memberPrefixes(member,
+				s.Server.hasCapability("HOPS")) + string(uid)
+
+			uids = append(uids, uidStr)
 		}
 
-		// If encoding the prefix truncates then we have a big problem. We won't be
-		// able to include any UIDs. Killing the connection is perhaps extreme but
-		// we cannot fully synchronize in this case.
-		sjoinEncoded, err := sjoinMessage.Encode()
+		// If the message is too long before we add any UIDs then we have a big
+		// problem. We won't be able to include any UIDs. Killing the connection is
+		// perhaps extreme but we cannot fully synchronize in this case.
+		sjoinMessages, err := splitListMessage(sjoinMessage, uids)
 		if err != nil {
 			s.quit(fmt.Sprintf("Unable to create SJOIN message: %s", err))
 			return
 		}
 
-		baseSize := len(sjoinEncoded)
-
-		uids := ""
-		for uid := range channel.Members {
-			member := s.Catbox.Users[uid]
-
-			uidStr := string(uid)
-
-			// Send with ops and/or voice prefix.
-			if channel.userHasOps(member) {
-				uidStr = "@" + uidStr
-			}
+		for _, m := range sjoinMessages {
+			s.maybeQueueMessage(m)
+		}
 
-			// Assume the first may fit.
-			if len(uids) == 0 {
-				uids += uidStr
-				continue
+		// If they support the IE capab then tell them the invite exceptions with
+		// BMASK.
+		if s.Server.hasCapability("IE") && len(channel.InviteExceptions) > 0 {
+			bmaskMessages, err := splitListMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "BMASK",
+				Params: []string{
+					fmt.Sprintf("%d", channel.TS),
+					channel.Name,
+					"I",
+					// Masks go in the last parameter.
+					"",
+				},
+			}, channel.sortedInviteExceptions())
+			if err != nil {
+				s.quit(fmt.Sprintf("Unable to create BMASK message: %s", err))
+				return
 			}
 
-			// If we'll exceed the max protocol message length, fire the message and
-			// start a new list.
-			// +1 to account for a space.
-			if baseSize+len(uids)+1+len(uidStr) > irc.MaxLineLength {
-				sjoinMessage.Params[3] = uids
-				s.maybeQueueMessage(sjoinMessage)
-				uids = "" + uidStr
-				continue
+			for _, m := range bmaskMessages {
+				s.maybeQueueMessage(m)
 			}
-
-			// Add it to the list.
-			uids += " " + uidStr
 		}
 
-		if len(uids) > 0 {
-			sjoinMessage.Params[3] = uids
-			s.maybeQueueMessage(sjoinMessage)
+		// Tell them what services lock.
+		if s.Server.hasCapability("MLOCK") && channel.ModeLock != "" {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "MLOCK",
+				Params: []string{fmt.Sprintf("%d", channel.TS), channel.Name,
+					channel.ModeLock},
+			})
+		}
+		if channel.TopicLocked {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "ENCAP",
+				Params: []string{"*", "TOPICLOCK", fmt.Sprintf("%d", channel.TS),
+					channel.Name, "1"},
+			})
 		}
 
 		// If they support the TB capab then send them TB commands. This tells them
@@ -354,6 +437,59 @@ func (s *LocalServer) sendBurst() {
 	}
 }
 
+// sendUser tells the server about a user, as in a burst.
+func (s *LocalServer) sendUser(user *User) {
+	var onServer TS6SID
+	if user.isLocal() {
+		onServer = s.Catbox.Config.TS6SID
+	} else {
+		onServer = user.Server.SID
+	}
+	s.maybeQueueMessage(irc.Message{
+		Prefix:  string(onServer),
+		Command: "UID",
+		Params: []string{
+			user.DisplayNick,
+			// Hop count increases for them by one.
+			fmt.Sprintf("%d", user.HopCount+1),
+			fmt.Sprintf("%d", user.NickTS),
+			user.modesString(),
+			user.Username,
+			user.Hostname,
+			s.Catbox.publicIP(user),
+			string(user.UID),
+			user.RealName,
+		},
+	})
+
+	// Send LOGIN if they are logged in to an account.
+	if len(user.Account) > 0 {
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(user.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "LOGIN", user.Account},
+		})
+	}
+
+	// Send RELAY if they may relay messages.
+	if user.Relay {
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(user.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "RELAY"},
+		})
+	}
+
+	// Send AWAY if they are away.
+	if len(user.AwayMessage) > 0 {
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(user.UID),
+			Command: "AWAY",
+			Params:  []string{user.AwayMessage},
+		})
+	}
+}
+
 // Part a user from a channel.
 // This updates our records and informs our local users of the part.
 // It does not send any messages to remote servers.
@@ -375,7 +511,7 @@ func (s *LocalServer) partUser(user *User, channel *Channel,
 	}
 
 	msg := irc.Message{
-		Prefix:  user.nickUhost(),
+		Prefix:  channel.sourceFor(user),
 		Command: "PART",
 		Params:  params,
 	}
@@ -386,7 +522,9 @@ func (s *LocalServer) partUser(user *User, channel *Channel,
 // The server sent us a message. Deal with it.
 func (s *LocalServer) handleMessage(m irc.Message) {
 	// Record that client said something to us just now.
-	s.LastActivityTime = time.Now()
+	s.LastActivityTime = s.Catbox.now()
+
+	s.Catbox.debugf("s2s", "From %s: %s", s.Server.Name, m)
 
 	// Ensure we always have a prefix. It removes the need to check this
 	// elsewhere.
@@ -394,6 +532,13 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		m.Prefix = string(s.Server.SID)
 	}
 
+	if s.Observer && !s.observerAllows(m) {
+		return
+	}
+	if s.Untrusted && !s.trustAllows(m) {
+		return
+	}
+
 	if m.Command == "PING" {
 		s.pingCommand(m)
 		return
@@ -449,6 +594,11 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KICK" {
+		s.kickCommand(m)
+		return
+	}
+
 	// ircd-ratbox sends OPERWALL between servers, like WALLOPS
 	if m.Command == "WALLOPS" || m.Command == "OPERWALL" {
 		s.wallopsCommand(m)
@@ -490,6 +640,26 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "ADMIN" {
+		s.adminCommand(m)
+		return
+	}
+
+	if m.Command == "TIME" {
+		s.timeCommand(m)
+		return
+	}
+
+	if m.Command == "LUSERS" {
+		s.lusersCommand(m)
+		return
+	}
+
+	if m.Command == "TRACE" {
+		s.traceCommand(m)
+		return
+	}
+
 	if isNumericCommand(m.Command) {
 		s.numericCommand(m)
 		return
@@ -515,6 +685,16 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "BMASK" {
+		s.bmaskCommand(m)
+		return
+	}
+
+	if m.Command == "MLOCK" {
+		s.mlockCommand(m)
+		return
+	}
+
 	// 421 ERR_UNKNOWNCOMMAND
 	s.messageFromServer("421", []string{m.Command, "Unknown command"})
 }
@@ -537,11 +717,13 @@ func (s *LocalServer) pingCommand(m irc.Message) {
 
 	// I don't use origin name. Instead, look only at the prefix.
 
+	// It may be from a user who asked a server to answer them. We send them the
+	// PONG in the same way.
 	sourceSID := TS6SID(m.Prefix)
 
-	// Do we know the server making the ping request?
+	// Do we know the server or user making the ping request?
 	_, exists := s.Catbox.Servers[sourceSID]
-	if !exists {
+	if _, isUser := s.Catbox.Users[TS6UID(m.Prefix)]; !exists && !isUser {
 		// 402 ERR_NOSUCHSERVER
 		s.maybeQueueMessage(irc.Message{
 			Prefix:  string(s.Catbox.Config.TS6SID),
@@ -561,7 +743,7 @@ func (s *LocalServer) pingCommand(m irc.Message) {
 	// If it's not for us, propagate it to where it should go.
 
 	if destinationSID == s.Catbox.Config.TS6SID {
-		s.maybeQueueMessage(irc.Message{
+		s.maybeQueueControlMessage(irc.Message{
 			Prefix:  string(s.Catbox.Config.TS6SID),
 			Command: "PONG",
 			Params:  []string{s.Catbox.Config.ServerName, string(sourceSID)},
@@ -572,8 +754,7 @@ func (s *LocalServer) pingCommand(m irc.Message) {
 		if s.Bursting && sourceSID == s.Server.SID {
 			s.GotPING = true
 			if s.GotPONG {
-				s.Bursting = false
-				s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
+				s.endBurst()
 			}
 		}
 		return
@@ -626,11 +807,29 @@ func (s *LocalServer) pongCommand(m irc.Message) {
 
 	if destinationSID == s.Catbox.Config.TS6SID {
 		s.GotPONG = true
+		if TS6SID(m.Prefix) == s.Server.SID {
+			s.gotPong()
+		}
 
 		if s.Bursting && s.GotPING {
-			s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
-			s.Bursting = false
+			s.endBurst()
+		}
+		return
+	}
+
+	// It may be for a user who sent a PING to the server.
+	if user, exists := s.Catbox.Users[TS6UID(m.Params[1])]; exists {
+		if !user.isLocal() {
+			user.ClosestServer.maybeQueueMessage(m)
+			return
 		}
+
+		source := s.Catbox.Servers[TS6SID(m.Prefix)]
+		user.LocalUser.maybeQueuePriorityMessage(irc.Message{
+			Prefix:  source.Name,
+			Command: "PONG",
+			Params:  []string{source.Name, user.DisplayNick},
+		})
 		return
 	}
 
@@ -713,8 +912,11 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 		return
 	}
 
-	// We could validate hostname
 	hostname := m.Params[5]
+	if !s.strictCheck("UID", "hostname", hostname,
+		isValidStrictHost(hostname)) {
+		return
+	}
 
 	// Is there a nick collision? If there is, and we're colliding this user, then
 	// don't continue.
@@ -741,14 +943,17 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 			continue
 		}
 
-		if umode == 'i' || umode == 'o' || umode == 'C' {
+		if umode == 'g' || umode == 'i' || umode == 'o' || umode == 'p' ||
+			umode == 'B' || umode == 'C' {
 			umodes[byte(umode)] = struct{}{}
 			continue
 		}
 	}
 
-	// We could validate IP
 	ip := m.Params[6]
+	if !s.strictCheck("UID", "IP", ip, isValidStrictIP(ip)) {
+		return
+	}
 
 	// I get UID ahead of time, above.
 
@@ -775,11 +980,16 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 		Server:        usersServer,
 	}
 
+	s.Catbox.internUser(u)
+
 	if u.isOperator() {
 		s.Catbox.Opers[u.UID] = u
 	}
 	s.Catbox.Nicks[canonicalizeNick(displayNick)] = u.UID
 	s.Catbox.Users[u.UID] = u
+	usersServer.UserCount++
+	delete(s.Catbox.NickDelays, canonicalizeNick(displayNick))
+	s.Catbox.nickOnline(u)
 
 	// No reply needed I think.
 
@@ -841,10 +1051,12 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 	}
 
 	// If we don't know source yet, then it must be a user.
+	var sourceUser *User
 	if source == "" {
-		sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+		user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 		if exists {
-			source = sourceUser.nickUhost()
+			sourceUser = user
+			source = user.nickUhost()
 		}
 	}
 
@@ -861,14 +1073,36 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 			// We either deliver it to a local user, and done, or we need to propagate
 			// it to another server.
 			if targetUser.isLocal() {
+				// Caller ID (+g). Tell the source why only if it's a PRIVMSG. We
+				// never reply to NOTICEs.
+				if sourceUser != nil &&
+					!targetUser.LocalUser.acceptsMessageFrom(sourceUser) {
+					if m.Command == "PRIVMSG" {
+						for _, reply := range targetUser.LocalUser.callerIDRefused(
+							sourceUser) {
+							sourceUser.ClosestServer.maybeQueueMessage(irc.Message{
+								Prefix:  string(s.Catbox.Config.TS6SID),
+								Command: reply.Command,
+								Params: append([]string{string(sourceUser.UID)},
+									reply.Params...),
+							})
+						}
+					}
+					return
+				}
+
 				// Source and target were UIDs. Translate to uhost and nick
 				// respectively.
 				m.Params[0] = targetUser.DisplayNick
-				targetUser.LocalUser.maybeQueueMessage(irc.Message{
+				targetUser.LocalUser.maybeQueueMessageFrom(sourceUser, irc.Message{
 					Prefix:  source,
 					Command: m.Command,
 					Params:  m.Params,
 				})
+				if sourceUser != nil {
+					s.Catbox.logChat(m.Command, source, targetUser.DisplayNick,
+						m.Params[1])
+				}
 			} else {
 				// Propagate to the server we know the target user through.
 				targetUser.ClosestServer.maybeQueueMessage(m)
@@ -888,19 +1122,25 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 		return
 	}
 
+	// Apply the channel's restrictions to what we deliver to our users. We pass
+	// on the message as we got it. Other servers apply the restrictions to their
+	// own users.
+	text, refusedBy := channel.filterMessage(s.Catbox, m.Params[1])
+	deliverLocally := refusedBy == 0
+	localParams := []string{m.Params[0], text}
+
 	// Inform all members of the channel.
 	// Message local users directly.
 	// If a user is remote, then we record the server to send the message towards.
+	var recipients []*LocalClient
 	toServers := make(map[*LocalServer]struct{})
 	for memberUID := range channel.Members {
 		member := s.Catbox.Users[memberUID]
 
 		if member.isLocal() {
-			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  source,
-				Command: m.Command,
-				Params:  m.Params,
-			})
+			if deliverLocally {
+				recipients = append(recipients, member.LocalUser.LocalClient)
+			}
 			continue
 		}
 
@@ -910,6 +1150,21 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 		}
 	}
 
+	tagsFrom := sourceUser
+	if sourceUser != nil && channel.isAnonymous() {
+		source = anonymousPrefix
+		tagsFrom = nil
+	}
+
+	s.Catbox.fanOutFrom(tagsFrom, recipients, irc.Message{
+		Prefix:  source,
+		Command: m.Command,
+		Params:  localParams,
+	})
+	if sourceUser != nil && len(recipients) > 0 {
+		s.Catbox.logChat(m.Command, source, channel.Name, text)
+	}
+
 	// Propagate message to any servers that need it.
 	for server := range toServers {
 		server.maybeQueueMessage(m)
@@ -963,6 +1218,17 @@ func (s *LocalServer) sidCommand(m irc.Message) {
 		s.quit(fmt.Sprintf("%s sent me SID command with my own SID!", s.Server.Name))
 		return
 	}
+	if reason := s.checkTopology(linkedToServer, name, int(hopCount)); reason != "" {
+		s.quit(fmt.Sprintf("Refused SID %s (%s) from %s: %s", name, sid,
+			linkedToServer.Name, reason))
+		return
+	}
+	if reason, ok := s.Catbox.checkRelink(sid, name, s.Server.Name); !ok {
+		s.Catbox.noticeLocalOpersAbout("links", fmt.Sprintf("Refused %s from %s: %s", name,
+			s.Server.Name, reason))
+		s.quit(fmt.Sprintf("Refused %s: %s", name, reason))
+		return
+	}
 
 	newServer := &Server{
 		SID:           sid,
@@ -992,10 +1258,48 @@ func (s *LocalServer) sidCommand(m irc.Message) {
 	// We don't need to tell the new server about the servers we are connected to.
 	// They'll be informed by the server they linked to about us.
 
-	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s is introducing server %s",
+	s.burstNotice("servers introduced", fmt.Sprintf("%s is introducing server %s",
 		s.Server.Name, newServer.Name))
 }
 
+// checkTopology looks for problems with where the server says a server it is
+// introducing is. It says what's wrong, if anything.
+func (s *LocalServer) checkTopology(linkedTo *Server, name string,
+	hopCount int) string {
+	maxHopCount := s.Catbox.Config.MaxHopCount
+	if maxHopCount > 0 && hopCount > maxHopCount {
+		return fmt.Sprintf("hop count %d is over the limit of %d", hopCount,
+			maxHopCount)
+	}
+
+	// A server on its side must be linked to one on its side.
+	if linkedTo.LocalServer != s && linkedTo.ClosestServer != s {
+		return fmt.Sprintf("%s is not on its side of the network", linkedTo.Name)
+	}
+
+	// It's one hop past the one it's linked to.
+	if hopCount != linkedTo.HopCount+1 {
+		return fmt.Sprintf("hop count %d does not follow %s's %d", hopCount,
+			linkedTo.Name, linkedTo.HopCount)
+	}
+
+	// Servers have unique names. If we know one with this name already, there
+	// is a loop, or it is linked to itself.
+	if strings.EqualFold(name, s.Catbox.Config.ServerName) {
+		return "it has my name"
+	}
+	if server := s.Catbox.getServerByName(name); server != nil {
+		path := "us"
+		if server.ClosestServer != nil {
+			path = server.ClosestServer.Server.Name
+		}
+		return fmt.Sprintf("there is already a server with that name (%s) behind %s",
+			server.SID, path)
+	}
+
+	return ""
+}
+
 // SJOIN occurs in two contexts:
 // 1. During bursts to inform us of channels and users in the channels.
 // 2. Outside bursts to inform us of channel creation. For regular joins after
@@ -1031,17 +1335,27 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		return
 	}
 
-	// Currently I ignore modes. All channels have the same mode, or we pretend so
-	// anyway.
+	// The member list comes after any mode parameters.
+	userList, err := sjoinUserList(m.Params)
+	if err != nil {
+		log.Printf("Invalid SJOIN for %s from %s: %s", chanName, sourceServer.Name,
+			err)
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SJOIN", "Not enough parameters"})
+		return
+	}
 
 	channel, channelExists := s.Catbox.Channels[canonicalizeChannel(chanName)]
 	if !channelExists {
 		channel = &Channel{
-			Name:    canonicalizeChannel(chanName),
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      channelTS,
+			Name:             canonicalizeChannel(chanName),
+			Members:          make(map[TS6UID]struct{}),
+			Ops:              make(map[TS6UID]*User),
+			Halfops:          make(map[TS6UID]*User),
+			Voiced:           make(map[TS6UID]*User),
+			Modes:            make(map[byte]struct{}),
+			InviteExceptions: make(map[string]*ListEntry),
+			TS:               channelTS,
 		}
 		s.Catbox.Channels[channel.Name] = channel
 		// No modes set yet.
@@ -1080,19 +1394,30 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 
 	modes := m.Params[2]
 
-	// Apply the simple (+ntski type) modes now.
+	// Apply the simple (+ntsi type) modes now, and the key and limit.
 	if acceptModes {
 		modeStr := ""
+		var modeParams []string
+		paramIndex := 3
 		for _, mode := range modes {
-			if mode != 'n' && mode != 's' {
+			if _, exists := sjoinParamChannelModes[byte(mode)]; exists {
+				param := m.Params[paramIndex]
+				paramIndex++
+				if channel.setModeParam('+', byte(mode), param) {
+					modeStr += string(mode)
+					modeParams = append(modeParams, param)
+				}
+				continue
+			}
+
+			if !isSimpleChannelMode(byte(mode)) {
 				continue
 			}
 
-			if _, ok := channel.Modes[byte(mode)]; ok {
+			if !channel.setMode(byte(mode)) {
 				continue
 			}
 
-			channel.Modes[byte(mode)] = struct{}{}
 			modeStr += string(mode)
 		}
 
@@ -1100,36 +1425,29 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 			s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
 				Prefix:  sourceServer.Name,
 				Command: "MODE",
-				Params:  []string{channel.Name, "+" + modeStr},
+				Params: append([]string{channel.Name, "+" + modeStr},
+					modeParams...),
 			})
 		}
 	}
 
-	// The user list is always the last parameter. It's possible we had one more
-	// more mode parameters.
-	userList := m.Params[len(m.Params)-1]
-
 	// Look at each of the members we were told about.
 	uidsRaw := strings.Split(userList, " ")
 	for _, uidRaw := range uidsRaw {
-		// May have op/voice prefix.
+		// May have op/halfop/voice prefixes.
 		opped := false
-		//voiced := false
+		halfopped := false
+		voiced := false
 
 		if acceptModes {
-			if uidRaw[0] == '@' {
-				opped = true
-				//if uidRaw[1] == '+' {
-				//	voiced = true
-				//}
-			}
-			//if uidRaw[0] == '+' {
-			//	voiced = true
-			//}
+			prefixes := uidRaw[:len(uidRaw)-len(strings.TrimLeft(uidRaw, "@%+"))]
+			opped = strings.Contains(prefixes, "@")
+			halfopped = strings.Contains(prefixes, "%")
+			voiced = strings.Contains(prefixes, "+")
 		}
 
 		// Done with prefix.
-		uidRaw = strings.TrimLeft(uidRaw, "@+")
+		uidRaw = strings.TrimLeft(uidRaw, "@%+")
 
 		user, exists := s.Catbox.Users[TS6UID(uidRaw)]
 		if !exists {
@@ -1151,6 +1469,12 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		if opped {
 			channel.grantOps(user)
 		}
+		if halfopped {
+			channel.grantHalfops(user)
+		}
+		if voiced {
+			channel.grantVoice(user)
+		}
 
 		// Tell our local users who are in the channel.
 		for memberUID := range channel.Members {
@@ -1160,7 +1484,7 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 			}
 
 			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  user.nickUhost(),
+				Prefix:  channel.sourceFor(user),
 				Command: "JOIN",
 				Params:  []string{channel.Name},
 			})
@@ -1172,6 +1496,20 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 					Params:  []string{channel.Name, "+o", user.DisplayNick},
 				})
 			}
+			if halfopped {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  sourceServer.Name,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+h", user.DisplayNick},
+				})
+			}
+			if voiced {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  sourceServer.Name,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+v", user.DisplayNick},
+				})
+			}
 		}
 	}
 
@@ -1182,7 +1520,7 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 			continue
 		}
 
-		server.maybeQueueMessage(m)
+		server.maybeQueueMessage(sjoinForServer(m, server.Server))
 	}
 }
 
@@ -1220,11 +1558,15 @@ func (s *LocalServer) tbCommand(m irc.Message) {
 		return
 	}
 
-	// We could validate the format is nick!user@host.
 	// Use server name for setter if setter not present.
 	setter := ""
 	if len(m.Params) >= 4 {
 		setter = m.Params[2]
+		if !s.strictCheck("TB", "setter", setter,
+			isValidUhost(s.Catbox.Config.MaxNickLength, setter) ||
+				isValidHostname(setter)) {
+			return
+		}
 	} else {
 		setter = server.Name
 	}
@@ -1357,11 +1699,14 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 	channel, channelExists := s.Catbox.Channels[chanName]
 	if !channelExists {
 		channel = &Channel{
-			Name:    chanName,
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      channelTS,
+			Name:             chanName,
+			Members:          make(map[TS6UID]struct{}),
+			Ops:              make(map[TS6UID]*User),
+			Halfops:          make(map[TS6UID]*User),
+			Voiced:           make(map[TS6UID]*User),
+			Modes:            make(map[byte]struct{}),
+			InviteExceptions: make(map[string]*ListEntry),
+			TS:               channelTS,
 		}
 		s.Catbox.Channels[channel.Name] = channel
 		// No modes set yet.
@@ -1382,7 +1727,7 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 
 	// Tell our local users who are in the channel about the new member.
 	msg := irc.Message{
-		Prefix:  user.nickUhost(),
+		Prefix:  channel.sourceFor(user),
 		Command: "JOIN",
 		Params:  []string{channel.Name},
 	}
@@ -1445,8 +1790,12 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 	// Tell each user only once.
 	// Do this prior to updating the user record as it needs to come from the
 	// old nick!user@host.
+	// Members of anonymous channels don't hear. It would say who they are.
 	toldUsers := make(map[TS6UID]struct{})
 	for _, channel := range user.Channels {
+		if channel.isAnonymous() {
+			continue
+		}
 		for memberUID := range channel.Members {
 			member := s.Catbox.Users[memberUID]
 			if !member.isLocal() {
@@ -1469,12 +1818,19 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 
 	// Update our records, their nick, and their nick TS.
 
-	delete(s.Catbox.Nicks, canonicalizeNick(user.DisplayNick))
+	oldNickCanon := canonicalizeNick(user.DisplayNick)
+	delete(s.Catbox.Nicks, oldNickCanon)
 	s.Catbox.Nicks[canonicalizeNick(nick)] = user.UID
 
 	user.DisplayNick = nick
 	user.NickTS = nickTS
 
+	if canonicalizeNick(nick) != oldNickCanon {
+		delete(s.Catbox.NickDelays, canonicalizeNick(nick))
+		s.Catbox.nickOffline(oldNickCanon)
+		s.Catbox.nickOnline(user)
+	}
+
 	// Propagate to other servers.
 	for _, server := range s.Catbox.LocalServers {
 		if server == s {
@@ -1529,6 +1885,49 @@ func (s *LocalServer) partCommand(m irc.Message) {
 	}
 }
 
+func (s *LocalServer) kickCommand(m irc.Message) {
+	// Params: <channel> <UID> <reason>
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	// The source is a user or a server, such as services.
+	sourceUser, userExists := s.Catbox.Users[TS6UID(m.Prefix)]
+	sourceServer, serverExists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !userExists && !serverExists {
+		s.quit("Unknown source (KICK)")
+		return
+	}
+
+	// The user may have left, and the channel gone, since they sent it.
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists {
+		log.Printf("KICK for unknown channel %s, ignoring", m.Params[0])
+		return
+	}
+
+	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[1])]
+	if exists && targetUser.onChannel(channel) {
+		origin := ""
+		if userExists {
+			origin = channel.sourceFor(sourceUser)
+		} else {
+			origin = sourceServer.Name
+		}
+		s.Catbox.kickUser(channel, origin, targetUser, m.Params[2])
+	}
+
+	// Propagate to all other servers.
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
+
 func (s *LocalServer) wallopsCommand(m irc.Message) {
 	// Params: <text to send>
 	if len(m.Params) < 1 {
@@ -1648,13 +2047,15 @@ func (s *LocalServer) modeCommand(m irc.Message) {
 			continue
 		}
 
-		if c == 'i' || c == 'o' || c == 'C' {
+		if c == 'g' || c == 'i' || c == 'o' || c == 'p' || c == 'B' ||
+			c == 'C' {
 			if motion == '+' {
 				user.Modes[byte(c)] = struct{}{}
 				if c == 'o' {
 					s.Catbox.Opers[user.UID] = user
-					s.Catbox.noticeLocalOpers(fmt.Sprintf("%s@%s became an operator.",
-						user.DisplayNick, user.Server.Name))
+					s.burstNotice("users became operators",
+						fmt.Sprintf("%s@%s became an operator.", user.DisplayNick,
+							user.Server.Name))
 				}
 			} else {
 				_, exists := user.Modes[byte(c)]
@@ -1716,15 +2117,35 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 
 	// We could check the source is on the channel.
 
-	// Make the change.
-
-	channel.Topic = topic
-	channel.TopicTS = time.Now().Unix()
-	channel.TopicSetter = sourceUser.nickUhost()
-
-	// Tell local clients who are in the channel about the topic change.
-
-	params := []string{channel.Name}
+	// If services lock the topic, only they may change it. Put it back for the
+	// servers that saw the change.
+	if channel.TopicLocked && !s.Catbox.isServices(sourceUser.Server) {
+		log.Printf("Reverting change to locked topic on %s by %s", channel.Name,
+			sourceUser.DisplayNick)
+		if s.Server.hasCapability("TB") {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "TB",
+				Params: []string{
+					channel.Name,
+					fmt.Sprintf("%d", channel.TopicTS),
+					channel.TopicSetter,
+					channel.Topic,
+				},
+			})
+		}
+		return
+	}
+
+	// Make the change.
+
+	channel.Topic = topic
+	channel.TopicTS = s.Catbox.now().Unix()
+	channel.TopicSetter = channel.sourceFor(sourceUser)
+
+	// Tell local clients who are in the channel about the topic change.
+
+	params := []string{channel.Name}
 
 	// TODO: I think we should include a blank parameter if it is blank.
 	if len(topic) > 0 {
@@ -1737,7 +2158,7 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 			continue
 		}
 		member.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  sourceUser.nickUhost(),
+			Prefix:  channel.sourceFor(sourceUser),
 			Command: "TOPIC",
 			Params:  params,
 		})
@@ -1826,8 +2247,10 @@ func (s *LocalServer) squitCommand(m irc.Message) {
 		server.maybeQueueMessage(m)
 	}
 
-	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s delinked from %s: %s",
+	s.Catbox.noticeLocalOpersAbout("links", fmt.Sprintf("%s delinked from %s: %s",
 		targetServer.Name, targetServer.LinkedTo.Name, m.Params[1]))
+	s.Catbox.emitEvent("split", "server", targetServer.Name, "from",
+		targetServer.LinkedTo.Name, "reason", m.Params[1])
 }
 
 // KILL tells us about a client getting disconnected forcefully.
@@ -1888,6 +2311,10 @@ func (s *LocalServer) killCommand(m irc.Message) {
 		return
 	}
 	sourceInfo := sourceAndReason[:space]
+	if !s.strictCheck("KILL", "path", sourceInfo,
+		isValidKillPath(s.Catbox.Config.MaxNickLength, sourceInfo)) {
+		return
+	}
 
 	sourceAndReason = sourceAndReason[space:]
 
@@ -1950,7 +2377,8 @@ func (s *LocalServer) killCommand(m irc.Message) {
 // Destination can be a mask. For servers it may be a wildcard. For clients
 // apparently not.
 //
-// Currently I will assume destination mask is always *.
+// We propagate it everywhere, but only act on it if the destination mask
+// matches our name.
 //
 // If the encapsulated command is one I know about, operate on it locally.
 func (s *LocalServer) encapCommand(m irc.Message) {
@@ -1960,7 +2388,18 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 		return
 	}
 
-	// I don't look at destination right now. Assume it's for this server too.
+	// Propagate everywhere, even if it isn't for us. Servers past them may be
+	// in the destination.
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+
+	if !s.Catbox.isServerTarget(m.Params[0]) {
+		return
+	}
 
 	// Extract the sub command and its parameters.
 	subCommand := strings.ToUpper(m.Params[1])
@@ -1991,13 +2430,40 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 			Params:  subParams,
 		})
 	}
-
-	// Propagate everywhere.
-	for _, server := range s.Catbox.LocalServers {
-		if server == s {
-			continue
-		}
-		server.maybeQueueMessage(m)
+	if subCommand == "LOGIN" {
+		s.loginCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "SU" {
+		s.suCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "RELAY" {
+		s.relayCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "RELAYMSG" {
+		s.relaymsgCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "TOPICLOCK" {
+		s.topiclockCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
 }
 
@@ -2037,7 +2503,12 @@ func (s *LocalServer) klineCommand(m irc.Message) {
 		return
 	}
 
-	// I ignore duration at this time. It's permanent.
+	// Duration is in seconds. 0 means permanent.
+	duration, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil || duration < 0 {
+		log.Printf("Invalid KLINE duration from %s: %s", source, m.Params[0])
+		return
+	}
 
 	reason := "<No reason given>"
 	if len(m.Params) > 3 {
@@ -2049,6 +2520,9 @@ func (s *LocalServer) klineCommand(m irc.Message) {
 		HostMask: m.Params[2],
 		Reason:   reason,
 	}
+	if duration > 0 {
+		kline.Expires = s.Catbox.now().Add(time.Duration(duration) * time.Second)
+	}
 
 	s.Catbox.addAndApplyKLine(kline, source, reason)
 
@@ -2135,6 +2609,151 @@ func (s *LocalServer) gcapCommand(m irc.Message) {
 	// We don't need to propagate. GCAP comes inside ENCAP. Already propagated.
 }
 
+// LOGIN tells us the account a user is logged in to. Servers send it for their
+// users during burst.
+//
+// :8ZZAAAAAB ENCAP * LOGIN :will
+func (s *LocalServer) loginCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"LOGIN", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		log.Printf("LOGIN for unknown user %s", m.Prefix)
+		return
+	}
+
+	user.Account = m.Params[0]
+
+	// We don't need to propagate. LOGIN comes inside ENCAP. Already propagated.
+}
+
+// SU changes the account a user is logged in to. Services send it. With no
+// account, the user is logged out. If we know the services server, we only
+// accept SU from it.
+//
+// :8ZZ ENCAP * SU 8ZZAAAAAB :will
+// :8ZZ ENCAP * SU 8ZZAAAAAB
+func (s *LocalServer) suCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SU", "Not enough parameters"})
+		return
+	}
+
+	if s.Catbox.Config.ServicesServer != "" &&
+		!s.Catbox.isServices(s.Catbox.sourceServer(m.Prefix)) {
+		log.Printf("SU from %s, which is not services", m.Prefix)
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		log.Printf("SU for unknown user %s", m.Params[0])
+		return
+	}
+
+	user.Account = ""
+	if len(m.Params) > 1 {
+		user.Account = m.Params[1]
+	}
+
+	// We don't need to propagate. SU comes inside ENCAP. Already propagated.
+}
+
+// RELAY tells us a user on another server may relay messages with RELAYMSG.
+// Their server sends it when they register and in bursts. Only the way to the
+// user's server may say so.
+//
+// :8ZZAAAAAB ENCAP * RELAY
+func (s *LocalServer) relayCommand(m irc.Message) {
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		log.Printf("RELAY for unknown user %s", m.Prefix)
+		return
+	}
+
+	if user.ClosestServer != s {
+		log.Printf("RELAY for %s from %s, which they are not behind",
+			user.DisplayNick, s.Server.Name)
+		return
+	}
+
+	user.Relay = true
+
+	// We don't need to propagate. RELAY comes inside ENCAP. Already propagated.
+}
+
+// RELAYMSG is a relay on another server sending a message to a channel as a
+// user of another network. Tell our users on the channel. We check it as we
+// would the user RELAYMSG command.
+//
+// :8ZZAAAAAB ENCAP * RELAYMSG #channel alice/matrix :hi there
+func (s *LocalServer) relaymsgCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"RELAYMSG", "Not enough parameters"})
+		return
+	}
+
+	relay, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		log.Printf("RELAYMSG from unknown user %s", m.Prefix)
+		return
+	}
+
+	if !relay.Relay {
+		log.Printf("RELAYMSG from %s, who may not relay", relay.DisplayNick)
+		return
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists || !relay.onChannel(channel) {
+		log.Printf("RELAYMSG from %s to %s, which they are not on",
+			relay.DisplayNick, m.Params[0])
+		return
+	}
+
+	if !isValidRelayNick(s.Catbox.Config.MaxNickLength, m.Params[1]) {
+		log.Printf("RELAYMSG from %s with invalid nick %s", relay.DisplayNick,
+			m.Params[1])
+		return
+	}
+
+	// The relay's server checked this too, but it may not know our modes yet.
+	msg, refusedBy := channel.filterMessage(s.Catbox, m.Params[2])
+	if refusedBy != 0 {
+		log.Printf("RELAYMSG from %s to %s refused by +%c", relay.DisplayNick,
+			channel.Name, refusedBy)
+		return
+	}
+
+	var recipients []*LocalClient
+	for memberUID := range channel.Members {
+		member := s.Catbox.Users[memberUID]
+		if member.isLocal() {
+			recipients = append(recipients, member.LocalUser.LocalClient)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	source := channel.relaySourceFor(relay, m.Params[1])
+	s.Catbox.fanOut(recipients, irc.Message{
+		Prefix:  source,
+		Command: "PRIVMSG",
+		Params:  []string{channel.Name, msg},
+	})
+	s.Catbox.logChat("PRIVMSG", source, channel.Name, msg)
+
+	// We don't need to propagate. RELAYMSG comes inside ENCAP. Already
+	// propagated.
+}
+
 // Params: <uid> <nick>
 // e.g. :1SNAAAAAB WHOIS 000AAAAAA :horgh
 func (s *LocalServer) whoisCommand(m irc.Message) {
@@ -2175,6 +2794,91 @@ func (s *LocalServer) whoisCommand(m irc.Message) {
 	user.ClosestServer.maybeQueueMessage(m)
 }
 
+// A remote user sent a command such as ADMIN for a server to answer. The
+// server's SID is the parameter at index param. If it's for us, return the
+// user so we can reply. Otherwise pass it on toward the server and return nil.
+//
+// e.g. :1SNAAAAAB ADMIN 000
+// e.g. :1SNAAAAAB LUSERS * 000
+func (s *LocalServer) huntServer(m irc.Message, param int) *User {
+	if len(m.Params) <= param {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return nil
+	}
+
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		log.Printf("%s from unknown user %s", m.Command, m.Prefix)
+		return nil
+	}
+
+	sid := TS6SID(m.Params[param])
+	if sid == s.Catbox.Config.TS6SID {
+		return sourceUser
+	}
+
+	server, exists := s.Catbox.Servers[sid]
+	if !exists {
+		// 402 ERR_NOSUCHSERVER
+		sourceUser.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "402",
+			Params:  []string{string(sourceUser.UID), m.Params[param], "No such server"},
+		})
+		return nil
+	}
+
+	if server.isLocal() {
+		server.LocalServer.maybeQueueMessage(m)
+		return nil
+	}
+	server.ClosestServer.maybeQueueMessage(m)
+	return nil
+}
+
+// A remote user wants to know who runs a server.
+//
+// Params: <SID>
+func (s *LocalServer) adminCommand(m irc.Message) {
+	sourceUser := s.huntServer(m, 0)
+	if sourceUser == nil {
+		return
+	}
+
+	for _, msg := range s.Catbox.createADMINResponse(sourceUser, true) {
+		sourceUser.ClosestServer.maybeQueueMessage(msg)
+	}
+}
+
+// A remote user wants to know a server's time.
+//
+// Params: <SID>
+func (s *LocalServer) timeCommand(m irc.Message) {
+	sourceUser := s.huntServer(m, 0)
+	if sourceUser == nil {
+		return
+	}
+
+	sourceUser.ClosestServer.maybeQueueMessage(
+		s.Catbox.createTIMEResponse(sourceUser, true))
+}
+
+// A remote user wants to know how many users and servers there are, as a
+// server sees it.
+//
+// Params: <mask> <SID>
+func (s *LocalServer) lusersCommand(m irc.Message) {
+	sourceUser := s.huntServer(m, 1)
+	if sourceUser == nil {
+		return
+	}
+
+	for _, msg := range s.Catbox.createLUSERSResponse(sourceUser, true) {
+		sourceUser.ClosestServer.maybeQueueMessage(msg)
+	}
+}
+
 // We've got a numeric command.
 // For example, a reply to a remote WHOIS.
 //
@@ -2259,6 +2963,12 @@ func (s *LocalServer) awayCommand(m irc.Message) {
 		user.AwayMessage = ""
 	}
 
+	// Another server, such as services, may set one of our users away or back.
+	// Tell them as if they'd done it themself.
+	if user.isLocal() {
+		user.LocalUser.sendAwayStatus()
+	}
+
 	// Propagate.
 	for _, server := range s.Catbox.LocalServers {
 		if server == s {
@@ -2322,11 +3032,12 @@ func (s *LocalServer) inviteCommand(m irc.Message) {
 		}
 	}
 
-	// TODO(horgh): If we had +i we'd have to record the invited user may join
-	// the channel.
+	s.Catbox.inviteNotify(channel, sourceUser, targetUser)
 
-	// If it's a local user, tell the user, and that's it.
+	// If it's a local user, record the invite so they may join if the channel
+	// is +i, tell the user, and that's it.
 	if targetUser.isLocal() {
+		targetUser.LocalUser.addInvite(channel.Name, sourceUser.nickUhost())
 		targetUser.LocalUser.maybeQueueMessage(irc.Message{
 			Prefix:  sourceUser.nickUhost(),
 			Command: "INVITE",
@@ -2395,9 +3106,12 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 	paramIndex := 3
 
 	// Track modes we apply so we can tell our local users.
-	appliedModes := ""
-	appliedModesAction := ' '
-	appliedModesParams := []string{}
+	var applied []modeChange
+
+	// Users other than services may not change modes services lock. We revert
+	// any such changes.
+	var reverted []modeChange
+	mayChangeLocked := sourceUser == nil || s.Catbox.isServices(sourceUser.Server)
 
 	action := '+'
 
@@ -2407,11 +3121,91 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 			continue
 		}
 
-		if char != 'o' {
+		// Simple modes such as +n/-n
+		if isSimpleChannelMode(byte(char)) {
+			if !mayChangeLocked && channel.isModeLocked(byte(char)) &&
+				channel.hasMode(byte(char)) != (action == '+') {
+				revertAction := '+'
+				if action == '+' {
+					revertAction = '-'
+				}
+				reverted = append(reverted, modeChange{action: revertAction,
+					mode: char})
+				continue
+			}
+
+			if !channel.applySimpleMode(action, byte(char)) {
+				continue
+			}
+
+			applied = append(applied, modeChange{action: action, mode: char})
+			continue
+		}
+
+		// +I/-I
+		if char == 'I' {
+			// Must have a parameter.
+			if paramIndex >= len(m.Params) {
+				break
+			}
+
+			// Consume the parameter.
+			mask := canonicalizeChannelMask(m.Params[paramIndex])
+			paramIndex++
+			if mask == "" {
+				continue
+			}
+
+			if action == '+' {
+				if !channel.addInviteException(mask, origin, s.Catbox.now().Unix()) {
+					continue
+				}
+			} else {
+				if !channel.removeInviteException(mask) {
+					continue
+				}
+			}
+
+			applied = append(applied, modeChange{
+				action:      action,
+				mode:        char,
+				userParam:   mask,
+				serverParam: mask,
+			})
+			continue
+		}
+
+		// Modes with a parameter other than those above. We keep the key and
+		// limit and skip the rest. The key has its parameter when set and unset,
+		// the others only when set.
+		if _, exists := sjoinParamChannelModes[byte(char)]; exists {
+			param := ""
+			if char == 'k' || action == '+' {
+				if paramIndex >= len(m.Params) {
+					break
+				}
+				param = m.Params[paramIndex]
+				paramIndex++
+			}
+
+			if !channel.setModeParam(action, byte(char), param) {
+				continue
+			}
+
+			applied = append(applied, modeChange{
+				action:      action,
+				mode:        char,
+				userParam:   param,
+				serverParam: param,
+			})
+			continue
+		}
+
+		if char != 'o' && char != 'h' && char != 'v' {
 			continue
 		}
 
-		// +o/-o
+		// +o/-o, +h/-h and +v/-v
 
 		// Must have a parameter.
 
@@ -2433,25 +3227,16 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 			break
 		}
 
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.removeOps(targetUser)
-		}
-
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
+		if !channel.applyStatusMode(action, char, targetUser) {
+			continue
 		}
 
-		appliedModes += string(char)
-		appliedModesParams = append(appliedModesParams, targetUser.DisplayNick)
+		applied = append(applied, modeChange{
+			action:      action,
+			mode:        char,
+			userParam:   targetUser.DisplayNick,
+			serverParam: string(targetUser.UID),
+		})
 	}
 
 	// It's possible we have more than ChanModesPerCommand to send to the client
@@ -2462,11 +3247,17 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 
 	// But only if there is something to tell.
 
-	if len(appliedModes) > 0 {
+	if len(applied) > 0 {
+		appliedModes, appliedModesParams := formatModeChanges(applied, false)
 		userModeParams := []string{channel.Name, appliedModes}
 		userModeParams = append(userModeParams, appliedModesParams...)
 		log.Printf("%v %v", appliedModes, appliedModesParams)
 
+		userOrigin := origin
+		if sourceUser != nil {
+			userOrigin = channel.sourceFor(sourceUser)
+		}
+
 		for memberUID := range channel.Members {
 			member := s.Catbox.Users[memberUID]
 
@@ -2475,18 +3266,237 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 			}
 
 			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  origin,
+				Prefix:  userOrigin,
 				Command: "MODE",
 				Params:  userModeParams,
 			})
 		}
 	}
 
-	// Propagate
+	// Propagate. Servers without the IE capab must not see +I, and servers
+	// without the HOPS capab must not see +h, so if there are any we strip them
+	// out for those servers.
+	hasInviteExceptions := strings.ContainsRune(m.Params[2], 'I')
+	hasHalfops := strings.ContainsRune(m.Params[2], 'h')
+
 	for _, ls := range s.Catbox.LocalServers {
 		if ls == s {
 			continue
 		}
+
+		if len(reverted) == 0 &&
+			(!hasInviteExceptions || ls.Server.hasCapability("IE")) &&
+			(!hasHalfops || ls.Server.hasCapability("HOPS")) {
+			ls.maybeQueueMessage(m)
+			continue
+		}
+
+		// We can only tell them the changes we understood and applied.
+		serverChanges := modeChangesForServer(applied, ls.Server)
+		if len(serverChanges) == 0 {
+			continue
+		}
+
+		serverModes, serverParams := formatModeChanges(serverChanges, true)
+		params := []string{m.Params[0], m.Params[1], serverModes}
+		params = append(params, serverParams...)
+
+		ls.maybeQueueMessage(irc.Message{
+			Prefix:  m.Prefix,
+			Command: "TMODE",
+			Params:  params,
+		})
+	}
+
+	// Undo locked changes for the servers that saw them.
+	if len(reverted) > 0 {
+		log.Printf("Reverting changes to locked modes on %s by %s", channel.Name,
+			origin)
+		revertModes, _ := formatModeChanges(reverted, true)
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "TMODE",
+			Params: []string{fmt.Sprintf("%d", channel.TS), channel.Name,
+				revertModes},
+		})
+	}
+}
+
+// BMASK tells us about the masks in one of a channel's lists. Servers send it
+// during burst.
+// Source: server
+// Parameters: <channel TS> <channel> <type> :<masks>
+// e.g., :8ZZ BMASK 1475187553 #test I :*!*@example.com
+//
+// We only keep invite exceptions (I). We pass on the others to servers that
+// understand them.
+func (s *LocalServer) bmaskCommand(m irc.Message) {
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"BMASK", "Not enough parameters"})
+		return
+	}
+
+	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s.quit("Unknown server (BMASK)")
+		return
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil {
+		s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[0], err))
+		return
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists {
+		// The channel may have been destroyed. Nothing to do.
+		return
+	}
+
+	// The list is from a channel newer than ours. Ignore it.
+	if channelTS > channel.TS {
+		return
+	}
+
+	listType := m.Params[2]
+
+	if listType == "I" {
+		var added []string
+		for _, rawMask := range strings.Fields(m.Params[3]) {
+			mask := canonicalizeChannelMask(rawMask)
+			if mask == "" {
+				continue
+			}
+			if !channel.addInviteException(mask, sourceServer.Name,
+				s.Catbox.now().Unix()) {
+				continue
+			}
+			added = append(added, mask)
+		}
+
+		// Tell our local users in the channel.
+		for len(added) > 0 {
+			n := len(added)
+			if n > ChanModesPerCommand {
+				n = ChanModesPerCommand
+			}
+
+			params := []string{channel.Name, "+" + strings.Repeat("I", n)}
+			params = append(params, added[:n]...)
+
+			s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+				Prefix:  sourceServer.Name,
+				Command: "MODE",
+				Params:  params,
+			})
+
+			added = added[n:]
+		}
+	}
+
+	// Propagate to servers that know the list type.
+	capab := ""
+	if listType == "e" {
+		capab = "EX"
+	}
+	if listType == "I" {
+		capab = "IE"
+	}
+
+	for _, ls := range s.Catbox.LocalServers {
+		if ls == s {
+			continue
+		}
+		if capab != "" && !ls.Server.hasCapability(capab) {
+			continue
+		}
 		ls.maybeQueueMessage(m)
 	}
 }
+
+// MLOCK tells us the modes services lock on a channel. No one but services
+// may change them. If we know the services server, we only accept MLOCK from
+// it.
+//
+// Parameters: <channel TS> <channel> :<modes>
+// e.g., :8ZZ MLOCK 1475187553 #test :nt
+//
+// Blank modes unlock all of them.
+func (s *LocalServer) mlockCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"MLOCK", "Not enough parameters"})
+		return
+	}
+
+	channel, ok := s.lockedChannel(m)
+	if !ok {
+		return
+	}
+
+	channel.setModeLock(m.Params[2])
+
+	// Propagate to servers that understand it.
+	for _, ls := range s.Catbox.LocalServers {
+		if ls == s || !ls.Server.hasCapability("MLOCK") {
+			continue
+		}
+		ls.maybeQueueMessage(m)
+	}
+}
+
+// TOPICLOCK tells us whether services lock a channel's topic. No one but
+// services may change it. It comes only in ENCAP messages. If we know the
+// services server, we only accept TOPICLOCK from it.
+//
+// Parameters: <channel TS> <channel> <1 or 0>
+// e.g., :8ZZ ENCAP * TOPICLOCK 1475187553 #test 1
+func (s *LocalServer) topiclockCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"TOPICLOCK", "Not enough parameters"})
+		return
+	}
+
+	channel, ok := s.lockedChannel(m)
+	if !ok {
+		return
+	}
+
+	channel.TopicLocked = m.Params[2] == "1"
+
+	// We don't need to propagate. TOPICLOCK comes inside ENCAP. Already
+	// propagated.
+}
+
+// lockedChannel finds the channel an MLOCK or TOPICLOCK is for. It checks it
+// came from services and that its channel TS is not newer than ours.
+func (s *LocalServer) lockedChannel(m irc.Message) (*Channel, bool) {
+	if s.Catbox.Config.ServicesServer != "" &&
+		!s.Catbox.isServices(s.Catbox.sourceServer(m.Prefix)) {
+		log.Printf("%s from %s, which is not services", m.Command, m.Prefix)
+		return nil, false
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil {
+		log.Printf("Invalid channel TS in %s: %s", m.Command, m.Params[0])
+		return nil, false
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists {
+		log.Printf("%s for unknown channel %s", m.Command, m.Params[1])
+		return nil, false
+	}
+
+	if channelTS > channel.TS {
+		log.Printf("%s for channel %s has newer TS, ignoring", m.Command,
+			channel.Name)
+		return nil, false
+	}
+
+	return channel, true
+}
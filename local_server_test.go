@@ -0,0 +1,413 @@
+package terrarium
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Three servers in a chain. Split the middle from one end and check everyone
+// agrees on who is left. Then link them again.
+func TestMemNetworkSplit(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	c := n.servers["c.example.com"]
+
+	userA := a.connectUser("usera", "usera")
+	userB := b.connectUser("userb", "userb")
+	userC := c.connectUser("userc", "userc")
+
+	n.link("a.example.com", "b.example.com")
+	n.link("b.example.com", "c.example.com")
+	n.waitForConverged(3)
+
+	for _, u := range []*memClient{userA, userB, userC} {
+		u.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	}
+	n.waitFor("everyone to see everyone in #test", func() bool {
+		return len(a.channelMembers("#test")) == 3 &&
+			len(b.channelMembers("#test")) == 3 &&
+			len(c.channelMembers("#test")) == 3
+	})
+
+	n.split("b.example.com", "c.example.com")
+
+	n.waitFor("split to be noticed", func() bool {
+		return a.userServer("userc") == "" &&
+			b.userServer("userc") == "" &&
+			c.userServer("usera") == "" &&
+			c.userServer("userb") == ""
+	})
+
+	if got := strings.Join(sortStrings(a.channelMembers("#test")), " "); got !=
+		"usera userb" {
+		t.Errorf("a sees #test as %s, wanted usera userb", got)
+	}
+	if got := strings.Join(c.channelMembers("#test"), " "); got != "userc" {
+		t.Errorf("c sees #test as %s, wanted userc", got)
+	}
+
+	n.link("c.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	for _, s := range []*memServer{a, b, c} {
+		if got := len(s.channelMembers("#test")); got != 3 {
+			t.Errorf("%s sees %d members in #test after relinking, wanted 3",
+				s.cb.Config.ServerName, got)
+		}
+	}
+}
+
+// Users with the same nick on both sides of a link. The TS6 rules decide who
+// survives. We control the clock so we can set up each case exactly.
+func TestMemNetworkNickCollision(t *testing.T) {
+	t.Run("equal TS", func(t *testing.T) {
+		n := newMemNetwork(t, "a.example.com", "b.example.com")
+		a := n.servers["a.example.com"]
+		b := n.servers["b.example.com"]
+
+		a.connectUser("alice", "alice1")
+		b.connectUser("alice", "alice2")
+
+		n.link("a.example.com", "b.example.com")
+
+		// Both die.
+		n.waitFor("both users to be killed", func() bool {
+			return a.userServer("alice") == "" && b.userServer("alice") == ""
+		})
+	})
+
+	t.Run("older wins", func(t *testing.T) {
+		n := newMemNetwork(t, "a.example.com", "b.example.com")
+		a := n.servers["a.example.com"]
+		b := n.servers["b.example.com"]
+
+		a.connectUser("alice", "alice1")
+		n.clock.advance(10 * time.Second)
+		b.connectUser("alice", "alice2")
+
+		n.link("a.example.com", "b.example.com")
+		n.waitForConverged(1)
+
+		// The user@hosts differ, so the older one stays.
+		if got := a.userServer("alice"); got != "a.example.com" {
+			t.Errorf("a has alice on %q, wanted a.example.com", got)
+		}
+		if got := b.userServer("alice"); got != "a.example.com" {
+			t.Errorf("b has alice on %q, wanted a.example.com", got)
+		}
+	})
+}
+
+// With the fake clock, a client that stops talking times out exactly when we
+// say.
+func TestMemNetworkPingTimeout(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	// The client never answers PINGs.
+	a.connectUser("idle", "idle")
+
+	deadTime := a.cb.Config.DeadTime
+
+	n.advance(deadTime - time.Second)
+	if a.userServer("idle") == "" {
+		t.Fatalf("user timed out early")
+	}
+
+	n.advance(2 * time.Second)
+	n.waitFor("user to time out", func() bool {
+		return a.userServer("idle") == ""
+	})
+}
+
+// With a services server configured, we count its users as services and only
+// it may log users in.
+func TestMemNetworkServicesServer(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "services.example.com")
+	a := n.servers["a.example.com"]
+	services := n.servers["services.example.com"]
+
+	userA := a.connectUser("usera", "usera")
+	services.connectUser("nickserv", "nickserv")
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.NetworkName = "ExampleNet"
+		cfg.ServicesServer = "services.example.com"
+		a.cb.setConfig(&cfg)
+	})
+
+	n.link("a.example.com", "services.example.com")
+	n.waitForConverged(2)
+
+	userA.send(irc.Message{Command: "LUSERS"})
+	n.waitFor("usera to get LUSERS", func() bool {
+		return userA.hasMessageContaining("251", "1 users and 1 services on 2")
+	})
+
+	su := func(from *memServer, account string) {
+		from.call(func() {
+			for _, server := range from.cb.LocalServers {
+				server.maybeQueueMessage(irc.Message{
+					Prefix:  string(from.cb.Config.TS6SID),
+					Command: "ENCAP",
+					Params: []string{"*", "SU", string(from.cb.Nicks["usera"]),
+						account},
+				})
+			}
+		})
+	}
+	account := func() string {
+		var account string
+		a.call(func() {
+			account = a.cb.Users[a.cb.Nicks["usera"]].Account
+		})
+		return account
+	}
+
+	su(services, "alice")
+	n.waitFor("services to log usera in", func() bool {
+		return account() == "alice"
+	})
+
+	// Now services is somewhere else. The same SU does nothing. Since messages
+	// arrive in order, once we see the AWAY we know the SU came first.
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ServicesServer = "elsewhere.example.com"
+		a.cb.setConfig(&cfg)
+	})
+	su(services, "mallory")
+	services.call(func() {
+		for _, server := range services.cb.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(services.cb.Nicks["nickserv"]),
+				Command: "AWAY",
+				Params:  []string{"busy"},
+			})
+		}
+	})
+	n.waitFor("a to see the AWAY", func() bool {
+		away := ""
+		a.call(func() {
+			away = a.cb.Users[a.cb.Nicks["nickserv"]].AwayMessage
+		})
+		return away == "busy"
+	})
+	if got := account(); got != "alice" {
+		t.Errorf("usera is logged in to %q, wanted alice", got)
+	}
+}
+
+// Operators may KILL users on other servers only with the remote-kill
+// privilege.
+func TestMemNetworkRemoteKill(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.Opers = map[string]string{"oper": "pass"}
+		cfg.OperPrivileges = map[string]map[string]struct{}{"oper": {}}
+		a.cb.setConfig(&cfg)
+	})
+
+	oper := a.connectUser("oper", "oper")
+	a.connectUser("usera", "usera")
+	userB := b.connectUser("userb", "userb")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	oper.send(irc.Message{Command: "OPER", Params: []string{"oper", "pass"}})
+	n.waitFor("oper to oper up", func() bool {
+		return oper.hasMessage("381")
+	})
+
+	oper.send(irc.Message{Command: "KILL", Params: []string{"userb", "bye"}})
+	n.waitFor("remote KILL to be refused", func() bool {
+		return oper.hasMessageContaining("481", "remote-kill")
+	})
+
+	// Local users are fine without the privilege.
+	oper.send(irc.Message{Command: "KILL", Params: []string{"usera", "bye"}})
+	n.waitForConverged(2)
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.OperPrivileges = map[string]map[string]struct{}{
+			"oper": {"remote-kill": {}},
+		}
+		a.cb.setConfig(&cfg)
+	})
+
+	oper.send(irc.Message{Command: "KILL", Params: []string{"userb", "bye"}})
+	n.waitForConverged(1)
+	n.waitFor("userb to hear it was killed", func() bool {
+		return userB.hasMessageContaining("ERROR", "Killed")
+	})
+}
+
+// STATS c shows the servers we connect to and how connecting to each went.
+func TestMemNetworkStatsLinks(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	a.makeOper("alice")
+
+	stats := func(want string) {
+		alice.send(irc.Message{Command: "STATS", Params: []string{"c"}})
+		n.waitFor("STATS c to say "+want, func() bool {
+			m := alice.lastMessage("213")
+			return m != nil && strings.Contains(m.Params[len(m.Params)-1], want)
+		})
+		m := alice.lastMessage("213")
+		if m.Params[1] != "C" || m.Params[4] != "b.example.com" {
+			t.Errorf("got STATS c line %v, wanted b.example.com", m.Params)
+		}
+	}
+
+	stats("never tried")
+
+	// We haven't allowed a to reach b yet.
+	a.call(func() {
+		a.cb.connectToServer(a.cb.Config.Servers["b.example.com"])
+	})
+	n.waitFor("the attempt to fail", func() bool {
+		failed := false
+		a.call(func() {
+			failed = a.cb.linkStatus("b.example.com").LastFailure != ""
+		})
+		return failed
+	})
+	stats("no route to b.example.com")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(1)
+	stats("linked")
+}
+
+// If a link keeps going away, we stop connecting to it automatically until an
+// operator CONNECTs.
+func TestMemNetworkLinkFlapping(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.LinkFlapLimit = 2
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	a.makeOper("alice")
+
+	suspended := func() bool {
+		var suspended bool
+		a.call(func() {
+			suspended = a.cb.isLinkSuspended("b.example.com")
+		})
+		return suspended
+	}
+
+	for i := 0; i < 2; i++ {
+		if suspended() {
+			t.Fatalf("link suspended after %d delinks", i)
+		}
+		n.link("a.example.com", "b.example.com")
+		n.waitForConverged(1)
+		n.split("a.example.com", "b.example.com")
+		n.waitFor("the split", func() bool {
+			linked := true
+			a.call(func() {
+				linked = len(a.cb.Servers) > 0
+			})
+			return !linked
+		})
+	}
+
+	n.waitFor("the link to be suspended", suspended)
+	if !alice.hasMessageContaining("NOTICE", "b.example.com is flapping") {
+		t.Errorf("alice did not hear the link is flapping")
+	}
+
+	// b is reachable again, but we don't connect on our own.
+	n.mutex.Lock()
+	n.allowed[[2]string{"a.example.com", "b.example.com"}] = struct{}{}
+	n.mutex.Unlock()
+	n.advance(2 * time.Minute)
+	a.call(func() {
+		if a.cb.LinkStatuses["b.example.com"].LastAttempt.After(
+			a.cb.now().Add(-time.Minute)) {
+			t.Errorf("a tried to connect to b while the link was suspended")
+		}
+	})
+
+	alice.send(irc.Message{Command: "CONNECT", Params: []string{"b.example.com"}})
+	n.waitForConverged(1)
+	if suspended() {
+		t.Errorf("link still suspended after CONNECT")
+	}
+}
+
+// Standalone servers refuse anyone trying to link with them.
+func TestMemNetworkStandalone(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.Standalone = true
+		a.cb.setConfig(&cfg)
+	})
+
+	ours, theirs := net.Pipe()
+	c := &memClient{conn: ours}
+	go c.readLoop()
+	a.cb.introduceClient(theirs, "")
+
+	c.send(irc.Message{Command: "PASS",
+		Params: []string{"secret", "TS", "6", "1BB"}})
+	n.waitFor("the server to be refused", func() bool {
+		return c.hasMessageContaining("ERROR", "does not link")
+	})
+
+	// Users are fine.
+	a.connectUser("user", "user")
+}
+
+// We delink a server that introduces one too many hops away.
+func TestMemNetworkMaxHopCount(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.MaxHopCount = 1
+		a.cb.setConfig(&cfg)
+	})
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+
+	n.link("b.example.com", "c.example.com")
+	b := n.servers["b.example.com"]
+	n.waitFor("b and c to link", func() bool {
+		servers := 0
+		b.call(func() { servers = len(b.cb.Servers) })
+		return servers == 1
+	})
+
+	n.link("a.example.com", "b.example.com")
+	n.waitFor("b to be delinked", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"Refused SID c.example.com (2AA) from b.example.com: hop count 2 is over the limit of 1")
+	})
+}
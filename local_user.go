@@ -3,8 +3,13 @@ package terrarium
 import (
 	"fmt"
 	"log"
+	"net"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/horgh/irc"
@@ -19,12 +24,6 @@ type LocalUser struct {
 	// A reference to their user information.
 	User *User
 
-	// The last time we heard anything from the client.
-	LastActivityTime time.Time
-
-	// The last time we sent the client a PING.
-	LastPingTime time.Time
-
 	// The last time the client sent a PRIVMSG/NOTICE. We use this to decide
 	// idle time.
 	LastMessageTime time.Time
@@ -36,32 +35,84 @@ type LocalUser struct {
 
 	// MessageQueue holds queued messages from the client.
 	MessageQueue []irc.Message
+
+	// Invites holds the channels the user has been invited to. An invite lets
+	// them join the channel while it is invite only (+i), until it expires (see
+	// invite-expiry). Canonicalized channel name to the invite.
+	Invites map[string]*Invite
+
+	// Nicks the user is monitoring with MONITOR. Canonicalized nick to the nick
+	// as they gave it.
+	Monitoring map[string]string
+
+	// The name of the oper block they used with OPER. This decides their
+	// privileges. Blank if they're not an operator.
+	OperName string
+
+	// The mask they last previewed with MASSKILL, when, and the users it
+	// matched. They must preview a mask before they may MASSKILL CONFIRM it.
+	// Confirming disconnects the users the preview showed.
+	MassKillMask        string
+	MassKillPreviewTime time.Time
+	MassKillUIDs        []TS6UID
+
+	// Users who may message them while they are +g (caller ID), and when we
+	// last told them someone else tried to. See ACCEPT.
+	Accepts            map[TS6UID]struct{}
+	LastCallerIDNotice time.Time
+
+	// Users they messaged directly and when they last did, for limiting how
+	// many different users they message. See max-targets.
+	Targets map[TS6UID]time.Time
+
+	// Whether they must pass a challenge before they may join channels. See
+	// challenge.go.
+	Challenged bool
+
+	// How many unknown commands they sent since UnknownCommandTime. See
+	// unknown-command-limit.
+	UnknownCommands    int
+	UnknownCommandTime time.Time
+
+	// The language they chose with LANGUAGE. Blank means the server's.
+	Language string
 }
 
 // NewLocalUser makes a LocalUser from a LocalClient.
 func NewLocalUser(c *LocalClient) *LocalUser {
-	now := time.Now()
+	now := c.Catbox.now()
 
 	u := &LocalUser{
-		LocalClient:      c,
-		LastActivityTime: now,
-		LastPingTime:     now,
-		LastMessageTime:  now,
-		MessageCounter:   UserMessageLimit,
-		MessageQueue:     []irc.Message{},
+		LocalClient:     c,
+		LastMessageTime: now,
+		MessageCounter:  UserMessageLimit,
+		MessageQueue:    []irc.Message{},
+		Invites:         make(map[string]*Invite),
+		Monitoring:      make(map[string]string),
+		Accepts:         make(map[TS6UID]struct{}),
+		Targets:         make(map[TS6UID]time.Time),
 	}
 
+	// Their registration counts as activity, and so does answering a PING.
+	u.LastActivityTime = now
+	u.LastPingTime = now
+
 	return u
 }
 
+// String describes the user in logs. Under the anonymous privacy profile we
+// leave out their address.
 func (u *LocalUser) String() string {
+	if u.Catbox.config().PrivacyProfile == PrivacyProfileAnonymous {
+		return u.User.String()
+	}
 	return fmt.Sprintf("%s %s", u.User.String(), u.Conn.RemoteAddr())
 }
 
 // Message from this local user to another user, remote or local.
 func (u *LocalUser) messageUser(to *User, command string, params []string) {
 	if to.isLocal() {
-		to.LocalUser.maybeQueueMessage(irc.Message{
+		to.LocalUser.maybeQueueMessageFrom(u.User, irc.Message{
 			Prefix:  u.User.nickUhost(),
 			Command: command,
 			Params:  params,
@@ -83,6 +134,16 @@ func (u *LocalUser) serverNotice(s string) {
 	})
 }
 
+// Determine if the user is an operator with the given privilege. We look at
+// the current config so a rehash can change privileges.
+func (u *LocalUser) hasPrivilege(privilege string) bool {
+	if !u.User.isOperator() {
+		return false
+	}
+	_, exists := u.Catbox.Config.OperPrivileges[u.OperName][privilege]
+	return exists
+}
+
 // Make TS6 UID. UID = SID concatenated with ID
 func (u *LocalUser) makeTS6UID(id uint64) (TS6UID, error) {
 	ts6id, err := makeTS6ID(u.ID)
@@ -103,6 +164,12 @@ func (u *LocalUser) messageFromServer(command string, params []string) {
 		newParams := []string{u.User.DisplayNick}
 		newParams = append(newParams, params...)
 		params = newParams
+
+		// Send the text in the user's language.
+		last := len(params) - 1
+		if name, ok := replyMessageName(command, params[last]); ok {
+			params[last] = u.Catbox.userMessageText(u.User, name)
+		}
 	}
 
 	u.maybeQueueMessage(irc.Message{
@@ -112,10 +179,10 @@ func (u *LocalUser) messageFromServer(command string, params []string) {
 	})
 }
 
-// join tries to join the client to a channel.
+// join tries to join the client to a channel, with the key they gave if any.
 //
 // We've validated the name is valid and have canonicalized it.
-func (u *LocalUser) join(channelName string) {
+func (u *LocalUser) join(channelName, key string) {
 	// Is the client in the channel already? Ignore it if so.
 	if u.User.onChannel(&Channel{Name: channelName}) {
 		return
@@ -123,23 +190,58 @@ func (u *LocalUser) join(channelName string) {
 
 	// Look up the channel. Create it if necessary.
 	channel, channelExists := u.Catbox.Channels[channelName]
+	if channelExists && !u.canJoinInviteOnly(channel) {
+		// 473 ERR_INVITEONLYCHAN
+		u.messageFromServer("473", []string{channel.Name,
+			"Cannot join channel (+i)"})
+		return
+	}
+	if channelExists && channel.hasMode('r') && u.User.Account == "" {
+		// 477 ERR_NEEDREGGEDNICK
+		u.messageFromServer("477", []string{channel.Name,
+			"Cannot join channel (+r) - you need to be logged in to an account"})
+		return
+	}
+	if channelExists && channel.Key != "" && key != channel.Key {
+		// 475 ERR_BADCHANNELKEY
+		u.messageFromServer("475", []string{channel.Name,
+			"Cannot join channel (+k)"})
+		return
+	}
+	// As with +i, an invite lets them past the limit.
+	if channelExists && channel.Limit > 0 &&
+		len(channel.Members) >= channel.Limit && !u.hasInvite(channel.Name) {
+		// 471 ERR_CHANNELISFULL
+		u.messageFromServer("471", []string{channel.Name,
+			"Cannot join channel (+l)"})
+		return
+	}
 	if !channelExists {
 		channel = &Channel{
-			Name:    channelName,
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      time.Now().Unix(),
+			Name:             channelName,
+			Members:          make(map[TS6UID]struct{}),
+			Ops:              make(map[TS6UID]*User),
+			Halfops:          make(map[TS6UID]*User),
+			Voiced:           make(map[TS6UID]*User),
+			Modes:            make(map[byte]struct{}),
+			InviteExceptions: make(map[string]*ListEntry),
+			TS:               u.Catbox.now().Unix(),
 		}
 		u.Catbox.Channels[channelName] = channel
 		channel.grantOps(u.User)
-		channel.Modes['n'] = struct{}{}
-		channel.Modes['s'] = struct{}{}
+		for _, mode := range DefaultChannelModes {
+			channel.setMode(byte(mode))
+		}
+		u.Catbox.emitEvent("channel-create", "channel", channel.Name, "nick",
+			u.User.DisplayNick)
 	}
 
 	// Add them to the channel.
 	channel.Members[u.User.UID] = struct{}{}
-	u.User.Channels[channelName] = channel
+	u.User.Channels[channel.Name] = channel
+
+	// An invite is good for one join.
+	delete(u.Invites, channel.Name)
 
 	// Tell the client about the join.
 	// This is what RFC says to send: JOIN, RPL_TOPIC, and RPL_NAMREPLY.
@@ -149,7 +251,7 @@ func (u *LocalUser) join(channelName string) {
 
 	// If this is a new channel, send them the modes we set by default.
 	if !channelExists {
-		u.messageFromServer("MODE", []string{channel.Name, "+ns"})
+		u.messageFromServer("MODE", []string{channel.Name, channel.modesString()})
 	}
 
 	// It appears RPL_TOPIC is optional, at least ircd-ratbox does always send it.
@@ -166,71 +268,7 @@ func (u *LocalUser) join(channelName string) {
 		})
 	}
 
-	// 353 RPL_NAMREPLY: This tells the client about who is in the channel
-	// (including itself).
-	// Format: :<server> 353 <targetNick> <channel flag> <#channel> :<nicks>
-	// <nicks> is a list of nicknames in the channel. Each is prefixed with @
-	// or + to indicate opped/voiced). Apparently only one or the other.
-
-	// Channel flag: = (public), * (private), @ (secret)
-	// When we have more chan modes (-s / +p) this needs to vary
-	channelFlag := "@"
-
-	// We put as many nicks per line as possible.
-
-	// First build the portion that is common to every NAMREPLY so we can get
-	// its length.
-	namMessage := irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "353",
-		// Last parameter is where nicks go. We'll have " :" since it's blank
-		// right now (when we encode to determine base size).
-		Params: []string{u.User.DisplayNick, channelFlag, channel.Name, ""},
-	}
-
-	// If encoding the message truncates before we add any nicks, then there is no
-	// point continuing.
-	messageBuf, err := namMessage.Encode()
-	if err != nil {
-		log.Printf("Unable to generate RPL_NAMREPLY: %s", err)
-		return
-	}
-
-	baseSize := len(messageBuf)
-
-	nicks := ""
-	for memberUID := range channel.Members {
-		member := u.Catbox.Users[memberUID]
-
-		// We send the nick with its mode prefix.
-		sendNick := member.DisplayNick
-		if channel.userHasOps(member) {
-			sendNick = "@" + sendNick
-		}
-
-		// Assume 1 nick will always be okay to send.
-		if len(nicks) == 0 {
-			nicks += sendNick
-			continue
-		}
-
-		// If we add another nick, will we be above our line length? If so, fire off
-		// the message and start with the nick in a new list.
-		// +1 for " "
-		if baseSize+len(nicks)+1+len(member.DisplayNick) > irc.MaxLineLength {
-			namMessage.Params[3] = nicks
-			u.maybeQueueMessage(namMessage)
-			nicks = "" + sendNick
-			continue
-		}
-
-		nicks += " " + sendNick
-	}
-
-	if len(nicks) > 0 {
-		namMessage.Params[3] = nicks
-		u.maybeQueueMessage(namMessage)
-	}
+	u.sendNames(channel)
 
 	// 366 RPL_ENDOFNAMES: Ends NAMES list.
 	u.messageFromServer("366", []string{channel.Name, "End of NAMES list"})
@@ -249,7 +287,11 @@ func (u *LocalUser) join(channelName string) {
 		}
 
 		// From the client to each member.
-		u.messageUser(member, "JOIN", []string{channel.Name})
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  channel.sourceFor(u.User),
+			Command: "JOIN",
+			Params:  []string{channel.Name},
+		})
 	}
 
 	// Tell servers about this.
@@ -262,7 +304,7 @@ func (u *LocalUser) join(channelName string) {
 				Params: []string{
 					fmt.Sprintf("%d", channel.TS),
 					channel.Name,
-					"+ns",
+					channel.serverModesString(),
 					"@" + string(u.User.UID),
 				},
 			})
@@ -280,6 +322,127 @@ func (u *LocalUser) join(channelName string) {
 	}
 }
 
+// sendNames sends 353 RPL_NAMREPLY messages telling the user who is in the
+// channel. It does not send 366 RPL_ENDOFNAMES.
+func (u *LocalUser) sendNames(channel *Channel) {
+	// 353 RPL_NAMREPLY: This tells the client about who is in the channel
+	// (including itself).
+	// Format: :<server> 353 <targetNick> <channel flag> <#channel> :<nicks>
+	// <nicks> is a list of nicknames in the channel. Each is prefixed with @
+	// or + to indicate opped/voiced). Apparently only one or the other.
+
+	var nicks []string
+	for memberUID := range channel.Members {
+		member := u.Catbox.Users[memberUID]
+
+		// In anonymous channels they see only themself.
+		if channel.isAnonymous() && member != u.User {
+			continue
+		}
+
+		// We send the nick with its mode prefix.
+		sendNick := channel.memberPrefix(member) + member.DisplayNick
+
+		nicks = append(nicks, sendNick)
+	}
+
+	// Channel flag: = (public), * (private), @ (secret)
+	u.sendNamesList(channel.namesFlag(), channel.Name, nicks)
+}
+
+// sendNamesList sends 353 RPL_NAMREPLY messages listing the nicks. We put as
+// many nicks per line as possible.
+func (u *LocalUser) sendNamesList(flag, channelName string, nicks []string) {
+	if len(nicks) == 0 {
+		return
+	}
+
+	namMessage := irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "353",
+		// Last parameter is where nicks go.
+		Params: []string{u.User.DisplayNick, flag, channelName, ""},
+	}
+
+	// If the message is too long before we add any nicks, then there is no
+	// point continuing.
+	namMessages, err := splitListMessage(namMessage, nicks)
+	if err != nil {
+		log.Printf("Unable to generate RPL_NAMREPLY: %s", err)
+		return
+	}
+
+	for _, m := range namMessages {
+		u.maybeQueueMessage(m)
+	}
+}
+
+// canJoinInviteOnly checks whether the user gets past the channel being invite
+// only. They do if it is not +i, if they were invited, or if they match an
+// invite exception.
+func (u *LocalUser) canJoinInviteOnly(channel *Channel) bool {
+	if !channel.isInviteOnly() {
+		return true
+	}
+
+	if u.hasInvite(channel.Name) {
+		return true
+	}
+
+	return channel.matchesInviteException(u.User)
+}
+
+// Invite is an invite a user has to a channel.
+type Invite struct {
+	// Who invited them. nick!user@host
+	Inviter string
+
+	// When they were invited.
+	Time time.Time
+}
+
+// addInvite records that the user was invited to the channel. The channel name
+// must be canonicalized.
+func (u *LocalUser) addInvite(channelName, inviter string) {
+	u.Invites[channelName] = &Invite{Inviter: inviter, Time: u.Catbox.now()}
+}
+
+// hasInvite checks if the user has an invite to the channel that hasn't
+// expired. The channel name must be canonicalized.
+func (u *LocalUser) hasInvite(channelName string) bool {
+	u.expireInvites()
+	_, exists := u.Invites[channelName]
+	return exists
+}
+
+// expireInvites forgets the user's invites older than invite-expiry.
+func (u *LocalUser) expireInvites() {
+	expiry := u.Catbox.Config.InviteExpiry
+	if expiry == 0 {
+		return
+	}
+
+	now := u.Catbox.now()
+	for channelName, invite := range u.Invites {
+		if now.Sub(invite.Time) >= expiry {
+			delete(u.Invites, channelName)
+		}
+	}
+}
+
+// sortedInvites returns the channels the user has invites to, in order. It
+// forgets expired invites first.
+func (u *LocalUser) sortedInvites() []string {
+	u.expireInvites()
+
+	var channelNames []string
+	for channelName := range u.Invites {
+		channelNames = append(channelNames, channelName)
+	}
+	sort.Strings(channelNames)
+	return channelNames
+}
+
 // part tries to remove the client from the channel.
 //
 // We send a reply to the client. We also inform any other clients that need to
@@ -323,8 +486,13 @@ func (u *LocalUser) part(channelName, message string) {
 			continue
 		}
 
+		prefix := channel.sourceFor(u.User)
+		if member == u.User {
+			prefix = u.User.nickUhost()
+		}
+
 		member.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  u.User.nickUhost(),
+			Prefix:  prefix,
 			Command: "PART",
 			Params:  partParams,
 		})
@@ -381,6 +549,19 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 				continue
 			}
 
+			// A QUIT would say who they were. Members of anonymous channels see
+			// an anonymous PART instead.
+			if channel.isAnonymous() {
+				if member != u.User {
+					member.LocalUser.maybeQueueMessage(irc.Message{
+						Prefix:  anonymousPrefix,
+						Command: "PART",
+						Params:  []string{channel.Name},
+					})
+				}
+				continue
+			}
+
 			if _, exists := toldClients[member.UID]; exists {
 				continue
 			}
@@ -417,14 +598,22 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 
 	u.messageFromServer("ERROR", []string{msg})
 
-	close(u.WriteChan)
+	u.closeWriteChan()
 
 	delete(u.Catbox.Nicks, canonicalizeNick(u.User.DisplayNick))
 	delete(u.Catbox.LocalUsers, u.ID)
+	u.Catbox.releaseClientID(u.ID)
+	u.Catbox.removeHostUser(u)
 	if u.User.isOperator() {
 		delete(u.Catbox.Opers, u.User.UID)
 	}
 	delete(u.Catbox.Users, u.User.UID)
+	u.Catbox.releaseUser(u.User)
+	u.Catbox.stopMonitoring(u)
+	u.Catbox.nickOffline(canonicalizeNick(u.User.DisplayNick))
+
+	u.Catbox.emitEvent("quit", "nick", u.User.DisplayNick, "uid",
+		string(u.User.UID), "reason", msg)
 }
 
 // Set the user away. We've been given a non-blank message.
@@ -433,13 +622,7 @@ func (u *LocalUser) setAway(message string) {
 	u.User.AwayMessage = message
 
 	// Reply to the user.
-
-	// 306 RPL_NOWAWAY
-	u.maybeQueueMessage(irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "306",
-		Params:  []string{u.User.DisplayNick, "You have been marked as away"},
-	})
+	u.sendAwayStatus()
 
 	// Propagate.
 	for _, server := range u.Catbox.LocalServers {
@@ -461,15 +644,7 @@ func (u *LocalUser) setUnaway() {
 	// Flag him as back.
 	u.User.AwayMessage = ""
 
-	// 305 RPL_UNAWAY
-	u.maybeQueueMessage(irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "305",
-		Params: []string{
-			u.User.DisplayNick,
-			"You are no longer been marked as being away",
-		},
-	})
+	u.sendAwayStatus()
 
 	// Propagate.
 	for _, server := range u.Catbox.LocalServers {
@@ -484,7 +659,7 @@ func (u *LocalUser) setUnaway() {
 // The user sent us a message. Deal with it.
 func (u *LocalUser) handleMessage(m irc.Message) {
 	// Record that client said something to us just now.
-	u.LastActivityTime = time.Now()
+	u.LastActivityTime = u.Catbox.now()
 
 	// Clients SHOULD NOT (section 2.3) send a prefix. I'm going to disallow it
 	// completely for all commands.
@@ -497,8 +672,12 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 	// queue it.
 	if !u.User.isFloodExempt() {
 		if u.MessageCounter == 0 {
-			log.Printf("%s is flooding. Queueing their message.", u.User.DisplayNick)
+			if u.Catbox.clientLogAllowed(u.LocalClient) {
+				log.Printf("%s is flooding. Queueing their message.", u.User.DisplayNick)
+			}
 			u.MessageQueue = append(u.MessageQueue, m)
+			u.Catbox.debugf("flood", "%s: Queued %s (%d queued)", u.User.DisplayNick,
+				m.Command, len(u.MessageQueue))
 
 			// Check for overwhelming their queue and disconnect them if so.
 			if len(u.MessageQueue) >= ExcessFloodThreshold {
@@ -511,9 +690,8 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		u.MessageCounter--
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
 	if m.Command == "CAP" {
+		u.capCommand(m, u.User.DisplayNick, true)
 		return
 	}
 
@@ -537,14 +715,49 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KICK" {
+		u.kickCommand(m)
+		return
+	}
+
+	if m.Command == "NAMES" {
+		u.namesCommand(m)
+		return
+	}
+
 	// Per RFC these commands are near identical.
 	if m.Command == "PRIVMSG" || m.Command == "NOTICE" {
 		u.privmsgCommand(m)
 		return
 	}
 
+	if m.Command == "CPRIVMSG" || m.Command == "CNOTICE" {
+		u.cprivmsgCommand(m)
+		return
+	}
+
+	if m.Command == "RELAYMSG" {
+		u.relaymsgCommand(m)
+		return
+	}
+
+	if m.Command == "ACCEPT" {
+		u.acceptCommand(m)
+		return
+	}
+
+	if m.Command == "MONITOR" {
+		u.monitorCommand(m)
+		return
+	}
+
+	if m.Command == "ISON" {
+		u.isonCommand(m)
+		return
+	}
+
 	if m.Command == "LUSERS" {
-		u.lusersCommand()
+		u.lusersCommand(m)
 		return
 	}
 
@@ -553,13 +766,18 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "RULES" {
+		u.rulesCommand()
+		return
+	}
+
 	if m.Command == "QUIT" {
 		u.quitCommand(m)
 		return
 	}
 
 	if m.Command == "PONG" {
-		// Not doing anything with this. Just accept it.
+		u.gotPong()
 		return
 	}
 
@@ -608,6 +826,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "ALLOWRELINK" {
+		u.allowRelinkCommand(m)
+		return
+	}
+
 	if m.Command == "LINKS" {
 		u.linksCommand(m)
 		return
@@ -658,6 +881,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "ADMIN" {
+		u.adminCommand(m)
+		return
+	}
+
 	if m.Command == "WHOWAS" {
 		u.whowasCommand(m)
 		return
@@ -668,6 +896,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	// TAGMSG carries only tags, which we drop. See tags.go.
+	if m.Command == "TAGMSG" {
+		return
+	}
+
 	if m.Command == "INVITE" {
 		u.inviteCommand(m)
 		return
@@ -678,12 +911,101 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "OPERMOTD" {
+		u.operMOTDCommand()
+		return
+	}
+
 	if m.Command == "SQUIT" {
 		u.squitCommand(m)
 		return
 	}
 
-	// Unknown command. We don't handle it yet anyway.
+	if m.Command == "CHECK" {
+		u.checkCommand(m)
+		return
+	}
+
+	if m.Command == "SET" {
+		u.setCommand(m)
+		return
+	}
+
+	if m.Command == "MASSKILL" {
+		u.massKillCommand(m)
+		return
+	}
+
+	if m.Command == "HELP" {
+		u.helpCommand(m)
+		return
+	}
+
+	if m.Command == "TRACE" {
+		u.traceCommand(m)
+		return
+	}
+
+	if m.Command == "ETRACE" {
+		u.etraceCommand(m)
+		return
+	}
+
+	if m.Command == "INVITES" {
+		u.invitesCommand(m)
+		return
+	}
+
+	if m.Command == "FINDUSER" {
+		u.findUserCommand(m)
+		return
+	}
+
+	if m.Command == "VERSIONSURVEY" {
+		u.versionSurveyCommand(m)
+		return
+	}
+
+	if m.Command == "LANGUAGE" {
+		u.languageCommand(m)
+		return
+	}
+
+	u.unknownCommand(m)
+}
+
+// unknownCommandWindow is how long unknown-command-limit applies over.
+const unknownCommandWindow = time.Minute
+
+// The user sent a command we don't know. We tell them so, unless it's one we
+// ignore or they're sending too many.
+func (u *LocalUser) unknownCommand(m irc.Message) {
+	cfg := u.Catbox.Config
+
+	if _, exists := cfg.IgnoreCommands[m.Command]; exists {
+		return
+	}
+
+	now := u.Catbox.now()
+	if now.Sub(u.UnknownCommandTime) >= unknownCommandWindow {
+		u.UnknownCommands = 0
+		u.UnknownCommandTime = now
+	}
+	u.UnknownCommands++
+
+	if cfg.UnknownCommandLimit > 0 &&
+		u.UnknownCommands > cfg.UnknownCommandLimit {
+		// Tell operators once per window.
+		if u.UnknownCommands == cfg.UnknownCommandLimit+1 &&
+			u.Catbox.clientLogAllowed(u.LocalClient) {
+			u.Catbox.noticeLocalOpersAbout("spam", fmt.Sprintf(
+				"%s sent more than %d unknown commands in %s (latest %s)",
+				u.User.DisplayNick, cfg.UnknownCommandLimit, unknownCommandWindow,
+				m.Command))
+		}
+		return
+	}
+
 	// 421 ERR_UNKNOWNCOMMAND
 	u.messageFromServer("421", []string{m.Command, "Unknown command"})
 }
@@ -697,7 +1019,7 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		u.messageFromServer("431", []string{"No nickname given"})
 		return
 	}
-	nick := m.Params[0]
+	nick := u.applyNickAffixes(m.Params[0])
 
 	// Truncate and validate the nick.
 
@@ -729,6 +1051,11 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 			u.messageFromServer("433", []string{nick, "Nickname is already in use"})
 			return
 		}
+
+		if numeric, text := u.Catbox.nickRefusal(nick); numeric != "" {
+			u.messageFromServer(numeric, []string{nick, text})
+			return
+		}
 	}
 
 	// Free the old nick.
@@ -737,16 +1064,24 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 	// Flag the nick as taken by this client.
 	u.Catbox.Nicks[newNickCanon] = u.User.UID
 
+	if newNickCanon != oldNickCanon {
+		u.Catbox.nickOffline(oldNickCanon)
+	}
+
 	// Nick TS changes when nick is set.
-	u.User.NickTS = time.Now().Unix()
+	u.User.NickTS = u.Catbox.now().Unix()
 
 	// We need to inform other clients about the nick change.
 	// Any that are in the same channel as this client.
 	// Tell only local clients. Tell all servers after.
 	// Tell each client only once.
 	// Message needs to come from the OLD nick.
+	// Members of anonymous channels don't hear. It would say who they are.
 	informedClients := map[TS6UID]struct{}{}
 	for _, channel := range u.User.Channels {
+		if channel.isAnonymous() {
+			continue
+		}
 		for memberUID := range channel.Members {
 			member := u.Catbox.Users[memberUID]
 			if !member.isLocal() {
@@ -774,6 +1109,10 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 	// old nick when crafting messages.
 	u.User.DisplayNick = nick
 
+	if newNickCanon != oldNickCanon {
+		u.Catbox.nickOnline(u.User)
+	}
+
 	// Propagate to servers.
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
@@ -810,26 +1149,115 @@ func (u *LocalUser) joinCommand(m irc.Message) {
 	// May have multiple channels in a single command.
 	channels := commaChannelsToChannelNames(m.Params[0])
 
-	// We could support keys.
+	if u.Challenged {
+		for _, channelName := range channels {
+			// 477 ERR_NEEDREGGEDNICK
+			u.messageFromServer("477", []string{channelName,
+				"Cannot join channel (you must pass the connection challenge first)"})
+		}
+		return
+	}
+
+	// Keys go with the channels in the order given.
+	keys := map[string]string{}
+	if len(m.Params) > 1 {
+		rawKeys := strings.Split(m.Params[1], ",")
+		for i, name := range strings.Split(m.Params[0], ",") {
+			if i >= len(rawKeys) {
+				break
+			}
+			keys[canonicalizeChannel(strings.TrimSpace(name))] = rawKeys[i]
+		}
+	}
 
 	// Try to join the client to the channels.
 	for _, channelName := range channels {
-		u.join(channelName)
+		u.join(channelName, keys[channelName])
 	}
 }
 
-func (u *LocalUser) partCommand(m irc.Message) {
-	// Parameters: <channel> *( "," <channel> ) [ <Part Message> ]
+// NAMES lists who is in channels.
+//
+// With channels, we list each that the user can see. Secret channels they are
+// not on look empty.
+//
+// Without channels, we list every channel they can see, then in the * group
+// every visible (-i) user who is not in one of those channels.
+func (u *LocalUser) namesCommand(m irc.Message) {
+	// Parameters: [<channel>{,<channel>}]
+	if len(m.Params) > 0 && m.Params[0] != "" {
+		for _, name := range strings.Split(m.Params[0], ",") {
+			if name == "" {
+				continue
+			}
 
-	if len(m.Params) == 0 {
-		// 461 ERR_NEEDMOREPARAMS
-		u.messageFromServer("461", []string{"PART", "Not enough parameters"})
+			channel, exists := u.Catbox.Channels[canonicalizeChannel(name)]
+			if exists && u.canSeeChannel(channel) {
+				u.sendNames(channel)
+			}
+
+			// 366 RPL_ENDOFNAMES
+			u.messageFromServer("366", []string{name, "End of NAMES list"})
+		}
 		return
 	}
 
-	partMessage := ""
-	if len(m.Params) >= 2 {
-		partMessage = m.Params[1]
+	var names []string
+	for name, channel := range u.Catbox.Channels {
+		if u.canSeeChannel(channel) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Users shown in a channel's list. They don't go in the * group.
+	shown := map[TS6UID]struct{}{}
+	for _, name := range names {
+		channel := u.Catbox.Channels[name]
+		u.sendNames(channel)
+		if channel.isAnonymous() {
+			continue
+		}
+		for memberUID := range channel.Members {
+			shown[memberUID] = struct{}{}
+		}
+	}
+
+	var nicks []string
+	for uid, user := range u.Catbox.Users {
+		if _, exists := shown[uid]; exists {
+			continue
+		}
+		if user.isInvisible() && user != u.User {
+			continue
+		}
+		nicks = append(nicks, user.DisplayNick)
+	}
+	sort.Strings(nicks)
+	u.sendNamesList("=", "*", nicks)
+
+	// 366 RPL_ENDOFNAMES
+	u.messageFromServer("366", []string{"*", "End of NAMES list"})
+}
+
+// canSeeChannel checks if the user may see who is in the channel. They can't
+// see into secret channels they are not on.
+func (u *LocalUser) canSeeChannel(channel *Channel) bool {
+	return !channel.hasMode('s') || u.User.onChannel(channel)
+}
+
+func (u *LocalUser) partCommand(m irc.Message) {
+	// Parameters: <channel> *( "," <channel> ) [ <Part Message> ]
+
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"PART", "Not enough parameters"})
+		return
+	}
+
+	partMessage := ""
+	if len(m.Params) >= 2 {
+		partMessage = m.Params[1]
 	}
 
 	// May have multiple channels in a single command.
@@ -840,6 +1268,71 @@ func (u *LocalUser) partCommand(m irc.Message) {
 	}
 }
 
+// kickCommand removes users from a channel. Channel operators may kick anyone.
+// Halfops may kick members without ops or halfops.
+func (u *LocalUser) kickCommand(m irc.Message) {
+	// Parameters: <channel> <user> *( "," <user> ) [ <comment> ]
+
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	channel, exists := u.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
+		return
+	}
+
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
+
+	reason := u.User.DisplayNick
+	if len(m.Params) >= 3 && len(m.Params[2]) > 0 {
+		reason = m.Params[2]
+	}
+
+	for _, nick := range strings.Split(m.Params[1], ",") {
+		targetUID, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
+			continue
+		}
+		targetUser := u.Catbox.Users[targetUID]
+
+		if !targetUser.onChannel(channel) {
+			// 441 ERR_USERNOTINCHANNEL
+			u.messageFromServer("441", []string{targetUser.DisplayNick,
+				channel.Name, "They aren't on that channel"})
+			continue
+		}
+
+		if !channel.canKick(u.User, targetUser) {
+			// 482 ERR_CHANOPRIVSNEEDED
+			u.messageFromServer("482", []string{channel.Name,
+				"You're not channel operator"})
+			continue
+		}
+
+		for _, server := range u.Catbox.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "KICK",
+				Params:  []string{channel.Name, string(targetUser.UID), reason},
+			})
+		}
+
+		u.Catbox.kickUser(channel, channel.sourceFor(u.User), targetUser, reason)
+	}
+}
+
 // Per RFC 2812, PRIVMSG and NOTICE are essentially the same, so both PRIVMSG
 // and NOTICE use this command function.
 func (u *LocalUser) privmsgCommand(m irc.Message) {
@@ -879,21 +1372,29 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			return
 		}
 
-		// Are they on it?
-		// Technically we should allow messaging if they aren't on it
-		// depending on the mode.
-		if !u.User.onChannel(channel) {
+		// Are they on it? They must be if the channel is +n.
+		if !u.User.onChannel(channel) && channel.hasMode('n') {
 			// 404 ERR_CANNOTSENDTOCHAN
 			u.messageFromServer("404", []string{channelName, "Cannot send to channel"})
 			return
 		}
 
-		u.LastMessageTime = time.Now()
+		filtered, refusedBy := channel.filterMessage(u.Catbox, msg)
+		if refusedBy != 0 {
+			// 404 ERR_CANNOTSENDTOCHAN
+			u.messageFromServer("404", []string{channelName,
+				fmt.Sprintf("Cannot send to channel (+%c)", refusedBy)})
+			return
+		}
+		msg = filtered
+
+		u.LastMessageTime = u.Catbox.now()
 
 		// Send to all members of the channel. Except the client itself it seems.
 		// Tell local users directly.
 		// If a user is remote, record the server we should propagate the message
 		// towards. Tell each server only once.
+		var recipients []*LocalClient
 		toServers := make(map[*LocalServer]struct{})
 		for memberUID := range channel.Members {
 			member := u.Catbox.Users[memberUID]
@@ -902,14 +1403,31 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			}
 
 			if member.isLocal() {
-				// From the client to each member.
-				u.messageUser(member, m.Command, []string{channel.Name, msg})
+				recipients = append(recipients, member.LocalUser.LocalClient)
+				continue
+			}
+
+			// Anonymous channels are local to this server. Other servers would show
+			// who sent the message.
+			if channel.isAnonymous() {
 				continue
 			}
 
 			toServers[member.ClosestServer] = struct{}{}
 		}
 
+		// From the client to each member. Members of anonymous channels don't
+		// learn they're a bot.
+		source := u.User
+		if channel.isAnonymous() {
+			source = nil
+		}
+		u.Catbox.fanOutFrom(source, recipients, irc.Message{
+			Prefix:  channel.sourceFor(u.User),
+			Command: m.Command,
+			Params:  []string{channel.Name, msg},
+		})
+
 		// Propagate message to any servers that need it.
 		for server := range toServers {
 			server.maybeQueueMessage(irc.Message{
@@ -919,11 +1437,19 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			})
 		}
 
+		u.Catbox.logChat(m.Command, channel.sourceFor(u.User), channel.Name, msg)
 		return
 	}
 
 	// We're messaging a nick directly.
 
+	// Replies to a version survey's CTCP VERSION come to us.
+	if m.Command == "NOTICE" &&
+		strings.EqualFold(target, u.Catbox.Config.ServerName) {
+		u.Catbox.versionSurveyReply(u.User, msg)
+		return
+	}
+
 	nickName := canonicalizeNick(target)
 	if !isValidNick(u.Catbox.Config.MaxNickLength, nickName) {
 		// 401 ERR_NOSUCHNICK
@@ -939,17 +1465,45 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 	}
 	targetUser := u.Catbox.Users[targetUID]
 
-	u.LastMessageTime = time.Now()
+	if !u.addTarget(targetUser) {
+		// 707 ERR_TARGCHANGE
+		u.messageFromServer("707", []string{targetUser.DisplayNick,
+			"Targets changing too fast, message dropped"})
+		return
+	}
+
+	u.messageNick(m.Command, nickName, targetUser, msg)
+}
+
+// messageNick sends a PRIVMSG or NOTICE to a user. The name is how we address
+// them to local users.
+func (u *LocalUser) messageNick(command, name string, targetUser *User,
+	msg string) {
+	// Caller ID (+g). Tell them why only if it's a PRIVMSG. We never reply to
+	// NOTICEs. For remote users, their server decides.
+	if targetUser.isLocal() && !targetUser.LocalUser.acceptsMessageFrom(u.User) {
+		if command == "PRIVMSG" {
+			for _, reply := range targetUser.LocalUser.callerIDRefused(u.User) {
+				u.messageFromServer(reply.Command, reply.Params)
+			}
+		}
+		return
+	}
+
+	u.LastMessageTime = u.Catbox.now()
 
 	if targetUser.isLocal() {
-		u.messageUser(targetUser, m.Command, []string{nickName, msg})
+		u.messageUser(targetUser, command, []string{name, msg})
 	} else {
-		u.messageUser(targetUser, m.Command, []string{string(targetUser.UID),
+		u.messageUser(targetUser, command, []string{string(targetUser.UID),
 			msg})
 	}
 
-	// Reply with 301 RPL_AWAY if they're away.
-	if len(targetUser.AwayMessage) > 0 {
+	u.Catbox.logChat(command, u.User.nickUhost(), targetUser.DisplayNick, msg)
+
+	// Reply with 301 RPL_AWAY if they're away. We know whether remote users are
+	// away too as servers tell each other. Never reply to a NOTICE.
+	if command == "PRIVMSG" && len(targetUser.AwayMessage) > 0 {
 		u.maybeQueueMessage(irc.Message{
 			Prefix:  u.Catbox.Config.ServerName,
 			Command: "301",
@@ -962,100 +1516,408 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 	}
 }
 
-func (u *LocalUser) lusersCommand() {
-	// We always send RPL_LUSERCLIENT and RPL_LUSERME.
-	// The others only need be sent if the counts are non-zero.
+// addTarget records that the user is messaging the target. It says whether
+// they may. They may message a limited number of different users (max-targets)
+// at a time. Once they reach it, a user they have not messaged in
+// target-change-time stops counting.
+//
+// Operators and flood exempt users have no limit.
+func (u *LocalUser) addTarget(target *User) bool {
+	cfg := u.Catbox.Config
+	if cfg.MaxTargets == 0 || u.User.isFloodExempt() || target == u.User {
+		return true
+	}
 
-	// 251 RPL_LUSERCLIENT
-	u.messageFromServer("251", []string{
-		fmt.Sprintf("There are %d users and %d services on %d servers.",
-			len(u.Catbox.Users),
-			0,
-			// +1 to count ourself.
-			len(u.Catbox.Servers)+1),
-	})
+	now := u.Catbox.now()
 
-	// 252 RPL_LUSEROP
-	operCount := 0
-	for _, user := range u.Catbox.Users {
-		if user.isOperator() {
-			operCount++
+	if _, exists := u.Targets[target.UID]; !exists &&
+		len(u.Targets) >= cfg.MaxTargets {
+		for uid, lastTime := range u.Targets {
+			if now.Sub(lastTime) >= cfg.TargetChangeTime {
+				delete(u.Targets, uid)
+			}
+		}
+		if len(u.Targets) >= cfg.MaxTargets {
+			return false
 		}
 	}
-	if operCount > 0 {
-		// 252 RPL_LUSEROP
-		u.messageFromServer("252", []string{
-			fmt.Sprintf("%d", operCount),
-			"operator(s) online",
-		})
+
+	u.Targets[target.UID] = now
+	return true
+}
+
+// CPRIVMSG and CNOTICE send a PRIVMSG or NOTICE to a user on a channel where
+// the sender is an operator (or halfop). They don't count toward the sender's
+// target limit (see addTarget()), so channel operators can talk to many users
+// on their channels.
+//
+// Parameters: <nick> <channel> <text>
+func (u *LocalUser) cprivmsgCommand(m irc.Message) {
+	command := "PRIVMSG"
+	if m.Command == "CNOTICE" {
+		command = "NOTICE"
 	}
 
-	// 253 RPL_LUSERUNKNOWN
-	// Unregistered connections.
-	numUnknown := len(u.Catbox.LocalClients)
-	if numUnknown > 0 {
-		u.messageFromServer("253", []string{
-			fmt.Sprintf("%d", numUnknown),
-			"unknown connection(s)",
-		})
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
 	}
 
-	// 254 RPL_LUSERCHANNELS
-	// RFC 2811 says to not include +s channels in this count. But I do.
-	if len(u.Catbox.Channels) > 0 {
-		u.messageFromServer("254", []string{
-			fmt.Sprintf("%d", len(u.Catbox.Channels)),
-			"channels formed",
-		})
+	if len(m.Params[2]) == 0 {
+		// 412 ERR_NOTEXTTOSEND
+		u.messageFromServer("412", []string{"No text to send"})
+		return
 	}
 
-	// 255 RPL_LUSERME
-	u.messageFromServer("255", []string{
-		fmt.Sprintf("I have %d clients and %d servers",
-			len(u.Catbox.LocalUsers), len(u.Catbox.LocalServers)),
-	})
+	nickName := canonicalizeNick(m.Params[0])
+	targetUID, exists := u.Catbox.Nicks[nickName]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{m.Params[0], "No such nick/channel"})
+		return
+	}
+	targetUser := u.Catbox.Users[targetUID]
 
-	// 265 tells current local user count and max. Not standard.
-	u.messageFromServer("265", []string{
-		fmt.Sprintf("%d", len(u.Catbox.LocalUsers)),
-		fmt.Sprintf("%d", u.Catbox.HighestLocalUserCount),
-		fmt.Sprintf("Current local users %d, max %d",
-			len(u.Catbox.LocalUsers), u.Catbox.HighestLocalUserCount),
-	})
+	channelName := canonicalizeChannel(m.Params[1])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{channelName, "No such channel"})
+		return
+	}
 
-	// 266 tells global user count and max. Not standard.
-	u.messageFromServer("266", []string{
-		fmt.Sprintf("%d", len(u.Catbox.Users)),
-		fmt.Sprintf("%d", u.Catbox.HighestGlobalUserCount),
-		fmt.Sprintf("Current global users %d, max %d",
-			len(u.Catbox.Users), u.Catbox.HighestGlobalUserCount),
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
+
+	if !channel.userHasHalfopsOrOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	if !targetUser.onChannel(channel) {
+		// 441 ERR_USERNOTINCHANNEL
+		u.messageFromServer("441", []string{targetUser.DisplayNick, channel.Name,
+			"They aren't on that channel"})
+		return
+	}
+
+	u.messageNick(command, nickName, targetUser, m.Params[2])
+}
+
+// CallerIDNoticeInterval is how often we tell a +g user that someone not on
+// their ACCEPT list is trying to message them.
+const CallerIDNoticeInterval = time.Minute
+
+// MaxAcceptListLength is how many users may be on a user's ACCEPT list.
+const MaxAcceptListLength = 20
+
+// acceptsMessageFrom checks if the user takes private messages from source.
+// Users who are +g take them only from users on their ACCEPT list.
+func (u *LocalUser) acceptsMessageFrom(source *User) bool {
+	if !u.User.isCallerID() || source == u.User {
+		return true
+	}
+	_, exists := u.Accepts[source.UID]
+	return exists
+}
+
+// callerIDRefused tells the user that source tried to message them, unless we
+// told them about someone recently. It returns the numerics to send source
+// about it, without the target parameter.
+func (u *LocalUser) callerIDRefused(source *User) []irc.Message {
+	// 716 ERR_TARGUMODEG
+	replies := []irc.Message{{Command: "716", Params: []string{
+		u.User.DisplayNick, "is in +g mode (server-side ignore)"}}}
+
+	now := u.Catbox.now()
+	if now.Sub(u.LastCallerIDNotice) < CallerIDNoticeInterval {
+		return replies
+	}
+	u.LastCallerIDNotice = now
+
+	// 718 RPL_UMODEGMSG
+	u.messageFromServer("718", []string{
+		source.DisplayNick,
+		source.Username + "@" + source.Hostname,
+		fmt.Sprintf("is messaging you, and you have user mode +g set. Use ACCEPT %s to allow.",
+			source.DisplayNick),
 	})
 
-	// 250 tells highest total connections, highest total local users (again, it
-	// does seem like ratbox does this), and the total number of connections
-	// received. Again this is not standard, but interesting.
-	u.messageFromServer("250", []string{
-		fmt.Sprintf("Highest connection count: %d (%d clients) (%d connections received)",
-			u.Catbox.HighestConnectionCount, u.Catbox.HighestLocalUserCount,
-			u.Catbox.ConnectionCount),
+	// 717 RPL_TARGNOTIFY
+	return append(replies, irc.Message{Command: "717", Params: []string{
+		u.User.DisplayNick, "has been informed that you messaged them."}})
+}
+
+// ACCEPT changes who may message the user while they are +g (caller ID).
+//
+// ACCEPT nick,nick adds users. A nick starting with - removes them instead.
+// ACCEPT * lists them.
+//
+// We remember users rather than nicks. If they change nick they are still on
+// the list. Once they quit, they're off it.
+func (u *LocalUser) acceptCommand(m irc.Message) {
+	// Parameters: <* or nick[,nick...]>
+	if len(m.Params) == 0 || m.Params[0] == "" {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"ACCEPT", "Not enough parameters"})
+		return
+	}
+
+	// Forget users who are gone.
+	for uid := range u.Accepts {
+		if _, exists := u.Catbox.Users[uid]; !exists {
+			delete(u.Accepts, uid)
+		}
+	}
+
+	if m.Params[0] == "*" {
+		var nicks []string
+		for uid := range u.Accepts {
+			nicks = append(nicks, u.Catbox.Users[uid].DisplayNick)
+		}
+		sort.Strings(nicks)
+		if len(nicks) > 0 {
+			// 281 RPL_ACCEPTLIST
+			u.messageFromServer("281", []string{strings.Join(nicks, " ")})
+		}
+		// 282 RPL_ENDOFACCEPT
+		u.messageFromServer("282", []string{"End of ACCEPT list"})
+		return
+	}
+
+	for _, nick := range strings.Split(m.Params[0], ",") {
+		remove := strings.HasPrefix(nick, "-")
+		nick = strings.TrimLeft(nick, "+-")
+		if nick == "" {
+			continue
+		}
+
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
+			continue
+		}
+		user := u.Catbox.Users[uid]
+		_, accepted := u.Accepts[uid]
+
+		if remove {
+			if !accepted {
+				// 458 ERR_ACCEPTNOT
+				u.messageFromServer("458", []string{user.DisplayNick,
+					"is not on your accept list"})
+				continue
+			}
+			delete(u.Accepts, uid)
+			continue
+		}
+
+		if accepted {
+			// 457 ERR_ACCEPTEXIST
+			u.messageFromServer("457", []string{user.DisplayNick,
+				"is already on your accept list"})
+			continue
+		}
+		if len(u.Accepts) >= MaxAcceptListLength {
+			// 456 ERR_ACCEPTFULL
+			u.messageFromServer("456", []string{"Accept list is full"})
+			return
+		}
+		u.Accepts[uid] = struct{}{}
+	}
+}
+
+// RELAYMSG lets a relay, such as a bridge to another chat network, send a
+// message to a channel as one of the other network's users. That way bridged
+// conversations don't all appear to come from the relay's nick.
+//
+// The nick looks like name/network. Members see the message from
+// nick!user@host with the relay's user and host. The users config says who
+// may relay.
+func (u *LocalUser) relaymsgCommand(m irc.Message) {
+	// Parameters: <channel> <nick> <text>
+	if !u.User.Relay {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{
+			"Permission Denied- You may not relay messages"})
+		return
+	}
+
+	if len(m.Params) < 3 || len(m.Params[2]) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"RELAYMSG", "Not enough parameters"})
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[0])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{channelName, "No such channel"})
+		return
+	}
+
+	// Relays must be on the channel whatever its modes.
+	if !u.User.onChannel(channel) {
+		// 404 ERR_CANNOTSENDTOCHAN
+		u.messageFromServer("404", []string{channelName, "Cannot send to channel"})
+		return
+	}
+
+	nick := m.Params[1]
+	if !isValidRelayNick(u.Catbox.Config.MaxNickLength, nick) {
+		// 432 ERR_ERRONEUSNICKNAME
+		u.messageFromServer("432", []string{nick, "Erroneous nickname"})
+		return
+	}
+
+	msg, refusedBy := channel.filterMessage(u.Catbox, m.Params[2])
+	if refusedBy != 0 {
+		// 404 ERR_CANNOTSENDTOCHAN
+		u.messageFromServer("404", []string{channelName,
+			fmt.Sprintf("Cannot send to channel (+%c)", refusedBy)})
+		return
+	}
+
+	u.LastMessageTime = u.Catbox.now()
+
+	source := channel.relaySourceFor(u.User, nick)
+
+	var recipients []*LocalClient
+	haveRemote := false
+	for memberUID := range channel.Members {
+		member := u.Catbox.Users[memberUID]
+		if member.UID == u.User.UID {
+			continue
+		}
+		if member.isLocal() {
+			recipients = append(recipients, member.LocalUser.LocalClient)
+			continue
+		}
+		haveRemote = true
+	}
+
+	u.Catbox.fanOut(recipients, irc.Message{
+		Prefix:  source,
+		Command: "PRIVMSG",
+		Params:  []string{channel.Name, msg},
 	})
+
+	// TS6 has no such command, so it goes in ENCAP. Anonymous channels are
+	// local to this server.
+	if haveRemote && !channel.isAnonymous() {
+		for _, server := range u.Catbox.LocalServers {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "RELAYMSG", channel.Name, nick, msg},
+			})
+		}
+	}
+
+	u.Catbox.logChat("PRIVMSG", source, channel.Name, msg)
+}
+
+// LUSERS tells how many users, servers, and channels there are. With a
+// server, that server answers. We don't support limiting the counts with a
+// mask.
+//
+// Parameters: [<mask> [<server or nick>]]
+func (u *LocalUser) lusersCommand(m irc.Message) {
+	if !u.huntServer("LUSERS", m, 1) {
+		return
+	}
+
+	for _, msg := range u.Catbox.createLUSERSResponse(u.User, false) {
+		u.maybeQueueMessage(msg)
+	}
 }
 
 func (u *LocalUser) motdCommand() {
+	if u.Catbox.Config.MOTD == "" {
+		// 422 ERR_NOMOTD
+		u.messageFromServer("422", []string{"MOTD File is missing"})
+		return
+	}
+
 	// 375 RPL_MOTDSTART
 	u.messageFromServer("375", []string{
-		fmt.Sprintf("- %s Message of the day - ", u.Catbox.Config.ServerName),
+		u.Catbox.userMessageText(u.User, "motd-start"),
 	})
 
-	// 372 RPL_MOTD
-	u.messageFromServer("372", []string{
-		fmt.Sprintf("- %s", u.Catbox.Config.MOTD),
-	})
+	// 372 RPL_MOTD. One per line.
+	for _, line := range strings.Split(u.Catbox.Config.MOTD, "\n") {
+		u.messageFromServer("372", []string{fmt.Sprintf("- %s", line)})
+	}
 
 	// 376 RPL_ENDOFMOTD
 	u.messageFromServer("376", []string{"End of MOTD command"})
 }
 
+// RULES shows the server's rules, from rules-file.
+func (u *LocalUser) rulesCommand() {
+	if u.Catbox.Config.Rules == "" {
+		// 434 ERR_NORULES
+		u.messageFromServer("434", []string{"RULES File is missing"})
+		return
+	}
+
+	// 308 RPL_RULESSTART
+	u.messageFromServer("308", []string{
+		fmt.Sprintf("- %s Server Rules -", u.Catbox.Config.ServerName),
+	})
+
+	// 232 RPL_RULES. One per line.
+	for _, line := range strings.Split(u.Catbox.Config.Rules, "\n") {
+		u.messageFromServer("232", []string{fmt.Sprintf("- %s", line)})
+	}
+
+	// 309 RPL_ENDOFRULES
+	u.messageFromServer("309", []string{"End of RULES command"})
+}
+
+// OPERMOTD shows operators their MOTD, from oper-motd-file. We show it when
+// they OPER too.
+func (u *LocalUser) operMOTDCommand() {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if u.Catbox.Config.OperMOTD == "" {
+		// 425 ERR_NOOPERMOTD
+		u.messageFromServer("425", []string{"OPERMOTD File is missing"})
+		return
+	}
+
+	u.sendOperMOTD()
+}
+
+// sendOperMOTD sends the operator MOTD.
+func (u *LocalUser) sendOperMOTD() {
+	// 720 RPL_OMOTDSTART
+	u.messageFromServer("720", []string{
+		fmt.Sprintf("- %s Message of the day for operators -",
+			u.Catbox.Config.ServerName),
+	})
+
+	// 721 RPL_OMOTD. One per line.
+	for _, line := range strings.Split(u.Catbox.Config.OperMOTD, "\n") {
+		u.messageFromServer("721", []string{fmt.Sprintf("- %s", line)})
+	}
+
+	// 722 RPL_ENDOFOMOTD
+	u.messageFromServer("722", []string{"End of OPERMOTD command"})
+}
+
 func (u *LocalUser) quitCommand(m irc.Message) {
 	msg := "Quit:"
 	if len(m.Params) > 0 {
@@ -1066,7 +1928,7 @@ func (u *LocalUser) quitCommand(m irc.Message) {
 }
 
 func (u *LocalUser) pingCommand(m irc.Message) {
-	// Parameters: <server> (I choose to not support forwarding)
+	// Parameters: <origin> [<server>]
 	if len(m.Params) == 0 {
 		// 409 ERR_NOORIGIN
 		u.messageFromServer("409", []string{"No origin specified"})
@@ -1088,7 +1950,35 @@ func (u *LocalUser) pingCommand(m irc.Message) {
 	//
 	// :<us> PONG <source, us> <server we are replying to, argument 0>
 
-	u.messageFromServer("PONG", []string{u.Catbox.Config.ServerName, m.Params[0]})
+	// With a server, that server answers. Some clients measure their lag to
+	// other servers this way.
+	if len(m.Params) > 1 && m.Params[1] != u.Catbox.Config.ServerName {
+		server := u.Catbox.getServerByName(m.Params[1])
+		if server == nil {
+			// 402 ERR_NOSUCHSERVER
+			u.messageFromServer("402", []string{m.Params[1], "No such server"})
+			return
+		}
+
+		// :<UID> PING <origin> <destination SID>
+		ping := irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "PING",
+			Params:  []string{u.User.DisplayNick, string(server.SID)},
+		}
+		if server.isLocal() {
+			server.LocalServer.maybeQueueMessage(ping)
+			return
+		}
+		server.ClosestServer.maybeQueueMessage(ping)
+		return
+	}
+
+	u.maybeQueuePriorityMessage(irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "PONG",
+		Params:  []string{u.Catbox.Config.ServerName, m.Params[0]},
+	})
 }
 
 func (u *LocalUser) dieCommand(m irc.Message) {
@@ -1180,6 +2070,7 @@ func (u *LocalUser) operCommand(m irc.Message) {
 
 	// Give them oper status.
 	u.User.Modes['o'] = struct{}{}
+	u.OperName = m.Params[0]
 
 	u.Catbox.Opers[u.User.UID] = u.User
 
@@ -1189,6 +2080,10 @@ func (u *LocalUser) operCommand(m irc.Message) {
 	// 381 RPL_YOUREOPER
 	u.messageFromServer("381", []string{"You are now an IRC operator"})
 
+	if u.Catbox.Config.OperMOTD != "" {
+		u.sendOperMOTD()
+	}
+
 	// Tell all servers about this mode change.
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
@@ -1200,6 +2095,9 @@ func (u *LocalUser) operCommand(m irc.Message) {
 
 	u.Catbox.noticeLocalOpers(fmt.Sprintf("%s@%s became an operator.",
 		u.User.DisplayNick, u.Catbox.Config.ServerName))
+	u.Catbox.emitEvent("oper", "nick", u.User.DisplayNick, "oper", u.OperName)
+
+	u.applyConnectsNotice()
 }
 
 // MODE command applies either to nicknames or to channels.
@@ -1252,6 +2150,8 @@ func (u *LocalUser) modeCommand(m irc.Message) {
 // Modes we support at this time:
 // +i/-i (invisible, actually doesn't change anything for this server, but)
 // +o/-o (operator)
+// +p/-p (private, hide channels in WHOIS)
+// +B/-B (bot)
 // +C/-C (must be +o to alter) (client connection notices)
 func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 	// They can only change their own mode.
@@ -1289,6 +2189,7 @@ func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 	for mode := range unsetModes {
 		if mode == 'o' {
 			delete(u.Catbox.Opers, u.User.UID)
+			u.OperName = ""
 		}
 		delete(u.User.Modes, mode)
 		unsetModeStr += string(mode)
@@ -1339,10 +2240,10 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	}
 
 	// No modes? Send back the channel's modes.
-	// Always send back +ns. That's only I support right now.
 	if len(modes) == 0 {
 		// 324 RPL_CHANNELMODEIS
-		u.messageFromServer("324", []string{channel.Name, "+ns"})
+		u.messageFromServer("324", append([]string{channel.Name},
+			channel.modesWithParams(channel.modesString())...))
 		// 329 RPL_CREATIONTIME. Not standard but oft used.
 		u.messageFromServer("329", []string{channel.Name,
 			fmt.Sprintf("%d", channel.TS)})
@@ -1357,9 +2258,23 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 		return
 	}
 
+	// Listing invite exceptions.
+	if modes == "I" || modes == "+I" {
+		for _, mask := range channel.sortedInviteExceptions() {
+			entry := channel.InviteExceptions[mask]
+			// 346 RPL_INVITELIST
+			u.messageFromServer("346", []string{channel.Name, entry.Mask,
+				entry.Setter, fmt.Sprintf("%d", entry.TS)})
+		}
+		// 347 RPL_ENDOFINVITELIST
+		u.messageFromServer("347", []string{channel.Name,
+			"End of Channel Invite List"})
+		return
+	}
+
 	// This is a channel mode change.
-	// They must be channel operator.
-	if !channel.userHasOps(u.User) {
+	// They must be channel operator, or halfop if they only voice and devoice.
+	if !channel.canChangeModes(u.User, modes) {
 		// 482 ERR_CHANOPRIVSNEEDED
 		u.messageFromServer("482", []string{channel.Name,
 			"You're not channel operator"})
@@ -1369,6 +2284,11 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	// Apply mode changes we support.
 	// Currently I support:
 	// - +o/-o
+	// - +h/-h
+	// - +v/-v
+	// - The simple modes (see simpleChannelModes)
+	// - The local modes (see localChannelModes), if enabled
+	// - +I/-I
 	// Also generate the information we need to send to our local users and to
 	// servers.
 
@@ -1379,15 +2299,8 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	// We support only a limited number per command.
 	modesApplied := 0
 
-	// Track the mode string of the modes we actually apply.
-	appliedModes := ""
-
-	// Track the current action in our applied modes string.
-	appliedModesAction := ' '
-
-	// Track the parameters of the modes we actually apply.
-	appliedParamsUser := []string{}
-	appliedParamsServer := []string{}
+	// Track the modes we actually apply.
+	var applied []modeChange
 
 	// Track what parameter we're on (of those presented).
 	// i.e., if we had "+oo u1 u2", then we start out at index 0 pointing
@@ -1404,11 +2317,74 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 			continue
 		}
 
-		if char != 'o' {
+		// Simple modes such as +n/-n. Local modes such as +a/-a work the same,
+		// though only if the config enables them.
+		if isSimpleChannelMode(byte(char)) ||
+			(isLocalChannelMode(byte(char)) && u.Catbox.Config.AnonymousChannels) {
+			if channel.isModeLocked(byte(char)) {
+				// 742 ERR_MLOCKRESTRICTED
+				u.messageFromServer("742", []string{channel.Name, string(char),
+					channel.ModeLock,
+					"MODE cannot be set due to channel having an active MLOCK restriction policy"})
+				continue
+			}
+
+			if !channel.applySimpleMode(action, byte(char)) {
+				continue
+			}
+
+			applied = append(applied, modeChange{action: action, mode: char})
+			modesApplied++
 			continue
 		}
 
-		// +o/-o
+		// +I/-I
+		if char == 'I' {
+			// Must have a parameter. A mask.
+			if paramIndex >= len(params) {
+				break
+			}
+
+			// Consume the parameter.
+			mask := canonicalizeChannelMask(params[paramIndex])
+			paramIndex++
+			if mask == "" {
+				continue
+			}
+
+			if action == '+' {
+				if _, exists := channel.InviteExceptions[mask]; exists {
+					continue
+				}
+				if len(channel.InviteExceptions) >= MaxChannelListEntries {
+					// 478 ERR_BANLISTFULL
+					u.messageFromServer("478", []string{channel.Name, mask,
+						"Channel invite exception list is full"})
+					continue
+				}
+				channel.addInviteException(mask, u.User.nickUhost(),
+					u.Catbox.now().Unix())
+			} else {
+				if !channel.removeInviteException(mask) {
+					continue
+				}
+			}
+
+			applied = append(applied, modeChange{
+				action:      action,
+				mode:        char,
+				userParam:   mask,
+				serverParam: mask,
+			})
+			modesApplied++
+			continue
+		}
+
+		if char != 'o' && char != 'h' && char != 'v' {
+			continue
+		}
+
+		// +o/-o, +h/-h and +v/-v
 
 		// Must have a parameter. A nick.
 		if paramIndex >= len(params) {
@@ -1432,27 +2408,16 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 
 		// Looks okay to do this.
 
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				break
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				break
-			}
-			channel.removeOps(targetUser)
-		}
-
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
+		if !channel.applyStatusMode(action, char, targetUser) {
+			break
 		}
 
-		appliedModes += string(char)
-		appliedParamsUser = append(appliedParamsUser, targetUser.DisplayNick)
-		appliedParamsServer = append(appliedParamsServer, string(targetUser.UID))
-
+		applied = append(applied, modeChange{
+			action:      action,
+			mode:        char,
+			userParam:   targetUser.DisplayNick,
+			serverParam: string(targetUser.UID),
+		})
 		modesApplied++
 	}
 
@@ -1463,8 +2428,9 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 
 	// Tell all local users in the channel about the mode changes.
 
+	appliedModes, appliedParams := formatModeChanges(applied, false)
 	userModeParams := []string{channel.Name, appliedModes}
-	userModeParams = append(userModeParams, appliedParamsUser...)
+	userModeParams = append(userModeParams, appliedParams...)
 
 	for memberUID := range channel.Members {
 		member := u.Catbox.Users[memberUID]
@@ -1474,22 +2440,27 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 		}
 
 		member.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  u.User.nickUhost(),
+			Prefix:  channel.sourceFor(u.User),
 			Command: "MODE",
 			Params:  userModeParams,
 		})
 	}
 
 	// Propagate mode changes everywhere.
+	for _, ls := range u.Catbox.LocalServers {
+		serverChanges := modeChangesForServer(applied, ls.Server)
+		if len(serverChanges) == 0 {
+			continue
+		}
 
-	serverModeParams := []string{
-		fmt.Sprintf("%d", channel.TS),
-		channel.Name,
-		appliedModes,
-	}
-	serverModeParams = append(serverModeParams, appliedParamsServer...)
+		appliedModes, appliedParams := formatModeChanges(serverChanges, true)
+		serverModeParams := []string{
+			fmt.Sprintf("%d", channel.TS),
+			channel.Name,
+			appliedModes,
+		}
+		serverModeParams = append(serverModeParams, appliedParams...)
 
-	for _, ls := range u.Catbox.LocalServers {
 		ls.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
 			Command: "TMODE",
@@ -1533,6 +2504,11 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 	for memberUID := range channel.Members {
 		member := u.Catbox.Users[memberUID]
 
+		// In anonymous channels they see only themself.
+		if channel.isAnonymous() && member != u.User {
+			continue
+		}
+
 		// 352 RPL_WHOREPLY
 		// "<channel> <user> <host> <server> <nick>
 		// ( "H" / "G" > ["*"] [ ( "@" / "+" ) ]
@@ -1550,8 +2526,10 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 			mode += "*"
 		}
 
-		if channel.userHasOps(member) {
-			mode += "@"
+		mode += channel.memberPrefix(member)
+
+		if member.isBot() {
+			mode += "B"
 		}
 
 		serverName := u.Catbox.Config.ServerName
@@ -1603,6 +2581,10 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 			mode += "*"
 		}
 
+		if user.isBot() {
+			mode += "B"
+		}
+
 		serverName := u.Catbox.Config.ServerName
 		if user.isRemote() {
 			serverName = user.Server.Name
@@ -1621,7 +2603,7 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 	}
 
 	// 315 RPL_ENDOFWHO
-	u.messageFromServer("315", []string{"*", "End of WHO list"})
+	u.messageFromServer("315", []string{"*", "End of /WHO list"})
 
 	u.Catbox.noticeOpers(fmt.Sprintf("%s used OPERSPY WHO !*",
 		u.User.DisplayNick))
@@ -1676,11 +2658,18 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 
 	// TODO: When we support channel mode +t we will need additional logic.
 
+	if channel.TopicLocked {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"The topic is locked by services"})
+		return
+	}
+
 	// Set new topic.
 
 	channel.Topic = topic
-	channel.TopicTS = time.Now().Unix()
-	channel.TopicSetter = u.User.nickUhost()
+	channel.TopicTS = u.Catbox.now().Unix()
+	channel.TopicSetter = channel.sourceFor(u.User)
 
 	// Tell all members of the channel, including the client.
 	// Only local clients. We tell remote users by telling all servers.
@@ -1690,7 +2679,11 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 			continue
 		}
 
-		u.messageUser(member, "TOPIC", []string{channel.Name, channel.Topic})
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  channel.sourceFor(u.User),
+			Command: "TOPIC",
+			Params:  []string{channel.Name, channel.Topic},
+		})
 	}
 
 	// Topic appears to propagate globally no matter what.
@@ -1722,6 +2715,11 @@ func (u *LocalUser) connectCommand(m irc.Message) {
 
 	serverName := m.Params[0]
 
+	if u.Catbox.Config.Standalone {
+		u.serverNotice("This server does not link with other servers.")
+		return
+	}
+
 	// Is it a server we know about?
 	linkInfo, exists := u.Catbox.Config.Servers[serverName]
 	if !exists {
@@ -1737,6 +2735,12 @@ func (u *LocalUser) connectCommand(m irc.Message) {
 		return
 	}
 
+	// Connecting by hand overrides stopping automatic connections because the
+	// link was flapping.
+	if status, exists := u.Catbox.LinkStatuses[serverName]; exists {
+		status.SuspendedUntil = time.Time{}
+	}
+
 	// We could check if we're already trying to link to it. But the result should
 	// be the same.
 	u.Catbox.connectToServer(linkInfo)
@@ -1830,6 +2834,13 @@ func (u *LocalUser) killCommand(m irc.Message) {
 	}
 	targetUser := u.Catbox.Users[targetUID]
 
+	if targetUser.isRemote() && !u.hasPrivilege("remote-kill") {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{
+			"Permission Denied- You need the remote-kill privilege"})
+		return
+	}
+
 	reason := ""
 	if len(m.Params) >= 2 && len(m.Params[1]) > 0 {
 		reason = m.Params[1]
@@ -1837,16 +2848,157 @@ func (u *LocalUser) killCommand(m irc.Message) {
 		reason = "<No reason given>"
 	}
 
-	u.Catbox.issueKill(u.User, targetUser, reason)
+	u.Catbox.emitEvent("kill", "oper", u.User.DisplayNick, "nick",
+		targetUser.DisplayNick, "reason", reason)
+	u.Catbox.issueKill(u.User, targetUser, reason)
+}
+
+// MassKillPreviewTimeout is how long after previewing a MASSKILL an operator
+// has to confirm it.
+const MassKillPreviewTimeout = 5 * time.Minute
+
+// massKillListLimit is how many matching nicks we show in a MASSKILL preview.
+const massKillListLimit = 10
+
+// Disconnect all local users matching a mask. This is for cleaning up floods
+// of bots.
+//
+// The host part of the mask may be a CIDR, which we match against users' IPs.
+// We never match operators.
+//
+// Without CONFIRM we only tell the oper who matches. They must do this before
+// they may give CONFIRM with the same mask.
+func (u *LocalUser) massKillCommand(m irc.Message) {
+	// Parameters: [CONFIRM] <user@host or user@CIDR> [reason]
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	params := m.Params
+
+	confirm := false
+	if len(params) > 0 && strings.EqualFold(params[0], "CONFIRM") {
+		confirm = true
+		params = params[1:]
+	}
+	if len(params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"MASSKILL", "Not enough parameters"})
+		return
+	}
+
+	mask := params[0]
+	userMask, hostMask, cidr, ok := parseMassKillMask(mask)
+	if !ok {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{mask, "Bad Server/host mask"})
+		return
+	}
+
+	reason := "<No reason given>"
+	if len(params) >= 2 && len(params[1]) > 0 {
+		reason = params[1]
+	}
+
+	if !confirm {
+		matches := u.Catbox.massKillMatches(userMask, hostMask, cidr)
+
+		var nicks []string
+		var uids []TS6UID
+		for _, lu := range matches {
+			nicks = append(nicks, lu.User.DisplayNick)
+			uids = append(uids, lu.User.UID)
+		}
+		sort.Strings(nicks)
+		if len(nicks) > massKillListLimit {
+			nicks = append(nicks[:massKillListLimit], "...")
+		}
+
+		u.serverNotice(fmt.Sprintf("MASSKILL for [%s] matches %d local users: %s",
+			mask, len(matches), strings.Join(nicks, " ")))
+		u.serverNotice(fmt.Sprintf(
+			"Use MASSKILL CONFIRM %s <reason> within %s to disconnect them", mask,
+			MassKillPreviewTimeout))
+		log.Printf("%s previewed MASSKILL for [%s]: %d matches", u.User.nickUhost(),
+			mask, len(matches))
+
+		u.MassKillMask = mask
+		u.MassKillPreviewTime = u.Catbox.now()
+		u.MassKillUIDs = uids
+		return
+	}
+
+	if u.MassKillMask != mask ||
+		u.Catbox.now().Sub(u.MassKillPreviewTime) > MassKillPreviewTimeout {
+		u.serverNotice(fmt.Sprintf(
+			"Preview MASSKILL for [%s] with MASSKILL %s before confirming it", mask,
+			mask))
+		return
+	}
+	uids := u.MassKillUIDs
+	u.MassKillMask = ""
+	u.MassKillUIDs = nil
+
+	// Those the preview showed who are still here. Anyone matching who came
+	// since needs another preview.
+	var matches []*LocalUser
+	for _, uid := range uids {
+		user, exists := u.Catbox.Users[uid]
+		if exists && user.isLocal() {
+			matches = append(matches, user.LocalUser)
+		}
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf(
+		"%s is using MASSKILL for [%s] on %d local users (%s)",
+		u.User.DisplayNick, mask, len(matches), reason))
+	u.Catbox.emitEvent("masskill", "oper", u.User.DisplayNick, "mask", mask,
+		"count", fmt.Sprintf("%d", len(matches)), "reason", reason)
+
+	for _, lu := range matches {
+		u.Catbox.issueKill(u.User, lu.User, reason)
+	}
+
+	u.serverNotice(fmt.Sprintf("MASSKILL for [%s] disconnected %d local users",
+		mask, len(matches)))
+}
+
+// parseMassKillMask splits a MASSKILL mask into its user mask and its host mask
+// or CIDR.
+func parseMassKillMask(mask string) (string, string, *net.IPNet, bool) {
+	pieces := strings.Split(mask, "@")
+	if len(pieces) != 2 || !isValidUserMask(pieces[0]) {
+		return "", "", nil, false
+	}
+
+	if strings.Contains(pieces[1], "/") {
+		_, cidr, err := net.ParseCIDR(pieces[1])
+		if err != nil {
+			return "", "", nil, false
+		}
+		return pieces[0], "", cidr, true
+	}
+
+	if !isValidHostMask(pieces[1]) {
+		return "", "", nil, false
+	}
+	return pieces[0], pieces[1], nil, true
 }
 
 // Apply a KLine (user ban) locally and cut off any users matching it.
 //
-// Propagate it to all servers.
+// Propagate it to all servers. With ON <server mask>, only the servers matching
+// the mask apply it.
+//
+// A duration in minutes makes it temporary. Without one, or with 0, it is
+// permanent (for the runtime).
 //
-// At this time we support only permanent (locally anyway) klines.
+// We tell the oper how many users it matches before we apply it. If that is
+// more than the configured threshold, they must give FORCE.
 func (u *LocalUser) klineCommand(m irc.Message) {
-	// Parameters: [duration] <user@host> <reason>
+	// Parameters: [FORCE] [duration] <user@host> [ON <server mask>] <reason>
 	if len(m.Params) < 2 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
@@ -1859,28 +3011,39 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 		return
 	}
 
-	duration := "0"
-	uhost := ""
-	reason := ""
+	params := m.Params
+
+	force := false
+	if strings.EqualFold(params[0], "FORCE") {
+		force = true
+		params = params[1:]
+	}
+	if len(params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
+		return
+	}
 
-	match, err := regexp.MatchString("^[0-9]+$", m.Params[0])
+	var duration time.Duration
+	match, err := regexp.MatchString("^[0-9]+$", params[0])
 	if err != nil {
 		log.Fatalf("KLine duration regex: %s", err)
 	}
 	if match {
-		duration = m.Params[0]
-
-		if len(m.Params) < 3 {
-			// 461 ERR_NEEDMOREPARAMS
-			u.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
+		minutes, err := strconv.ParseInt(params[0], 10, 32)
+		if err != nil {
+			u.messageFromServer("NOTICE", []string{"Invalid K-Line duration"})
 			return
 		}
+		duration = time.Duration(minutes) * time.Minute
+		params = params[1:]
+	}
 
-		uhost = m.Params[1]
-		reason = m.Params[2]
-	} else {
-		uhost = m.Params[0]
-		reason = m.Params[1]
+	uhost, serverMask, reason, ok := parseBanTarget(params)
+	if !ok || len(reason) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
+		return
 	}
 
 	pieces := strings.Split(uhost, "@")
@@ -1905,9 +3068,24 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 		HostMask: hostMask,
 		Reason:   reason,
 	}
+	if duration > 0 {
+		kline.Expires = u.Catbox.now().Add(duration)
+	}
+
+	localMatches, globalMatches := u.Catbox.countKLineMatches(userMask, hostMask)
+	threshold := u.Catbox.Config.KLineForceThreshold
+	if threshold > 0 && globalMatches > threshold && !force {
+		u.serverNotice(fmt.Sprintf(
+			"K-Line for [%s@%s] matches %d users, more than %d. Use KLINE FORCE to set it anyway.",
+			userMask, hostMask, globalMatches, threshold))
+		return
+	}
+	u.serverNotice(fmt.Sprintf(
+		"K-Line for [%s@%s] matches %d local and %d global users", userMask,
+		hostMask, localMatches, globalMatches))
 
 	// Propagate.
-	// In TS6 this must be in ENCAP.
+	// In TS6 this must be in ENCAP. The duration is in seconds.
 	// Do this before applying K-Line locally for the hopefully rare scenario
 	// that the user K-Lines himself.
 	for _, server := range u.Catbox.LocalServers {
@@ -1915,9 +3093,9 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 			Prefix:  string(u.User.UID),
 			Command: "ENCAP",
 			Params: []string{
-				"*",
+				serverMask,
 				"KLINE",
-				duration,
+				fmt.Sprintf("%d", int64(duration.Seconds())),
 				userMask,
 				hostMask,
 				reason,
@@ -1925,11 +3103,56 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 		})
 	}
 
+	u.Catbox.emitEvent("kline", "oper", u.User.DisplayNick, "mask",
+		userMask+"@"+hostMask, "servers", serverMask, "duration",
+		fmt.Sprintf("%d", int64(duration.Seconds())), "reason", reason)
+
+	if !u.Catbox.isServerTarget(serverMask) {
+		return
+	}
+
 	u.Catbox.addAndApplyKLine(kline, u.User.DisplayNick, reason)
+
+	// We may have cut ourself off.
+	if _, exists := u.Catbox.LocalUsers[u.ID]; !exists {
+		return
+	}
+	localAfter, _ := u.Catbox.countKLineMatches(userMask, hostMask)
+	u.serverNotice(fmt.Sprintf("K-Line for [%s@%s] disconnected %d local users",
+		userMask, hostMask, localMatches-localAfter))
+}
+
+// parseBanTarget parses the end of a KLINE or UNKLINE command:
+// <user@host> [ON <server mask>] [reason]
+//
+// The server mask is * if there is no ON.
+func parseBanTarget(params []string) (string, string, string, bool) {
+	if len(params) == 0 {
+		return "", "", "", false
+	}
+
+	uhost := params[0]
+	params = params[1:]
+
+	serverMask := "*"
+	if len(params) > 0 && strings.EqualFold(params[0], "ON") {
+		if len(params) < 2 {
+			return "", "", "", false
+		}
+		serverMask = params[1]
+		params = params[2:]
+	}
+
+	reason := ""
+	if len(params) > 0 {
+		reason = params[0]
+	}
+
+	return uhost, serverMask, reason, true
 }
 
 func (u *LocalUser) unklineCommand(m irc.Message) {
-	// Parameters: <usermask@hostmask>
+	// Parameters: <usermask@hostmask> [ON <server mask>]
 	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{"UNKLINE", "Not enough parameters"})
@@ -1942,16 +3165,28 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 		return
 	}
 
-	pieces := strings.Split(m.Params[0], "@")
+	uhost, serverMask, _, ok := parseBanTarget(m.Params)
+	if !ok {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"UNKLINE", "Not enough parameters"})
+		return
+	}
+
+	pieces := strings.Split(uhost, "@")
 	if len(pieces) != 2 {
 		// 415 ERR_BADMASK
-		u.messageFromServer("415", []string{m.Params[0], "Bad Server/host mask"})
+		u.messageFromServer("415", []string{uhost, "Bad Server/host mask"})
 		return
 	}
 	userMask := pieces[0]
 	hostMask := pieces[1]
 
-	u.Catbox.removeKLine(userMask, hostMask, u.User.DisplayNick)
+	if u.Catbox.isServerTarget(serverMask) {
+		u.Catbox.removeKLine(userMask, hostMask, u.User.DisplayNick)
+	}
+
+	u.Catbox.emitEvent("unkline", "oper", u.User.DisplayNick, "mask", uhost,
+		"servers", serverMask)
 
 	// Propagate.
 	for _, server := range u.Catbox.LocalServers {
@@ -1959,7 +3194,7 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 			Prefix:  string(u.User.UID),
 			Command: "ENCAP",
 			Params: []string{
-				"*",
+				serverMask,
 				"UNKLINE",
 				userMask,
 				hostMask,
@@ -1970,6 +3205,7 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 
 // I support the following queries right now:
 // k/K - Show K-Lines
+// z/Z - Show memory usage
 // I do not support remote STATS yet.
 func (u *LocalUser) statsCommand(m irc.Message) {
 	if len(m.Params) == 0 {
@@ -1979,7 +3215,8 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	}
 
 	query := m.Params[0]
-	if query != "k" && query != "K" {
+	if query != "c" && query != "C" && query != "h" && query != "H" &&
+		query != "k" && query != "K" && query != "z" && query != "Z" {
 		u.messageFromServer("NOTICE", []string{"Unknown stats query"})
 		return
 	}
@@ -1990,6 +3227,30 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 		return
 	}
 
+	if query == "c" || query == "C" {
+		u.statsLinks()
+		// 219 RPL_ENDOFSTATS
+		u.messageFromServer("219", []string{"C", "End of /STATS report"})
+		return
+	}
+
+	if query == "h" || query == "H" {
+		for _, line := range u.Catbox.historyLines(historyStatsSamples) {
+			// 249 RPL_STATSDEBUG
+			u.messageFromServer("249", []string{"h", line})
+		}
+		// 219 RPL_ENDOFSTATS
+		u.messageFromServer("219", []string{"H", "End of /STATS report"})
+		return
+	}
+
+	if query == "z" || query == "Z" {
+		u.statsMemory()
+		// 219 RPL_ENDOFSTATS
+		u.messageFromServer("219", []string{"Z", "End of /STATS report"})
+		return
+	}
+
 	// We could sort the KLines.
 
 	for _, kline := range u.Catbox.KLines {
@@ -2000,12 +3261,17 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 		// ircd-ratbox says:
 		// K <host> * <username> <reason>
 		// I use ratbox's.
+		reason := kline.Reason
+		if !kline.Expires.IsZero() {
+			reason = fmt.Sprintf("%s (expires in %s)", reason,
+				kline.Expires.Sub(u.Catbox.now()).Round(time.Second))
+		}
 		u.messageFromServer("216", []string{
 			"K",
 			kline.HostMask,
 			"*",
 			kline.UserMask,
-			kline.Reason,
+			reason,
 		})
 	}
 
@@ -2013,6 +3279,292 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	u.messageFromServer("219", []string{"K", "End of /STATS report"})
 }
 
+// Report the servers we connect to and how our last attempt to connect to
+// each went.
+func (u *LocalUser) statsLinks() {
+	var names []string
+	for name := range u.Catbox.Config.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == u.Catbox.Config.ServerName {
+			continue
+		}
+		linkInfo := u.Catbox.Config.Servers[name]
+
+		// We connect to every server in the config, so all get A (autoconnect).
+		// S means TLS.
+		flags := "A"
+		if linkInfo.TLS {
+			flags += "S"
+		}
+
+		port := strconv.Itoa(linkInfo.Port)
+		if linkInfo.SRV {
+			port = "srv"
+		}
+
+		status := "never tried"
+		if u.Catbox.isLinkedToServer(name) {
+			status = "linked"
+		} else if u.Catbox.isLinkSuspended(name) {
+			status = fmt.Sprintf("flapping, not connecting for %s",
+				u.Catbox.LinkStatuses[name].SuspendedUntil.Sub(
+					u.Catbox.now()).Round(time.Second))
+		} else if s, exists := u.Catbox.LinkStatuses[name]; exists &&
+			!s.LastAttempt.IsZero() {
+			status = fmt.Sprintf("last tried %s ago",
+				u.Catbox.now().Sub(s.LastAttempt).Round(time.Second))
+			if s.LastFailure != "" {
+				status += ": " + s.LastFailure
+			}
+		}
+
+		// 213 RPL_STATSCLINE
+		// ircd-ratbox says:
+		// C <host> <flags> <name> <port> <class>
+		// We have no classes. We add how linking is going.
+		u.messageFromServer("213", []string{
+			"C",
+			"*@" + linkInfo.Hostname,
+			flags,
+			name,
+			port,
+			"default",
+			status,
+		})
+	}
+}
+
+// Report counts of what we track along with memory usage. This is to help
+// see how much memory each user costs. We also report on the event queue.
+func (u *LocalUser) statsMemory() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	channelMembers := 0
+	for _, channel := range u.Catbox.Channels {
+		channelMembers += len(channel.Members)
+	}
+
+	lines := []string{
+		fmt.Sprintf("Users %d (%d local) Servers %d Channels %d (%d memberships)",
+			len(u.Catbox.Users), len(u.Catbox.LocalUsers), len(u.Catbox.Servers),
+			len(u.Catbox.Channels), channelMembers),
+		fmt.Sprintf("Nicks %d K-Lines %d Opers %d", len(u.Catbox.Nicks),
+			len(u.Catbox.KLines), len(u.Catbox.Opers)),
+		fmt.Sprintf("Interned strings %d (%d bytes, %d references)",
+			len(u.Catbox.Strings.strings), u.Catbox.Strings.bytes,
+			u.Catbox.Strings.refs()),
+		fmt.Sprintf("Heap in use %d bytes, %d objects. System %d bytes",
+			mem.HeapInuse, mem.HeapObjects, mem.Sys),
+	}
+
+	if len(u.Catbox.Users) > 0 {
+		lines = append(lines, fmt.Sprintf("Heap in use per user %d bytes",
+			mem.HeapInuse/uint64(len(u.Catbox.Users))))
+	}
+
+	lines = append(lines, u.Catbox.eventQueueReport()...)
+	lines = append(lines, u.Catbox.clientIDReport()...)
+
+	lines = append(lines, fmt.Sprintf("Log messages caused by clients left out %d",
+		u.Catbox.LogLimiter.totalSuppressed()))
+
+	for _, line := range lines {
+		// 249 RPL_STATSDEBUG
+		u.messageFromServer("249", []string{"z", line})
+	}
+}
+
+// SET changes settings while we run. DEBUG turns verbose logging for a
+// subsystem on or off. Without a subsystem, it shows which are on. NOTICES
+// chooses which notices the operator gets. See notices.go.
+//
+// Parameters: DEBUG|NOTICES [<subsystem or category> <ON|OFF>]
+func (u *LocalUser) setCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) > 0 && strings.ToUpper(m.Params[0]) == "NOTICES" {
+		u.setNotices(m)
+		return
+	}
+
+	if len(m.Params) == 0 || strings.ToUpper(m.Params[0]) != "DEBUG" {
+		u.serverNotice("Usage: SET DEBUG|NOTICES [<name> <ON|OFF>]")
+		return
+	}
+
+	var subsystems []string
+	for subsystem := range debugSubsystems {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Strings(subsystems)
+
+	if len(m.Params) == 1 {
+		for _, subsystem := range subsystems {
+			state := "off"
+			if u.Catbox.Debug.enabled(subsystem) {
+				state = "on"
+			}
+			u.serverNotice(fmt.Sprintf("Debug logging for %s (%s) is %s", subsystem,
+				debugSubsystems[subsystem], state))
+		}
+		return
+	}
+
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"SET", "Not enough parameters"})
+		return
+	}
+
+	subsystem := strings.ToLower(m.Params[1])
+	if _, exists := debugSubsystems[subsystem]; !exists {
+		u.serverNotice(fmt.Sprintf("Unknown subsystem %s. Subsystems: %s",
+			m.Params[1], strings.Join(subsystems, ", ")))
+		return
+	}
+
+	var on bool
+	switch strings.ToUpper(m.Params[2]) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		u.serverNotice("Usage: SET DEBUG [<subsystem> <ON|OFF>]")
+		return
+	}
+
+	u.Catbox.Debug.set(subsystem, on)
+
+	state := "off"
+	if on {
+		state = "on"
+	}
+	u.Catbox.noticeLocalOpers(fmt.Sprintf("%s turned debug logging for %s %s",
+		u.User.DisplayNick, subsystem, state))
+}
+
+// lagLine describes how long the client took to answer our last PING, for
+// CHECK.
+func lagLine(c *LocalClient) string {
+	pending := ""
+	if c.PingPending {
+		pending = ", waiting for PONG"
+	}
+	return fmt.Sprintf("Lag %s%s", c.Lag.Round(time.Millisecond), pending)
+}
+
+// CHECK is a non standard command. It shows an operator the state of a local
+// user's or server's queues. This is to help figure out why a client is
+// lagging.
+//
+// Parameters: <nick or server name>
+func (u *LocalUser) checkCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"CHECK", "Not enough parameters"})
+		return
+	}
+
+	target := m.Params[0]
+	now := u.Catbox.now()
+	ago := func(t time.Time) string {
+		return now.Sub(t).Round(time.Second).String()
+	}
+
+	var client *LocalClient
+	var lines []string
+
+	if uid, exists := u.Catbox.Nicks[canonicalizeNick(target)]; exists {
+		user := u.Catbox.Users[uid]
+		if !user.isLocal() {
+			u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+				fmt.Sprintf("%s is not on this server", user.DisplayNick)})
+			return
+		}
+
+		lu := user.LocalUser
+		client = lu.LocalClient
+		target = user.DisplayNick
+
+		floodTokens := fmt.Sprintf("%d/%d", lu.MessageCounter, UserMessageLimit)
+		if user.isFloodExempt() {
+			floodTokens = "exempt"
+		}
+
+		lines = append(lines,
+			fmt.Sprintf("RecvQ %d messages held by flood control, %d deferred",
+				len(lu.MessageQueue), u.Catbox.deferredClients[lu.ID]),
+			fmt.Sprintf("Flood tokens %s", floodTokens),
+			fmt.Sprintf("Last activity %s ago, last message %s ago, last PING %s ago",
+				ago(lu.LastActivityTime), ago(lu.LastMessageTime),
+				ago(lu.LastPingTime)),
+			lagLine(lu.LocalClient),
+		)
+	} else {
+		for _, ls := range u.Catbox.LocalServers {
+			if strings.EqualFold(ls.Server.Name, target) {
+				client = ls.LocalClient
+				target = ls.Server.Name
+
+				lines = append(lines,
+					fmt.Sprintf("Bursting %v", ls.Bursting),
+					fmt.Sprintf("Last activity %s ago, last PING %s ago",
+						ago(ls.LastActivityTime), ago(ls.LastPingTime)),
+					lagLine(ls.LocalClient),
+				)
+				break
+			}
+		}
+	}
+
+	if client == nil {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{target, "No such nick/channel"})
+		return
+	}
+
+	sendQ := fmt.Sprintf("SendQ %d bytes in %d/%d messages, %d priority",
+		atomic.LoadInt64(&client.SendQueueBytes), len(client.WriteChan),
+		cap(client.WriteChan), len(client.PriorityWriteChan))
+	if client.sendQueueExceeded() {
+		sendQ += " (exceeded)"
+	}
+
+	from := client.ip().String()
+	if u.Catbox.Config.PrivacyProfile == PrivacyProfileAnonymous &&
+		!u.hasPrivilege("admin") {
+		from = "a hidden address"
+	}
+
+	lines = append([]string{
+		fmt.Sprintf("Connected %s ago from %s", ago(client.ConnectionStartTime),
+			from),
+		sendQ,
+	}, lines...)
+
+	for _, line := range lines {
+		u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+			fmt.Sprintf("CHECK %s: %s", target, line)})
+	}
+	u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+		fmt.Sprintf("End of CHECK %s", target)})
+}
+
 // Reload config.
 // No parameters.
 func (u *LocalUser) rehashCommand(m irc.Message) {
@@ -2022,6 +3574,9 @@ func (u *LocalUser) rehashCommand(m irc.Message) {
 		return
 	}
 
+	// 382 RPL_REHASHING
+	u.messageFromServer("382", []string{u.Catbox.ConfigFile, "Rehashing"})
+
 	u.Catbox.rehash(u.User)
 }
 
@@ -2054,14 +3609,14 @@ func (u *LocalUser) mapCommand(m irc.Message) {
 	for _, ls := range u.Catbox.LocalServers {
 		// The local server.
 		lines = append(lines, serverToMapLine(ls.Server.Name, ls.Server.SID,
-			ls.Server.getLocalUserCount(u.Catbox.Users), globalUserCount,
+			ls.Server.UserCount, globalUserCount,
 			ls.Server.HopCount))
 
 		// And all servers it is linked to.
 		linkedServers := ls.Server.getLinkedServers(u.Catbox.Servers)
 		for _, s := range linkedServers {
 			lines = append(lines, serverToMapLine(s.Name, s.SID,
-				s.getLocalUserCount(u.Catbox.Users), globalUserCount, s.HopCount))
+				s.UserCount, globalUserCount, s.HopCount))
 		}
 	}
 
@@ -2109,19 +3664,72 @@ func (u *LocalUser) versionCommand(m irc.Message) {
 	})
 }
 
-// Send back current time.
-// No parameter supported.
+// Send back a server's current time. Without a parameter, it's ours.
+//
+// Parameters: [<server or nick>]
 func (u *LocalUser) timeCommand(m irc.Message) {
-	// 391 RPL_TIME
-	u.maybeQueueMessage(irc.Message{
-		Prefix:  u.Catbox.Config.ServerName,
-		Command: "391",
-		Params: []string{
-			u.User.DisplayNick,
-			u.Catbox.Config.ServerName,
-			time.Now().Format(time.RFC1123),
-		},
-	})
+	if !u.huntServer("TIME", m, 0) {
+		return
+	}
+
+	u.maybeQueueMessage(u.Catbox.createTIMEResponse(u.User, false))
+}
+
+// huntServer works out which server a command such as ADMIN is for. The
+// server is the parameter at index param, given by name or by the nick of a
+// user on it. A blank target means us. If it's for us, we return true. If it's
+// for another server, we ask that server to answer for itself. If there's no
+// such server, we tell the user.
+//
+// We pass commands on with the parameters up to the server, and the server as
+// a SID, e.g. :<UID> <command> <SID>.
+func (u *LocalUser) huntServer(command string, m irc.Message, param int) bool {
+	if len(m.Params) <= param || m.Params[param] == "" ||
+		m.Params[param] == u.Catbox.Config.ServerName {
+		return true
+	}
+	target := m.Params[param]
+
+	server := u.Catbox.getServerByName(target)
+	if server == nil {
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(target)]
+		if !exists {
+			// 402 ERR_NOSUCHSERVER
+			u.messageFromServer("402", []string{target, "No such server"})
+			return false
+		}
+		// A local user has no Server. They're on ours.
+		server = u.Catbox.Users[uid].Server
+		if server == nil {
+			return true
+		}
+	}
+
+	params := append([]string{}, m.Params[:param]...)
+	msg := irc.Message{
+		Prefix:  string(u.User.UID),
+		Command: command,
+		Params:  append(params, string(server.SID)),
+	}
+	if server.isLocal() {
+		server.LocalServer.maybeQueueMessage(msg)
+		return false
+	}
+	server.ClosestServer.maybeQueueMessage(msg)
+	return false
+}
+
+// ADMIN tells who runs a server. Without a parameter, it's us.
+//
+// Parameters: [<server or nick>]
+func (u *LocalUser) adminCommand(m irc.Message) {
+	if !u.huntServer("ADMIN", m, 0) {
+		return
+	}
+
+	for _, msg := range u.Catbox.createADMINResponse(u.User, false) {
+		u.maybeQueueMessage(msg)
+	}
 }
 
 // WHOWAS is to look up previously used nick information.
@@ -2150,6 +3758,29 @@ func (u *LocalUser) whowasCommand(m irc.Message) {
 	})
 }
 
+// Tell the user whether they're away. We do this when it changes.
+func (u *LocalUser) sendAwayStatus() {
+	if u.User.AwayMessage != "" {
+		// 306 RPL_NOWAWAY
+		u.maybeQueueMessage(irc.Message{
+			Prefix:  u.Catbox.Config.ServerName,
+			Command: "306",
+			Params:  []string{u.User.DisplayNick, "You have been marked as away"},
+		})
+		return
+	}
+
+	// 305 RPL_UNAWAY
+	u.maybeQueueMessage(irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "305",
+		Params: []string{
+			u.User.DisplayNick,
+			"You are no longer been marked as being away",
+		},
+	})
+}
+
 // Set yourself away by including a message.
 // Set yourself not away by not including a message, or having a blank message.
 // Parameters: [message]
@@ -2164,11 +3795,23 @@ func (u *LocalUser) awayCommand(m irc.Message) {
 
 // Invite a user to a channel.
 // Parameters: <nick> <channel>
+// Without parameters, we list the channels they're invited to.
 // You must be on the channel.
 // If the channel is +i, you must have ops. Actually when we have ops, it is
 // probably better to always require ops to invite.
 // If the nick is on the channel, error.
 func (u *LocalUser) inviteCommand(m irc.Message) {
+	// Without parameters, list the channels they're invited to.
+	if len(m.Params) == 0 {
+		for _, channelName := range u.sortedInvites() {
+			// 336 RPL_INVITELIST
+			u.messageFromServer("336", []string{channelName})
+		}
+		// 337 RPL_ENDOFINVITELIST
+		u.messageFromServer("337", []string{"End of /INVITE list"})
+		return
+	}
+
 	if len(m.Params) < 2 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{"INVITE", "Not enough parameters"})
@@ -2219,8 +3862,8 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 
 	// We may try to invite.
 
-	// They must have ops to do this.
-	if !channel.userHasOps(u.User) {
+	// They must have ops or halfops to do this.
+	if !channel.userHasHalfopsOrOps(u.User) {
 		// 482 ERR_CHANOPRIVSNEEDED
 		u.messageFromServer("482", []string{channel.Name,
 			"You're not channel operator"})
@@ -2229,6 +3872,7 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 
 	// Send an invite message.
 	if targetUser.isLocal() {
+		targetUser.LocalUser.addInvite(channel.Name, u.User.nickUhost())
 		targetUser.LocalUser.maybeQueueMessage(irc.Message{
 			Prefix:  u.User.nickUhost(),
 			Command: "INVITE",
@@ -2246,6 +3890,8 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 		})
 	}
 
+	u.Catbox.inviteNotify(channel, u.User, targetUser)
+
 	// Reply to the user.
 
 	// First tell them we're inviting the user.
@@ -2373,3 +4019,57 @@ func (u *LocalUser) squitCommand(m irc.Message) {
 		Params:  []string{string(server.SID), reason},
 	})
 }
+
+// INVITES is a non standard command. It shows an operator the invites users
+// on this server have that haven't expired, by channel, such as to find stale
+// invites to a channel. With a nick or channel, it shows only that user's or
+// channel's.
+//
+// Parameters: [<nick or channel>]
+func (u *LocalUser) invitesCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	nick, channel := "", ""
+	if len(m.Params) > 0 && strings.HasPrefix(m.Params[0], "#") {
+		channel = canonicalizeChannel(m.Params[0])
+	} else if len(m.Params) > 0 {
+		nick = canonicalizeNick(m.Params[0])
+	}
+
+	now := u.Catbox.now()
+	var lines []string
+	for _, user := range u.Catbox.sortedLocalUsers() {
+		if nick != "" && canonicalizeNick(user.DisplayNick) != nick {
+			continue
+		}
+
+		for _, channelName := range user.LocalUser.sortedInvites() {
+			if channel != "" && channelName != channel {
+				continue
+			}
+
+			invite := user.LocalUser.Invites[channelName]
+			line := fmt.Sprintf("%s %s invited by %s %s ago", channelName,
+				user.DisplayNick, invite.Inviter,
+				now.Sub(invite.Time).Round(time.Second))
+			if u.Catbox.Config.InviteExpiry > 0 {
+				line += fmt.Sprintf(", expires in %s",
+					invite.Time.Add(u.Catbox.Config.InviteExpiry).Sub(now).Round(
+						time.Second))
+			}
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+			fmt.Sprintf("INVITES: %s", line)})
+	}
+	u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+		fmt.Sprintf("INVITES: %d pending", len(lines))})
+}
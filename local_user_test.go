@@ -0,0 +1,836 @@
+package terrarium
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// K-Lines may target some servers with ON, and may be temporary.
+func TestMemNetworkKLineTargetsAndExpiry(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	c := n.servers["c.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	b.connectUser("victimb", "victim")
+	c.connectUser("victimc", "victim")
+
+	n.link("a.example.com", "b.example.com")
+	n.link("b.example.com", "c.example.com")
+	n.waitForConverged(3)
+
+	klines := func(s *memServer) int {
+		count := 0
+		s.call(func() { count = len(s.cb.KLines) })
+		return count
+	}
+
+	oper.send(irc.Message{Command: "KLINE",
+		Params: []string{"1", "~victim@*", "ON", "b.example.com", "go away"}})
+	n.waitForConverged(2)
+	if b.userServer("victimb") != "" || c.userServer("victimc") == "" {
+		t.Fatalf("wrong victim cut off")
+	}
+
+	// Once c has an UNKLINE from a, it has seen the KLINE before it too.
+	oper.send(irc.Message{Command: "UNKLINE",
+		Params: []string{"nobody@*", "ON", "c.example.com"}})
+	n.waitFor("c to see the UNKLINE", func() bool {
+		return oper.hasMessageContaining("NOTICE", "Not removing K-Line for [nobody@*]")
+	})
+	if klines(a) != 0 || klines(b) != 1 || klines(c) != 0 {
+		t.Fatalf("K-Lines a %d b %d c %d, wanted only b to have one", klines(a),
+			klines(b), klines(c))
+	}
+
+	// Stay under the dead time so no one times out.
+	n.advance(50 * time.Second)
+	if klines(b) != 1 {
+		t.Fatalf("K-Line expired early")
+	}
+
+	n.advance(20 * time.Second)
+	n.waitFor("the K-Line to expire", func() bool {
+		return klines(b) == 0
+	})
+}
+
+// Opers hear how many users a K-Line matches, and must force one matching too
+// many.
+func TestMemNetworkKLineThreshold(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.KLineForceThreshold = 2
+		a.cb.setConfig(&cfg)
+	})
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	a.connectUser("victim1", "victim")
+	a.connectUser("victim2", "victim")
+	b.connectUser("victim3", "victim")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(4)
+
+	oper.send(irc.Message{Command: "KLINE",
+		Params: []string{"~victim@*", "too many"}})
+	n.waitFor("the K-Line to be refused", func() bool {
+		return oper.hasMessageContaining("NOTICE", "Use KLINE FORCE")
+	})
+
+	oper.send(irc.Message{Command: "KLINE",
+		Params: []string{"FORCE", "~victim@*", "too many"}})
+	n.waitFor("the K-Line to apply", func() bool {
+		return oper.hasMessageContaining("NOTICE", "disconnected 2 local users")
+	})
+	if !oper.hasMessageContaining("NOTICE", "matches 2 local and 3 global users") {
+		t.Errorf("oper did not hear how many users matched")
+	}
+	n.waitForConverged(1)
+}
+
+// MASSKILL disconnects matching local users, but only after a preview.
+func TestMemNetworkMassKill(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	oper := a.connectUser("oper", "bot")
+	a.makeOper("oper")
+	a.connectUser("bot1", "bot")
+	a.connectUser("bot2", "bot")
+	a.connectUser("human", "human")
+	b.connectUser("bot3", "bot")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(5)
+
+	oper.send(irc.Message{Command: "MASSKILL",
+		Params: []string{"CONFIRM", "~bot@*", "bots"}})
+	n.waitFor("the unpreviewed MASSKILL to be refused", func() bool {
+		return oper.hasMessageContaining("NOTICE", "before confirming it")
+	})
+
+	oper.send(irc.Message{Command: "MASSKILL",
+		Params: []string{"~bot@127.0.0.0/8"}})
+	n.waitFor("the CIDR preview", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"MASSKILL for [~bot@127.0.0.0/8] matches 2 local users: bot1 bot2")
+	})
+
+	oper.send(irc.Message{Command: "MASSKILL",
+		Params: []string{"CONFIRM", "~bot@*", "bots"}})
+	n.waitFor("the MASSKILL of another mask to be refused", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"Preview MASSKILL for [~bot@*]")
+	})
+
+	oper.send(irc.Message{Command: "MASSKILL", Params: []string{"~bot@*"}})
+	n.waitFor("the preview", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"MASSKILL for [~bot@*] matches 2 local users: bot1 bot2")
+	})
+
+	// Someone who matches after the preview wasn't in it, so they stay.
+	a.connectUser("bot4", "bot")
+
+	oper.send(irc.Message{Command: "MASSKILL",
+		Params: []string{"CONFIRM", "~bot@*", "bots"}})
+	n.waitFor("the MASSKILL", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"MASSKILL for [~bot@*] disconnected 2 local users")
+	})
+	n.waitForConverged(4)
+	if a.userServer("bot4") == "" {
+		t.Errorf("MASSKILL disconnected a user who wasn't in the preview")
+	}
+}
+
+// Operators can see the state of a client's queues.
+func TestMemNetworkCheck(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	a.connectUser("usera", "usera")
+	n.servers["b.example.com"].connectUser("userb", "userb")
+	a.makeOper("oper")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	oper.send(irc.Message{Command: "CHECK", Params: []string{"usera"}})
+	n.waitFor("CHECK usera to end", func() bool {
+		return oper.hasMessageContaining("NOTICE", "End of CHECK usera")
+	})
+	for _, want := range []string{"SendQ ", "RecvQ 0 messages", "Flood tokens ",
+		"Last activity "} {
+		if !oper.hasMessageContaining("NOTICE", "CHECK usera: "+want) {
+			t.Errorf("CHECK usera did not show %q", want)
+		}
+	}
+
+	// Let the link finish its burst and write it out so the queue is steady.
+	var sendQ string
+	n.waitFor("the burst to end", func() bool {
+		done := false
+		a.call(func() {
+			for _, ls := range a.cb.LocalServers {
+				done = !ls.Bursting && len(ls.WriteChan) == 0
+				sendQ = fmt.Sprintf("SendQ 0 bytes in 0/%d messages, 0 priority",
+					cap(ls.WriteChan))
+			}
+		})
+		return done
+	})
+
+	oper.send(irc.Message{Command: "CHECK", Params: []string{"b.example.com"}})
+	n.waitFor("CHECK b.example.com to end", func() bool {
+		return oper.hasMessageContaining("NOTICE", "End of CHECK b.example.com")
+	})
+	for _, want := range []string{sendQ, "Bursting false"} {
+		if !oper.hasMessageContaining("NOTICE", "CHECK b.example.com: "+want) {
+			t.Errorf("CHECK b.example.com did not show %q", want)
+		}
+	}
+
+	oper.send(irc.Message{Command: "CHECK", Params: []string{"userb"}})
+	n.waitFor("CHECK userb to be refused", func() bool {
+		return oper.hasMessageContaining("NOTICE", "userb is not on this server")
+	})
+}
+
+// Users learn their ID when they register. Operators see it in WHOIS, even
+// for users on other servers. Others don't.
+func TestMemNetworkUserID(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	user := a.connectUser("usera", "usera")
+	userB := n.servers["b.example.com"].connectUser("userb", "userb")
+	a.makeOper("oper")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	n.waitFor("userb to get its ID", func() bool {
+		return userB.hasMessage("042")
+	})
+	uid := userB.lastMessage("042").Params[1]
+	if !isValidUID(uid) {
+		t.Fatalf("userb got ID %q, wanted a UID", uid)
+	}
+
+	oper.send(irc.Message{Command: "WHOIS", Params: []string{"userb"}})
+	n.waitFor("oper's WHOIS to end", func() bool {
+		return oper.hasMessage("318")
+	})
+	if !oper.hasMessageContaining("320", "has unique ID "+uid) {
+		t.Errorf("oper did not see userb's ID %s", uid)
+	}
+
+	user.send(irc.Message{Command: "WHOIS", Params: []string{"userb"}})
+	n.waitFor("usera's WHOIS to end", func() bool {
+		return user.hasMessage("318")
+	})
+	if user.hasMessage("320") {
+		t.Errorf("usera saw userb's ID")
+	}
+}
+
+// WHOIS lists a user's channels, leaving out secret ones. Users are +p by
+// default, which hides their channels from all but operators.
+func TestMemNetworkWHOISChannels(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	user := a.connectUser("usera", "usera")
+	oper := b.connectUser("oper", "oper")
+	b.makeOper("oper")
+	userB := b.connectUser("userb", "userb")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	userB.send(irc.Message{Command: "JOIN", Params: []string{"#open,#closed"}})
+	userB.send(irc.Message{Command: "MODE", Params: []string{"#open", "-s"}})
+	n.waitFor("#open to not be secret", func() bool {
+		return a.channelModes("#open") == "+n"
+	})
+
+	user.send(irc.Message{Command: "WHOIS", Params: []string{"userb"}})
+	n.waitFor("usera's WHOIS to end", func() bool {
+		return user.hasMessage("318")
+	})
+	if user.hasMessage("319") {
+		t.Errorf("usera saw the channels of userb, who is +p")
+	}
+
+	oper.send(irc.Message{Command: "WHOIS", Params: []string{"userb"}})
+	n.waitFor("oper's WHOIS to end", func() bool {
+		return oper.hasMessage("318")
+	})
+	if !oper.hasMessageContaining("319", "@#closed @#open") {
+		t.Errorf("oper did not see all of userb's channels")
+	}
+
+	userB.send(irc.Message{Command: "MODE", Params: []string{"userb", "-p"}})
+	n.waitFor("userb to be -p", func() bool {
+		return userB.hasMessageContaining("MODE", "-p")
+	})
+
+	user.send(irc.Message{Command: "WHOIS", Params: []string{"userb"}})
+	n.waitFor("usera to see userb's channels", func() bool {
+		return user.hasMessage("319")
+	})
+	if m := user.lastMessage("319"); m.Params[len(m.Params)-1] != "@#open" {
+		t.Errorf("usera saw userb's channels as %q, wanted @#open",
+			m.Params[len(m.Params)-1])
+	}
+}
+
+// Relays may send messages to channels as users of another network. Members on
+// every server see who relayed them.
+func TestMemNetworkRelayMsg(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.UserConfigs = []UserConfig{{UserMask: "~relay", HostMask: "*",
+			Relay: true}}
+		a.cb.setConfig(&cfg)
+	})
+
+	relay := a.connectUser("relay", "relay")
+	alice := a.connectUser("alice", "alice")
+	bob := b.connectUser("bob", "bob")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	joinAll("#chat", relay, alice, bob)
+	n.waitFor("everyone to join", func() bool {
+		return len(a.channelMembers("#chat")) == 3 &&
+			len(b.channelMembers("#chat")) == 3
+	})
+
+	alice.send(irc.Message{Command: "RELAYMSG",
+		Params: []string{"#chat", "mallory/matrix", "hi"}})
+	n.waitFor("alice to be refused", func() bool {
+		return alice.hasMessage("481")
+	})
+
+	relay.send(irc.Message{Command: "RELAYMSG",
+		Params: []string{"#chat", "carol", "hi"}})
+	n.waitFor("a nick without a network to be refused", func() bool {
+		return relay.hasMessage("432")
+	})
+
+	relay.send(irc.Message{Command: "RELAYMSG",
+		Params: []string{"#chat", "carol/matrix", "hello from matrix"}})
+	n.waitFor("alice and bob to see the relayed message", func() bool {
+		return alice.hasMessageContaining("PRIVMSG", "hello from matrix") &&
+			bob.hasMessageContaining("PRIVMSG", "hello from matrix")
+	})
+
+	for _, c := range []*memClient{alice, bob} {
+		if m := c.lastMessage("PRIVMSG"); m.Prefix != "carol/matrix!~relay@localhost" {
+			t.Errorf("relayed message came from %s", m.Prefix)
+		}
+	}
+	if relay.hasMessage("PRIVMSG") {
+		t.Errorf("relay got its own message")
+	}
+
+	// b checks RELAYMSG from a as a does. alice may not relay, and b refuses
+	// CTCPs to #chat even if a doesn't know it's +C yet.
+	uid := func(nick string) string {
+		id := ""
+		b.call(func() { id = string(b.cb.Nicks[canonicalizeNick(nick)]) })
+		return id
+	}
+	aliceUID, relayUID := uid("alice"), uid("relay")
+	b.call(func() {
+		b.cb.Channels["#chat"].Modes['C'] = struct{}{}
+		for _, ls := range b.cb.LocalServers {
+			ls.handleMessage(irc.Message{Prefix: aliceUID, Command: "ENCAP",
+				Params: []string{"*", "RELAYMSG", "#chat", "eve/matrix", "forged"}})
+			ls.handleMessage(irc.Message{Prefix: relayUID, Command: "ENCAP",
+				Params: []string{"*", "RELAYMSG", "#chat", "eve/matrix",
+					"\x01VERSION\x01"}})
+		}
+	})
+
+	relay.send(irc.Message{Command: "RELAYMSG",
+		Params: []string{"#chat", "carol/matrix", "after"}})
+	n.waitFor("bob to see the next relayed message", func() bool {
+		return bob.hasMessageContaining("PRIVMSG", "after")
+	})
+	if bob.hasMessageContaining("PRIVMSG", "forged") {
+		t.Errorf("bob got a message relayed by alice")
+	}
+	if bob.hasMessageContaining("PRIVMSG", "VERSION") {
+		t.Errorf("bob got a CTCP relayed to a +C channel")
+	}
+}
+
+// Users who are +g get private messages only from users on their ACCEPT list.
+// Others hear why, and the +g user hears about them at most once a minute.
+func TestMemNetworkCallerID(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	carol := a.connectUser("carol", "carol")
+	bob := b.connectUser("bob", "bob")
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	count := func(c *memClient, command string) int {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		found := 0
+		for _, m := range c.messages {
+			if m.Command == command {
+				found++
+			}
+		}
+		return found
+	}
+
+	alice.send(irc.Message{Command: "MODE", Params: []string{"alice", "+g"}})
+	n.waitFor("alice to be +g", func() bool {
+		return alice.hasMessageContaining("MODE", "+g")
+	})
+
+	carol.send(irc.Message{Command: "PRIVMSG", Params: []string{"alice", "one"}})
+	carol.send(irc.Message{Command: "PRIVMSG", Params: []string{"alice", "two"}})
+	n.waitFor("carol to be refused twice", func() bool {
+		return count(carol, "716") == 2
+	})
+	if count(carol, "717") != 1 || count(alice, "718") != 1 {
+		t.Errorf("alice heard about carol %d times, wanted once",
+			count(alice, "718"))
+	}
+	if alice.hasMessage("PRIVMSG") {
+		t.Errorf("alice got a message while +g")
+	}
+
+	// Users on other servers are refused by alice's server.
+	n.advance(CallerIDNoticeInterval)
+	bob.send(irc.Message{Command: "PRIVMSG", Params: []string{"alice", "hi"}})
+	n.waitFor("bob to be refused and alice told", func() bool {
+		return bob.hasMessage("716") && bob.hasMessage("717") &&
+			count(alice, "718") == 2
+	})
+
+	alice.send(irc.Message{Command: "ACCEPT", Params: []string{"carol,bob"}})
+	alice.send(irc.Message{Command: "ACCEPT", Params: []string{"*"}})
+	n.waitFor("alice to list her accept list", func() bool {
+		return alice.hasMessage("282")
+	})
+	if m := alice.lastMessage("281"); m == nil || m.Params[1] != "bob carol" {
+		t.Errorf("accept list is %v, wanted bob carol", m)
+	}
+
+	carol.send(irc.Message{Command: "PRIVMSG", Params: []string{"alice", "three"}})
+	bob.send(irc.Message{Command: "PRIVMSG", Params: []string{"alice", "four"}})
+	n.waitFor("alice to get messages from accepted users", func() bool {
+		return alice.hasMessageContaining("PRIVMSG", "three") &&
+			alice.hasMessageContaining("PRIVMSG", "four")
+	})
+
+	alice.send(irc.Message{Command: "ACCEPT", Params: []string{"-carol"}})
+	alice.send(irc.Message{Command: "ACCEPT", Params: []string{"-carol"}})
+	n.waitFor("removing carol twice to be refused", func() bool {
+		return alice.hasMessage("458")
+	})
+}
+
+// PRIVMSGs to someone away get 301 RPL_AWAY, wherever they are. NOTICEs don't.
+// If another server sets one of our users away, we tell them.
+func TestMemNetworkAway(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	bob := b.connectUser("bob", "bob")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	bob.send(irc.Message{Command: "AWAY", Params: []string{"gone fishing"}})
+	n.waitFor("bob to be away", func() bool {
+		away := ""
+		a.call(func() {
+			away = a.cb.Users[a.cb.Nicks["bob"]].AwayMessage
+		})
+		return bob.hasMessage("306") && away == "gone fishing"
+	})
+
+	alice.send(irc.Message{Command: "NOTICE", Params: []string{"bob", "hi"}})
+	alice.send(irc.Message{Command: "PRIVMSG", Params: []string{"bob", "hello"}})
+	n.waitFor("alice to get 301", func() bool {
+		m := alice.lastMessage("301")
+		return m != nil && m.Params[1] == "bob" && m.Params[2] == "gone fishing"
+	})
+	alice.mutex.Lock()
+	count := 0
+	for _, m := range alice.messages {
+		if m.Command == "301" {
+			count++
+		}
+	}
+	alice.mutex.Unlock()
+	if count != 1 {
+		t.Errorf("alice got %d 301s, wanted 1 for the PRIVMSG only", count)
+	}
+
+	away := func(uid TS6UID, params ...string) {
+		b.call(func() {
+			for _, server := range b.cb.LocalServers {
+				server.maybeQueueMessage(irc.Message{
+					Prefix:  string(uid),
+					Command: "AWAY",
+					Params:  params,
+				})
+			}
+		})
+	}
+
+	var uid TS6UID
+	a.call(func() {
+		uid = a.cb.Nicks["alice"]
+	})
+
+	away(uid, "set by services")
+	n.waitFor("alice to get 306", func() bool {
+		return alice.hasMessage("306")
+	})
+
+	away(uid)
+	n.waitFor("alice to get 305", func() bool {
+		return alice.hasMessage("305")
+	})
+}
+
+// Users may message only so many different users at a time. Channel
+// operators may use CPRIVMSG to message users on their channels past that.
+func TestMemNetworkTargetChange(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.MaxTargets = 2
+		cfg.TargetChangeTime = time.Minute
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	bob := a.connectUser("bob", "bob")
+	carol := b.connectUser("carol", "carol")
+	dave := b.connectUser("dave", "dave")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(4)
+
+	for _, nick := range []string{"bob", "carol", "bob", "dave"} {
+		alice.send(irc.Message{Command: "PRIVMSG",
+			Params: []string{nick, "hi " + nick}})
+	}
+	n.waitFor("alice to get 707 for dave", func() bool {
+		m := alice.lastMessage("707")
+		return m != nil && m.Params[1] == "dave"
+	})
+	n.waitFor("bob and carol to get messages", func() bool {
+		return bob.hasMessageContaining("PRIVMSG", "hi bob") &&
+			carol.hasMessageContaining("PRIVMSG", "hi carol")
+	})
+	if dave.hasMessageContaining("PRIVMSG", "hi dave") {
+		t.Errorf("dave got a message past the target limit")
+	}
+
+	// Alice creates #chan, so she has ops there.
+	joinAll("#chan", alice)
+	n.waitFor("alice to create #chan", func() bool {
+		return len(b.channelMembers("#chan")) == 1
+	})
+	joinAll("#chan", dave)
+	n.waitFor("dave to join", func() bool {
+		return len(a.channelMembers("#chan")) == 2
+	})
+
+	bob.send(irc.Message{Command: "CPRIVMSG",
+		Params: []string{"dave", "#chan", "hi from bob"}})
+	n.waitFor("bob to get 442", func() bool {
+		return bob.hasMessage("442")
+	})
+	dave.send(irc.Message{Command: "CPRIVMSG",
+		Params: []string{"alice", "#chan", "hi from dave"}})
+	n.waitFor("dave to get 482", func() bool {
+		return dave.hasMessage("482")
+	})
+
+	alice.send(irc.Message{Command: "CPRIVMSG",
+		Params: []string{"dave", "#chan", "hi via #chan"}})
+	n.waitFor("dave to get alice's CPRIVMSG", func() bool {
+		return dave.hasMessageContaining("PRIVMSG", "hi via #chan")
+	})
+
+	// After target-change-time, an old target stops counting.
+	n.advance(2 * time.Minute)
+	alice.send(irc.Message{Command: "PRIVMSG",
+		Params: []string{"dave", "hi again dave"}})
+	n.waitFor("dave to get alice's PRIVMSG", func() bool {
+		return dave.hasMessageContaining("PRIVMSG", "hi again dave")
+	})
+}
+
+// ADMIN tells who runs our server or a remote one.
+func TestMemNetworkAdmin(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	b.call(func() {
+		cfg := *b.cb.Config
+		cfg.AdminLocation = "Somewhere"
+		cfg.AdminName = "Bob Admin"
+		cfg.AdminEmail = "admin@b.example.com"
+		b.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	b.connectUser("bob", "bob")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	// We have no admin info.
+	alice.send(irc.Message{Command: "ADMIN"})
+	n.waitFor("alice to hear a has no admin info", func() bool {
+		return alice.hasMessageContaining("423", "No administrative info")
+	})
+
+	for _, target := range []string{"b.example.com", "bob"} {
+		alice.mutex.Lock()
+		alice.messages = nil
+		alice.mutex.Unlock()
+
+		alice.send(irc.Message{Command: "ADMIN", Params: []string{target}})
+		n.waitFor("alice to get b's admin info", func() bool {
+			return alice.hasMessage("259")
+		})
+
+		m := alice.lastMessage("256")
+		if m == nil || m.Prefix != "b.example.com" ||
+			m.Params[0] != "alice" || m.Params[1] != "b.example.com" {
+			t.Errorf("ADMIN %s: RPL_ADMINME is %v", target, m)
+		}
+		if m := alice.lastMessage("258"); m == nil || m.Params[1] != "Bob Admin" {
+			t.Errorf("ADMIN %s: RPL_ADMINLOC2 is %v", target, m)
+		}
+		if m := alice.lastMessage("259"); m == nil ||
+			m.Params[1] != "admin@b.example.com" {
+			t.Errorf("ADMIN %s: RPL_ADMINEMAIL is %v", target, m)
+		}
+	}
+
+	alice.send(irc.Message{Command: "ADMIN", Params: []string{"c.example.com"}})
+	n.waitFor("alice to hear there's no such server", func() bool {
+		return alice.hasMessageContaining("402", "No such server")
+	})
+}
+
+// TIME shows our time or, routed to it, a remote server's.
+func TestMemNetworkTime(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	b.connectUser("bob", "bob")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(2)
+
+	tests := []struct {
+		params []string
+		server string
+	}{
+		{nil, "a.example.com"},
+		{[]string{"b.example.com"}, "b.example.com"},
+		{[]string{"bob"}, "b.example.com"},
+		{[]string{"alice"}, "a.example.com"},
+	}
+	for _, test := range tests {
+		alice.mutex.Lock()
+		alice.messages = nil
+		alice.mutex.Unlock()
+
+		alice.send(irc.Message{Command: "TIME", Params: test.params})
+		n.waitFor("alice to get the time", func() bool {
+			return alice.hasMessage("391")
+		})
+
+		m := alice.lastMessage("391")
+		if m.Prefix != test.server || len(m.Params) != 3 ||
+			m.Params[0] != "alice" || m.Params[1] != test.server {
+			t.Errorf("TIME %v: RPL_TIME is %v, wanted it from %s", test.params, m,
+				test.server)
+		}
+	}
+}
+
+// LUSERS counts the whole network, and a server given as a parameter answers
+// for itself.
+func TestMemNetworkLusers(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	bob := b.connectUser("bob", "bob")
+	b.connectUser("carol", "carol")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+
+	tests := []struct {
+		params []string
+		server string
+		me     string
+	}{
+		{nil, "a.example.com", "I have 1 clients and 1 servers"},
+		{[]string{"*", "b.example.com"}, "b.example.com",
+			"I have 2 clients and 1 servers"},
+		{[]string{"*", "carol"}, "b.example.com", "I have 2 clients and 1 servers"},
+	}
+	for _, test := range tests {
+		alice.mutex.Lock()
+		alice.messages = nil
+		alice.mutex.Unlock()
+
+		alice.send(irc.Message{Command: "LUSERS", Params: test.params})
+		n.waitFor("alice to get the counts", func() bool {
+			return alice.hasMessage("250")
+		})
+
+		m := alice.lastMessage("255")
+		if m == nil || m.Prefix != test.server || len(m.Params) != 2 ||
+			m.Params[0] != "alice" || m.Params[1] != test.me {
+			t.Errorf("LUSERS %v: RPL_LUSERME is %v, wanted %s from %s",
+				test.params, m, test.me, test.server)
+		}
+		m = alice.lastMessage("266")
+		if m == nil || m.Prefix != test.server || len(m.Params) != 4 ||
+			m.Params[1] != "3" {
+			t.Errorf("LUSERS %v: global users is %v, wanted 3", test.params, m)
+		}
+	}
+
+	// Servers count their users as they come and go.
+	bob.send(irc.Message{Command: "QUIT"})
+	n.waitFor("bob to quit", func() bool {
+		return a.userServer("bob") == ""
+	})
+	a.call(func() {
+		server := a.cb.getServerByName("b.example.com")
+		if server.UserCount != 1 {
+			t.Errorf("a counts %d users on b, wanted 1", server.UserCount)
+		}
+	})
+}
+
+// Operators see the oper MOTD when they OPER. Anyone may see the rules.
+func TestMemNetworkOperMOTDRules(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.Opers = map[string]string{"oper": "pass"}
+		cfg.OperMOTD = "Be careful\nwith KILL"
+		cfg.Rules = "No spam"
+		a.cb.setConfig(&cfg)
+	})
+
+	user := a.connectUser("user", "user")
+	user.send(irc.Message{Command: "RULES"})
+	n.waitFor("the rules", func() bool {
+		return user.hasMessageContaining("232", "No spam") &&
+			user.hasMessage("309")
+	})
+
+	user.send(irc.Message{Command: "OPERMOTD"})
+	n.waitFor("OPERMOTD to be refused", func() bool {
+		return user.hasMessage("481")
+	})
+
+	user.send(irc.Message{Command: "OPER", Params: []string{"oper", "pass"}})
+	n.waitFor("the oper MOTD", func() bool {
+		return user.hasMessageContaining("721", "with KILL") &&
+			user.hasMessage("722")
+	})
+	if !user.hasMessage("381") {
+		t.Errorf("user did not oper up")
+	}
+}
+
+func TestMemNetworkBotMode(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	// b hears about the bot in the burst.
+	bot := a.connectUser("bot", "bot")
+	bot.send(irc.Message{Command: "MODE", Params: []string{"bot", "+B"}})
+	bot.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	n.waitFor("bot to join", func() bool { return bot.hasMessage("366") })
+	n.link("a.example.com", "b.example.com")
+
+	user := b.connectUser("user", "user")
+	n.waitForConverged(2)
+	// Otherwise the user may create #test on b and op themself.
+	n.waitFor("b to know #test", func() bool {
+		return len(b.channelMembers("#test")) == 1
+	})
+	user.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+
+	user.send(irc.Message{Command: "WHOIS", Params: []string{"bot"}})
+	n.waitFor("WHOIS", func() bool { return user.hasMessage("318") })
+	if !user.hasMessageContaining("335", "is a bot") {
+		t.Errorf("WHOIS did not say bot is a bot")
+	}
+
+	user.send(irc.Message{Command: "WHO", Params: []string{"#test"}})
+	n.waitFor("WHO", func() bool { return user.hasMessage("315") })
+	var flags []string
+	user.mutex.Lock()
+	for _, m := range user.messages {
+		if m.Command == "352" {
+			flags = append(flags, m.Params[6]+" "+m.Params[5])
+		}
+	}
+	user.mutex.Unlock()
+	sort.Strings(flags)
+	if want := []string{"H user", "H@B bot"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("WHO flags were %q, wanted %q", flags, want)
+	}
+}
@@ -0,0 +1,184 @@
+package terrarium
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Some things a client does make us log, such as sending an invalid message
+// or flooding. A client could do these as fast as it can and have us write
+// gigabytes of logs (and oper notices). So we limit how much each client may
+// make us log: logLimitMessages in logLimitWindow. After that, we log only
+// one in logSampleRate until the window ends, so the logs still show what the
+// client is up to. When the window ends we tell opers how many we left out.
+//
+// This is only for what clients control. We log everything else.
+
+// logLimitMessages is how many log messages a client may cause in each
+// logLimitWindow.
+const logLimitMessages = 20
+
+// logLimitWindow is how long a client's limit lasts.
+const logLimitWindow = time.Minute
+
+// logSampleRate is how often we log anyway once a client is over its limit:
+// once per this many messages.
+const logSampleRate = 100
+
+// logLimiter tracks how many log messages each client caused. The zero value
+// is ready to use. Readers and the server goroutine use it, so it has its own
+// mutex.
+type logLimiter struct {
+	mutex sync.Mutex
+
+	// Client ID to what it caused in its current window.
+	clients map[uint64]*logLimitClient
+
+	// How many log messages we left out in total.
+	suppressed uint64
+}
+
+// logLimitClient is what a client caused in its current window.
+type logLimitClient struct {
+	// How we describe the client in logs.
+	name string
+
+	windowStart time.Time
+	logged      int
+
+	// How many messages it caused past its limit, and how many of those we
+	// left out.
+	over       int
+	suppressed int
+}
+
+// allow decides whether to log a message the client caused. name describes
+// the client. The first time we leave one out, we say so in the message we
+// return. Otherwise it is blank.
+func (l *logLimiter) allow(id uint64, name string, now time.Time) (bool,
+	string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.clients == nil {
+		l.clients = map[uint64]*logLimitClient{}
+	}
+
+	client, exists := l.clients[id]
+	if !exists {
+		client = &logLimitClient{name: name, windowStart: now}
+		l.clients[id] = client
+	}
+
+	if client.logged < logLimitMessages {
+		client.logged++
+		return true, ""
+	}
+
+	client.over++
+	if client.over%logSampleRate == 0 {
+		return true, ""
+	}
+
+	client.suppressed++
+	l.suppressed++
+
+	if client.over == 1 {
+		return false, fmt.Sprintf(
+			"Client %s is causing too many log messages. Logging 1 in %d until %s",
+			name, logSampleRate, client.windowStart.Add(logLimitWindow).Format(
+				time.RFC1123))
+	}
+	return false, ""
+}
+
+// sweep ends windows that are over. It returns a message for each client we
+// left messages out for saying how many.
+func (l *logLimiter) sweep(now time.Time) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var msgs []string
+	for id, client := range l.clients {
+		if now.Sub(client.windowStart) < logLimitWindow {
+			continue
+		}
+		if client.suppressed > 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"Left out %d log messages caused by client %s", client.suppressed,
+				client.name))
+		}
+		delete(l.clients, id)
+	}
+	return msgs
+}
+
+// totalSuppressed is how many log messages we left out in total.
+func (l *logLimiter) totalSuppressed() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.suppressed
+}
+
+// clientLogAllowed decides whether to log something the client did. Any
+// goroutine may call it. If we start leaving the client's messages out, we
+// tell opers.
+func (cb *Catbox) clientLogAllowed(c *LocalClient) bool {
+	ok, notice := cb.LogLimiter.allow(c.ID, c.String(), cb.now())
+	if notice != "" {
+		cb.queueOperNotice(notice)
+	}
+	return ok
+}
+
+// sweepLogLimits ends clients' log limit windows that are over and tells
+// opers how many messages we left out.
+func (cb *Catbox) sweepLogLimits() {
+	for _, msg := range cb.LogLimiter.sweep(cb.now()) {
+		cb.noticeOpers(msg)
+	}
+}
+
+// Opers may turn on verbose logging for parts of the server while it runs,
+// with SET DEBUG. These are the parts, and what we log for each.
+var debugSubsystems = map[string]string{
+	"dns":   "looking up clients' hostnames",
+	"flood": "queueing messages from users who are flooding",
+	"s2s":   "each message servers send us",
+}
+
+// debugLogging tracks which subsystems we log verbosely for. The zero value
+// has them all off. The server goroutine changes it, and other goroutines
+// (such as those looking up hostnames) read it, so it has its own mutex.
+type debugLogging struct {
+	mutex sync.RWMutex
+	on    map[string]bool
+}
+
+// enabled says whether we log verbosely for the subsystem.
+func (d *debugLogging) enabled(subsystem string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.on[subsystem]
+}
+
+// set turns verbose logging for the subsystem on or off.
+func (d *debugLogging) set(subsystem string, on bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.on == nil {
+		d.on = map[string]bool{}
+	}
+	d.on[subsystem] = on
+}
+
+// debugf logs if verbose logging for the subsystem is on. Any goroutine may
+// call it.
+func (cb *Catbox) debugf(subsystem, format string, args ...interface{}) {
+	if !cb.Debug.enabled(subsystem) {
+		return
+	}
+	log.Printf("Debug %s: %s", subsystem, fmt.Sprintf(format, args...))
+}
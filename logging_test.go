@@ -0,0 +1,109 @@
+package terrarium
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// A client may cause logLimitMessages log messages per window. After that we
+// log only a sample, and say how many we left out when the window ends.
+func TestLogLimiter(t *testing.T) {
+	var l logLimiter
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < logLimitMessages; i++ {
+		if ok, notice := l.allow(1, "client1", start); !ok || notice != "" {
+			t.Fatalf("message %d: allow = %v %q, wanted true and no notice", i, ok,
+				notice)
+		}
+	}
+
+	ok, notice := l.allow(1, "client1", start)
+	if ok || !strings.Contains(notice, "client1 is causing too many") {
+		t.Fatalf("over the limit: allow = %v %q, wanted false and a notice", ok,
+			notice)
+	}
+
+	// Other clients have their own limits.
+	if ok, _ := l.allow(2, "client2", start); !ok {
+		t.Errorf("client2 was limited by client1's messages")
+	}
+
+	sampled := 0
+	for i := 1; i < logSampleRate*3; i++ {
+		ok, notice := l.allow(1, "client1", start)
+		if notice != "" {
+			t.Errorf("got a second notice: %q", notice)
+		}
+		if ok {
+			sampled++
+		}
+	}
+	if sampled != 3 {
+		t.Errorf("logged %d of the messages over the limit, wanted 3", sampled)
+	}
+
+	if msgs := l.sweep(start.Add(logLimitWindow / 2)); len(msgs) != 0 {
+		t.Errorf("window ended early: %v", msgs)
+	}
+
+	msgs := l.sweep(start.Add(logLimitWindow))
+	if len(msgs) != 1 ||
+		msgs[0] != "Left out 297 log messages caused by client client1" {
+		t.Errorf("sweep = %v, wanted one message about client1", msgs)
+	}
+	if l.totalSuppressed() != 297 {
+		t.Errorf("suppressed %d in total, wanted 297", l.totalSuppressed())
+	}
+
+	// A new window starts over.
+	if ok, _ := l.allow(1, "client1", start.Add(logLimitWindow)); !ok {
+		t.Errorf("client1 still limited in a new window")
+	}
+}
+
+// Operators may turn debug logging for a subsystem on and off with SET.
+func TestMemNetworkSetDebug(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	bob := a.connectUser("bob", "bob")
+	a.makeOper("alice")
+
+	bob.send(irc.Message{Command: "SET", Params: []string{"DEBUG", "s2s", "ON"}})
+	n.waitFor("bob to be refused", func() bool {
+		return bob.hasMessage("481")
+	})
+
+	alice.send(irc.Message{Command: "SET", Params: []string{"DEBUG", "s2s", "ON"}})
+	n.waitFor("alice to turn on s2s debugging", func() bool {
+		return alice.hasMessageContaining("NOTICE",
+			"alice turned debug logging for s2s on")
+	})
+	if !a.cb.Debug.enabled("s2s") || a.cb.Debug.enabled("dns") {
+		t.Errorf("only s2s debugging should be on")
+	}
+
+	alice.send(irc.Message{Command: "SET", Params: []string{"DEBUG"}})
+	n.waitFor("alice to see what's on", func() bool {
+		return alice.hasMessageContaining("NOTICE",
+			"Debug logging for s2s (each message servers send us) is on") &&
+			alice.hasMessageContaining("NOTICE",
+				"Debug logging for dns (looking up clients' hostnames) is off")
+	})
+
+	alice.send(irc.Message{Command: "SET", Params: []string{"DEBUG", "sasl", "ON"}})
+	n.waitFor("alice to hear sasl isn't a subsystem", func() bool {
+		return alice.hasMessageContaining("NOTICE",
+			"Unknown subsystem sasl. Subsystems: dns, flood, s2s")
+	})
+
+	alice.send(irc.Message{Command: "SET", Params: []string{"DEBUG", "s2s", "OFF"}})
+	n.waitFor("alice to turn off s2s debugging", func() bool {
+		return !a.cb.Debug.enabled("s2s")
+	})
+}
@@ -11,9 +11,10 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/horgh/irc"
@@ -29,8 +30,24 @@ type Catbox struct {
 	// ConfigFile is the path to the config file.
 	ConfigFile string
 
-	// Config is the currently loaded config.
-	Config *Config
+	// Config is the currently loaded config. Goroutines other than the server
+	// goroutine must read it through config(). See ownership.go.
+	Config      *Config
+	ConfigMutex sync.RWMutex
+
+	// CheckOwnership turns on checks that only the server goroutine touches the
+	// server's state. See ownership.go.
+	CheckOwnership bool
+
+	// The ID of the server goroutine, if we're checking ownership.
+	ownerGoroutine uint64
+
+	// Clock tells us the time.
+	Clock Clock
+
+	// DialServer, if set, connects to a server we link to in place of dialing
+	// its host and port. Tests use it to link servers in memory.
+	DialServer func(linkInfo *ServerDefinition) (net.Conn, error)
 
 	// Next client ID to issue. This turns into TS6 ID which gets concatenated
 	// with our SID to make the TS6 UID. We wrap it in a mutex as different
@@ -38,6 +55,17 @@ type Catbox struct {
 	NextClientID     uint64
 	NextClientIDLock sync.Mutex
 
+	// Next client ID to issue to a virtual user, counting from
+	// virtualClientIDBase. NextClientIDLock guards it too.
+	NextVirtualClientID uint64
+
+	// IDs of clients that left that we may issue again, oldest first.
+	// NextClientIDLock guards it too. See clientid.go.
+	freeClientIDs []freeClientID
+
+	// The most of the client ID space we've told operators we used, in percent.
+	clientIDWarnPercent int
+
 	// LocalClients are unregistered.
 	// Client id (uint64) is the locally unique key.
 	// It is useful to use this instead of TS6UID/TS6SID as we need to look up
@@ -67,6 +95,36 @@ type Catbox struct {
 	// Active K:Lines (bans).
 	KLines []KLine
 
+	// Local users indexed by hostname. Hostname to client ID to LocalUser. This
+	// lets us find users matching a K-Line with an exact host mask without
+	// looking at every user.
+	HostUsers map[string]map[uint64]*LocalUser
+
+	// Nicks we're holding after a netsplit, and until when. Canonicalized nick
+	// to time. See resv.go.
+	NickDelays map[string]time.Time
+
+	// Local users monitoring each nick. Canonicalized nick to client ID to
+	// LocalUser. See monitor.go.
+	Monitors map[string]map[uint64]*LocalUser
+
+	// Servers that split lately, by SID. See relink.go.
+	RecentSplits map[TS6SID]*recentSplit
+
+	// The notice categories each operator turned on or off, by oper name. See
+	// notices.go.
+	OperNotices map[string]map[string]bool
+
+	// We write the choices in goroutines. Each save has a number so that an
+	// older one doesn't replace a newer. The goroutines hold
+	// operNoticesMutex to use operNoticesWritten.
+	operNoticesSaves   uint64
+	operNoticesMutex   sync.Mutex
+	operNoticesWritten uint64
+
+	// Interned strings shared between users, such as hostnames.
+	Strings *stringTable
+
 	// When we close this channel, this indicates that we're shutting down.
 	// Other goroutines can check if this channel is closed.
 	ShutdownChan chan struct{}
@@ -74,6 +132,43 @@ type Catbox struct {
 	// Tell the server something on this channel.
 	ToServerChan chan Event
 
+	// Low priority events we put off because we were overloaded, and how many
+	// of them each client has. See eventqueue.go.
+	deferredEvents  []Event
+	deferredClients map[uint64]int
+
+	// How the event queue is doing.
+	EventStats EventQueueStats
+
+	// Jobs for each of the fan-out workers. See fanout.go.
+	fanOutChans []chan fanOutJob
+
+	// Messages for the chat logger, and how many we dropped because it was
+	// behind. See chatlog.go.
+	chatLogChan    chan chatLogEntry
+	ChatLogDropped int
+
+	// Events for the event sender, and how many we dropped because it was
+	// behind. See events.go.
+	eventChan     chan serverEvent
+	EventsDropped int
+
+	// Decides whether to challenge users who connect. Programs embedding the
+	// server may set this before Start. See challenge.go.
+	Challenger Challenger
+
+	// How many log messages each client caused lately. See logging.go.
+	LogLimiter logLimiter
+
+	// Which subsystems we log verbosely for. See logging.go.
+	Debug debugLogging
+
+	// The bridge user's UID once it registers, and whether it is connecting.
+	// The bridge's goroutines use these, so hold bridgeMutex. See bridge.go.
+	bridgeMutex      sync.Mutex
+	bridgeUID        TS6UID
+	bridgeConnecting bool
+
 	// The highest number of local users we have seen at once.
 	HighestLocalUserCount int
 
@@ -94,14 +189,38 @@ type Catbox struct {
 	Certificate      *tls.Certificate
 	CertificateMutex *sync.RWMutex
 
-	// TCP plaintext and TLS listeners.
-	Listener    net.Listener
-	TLSListener net.Listener
+	// When we last checked when our certificate expires. See cert.go.
+	CertificateCheckedAt time.Time
+
+	// When we last wrote the channels export file. See export.go.
+	ChannelsExportedAt time.Time
 
-	// I2P Streaming and I2P+TLS listeners.
+	// Counts of users, channels, and servers over time, and when we last took
+	// them. See history.go.
+	History           history
+	HistoryRecordedAt time.Time
+
+	// The latest version survey, if there has been one. See survey.go.
+	VersionSurvey *versionSurvey
+
+	// Listeners we accept connections on, by name. This includes TCP plaintext
+	// and TLS listeners as well as I2P ones.
+	Listeners map[string]*Listener
+
+	// I2P Streaming and I2P+TLS listeners. These are also in Listeners.
 	I2PListener    net.Listener
 	I2PListenerTLS net.Listener
 
+	// Listening sockets inherited from our parent process (e.g., across a
+	// restart). Listener name to file descriptor. We take these over rather than
+	// opening new sockets.
+	ListenFDs map[string]int
+
+	// When we restart, the listening sockets we keep open for the new process.
+	// Listener name to file descriptor.
+	RestartListenFDs map[string]int
+	restartFiles     []*os.File
+
 	// WaitGroup to ensure all goroutines clean up before we end.
 	WG sync.WaitGroup
 
@@ -116,6 +235,9 @@ type Catbox struct {
 	// one at a time, and we don't want to favour those that happen to be appear
 	// first in the config.
 	LinkQueue []*ServerDefinition
+
+	// Server name to how our last attempt to connect to it went. For STATS c.
+	LinkStatuses map[string]*LinkStatus
 }
 
 // KLine holds a kline (a ban).
@@ -125,6 +247,9 @@ type KLine struct {
 	HostMask string
 
 	Reason string
+
+	// When the K-Line expires. If zero, it is permanent.
+	Expires time.Time
 }
 
 // Message tells us the message and its destination. It primarily exists so that
@@ -155,6 +280,12 @@ type Event struct {
 	// If we have an error associated with the event, such as in the case of
 	// some DeadClientEvents, populate it here.
 	Error error
+
+	// For CallEvents, the function to run.
+	Func func()
+
+	// When the event went on the queue. newEvent() sets this.
+	Queued time.Time
 }
 
 // EventType is a type of event we can tell the server about.
@@ -183,6 +314,14 @@ const ( // nolint: deadcode
 
 	// RestartEvent tells the server to restart.
 	RestartEvent
+
+	// ShutdownEvent tells the server to shut down.
+	ShutdownEvent
+
+	// CallEvent tells the server to run a function. The function runs on the
+	// server goroutine, so it may look at and change server state. Tests and
+	// the bridge use this.
+	CallEvent
 )
 
 // UserMessageLimit defines a cap on how many messages a user may send at once.
@@ -219,6 +358,7 @@ func NewCatbox(configFile string) (*Catbox, error) {
 	rand.Seed(time.Now().UnixNano())
 	cb := Catbox{
 		ConfigFile:   configFile,
+		Clock:        systemClock{},
 		LocalClients: make(map[uint64]*LocalClient),
 		LocalUsers:   make(map[uint64]*LocalUser),
 		LocalServers: make(map[uint64]*LocalServer),
@@ -228,12 +368,18 @@ func NewCatbox(configFile string) (*Catbox, error) {
 		Servers:      make(map[TS6SID]*Server),
 		Channels:     make(map[string]*Channel),
 		KLines:       []KLine{},
+		HostUsers:    make(map[string]map[uint64]*LocalUser),
+		NickDelays:   make(map[string]time.Time),
+		Monitors:     make(map[string]map[uint64]*LocalUser),
+		RecentSplits: make(map[TS6SID]*recentSplit),
+		Listeners:    make(map[string]*Listener),
+		Strings:      newStringTable(),
 
 		// shutdown() closes this channel.
 		ShutdownChan: make(chan struct{}),
 
 		// We never manually close this channel.
-		ToServerChan: make(chan Event),
+		ToServerChan: make(chan Event, EventQueueSize),
 	}
 
 	cfg, err := checkAndParseConfig(configFile)
@@ -245,6 +391,10 @@ func NewCatbox(configFile string) (*Catbox, error) {
 	}
 	cb.Config = cfg
 
+	if err := cb.loadOperNotices(); err != nil {
+		return nil, err
+	}
+
 	if cb.Config.ListenPortTLS != "-1" || cb.Config.CertificateFile != "" ||
 		cb.Config.KeyFile != "" {
 		cb.CertificateMutex = &sync.RWMutex{}
@@ -252,6 +402,9 @@ func NewCatbox(configFile string) (*Catbox, error) {
 			GetCertificate:           cb.getCertificate,
 			PreferServerCipherSuites: true,
 			SessionTicketsDisabled:   true,
+			// Ask for a client certificate so we can tell operators its
+			// fingerprint. We don't verify it.
+			ClientAuth: tls.RequestClientCert,
 			// It would be nice to be able to be more restrictive on ciphers, but in
 			// practice many clients do not support the strictest.
 			//CipherSuites: []uint16{
@@ -285,19 +438,38 @@ func (cb *Catbox) getCertificate(
 
 // Load the certificate and key from files.
 func (cb *Catbox) loadCertificate() error {
-	if cb.Config.CertificateFile == "" || cb.Config.KeyFile == "" {
-		return nil
+	cert, err := readCertificate(cb.Config.CertificateFile, cb.Config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if cert != nil {
+		cb.setCertificate(cert)
+	}
+	return nil
+}
+
+// Read a certificate and key from files. If either file is not set, there is
+// no certificate and we return nil.
+func readCertificate(certificateFile, keyFile string) (*tls.Certificate,
+	error) {
+	if certificateFile == "" || keyFile == "" {
+		return nil, nil
 	}
 
-	cert, err := tls.LoadX509KeyPair(cb.Config.CertificateFile, cb.Config.KeyFile)
+	cert, err := tls.LoadX509KeyPair(certificateFile, keyFile)
 	if err != nil {
-		return errors.Wrap(err, "error loading certificate/key")
+		return nil, errors.Wrap(err, "error loading certificate/key")
 	}
 
+	return &cert, nil
+}
+
+// Swap in a new certificate.
+func (cb *Catbox) setCertificate(cert *tls.Certificate) {
 	cb.CertificateMutex.Lock()
 	defer cb.CertificateMutex.Unlock()
-	cb.Certificate = &cert
-	return nil
+	cb.Certificate = cert
 }
 
 // start starts up the server.
@@ -305,49 +477,55 @@ func (cb *Catbox) loadCertificate() error {
 // We open the TCP port, start goroutines, and then receive messages on our
 // channels.
 func (cb *Catbox) Start(listenFD int) error {
-	if listenFD == -1 && cb.Config.ListenPort == "-1" &&
-		cb.Config.ListenPortTLS == "-1" {
-		log.Fatalf("You must set a listen port.")
+	if cb.ListenFDs == nil {
+		cb.ListenFDs = map[string]int{}
 	}
 
-	// Plaintext listener.
-
 	if listenFD != -1 {
-		f := os.NewFile(uintptr(listenFD), "<fd>")
-		ln, err := net.FileListener(f)
-		if err != nil {
-			return fmt.Errorf("unable to listen: %s", err)
-		}
-		cb.Listener = ln
+		cb.ListenFDs[listenFDName] = listenFD
+	}
 
-		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+	systemdFDs, err := systemdListenFDs(cb.Config)
+	if err != nil {
+		return fmt.Errorf("unable to use sockets from systemd: %s", err)
+	}
+	for name, fd := range systemdFDs {
+		cb.ListenFDs[name] = fd
 	}
 
-	if cb.Config.ListenPort != "-1" {
-		ln, err := net.Listen("tcp", fmt.Sprintf("%s:%s", cb.Config.ListenHost,
-			cb.Config.ListenPort))
-		if err != nil {
+	if _, exists := cb.ListenFDs[listenFDName]; !exists &&
+		cb.Config.ListenPort == "-1" && cb.Config.ListenPortTLS == "-1" {
+		log.Fatalf("You must set a listen port.")
+	}
+
+	// Plaintext and TLS listeners.
+
+	if _, exists := cb.ListenFDs[listenFDName]; exists {
+		if _, err := cb.openListener(listenFDName, false, true); err != nil {
 			return fmt.Errorf("unable to listen: %s", err)
 		}
-		cb.Listener = ln
+	}
 
-		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+	names := listenerNames(cb.Config)
+	var sortedNames []string
+	for name := range names {
+		sortedNames = append(sortedNames, name)
 	}
+	sort.Strings(sortedNames)
 
-	// TLS listener.
-	if cb.Config.ListenPortTLS != "-1" {
-		tlsLN, err := tls.Listen("tcp", fmt.Sprintf("%s:%s", cb.Config.ListenHost,
-			cb.Config.ListenPortTLS), cb.TLSConfig)
-		if err != nil {
-			return fmt.Errorf("unable to listen (TLS): %s", err)
+	for _, name := range sortedNames {
+		if _, err := cb.openListener(name, names[name], false); err != nil {
+			return fmt.Errorf("unable to listen: %s", err)
 		}
-		cb.TLSListener = tlsLN
+	}
 
-		cb.WG.Add(1)
-		go cb.acceptConnections(cb.TLSListener)
+	// Close any sockets we inherited but no longer want.
+	for name, fd := range cb.ListenFDs {
+		log.Printf("Closing inherited listener %s as it is no longer configured",
+			name)
+		_ = os.NewFile(uintptr(fd), name).Close() // nolint: gosec
 	}
+	cb.ListenFDs = nil
 
 	// I2P Listener
 	if cb.Config.ListenI2P != "-1" {
@@ -366,8 +544,13 @@ func (cb *Catbox) Start(listenFD int) error {
 				return fmt.Errorf("unable to write I2P addresshelper link to file: %s", err)
 			}
 		}
-		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		cb.addListener(&Listener{
+			Listener: ln,
+			Name:     "i2p/" + cb.Config.ListenI2P,
+			Fixed:    true,
+			raw:      ln,
+			closed:   make(chan struct{}),
+		})
 	}
 
 	// I2P Listener with TLS
@@ -388,8 +571,32 @@ func (cb *Catbox) Start(listenFD int) error {
 				return fmt.Errorf("unable to write I2P addresshelper link to file: %s", err)
 			}
 		}
-		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		cb.addListener(&Listener{
+			Listener: tlsln,
+			Name:     "i2p-tls/" + cb.Config.ListenI2PTLS,
+			TLS:      true,
+			Fixed:    true,
+			raw:      ln,
+			closed:   make(chan struct{}),
+		})
+	}
+
+	// HTTP listener for the bridge.
+	if cb.Config.BridgeListen != "" {
+		if err := cb.startBridge(); err != nil {
+			return fmt.Errorf("unable to start bridge: %s", err)
+		}
+	}
+
+	if cb.Config.AdminSocket != "" {
+		if err := cb.startAdminSocket(); err != nil {
+			return fmt.Errorf("unable to listen on admin socket: %s", err)
+		}
+	}
+
+	// We've opened everything we need privileges for.
+	if err := dropPrivileges(cb.Config); err != nil {
+		return fmt.Errorf("unable to drop privileges: %s", err)
 	}
 
 	// Alarm is a goroutine to wake up this one periodically so we can do things
@@ -397,128 +604,162 @@ func (cb *Catbox) Start(listenFD int) error {
 	cb.WG.Add(1)
 	go cb.alarm()
 
-	// Catch SIGHUP and rehash.
-	// Catch SIGUSR1 and restart.
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, syscall.SIGHUP)
-	signal.Notify(signalChan, syscall.SIGINT)
-
+	// Turn signals into events such as rehash and restart. Which signals we
+	// catch depends on the platform.
+	//
+	// We register before we say we started so signals sent after that point
+	// are not lost.
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, controlSignals()...)
 	cb.WG.Add(1)
-	go func() {
-		defer cb.WG.Done()
-		for {
-			select {
-			case sig := <-signalChan:
-				if sig == syscall.SIGHUP {
-					log.Printf("Received SIGHUP signal, rehashing")
-					cb.newEvent(Event{Type: RehashEvent})
-					break
-				}
-				if sig == syscall.SIGINT {
-					log.Printf("Received SIGUSR1 signal, restarting")
-					cb.newEvent(Event{Type: RestartEvent})
-					break
-				}
-				log.Printf("Received unknown signal!")
-			case <-cb.ShutdownChan:
-				signal.Stop(signalChan)
-				// After Stop() we're guaranteed we will receive no more on the channel,
-				// so we can close the channel, and then drain it.
-				close(signalChan)
-				for range signalChan {
-				}
-				log.Printf("Signal listener shutting down.")
-				return
-			}
-		}
-	}()
+	go cb.handleSignals(signalChan)
 
+	cb.serve()
+	return nil
+}
+
+// serve processes events until we shut down, then waits for our goroutines to
+// end.
+//
+// Start() calls this once it has set up listeners and the alarm. Tests call it
+// directly to run a server in memory. They introduce connections themselves
+// and send wake ups in place of the alarm.
+func (cb *Catbox) serve() {
 	log.Printf("terrarium started")
+	if cb.Config.Standalone {
+		log.Printf("Running standalone. We won't link with other servers.")
+	}
 	cb.eventLoop()
 
 	// We don't need to drain any channels. None close that will have any
 	// goroutines blocked on them.
 
 	cb.WG.Wait()
-
-	return nil
 }
 
 // eventLoop processes events on the server's channel.
 //
 // It continues until the shutdown channel closes, indicating shutdown.
 func (cb *Catbox) eventLoop() {
-	for {
-		select {
-		// Careful about using the Client we get back in events. It may have been
-		// promoted to a different client type (LocalUser, LocalServer).
-		case evt := <-cb.ToServerChan:
-			if evt.Type == NewClientEvent {
-				log.Printf("New client connection: %s", evt.Client)
-				cb.LocalClients[evt.Client.ID] = evt.Client
-				continue
-			}
+	if cb.CheckOwnership {
+		atomic.StoreUint64(&cb.ownerGoroutine, goroutineID())
+	}
 
-			if evt.Type == DeadClientEvent {
-				lc, exists := cb.LocalClients[evt.Client.ID]
-				if exists {
-					lc.quit("I/O error")
-					continue
-				}
-				lu, exists := cb.LocalUsers[evt.Client.ID]
-				if exists {
-					lu.quit(cb.errorToQuitMessage(evt.Error), true)
-					continue
-				}
-				ls, exists := cb.LocalServers[evt.Client.ID]
-				if exists {
-					ls.quit("I/O error")
-					continue
-				}
-				continue
-			}
+	for {
+		// Catch up on work we put off. We take turns with new events so a steady
+		// stream of them doesn't keep it waiting.
+		if cb.shouldRunDeferredEvent() {
+			cb.runDeferredEvent()
 
-			if evt.Type == MessageFromClientEvent {
-				lc, exists := cb.LocalClients[evt.Client.ID]
-				if exists {
-					lc.handleMessage(evt.Message)
-					continue
-				}
-				lu, exists := cb.LocalUsers[evt.Client.ID]
-				if exists {
-					lu.handleMessage(evt.Message)
-					continue
-				}
-				ls, exists := cb.LocalServers[evt.Client.ID]
-				if exists {
-					ls.handleMessage(evt.Message)
-					continue
-				}
-				continue
+			select {
+			case evt := <-cb.ToServerChan:
+				cb.receiveEvent(evt)
+			case <-cb.ShutdownChan:
+				return
+			default:
 			}
+			continue
+		}
 
-			if evt.Type == WakeUpEvent {
-				cb.checkAndPingClients()
-				cb.connectToServers()
-				cb.floodControl()
-				continue
-			}
+		select {
+		case evt := <-cb.ToServerChan:
+			cb.receiveEvent(evt)
+		case <-cb.ShutdownChan:
+			return
+		}
+	}
+}
 
-			if evt.Type == RehashEvent {
-				cb.rehash(nil)
-				continue
-			}
+// handleEvent does what an event asks.
+//
+// Careful about using the Client we get back in events. It may have been
+// promoted to a different client type (LocalUser, LocalServer).
+func (cb *Catbox) handleEvent(evt Event) {
+	if evt.Type == NewClientEvent {
+		log.Printf("New client connection: %s", evt.Client)
+		cb.LocalClients[evt.Client.ID] = evt.Client
+		if evt.Client.Listener != "" &&
+			cb.Config.GuestListeners[listenerKind(evt.Client.Listener)] {
+			evt.Client.Guest = true
+		}
+		return
+	}
 
-			if evt.Type == RestartEvent {
-				cb.restart(nil)
-				continue
-			}
+	if evt.Type == DeadClientEvent {
+		lc, exists := cb.LocalClients[evt.Client.ID]
+		if exists {
+			lc.quit("I/O error")
+			return
+		}
+		lu, exists := cb.LocalUsers[evt.Client.ID]
+		if exists {
+			lu.quit(cb.errorToQuitMessage(evt.Error), true)
+			return
+		}
+		ls, exists := cb.LocalServers[evt.Client.ID]
+		if exists {
+			ls.quit("I/O error")
+			return
+		}
+		return
+	}
 
-			log.Fatalf("Unexpected event: %d", evt.Type)
-		case <-cb.ShutdownChan:
+	if evt.Type == MessageFromClientEvent {
+		lc, exists := cb.LocalClients[evt.Client.ID]
+		if exists {
+			lc.handleMessage(evt.Message)
 			return
 		}
+		lu, exists := cb.LocalUsers[evt.Client.ID]
+		if exists {
+			lu.handleMessage(evt.Message)
+			return
+		}
+		ls, exists := cb.LocalServers[evt.Client.ID]
+		if exists {
+			ls.handleMessage(evt.Message)
+			return
+		}
+		return
+	}
+
+	if evt.Type == WakeUpEvent {
+		cb.checkAndPingClients()
+		cb.connectToServers()
+		cb.floodControl()
+		cb.expireKLines()
+		cb.expireNickDelays()
+		cb.expireRecentSplits()
+		cb.checkClientIDs()
+		cb.sweepLogLimits()
+		cb.checkCertificateExpiry()
+		cb.exportChannels()
+		cb.recordHistory()
+		cb.continueVersionSurvey()
+		return
 	}
+
+	if evt.Type == RehashEvent {
+		cb.rehash(nil)
+		return
+	}
+
+	if evt.Type == RestartEvent {
+		cb.restart(nil)
+		return
+	}
+
+	if evt.Type == ShutdownEvent {
+		cb.shutdown()
+		return
+	}
+
+	if evt.Type == CallEvent {
+		evt.Func()
+		return
+	}
+
+	log.Fatalf("Unexpected event: %d", evt.Type)
 }
 
 // Given a DeadClientEvent's error, translate that to a QUIT message.
@@ -573,16 +814,13 @@ func (cb *Catbox) shutdown() {
 	// down.
 	close(cb.ShutdownChan)
 
-	if cb.Listener != nil {
-		if err := cb.Listener.Close(); err != nil {
-			log.Printf("Error closing plaintext listener: %s", err)
-		}
+	// If we're restarting, keep our listening sockets open for the new process.
+	if cb.Restart {
+		cb.keepListenersForRestart()
 	}
 
-	if cb.TLSListener != nil {
-		if err := cb.TLSListener.Close(); err != nil {
-			log.Printf("Error closing TLS listener: %s", err)
-		}
+	for _, l := range cb.Listeners {
+		cb.closeListener(l)
 	}
 
 	// All clients need to be told. This also closes their write channels.
@@ -606,9 +844,14 @@ func (cb *Catbox) getClientID() uint64 {
 	cb.NextClientIDLock.Lock()
 	defer cb.NextClientIDLock.Unlock()
 
+	if id, ok := cb.reuseClientID(); ok {
+		return id
+	}
+
 	id := cb.NextClientID
 
-	if cb.NextClientID+1 == 0 {
+	// IDs from virtualClientIDBase on are for virtual users.
+	if cb.NextClientID+1 == virtualClientIDBase {
 		log.Fatalf("Client id overflow")
 	}
 	cb.NextClientID++
@@ -619,7 +862,7 @@ func (cb *Catbox) getClientID() uint64 {
 // acceptConnections accepts TCP connections and tells the main server loop
 // through a channel. It sets up separate goroutines for reading/writing to
 // and from the client.
-func (cb *Catbox) acceptConnections(listener net.Listener) {
+func (cb *Catbox) acceptConnections(listener *Listener) {
 	defer cb.WG.Done()
 
 	for {
@@ -629,36 +872,51 @@ func (cb *Catbox) acceptConnections(listener net.Listener) {
 
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-listener.closed:
+				log.Printf("Listener %s closed.", listener.Name)
+				return
+			default:
+			}
 			log.Printf("Failed to accept connection: %s", err)
 			continue
 		}
 
-		cb.introduceClient(conn)
+		cb.introduceClient(conn, listener.Name)
 	}
 
 	log.Printf("Connection accepter shutting down.")
 }
 
-// introduceClient sets up a client we just accepted.
+// introduceClient sets up a client we just accepted on the named listener.
+// The name is blank if the connection is not from a listener.
 //
 // It creates a Client struct, and sends initial NOTICEs to the client. It also
 // attempts to look up the client's hostname.
-func (cb *Catbox) introduceClient(conn net.Conn) {
+func (cb *Catbox) introduceClient(conn net.Conn, listenerName string) {
+	cb.introduceClientWithID(cb.getClientID(), conn, listenerName)
+}
+
+// introduceClientWithID is introduceClient for a client we already chose an ID
+// for.
+func (cb *Catbox) introduceClientWithID(id uint64, conn net.Conn,
+	listenerName string) {
 	cb.WG.Add(1)
 
 	go func() {
 		defer cb.WG.Done()
 
-		id := cb.getClientID()
+		cfg := cb.config()
 
 		client := NewLocalClient(cb, id, conn)
+		client.Listener = listenerName
 
 		cb.WG.Add(1)
 		go client.writeLoop()
 
 		sendAuthNotice(
 			client,
-			"*** Processing your connection to "+cb.Config.ServerName,
+			"*** Processing your connection to "+cfg.ServerName,
 		)
 
 		if client.isTLS() {
@@ -670,14 +928,14 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 			}
 
 			if tlsVersion != "TLS 1.2" && tlsVersion != "TLS 1.3" {
-				cb.noticeOpers(fmt.Sprintf("Rejecting client %s using %s",
-					client.Conn.IP, tlsVersion))
+				cb.queueOperNotice(fmt.Sprintf("Rejecting client %s using %s",
+					client.String(), tlsVersion))
 				// Send ERROR and start up the writer to try to let them get it. Don't
 				// bother recording the client or starting the reader. We don't care.
 				client.messageFromServer("ERROR",
 					[]string{fmt.Sprintf(
 						"Your SSL/TLS version is %s. This server requires at least TLS 1.2. Contact %s if this is a problem.",
-						tlsVersion, cb.Config.AdminEmail)})
+						tlsVersion, cfg.AdminEmail)})
 				close(client.WriteChan)
 				return
 			}
@@ -688,14 +946,21 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 			)
 		}
 
-		sendAuthNotice(client, "*** Looking up your hostname...")
-
-		hostname := lookupHostname(context.TODO(), client.Conn.IP)
-		if len(hostname) > 0 {
-			sendAuthNotice(client, "*** Found your hostname")
-			client.Hostname = hostname
-		} else {
-			sendAuthNotice(client, "*** Couldn't look up your hostname")
+		// Under the anonymous privacy profile we cloak everyone. Don't ask DNS
+		// about them.
+		if cfg.PrivacyProfile != PrivacyProfileAnonymous {
+			sendAuthNotice(client, "*** Looking up your hostname...")
+
+			start := time.Now()
+			hostname := lookupHostname(context.TODO(), client.Conn.IP)
+			cb.debugf("dns", "Looked up %s in %s: %q", client.Conn.IP,
+				time.Since(start), hostname)
+			if len(hostname) > 0 {
+				sendAuthNotice(client, "*** Found your hostname")
+				client.Hostname = hostname
+			} else {
+				sendAuthNotice(client, "*** Couldn't look up your hostname")
+			}
 		}
 
 		// Inform the main server goroutine about the client.
@@ -711,10 +976,12 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 }
 
 func sendAuthNotice(c *LocalClient, m string) {
-	c.WriteChan <- irc.Message{
+	msg := irc.Message{
 		Command: "NOTICE",
 		Params:  []string{"AUTH", m},
 	}
+	atomic.AddInt64(&c.SendQueueBytes, int64(messageLength(msg)))
+	c.WriteChan <- outMessage{Message: msg}
 }
 
 // Return true if the server is shutting down.
@@ -757,17 +1024,19 @@ func (cb *Catbox) alarm() {
 
 // checkAndPingClients looks at each connected client.
 //
-// If they've been idle a short time, we send them a PING (if they're
-// registered).
+// If they've been idle a short time, we send them a PING.
 //
 // If they've been idle a long time, we kill their connection.
 //
-// We also kill any whose send queue maxed out.
+// We also kill any whose send queue maxed out, and any taking too long to
+// register.
 func (cb *Catbox) checkAndPingClients() {
-	now := time.Now()
+	now := cb.now()
 
-	// Unregistered clients do not receive PINGs, nor do we care about their
-	// idle time. Kill them if they are connected too long and still unregistered.
+	// Unregistered clients must register within RegistrationTime. Until then we
+	// ping those that go quiet, and we give them PingTime to answer. We don't
+	// ping servers that are part way through linking. They answer in the link
+	// handshake.
 	for _, client := range cb.LocalClients {
 		if client.SendQueueExceeded {
 			client.quit("SendQ exceeded")
@@ -775,54 +1044,52 @@ func (cb *Catbox) checkAndPingClients() {
 		}
 
 		timeConnected := now.Sub(client.ConnectionStartTime)
-
-		// If it's been connected long enough to need to ping it, cut it off.
-		if timeConnected > cb.Config.PingTime {
+		if timeConnected > cb.Config.RegistrationTime {
 			client.quit("Idle too long.")
+			continue
 		}
-	}
-
-	// User and server clients we are more lenient with. Ping them if they are
-	// idle for a while.
 
-	for _, client := range cb.LocalUsers {
-		if client.SendQueueExceeded {
-			client.quit("SendQ exceeded", true)
+		if client.Guest && !client.CapNegotiating &&
+			timeConnected >= GuestRegisterDelay {
+			client.registerGuest()
 			continue
 		}
 
-		timeIdle := now.Sub(client.LastActivityTime)
-
-		// Was it active recently enough that we don't need to do anything?
-		if timeIdle < cb.Config.PingTime {
+		// The PING cookie is a PING too.
+		if client.isLinking() || client.PingCookie != "" {
 			continue
 		}
 
-		// It's been idle a while.
-
-		// Has it been idle long enough that we consider it dead?
-		if timeIdle > cb.Config.DeadTime {
+		if !client.checkIdle(now, cb.Config.PingTime, 2*cb.Config.PingTime,
+			irc.Message{
+				Command: "PING",
+				Params:  []string{cb.Config.ServerName},
+			}) {
 			client.quit(fmt.Sprintf("Ping timeout: %d seconds",
-				int(timeIdle.Seconds())), true)
-			continue
+				int(now.Sub(client.LastActivityTime).Seconds())))
 		}
+	}
 
-		timeSincePing := now.Sub(client.LastPingTime)
+	// User and server clients we are more lenient with. Ping them if they are
+	// idle for a while.
 
-		// Should we ping it? We might have pinged it recently.
-		if timeSincePing < cb.Config.PingTime {
+	for _, client := range cb.LocalUsers {
+		if client.sendQueueExceeded() {
+			client.quit("SendQ exceeded", true)
 			continue
 		}
 
-		// Don't send with a prefix. mIRC apparently will not recognize PING if we do.
-		// It will not respond and it will show the PING in its status window.
+		// Don't send with a prefix. mIRC apparently will not recognize PING if we
+		// do. It will not respond and it will show the PING in its status window.
 		// PING <source to reply to, us>
-		client.maybeQueueMessage(irc.Message{
-			Command: "PING",
-			Params:  []string{cb.Config.ServerName},
-		})
-
-		client.LastPingTime = now
+		if !client.checkIdle(now, cb.Config.PingTime, cb.Config.DeadTime,
+			irc.Message{
+				Command: "PING",
+				Params:  []string{cb.Config.ServerName},
+			}) {
+			client.quit(fmt.Sprintf("Ping timeout: %d seconds",
+				int(now.Sub(client.LastActivityTime).Seconds())), true)
+		}
 	}
 
 	for _, server := range cb.LocalServers {
@@ -844,33 +1111,17 @@ func (cb *Catbox) checkAndPingClients() {
 
 		// Its burst completed. Now we monitor the last time we heard from it
 		// and possibly ping it.
-
-		timeIdle := now.Sub(server.LastActivityTime)
-
-		// Was it active recently enough that we don't need to do anything?
-		if timeIdle < cb.Config.PingTime {
-			continue
-		}
-
-		// It's been idle a while.
-
-		// Has it been idle long enough that we consider it dead?
-		if timeIdle > cb.Config.DeadTime {
+		//
+		// PING origin is our SID for servers.
+		if !server.checkIdle(now, cb.Config.PingTime, cb.Config.DeadTime,
+			irc.Message{
+				Prefix:  string(cb.Config.TS6SID),
+				Command: "PING",
+				Params:  []string{string(cb.Config.TS6SID)},
+			}) {
 			server.quit(fmt.Sprintf("Ping timeout: %d seconds",
-				int(timeIdle.Seconds())))
-			continue
-		}
-
-		timeSincePing := now.Sub(server.LastPingTime)
-
-		// Should we ping it? We might have pinged it recently.
-		if timeSincePing < cb.Config.PingTime {
-			continue
+				int(now.Sub(server.LastActivityTime).Seconds())))
 		}
-
-		// PING origin is our SID for servers.
-		server.messageFromServer("PING", []string{string(cb.Config.TS6SID)})
-		server.LastPingTime = now
 	}
 }
 
@@ -891,7 +1142,11 @@ func (cb *Catbox) checkAndPingClients() {
 // happening rather than make it impossible. Mainly because I am not sure a
 // simple way to make it impossible.
 func (cb *Catbox) connectToServers() {
-	now := time.Now()
+	if cb.Config.Standalone {
+		return
+	}
+
+	now := cb.now()
 
 	// Delay between any connection attempt. This means we try to connect to at
 	// most one server, and then wait ConnectAttemptTime before trying any others.
@@ -914,6 +1169,10 @@ func (cb *Catbox) connectToServers() {
 				continue
 			}
 
+			if cb.isLinkSuspended(linkInfo.Name) {
+				continue
+			}
+
 			cb.LinkQueue = append(cb.LinkQueue, linkInfo)
 		}
 	}
@@ -975,6 +1234,11 @@ func (cb *Catbox) floodControl() {
 			user.MessageCounter++
 		}
 
+		if len(user.MessageQueue) > 0 {
+			cb.debugf("flood", "%s has %d queued messages and may send %d",
+				user.User.DisplayNick, len(user.MessageQueue), user.MessageCounter)
+		}
+
 		// Process their queued messages until their message counter hits zero.
 		for user.MessageCounter > 0 && len(user.MessageQueue) > 0 {
 			// Pull a message off the queue.
@@ -1007,21 +1271,30 @@ func (cb *Catbox) isLinkedToServer(name string) bool {
 //
 // Do this in a goroutine to avoid blocking the main server goroutine.
 func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
+	status := cb.linkStatus(linkInfo.Name)
+	status.LastAttempt = cb.now()
+	status.LastFailure = ""
+
 	cb.WG.Add(1)
 
 	go func() {
 		defer cb.WG.Done()
 
+		cfg := cb.config()
+
 		var conn net.Conn
 		var err error
 
-		if linkInfo.TLS {
+		if cb.DialServer != nil {
+			cb.queueOperNoticeAbout("links", fmt.Sprintf("Connecting to %s...", linkInfo.Name))
+			conn, err = cb.DialServer(linkInfo)
+		} else if linkInfo.TLS {
 			if strings.HasSuffix(linkInfo.Hostname, ".i2p") {
-				cb.noticeOpers(fmt.Sprintf("Connecting to %s with I2P and TLS...", linkInfo.Name))
+				cb.queueOperNoticeAbout("links", fmt.Sprintf("Connecting to %s with I2P and TLS...", linkInfo.Name))
 
-				cb.noticeOpers(fmt.Sprintf("Connecting to %s with I2P...",
+				cb.queueOperNoticeAbout("links", fmt.Sprintf("Connecting to %s with I2P...",
 					linkInfo.Name))
-				I2PSession, err := sam.I2PStreamSession(cb.Config.ListenI2P+"-tls-"+linkInfo.Hostname, cb.Config.SAMAddress, cb.Config.ListenI2P+"-tls-"+linkInfo.Hostname)
+				I2PSession, err := sam.I2PStreamSession(cfg.ListenI2P+"-tls-"+linkInfo.Hostname, cfg.SAMAddress, cfg.ListenI2P+"-tls-"+linkInfo.Hostname)
 				if err == nil {
 					conn, err = I2PSession.Dial("tcp", linkInfo.Hostname)
 					if err == nil {
@@ -1029,51 +1302,50 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 					}
 				}
 			} else {
-				cb.noticeOpers(fmt.Sprintf("Connecting to %s with TLS...", linkInfo.Name))
+				cb.queueOperNoticeAbout("links", fmt.Sprintf("Connecting to %s with TLS...", linkInfo.Name))
 
-				dialer := &net.Dialer{
-					Timeout: cb.Config.DeadTime,
-				}
-				conn, err = tls.DialWithDialer(dialer, "tcp",
-					fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port), cb.TLSConfig)
+				conn, err = cb.dialLink(linkInfo)
 			}
 		} else if strings.HasSuffix(linkInfo.Hostname, ".i2p") {
-			cb.noticeOpers(fmt.Sprintf("Connecting to %s with I2P...",
+			cb.queueOperNoticeAbout("links", fmt.Sprintf("Connecting to %s with I2P...",
 				linkInfo.Name))
-			I2PSession, err := sam.I2PStreamSession(cb.Config.ListenI2P+"-"+linkInfo.Hostname, cb.Config.SAMAddress, cb.Config.ListenI2P+"-"+linkInfo.Hostname)
+			I2PSession, err := sam.I2PStreamSession(cfg.ListenI2P+"-"+linkInfo.Hostname, cfg.SAMAddress, cfg.ListenI2P+"-"+linkInfo.Hostname)
 			if err == nil {
 				conn, err = I2PSession.Dial("tcp", linkInfo.Hostname)
 			}
 		} else {
-			cb.noticeOpers(fmt.Sprintf("Connecting to %s without TLS...",
+			cb.queueOperNoticeAbout("links", fmt.Sprintf("Connecting to %s without TLS...",
 				linkInfo.Name))
-			conn, err = net.DialTimeout("tcp",
-				fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port),
-				cb.Config.DeadTime)
+
+			conn, err = cb.dialLink(linkInfo)
 		}
 
 		if err != nil {
-			cb.noticeOpers(fmt.Sprintf("Unable to connect to server [%s]: %s",
+			cb.queueOperNoticeAbout("links", fmt.Sprintf("Unable to connect to server [%s]: %s",
 				linkInfo.Name, err))
+			cb.queueLinkFailure(linkInfo.Name, err.Error())
 			return
 		}
 
 		id := cb.getClientID()
 
 		client := NewLocalClient(cb, id, conn)
+		client.LinkTo = linkInfo.Name
 
-		if linkInfo.TLS {
+		if client.isTLS() {
 			tlsVersion, tlsCipherSuite, err := client.getTLSState()
 			if err != nil {
 				log.Printf("Disconnecting from server %s: %s", linkInfo.Name, err)
+				cb.queueLinkFailure(linkInfo.Name, err.Error())
 				_ = conn.Close() // nolint: gosec
 				return
 			}
 
 			if tlsVersion != "TLS 1.2" && tlsVersion != "TLS 1.3" {
-				cb.noticeOpers(fmt.Sprintf(
+				cb.queueOperNoticeAbout("links", fmt.Sprintf(
 					"Disconnecting from %s because of TLS version: %s", linkInfo.Name,
 					tlsVersion))
+				cb.queueLinkFailure(linkInfo.Name, "TLS version "+tlsVersion)
 				_ = conn.Close() // nolint: gosec
 				return
 			}
@@ -1097,56 +1369,233 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 	}()
 }
 
-// newEvent tells the server something happened.
-//
-// Any goroutine can call this function.
-//
-// It sends the server a message on its ToServerChan.
-//
-// It will not block on shutdown as we select on the shutdown channel which we
-// close when shutting down the server. This means receive on the shutdown
-// channel will proceed at that point.
-//
-// We only need to use this function in goroutines other the main server
-// goroutine.
-func (cb *Catbox) newEvent(evt Event) {
-	select {
-	case cb.ToServerChan <- evt:
-	case <-cb.ShutdownChan:
-	}
-}
+// LinkStatus is how our last attempt to connect to a server went.
+type LinkStatus struct {
+	// When we last tried to connect. Zero if we haven't.
+	LastAttempt time.Time
 
-// Send a message to all operator users.
-func (cb *Catbox) noticeOpers(msg string) {
-	log.Printf("Global oper notice: %s", msg)
+	// Why the last attempt failed. Blank if it hasn't failed (as far as we
+	// know).
+	LastFailure string
 
-	for _, user := range cb.Opers {
-		if user.isLocal() {
-			user.LocalUser.serverNotice(msg)
-			continue
+	// When it recently delinked from us. We use this to tell if the link is
+	// flapping.
+	Delinks []time.Time
+
+	// If the link is flapping, we don't connect to it automatically until this
+	// time.
+	SuspendedUntil time.Time
+}
+
+// linkStatus finds how our last attempt to connect to the server went. It
+// creates the record if there isn't one.
+func (cb *Catbox) linkStatus(name string) *LinkStatus {
+	if cb.LinkStatuses == nil {
+		cb.LinkStatuses = map[string]*LinkStatus{}
+	}
+	status, exists := cb.LinkStatuses[name]
+	if !exists {
+		status = &LinkStatus{}
+		cb.LinkStatuses[name] = status
+	}
+	return status
+}
+
+// recordDelink notes that a server delinked from us. If it has done so too
+// often lately, the link is flapping. Each time it connects we'd burst to it
+// and each time it goes we'd tell everyone about the split, so we stop
+// connecting to it for a while. Operators may still CONNECT to it.
+func (cb *Catbox) recordDelink(name string) {
+	if _, exists := cb.Config.Servers[name]; !exists ||
+		cb.Config.LinkFlapLimit == 0 {
+		return
+	}
+
+	status := cb.linkStatus(name)
+	now := cb.now()
+
+	var recent []time.Time
+	for _, t := range status.Delinks {
+		if now.Sub(t) < cb.Config.LinkFlapWindow {
+			recent = append(recent, t)
 		}
+	}
+	status.Delinks = append(recent, now)
 
-		user.ClosestServer.maybeQueueMessage(irc.Message{
-			Prefix:  string(cb.Config.TS6SID),
-			Command: "NOTICE",
-			Params: []string{
-				string(user.UID),
-				fmt.Sprintf("*** Notice --- %s", msg),
-			},
-		})
+	if len(status.Delinks) < cb.Config.LinkFlapLimit {
+		return
 	}
+
+	status.Delinks = nil
+	status.SuspendedUntil = now.Add(cb.Config.LinkFlapSuspendTime)
+	cb.noticeLocalOpersAbout("links", fmt.Sprintf(
+		"Link to %s is flapping (%d delinks in %s). Not connecting to it for %s. Use CONNECT to connect anyway.",
+		name, cb.Config.LinkFlapLimit, cb.Config.LinkFlapWindow,
+		cb.Config.LinkFlapSuspendTime))
 }
 
-// Send a message to all local operator users.
-func (cb *Catbox) noticeLocalOpers(msg string) {
-	log.Printf("Local oper notice: %s", msg)
+// isLinkSuspended checks if we stopped connecting to a server automatically
+// because its link is flapping.
+func (cb *Catbox) isLinkSuspended(name string) bool {
+	status, exists := cb.LinkStatuses[name]
+	return exists && cb.now().Before(status.SuspendedUntil)
+}
 
-	for _, user := range cb.Opers {
-		if user.isLocal() {
-			user.LocalUser.serverNotice(msg)
+// queueLinkFailure records why connecting to a server failed. Call it from
+// goroutines other than the server goroutine.
+func (cb *Catbox) queueLinkFailure(name, reason string) {
+	cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() {
+			cb.linkStatus(name).LastFailure = reason
+		},
+	})
+}
+
+// linkDialer builds the dialer to use to connect to a server.
+//
+// If configured, we bind to a particular local address or to an address of a
+// particular network interface. The server's link information takes precedence
+// over the global settings.
+func (cb *Catbox) linkDialer(linkInfo *ServerDefinition) (*net.Dialer, error) {
+	cfg := cb.config()
+
+	dialer := &net.Dialer{
+		Timeout: cfg.LinkConnectTimeout,
+	}
+
+	bindAddress := cfg.LinkBindAddress
+	bindInterface := cfg.LinkBindInterface
+	if linkInfo.BindAddress != "" || linkInfo.BindInterface != "" {
+		bindAddress = linkInfo.BindAddress
+		bindInterface = linkInfo.BindInterface
+	}
+
+	if bindAddress == "" && bindInterface == "" {
+		return dialer, nil
+	}
+
+	host, port := "", "0"
+	if bindAddress != "" {
+		host, port = splitBindAddress(bindAddress)
+	}
+
+	if bindInterface != "" {
+		ip, err := interfaceIP(bindInterface, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	}
+
+	localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address: %s", err)
+	}
+	dialer.LocalAddr = localAddr
+
+	return dialer, nil
+}
+
+// interfaceIP finds an IP on the named network interface to bind to.
+//
+// If want is set, the interface must have that IP. Otherwise we prefer an IPv4
+// address as we can't know ahead of time which family the remote side will
+// resolve to.
+func interfaceIP(name, want string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface %s: %s", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get addresses of interface %s: %s", name,
+			err)
+	}
+
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if want != "" {
+			if ipNet.IP.Equal(net.ParseIP(want)) {
+				return ipNet.IP, nil
+			}
 			continue
 		}
+
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+
+	if found == nil {
+		if want != "" {
+			return nil, fmt.Errorf("interface %s does not have address %s", name,
+				want)
+		}
+		return nil, fmt.Errorf("interface %s has no usable address", name)
 	}
+
+	return found, nil
+}
+
+// newEvent tells the server something happened.
+//
+// Any goroutine can call this function.
+//
+// It sends the server a message on its ToServerChan.
+//
+// It will not block on shutdown as we select on the shutdown channel which we
+// close when shutting down the server. This means receive on the shutdown
+// channel will proceed at that point.
+//
+// We only need to use this function in goroutines other the main server
+// goroutine.
+func (cb *Catbox) newEvent(evt Event) {
+	evt.Queued = cb.now()
+
+	select {
+	case cb.ToServerChan <- evt:
+	case <-cb.ShutdownChan:
+	}
+}
+
+// cloakedHostname is the hostname we give every user under the anonymous
+// privacy profile.
+func (cb *Catbox) cloakedHostname() string {
+	if cb.Config.CloakSuffix == "" {
+		return "anonymous"
+	}
+	return "anonymous." + cb.Config.CloakSuffix
+}
+
+// publicIP is the user's IP as we show or send it to others. Under the
+// anonymous privacy profile our users' IPs stay with us, so it's 0, as TS6
+// says to send when we don't want to reveal it.
+func (cb *Catbox) publicIP(u *User) string {
+	if u.isLocal() && cb.Config.PrivacyProfile == PrivacyProfileAnonymous {
+		return "0"
+	}
+	return u.IP
+}
+
+// Send a message to all operator users.
+func (cb *Catbox) noticeOpers(msg string) {
+	cb.noticeOpersAbout("", msg)
+}
+
+// Send a message to all local operator users.
+func (cb *Catbox) noticeLocalOpers(msg string) {
+	cb.noticeLocalOpersAbout("", msg)
 }
 
 // Store a KLINE locally, and then check if any connected local users match
@@ -1154,42 +1603,172 @@ func (cb *Catbox) noticeLocalOpers(msg string) {
 //
 // This function does not propagate to any other servers.
 //
-// KLines are currently always permanent locally.
+// KLines last until they expire, or for the runtime if they're permanent.
 func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
-	// If it's a duplicate KLINE, ignore it.
-	for _, k := range cb.KLines {
-		if k.UserMask != kline.UserMask {
-			continue
-		}
-		if k.HostMask != kline.HostMask {
+	kline.Reason = reason
+	cb.addAndApplyKLines([]KLine{kline}, source)
+}
+
+// Store several KLINEs locally, and then cut off any connected local users
+// matching any of them.
+//
+// We look at each local user at most once no matter how many K-Lines we are
+// given. K-Lines with an exact host mask (no wildcards) we look up in the
+// HostUsers index rather than scanning all users. The idea is that applying a
+// large number of bans at once does not stall the event loop.
+//
+// This function does not propagate to any other servers.
+func (cb *Catbox) addAndApplyKLines(klines []KLine, source string) {
+	added := []KLine{}
+
+	for _, kline := range klines {
+		// If it's a duplicate KLINE, ignore it.
+		if cb.hasKLine(kline.UserMask, kline.HostMask) {
+			cb.noticeOpersAbout("klines", fmt.Sprintf(
+				"Ignoring duplicate K-Line for [%s@%s] from %s", kline.UserMask,
+				kline.HostMask, source))
 			continue
 		}
-		cb.noticeOpers(fmt.Sprintf("Ignoring duplicate K-Line for [%s@%s] from %s",
-			k.UserMask, k.HostMask, source))
+
+		cb.KLines = append(cb.KLines, kline)
+		added = append(added, kline)
+
+		cb.noticeOpersAbout("klines", fmt.Sprintf("%s added K-Line for [%s@%s] [%s]",
+			source, kline.UserMask, kline.HostMask, kline.Reason))
+	}
+
+	if len(added) == 0 {
 		return
 	}
 
-	cb.KLines = append(cb.KLines, kline)
+	// Do we have any matching users connected? Find them all before cutting any
+	// off as quitting alters the maps we look through.
+	//
+	// Client ID to the K-Line they matched.
+	matches := make(map[uint64]KLine)
+
+	// HostUsers finds users by hostname. K-Lines on an IP may match users by
+	// their IP, so we look through everyone for those too.
+	unindexedKLines := []KLine{}
+	for _, kline := range added {
+		if !isLiteralMask(kline.HostMask) || net.ParseIP(kline.HostMask) != nil {
+			unindexedKLines = append(unindexedKLines, kline)
+			continue
+		}
 
-	cb.noticeOpers(fmt.Sprintf("%s added K-Line for [%s@%s] [%s]",
-		source, kline.UserMask, kline.HostMask, reason))
+		for id, user := range cb.HostUsers[kline.HostMask] {
+			if _, exists := matches[id]; exists {
+				continue
+			}
+			if !matchMask(kline.UserMask, user.User.Username) {
+				continue
+			}
+			matches[id] = kline
+		}
+	}
 
-	// Do we have any matching users connected? Cut them off if so.
+	if len(unindexedKLines) > 0 {
+		for id, user := range cb.LocalUsers {
+			if _, exists := matches[id]; exists {
+				continue
+			}
 
-	quitReason := fmt.Sprintf("Connection closed: %s", reason)
+			for _, kline := range unindexedKLines {
+				if !user.User.matchesMask(kline.UserMask, kline.HostMask) {
+					continue
+				}
+				matches[id] = kline
+				break
+			}
+		}
+	}
 
-	for _, user := range cb.LocalUsers {
-		if !user.User.matchesMask(kline.UserMask, kline.HostMask) {
+	for id, kline := range matches {
+		user, exists := cb.LocalUsers[id]
+		if !exists {
 			continue
 		}
 
-		user.quit(quitReason, true)
+		user.quit(cb.messageText("kline-quit", user.User.DisplayNick, "reason",
+			kline.Reason), true)
 
-		cb.noticeOpers(fmt.Sprintf("User disconnected due to K-Line: %s",
+		cb.noticeOpersAbout("klines", fmt.Sprintf("User disconnected due to K-Line: %s",
 			user.User.DisplayNick))
 	}
 }
 
+// Count the users a K-Line would match. Local users, then all users.
+func (cb *Catbox) countKLineMatches(userMask, hostMask string) (int, int) {
+	local, global := 0, 0
+	for _, user := range cb.Users {
+		if !user.matchesMask(userMask, hostMask) {
+			continue
+		}
+		global++
+		if user.isLocal() {
+			local++
+		}
+	}
+	return local, global
+}
+
+// Find the local users matching a MASSKILL mask. If cidr is set, we match it
+// against their IP rather than matching the host mask against their hostname.
+// We skip operators.
+func (cb *Catbox) massKillMatches(userMask, hostMask string,
+	cidr *net.IPNet) []*LocalUser {
+	var matches []*LocalUser
+	for _, lu := range cb.LocalUsers {
+		if lu.User.isOperator() || !matchMask(userMask, lu.User.Username) {
+			continue
+		}
+
+		if cidr != nil {
+			ip := net.ParseIP(lu.User.IP)
+			if ip == nil || !cidr.Contains(ip) {
+				continue
+			}
+		} else if !matchMask(hostMask, lu.User.Hostname) {
+			continue
+		}
+
+		matches = append(matches, lu)
+	}
+	return matches
+}
+
+// Determine if we have a K-Line with exactly the given masks.
+func (cb *Catbox) hasKLine(userMask, hostMask string) bool {
+	for _, kline := range cb.KLines {
+		if kline.UserMask == userMask && kline.HostMask == hostMask {
+			return true
+		}
+	}
+	return false
+}
+
+// Record a local user in the HostUsers index. Call this when they register.
+func (cb *Catbox) addHostUser(lu *LocalUser) {
+	users, exists := cb.HostUsers[lu.User.Hostname]
+	if !exists {
+		users = make(map[uint64]*LocalUser)
+		cb.HostUsers[lu.User.Hostname] = users
+	}
+	users[lu.ID] = lu
+}
+
+// Forget a local user from the HostUsers index.
+func (cb *Catbox) removeHostUser(lu *LocalUser) {
+	users, exists := cb.HostUsers[lu.User.Hostname]
+	if !exists {
+		return
+	}
+	delete(users, lu.ID)
+	if len(users) == 0 {
+		delete(cb.HostUsers, lu.User.Hostname)
+	}
+}
+
 func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
 	idx := -1
 	for i, kline := range cb.KLines {
@@ -1201,19 +1780,41 @@ func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
 	}
 
 	if idx == -1 {
-		cb.noticeOpers(fmt.Sprintf("Not removing K-Line for [%s@%s] (not found)",
+		cb.noticeOpersAbout("klines", fmt.Sprintf("Not removing K-Line for [%s@%s] (not found)",
 			userMask, hostMask))
 		return false
 	}
 
 	cb.KLines = append(cb.KLines[:idx], cb.KLines[idx+1:]...)
 
-	cb.noticeOpers(fmt.Sprintf("%s removed K-Line for [%s@%s]",
+	cb.noticeOpersAbout("klines", fmt.Sprintf("%s removed K-Line for [%s@%s]",
 		source, userMask, hostMask))
 
 	return true
 }
 
+// Forget K-Lines whose time is up.
+func (cb *Catbox) expireKLines() {
+	now := cb.now()
+
+	klines := cb.KLines[:0]
+	for _, kline := range cb.KLines {
+		if kline.Expires.IsZero() || now.Before(kline.Expires) {
+			klines = append(klines, kline)
+			continue
+		}
+
+		cb.noticeOpersAbout("klines", fmt.Sprintf("K-Line for [%s@%s] expired", kline.UserMask,
+			kline.HostMask))
+	}
+	cb.KLines = klines
+}
+
+// Determine if a server mask, such as in ENCAP or KLINE ON, includes us.
+func (cb *Catbox) isServerTarget(mask string) bool {
+	return matchMask(strings.ToLower(mask), strings.ToLower(cb.Config.ServerName))
+}
+
 // Issue a KILL from this server.
 //
 // We send a KILL message to each server.
@@ -1352,7 +1953,34 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 	})
 
 	// 319 RPL_WHOISCHANNELS
-	// I choose to not show any.
+	// We leave out secret channels the asker is not on. If the user is +p, we
+	// show non-operators only the channels they share. We never show
+	// non-operators anonymous channels.
+	var channels []string
+	for _, channel := range user.Channels {
+		if replyUser != user && !replyUser.isOperator() {
+			if channel.isAnonymous() {
+				continue
+			}
+			if !replyUser.onChannel(channel) &&
+				(channel.hasMode('s') || user.isPrivate()) {
+				continue
+			}
+		}
+		channels = append(channels, channel.memberPrefix(user)+channel.Name)
+	}
+	if len(channels) > 0 {
+		sort.Strings(channels)
+		channelMsgs, err := splitListMessage(irc.Message{
+			Prefix:  from,
+			Command: "319",
+			Params:  []string{to, user.DisplayNick, ""},
+		}, channels)
+		if err != nil {
+			log.Printf("Unable to generate RPL_WHOISCHANNELS: %s", err)
+		}
+		msgs = append(msgs, channelMsgs...)
+	}
 
 	// 312 RPL_WHOISSERVER
 	msgs = append(msgs, irc.Message{
@@ -1379,6 +2007,20 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		})
 	}
 
+	// 330 RPL_WHOISACCOUNT. Non standard. Ratbox uses it.
+	if len(user.Account) > 0 {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "330",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				user.Account,
+				"is logged in as",
+			},
+		})
+	}
+
 	// 313 RPL_WHOISOPERATOR
 	if user.isOperator() {
 		msgs = append(msgs, irc.Message{
@@ -1387,7 +2029,29 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 			Params: []string{
 				to,
 				user.DisplayNick,
-				"is an IRC operator",
+				cb.userMessageText(replyUser, "whois-operator"),
+			},
+		})
+	}
+
+	// 335 RPL_WHOISBOT
+	if user.isBot() {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "335",
+			Params:  []string{to, user.DisplayNick, "is a bot"},
+		})
+	}
+
+	// 320 RPL_WHOISSPECIAL. Non standard. Only operators see the user's ID.
+	if replyUser.isOperator() {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "320",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				fmt.Sprintf("has unique ID %s", user.UID),
 			},
 		})
 	}
@@ -1414,7 +2078,7 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 
 	// 317 RPL_WHOISIDLE. Only if local.
 	if user.isLocal() {
-		idleDuration := time.Since(user.LocalUser.LastMessageTime)
+		idleDuration := cb.now().Sub(user.LocalUser.LastMessageTime)
 		idleSeconds := int(idleDuration.Seconds())
 
 		msgs = append(msgs, irc.Message{
@@ -1445,6 +2109,153 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 	return msgs
 }
 
+// Build the reply to TIME: our current time. If the reply is going to a remote
+// user, set useIDs so the reply uses IDs for us and the user.
+func (cb *Catbox) createTIMEResponse(replyUser *User, useIDs bool) irc.Message {
+	from := cb.Config.ServerName
+	to := replyUser.DisplayNick
+	if useIDs {
+		from = string(cb.Config.TS6SID)
+		to = string(replyUser.UID)
+	}
+
+	// 391 RPL_TIME
+	return irc.Message{
+		Prefix:  from,
+		Command: "391",
+		Params: []string{
+			to,
+			cb.Config.ServerName,
+			cb.now().Format(time.RFC1123),
+		},
+	}
+}
+
+// Build the replies to ADMIN: who runs this server. If the reply is going to a
+// remote user, set useIDs so the replies use IDs for us and the user.
+func (cb *Catbox) createADMINResponse(replyUser *User,
+	useIDs bool) []irc.Message {
+	cfg := cb.Config
+
+	from := cfg.ServerName
+	to := replyUser.DisplayNick
+	if useIDs {
+		from = string(cfg.TS6SID)
+		to = string(replyUser.UID)
+	}
+
+	if cfg.AdminLocation == "" && cfg.AdminName == "" && cfg.AdminEmail == "" {
+		// 423 ERR_NOADMININFO
+		return []irc.Message{{
+			Prefix:  from,
+			Command: "423",
+			Params: []string{to, cfg.ServerName,
+				"No administrative info available"},
+		}}
+	}
+
+	return []irc.Message{
+		// 256 RPL_ADMINME
+		{Prefix: from, Command: "256",
+			Params: []string{to, cfg.ServerName, "Administrative info"}},
+		// 257 RPL_ADMINLOC1
+		{Prefix: from, Command: "257", Params: []string{to, cfg.AdminLocation}},
+		// 258 RPL_ADMINLOC2
+		{Prefix: from, Command: "258", Params: []string{to, cfg.AdminName}},
+		// 259 RPL_ADMINEMAIL
+		{Prefix: from, Command: "259", Params: []string{to, cfg.AdminEmail}},
+	}
+}
+
+// Build the replies to LUSERS: how many users, servers, and channels there
+// are. If the reply is going to a remote user, set useIDs so the replies use
+// IDs for us and the user.
+//
+// We keep the counts as things change rather than counting here. Users is
+// every user on the network, and each server counts its users.
+func (cb *Catbox) createLUSERSResponse(replyUser *User,
+	useIDs bool) []irc.Message {
+	from := cb.Config.ServerName
+	to := replyUser.DisplayNick
+	if useIDs {
+		from = string(cb.Config.TS6SID)
+		to = string(replyUser.UID)
+	}
+
+	reply := func(command string, params ...string) irc.Message {
+		return irc.Message{
+			Prefix:  from,
+			Command: command,
+			Params:  append([]string{to}, params...),
+		}
+	}
+
+	// We always send RPL_LUSERCLIENT and RPL_LUSERME.
+	// The others only need be sent if the counts are non-zero.
+
+	// 251 RPL_LUSERCLIENT
+	services := 0
+	if server := cb.getServerByName(cb.Config.ServicesServer); server != nil &&
+		cb.isServices(server) {
+		services = server.UserCount
+	}
+	msgs := []irc.Message{
+		reply("251", cb.userMessageText(replyUser, "lusers",
+			"users", fmt.Sprintf("%d", len(cb.Users)-services),
+			"services", fmt.Sprintf("%d", services),
+			// +1 to count ourself.
+			"servers", fmt.Sprintf("%d", len(cb.Servers)+1))),
+	}
+
+	// 252 RPL_LUSEROP
+	if len(cb.Opers) > 0 {
+		msgs = append(msgs, reply("252", fmt.Sprintf("%d", len(cb.Opers)),
+			"operator(s) online"))
+	}
+
+	// 253 RPL_LUSERUNKNOWN
+	// Unregistered connections.
+	if len(cb.LocalClients) > 0 {
+		msgs = append(msgs, reply("253", fmt.Sprintf("%d", len(cb.LocalClients)),
+			"unknown connection(s)"))
+	}
+
+	// 254 RPL_LUSERCHANNELS
+	// RFC 2811 says to not include +s channels in this count. But I do.
+	if len(cb.Channels) > 0 {
+		msgs = append(msgs, reply("254", fmt.Sprintf("%d", len(cb.Channels)),
+			"channels formed"))
+	}
+
+	msgs = append(msgs,
+		// 255 RPL_LUSERME
+		reply("255", fmt.Sprintf("I have %d clients and %d servers",
+			len(cb.LocalUsers), len(cb.LocalServers))),
+
+		// 265 tells current local user count and max. Not standard.
+		reply("265", fmt.Sprintf("%d", len(cb.LocalUsers)),
+			fmt.Sprintf("%d", cb.HighestLocalUserCount),
+			fmt.Sprintf("Current local users %d, max %d", len(cb.LocalUsers),
+				cb.HighestLocalUserCount)),
+
+		// 266 tells global user count and max. Not standard.
+		reply("266", fmt.Sprintf("%d", len(cb.Users)),
+			fmt.Sprintf("%d", cb.HighestGlobalUserCount),
+			fmt.Sprintf("Current global users %d, max %d", len(cb.Users),
+				cb.HighestGlobalUserCount)),
+
+		// 250 tells highest total connections, highest total local users (again,
+		// it does seem like ratbox does this), and the total number of
+		// connections received. Again this is not standard, but interesting.
+		reply("250", fmt.Sprintf(
+			"Highest connection count: %d (%d clients) (%d connections received)",
+			cb.HighestConnectionCount, cb.HighestLocalUserCount,
+			cb.ConnectionCount)),
+	)
+
+	return msgs
+}
+
 // Update some of our counters.
 //
 // We track the maximum number of local users we've seen, and the maximum
@@ -1493,6 +2304,17 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 				continue
 			}
 
+			// A QUIT would say who they were. Members of anonymous channels see an
+			// anonymous PART instead.
+			if channel.isAnonymous() {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  anonymousPrefix,
+					Command: "PART",
+					Params:  []string{channel.Name},
+				})
+				continue
+			}
+
 			_, exists := informedUsers[member.UID]
 			if exists {
 				continue
@@ -1514,64 +2336,177 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 
 	// Forget the user.
 	delete(cb.Users, u.UID)
+	u.Server.UserCount--
+	cb.releaseUser(u)
 	if u.isOperator() {
 		delete(cb.Opers, u.UID)
 	}
 	delete(cb.Nicks, canonicalizeNick(u.DisplayNick))
+	cb.nickOffline(canonicalizeNick(u.DisplayNick))
+}
+
+// Rehash asks the server to reload its configuration. This does the same as
+// sending the process SIGHUP or an operator issuing REHASH.
+//
+// It is safe to call from any goroutine. The server reports the outcome to
+// operators and in its log.
+func (cb *Catbox) Rehash() {
+	cb.newEvent(Event{Type: RehashEvent})
+}
+
+// RequestRestart asks the server to restart. This does the same as an
+// operator issuing RESTART.
+//
+// It is safe to call from any goroutine.
+func (cb *Catbox) RequestRestart() {
+	cb.newEvent(Event{Type: RestartEvent})
+}
+
+// RequestShutdown asks the server to shut down. This does the same as an
+// operator issuing DIE.
+//
+// It is safe to call from any goroutine.
+func (cb *Catbox) RequestShutdown() {
+	cb.newEvent(Event{Type: ShutdownEvent})
 }
 
-// Rehash reloads our config.
+// rehash reloads our config.
 //
-// Only certain config options can change during rehash.
+// Only certain config options can change during rehash. This includes which
+// ports we listen on. We open new listeners and close ones no longer
+// configured. Closing a listener does not affect clients already connected
+// through it.
 //
-// We could close listeners and open new ones. But nah.
-func (cb *Catbox) rehash(byUser *User) {
-	cfg, err := checkAndParseConfig(cb.ConfigFile)
+// The reload is all or nothing. We parse the new configuration and load
+// anything it refers to (such as the certificate) before changing anything.
+// If there is a problem we keep running with the old configuration. Otherwise
+// we swap in the new configuration in one step, and return the problem.
+func (cb *Catbox) rehash(byUser *User) error {
+	cfg, cert, err := cb.loadRehashConfig()
 	if err != nil {
-		cb.noticeOpers(fmt.Sprintf("Rehash: Configuration problem: %s", err))
-		return
+		cb.noticeOpers(fmt.Sprintf(
+			"Rehash: Configuration problem: %s. Keeping the current configuration.",
+			err))
+		log.Printf("%+v", err)
+		return err
+	}
+
+	if err := cb.updateListeners(cfg); err != nil {
+		cb.noticeOpers(fmt.Sprintf(
+			"Rehash: Unable to update listeners: %s. Keeping the current configuration.",
+			err))
+		return err
 	}
 
-	// Changing these requires closing/reopening listeners:
-	// ListenHost
-	// ListenPort
-	// ListenPortTLS
+	cb.setConfig(cfg)
+	cb.updateCaps()
+	if cert != nil {
+		cb.setCertificate(cert)
+		// Look at when the new one expires right away.
+		cb.CertificateCheckedAt = time.Time{}
+	}
 
-	cb.Config.CertificateFile = cfg.CertificateFile
-	cb.Config.KeyFile = cfg.KeyFile
-	if err := cb.loadCertificate(); err != nil {
-		cb.noticeOpers(fmt.Sprintf("Error loading certificate/key: %s", err))
-		log.Printf("%+v", err)
+	if byUser != nil {
+		cb.noticeOpers(fmt.Sprintf("%s rehashed configuration.",
+			byUser.DisplayNick))
+	} else {
+		cb.noticeOpers("Rehashed configuration.")
+	}
+	return nil
+}
+
+// loadRehashConfig reads and validates the config file. It returns the
+// configuration to use after the rehash, and the certificate if we should
+// replace it.
+//
+// It does not change the server's state.
+func (cb *Catbox) loadRehashConfig() (*Config, *tls.Certificate, error) {
+	newCfg, err := checkAndParseConfig(cb.ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Start from the current configuration. Some options we can't change live.
+	cfg := *cb.Config
+
+	// We open and close listeners to match these.
+	cfg.ListenHost = newCfg.ListenHost
+	cfg.ListenPort = newCfg.ListenPort
+	cfg.ListenPortTLS = newCfg.ListenPortTLS
+
+	// We only load a certificate if we set up TLS at startup.
+	var cert *tls.Certificate
+	if cb.TLSConfig != nil {
+		cert, err = readCertificate(newCfg.CertificateFile, newCfg.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
+	cfg.CertificateFile = newCfg.CertificateFile
+	cfg.KeyFile = newCfg.KeyFile
 
 	// Changing these may require relinking servers as they are part of the
 	// link handshake:
 	// ServerName
 	// ServerInfo
 
-	cb.Config.MOTD = cfg.MOTD
+	cfg.MOTD = newCfg.MOTD
+	cfg.MOTDFile = newCfg.MOTDFile
+	cfg.OperMOTD = newCfg.OperMOTD
+	cfg.OperMOTDFile = newCfg.OperMOTDFile
+	cfg.Rules = newCfg.Rules
+	cfg.RulesFile = newCfg.RulesFile
 
 	// MaxNickLength: I think this is not acceptable to change live. Live clients
 	// might turn out to be invalid, plus there is the issue of remote clients.
 
-	cb.Config.PingTime = cfg.PingTime
-	cb.Config.DeadTime = cfg.DeadTime
-	cb.Config.ConnectAttemptTime = cfg.ConnectAttemptTime
+	cfg.PingTime = newCfg.PingTime
+	cfg.DeadTime = newCfg.DeadTime
+	cfg.LineTime = newCfg.LineTime
+	cfg.RegistrationTime = newCfg.RegistrationTime
+	cfg.ConnectAttemptTime = newCfg.ConnectAttemptTime
+	cfg.LinkFlapLimit = newCfg.LinkFlapLimit
+	cfg.LinkFlapWindow = newCfg.LinkFlapWindow
+	cfg.LinkFlapSuspendTime = newCfg.LinkFlapSuspendTime
+	cfg.RelinkGraceTime = newCfg.RelinkGraceTime
+	cfg.MaxHopCount = newCfg.MaxHopCount
+	cfg.MaxTargets = newCfg.MaxTargets
+	cfg.TargetChangeTime = newCfg.TargetChangeTime
+	cfg.UnknownCommandLimit = newCfg.UnknownCommandLimit
+	cfg.IgnoreCommands = newCfg.IgnoreCommands
+	cfg.ResvNicks = newCfg.ResvNicks
+	cfg.NickDelay = newCfg.NickDelay
+	cfg.NickInUseAction = newCfg.NickInUseAction
+	cfg.RecycleClientIDs = newCfg.RecycleClientIDs
+	cfg.ChannelsExportFile = newCfg.ChannelsExportFile
+	cfg.OperNoticesFile = newCfg.OperNoticesFile
+	cfg.DisabledCaps = newCfg.DisabledCaps
+	cfg.STSDuration = newCfg.STSDuration
+	cfg.STSPort = newCfg.STSPort
+	cfg.ChannelsExportInterval = newCfg.ChannelsExportInterval
 
 	// TS6SID: Changing this requires relinking. It is part of link handshake.
 
-	cb.Config.AdminEmail = cfg.AdminEmail
-
-	cb.Config.Opers = cfg.Opers
-	cb.Config.Servers = cfg.Servers
-	cb.Config.UserConfigs = cfg.UserConfigs
-
-	if byUser != nil {
-		cb.noticeOpers(fmt.Sprintf("%s rehashed configuration.",
-			byUser.DisplayNick))
-	} else {
-		cb.noticeOpers("Rehashed configuration.")
-	}
+	cfg.AdminLocation = newCfg.AdminLocation
+	cfg.AdminName = newCfg.AdminName
+	cfg.AdminEmail = newCfg.AdminEmail
+
+	cfg.Opers = newCfg.Opers
+	cfg.Servers = newCfg.Servers
+	cfg.LinkBindAddress = newCfg.LinkBindAddress
+	cfg.LinkBindInterface = newCfg.LinkBindInterface
+	cfg.LinkConnectTimeout = newCfg.LinkConnectTimeout
+	cfg.LinkPreferIPv4 = newCfg.LinkPreferIPv4
+	cfg.LinkFallbackDelay = newCfg.LinkFallbackDelay
+	cfg.LinkCAFile = newCfg.LinkCAFile
+	cfg.StrictLinks = newCfg.StrictLinks
+	cfg.UserConfigs = newCfg.UserConfigs
+	cfg.WebIRCGateways = newCfg.WebIRCGateways
+	cfg.ClientPassword = newCfg.ClientPassword
+	cfg.ClientPasswords = newCfg.ClientPasswords
+	cfg.GuestListeners = newCfg.GuestListeners
+
+	return &cfg, cert, nil
 }
 
 // Restart initiates shutdown and flags us so we restart our process.
@@ -1582,10 +2517,10 @@ func (cb *Catbox) restart(byUser *User) {
 		cb.noticeOpers("Restarting.")
 	}
 
-	// We shutdown everything, then flag to restart. This means when we exit our
+	// We flag to restart, then shutdown everything. This means when we exit our
 	// main loop we'll start a new process.
-	cb.shutdown()
 	cb.Restart = true
+	cb.shutdown()
 }
 
 // Look up a server by its name. e.g., irc.example.com
@@ -1598,8 +2533,29 @@ func (cb *Catbox) getServerByName(name string) *Server {
 	return nil
 }
 
+// Look up the server a message came from. The source may be a server's SID or
+// a user's UID. For a local user or a source we don't know, this is nil.
+func (cb *Catbox) sourceServer(source string) *Server {
+	if server, exists := cb.Servers[TS6SID(source)]; exists {
+		return server
+	}
+	if user, exists := cb.Users[TS6UID(source)]; exists {
+		return user.Server
+	}
+	return nil
+}
+
+// Determine if the server is the services server.
+func (cb *Catbox) isServices(server *Server) bool {
+	return server != nil && cb.Config.ServicesServer != "" &&
+		strings.EqualFold(server.Name, cb.Config.ServicesServer)
+}
+
 // Send a message to all local users in a channel.
 func (cb *Catbox) messageLocalUsersOnChannel(channel *Channel, m irc.Message) {
+	cb.assertOwner()
+
+	var recipients []*LocalClient
 	for memberUID := range channel.Members {
 		member := cb.Users[memberUID]
 
@@ -1607,7 +2563,26 @@ func (cb *Catbox) messageLocalUsersOnChannel(channel *Channel, m irc.Message) {
 			continue
 		}
 
-		member.LocalUser.maybeQueueMessage(m)
+		recipients = append(recipients, member.LocalUser.LocalClient)
+	}
+
+	cb.fanOut(recipients, m)
+}
+
+// kickUser tells our users in the channel that origin kicked the user, and
+// removes the user from it. It does not tell any servers.
+func (cb *Catbox) kickUser(channel *Channel, origin string, target *User,
+	reason string) {
+	cb.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  origin,
+		Command: "KICK",
+		Params:  []string{channel.Name, target.DisplayNick, reason},
+	})
+
+	channel.removeUser(target)
+
+	if len(channel.Members) == 0 {
+		delete(cb.Channels, channel.Name)
 	}
 }
 
@@ -2,6 +2,9 @@ package terrarium
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -70,3 +73,267 @@ func TestErrorToQuitMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestRehash(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "catbox.conf")
+
+	cb := &Catbox{
+		ConfigFile: configFile,
+		Config: &Config{
+			ServerName:    "irc.example.com",
+			MOTD:          "old motd",
+			DeadTime:      time.Minute,
+			ListenPort:    "-1",
+			ListenPortTLS: "-1",
+		},
+		Opers:     map[TS6UID]*User{},
+		Listeners: map[string]*Listener{},
+	}
+	oldConfig := cb.Config
+
+	// A bad config must leave us as we were.
+	if err := ioutil.WriteFile(configFile,
+		[]byte("listen-port = -1\nmotd = new motd\nping-time = bogus\n"),
+		0600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	if cb.Config != oldConfig || cb.Config.MOTD != "old motd" {
+		t.Errorf("bad config changed configuration")
+	}
+
+	if err := ioutil.WriteFile(configFile,
+		[]byte("listen-port = -1\nmotd = new motd\nserver-name = irc2.example.com\n"),
+		0600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	if cb.Config == oldConfig {
+		t.Fatalf("config was not swapped")
+	}
+	if cb.Config.MOTD != "new motd" {
+		t.Errorf("MOTD = %s, wanted new motd", cb.Config.MOTD)
+	}
+	if cb.Config.ServerName != "irc.example.com" {
+		t.Errorf("server name changed during rehash")
+	}
+	if oldConfig.MOTD != "old motd" {
+		t.Errorf("old config was modified")
+	}
+}
+
+func TestRehashMOTDFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "catbox.conf")
+	motdFile := filepath.Join(dir, "motd.txt")
+
+	if err := ioutil.WriteFile(configFile,
+		[]byte("listen-port = -1\nmotd-file = "+motdFile+"\n"), 0600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+	if err := ioutil.WriteFile(motdFile, []byte("Welcome\r\n\nBe nice\n\n"),
+		0600); err != nil {
+		t.Fatalf("writing MOTD: %s", err)
+	}
+
+	cfg, err := checkAndParseConfig(configFile)
+	if err != nil {
+		t.Fatalf("parsing config: %s", err)
+	}
+	if cfg.MOTD != "Welcome\n\nBe nice" {
+		t.Errorf("MOTD = %q, wanted the file's lines", cfg.MOTD)
+	}
+
+	cb := &Catbox{
+		ConfigFile: configFile,
+		Config:     cfg,
+		Opers:      map[TS6UID]*User{},
+		Listeners:  map[string]*Listener{},
+	}
+
+	if err := ioutil.WriteFile(motdFile, []byte("Changed\n"), 0600); err != nil {
+		t.Fatalf("writing MOTD: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	if cb.Config.MOTD != "Changed" {
+		t.Errorf("MOTD = %q after rehash, wanted Changed", cb.Config.MOTD)
+	}
+
+	// A missing file is an error, so we keep the MOTD we had.
+	if err := os.Remove(motdFile); err != nil {
+		t.Fatalf("removing MOTD: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	if cb.Config.MOTD != "Changed" {
+		t.Errorf("MOTD = %q after failed rehash, wanted Changed", cb.Config.MOTD)
+	}
+}
+
+func TestRehashListeners(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "catbox.conf")
+
+	cb := &Catbox{
+		ConfigFile: configFile,
+		Config: &Config{
+			ListenHost:    "127.0.0.1",
+			ListenPort:    "-1",
+			ListenPortTLS: "-1",
+		},
+		Opers:        map[TS6UID]*User{},
+		Listeners:    map[string]*Listener{},
+		ShutdownChan: make(chan struct{}),
+	}
+	defer cb.WG.Wait()
+
+	if err := ioutil.WriteFile(configFile,
+		[]byte("listen-host = 127.0.0.1\nlisten-port = 0\n"), 0600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	l, exists := cb.Listeners["tcp/127.0.0.1:0"]
+	if !exists {
+		t.Fatalf("listener not opened on rehash")
+	}
+
+	// Adding a TLS listener is not possible as we did not set up TLS. The rehash
+	// must fail and change nothing.
+	if err := ioutil.WriteFile(configFile,
+		[]byte("listen-host = 127.0.0.1\nlisten-port-tls = 0\nmotd = new\n"),
+		0600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	if cb.Listeners["tcp/127.0.0.1:0"] != l || len(cb.Listeners) != 1 {
+		t.Errorf("failed rehash changed listeners")
+	}
+	if cb.Config.MOTD == "new" {
+		t.Errorf("failed rehash changed config")
+	}
+
+	if err := ioutil.WriteFile(configFile,
+		[]byte("listen-host = 127.0.0.1\nlisten-port = -1\n"), 0600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+
+	cb.rehash(nil)
+
+	if len(cb.Listeners) != 0 {
+		t.Errorf("listener not closed on rehash")
+	}
+
+	// The accepting goroutine must stop.
+	select {
+	case <-l.closed:
+	default:
+		t.Errorf("listener not flagged closed")
+	}
+}
+
+func TestParseListenFDs(t *testing.T) {
+	fds := map[string]int{
+		"fd":                  3,
+		"tcp/0.0.0.0:6667":    4,
+		"tls/[::1]:6697":      5,
+		"i2p-tls/terrarium=x": 6,
+	}
+
+	parsed, err := ParseListenFDs(FormatListenFDs(fds))
+	if err != nil {
+		t.Fatalf("ParseListenFDs: %s", err)
+	}
+
+	if len(parsed) != len(fds) {
+		t.Fatalf("parsed %d fds, wanted %d", len(parsed), len(fds))
+	}
+	for name, fd := range fds {
+		if parsed[name] != fd {
+			t.Errorf("fd for %s = %d, wanted %d", name, parsed[name], fd)
+		}
+	}
+
+	for _, bad := range []string{"=3", "fd", "fd=x", "fd=-1"} {
+		if _, err := ParseListenFDs(bad); err == nil {
+			t.Errorf("ParseListenFDs(%s) succeeded, wanted failure", bad)
+		}
+	}
+}
+
+func TestSystemdListenFDs(t *testing.T) {
+	cfg := &Config{
+		ListenHost:    "0.0.0.0",
+		ListenPort:    "6667",
+		ListenPortTLS: "6697",
+	}
+
+	pid := fmt.Sprintf("%d", os.Getpid())
+
+	tests := []struct {
+		pid     string
+		count   string
+		names   string
+		success bool
+		fds     map[string]int
+	}{
+		{"", "", "", true, nil},
+		{"1", "2", "tcp:tls", true, nil},
+		{pid, "2", "tcp:tls", true, map[string]int{
+			"tcp/0.0.0.0:6667": 3,
+			"tls/0.0.0.0:6697": 4,
+		}},
+		{pid, "1", "", true, map[string]int{"fd": 3}},
+		{pid, "2", "", false, nil},
+		{pid, "1", "websocket", false, nil},
+		{pid, "x", "", false, nil},
+	}
+
+	for _, test := range tests {
+		t.Setenv("LISTEN_PID", test.pid)
+		t.Setenv("LISTEN_FDS", test.count)
+		t.Setenv("LISTEN_FDNAMES", test.names)
+
+		fds, err := systemdListenFDs(cfg)
+		if err != nil {
+			if test.success {
+				t.Errorf("systemdListenFDs(%s, %s) failed: %s", test.count, test.names,
+					err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("systemdListenFDs(%s, %s) succeeded, wanted failure",
+				test.count, test.names)
+			continue
+		}
+
+		if len(fds) != len(test.fds) {
+			t.Errorf("systemdListenFDs(%s, %s) = %v, wanted %v", test.count,
+				test.names, fds, test.fds)
+			continue
+		}
+		for name, fd := range test.fds {
+			if fds[name] != fd {
+				t.Errorf("systemdListenFDs(%s, %s) = %v, wanted %v", test.count,
+					test.names, fds, test.fds)
+			}
+		}
+
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Errorf("LISTEN_FDS not unset")
+		}
+	}
+}
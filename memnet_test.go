@@ -0,0 +1,521 @@
+package terrarium
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// This file has a harness to run several servers in the test process. They
+// share a fake clock and link to each other over in memory connections. This
+// makes tests of things such as netsplits and nick collisions fast and
+// repeatable, unlike the harness in tests/ that runs the binary.
+//
+// Servers only link when a test asks them to. Time only moves when a test
+// advances it, and servers only wake up (to ping clients, connect to servers,
+// and so on) when a test wakes them.
+//
+// The tests using it are next to the code they test, such as trust_test.go
+// for untrusted links.
+
+// fakeClock is a Clock that tests control.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the fake clock's time.
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// memNetwork is a set of servers running in memory.
+type memNetwork struct {
+	t     *testing.T
+	clock *fakeClock
+
+	mutex sync.Mutex
+
+	// Server name to server.
+	servers map[string]*memServer
+
+	// Links servers may make. Dialing server name and the name of the server
+	// it dials. Other attempts fail.
+	allowed map[[2]string]struct{}
+
+	// Connections making up each link, so we can sever it.
+	links map[[2]string][]net.Conn
+}
+
+// memServer is a server in a memNetwork.
+type memServer struct {
+	network *memNetwork
+	cb      *Catbox
+	done    chan struct{}
+}
+
+// memClient is a user client connected to a memServer.
+type memClient struct {
+	conn net.Conn
+
+	mutex    sync.Mutex
+	messages []irc.Message
+}
+
+// newMemNetwork starts a server for each name. They do not link until told
+// to.
+func newMemNetwork(t *testing.T, names ...string) *memNetwork {
+	n := &memNetwork{
+		t:       t,
+		clock:   newFakeClock(),
+		servers: map[string]*memServer{},
+		allowed: map[[2]string]struct{}{},
+		links:   map[[2]string][]net.Conn{},
+	}
+
+	dir := t.TempDir()
+
+	for i, name := range names {
+		serversConf := ""
+		for _, other := range names {
+			if other != name {
+				// Only the name and password matter. We don't dial the host.
+				serversConf += fmt.Sprintf("%s = 127.0.0.1,6667,testing,0\n", other)
+			}
+		}
+
+		serversFile := filepath.Join(dir, name+".servers.conf")
+		if err := ioutil.WriteFile(serversFile, []byte(serversConf),
+			0600); err != nil {
+			t.Fatalf("writing servers config: %s", err)
+		}
+
+		configFile := filepath.Join(dir, name+".conf")
+		if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(
+			"listen-port = -1\nserver-name = %s\nts6-sid = %dAA\nservers-config = %s\n",
+			name, i, serversFile)), 0600); err != nil {
+			t.Fatalf("writing config: %s", err)
+		}
+
+		cb, err := NewCatbox(configFile)
+		if err != nil {
+			t.Fatalf("creating server %s: %s", name, err)
+		}
+
+		cb.Clock = n.clock
+		cb.DialServer = n.dialer(name)
+		cb.CheckOwnership = true
+
+		s := &memServer{
+			network: n,
+			cb:      cb,
+			done:    make(chan struct{}),
+		}
+		n.servers[name] = s
+
+		go func() {
+			cb.serve()
+			close(s.done)
+		}()
+	}
+
+	t.Cleanup(n.stop)
+	return n
+}
+
+// dialer makes the function a server uses to connect to other servers.
+func (n *memNetwork) dialer(from string) func(*ServerDefinition) (net.Conn,
+	error) {
+	return func(linkInfo *ServerDefinition) (net.Conn, error) {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+
+		pair := [2]string{from, linkInfo.Name}
+		if _, ok := n.allowed[pair]; !ok {
+			return nil, fmt.Errorf("no route to %s", linkInfo.Name)
+		}
+
+		to, ok := n.servers[linkInfo.Name]
+		if !ok || to.stopped() {
+			return nil, fmt.Errorf("no such server: %s", linkInfo.Name)
+		}
+
+		ours, theirs := net.Pipe()
+		n.links[pair] = append(n.links[pair], ours, theirs)
+		to.cb.introduceClient(theirs, "")
+		return ours, nil
+	}
+}
+
+// link has one server connect to another.
+func (n *memNetwork) link(from, to string) {
+	n.mutex.Lock()
+	n.allowed[[2]string{from, to}] = struct{}{}
+	n.mutex.Unlock()
+
+	s := n.servers[from]
+	s.call(func() {
+		s.cb.connectToServer(s.cb.Config.Servers[to])
+	})
+}
+
+// split severs the link between two servers. They won't link again unless told
+// to.
+func (n *memNetwork) split(a, b string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		delete(n.allowed, pair)
+		for _, conn := range n.links[pair] {
+			_ = conn.Close()
+		}
+		delete(n.links, pair)
+	}
+}
+
+// kill shuts down a server. Its links go with it.
+func (n *memNetwork) kill(name string) {
+	n.mutex.Lock()
+	for pair := range n.allowed {
+		if pair[0] == name || pair[1] == name {
+			delete(n.allowed, pair)
+		}
+	}
+	n.mutex.Unlock()
+
+	s := n.servers[name]
+	s.cb.RequestShutdown()
+	<-s.done
+}
+
+// components groups the running servers by which we linked to each other.
+// Each group is sorted by name.
+func (n *memNetwork) components() [][]*memServer {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var names []string
+	for name, s := range n.servers {
+		if !s.stopped() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	seen := map[string]struct{}{}
+	var groups [][]*memServer
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+
+		var group []*memServer
+		queue := []string{name}
+		seen[name] = struct{}{}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			group = append(group, n.servers[current])
+
+			for _, other := range names {
+				if _, ok := seen[other]; ok {
+					continue
+				}
+				_, linked := n.allowed[[2]string{current, other}]
+				_, linkedBack := n.allowed[[2]string{other, current}]
+				if linked || linkedBack {
+					seen[other] = struct{}{}
+					queue = append(queue, other)
+				}
+			}
+		}
+
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].cb.Config.ServerName < group[j].cb.Config.ServerName
+		})
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// advance moves the clock forward and wakes up each server.
+func (n *memNetwork) advance(d time.Duration) {
+	n.clock.advance(d)
+	for _, s := range n.servers {
+		s.cb.newEvent(Event{Type: WakeUpEvent})
+	}
+}
+
+// waitFor waits for a condition to become true. The condition should look at
+// server state through call().
+func (n *memNetwork) waitFor(description string, cond func() bool) {
+	n.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	n.t.Fatalf("timed out waiting for %s", description)
+}
+
+// waitForConverged waits until every server knows every other server and the
+// given number of users.
+func (n *memNetwork) waitForConverged(users int) {
+	n.t.Helper()
+
+	n.waitFor(fmt.Sprintf("network to converge with %d users", users),
+		func() bool {
+			for _, s := range n.servers {
+				ok := false
+				s.call(func() {
+					ok = len(s.cb.Servers) == len(n.servers)-1 &&
+						len(s.cb.Users) == users
+				})
+				if !ok {
+					return false
+				}
+			}
+			return true
+		})
+}
+
+func (n *memNetwork) stop() {
+	for _, s := range n.servers {
+		s.cb.RequestShutdown()
+	}
+
+	// A server may have linked to one that is shutting down and never reads. Its
+	// writer would wait on the pipe forever.
+	n.mutex.Lock()
+	for _, conns := range n.links {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, s := range n.servers {
+		<-s.done
+	}
+}
+
+func (s *memServer) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// call runs the function on the server goroutine and waits for it to finish.
+func (s *memServer) call(f func()) {
+	done := make(chan struct{})
+	s.cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() {
+			f()
+			close(done)
+		},
+	})
+
+	select {
+	case <-done:
+	case <-s.cb.ShutdownChan:
+	}
+}
+
+// connectUser connects a client and registers it. It waits until the server
+// has registered it.
+func (s *memServer) connectUser(nick, username string) *memClient {
+	return s.connectUserWithModes(nick, username, "0")
+}
+
+// connectUserWithModes registers a user sending the given mode bitmask in USER.
+func (s *memServer) connectUserWithModes(nick, username,
+	modes string) *memClient {
+	return s.connectUserOn("", nick, username, modes)
+}
+
+// connectUserOn registers a user as if they connected on the named listener.
+func (s *memServer) connectUserOn(listener, nick, username,
+	modes string) *memClient {
+	ours, theirs := net.Pipe()
+
+	c := &memClient{conn: ours}
+	go c.readLoop()
+
+	s.cb.introduceClient(theirs, listener)
+
+	c.send(irc.Message{Command: "NICK", Params: []string{nick}})
+	c.send(irc.Message{Command: "USER",
+		Params: []string{username, modes, "*", nick}})
+
+	s.network.waitFor(fmt.Sprintf("%s to register", nick), func() bool {
+		return c.hasMessage(irc.ReplyWelcome)
+	})
+
+	return c
+}
+
+// readLoop records every message the client receives. We always read so
+// the server never blocks writing to us.
+func (c *memClient) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		m, err := irc.ParseMessage(line)
+		if err != nil && err != irc.ErrTruncated {
+			continue
+		}
+
+		c.mutex.Lock()
+		c.messages = append(c.messages, m)
+		c.mutex.Unlock()
+	}
+}
+
+func (c *memClient) send(m irc.Message) {
+	buf, err := m.Encode()
+	if err != nil {
+		panic(err)
+	}
+
+	// Writing may fail if the server cut us off. Tests notice that in other
+	// ways.
+	_, _ = c.conn.Write([]byte(buf))
+}
+
+// hasMessage checks if the client received a message with the command.
+func (c *memClient) hasMessage(command string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, m := range c.messages {
+		if m.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+// lastMessage finds the last message the client received with the command.
+func (c *memClient) lastMessage(command string) *irc.Message {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].Command == command {
+			m := c.messages[i]
+			return &m
+		}
+	}
+	return nil
+}
+
+// hasMessageContaining checks if the client received a message with the
+// command whose last parameter contains the text.
+func (c *memClient) hasMessageContaining(command, text string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, m := range c.messages {
+		if m.Command == command && len(m.Params) > 0 &&
+			strings.Contains(m.Params[len(m.Params)-1], text) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeOper gives the user with the nick operator status.
+func (s *memServer) makeOper(nick string) {
+	s.call(func() {
+		user := s.cb.Users[s.cb.Nicks[canonicalizeNick(nick)]]
+		user.Modes['o'] = struct{}{}
+		s.cb.Opers[user.UID] = user
+	})
+}
+
+// userServer finds the name of the server the user with the nick is on, from
+// the point of view of s. It is blank if s does not know the nick.
+func (s *memServer) userServer(nick string) string {
+	name := ""
+	s.call(func() {
+		uid, exists := s.cb.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			return
+		}
+		user := s.cb.Users[uid]
+		if user.isLocal() {
+			name = s.cb.Config.ServerName
+			return
+		}
+		name = user.Server.Name
+	})
+	return name
+}
+
+// channelMembers finds the nicks in a channel from the point of view of s.
+func (s *memServer) channelMembers(channelName string) []string {
+	var nicks []string
+	s.call(func() {
+		channel, exists := s.cb.Channels[canonicalizeChannel(channelName)]
+		if !exists {
+			return
+		}
+		for uid := range channel.Members {
+			nicks = append(nicks, s.cb.Users[uid].DisplayNick)
+		}
+	})
+	return nicks
+}
+
+// channelModes finds the channel's simple modes from the point of view of s.
+func (s *memServer) channelModes(channelName string) string {
+	modes := ""
+	s.call(func() {
+		channel, exists := s.cb.Channels[canonicalizeChannel(channelName)]
+		if !exists {
+			return
+		}
+		modes = channel.modesString()
+	})
+	return modes
+}
+
+func sortStrings(s []string) []string {
+	sort.Strings(s)
+	return s
+}
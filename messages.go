@@ -0,0 +1,466 @@
+package terrarium
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/horgh/config"
+	"github.com/horgh/irc"
+)
+
+// Some of the text we send users may be changed in the config (see
+// messages-config). Each message has a name and default text. The text may
+// contain variables such as {nick} which we fill in when we send it.
+//
+// The messages may also be translated. Each file <language>.conf in
+// languages-dir is a translation, in the same format as messages-config. The
+// server sends messages in its language (language), and users may choose
+// another with LANGUAGE.
+
+// defaultMessages is the text of each message we let the config change.
+var defaultMessages = map[string]string{
+	// 001 RPL_WELCOME
+	"welcome": "Welcome to the Internet Relay Network {nick}!{user}@{host}",
+
+	// 002 RPL_YOURHOST
+	"your-host": "Your host is {server}, running version {version}",
+
+	// 003 RPL_CREATED
+	"created": "This server was created {created}",
+
+	// 465 ERR_YOUREBANNEDCREEP, when a K-Lined user tries to register.
+	"banned": "You are banned from this server",
+
+	// Why we disconnect a user who is K-Lined.
+	"kline-quit": "Connection closed: {reason}",
+
+	// 251 RPL_LUSERCLIENT
+	"lusers": "There are {users} users and {services} services on {servers} servers.",
+
+	// 375 RPL_MOTDSTART
+	"motd-start": "- {server} Message of the day - ",
+
+	// 313 RPL_WHOISOPERATOR
+	"whois-operator": "is an IRC operator",
+
+	// The rest are the fixed text of numeric replies. See replyMessages.
+
+	// 042 RPL_YOURID
+	"your-id": "your unique ID",
+	// 219 RPL_ENDOFSTATS
+	"end-of-stats": "End of /STATS report",
+	// 262 RPL_ENDOFTRACE
+	"end-of-etrace": "End of ETRACE",
+	// 263 RPL_TRYAGAIN
+	"try-again": "Server load is temporarily too heavy. Please wait a while and try again.",
+	// 282 RPL_ENDOFACCEPT
+	"end-of-accept": "End of ACCEPT list",
+	// 309 RPL_ENDOFRULES
+	"end-of-rules": "End of RULES command",
+	// 315 RPL_ENDOFWHO
+	"end-of-who": "End of /WHO list",
+	// 331 RPL_NOTOPIC
+	"no-topic": "No topic is set",
+	// 337 RPL_ENDOFINVITELIST
+	"end-of-invite-list": "End of /INVITE list",
+	// 347 RPL_ENDOFINVEXLIST
+	"end-of-invex-list": "End of Channel Invite List",
+	// 365 RPL_ENDOFLINKS
+	"end-of-links": "End of LINKS list",
+	// 366 RPL_ENDOFNAMES
+	"end-of-names": "End of NAMES list",
+	// 368 RPL_ENDOFBANLIST
+	"end-of-ban-list": "End of channel ban list",
+	// 376 RPL_ENDOFMOTD
+	"end-of-motd": "End of MOTD command",
+	// 381 RPL_YOUREOPER
+	"already-oper": "You are already an IRC operator",
+	// 381 RPL_YOUREOPER
+	"now-oper": "You are now an IRC operator",
+	// 382 RPL_REHASHING
+	"rehashing": "Rehashing",
+	// 401 ERR_NOSUCHNICK
+	"no-such-nick": "No such nick/channel",
+	// 402 ERR_NOSUCHSERVER
+	"no-such-server": "No such server",
+	// 402 ERR_NOSUCHSERVER
+	"no-split-server": "No server split lately with that name",
+	// 403 ERR_NOSUCHCHANNEL
+	"invalid-channel": "Invalid channel name",
+	// 403 ERR_NOSUCHCHANNEL
+	"no-such-channel": "No such channel",
+	// 403 ERR_NOSUCHCHANNEL
+	"not-on-that-channel": "You are not on that channel",
+	// 404 ERR_CANNOTSENDTOCHAN
+	"cannot-send": "Cannot send to channel",
+	// 409 ERR_NOORIGIN
+	"no-origin": "No origin specified",
+	// 411 ERR_NORECIPIENT
+	"no-recipient": "No recipient given (PRIVMSG)",
+	// 412 ERR_NOTEXTTOSEND
+	"no-text": "No text to send",
+	// 415 ERR_BADMASK
+	"bad-mask": "Bad Server/host mask",
+	// 421 ERR_UNKNOWNCOMMAND
+	"unknown-command": "Unknown command",
+	// 422 ERR_NOMOTD
+	"no-motd": "MOTD File is missing",
+	// 425 ERR_NOOPERMOTD
+	"no-oper-motd": "OPERMOTD File is missing",
+	// 431 ERR_NONICKNAMEGIVEN
+	"no-nickname": "No nickname given",
+	// 432 ERR_ERRONEUSNICKNAME
+	"erroneous-nickname": "Erroneous nickname",
+	// 433 ERR_NICKNAMEINUSE
+	"nickname-in-use": "Nickname is already in use",
+	// 434 ERR_NORULES
+	"no-rules": "RULES File is missing",
+	// 441 ERR_USERNOTINCHANNEL
+	"user-not-in-channel": "They aren't on that channel",
+	// 442 ERR_NOTONCHANNEL
+	"not-on-channel": "You're not on that channel",
+	// 443 ERR_USERONCHANNEL
+	"user-on-channel": "is already on channel",
+	// 456 ERR_ACCEPTFULL
+	"accept-full": "Accept list is full",
+	// 457 ERR_ACCEPTEXIST
+	"accept-exists": "is already on your accept list",
+	// 458 ERR_ACCEPTNOT
+	"accept-not": "is not on your accept list",
+	// 461 ERR_NEEDMOREPARAMS
+	"need-more-params": "Not enough parameters",
+	// 462 ERR_ALREADYREGISTRED
+	"already-registered": "Unauthorized command (already registered)",
+	// 464 ERR_PASSWDMISMATCH
+	"password-mismatch": "Password incorrect",
+	// 471 ERR_CHANNELISFULL
+	"channel-full": "Cannot join channel (+l)",
+
+	// 473 ERR_INVITEONLYCHAN
+	"invite-only": "Cannot join channel (+i)",
+
+	// 475 ERR_BADCHANNELKEY
+	"bad-channel-key": "Cannot join channel (+k)",
+	// 477 ERR_NEEDREGGEDNICK
+	"need-account": "Cannot join channel (+r) - you need to be logged in to an account",
+	// 477 ERR_NEEDREGGEDNICK
+	"need-challenge": "Cannot join channel (you must pass the connection challenge first)",
+	// 478 ERR_BANLISTFULL
+	"invex-list-full": "Channel invite exception list is full",
+	// 481 ERR_NOPRIVILEGES
+	"no-relay-privilege": "Permission Denied- You may not relay messages",
+	// 481 ERR_NOPRIVILEGES
+	"no-remote-kill-privilege": "Permission Denied- You need the remote-kill privilege",
+	// 481 ERR_NOPRIVILEGES
+	"not-oper": "Permission Denied- You're not an IRC operator",
+	// 482 ERR_CHANOPRIVSNEEDED
+	"topic-locked": "The topic is locked by services",
+	// 482 ERR_CHANOPRIVSNEEDED
+	"not-channel-operator": "You're not channel operator",
+	// 501 ERR_UMODEUNKNOWNFLAG
+	"unknown-mode": "Unknown MODE flag",
+	// 502 ERR_USERSDONTMATCH
+	"users-dont-match": "Cannot change mode for other users",
+	// 524 ERR_HELPNOTFOUND
+	"no-help": "No help available on this topic",
+	// 687 RPL_YOURLANGUAGEIS
+	"your-language": "is now your language",
+	// 706 RPL_ENDOFHELP
+	"end-of-help": "End of /HELP",
+	// 707 ERR_TARGCHANGE
+	"target-change-too-fast": "Targets changing too fast, message dropped",
+	// 722 RPL_ENDOFOMOTD
+	"end-of-oper-motd": "End of OPERMOTD command",
+	// 733 RPL_ENDOFMONLIST
+	"end-of-monitor": "End of MONITOR list",
+	// 734 ERR_MONLISTFULL
+	"monitor-list-full": "Monitor list is full",
+	// 742 ERR_MLOCKRESTRICTED
+	"mlock": "MODE cannot be set due to channel having an active MLOCK restriction policy",
+	// 982 ERR_NOLANGUAGE
+	"no-such-language": "No such language",
+}
+
+// messageVariables are the variables each message may use. Every message may
+// use the variables in globalMessageVariables. Those in replyMessages may use
+// only those.
+var messageVariables = map[string][]string{
+	"welcome":        {"user", "host"},
+	"your-host":      {"version"},
+	"created":        {"created"},
+	"banned":         {"reason"},
+	"kline-quit":     {"reason"},
+	"lusers":         {"users", "services", "servers"},
+	"motd-start":     {},
+	"whois-operator": {},
+}
+
+// replyMessages are the messages that are the text of numeric replies, by
+// numeric. Rather than look each up where we send it, we write the English
+// text there and swap it as we send the reply (see replyMessageName()).
+var replyMessages = map[string][]string{
+	"042": {"your-id"},
+	"219": {"end-of-stats"},
+	"262": {"end-of-etrace"},
+	"263": {"try-again"},
+	"282": {"end-of-accept"},
+	"309": {"end-of-rules"},
+	"315": {"end-of-who"},
+	"331": {"no-topic"},
+	"337": {"end-of-invite-list"},
+	"347": {"end-of-invex-list"},
+	"365": {"end-of-links"},
+	"366": {"end-of-names"},
+	"368": {"end-of-ban-list"},
+	"376": {"end-of-motd"},
+	"381": {"already-oper", "now-oper"},
+	"382": {"rehashing"},
+	"401": {"no-such-nick"},
+	"402": {"no-such-server", "no-split-server"},
+	"403": {"invalid-channel", "no-such-channel", "not-on-that-channel"},
+	"404": {"cannot-send"},
+	"409": {"no-origin"},
+	"411": {"no-recipient"},
+	"412": {"no-text"},
+	"415": {"bad-mask"},
+	"421": {"unknown-command"},
+	"422": {"no-motd"},
+	"425": {"no-oper-motd"},
+	"431": {"no-nickname"},
+	"432": {"erroneous-nickname"},
+	"433": {"nickname-in-use"},
+	"434": {"no-rules"},
+	"441": {"user-not-in-channel"},
+	"442": {"not-on-channel"},
+	"443": {"user-on-channel"},
+	"456": {"accept-full"},
+	"457": {"accept-exists"},
+	"458": {"accept-not"},
+	"461": {"need-more-params"},
+	"462": {"already-registered"},
+	"464": {"password-mismatch"},
+	"471": {"channel-full"},
+	"473": {"invite-only"},
+	"475": {"bad-channel-key"},
+	"477": {"need-account", "need-challenge"},
+	"478": {"invex-list-full"},
+	"481": {"no-relay-privilege", "no-remote-kill-privilege", "not-oper"},
+	"482": {"topic-locked", "not-channel-operator"},
+	"501": {"unknown-mode"},
+	"502": {"users-dont-match"},
+	"524": {"no-help"},
+	"687": {"your-language"},
+	"706": {"end-of-help"},
+	"707": {"target-change-too-fast"},
+	"722": {"end-of-oper-motd"},
+	"733": {"end-of-monitor"},
+	"734": {"monitor-list-full"},
+	"742": {"mlock"},
+	"982": {"no-such-language"},
+}
+
+// globalMessageVariables are the variables every message may use.
+var globalMessageVariables = []string{"nick", "server", "network",
+	"network-description"}
+
+var messageVariableRE = regexp.MustCompile(`\{([a-z-]+)\}`)
+
+var languageRE = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// parseMessages checks the messages given in the config. Message name to text.
+// We fill in the defaults for any not given.
+func parseMessages(given map[string]string) (map[string]string, error) {
+	return parseMessagesOver(defaultMessages, given)
+}
+
+// parseMessagesOver checks the messages given, as parseMessages does. We fill
+// in the messages from base for any not given.
+func parseMessagesOver(base, given map[string]string) (map[string]string,
+	error) {
+	messages := map[string]string{}
+	for name, text := range base {
+		messages[name] = text
+	}
+
+	for name, text := range given {
+		if _, exists := defaultMessages[name]; !exists {
+			return nil, fmt.Errorf("unknown message: %s", name)
+		}
+
+		if len(text) == 0 {
+			return nil, fmt.Errorf("message %s is blank", name)
+		}
+
+		for _, match := range messageVariableRE.FindAllStringSubmatch(text, -1) {
+			if !isMessageVariable(name, match[1]) {
+				return nil, fmt.Errorf("message %s can't use variable {%s}", name,
+					match[1])
+			}
+		}
+
+		messages[name] = text
+	}
+
+	return messages, nil
+}
+
+// loadLanguages reads the translations in the directory. Each file is named
+// after its language, such as de.conf. Those messages a translation doesn't
+// give are as in base.
+func loadLanguages(dir string, base map[string]string) (
+	map[string]map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read languages dir: %s", err)
+	}
+
+	languages := map[string]map[string]string{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".conf" {
+			continue
+		}
+
+		language := strings.TrimSuffix(file.Name(), ".conf")
+		if !languageRE.MatchString(language) {
+			return nil, fmt.Errorf("invalid language: %s", language)
+		}
+		if language == "en" {
+			return nil, fmt.Errorf(
+				"en is the messages-config language and can't be in languages-dir")
+		}
+
+		given, err := config.ReadStringMap(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load language %s: %s", language, err)
+		}
+
+		languages[language], err = parseMessagesOver(base, given)
+		if err != nil {
+			return nil, fmt.Errorf("language %s: %s", language, err)
+		}
+	}
+
+	return languages, nil
+}
+
+// languageNames lists the languages we have, English included, in order.
+func (cb *Catbox) languageNames() []string {
+	names := []string{"en"}
+	for language := range cb.Config.Languages {
+		names = append(names, language)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasLanguage tells whether we have messages in the language.
+func (cb *Catbox) hasLanguage(language string) bool {
+	_, exists := cb.Config.Languages[language]
+	return exists || language == "en"
+}
+
+// LANGUAGE chooses the language we send the user messages in. We take the
+// first language we have from those they give. Without a language, we say
+// which they have and which we have.
+//
+// Parameters: [<language>[,<language>...]]
+func (u *LocalUser) languageCommand(m irc.Message) {
+	if len(m.Params) == 0 || m.Params[0] == "" {
+		language := u.Language
+		if language == "" {
+			language = u.Catbox.Config.Language
+		}
+		u.serverNotice(fmt.Sprintf("Your language is %s. Languages: %s", language,
+			strings.Join(u.Catbox.languageNames(), " ")))
+		return
+	}
+
+	for _, language := range strings.Split(m.Params[0], ",") {
+		if !u.Catbox.hasLanguage(language) {
+			continue
+		}
+
+		u.Language = language
+		// 687 RPL_YOURLANGUAGEIS
+		u.messageFromServer("687", []string{language, "is now your language"})
+		return
+	}
+
+	// 982 ERR_NOLANGUAGE
+	u.messageFromServer("982", []string{m.Params[0], "No such language"})
+}
+
+func isMessageVariable(name, variable string) bool {
+	for _, v := range globalMessageVariables {
+		if v == variable {
+			return true
+		}
+	}
+	for _, v := range messageVariables[name] {
+		if v == variable {
+			return true
+		}
+	}
+	return false
+}
+
+// userMessageText builds the text of a message for the user, in their
+// language. We only know the language of local users. Others get the
+// server's.
+func (cb *Catbox) userMessageText(user *User, name string,
+	vars ...string) string {
+	language := cb.Config.Language
+	if user.isLocal() && user.LocalUser.Language != "" {
+		language = user.LocalUser.Language
+	}
+	return cb.messageTextIn(language, name, user.DisplayNick, vars...)
+}
+
+// replyMessageName finds which of replyMessages a numeric reply's text is.
+// The text is the reply's last parameter, in English.
+func replyMessageName(command, text string) (string, bool) {
+	for _, name := range replyMessages[command] {
+		if defaultMessages[name] == text {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// messageText builds the text of a message for a user, in the server's
+// language. vars holds the values of the variables particular to the message,
+// as name then value.
+func (cb *Catbox) messageText(name, nick string, vars ...string) string {
+	return cb.messageTextIn(cb.Config.Language, name, nick, vars...)
+}
+
+// messageTextIn builds the text of a message in the language. If we don't
+// have the language, it's in English.
+func (cb *Catbox) messageTextIn(language, name, nick string,
+	vars ...string) string {
+	messages, exists := cb.Config.Languages[language]
+	if !exists {
+		messages = cb.Config.Messages
+	}
+
+	text, exists := messages[name]
+	if !exists {
+		text = defaultMessages[name]
+	}
+
+	pairs := []string{
+		"{nick}", nick,
+		"{server}", cb.Config.ServerName,
+		"{network}", cb.Config.NetworkName,
+		"{network-description}", cb.Config.NetworkDescription,
+	}
+	for i := 0; i+1 < len(vars); i += 2 {
+		pairs = append(pairs, "{"+vars[i]+"}", vars[i+1])
+	}
+
+	return strings.NewReplacer(pairs...).Replace(text)
+}
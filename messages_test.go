@@ -0,0 +1,170 @@
+package terrarium
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestParseMessages(t *testing.T) {
+	messages, err := parseMessages(map[string]string{
+		"welcome": "Welcome to {server}, {nick} ({user}@{host})",
+	})
+	if err != nil {
+		t.Fatalf("parseMessages failed: %s", err)
+	}
+	if messages["kline-quit"] != defaultMessages["kline-quit"] {
+		t.Errorf("kline-quit is %q, wanted the default", messages["kline-quit"])
+	}
+
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com",
+		Messages: messages}}
+	got := cb.messageText("welcome", "will", "user", "~will", "host",
+		"example.com")
+	if want := "Welcome to irc.example.com, will (~will@example.com)"; got != want {
+		t.Errorf("welcome is %q, wanted %q", got, want)
+	}
+
+	// Without messages from the config we use the defaults.
+	cb.Config.Messages = nil
+	got = cb.messageText("kline-quit", "will", "reason", "go away")
+	if want := "Connection closed: go away"; got != want {
+		t.Errorf("kline-quit is %q, wanted %q", got, want)
+	}
+
+	for _, bad := range []map[string]string{
+		{"goodbye": "Bye"},
+		{"welcome": ""},
+		{"banned": "Banned from {host}"},
+	} {
+		if _, err := parseMessages(bad); err == nil {
+			t.Errorf("parseMessages(%v) succeeded, wanted failure", bad)
+		}
+	}
+}
+
+func TestLoadLanguages(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "de.conf"),
+		[]byte("banned = Du bist hier gesperrt\n"), 0600); err != nil {
+		t.Fatalf("writing translation: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hi\n"),
+		0600); err != nil {
+		t.Fatalf("writing README: %s", err)
+	}
+
+	messages, err := parseMessages(map[string]string{
+		"kline-quit": "Bye: {reason}",
+	})
+	if err != nil {
+		t.Fatalf("parseMessages failed: %s", err)
+	}
+
+	languages, err := loadLanguages(dir, messages)
+	if err != nil {
+		t.Fatalf("loadLanguages failed: %s", err)
+	}
+	if len(languages) != 1 {
+		t.Fatalf("have languages %v, wanted de", languages)
+	}
+
+	cb := &Catbox{Config: &Config{
+		ServerName: "irc.example.com",
+		Messages:   messages,
+		Languages:  languages,
+		Language:   "en",
+	}}
+
+	if got := cb.messageTextIn("de", "banned", "will"); got !=
+		"Du bist hier gesperrt" {
+		t.Errorf("banned in de is %q", got)
+	}
+	// What de doesn't translate is as in the messages config.
+	if got := cb.messageTextIn("de", "kline-quit", "will", "reason",
+		"spam"); got != "Bye: spam" {
+		t.Errorf("kline-quit in de is %q", got)
+	}
+	// Languages we don't have are English.
+	if got := cb.messageTextIn("fr", "banned", "will"); got !=
+		defaultMessages["banned"] {
+		t.Errorf("banned in fr is %q", got)
+	}
+
+	for _, bad := range []string{"en.conf", "Bad Name.conf"} {
+		badDir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(badDir, bad), []byte(""),
+			0600); err != nil {
+			t.Fatalf("writing translation: %s", err)
+		}
+		if _, err := loadLanguages(badDir, messages); err == nil {
+			t.Errorf("loadLanguages with %s succeeded, wanted failure", bad)
+		}
+	}
+}
+
+func TestReplyMessageName(t *testing.T) {
+	for numeric, names := range replyMessages {
+		for _, name := range names {
+			text, exists := defaultMessages[name]
+			if !exists {
+				t.Errorf("reply message %s (%s) has no default", name, numeric)
+				continue
+			}
+			if got, ok := replyMessageName(numeric, text); !ok || got != name {
+				t.Errorf("replyMessageName(%s, %q) = %s, wanted %s", numeric, text,
+					got, name)
+			}
+		}
+	}
+
+	// The text must be that of a message for the numeric.
+	if _, ok := replyMessageName("332", "No topic is set"); ok {
+		t.Errorf("replyMessageName found a message for a topic")
+	}
+	if _, ok := replyMessageName("331", "No topic"); ok {
+		t.Errorf("replyMessageName found a message for other text")
+	}
+}
+
+// Users may choose a language with LANGUAGE, and get messages in it.
+func TestMemNetworkLanguage(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		de, err := parseMessagesOver(cfg.Messages, map[string]string{
+			"motd-start":      "- Nachricht des Tages -",
+			"unknown-command": "Unbekannter Befehl",
+		})
+		if err != nil {
+			t.Fatalf("parsing translation: %s", err)
+		}
+		cfg.Languages = map[string]map[string]string{"de": de}
+		a.cb.setConfig(&cfg)
+	})
+
+	user := a.connectUser("user", "user")
+
+	user.send(irc.Message{Command: "LANGUAGE", Params: []string{"fr"}})
+	n.waitFor("fr to be refused", func() bool { return user.hasMessage("982") })
+
+	user.send(irc.Message{Command: "LANGUAGE", Params: []string{"fr,de"}})
+	n.waitFor("the language to change", func() bool {
+		return user.hasMessage("687")
+	})
+
+	user.send(irc.Message{Command: "MOTD"})
+	n.waitFor("the MOTD in German", func() bool {
+		return user.hasMessageContaining("375", "Nachricht des Tages")
+	})
+
+	// Numeric replies are translated too.
+	user.send(irc.Message{Command: "FOO"})
+	n.waitFor("421 in German", func() bool {
+		return user.hasMessageContaining("421", "Unbekannter Befehl")
+	})
+}
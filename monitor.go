@@ -0,0 +1,242 @@
+package terrarium
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// MONITOR lets users hear when nicks come online or go offline. ISON asks
+// once. See https://ircv3.net/specs/extensions/monitor
+//
+// Nicks no one has but our users may not take, such as reserved ones and
+// those we hold after a netsplit, count as online. We show them without a
+// user and host. See resv.go.
+
+// MaxMonitorTargets is how many nicks a user may monitor.
+const MaxMonitorTargets = 100
+
+// Parameters: <+ or -><nick>[,<nick>...], or C, L, or S
+func (u *LocalUser) monitorCommand(m irc.Message) {
+	if len(m.Params) == 0 || m.Params[0] == "" {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"MONITOR", "Not enough parameters"})
+		return
+	}
+
+	switch m.Params[0] {
+	case "+", "-":
+		if len(m.Params) < 2 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{"MONITOR", "Not enough parameters"})
+			return
+		}
+		if m.Params[0] == "+" {
+			u.addMonitors(m.Params[1])
+			return
+		}
+		u.removeMonitors(m.Params[1])
+		return
+	case "C", "c":
+		u.Catbox.stopMonitoring(u)
+		return
+	case "L", "l":
+		var nicks []string
+		for _, nick := range u.Monitoring {
+			nicks = append(nicks, nick)
+		}
+		sort.Strings(nicks)
+		// 732 RPL_MONLIST
+		u.sendMonitorTargets("732", nicks)
+		// 733 RPL_ENDOFMONLIST
+		u.messageFromServer("733", []string{"End of MONITOR list"})
+		return
+	case "S", "s":
+		var nicks []string
+		for _, nick := range u.Monitoring {
+			nicks = append(nicks, nick)
+		}
+		sort.Strings(nicks)
+		u.sendMonitorStatus(nicks)
+		return
+	}
+
+	// They may give the + or - with the nicks, such as +alice,bob.
+	if m.Params[0][0] == '+' {
+		u.addMonitors(m.Params[0][1:])
+		return
+	}
+	if m.Params[0][0] == '-' {
+		u.removeMonitors(m.Params[0][1:])
+		return
+	}
+
+	// 461 ERR_NEEDMOREPARAMS
+	u.messageFromServer("461", []string{"MONITOR", "Not enough parameters"})
+}
+
+// addMonitors starts monitoring a comma separated list of nicks and tells the
+// user whether each is online.
+func (u *LocalUser) addMonitors(list string) {
+	var added []string
+	for i, nick := range strings.Split(list, ",") {
+		nick = strings.TrimSpace(nick)
+		if !isValidNick(u.Catbox.Config.MaxNickLength, nick) {
+			continue
+		}
+		canon := canonicalizeNick(nick)
+		if _, exists := u.Monitoring[canon]; exists {
+			continue
+		}
+
+		if len(u.Monitoring) >= MaxMonitorTargets {
+			// 734 ERR_MONLISTFULL
+			u.messageFromServer("734", []string{
+				fmt.Sprintf("%d", MaxMonitorTargets),
+				strings.Join(strings.Split(list, ",")[i:], ","),
+				"Monitor list is full",
+			})
+			break
+		}
+
+		u.Monitoring[canon] = nick
+		if u.Catbox.Monitors[canon] == nil {
+			u.Catbox.Monitors[canon] = make(map[uint64]*LocalUser)
+		}
+		u.Catbox.Monitors[canon][u.ID] = u
+		added = append(added, nick)
+	}
+
+	u.sendMonitorStatus(added)
+}
+
+// removeMonitors stops monitoring a comma separated list of nicks.
+func (u *LocalUser) removeMonitors(list string) {
+	for _, nick := range strings.Split(list, ",") {
+		u.Catbox.stopMonitoringNick(u, canonicalizeNick(strings.TrimSpace(nick)))
+	}
+}
+
+// sendMonitorStatus tells the user which of the nicks are online and which are
+// offline.
+func (u *LocalUser) sendMonitorStatus(nicks []string) {
+	var online, offline []string
+	for _, nick := range nicks {
+		if target := u.Catbox.monitorTarget(nick); target != "" {
+			online = append(online, target)
+			continue
+		}
+		offline = append(offline, nick)
+	}
+
+	// 730 RPL_MONONLINE
+	u.sendMonitorTargets("730", online)
+	// 731 RPL_MONOFFLINE
+	u.sendMonitorTargets("731", offline)
+}
+
+// monitorTarget decides how MONITOR shows a nick that's online: nick!user@host
+// if someone has it, and the bare nick if no one may take it. If the nick is
+// offline, it returns a blank string.
+func (cb *Catbox) monitorTarget(nick string) string {
+	canon := canonicalizeNick(nick)
+	if uid, exists := cb.Nicks[canon]; exists {
+		return cb.Users[uid].nickUhost()
+	}
+	if cb.isNickUnavailable(canon) {
+		return nick
+	}
+	return ""
+}
+
+// stopMonitoring forgets every nick a user monitors.
+func (cb *Catbox) stopMonitoring(u *LocalUser) {
+	for nick := range u.Monitoring {
+		cb.stopMonitoringNick(u, nick)
+	}
+}
+
+// stopMonitoringNick stops a user monitoring a nick. The nick must be
+// canonicalized.
+func (cb *Catbox) stopMonitoringNick(u *LocalUser, nick string) {
+	delete(u.Monitoring, nick)
+	delete(cb.Monitors[nick], u.ID)
+	if len(cb.Monitors[nick]) == 0 {
+		delete(cb.Monitors, nick)
+	}
+}
+
+// nickOnline tells users monitoring a user's nick that they're online. We call
+// this when a user registers, links in, or changes their nick.
+func (cb *Catbox) nickOnline(user *User) {
+	for _, lu := range cb.Monitors[canonicalizeNick(user.DisplayNick)] {
+		// 730 RPL_MONONLINE
+		lu.messageFromServer("730", []string{user.nickUhost()})
+	}
+}
+
+// nickOffline tells users monitoring a nick that it's offline. We call this
+// when a user with it quits, splits, or changes their nick. If the nick is still
+// unavailable, such as because we're holding it, we say nothing. The nick must
+// be canonicalized.
+func (cb *Catbox) nickOffline(nick string) {
+	if cb.monitorTarget(nick) != "" {
+		return
+	}
+	for _, lu := range cb.Monitors[nick] {
+		// 731 RPL_MONOFFLINE
+		lu.messageFromServer("731", []string{lu.Monitoring[nick]})
+	}
+}
+
+// sendMonitorTargets sends the targets in a MONITOR reply, separated by commas,
+// in as few messages as fit.
+func (u *LocalUser) sendMonitorTargets(numeric string, targets []string) {
+	msgs, err := splitListMessageWith(irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: numeric,
+		// Targets go in the last parameter.
+		Params: []string{u.User.DisplayNick, ""},
+	}, targets, ",")
+	if err != nil {
+		log.Printf("Unable to create MONITOR reply: %s", err)
+		return
+	}
+
+	for _, m := range msgs {
+		u.maybeQueueMessage(m)
+	}
+}
+
+// ISON tells which of the nicks are online. Nicks no one may take count as
+// online, as with MONITOR.
+//
+// Parameters: <nick> [<nick>...]
+func (u *LocalUser) isonCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"ISON", "Not enough parameters"})
+		return
+	}
+
+	// Clients may give the nicks as one parameter or as several.
+	var online []string
+	for _, param := range m.Params {
+		for _, nick := range strings.Fields(param) {
+			canon := canonicalizeNick(nick)
+			if uid, exists := u.Catbox.Nicks[canon]; exists {
+				online = append(online, u.Catbox.Users[uid].DisplayNick)
+				continue
+			}
+			if u.Catbox.isNickUnavailable(canon) {
+				online = append(online, nick)
+			}
+		}
+	}
+
+	// 303 RPL_ISON
+	u.messageFromServer("303", []string{strings.Join(online, " ")})
+}
@@ -5,32 +5,59 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/horgh/irc"
 	"github.com/pkg/errors"
 )
 
+// maxTagsLength is the most bytes of message tags we accept on an inbound
+// line. This includes the leading '@' and the trailing space. This is from the
+// IRCv3 message tags specification. Tags do not count towards
+// irc.MaxLineLength.
+const maxTagsLength = 8191
+
+// ErrLineTooLong is returned by Read when the peer sends a line longer than we
+// permit. We discard the line.
+var ErrLineTooLong = errors.New("line too long")
+
 // Conn is a connection to a client/server
 type Conn struct {
 	conn   net.Conn
 	rw     *bufio.ReadWriter
 	ioWait time.Duration
-	IP     net.IP
+
+	// How long the peer has to complete a line once we see the start of it.
+	lineWait time.Duration
+
+	IP net.IP
 }
 
 // NewConn initializes a Conn struct
-func NewConn(conn net.Conn, ioWait time.Duration) Conn {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
-	// This shouldn't happen.
-	if err != nil {
-		log.Fatalf("Unable to resolve TCP address: %s", err)
+func NewConn(conn net.Conn, ioWait, lineWait time.Duration) Conn {
+	ip := net.IPv4(127, 0, 0, 1)
+
+	// In memory connections (net.Pipe()) have no address. Tests use these. Treat
+	// them as coming from localhost.
+	if conn.RemoteAddr().Network() != "pipe" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
+		// This shouldn't happen.
+		if err != nil {
+			log.Fatalf("Unable to resolve TCP address: %s", err)
+		}
+		ip = tcpAddr.IP
 	}
 
 	return Conn{
-		conn:   conn,
-		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
-		ioWait: ioWait,
-		IP:     tcpAddr.IP,
+		conn: conn,
+		rw: bufio.NewReadWriter(
+			bufio.NewReaderSize(conn, maxTagsLength+irc.MaxLineLength),
+			bufio.NewWriter(conn),
+		),
+		ioWait:   ioWait,
+		lineWait: lineWait,
+		IP:       ip,
 	}
 }
 
@@ -45,6 +72,9 @@ func (c Conn) RemoteAddr() net.Addr {
 }
 
 // Read reads a line from the connection.
+//
+// If the line is longer than we permit, we discard it and return
+// ErrLineTooLong. The connection is still usable in that case.
 func (c Conn) Read() (string, error) {
 	if err := c.conn.SetReadDeadline(time.Now().Add(c.ioWait)); err != nil {
 		// Do not treat this as fatal. There can be something available to read in
@@ -52,15 +82,72 @@ func (c Conn) Read() (string, error) {
 		log.Printf("Error setting read deadline: %s", err)
 	}
 
-	line, err := c.rw.ReadString('\n')
+	// Once the peer starts sending a line, it must finish it within lineWait.
+	// Otherwise a peer could hold a partial line open by trickling bytes.
+	if _, err := c.rw.Peek(1); err != nil {
+		return "", errors.Wrap(err, "error reading")
+	}
+
+	if c.lineWait > 0 && c.lineWait < c.ioWait {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.lineWait)); err != nil {
+			log.Printf("Error setting read deadline: %s", err)
+		}
+	}
+
+	// The reader's buffer is sized to hold the longest line we accept. If it
+	// fills without us seeing a newline then the line is too long. Throw away
+	// the remainder of it so we hold on to at most one buffer's worth.
+	buf, err := c.rw.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = c.rw.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "error reading")
+		}
+		return "", ErrLineTooLong
+	}
+
+	// ReadSlice's buffer is overwritten by the next read, so copy it.
+	line := string(buf)
+
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && line != "" {
+			return line, errors.Wrap(err, "line not completed in time")
+		}
 		// There may be something read even with error.
 		return line, errors.Wrap(err, "error reading")
 	}
 
+	if !isValidLineLength(line) {
+		return "", ErrLineTooLong
+	}
+
 	return line, nil
 }
 
+// isValidLineLength checks whether a line read from a peer fits within our
+// limits. The line includes its terminating newline.
+//
+// If the line has message tags, they may be up to maxTagsLength bytes. The
+// rest of the line may be up to irc.MaxLineLength bytes.
+func isValidLineLength(line string) bool {
+	if len(line) > 0 && line[0] == '@' {
+		space := strings.IndexByte(line, ' ')
+		if space == -1 {
+			return len(line) <= maxTagsLength
+		}
+
+		if space+1 > maxTagsLength {
+			return false
+		}
+
+		line = line[space+1:]
+	}
+
+	return len(line) <= irc.MaxLineLength
+}
+
 // Write writes a string to the connection
 func (c Conn) Write(s string) error {
 	if err := c.conn.SetWriteDeadline(time.Now().Add(c.ioWait)); err != nil {
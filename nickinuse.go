@@ -0,0 +1,123 @@
+package terrarium
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// When a client asks for a nick someone already has before they register, we
+// may help them find another, as clients behind web gateways often can't
+// choose one themselves. nick-in-use-action says how:
+//
+// - NickInUseReject: We reply 433 ERR_NICKNAMEINUSE, as always.
+// - NickInUseSuggest: We reply 433 and name a nick they could have instead.
+// - NickInUseGuest: We give them a guest nick such as Guest1234 and carry on
+//   registering them.
+//
+// A client that keeps asking for nicks in use without registering is likely
+// cycling through a list of them, perhaps our suggestions, so with
+// NickInUseSuggest and NickInUseGuest we cut it off after MaxNickInUseReplies.
+// With NickInUseReject we leave it be, as we always have.
+
+// What to do when a client asks for a nick in use before registering.
+const (
+	NickInUseReject  = "reject"
+	NickInUseSuggest = "suggest"
+	NickInUseGuest   = "guest"
+)
+
+// MaxNickInUseReplies is how many times we tell a client a nick is in use
+// before they register before we cut them off, unless we reject them.
+const MaxNickInUseReplies = 5
+
+// nickSuggestionSuffixes are what we try adding to a nick in use to suggest
+// another.
+var nickSuggestionSuffixes = []string{"_", "1", "2", "3", "4", "5", "6", "7",
+	"8", "9"}
+
+// nickInUse deals with a client asking for a nick in use before they register.
+// It tells whether we gave them another.
+func (c *LocalClient) nickInUse(nick string) bool {
+	c.NickInUseReplies++
+	if c.Catbox.Config.NickInUseAction != NickInUseReject &&
+		c.NickInUseReplies > MaxNickInUseReplies {
+		c.quit("Too many nicknames in use")
+		return false
+	}
+
+	switch c.Catbox.Config.NickInUseAction {
+	case NickInUseGuest:
+		guest := c.guestNick()
+		if guest == "" {
+			break
+		}
+		c.messageFromServer("NOTICE", []string{"*", fmt.Sprintf(
+			"*** Nickname %s is already in use. You are now %s.", nick, guest)})
+		c.PreRegDisplayNick = guest
+		return true
+	case NickInUseSuggest:
+		if suggestion := c.suggestNick(nick); suggestion != "" {
+			// 433 ERR_NICKNAMEINUSE
+			c.messageFromServer("433", []string{nick,
+				fmt.Sprintf("Nickname is already in use. Try %s", suggestion)})
+			return false
+		}
+	}
+
+	// 433 ERR_NICKNAMEINUSE
+	c.messageFromServer("433", []string{nick, "Nickname is already in use"})
+	return false
+}
+
+// suggestNick finds a nick like the one in use that the client could have.
+// Blank if we find none.
+func (c *LocalClient) suggestNick(nick string) string {
+	for _, suffix := range nickSuggestionSuffixes {
+		base := nick
+		if len(base)+len(suffix) > c.Catbox.Config.MaxNickLength {
+			base = base[:c.Catbox.Config.MaxNickLength-len(suffix)]
+		}
+		if suggestion := base + suffix; c.nickAvailable(suggestion) {
+			return suggestion
+		}
+	}
+	return ""
+}
+
+// guestNick picks a nick such as Guest1234 that no one has. Blank if we find
+// none.
+func (c *LocalClient) guestNick() string {
+	digits := c.Catbox.Config.MaxNickLength - len("Guest")
+	if digits > 5 {
+		digits = 5
+	}
+	if digits < 1 {
+		return ""
+	}
+
+	for i := 0; i < 10; i++ {
+		guest := "Guest"
+		for j := 0; j < digits; j++ {
+			guest += fmt.Sprintf("%d", rand.Intn(10))
+		}
+		// The listener may want it to look a certain way.
+		guest = c.applyNickAffixes(guest)
+		if c.nickAvailable(guest) {
+			return guest
+		}
+	}
+	return ""
+}
+
+// nickAvailable decides whether the client could take the nick.
+func (c *LocalClient) nickAvailable(nick string) bool {
+	if nick == "" || !isValidNick(c.Catbox.Config.MaxNickLength, nick) ||
+		c.applyNickAffixes(nick) != nick {
+		return false
+	}
+	if _, exists := c.Catbox.Nicks[canonicalizeNick(nick)]; exists {
+		return false
+	}
+	numeric, _ := c.Catbox.nickRefusal(nick)
+	return numeric == ""
+}
@@ -0,0 +1,75 @@
+package terrarium
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestMemNetworkNickInUse(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+	a.connectUser("alice", "alice")
+	a.connectUser("alice_", "alice")
+
+	setAction := func(action string) {
+		a.call(func() {
+			cfg := *a.cb.Config
+			cfg.NickInUseAction = action
+			a.cb.setConfig(&cfg)
+		})
+	}
+
+	register := func() *memClient {
+		ours, theirs := net.Pipe()
+		c := &memClient{conn: ours}
+		go c.readLoop()
+		a.cb.introduceClient(theirs, "")
+		c.send(irc.Message{Command: "USER", Params: []string{"user", "0", "*", "user"}})
+		c.send(irc.Message{Command: "NICK", Params: []string{"alice"}})
+		return c
+	}
+
+	setAction(NickInUseSuggest)
+	c := register()
+	n.waitFor("433", func() bool { return c.hasMessage("433") })
+	if m := c.lastMessage("433"); m.Params[2] != "Nickname is already in use. Try alice1" {
+		t.Errorf("433 was %q, wanted a suggestion of alice1", m.Params[2])
+	}
+
+	for i := 1; i < MaxNickInUseReplies; i++ {
+		c.send(irc.Message{Command: "NICK", Params: []string{"alice"}})
+	}
+	c.send(irc.Message{Command: "NICK", Params: []string{"alice"}})
+	n.waitFor("client cut off", func() bool {
+		return c.hasMessageContaining("ERROR", "Too many nicknames in use")
+	})
+
+	// Rejecting is as it always was. We don't cut them off.
+	setAction(NickInUseReject)
+	c = register()
+	for i := 0; i < MaxNickInUseReplies; i++ {
+		c.send(irc.Message{Command: "NICK", Params: []string{"alice"}})
+	}
+	c.send(irc.Message{Command: "NICK", Params: []string{"bob"}})
+	n.waitFor("registration after rejections", func() bool {
+		return c.hasMessage(irc.ReplyWelcome)
+	})
+	if c.hasMessage("ERROR") {
+		t.Errorf("client rejecting nicks was cut off")
+	}
+
+	setAction(NickInUseGuest)
+	c = register()
+	n.waitFor("registration", func() bool {
+		return c.hasMessage(irc.ReplyWelcome)
+	})
+	if m := c.lastMessage(irc.ReplyWelcome); !strings.HasPrefix(m.Params[0], "Guest") {
+		t.Errorf("registered as %s, wanted a guest nick", m.Params[0])
+	}
+	if c.hasMessage("433") {
+		t.Errorf("client given a guest nick got 433")
+	}
+}
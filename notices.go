@@ -0,0 +1,235 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Operators may choose which kinds of notices they get with SET NOTICES. We
+// remember their choices by oper name, so they apply each time they OPER, and
+// keep them in oper-notices-file if there is one so they last across
+// restarts.
+//
+// Notices about users connecting are +C, as they always were. Notices outside
+// the categories always go to every operator. Operators on other servers get
+// our global notices whatever they chose, since their server decides what
+// they see.
+
+// noticeCategories are the kinds of notices operators may turn off, and what
+// each covers.
+var noticeCategories = map[string]string{
+	"connects": "users connecting (+C)",
+	"klines":   "K-Lines added, removed, expired, and applied",
+	"links":    "servers connecting, linking, bursting, and splitting",
+	"spam":     "clients sending invalid, overlong, or unknown commands",
+}
+
+// wantsNotice decides whether a local operator gets notices in the category.
+// Those they never chose about, they get, apart from connects which is off
+// until they turn on +C.
+func (cb *Catbox) wantsNotice(user *User, category string) bool {
+	if category == "" {
+		return true
+	}
+	if category == "connects" {
+		_, exists := user.Modes['C']
+		return exists
+	}
+
+	on, chose := cb.OperNotices[user.LocalUser.OperName][category]
+	return !chose || on
+}
+
+// noticeOpersAbout sends a notice in the category to all operators. Local
+// operators who turned the category off don't get it.
+func (cb *Catbox) noticeOpersAbout(category, msg string) {
+	cb.assertOwner()
+
+	log.Printf("Global oper notice: %s", msg)
+
+	for _, user := range cb.Opers {
+		if user.isLocal() {
+			if cb.wantsNotice(user, category) {
+				user.LocalUser.serverNotice(msg)
+			}
+			continue
+		}
+
+		user.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "NOTICE",
+			Params: []string{
+				string(user.UID),
+				fmt.Sprintf("*** Notice --- %s", msg),
+			},
+		})
+	}
+}
+
+// noticeLocalOpersAbout sends a notice in the category to local operators who
+// want it.
+func (cb *Catbox) noticeLocalOpersAbout(category, msg string) {
+	cb.assertOwner()
+
+	log.Printf("Local oper notice: %s", msg)
+
+	for _, user := range cb.Opers {
+		if user.isLocal() && cb.wantsNotice(user, category) {
+			user.LocalUser.serverNotice(msg)
+		}
+	}
+}
+
+// queueOperNoticeAbout is queueOperNotice() for a notice in the category.
+func (cb *Catbox) queueOperNoticeAbout(category, msg string) {
+	cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() { cb.noticeOpersAbout(category, msg) },
+	})
+}
+
+// setNotices handles SET NOTICES. Without a category, it shows which the
+// operator gets.
+//
+// Parameters: NOTICES [<category> <ON|OFF>]
+func (u *LocalUser) setNotices(m irc.Message) {
+	var categories []string
+	for category := range noticeCategories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	if len(m.Params) == 1 {
+		for _, category := range categories {
+			state := "off"
+			if u.Catbox.wantsNotice(u.User, category) {
+				state = "on"
+			}
+			u.serverNotice(fmt.Sprintf("Notices about %s (%s) are %s", category,
+				noticeCategories[category], state))
+		}
+		return
+	}
+
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"SET", "Not enough parameters"})
+		return
+	}
+
+	category := strings.ToLower(m.Params[1])
+	if _, exists := noticeCategories[category]; !exists {
+		u.serverNotice(fmt.Sprintf("Unknown category %s. Categories: %s",
+			m.Params[1], strings.Join(categories, ", ")))
+		return
+	}
+
+	var on bool
+	switch strings.ToUpper(m.Params[2]) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		u.serverNotice("Usage: SET NOTICES [<category> <ON|OFF>]")
+		return
+	}
+
+	u.Catbox.setOperNotice(u.OperName, category, on)
+	u.applyConnectsNotice()
+
+	state := "off"
+	if on {
+		state = "on"
+	}
+	u.serverNotice(fmt.Sprintf("Notices about %s are now %s", category, state))
+}
+
+// applyConnectsNotice sets or unsets +C if the operator chose whether to get
+// notices about users connecting.
+func (u *LocalUser) applyConnectsNotice() {
+	on, chose := u.Catbox.OperNotices[u.OperName]["connects"]
+	if !chose {
+		return
+	}
+
+	_, exists := u.User.Modes['C']
+	if on && !exists {
+		u.userModeCommand(u.User, "+C")
+	}
+	if !on && exists {
+		u.userModeCommand(u.User, "-C")
+	}
+}
+
+// setOperNotice records an operator's choice about a category and saves the
+// choices.
+func (cb *Catbox) setOperNotice(operName, category string, on bool) {
+	if cb.OperNotices[operName] == nil {
+		cb.OperNotices[operName] = map[string]bool{}
+	}
+	cb.OperNotices[operName][category] = on
+
+	file := cb.Config.OperNoticesFile
+	if file == "" {
+		return
+	}
+
+	buf, err := json.MarshalIndent(cb.OperNotices, "", "  ")
+	if err != nil {
+		log.Printf("Unable to encode oper notice choices: %s", err)
+		return
+	}
+
+	cb.operNoticesSaves++
+	save := cb.operNoticesSaves
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+
+		cb.operNoticesMutex.Lock()
+		defer cb.operNoticesMutex.Unlock()
+		if save < cb.operNoticesWritten {
+			return
+		}
+
+		if err := writeFileAtomic(file, buf); err != nil {
+			log.Printf("Unable to write oper notice choices: %s", err)
+			return
+		}
+		cb.operNoticesWritten = save
+	}()
+}
+
+// loadOperNotices reads the choices operators made from oper-notices-file.
+// It's fine if it doesn't exist yet.
+func (cb *Catbox) loadOperNotices() error {
+	cb.OperNotices = map[string]map[string]bool{}
+
+	if cb.Config.OperNoticesFile == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(cb.Config.OperNoticesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read oper notices file: %s", err)
+	}
+
+	if err := json.Unmarshal(buf, &cb.OperNotices); err != nil {
+		return fmt.Errorf("unable to parse oper notices file: %s", err)
+	}
+	if cb.OperNotices == nil {
+		cb.OperNotices = map[string]map[string]bool{}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package terrarium
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// Notices about what a server tells us during its burst, and about each user
+// lost in a split, come summarized with counts rather than one at a time.
+func TestMemNetworkSquelchedNotices(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	c := n.servers["c.example.com"]
+
+	alice := a.connectUser("alice", "alice")
+	a.makeOper("alice")
+	b.connectUser("bob", "bob")
+	c.connectUser("carol", "carol")
+
+	n.link("b.example.com", "c.example.com")
+	n.waitFor("b and c to link", func() bool {
+		return b.userServer("carol") == "c.example.com"
+	})
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(3)
+	n.waitFor("the burst summary", func() bool {
+		return alice.hasMessageContaining("NOTICE",
+			"During burst with b.example.com: 1 servers introduced")
+	})
+	if alice.hasMessageContaining("NOTICE", "is introducing server") {
+		t.Errorf("alice heard about a server introduced during the burst")
+	}
+
+	n.split("a.example.com", "b.example.com")
+	n.waitFor("the split summary", func() bool {
+		return alice.hasMessageContaining("NOTICE",
+			"Netsplit a.example.com b.example.com: Lost 2 users and 2 servers")
+	})
+}
+
+// Operators choose which notices they get. We remember their choices for the
+// next time they OPER.
+func TestMemNetworkOperNotices(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+
+	file := filepath.Join(t.TempDir(), "oper-notices.json")
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.Opers = map[string]string{"admin": "pw", "other": "pw"}
+		cfg.OperNoticesFile = file
+		a.cb.setConfig(&cfg)
+	})
+
+	admin := a.connectUser("admin", "admin")
+	admin.send(irc.Message{Command: "OPER", Params: []string{"admin", "pw"}})
+	other := a.connectUser("other", "other")
+	other.send(irc.Message{Command: "OPER", Params: []string{"other", "pw"}})
+	n.waitFor("the opers", func() bool {
+		return admin.hasMessage("381") && other.hasMessage("381")
+	})
+
+	admin.send(irc.Message{Command: "SET",
+		Params: []string{"NOTICES", "links", "OFF"}})
+	admin.send(irc.Message{Command: "SET",
+		Params: []string{"NOTICES", "connects", "ON"}})
+	n.waitFor("admin to be +C", func() bool {
+		return admin.hasMessageContaining("MODE", "+C")
+	})
+
+	a.connectUser("user", "user")
+	n.waitFor("the connection notice", func() bool {
+		return admin.hasMessageContaining("NOTICE", "CLICONN user ~user")
+	})
+	if other.hasMessageContaining("NOTICE", "CLICONN user ~user") {
+		t.Errorf("other got a connection notice without +C")
+	}
+
+	n.link("a.example.com", "b.example.com")
+	n.waitFor("other to hear of the burst", func() bool {
+		return other.hasMessageContaining("NOTICE", "Burst with b.example.com over")
+	})
+	if admin.hasMessageContaining("NOTICE", "Burst with b.example.com over") {
+		t.Errorf("admin got a link notice after turning them off")
+	}
+
+	n.waitFor("the choices to be saved", func() bool {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false
+		}
+		var saved map[string]map[string]bool
+		return json.Unmarshal(buf, &saved) == nil &&
+			reflect.DeepEqual(saved, map[string]map[string]bool{
+				"admin": {"connects": true, "links": false},
+			})
+	})
+
+	again := a.connectUser("again", "again")
+	again.send(irc.Message{Command: "OPER", Params: []string{"admin", "pw"}})
+	n.waitFor("the choices to apply again", func() bool {
+		return again.hasMessageContaining("MODE", "+C")
+	})
+}
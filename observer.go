@@ -0,0 +1,83 @@
+package terrarium
+
+import (
+	"fmt"
+
+	"github.com/horgh/irc"
+)
+
+// An observer link is one we mark observer in the servers config. The server
+// gets our burst and everything we propagate like any other, but it may only
+// watch. We reject the users and servers it introduces and ignore anything it
+// says that would change the network, such as channels it bursts. This is for
+// servers that log, gather statistics, or monitor the spanning tree.
+
+// observerCommands are the commands we accept from an observer link. Numerics
+// are fine too. They are replies to our users' queries.
+var observerCommands = map[string]struct{}{
+	"PING":  {},
+	"PONG":  {},
+	"ERROR": {},
+	"SQUIT": {},
+	"ENCAP": {},
+}
+
+// observerAllows decides whether to act on a message from an observer link.
+// If not, we reject or ignore it here.
+func (s *LocalServer) observerAllows(m irc.Message) bool {
+	if isNumericCommand(m.Command) {
+		return true
+	}
+
+	if _, ok := observerCommands[m.Command]; ok {
+		// It may tell us it is leaving, but not that others are.
+		if m.Command == "SQUIT" && len(m.Params) > 0 &&
+			TS6SID(m.Params[0]) != s.Server.SID {
+			s.observerIgnore(m)
+			return false
+		}
+
+		// It may tell us its capabilities. Nothing else.
+		if m.Command == "ENCAP" && (len(m.Params) < 2 || m.Params[1] != "GCAP") {
+			s.observerIgnore(m)
+			return false
+		}
+
+		return true
+	}
+
+	// Tell it to remove the users and servers it tried to introduce so that it
+	// doesn't think they are on the network.
+
+	if m.Command == "UID" && len(m.Params) == 9 {
+		s.burstNotice("users from observer links rejected", fmt.Sprintf(
+			"Rejected user %s from observer link %s", m.Params[0], s.Server.Name))
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "KILL",
+			Params: []string{m.Params[7], fmt.Sprintf("%s (Observer link)",
+				s.Catbox.Config.ServerName)},
+		})
+		return false
+	}
+
+	if m.Command == "SID" && len(m.Params) >= 4 {
+		s.burstNotice("servers from observer links rejected", fmt.Sprintf(
+			"Rejected server %s from observer link %s", m.Params[0], s.Server.Name))
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "SQUIT",
+			Params:  []string{m.Params[2], "Observer link"},
+		})
+		return false
+	}
+
+	s.observerIgnore(m)
+	return false
+}
+
+// observerIgnore drops a message from an observer link.
+func (s *LocalServer) observerIgnore(m irc.Message) {
+	s.Catbox.debugf("s2s", "Ignoring %s from observer link %s", m.Command,
+		s.Server.Name)
+}
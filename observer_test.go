@@ -0,0 +1,62 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// An observer link gets our users and channels but may not add its own.
+func TestMemNetworkObserverLink(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.Servers = map[string]*ServerDefinition{}
+		for name, link := range a.cb.Config.Servers {
+			observer := *link
+			observer.Observer = true
+			cfg.Servers[name] = &observer
+		}
+		a.cb.setConfig(&cfg)
+	})
+
+	alice := a.connectUser("alice", "alice")
+	alice.send(irc.Message{Command: "JOIN", Params: []string{"#chan"}})
+	bob := b.connectUser("bob", "bob")
+	bob.send(irc.Message{Command: "JOIN", Params: []string{"#other"}})
+	n.waitFor("the users to join", func() bool {
+		return alice.hasMessage("366") && bob.hasMessage("366")
+	})
+
+	n.link("a.example.com", "b.example.com")
+	n.waitFor("the observer to get the burst", func() bool {
+		return b.userServer("alice") == "a.example.com"
+	})
+	n.waitFor("the observer's user to be killed", func() bool {
+		return bob.hasMessage("ERROR")
+	})
+
+	if server := a.userServer("bob"); server != "" {
+		t.Errorf("a knows bob on %s, wanted not at all", server)
+	}
+	a.call(func() {
+		if _, exists := a.cb.Channels[canonicalizeChannel("#other")]; exists {
+			t.Errorf("a knows the observer's channel")
+		}
+	})
+
+	// We still propagate to it.
+	alice.send(irc.Message{Command: "TOPIC", Params: []string{"#chan", "hi"}})
+	n.waitFor("the topic to reach the observer", func() bool {
+		topic := ""
+		b.call(func() {
+			if channel, exists := b.cb.Channels[canonicalizeChannel("#chan")]; exists {
+				topic = channel.Topic
+			}
+		})
+		return topic == "hi"
+	})
+}
@@ -0,0 +1,102 @@
+package terrarium
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// Who may touch what.
+//
+// The server goroutine (the one running eventLoop()) owns the server's state:
+// the LocalClients, LocalUsers, LocalServers, Opers, Nicks, Users, Servers,
+// Channels, KLines, HostUsers, and LinkStatuses maps, the counters, and
+// everything reachable from them (clients, users, servers, channels). Only it
+// may read or change them. Other goroutines (connection readers and writers,
+// accepting connections, dialing servers, the alarm, signal handling) tell it
+// things by sending Events on ToServerChan.
+//
+// Other goroutines may use:
+// - Config, but only through config(). Rehashing swaps in a new Config rather
+//   than changing the one in use, so what config() returns does not change.
+// - NextClientID, NextVirtualClientID, and freeClientIDs, through
+//   getClientID() and getVirtualClientID().
+// - Certificate, holding CertificateMutex.
+// - ShutdownChan, ToServerChan, and WG.
+// - LogLimiter and Debug, which have their own mutexes.
+// - A client's Conn and WriteChan before the client is known to the server
+//   goroutine, and after that only from its reader and writer.
+// - A client's WriteChan, from the fan-out worker with jobs for it, and its
+//   FanOutPending and FanOutExceeded, through sync/atomic. See fanout.go.
+//
+// To send a notice to operators from another goroutine, use
+// queueOperNotice().
+//
+// Setting CheckOwnership makes functions that touch owned state check they're
+// on the server goroutine. They panic if not. Tests turn this on.
+
+// config returns the current config. Goroutines other than the server
+// goroutine must use this rather than reading Config.
+func (cb *Catbox) config() *Config {
+	cb.ConfigMutex.RLock()
+	defer cb.ConfigMutex.RUnlock()
+	return cb.Config
+}
+
+// setConfig replaces the config. Only the server goroutine may call this.
+func (cb *Catbox) setConfig(cfg *Config) {
+	cb.assertOwner()
+	cb.ConfigMutex.Lock()
+	defer cb.ConfigMutex.Unlock()
+	cb.Config = cfg
+}
+
+// queueOperNotice sends a notice to operators from a goroutine other than the
+// server goroutine. The server goroutine sends it when it gets to it.
+func (cb *Catbox) queueOperNotice(msg string) {
+	cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() { cb.noticeOpers(msg) },
+	})
+}
+
+// assertOwner panics if CheckOwnership is on and we're not on the server
+// goroutine.
+func (cb *Catbox) assertOwner() {
+	if !cb.CheckOwnership {
+		return
+	}
+
+	// Before the event loop starts, the goroutine setting up owns everything.
+	owner := atomic.LoadUint64(&cb.ownerGoroutine)
+	if owner == 0 {
+		return
+	}
+
+	if id := goroutineID(); id != owner {
+		panic(fmt.Sprintf(
+			"server state accessed from goroutine %d, but goroutine %d owns it",
+			id, owner))
+	}
+}
+
+// goroutineID finds the ID of the current goroutine. Go does not expose this
+// so we read it from the stack trace. This is slow. Only use it for checks.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+
+	// goroutine 123 [running]:
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if idx := bytes.IndexByte(buf, ' '); idx != -1 {
+		buf = buf[:idx]
+	}
+
+	id, err := strconv.ParseUint(string(buf), 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("unable to parse goroutine ID: %s", err))
+	}
+	return id
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+// +build !windows
+
+package terrarium
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to the configured user and group, and chroots if
+// configured.
+//
+// Call this after we bind our listeners and read our certificate, as we may
+// no longer be able to once we drop privileges.
+func dropPrivileges(cfg *Config) error {
+	if cfg.RunAsUser == "" && cfg.RunAsGroup == "" && cfg.Chroot == "" {
+		return nil
+	}
+
+	// Look up IDs before chrooting. The user and group databases are likely not
+	// in the chroot.
+	uid, gid := -1, -1
+
+	if cfg.RunAsUser != "" {
+		u, err := user.Lookup(cfg.RunAsUser)
+		if err != nil {
+			return fmt.Errorf("unable to look up user %s: %s", cfg.RunAsUser, err)
+		}
+
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid for user %s: %s", cfg.RunAsUser, u.Uid)
+		}
+
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("invalid gid for user %s: %s", cfg.RunAsUser, u.Gid)
+		}
+	}
+
+	if cfg.RunAsGroup != "" {
+		g, err := user.LookupGroup(cfg.RunAsGroup)
+		if err != nil {
+			return fmt.Errorf("unable to look up group %s: %s", cfg.RunAsGroup, err)
+		}
+
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid for group %s: %s", cfg.RunAsGroup, g.Gid)
+		}
+	}
+
+	// We must chroot before giving up root.
+	if cfg.Chroot != "" {
+		if err := syscall.Chroot(cfg.Chroot); err != nil {
+			return fmt.Errorf("unable to chroot to %s: %s", cfg.Chroot, err)
+		}
+
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("unable to change directory after chroot: %s", err)
+		}
+	}
+
+	// Drop the group before the user. Once we are no longer root we can't change
+	// our group.
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("unable to set supplementary groups: %s", err)
+		}
+
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("unable to set group to %d: %s", gid, err)
+		}
+	}
+
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to set user to %d: %s", uid, err)
+		}
+
+		// Make sure we can't get root back.
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return fmt.Errorf("still able to become root after dropping privileges")
+		}
+	}
+
+	return nil
+}
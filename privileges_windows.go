@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package terrarium
+
+import "fmt"
+
+// dropPrivileges switches to the configured user and group, and chroots if
+// configured. Windows supports none of these.
+func dropPrivileges(cfg *Config) error {
+	if cfg.RunAsUser == "" && cfg.RunAsGroup == "" && cfg.Chroot == "" {
+		return nil
+	}
+
+	return fmt.Errorf("user, group, and chroot are not supported on Windows")
+}
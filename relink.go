@@ -0,0 +1,123 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// When a server splits, we remember its SID and name, and which of our links
+// it was behind, for relink-grace-time. If something introduces a server with
+// that SID or name through a different link in that time, we refuse it. During
+// a split, different parts of the network may disagree about which servers
+// are where, and a hostile server may use that to claim to be one that just
+// left. Operators may let a server link sooner with ALLOWRELINK.
+
+// recentSplit is a server that split from us lately.
+type recentSplit struct {
+	SID  TS6SID
+	Name string
+
+	// The name of the server we linked to it through. Its own name if it was
+	// linked to us.
+	Path string
+
+	Time time.Time
+}
+
+// recordSplit remembers that a server split from us.
+func (cb *Catbox) recordSplit(server *Server, path string) {
+	if cb.Config.RelinkGraceTime == 0 {
+		return
+	}
+
+	cb.RecentSplits[server.SID] = &recentSplit{
+		SID:  server.SID,
+		Name: server.Name,
+		Path: path,
+		Time: cb.now(),
+	}
+}
+
+// checkRelink decides whether a server may link through the given path. If
+// not, it says why.
+func (cb *Catbox) checkRelink(sid TS6SID, name, path string) (string, bool) {
+	now := cb.now()
+	for _, split := range cb.RecentSplits {
+		if split.SID != sid && !strings.EqualFold(split.Name, name) {
+			continue
+		}
+		if now.Sub(split.Time) >= cb.Config.RelinkGraceTime ||
+			strings.EqualFold(split.Path, path) {
+			continue
+		}
+
+		return fmt.Sprintf(
+			"%s (%s) split from behind %s %s ago and may not link through %s for %s. Use ALLOWRELINK to allow it.",
+			split.Name, split.SID, split.Path,
+			now.Sub(split.Time).Round(time.Second), path,
+			cb.Config.RelinkGraceTime), false
+	}
+	return "", true
+}
+
+// expireRecentSplits forgets splits older than relink-grace-time.
+func (cb *Catbox) expireRecentSplits() {
+	now := cb.now()
+	for sid, split := range cb.RecentSplits {
+		if now.Sub(split.Time) >= cb.Config.RelinkGraceTime {
+			delete(cb.RecentSplits, sid)
+		}
+	}
+}
+
+// ALLOWRELINK lets a server that split lately link through another path now.
+// Without a server, it lists the servers we're holding back.
+//
+// Parameters: [<server name or SID>]
+func (u *LocalUser) allowRelinkCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) == 0 || m.Params[0] == "" {
+		var splits []*recentSplit
+		for _, split := range u.Catbox.RecentSplits {
+			splits = append(splits, split)
+		}
+		sort.Slice(splits, func(i, j int) bool {
+			return splits[i].Name < splits[j].Name
+		})
+
+		for _, split := range splits {
+			u.serverNotice(fmt.Sprintf("%s (%s) split from behind %s %s ago",
+				split.Name, split.SID, split.Path,
+				u.Catbox.now().Sub(split.Time).Round(time.Second)))
+		}
+		u.serverNotice(fmt.Sprintf("%d servers may link only as they were.",
+			len(splits)))
+		return
+	}
+
+	for sid, split := range u.Catbox.RecentSplits {
+		if string(sid) != m.Params[0] &&
+			!strings.EqualFold(split.Name, m.Params[0]) {
+			continue
+		}
+
+		delete(u.Catbox.RecentSplits, sid)
+		u.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"%s allowed %s (%s) to link through any server.", u.User.DisplayNick,
+			split.Name, split.SID))
+		return
+	}
+
+	// 402 ERR_NOSUCHSERVER
+	u.messageFromServer("402", []string{m.Params[0],
+		"No server split lately with that name"})
+}
@@ -0,0 +1,50 @@
+package terrarium
+
+import (
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// A server that split may not come back through a different server for a
+// while unless an operator allows it.
+func TestMemNetworkRelinkGraceTime(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.RelinkGraceTime = time.Minute
+		a.cb.setConfig(&cfg)
+	})
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+
+	n.link("a.example.com", "b.example.com")
+	n.link("b.example.com", "c.example.com")
+	n.waitForConverged(1)
+
+	n.split("b.example.com", "c.example.com")
+	n.waitFor("a to hear c split", func() bool {
+		servers := 0
+		a.call(func() { servers = len(a.cb.Servers) })
+		return servers == 1
+	})
+
+	n.link("c.example.com", "a.example.com")
+	n.waitFor("c to be refused", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"Refused link from c.example.com: c.example.com (2AA) split from behind b.example.com")
+	})
+
+	oper.send(irc.Message{Command: "ALLOWRELINK", Params: []string{"c.example.com"}})
+	n.waitFor("c to be allowed", func() bool {
+		return oper.hasMessageContaining("NOTICE",
+			"oper allowed c.example.com (2AA) to link through any server")
+	})
+
+	n.link("c.example.com", "a.example.com")
+	n.waitForConverged(1)
+}
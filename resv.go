@@ -0,0 +1,99 @@
+package terrarium
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Some nicks no one has may still be unavailable to our users:
+//
+// - Reserved nicks (RESV), from resv-nicks in the config, such as nicks
+//   services use. Our users may never take them.
+// - Delayed nicks. When a server splits from us, we hold the nicks of the
+//   users we lost for nick-delay, so no one takes them over while their owners
+//   are away.
+//
+// ISON and MONITOR count unavailable nicks as present, since trying to take
+// one would fail. See monitor.go.
+
+// isReservedNick checks if a nick matches one of the reserved nick masks. The
+// nick must be canonicalized.
+func (cb *Catbox) isReservedNick(nick string) bool {
+	for _, mask := range cb.Config.ResvNicks {
+		if matchMask(mask, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDelayedNick checks if we're holding a nick after a netsplit. The nick must
+// be canonicalized.
+func (cb *Catbox) isDelayedNick(nick string) bool {
+	until, exists := cb.NickDelays[nick]
+	return exists && cb.now().Before(until)
+}
+
+// isNickUnavailable checks if no one has the nick but our users still may not
+// take it. The nick must be canonicalized.
+func (cb *Catbox) isNickUnavailable(nick string) bool {
+	if _, exists := cb.Nicks[nick]; exists {
+		return false
+	}
+	return cb.isReservedNick(nick) || cb.isDelayedNick(nick)
+}
+
+// nickRefusal checks if a local user may take a nick no one has. If not, it
+// returns the numeric and text to refuse them with.
+func (cb *Catbox) nickRefusal(nick string) (string, string) {
+	canon := canonicalizeNick(nick)
+	if cb.isReservedNick(canon) {
+		// 432 ERR_ERRONEUSNICKNAME
+		return "432", "Nickname is reserved"
+	}
+	if cb.isDelayedNick(canon) {
+		// 437 ERR_UNAVAILRESOURCE
+		return "437", "Nick/channel is temporarily unavailable"
+	}
+	return "", ""
+}
+
+// delayNick holds a nick for nick-delay, if it is set. We call this for users
+// we lose in a netsplit.
+func (cb *Catbox) delayNick(nick string) {
+	if cb.Config.NickDelay == 0 {
+		return
+	}
+	cb.NickDelays[canonicalizeNick(nick)] = cb.now().Add(cb.Config.NickDelay)
+}
+
+// expireNickDelays stops holding nicks once their delay is up. Users
+// monitoring them hear they're offline.
+func (cb *Catbox) expireNickDelays() {
+	now := cb.now()
+	for nick, until := range cb.NickDelays {
+		if now.Before(until) {
+			continue
+		}
+		delete(cb.NickDelays, nick)
+		cb.nickOffline(nick)
+	}
+}
+
+// parseResvNicks parses a comma separated list of nick masks, such as
+// NickServ,*Serv. It canonicalizes them.
+func parseResvNicks(s string) ([]string, error) {
+	var masks []string
+	for _, mask := range strings.Split(s, ",") {
+		mask = canonicalizeNick(strings.TrimSpace(mask))
+		if mask == "" {
+			continue
+		}
+		if !isValidNick(len(mask), strings.NewReplacer("*", "a", "?",
+			"a").Replace(mask)) {
+			return nil, fmt.Errorf("invalid reserved nick: %s", mask)
+		}
+		masks = append(masks, mask)
+	}
+	return masks, nil
+}
@@ -0,0 +1,81 @@
+package terrarium
+
+import (
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// MONITOR and ISON count reserved nicks and nicks held after a netsplit as
+// online, and users may not take them.
+func TestMemNetworkMonitorResvNickDelay(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.ResvNicks = []string{"*serv"}
+		cfg.NickDelay = time.Minute
+		a.cb.setConfig(&cfg)
+	})
+
+	watcher := a.connectUser("watcher", "watcher")
+	watcher.send(irc.Message{Command: "MONITOR",
+		Params: []string{"+", "bob,NickServ,carol"}})
+	n.waitFor("watcher's monitor status", func() bool {
+		return watcher.hasMessage("731")
+	})
+	if m := watcher.lastMessage("730"); m == nil || m.Params[1] != "NickServ" {
+		t.Errorf("NickServ was not online: %v", m)
+	}
+	if m := watcher.lastMessage("731"); m == nil || m.Params[1] != "bob,carol" {
+		t.Errorf("bob and carol were not offline: %v", m)
+	}
+
+	n.link("a.example.com", "b.example.com")
+	_ = b.connectUser("bob", "bob")
+	n.waitForConverged(2)
+	n.waitFor("bob to come online", func() bool {
+		return watcher.hasMessageContaining("730", "bob!~bob@")
+	})
+
+	n.split("a.example.com", "b.example.com")
+	n.waitFor("the split", func() bool {
+		gone := false
+		a.call(func() { gone = len(a.cb.Servers) == 0 })
+		return gone
+	})
+
+	watcher.send(irc.Message{Command: "ISON",
+		Params: []string{"bob NickServ carol"}})
+	n.waitFor("ISON", func() bool { return watcher.hasMessage("303") })
+	if m := watcher.lastMessage("303"); m.Params[1] != "bob NickServ" {
+		t.Errorf("ISON said %q, wanted bob NickServ", m.Params[1])
+	}
+	if watcher.hasMessage("731") && watcher.lastMessage("731").Params[1] ==
+		"bob" {
+		t.Errorf("bob went offline while we held the nick")
+	}
+
+	watcher.send(irc.Message{Command: "NICK", Params: []string{"bob"}})
+	n.waitFor("bob to be unavailable", func() bool {
+		return watcher.hasMessage("437")
+	})
+	watcher.send(irc.Message{Command: "NICK", Params: []string{"ChanServ"}})
+	n.waitFor("ChanServ to be reserved", func() bool {
+		return watcher.hasMessageContaining("432", "reserved")
+	})
+
+	n.advance(2 * time.Minute)
+	n.waitFor("bob to go offline", func() bool {
+		m := watcher.lastMessage("731")
+		return m != nil && m.Params[1] == "bob"
+	})
+
+	watcher.send(irc.Message{Command: "NICK", Params: []string{"bob"}})
+	n.waitFor("watcher to take bob", func() bool {
+		return watcher.hasMessageContaining("NICK", "bob")
+	})
+}
@@ -35,6 +35,9 @@ type Server struct {
 
 	// We know what server it is linked to. The SID message tells us.
 	LinkedTo *Server
+
+	// How many users are on it. We count as users arrive and leave.
+	UserCount int
 }
 
 func (s *Server) String() string {
@@ -87,14 +90,3 @@ func (s *Server) getLinkedServers(allServers map[TS6SID]*Server) []*Server {
 
 	return linkedServers
 }
-
-// Count how many users are on this server.
-func (s *Server) getLocalUserCount(users map[TS6UID]*User) int {
-	count := 0
-	for _, u := range users {
-		if u.Server == s {
-			count++
-		}
-	}
-	return count
-}
@@ -0,0 +1,37 @@
+package terrarium
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+// handleSignals turns signals we receive into events for the server. See
+// signalEvent() for the platform specific meaning of each signal.
+//
+// It runs until we shut down.
+func (cb *Catbox) handleSignals(signalChan chan os.Signal) {
+	defer cb.WG.Done()
+
+	for {
+		select {
+		case sig := <-signalChan:
+			evtType, ok := signalEvent(sig)
+			if !ok {
+				log.Printf("Received unknown signal: %s", sig)
+				continue
+			}
+			log.Printf("Received %s signal", sig)
+			cb.newEvent(Event{Type: evtType})
+		case <-cb.ShutdownChan:
+			signal.Stop(signalChan)
+			// After Stop() we're guaranteed we will receive no more on the channel,
+			// so we can close the channel, and then drain it.
+			close(signalChan)
+			for range signalChan {
+			}
+			log.Printf("Signal listener shutting down.")
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package terrarium
+
+import (
+	"os"
+	"syscall"
+)
+
+// controlSignals are the signals we act on.
+func controlSignals() []os.Signal {
+	return []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1}
+}
+
+// signalEvent decides what to do when we receive a signal:
+//
+// SIGHUP - Rehash.
+//
+// SIGINT or SIGUSR1 - Restart.
+func signalEvent(sig os.Signal) (EventType, bool) {
+	switch sig {
+	case syscall.SIGHUP:
+		return RehashEvent, true
+	case syscall.SIGINT, syscall.SIGUSR1:
+		return RestartEvent, true
+	}
+	return NullEvent, false
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package terrarium
+
+import "os"
+
+// controlSignals are the signals we act on. Windows has no SIGHUP or SIGUSR1.
+// We only see interrupts (e.g., Ctrl+C or the console closing). To rehash or
+// restart, use the REHASH and RESTART commands, the admin socket (Windows has
+// Unix sockets from Windows 10), or Rehash() and RequestRestart().
+//
+// We don't run as a Windows service or listen on a named pipe. Both need the
+// service control and pipe APIs, which the standard library doesn't have.
+func controlSignals() []os.Signal {
+	return []os.Signal{os.Interrupt}
+}
+
+// signalEvent decides what to do when we receive a signal. We shut down on
+// interrupt.
+func signalEvent(sig os.Signal) (EventType, bool) {
+	if sig == os.Interrupt {
+		return ShutdownEvent, true
+	}
+	return NullEvent, false
+}
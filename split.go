@@ -0,0 +1,199 @@
+package terrarium
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/horgh/irc"
+)
+
+// Helpers to split messages that would be too long to encode into multiple
+// messages that each fit in irc.MaxLineLength. Encoding truncates long
+// messages. A truncated message is often invalid (e.g., a list cut in the
+// middle of a nick), so we prefer to split instead.
+
+// messageBaseSize returns the length of the message when encoded with an empty
+// last parameter. This is how much space is used before we add anything to
+// the last parameter.
+func messageBaseSize(m irc.Message) (int, error) {
+	if len(m.Params) == 0 {
+		return 0, fmt.Errorf("message has no parameters")
+	}
+
+	params := make([]string, len(m.Params))
+	copy(params, m.Params)
+	params[len(params)-1] = ""
+
+	buf, err := irc.Message{
+		Prefix:  m.Prefix,
+		Command: m.Command,
+		Params:  params,
+	}.Encode()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// splitListMessage builds messages based on m with the items packed into the
+// last parameter separated by spaces. It uses as few messages as possible
+// while keeping each within the line length limit. The last parameter of m is
+// replaced.
+//
+// An item is never split. If a single item does not fit, it is sent in a
+// message by itself.
+func splitListMessage(m irc.Message, items []string) ([]irc.Message, error) {
+	return splitListMessageWith(m, items, " ")
+}
+
+// splitListMessageWith is like splitListMessage but separates the items with
+// sep, such as a comma.
+func splitListMessageWith(m irc.Message, items []string,
+	sep string) ([]irc.Message, error) {
+	baseSize, err := messageBaseSize(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []irc.Message
+	add := func(list string) {
+		params := make([]string, len(m.Params))
+		copy(params, m.Params)
+		params[len(params)-1] = list
+		msgs = append(msgs, irc.Message{
+			Prefix:  m.Prefix,
+			Command: m.Command,
+			Params:  params,
+		})
+	}
+
+	list := ""
+	for _, item := range items {
+		if len(list) == 0 {
+			list = item
+			continue
+		}
+
+		if baseSize+len(list)+len(sep)+len(item) > irc.MaxLineLength {
+			add(list)
+			list = item
+			continue
+		}
+
+		list += sep + item
+	}
+
+	if len(list) > 0 {
+		add(list)
+	}
+
+	return msgs, nil
+}
+
+// splitTrailingMessage splits the last parameter of m across as many messages
+// as necessary so each fits within the line length limit. This is suitable for
+// free text such as a topic or a message.
+//
+// We split at a space if there is one in the chunk, and never in the middle of
+// a UTF-8 sequence.
+func splitTrailingMessage(m irc.Message) ([]irc.Message, error) {
+	baseSize, err := messageBaseSize(m)
+	if err != nil {
+		return nil, err
+	}
+
+	room := irc.MaxLineLength - baseSize
+	if room <= 0 {
+		return nil, fmt.Errorf("no room for last parameter")
+	}
+
+	var msgs []irc.Message
+	text := m.Params[len(m.Params)-1]
+	for {
+		chunk := text
+		if len(chunk) > room {
+			end := room
+			for end > 0 && !utf8.RuneStart(text[end]) {
+				end--
+			}
+			if end == 0 {
+				end = room
+			}
+
+			if space := strings.LastIndexByte(text[:end], ' '); space > 0 {
+				end = space
+			}
+
+			chunk = text[:end]
+		}
+
+		params := make([]string, len(m.Params))
+		copy(params, m.Params)
+		params[len(params)-1] = chunk
+		msgs = append(msgs, irc.Message{
+			Prefix:  m.Prefix,
+			Command: m.Command,
+			Params:  params,
+		})
+
+		text = strings.TrimPrefix(text[len(chunk):], " ")
+		if len(text) == 0 {
+			break
+		}
+	}
+
+	return msgs, nil
+}
+
+// splitCommands are the messages to users we split across lines when they're
+// too long: free text, and replies whose last parameter is a list of words.
+// Splitting anything else would have the user see a command repeated, so we
+// truncate those.
+var splitCommands = map[string]struct{}{
+	"PRIVMSG": {},
+	"NOTICE":  {},
+	// RPL_USERHOST, RPL_ISON, RPL_WHOISCHANNELS, RPL_NAMREPLY
+	"302": {},
+	"303": {},
+	"319": {},
+	"353": {},
+}
+
+// encodeMessage encodes the message to send on the wire. If it is too long and
+// split is true, we split its last parameter across multiple lines rather than
+// truncate, if it is a message in splitCommands. We never split messages to
+// servers. They would see each part as a separate command.
+//
+// If we do not split the message, we return the truncated line and
+// irc.ErrTruncated.
+func encodeMessage(m irc.Message, split bool) ([]string, error) {
+	buf, err := m.Encode()
+	if err == nil {
+		return []string{buf}, nil
+	}
+	if err != irc.ErrTruncated {
+		return nil, err
+	}
+
+	if _, ok := splitCommands[m.Command]; !ok || !split {
+		return []string{buf}, err
+	}
+
+	msgs, splitErr := splitTrailingMessage(m)
+	if splitErr != nil {
+		return []string{buf}, err
+	}
+
+	var bufs []string
+	for _, msg := range msgs {
+		buf, err := msg.Encode()
+		if err != nil && err != irc.ErrTruncated {
+			return nil, err
+		}
+		bufs = append(bufs, buf)
+	}
+
+	return bufs, nil
+}
@@ -0,0 +1,81 @@
+package terrarium
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// With strict-links on, we check the hostnames, IPs, and nick!user@host
+// strings other servers send us in UID, TB, and KILL, rather than take them
+// as they are. A server that sends one we don't accept is broken or hostile,
+// so we delink it. This is off by default because other servers may accept
+// more than we do.
+
+// maxStrictHostLength is the longest hostname we accept in strict mode. This
+// is ircd-ratbox's HOSTLEN.
+const maxStrictHostLength = 63
+
+// isValidStrictHost checks a user's hostname from another server. It may be a
+// hostname, an IP, or a cloak such as user/alice or an IPv6 address.
+func isValidStrictHost(s string) bool {
+	// A leading : would make it the last parameter of a message.
+	if len(s) == 0 || len(s) > maxStrictHostLength || s[0] == ':' {
+		return false
+	}
+
+	for _, char := range s {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') || char == '.' || char == '-' ||
+			char == ':' || char == '/' || char == '_' {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// isValidStrictIP checks a user's IP from another server. 0 means the server
+// won't say.
+func isValidStrictIP(s string) bool {
+	return s == "0" || net.ParseIP(s) != nil
+}
+
+// isValidUhost checks a string is a nick!user@host.
+func isValidUhost(maxNickLength int, s string) bool {
+	bang := strings.IndexByte(s, '!')
+	at := strings.LastIndexByte(s, '@')
+	if bang == -1 || at < bang {
+		return false
+	}
+
+	return isValidNick(maxNickLength, s[:bang]) && isValidUser(s[bang+1:at]) &&
+		isValidStrictHost(s[at+1:])
+}
+
+// isValidKillPath checks where a KILL says it came from. A server sends
+// <server name> if it killed the user itself, or
+// <server name>!<host>!<username>!<nick> if an operator did.
+func isValidKillPath(maxNickLength int, s string) bool {
+	pieces := strings.Split(s, "!")
+	if len(pieces) == 1 {
+		return isValidHostname(pieces[0])
+	}
+
+	return len(pieces) == 4 && isValidHostname(pieces[0]) &&
+		isValidStrictHost(pieces[1]) && isValidUser(pieces[2]) &&
+		isValidNick(maxNickLength, pieces[3])
+}
+
+// strictCheck delinks the server if we're in strict mode and what it sent us
+// is not valid. It says whether to go on.
+func (s *LocalServer) strictCheck(command, what, value string,
+	valid bool) bool {
+	if valid || !s.Catbox.Config.StrictLinks {
+		return true
+	}
+
+	s.quit(fmt.Sprintf("Invalid %s in %s: %s", what, command, value))
+	return false
+}
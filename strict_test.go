@@ -0,0 +1,80 @@
+package terrarium
+
+import "testing"
+
+func TestStrictValidation(t *testing.T) {
+	hosts := []struct {
+		input string
+		valid bool
+	}{
+		{"irc.example.com", true},
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"0::1", true},
+		{"user/alice", true},
+		{"anonymous", true},
+		{"::1", false},
+		{"", false},
+		{"bad host", false},
+		{"bad!host", false},
+		{"bad@host", false},
+	}
+	for _, test := range hosts {
+		if got := isValidStrictHost(test.input); got != test.valid {
+			t.Errorf("isValidStrictHost(%q) = %v, wanted %v", test.input, got,
+				test.valid)
+		}
+	}
+
+	ips := []struct {
+		input string
+		valid bool
+	}{
+		{"0", true},
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"192.0.2", false},
+		{"example.com", false},
+	}
+	for _, test := range ips {
+		if got := isValidStrictIP(test.input); got != test.valid {
+			t.Errorf("isValidStrictIP(%q) = %v, wanted %v", test.input, got,
+				test.valid)
+		}
+	}
+
+	uhosts := []struct {
+		input string
+		valid bool
+	}{
+		{"alice!~alice@example.com", true},
+		{"alice!~alice@user/alice", true},
+		{"alice@example.com", false},
+		{"alice!~alice", false},
+		{"alice!bad user@example.com", false},
+		{"a*!~alice@example.com", false},
+	}
+	for _, test := range uhosts {
+		if got := isValidUhost(9, test.input); got != test.valid {
+			t.Errorf("isValidUhost(%q) = %v, wanted %v", test.input, got,
+				test.valid)
+		}
+	}
+
+	paths := []struct {
+		input string
+		valid bool
+	}{
+		{"irc.example.com", true},
+		{"irc.example.com!example.com!~alice!alice", true},
+		{"irc.example.com!example.com!~alice", false},
+		{"irc.example.com!example.com!~alice!bad nick", false},
+		{"bad server!example.com!~alice!alice", false},
+	}
+	for _, test := range paths {
+		if got := isValidKillPath(9, test.input); got != test.valid {
+			t.Errorf("isValidKillPath(%q) = %v, wanted %v", test.input, got,
+				test.valid)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package terrarium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// VERSIONSURVEY lets operators find out what client software the users on
+// this server run, such as to decide which IRCv3 features matter most. We send
+// each local user a CTCP VERSION from the server, a few at a time, and count
+// the replies by the client's name. We keep only the counts, not who runs
+// what.
+
+// versionSurveyRate is how many users we ask each second.
+const versionSurveyRate = 10
+
+// versionSurveyNameLength is how much of a client's name we keep.
+const versionSurveyNameLength = 32
+
+// versionSurvey is a survey underway or done.
+type versionSurvey struct {
+	// Who started it, and when.
+	StartedBy string
+	Started   time.Time
+
+	// Users we have yet to ask.
+	Pending []TS6UID
+
+	// Users we asked who have not replied.
+	Asked map[TS6UID]struct{}
+
+	// How many users we have asked and how many replied.
+	AskedCount   int
+	RepliedCount int
+
+	// How many replies there were from each client, by name.
+	Clients map[string]int
+}
+
+// VERSIONSURVEY starts a survey, stops one, or shows how one is going.
+//
+// Parameters: [START|STOP]
+func (u *LocalUser) versionSurveyCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	action := ""
+	if len(m.Params) > 0 {
+		action = strings.ToUpper(m.Params[0])
+	}
+
+	switch action {
+	case "START":
+		u.Catbox.startVersionSurvey(u.User)
+		u.serverNotice(fmt.Sprintf("Asking %d users what client they use.",
+			len(u.Catbox.VersionSurvey.Pending)))
+	case "STOP":
+		survey := u.Catbox.VersionSurvey
+		if survey == nil || len(survey.Pending) == 0 {
+			u.serverNotice("There is no version survey underway.")
+			return
+		}
+		survey.Pending = nil
+		u.serverNotice("Stopped the version survey.")
+	case "":
+		for _, line := range u.Catbox.versionSurveyReport() {
+			u.serverNotice(line)
+		}
+	default:
+		u.serverNotice("Usage: VERSIONSURVEY [START|STOP]")
+	}
+}
+
+// startVersionSurvey starts a survey of the users on this server, replacing
+// any earlier one.
+func (cb *Catbox) startVersionSurvey(by *User) {
+	survey := &versionSurvey{
+		StartedBy: by.DisplayNick,
+		Started:   cb.now(),
+		Asked:     map[TS6UID]struct{}{},
+		Clients:   map[string]int{},
+	}
+
+	for _, user := range cb.LocalUsers {
+		survey.Pending = append(survey.Pending, user.User.UID)
+	}
+	sort.Slice(survey.Pending, func(i, j int) bool {
+		return survey.Pending[i] < survey.Pending[j]
+	})
+
+	cb.VersionSurvey = survey
+	cb.noticeLocalOpers(fmt.Sprintf("%s started a version survey of %d users.",
+		by.DisplayNick, len(survey.Pending)))
+}
+
+// continueVersionSurvey asks the next few users, if a survey is underway.
+func (cb *Catbox) continueVersionSurvey() {
+	survey := cb.VersionSurvey
+	if survey == nil {
+		return
+	}
+
+	for asked := 0; asked < versionSurveyRate && len(survey.Pending) > 0; {
+		uid := survey.Pending[0]
+		survey.Pending = survey.Pending[1:]
+
+		// They may have left.
+		user, exists := cb.Users[uid]
+		if !exists || !user.isLocal() {
+			continue
+		}
+
+		user.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "PRIVMSG",
+			Params:  []string{user.DisplayNick, "\x01VERSION\x01"},
+		})
+		survey.Asked[uid] = struct{}{}
+		survey.AskedCount++
+		asked++
+	}
+}
+
+// versionSurveyReply counts a user's reply to our CTCP VERSION. We count each
+// user we asked once.
+func (cb *Catbox) versionSurveyReply(user *User, text string) {
+	survey := cb.VersionSurvey
+	if survey == nil {
+		return
+	}
+	if _, asked := survey.Asked[user.UID]; !asked {
+		return
+	}
+
+	if command, ok := ctcpCommand(text); !ok || command != "VERSION" {
+		return
+	}
+	delete(survey.Asked, user.UID)
+	survey.RepliedCount++
+
+	// The reply is "\x01VERSION <client and whatever else>\x01". Keep only the
+	// first word, which is usually the client's name. The rest can say more
+	// about the user than we want to know, such as their operating system.
+	fields := strings.Fields(stripFormatting(strings.Trim(text, "\x01")))
+	name := "(blank)"
+	if len(fields) > 1 {
+		name = strings.TrimRight(fields[1], ":,;")
+		if len(name) > versionSurveyNameLength {
+			name = name[:versionSurveyNameLength]
+		}
+	}
+	survey.Clients[name]++
+}
+
+// versionSurveyReport describes how the survey is going and what clients the
+// replies were from, most common first.
+func (cb *Catbox) versionSurveyReport() []string {
+	survey := cb.VersionSurvey
+	if survey == nil {
+		return []string{"There has been no version survey."}
+	}
+
+	state := "done"
+	if len(survey.Pending) > 0 {
+		state = fmt.Sprintf("underway, %d users left to ask", len(survey.Pending))
+	}
+
+	lines := []string{fmt.Sprintf(
+		"Version survey %s started %s ago is %s. Asked %d users, %d replied.",
+		survey.StartedBy, cb.now().Sub(survey.Started).Round(time.Second), state,
+		survey.AskedCount, survey.RepliedCount)}
+
+	var names []string
+	for name := range survey.Clients {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if survey.Clients[names[i]] != survey.Clients[names[j]] {
+			return survey.Clients[names[i]] > survey.Clients[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		count := survey.Clients[name]
+		lines = append(lines, fmt.Sprintf("%s: %d (%.1f%%)", name, count,
+			100*float64(count)/float64(survey.RepliedCount)))
+	}
+
+	return lines
+}
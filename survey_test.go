@@ -0,0 +1,60 @@
+package terrarium
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// A version survey asks local users for their client and counts the replies.
+func TestMemNetworkVersionSurvey(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com")
+	a := n.servers["a.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	a.makeOper("oper")
+	users := []*memClient{oper}
+	for i := 0; i < 3; i++ {
+		users = append(users, a.connectUser(fmt.Sprintf("user%d", i), "user"))
+	}
+
+	oper.send(irc.Message{Command: "VERSIONSURVEY", Params: []string{"start"}})
+	n.waitFor("the survey to start", func() bool {
+		return oper.hasMessageContaining("NOTICE", "Asking 4 users")
+	})
+
+	n.advance(time.Second)
+	for _, user := range users {
+		n.waitFor("the CTCP VERSION", func() bool {
+			return user.hasMessageContaining("PRIVMSG", "\x01VERSION\x01")
+		})
+	}
+
+	replies := []string{"HexChat 2.16.1 / Linux", "irssi v1.4", "HexChat 2.14"}
+	for i, reply := range replies {
+		users[i].send(irc.Message{Command: "NOTICE",
+			Params: []string{"a.example.com", "\x01VERSION " + reply + "\x01"}})
+	}
+	// We count each user once.
+	users[0].send(irc.Message{Command: "NOTICE",
+		Params: []string{"a.example.com", "\x01VERSION HexChat\x01"}})
+
+	n.waitFor("the replies to be counted", func() bool {
+		done := false
+		a.call(func() { done = a.cb.VersionSurvey.RepliedCount == 3 })
+		return done
+	})
+
+	oper.send(irc.Message{Command: "VERSIONSURVEY"})
+	n.waitFor("the report", func() bool {
+		return oper.hasMessageContaining("NOTICE", "irssi: 1 (33.3%)")
+	})
+	for _, want := range []string{"is done. Asked 4 users, 3 replied.",
+		"HexChat: 2 (66.7%)"} {
+		if !oper.hasMessageContaining("NOTICE", want) {
+			t.Errorf("report did not say %q", want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package terrarium
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor systemd passes us. See sd_listen_fds(3).
+const systemdListenFDsStart = 3
+
+// systemdListenFDs finds listening sockets systemd passed to us through socket
+// activation. It returns listener name to file descriptor.
+//
+// systemd tells us about the sockets with the LISTEN_PID, LISTEN_FDS, and
+// LISTEN_FDNAMES environment variables. Give each listener its own socket
+// unit, named with FileDescriptorName= to say which listener it is for.
+// systemd names every socket in a unit the same. The names are:
+//
+// tcp - The plaintext listener from listen-host/listen-port.
+//
+// tls - The TLS listener from listen-host/listen-port-tls.
+//
+// If there is a single unnamed socket, we treat it the same as one given with
+// -listen-fd.
+//
+// We unset the variables so they do not pass on to processes we start.
+func systemdListenFDs(cfg *Config) (map[string]int, error) {
+	pid := os.Getenv("LISTEN_PID")
+	count := os.Getenv("LISTEN_FDS")
+	fdNames := os.Getenv("LISTEN_FDNAMES")
+
+	_ = os.Unsetenv("LISTEN_PID")     // nolint: gosec
+	_ = os.Unsetenv("LISTEN_FDS")     // nolint: gosec
+	_ = os.Unsetenv("LISTEN_FDNAMES") // nolint: gosec
+
+	if pid == "" || count == "" {
+		return nil, nil
+	}
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", count)
+	}
+
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	configured := listenerNames(cfg)
+	byKind := map[string]string{}
+	for name, isTLS := range configured {
+		if isTLS {
+			byKind["tls"] = name
+			continue
+		}
+		byKind["tcp"] = name
+	}
+
+	fds := map[string]int{}
+	for i := 0; i < n; i++ {
+		fd := systemdListenFDsStart + i
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		if name == "" || name == "unknown" {
+			if n != 1 {
+				return nil, fmt.Errorf(
+					"socket %d from systemd has no name. Set FileDescriptorName", fd)
+			}
+			fds[listenFDName] = fd
+			continue
+		}
+
+		listenerName, exists := byKind[name]
+		if !exists {
+			return nil, fmt.Errorf(
+				"socket %s from systemd does not match a configured listener", name)
+		}
+
+		fds[listenerName] = fd
+	}
+
+	return fds, nil
+}
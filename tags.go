@@ -0,0 +1,51 @@
+package terrarium
+
+import "strings"
+
+// Clients with the message-tags capability may get IRCv3 message tags on what
+// we send them. The IRC library we use knows nothing of tags, so we add them
+// to the lines as we write them (see outMessage). The only tag we send is
+// botTag.
+//
+// Clients with the capability may send us tags too. We don't act on any, so
+// we drop them as we read each line, and ignore TAGMSG, which carries only
+// tags.
+
+// botTag marks messages from users with bot mode (+B).
+const botTag = "draft/bot"
+
+// messageTagsFrom are the tags for a message to the client from the user.
+// Blank if there are none, or if the client can't have them. The user may be
+// nil if the message isn't from one.
+func (c *LocalClient) messageTagsFrom(source *User) string {
+	if source == nil || !source.isBot() || !c.hasCap("message-tags") {
+		return ""
+	}
+	return botTag
+}
+
+// addTags adds the tags to each of the encoded lines.
+func addTags(tags string, lines []string) []string {
+	if tags == "" {
+		return lines
+	}
+
+	tagged := make([]string, len(lines))
+	for i, line := range lines {
+		tagged[i] = "@" + tags + " " + line
+	}
+	return tagged
+}
+
+// stripTags removes the tags from a line we read, if it has any.
+func stripTags(line string) string {
+	if !strings.HasPrefix(line, "@") {
+		return line
+	}
+
+	space := strings.IndexByte(line, ' ')
+	if space == -1 {
+		return ""
+	}
+	return strings.TrimLeft(line[space:], " ")
+}
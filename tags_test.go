@@ -0,0 +1,36 @@
+package terrarium
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripTags(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"PRIVMSG #a :hi\r\n", "PRIVMSG #a :hi\r\n"},
+		{"@+typing=active TAGMSG #a\r\n", "TAGMSG #a\r\n"},
+		{"@label=1;+x  PING a\r\n", "PING a\r\n"},
+		{"@label=1\r\n", ""},
+	}
+	for _, test := range tests {
+		if got := stripTags(test.line); got != test.want {
+			t.Errorf("stripTags(%q) = %q, wanted %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestAddTags(t *testing.T) {
+	lines := []string{"PRIVMSG #a :hi\r\n", "PRIVMSG #a :there\r\n"}
+	if got := addTags("", lines); !reflect.DeepEqual(got, lines) {
+		t.Errorf("addTags without tags = %q", got)
+	}
+
+	want := []string{"@draft/bot PRIVMSG #a :hi\r\n",
+		"@draft/bot PRIVMSG #a :there\r\n"}
+	if got := addTags(botTag, lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("addTags = %q, wanted %q", got, want)
+	}
+}
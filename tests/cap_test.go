@@ -0,0 +1,496 @@
+package tests
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Support in Client for IRCv3 capability negotiation, SASL, and message tags.
+
+// TaggedMessage is a message along with its IRCv3 message tags.
+type TaggedMessage struct {
+	irc.Message
+
+	// Tag name to value. Tags without a value have a blank value. nil if the
+	// message had no tags.
+	Tags map[string]string
+}
+
+// The most bytes of base64 we send in one AUTHENTICATE message.
+const saslChunkSize = 400
+
+// RequestCaps sets capabilities to request when we register. Call it before
+// Start(). We request those the server offers. See HasCap() to find out which
+// the server acknowledged.
+func (c *Client) RequestCaps(caps ...string) {
+	c.wantCaps = append(c.wantCaps, caps...)
+}
+
+// UseSASL sets credentials to authenticate with using SASL PLAIN when we
+// register. Call it before Start(). Start() fails if authentication fails.
+func (c *Client) UseSASL(user, pass string) {
+	c.saslUser = user
+	c.saslPass = pass
+}
+
+// EnableTags makes the client deliver messages with their tags. Call it before
+// Start(). Messages then arrive on the tagged channel (see
+// GetTaggedChannel()) rather than on the receive channel.
+func (c *Client) EnableTags() {
+	c.tagged = true
+}
+
+// HasCap checks if the server acknowledged the capability.
+func (c Client) HasCap(capab string) bool {
+	_, exists := c.caps[capab]
+	return exists
+}
+
+// GetTaggedChannel retrieves the tagged receive channel. See EnableTags().
+func (c Client) GetTaggedChannel() <-chan TaggedMessage { return c.taggedChan }
+
+// negotiateCaps runs capability negotiation after we sent CAP LS, NICK, and
+// USER. It requests the capabilities we want that the server offers, runs
+// SASL if we want it, and ends negotiation.
+//
+// If the server does not support capabilities, it registers us without
+// replying to CAP LS. We stop when we see that.
+func (c *Client) negotiateCaps() error {
+	offered, registered, err := c.readCapLS()
+	if err != nil {
+		return err
+	}
+
+	if registered {
+		if c.saslUser != "" {
+			return fmt.Errorf("server does not support SASL")
+		}
+		return nil
+	}
+
+	var req []string
+	for _, capab := range c.wantCaps {
+		if _, exists := offered[capab]; exists {
+			req = append(req, capab)
+		}
+	}
+
+	if c.saslUser != "" {
+		if _, exists := offered["sasl"]; !exists {
+			return fmt.Errorf("server does not offer SASL")
+		}
+		req = append(req, "sasl")
+	}
+
+	if len(req) > 0 {
+		if err := c.writeMessage(irc.Message{
+			Command: "CAP",
+			Params:  []string{"REQ", strings.Join(req, " ")},
+		}); err != nil {
+			return err
+		}
+
+		m, err := c.waitFor(func(m irc.Message) bool {
+			return isCapReply(m, "ACK", "NAK")
+		})
+		if err != nil {
+			return fmt.Errorf("error waiting for CAP ACK: %s", err)
+		}
+		if m.Command == irc.ReplyWelcome {
+			return fmt.Errorf("registered before CAP ACK")
+		}
+
+		if m.Params[1] == "NAK" {
+			return fmt.Errorf("server refused capabilities: %s", m.Params[2])
+		}
+
+		for _, capab := range strings.Fields(m.Params[2]) {
+			if capab[0] == '-' {
+				delete(c.caps, capab[1:])
+				continue
+			}
+			c.caps[capab] = struct{}{}
+		}
+	}
+
+	if c.HasCap("sasl") {
+		if err := c.authenticate(); err != nil {
+			return err
+		}
+	}
+
+	return c.writeMessage(irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+}
+
+// readCapLS reads the reply to CAP LS. It may span several messages. We
+// return the offered capability names.
+//
+// If the server registers us instead (001), we say so.
+func (c *Client) readCapLS() (map[string]struct{}, bool, error) {
+	offered := map[string]struct{}{}
+
+	for {
+		m, err := c.waitFor(func(m irc.Message) bool {
+			return isCapReply(m, "LS")
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("error waiting for CAP LS: %s", err)
+		}
+
+		if m.Command == irc.ReplyWelcome {
+			return nil, true, nil
+		}
+
+		// CAP <nick> LS [*] :<caps>
+		if len(m.Params) < 3 {
+			return nil, false, fmt.Errorf("malformed CAP LS: %s", m)
+		}
+
+		for _, capab := range strings.Fields(m.Params[len(m.Params)-1]) {
+			// Capabilities may have a value: sasl=PLAIN,EXTERNAL
+			if idx := strings.Index(capab, "="); idx != -1 {
+				capab = capab[:idx]
+			}
+			offered[capab] = struct{}{}
+		}
+
+		if len(m.Params) == 3 {
+			return offered, false, nil
+		}
+	}
+}
+
+// authenticate runs SASL PLAIN.
+func (c *Client) authenticate() error {
+	if err := c.writeMessage(irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{"PLAIN"},
+	}); err != nil {
+		return err
+	}
+
+	m, err := c.waitFor(func(m irc.Message) bool {
+		return m.Command == "AUTHENTICATE"
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for AUTHENTICATE: %s", err)
+	}
+	if m.Command != "AUTHENTICATE" {
+		return fmt.Errorf("registered before SASL authentication")
+	}
+
+	payload := base64.StdEncoding.EncodeToString([]byte(
+		c.saslUser + "\x00" + c.saslUser + "\x00" + c.saslPass))
+
+	// We send the payload in chunks. If the last chunk is full, we send + to
+	// say we're done.
+	for {
+		chunk := payload
+		if len(chunk) > saslChunkSize {
+			chunk = chunk[:saslChunkSize]
+		}
+		payload = payload[len(chunk):]
+
+		if chunk == "" {
+			chunk = "+"
+		}
+
+		if err := c.writeMessage(irc.Message{
+			Command: "AUTHENTICATE",
+			Params:  []string{chunk},
+		}); err != nil {
+			return err
+		}
+
+		if len(chunk) < saslChunkSize {
+			break
+		}
+	}
+
+	// 903 RPL_SASLSUCCESS. Failures are 902, 904, 905, 906, and 907.
+	m, err = c.waitFor(func(m irc.Message) bool {
+		switch m.Command {
+		case "903", "902", "904", "905", "906", "907":
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for SASL result: %s", err)
+	}
+
+	if m.Command != "903" {
+		return fmt.Errorf("SASL authentication failed: %s", m)
+	}
+
+	return nil
+}
+
+// waitFor reads messages until we see one that matches. We stop as well if
+// the server registers us (001) since negotiation is then over.
+//
+// We keep other messages to deliver once we start.
+func (c *Client) waitFor(match func(irc.Message) bool) (*irc.Message, error) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		m, tags, err := c.readMessage()
+		if err != nil {
+			if strings.Contains(err.Error(), "i/o timeout") {
+				continue
+			}
+			return nil, err
+		}
+
+		if m.Command == "PING" {
+			if err := c.writeMessage(irc.Message{
+				Command: "PONG",
+				Params:  []string{m.Params[0]},
+			}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if m.Command == irc.ReplyWelcome {
+			c.pending = append(c.pending, TaggedMessage{Message: m, Tags: tags})
+			return &m, nil
+		}
+
+		if match(m) {
+			return &m, nil
+		}
+
+		c.pending = append(c.pending, TaggedMessage{Message: m, Tags: tags})
+	}
+
+	return nil, fmt.Errorf("timeout")
+}
+
+// isCapReply checks if the message is a CAP reply with one of the given
+// subcommands, such as CAP <nick> ACK :<caps>.
+func isCapReply(m irc.Message, subcommands ...string) bool {
+	if m.Command != "CAP" || len(m.Params) < 3 {
+		return false
+	}
+	for _, sub := range subcommands {
+		if m.Params[1] == sub {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTags splits the tags off a line. It returns the tags and the rest of
+// the line.
+func splitTags(line string) (map[string]string, string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+
+	idx := strings.Index(line, " ")
+	if idx == -1 {
+		return parseTags(line[1:]), ""
+	}
+
+	return parseTags(line[1:idx]), strings.TrimLeft(line[idx:], " ")
+}
+
+// parseTags parses the tags part of a message (without the leading @).
+//
+// We unescape values as the IRCv3 message tags specification describes.
+func parseTags(raw string) map[string]string {
+	tags := map[string]string{}
+
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+
+		idx := strings.Index(tag, "=")
+		if idx == -1 {
+			tags[tag] = ""
+			continue
+		}
+
+		tags[tag[:idx]] = unescapeTagValue(tag[idx+1:])
+	}
+
+	return tags
+}
+
+// unescapeTagValue reverses the escaping of a tag value.
+func unescapeTagValue(value string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		// A trailing backslash is dropped.
+		if i+1 == len(value) {
+			break
+		}
+
+		i++
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			// Includes \\. Others are invalid and we drop the backslash.
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		line string
+		tags map[string]string
+		rest string
+	}{
+		{
+			":irc.example.com NOTICE * :hi\r\n",
+			nil,
+			":irc.example.com NOTICE * :hi\r\n",
+		},
+		{
+			"@time=2020-01-01T00:00:00.000Z :irc.example.com NOTICE * :hi\r\n",
+			map[string]string{"time": "2020-01-01T00:00:00.000Z"},
+			":irc.example.com NOTICE * :hi\r\n",
+		},
+		{
+			"@a;b=;+c=x\\sy\\:z\\\\;d=end\\ PING :hi\r\n",
+			map[string]string{"a": "", "b": "", "+c": "x y;z\\", "d": "end"},
+			"PING :hi\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		tags, rest := splitTags(test.line)
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("splitTags(%q) tags = %v, wanted %v", test.line, tags,
+				test.tags)
+		}
+		if rest != test.rest {
+			t.Errorf("splitTags(%q) rest = %q, wanted %q", test.line, rest,
+				test.rest)
+		}
+	}
+}
+
+// terrarium does not support server-time. A client that asks for it should
+// still register.
+func TestCapNegotiationUnsupported(t *testing.T) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	client := NewClient("client1", "127.0.0.1", terrarium.Port)
+	client.RequestCaps("server-time")
+	client.EnableTags()
+
+	_, _, _, err = client.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	if client.HasCap("server-time") {
+		t.Errorf("client has server-time but server does not support it")
+	}
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-client.GetTaggedChannel():
+			if m.Command == irc.ReplyWelcome {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for welcome")
+		}
+	}
+}
+
+// Clients with message-tags get the bot tag on messages from bots (+B).
+func TestBotTag(t *testing.T) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	watcher := NewClient("watcher", "127.0.0.1", terrarium.Port)
+	watcher.RequestCaps("message-tags")
+	watcher.EnableTags()
+	if _, _, _, err := watcher.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer watcher.Stop()
+	if !watcher.HasCap("message-tags") {
+		t.Fatalf("server did not acknowledge message-tags")
+	}
+
+	bot := NewClient("bot", "127.0.0.1", terrarium.Port)
+	botRecv, botSend, _, err := bot.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer bot.Stop()
+	if waitForMessage(t, botRecv, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", bot.GetNick()) == nil {
+		t.Fatalf("bot did not get welcome")
+	}
+
+	waitForPRIVMSG := func(text string) *TaggedMessage {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case m := <-watcher.GetTaggedChannel():
+				if m.Command == "PRIVMSG" && len(m.Params) == 2 &&
+					m.Params[1] == text {
+					return &m
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for PRIVMSG %q", text)
+			}
+		}
+	}
+
+	botSend <- irc.Message{Command: "PRIVMSG",
+		Params: []string{watcher.GetNick(), "before"}}
+	if m := waitForPRIVMSG("before"); m.Tags != nil {
+		t.Errorf("message from a user who isn't a bot had tags %v", m.Tags)
+	}
+
+	botSend <- irc.Message{Command: "MODE", Params: []string{bot.GetNick(), "+B"}}
+	botSend <- irc.Message{Command: "PRIVMSG",
+		Params: []string{watcher.GetNick(), "after"}}
+	if m := waitForPRIVMSG("after"); m.Tags == nil {
+		t.Errorf("message from a bot had no tags")
+	} else if _, exists := m.Tags["draft/bot"]; !exists {
+		t.Errorf("message from a bot had tags %v, wanted draft/bot", m.Tags)
+	}
+}
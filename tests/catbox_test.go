@@ -286,6 +286,34 @@ func (c *Catbox) linkServer(other *Catbox) error {
 	return c.rehash()
 }
 
+// linkPeer configures terrarium to link to the scripted peer. terrarium
+// connects to it, so call Accept() on the peer after this.
+func (c *Catbox) linkPeer(p *Peer) error {
+	return c.linkRemote(p.Name, p.Port, p.Pass)
+}
+
+// linkRemote configures terrarium to link to a server that is not a harnessed
+// terrarium, such as another ircd. terrarium connects to it.
+func (c *Catbox) linkRemote(name string, port uint16, pass string) error {
+	conf := filepath.Join(c.ConfigDir, "terrarium.conf")
+	serversConf := filepath.Join(c.ConfigDir, "servers.conf")
+	extra := fmt.Sprintf("servers-config = %s", serversConf)
+
+	if err := writeConf(conf, c.Name, c.SID, extra); err != nil {
+		return err
+	}
+
+	serversConfContent := fmt.Sprintf(`%s = %s,%d,%s,0`,
+		name, "127.0.0.1", port, pass)
+
+	if err := ioutil.WriteFile(serversConf, []byte(serversConfContent),
+		0644); err != nil {
+		return fmt.Errorf("error writing server conf: %s: %s", serversConf, err)
+	}
+
+	return c.rehash()
+}
+
 func (c *Catbox) rehash() error {
 	return errors.Wrap(
 		c.Command.Process.Signal(syscall.SIGHUP),
@@ -32,6 +32,23 @@ type Client struct {
 
 	channels map[string]struct{}
 	mutex    *sync.Mutex
+
+	// Capabilities to request when we register. See RequestCaps().
+	wantCaps []string
+
+	// SASL PLAIN credentials. See UseSASL().
+	saslUser string
+	saslPass string
+
+	// Capabilities the server acknowledged.
+	caps map[string]struct{}
+
+	// Whether to deliver messages with their tags. See EnableTags().
+	tagged     bool
+	taggedChan chan TaggedMessage
+
+	// Messages we read while registering. We deliver them once we start.
+	pending []TaggedMessage
 }
 
 // NewClient creates a Client.
@@ -46,6 +63,7 @@ func NewClient(nick, serverHost string, serverPort uint16) *Client {
 
 		channels: map[string]struct{}{},
 		mutex:    &sync.Mutex{},
+		caps:     map[string]struct{}{},
 	}
 }
 
@@ -71,6 +89,18 @@ func (c *Client) Start() (
 		return nil, nil, nil, fmt.Errorf("error connecting: %s", err)
 	}
 
+	negotiate := len(c.wantCaps) > 0 || c.saslUser != ""
+
+	if negotiate {
+		if err := c.writeMessage(irc.Message{
+			Command: "CAP",
+			Params:  []string{"LS", "302"},
+		}); err != nil {
+			_ = c.conn.Close()
+			return nil, nil, nil, err
+		}
+	}
+
 	if err := c.writeMessage(irc.Message{
 		Command: "NICK",
 		Params:  []string{c.nick},
@@ -87,10 +117,21 @@ func (c *Client) Start() (
 		return nil, nil, nil, err
 	}
 
+	if negotiate {
+		if err := c.negotiateCaps(); err != nil {
+			_ = c.conn.Close()
+			return nil, nil, nil, fmt.Errorf("error negotiating capabilities: %s",
+				err)
+		}
+	}
+
 	c.recvChan = make(chan irc.Message, 512)
 	c.sendChan = make(chan irc.Message, 512)
 	c.errChan = make(chan error, 512)
 	c.doneChan = make(chan struct{})
+	if c.tagged {
+		c.taggedChan = make(chan TaggedMessage, 512)
+	}
 
 	c.wg = &sync.WaitGroup{}
 
@@ -124,15 +165,20 @@ func (c *Client) connect() error {
 func (c Client) reader(recvChan chan<- irc.Message) {
 	defer c.wg.Done()
 
+	for _, m := range c.pending {
+		c.deliver(recvChan, m)
+	}
+
 	for {
 		select {
 		case <-c.doneChan:
 			close(recvChan)
+			c.closeTagged()
 			return
 		default:
 		}
 
-		m, err := c.readMessage()
+		m, tags, err := c.readMessage()
 		if err != nil {
 			// If we time out waiting for a read to succeed, just ignore it and try
 			// again. We want a short timeout on that so we frequently check whether
@@ -145,6 +191,7 @@ func (c Client) reader(recvChan chan<- irc.Message) {
 
 			c.errChan <- fmt.Errorf("error reading message: %s", err)
 			close(recvChan)
+			c.closeTagged()
 			return
 		}
 
@@ -155,19 +202,37 @@ func (c Client) reader(recvChan chan<- irc.Message) {
 			}); err != nil {
 				c.errChan <- fmt.Errorf("error sending pong: %s", err)
 				close(recvChan)
+				c.closeTagged()
 				return
 			}
 		}
 
-		if m.Command == "JOIN" {
-			if m.SourceNick() == c.nick {
-				c.mutex.Lock()
-				c.channels[m.Params[0]] = struct{}{}
-				c.mutex.Unlock()
-			}
+		c.deliver(recvChan, TaggedMessage{Message: m, Tags: tags})
+	}
+}
+
+// deliver passes a message we read to the caller.
+func (c Client) deliver(recvChan chan<- irc.Message, m TaggedMessage) {
+	if m.Command == "JOIN" {
+		if m.SourceNick() == c.nick {
+			c.mutex.Lock()
+			c.channels[m.Params[0]] = struct{}{}
+			c.mutex.Unlock()
 		}
+	}
+
+	if c.tagged {
+		c.taggedChan <- m
+		return
+	}
+
+	recvChan <- m.Message
+}
 
-		recvChan <- m
+// closeTagged closes the tagged channel if we're using it.
+func (c Client) closeTagged() {
+	if c.tagged {
+		close(c.taggedChan)
 	}
 }
 
@@ -224,25 +289,29 @@ func (c Client) writeMessage(m irc.Message) error {
 }
 
 // readMessage reads a line from the connection and parses it as an IRC message.
-func (c Client) readMessage() (irc.Message, error) {
+//
+// We return the message's tags separately. They are nil if there are none.
+func (c Client) readMessage() (irc.Message, map[string]string, error) {
 	if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
-		return irc.Message{}, fmt.Errorf("unable to set deadline: %s", err)
+		return irc.Message{}, nil, fmt.Errorf("unable to set deadline: %s", err)
 	}
 
 	line, err := c.rw.ReadString('\n')
 	if err != nil {
-		return irc.Message{}, err
+		return irc.Message{}, nil, err
 	}
 
 	log.Printf("client %s: read: %s", c.nick, strings.TrimRight(line, "\r\n"))
 
-	m, err := irc.ParseMessage(line)
+	tags, rest := splitTags(line)
+
+	m, err := irc.ParseMessage(rest)
 	if err != nil && err != irc.ErrTruncated {
-		return irc.Message{}, fmt.Errorf("unable to parse message: %s: %s", line,
-			err)
+		return irc.Message{}, nil, fmt.Errorf("unable to parse message: %s: %s",
+			line, err)
 	}
 
-	return m, nil
+	return m, tags, nil
 }
 
 // Stop shuts down the client and cleans up.
@@ -267,6 +336,10 @@ func (c *Client) Stop() {
 
 	for range c.recvChan {
 	}
+	if c.tagged {
+		for range c.taggedChan {
+		}
+	}
 	for range c.errChan {
 	}
 }
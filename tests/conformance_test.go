@@ -0,0 +1,277 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Conformance tests. These check replies the RFCs (1459 and 2812) specify.
+// They are a small subset of what the irctest suite
+// (https://github.com/progval/irctest) covers, but they run on every test run
+// and need nothing but terrarium.
+//
+// TestIRCTest runs the full irctest suite if you have it. See there.
+
+// conformanceCase is one exchange with the server after registration.
+type conformanceCase struct {
+	// Where the spec describes the behaviour.
+	spec string
+
+	// Messages to send. %[1]s in a parameter is replaced by the client's nick.
+	send []irc.Message
+
+	// The reply we expect. We skip other replies until we see this command.
+	wantCommand string
+
+	// Parameters we expect in the reply, after the client's nick. We only check
+	// as many as given.
+	wantParams []string
+}
+
+var conformanceCases = []conformanceCase{
+	{
+		spec: "RFC 1459 4.6.2 PING",
+		send: []irc.Message{{Command: "PING",
+			Params: []string{"token123"}}},
+		wantCommand: "PONG",
+	},
+	{
+		spec:        "RFC 1459 4.1.2 NICK with no nickname",
+		send:        []irc.Message{{Command: "NICK"}},
+		wantCommand: "431",
+	},
+	{
+		spec: "RFC 1459 4.1.2 NICK with an erroneous nickname",
+		send: []irc.Message{{Command: "NICK",
+			Params: []string{"1bad"}}},
+		wantCommand: "432",
+	},
+	{
+		spec: "RFC 1459 4.1.2 NICK in use",
+		send: []irc.Message{{Command: "NICK",
+			Params: []string{"holder"}}},
+		wantCommand: "433",
+		wantParams:  []string{"holder"},
+	},
+	{
+		spec:        "RFC 1459 4.2.1 JOIN with no channel",
+		send:        []irc.Message{{Command: "JOIN"}},
+		wantCommand: "461",
+		wantParams:  []string{"JOIN"},
+	},
+	{
+		spec: "RFC 1459 4.2.2 PART a channel that does not exist",
+		send: []irc.Message{{Command: "PART",
+			Params: []string{"#doesnotexist"}}},
+		wantCommand: "403",
+		wantParams:  []string{"#doesnotexist"},
+	},
+	{
+		spec:        "RFC 1459 4.4.1 PRIVMSG with no recipient",
+		send:        []irc.Message{{Command: "PRIVMSG"}},
+		wantCommand: "411",
+	},
+	{
+		spec: "RFC 1459 4.4.1 PRIVMSG with no text",
+		send: []irc.Message{{Command: "PRIVMSG",
+			Params: []string{"holder"}}},
+		wantCommand: "412",
+	},
+	{
+		spec: "RFC 1459 4.4.1 PRIVMSG to a nick that does not exist",
+		send: []irc.Message{{Command: "PRIVMSG",
+			Params: []string{"nosuchnick", "hi"}}},
+		wantCommand: "401",
+		wantParams:  []string{"nosuchnick"},
+	},
+	{
+		spec: "RFC 1459 4.5.2 WHOIS a nick that does not exist",
+		send: []irc.Message{{Command: "WHOIS",
+			Params: []string{"nosuchnick"}}},
+		wantCommand: "401",
+		wantParams:  []string{"nosuchnick"},
+	},
+	{
+		spec: "RFC 1459 4.5.2 WHOIS ends with RPL_ENDOFWHOIS",
+		send: []irc.Message{{Command: "WHOIS",
+			Params: []string{"%[1]s"}}},
+		wantCommand: "318",
+	},
+	{
+		spec: "RFC 1459 4.1.3 USER after registering",
+		send: []irc.Message{{Command: "USER",
+			Params: []string{"a", "0", "*", "a"}}},
+		wantCommand: "462",
+	},
+	{
+		spec:        "RFC 1459 6.1 Unknown command",
+		send:        []irc.Message{{Command: "NOSUCHCOMMAND"}},
+		wantCommand: "421",
+		wantParams:  []string{"NOSUCHCOMMAND"},
+	},
+	{
+		spec: "RFC 2812 3.1.7 QUIT",
+		send: []irc.Message{{Command: "QUIT",
+			Params: []string{"bye"}}},
+		wantCommand: "ERROR",
+	},
+}
+
+func TestConformance(t *testing.T) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	// Hold a nick so we can collide with it.
+	holder := NewClient("holder", "127.0.0.1", terrarium.Port)
+	holderRecv, _, _, err := holder.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer holder.Stop()
+	if waitForMessage(t, holderRecv, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", holder.GetNick()) == nil {
+		t.Fatalf("client did not get welcome")
+	}
+
+	for i, test := range conformanceCases {
+		t.Run(test.spec, func(t *testing.T) {
+			nick := fmt.Sprintf("conf%d", i)
+			client := NewClient(nick, "127.0.0.1", terrarium.Port)
+			recvChan, sendChan, _, err := client.Start()
+			if err != nil {
+				t.Fatalf("error starting client: %s", err)
+			}
+			defer client.Stop()
+
+			if waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+				"welcome from %s", nick) == nil {
+				t.Fatalf("client did not get welcome")
+			}
+
+			for _, m := range test.send {
+				var params []string
+				for _, param := range m.Params {
+					if strings.Contains(param, "%[1]s") {
+						param = fmt.Sprintf(param, nick)
+					}
+					params = append(params, param)
+				}
+				sendChan <- irc.Message{Command: m.Command, Params: params}
+			}
+
+			m := waitForMatch(t, recvChan, test.wantCommand,
+				func(m irc.Message) bool { return m.Command == test.wantCommand })
+			if m == nil {
+				t.Fatalf("did not get %s", test.wantCommand)
+			}
+
+			for j, want := range test.wantParams {
+				if len(m.Params) < j+2 || m.Params[j+1] != want {
+					t.Errorf("reply %s has parameter %d %q, wanted %q", m, j+1,
+						paramOrBlank(m.Params, j+1), want)
+				}
+			}
+		})
+	}
+}
+
+// RFC 1459 4.1: commands other than those for registering need a registered
+// client. We can't use Client for this as it registers.
+func TestConformanceNotRegistered(t *testing.T) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", terrarium.Port))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := conn.Write([]byte("PRIVMSG someone :hi\r\n")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatalf("error setting deadline: %s", err)
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading: %s", err)
+		}
+
+		m, err := irc.ParseMessage(line)
+		if err != nil {
+			t.Fatalf("error parsing %q: %s", line, err)
+		}
+
+		// 451 ERR_NOTREGISTERED
+		if m.Command == "451" {
+			return
+		}
+	}
+}
+
+// TestIRCTest runs the irctest conformance suite against terrarium. It is off
+// by default as it needs irctest and Python. To run it, set TERRARIUM_IRCTEST to
+// the path of an irctest checkout with its requirements installed.
+//
+// irctest runs many tests for features terrarium does not have. Select the ones
+// to run by setting TERRARIUM_IRCTEST_ARGS to extra pytest arguments separated
+// by spaces, such as -k Ping.
+//
+// irctest's external server controller connects to our harnessed terrarium.
+func TestIRCTest(t *testing.T) {
+	irctestDir := os.Getenv("TERRARIUM_IRCTEST")
+	if irctestDir == "" {
+		t.Skip("TERRARIUM_IRCTEST is not set")
+	}
+
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	args := []string{"-m", "pytest",
+		"--controller=irctest.controllers.external_server"}
+	args = append(args, strings.Fields(os.Getenv("TERRARIUM_IRCTEST_ARGS"))...)
+
+	cmd := exec.Command("python3", args...)
+	cmd.Dir = irctestDir
+	cmd.Env = append(os.Environ(),
+		"IRCTEST_SERVER_HOSTNAME=127.0.0.1",
+		fmt.Sprintf("IRCTEST_SERVER_PORT=%d", terrarium.Port),
+	)
+
+	output, err := cmd.CombinedOutput()
+	t.Logf("irctest output:\n%s", output)
+	if err != nil {
+		t.Fatalf("irctest failed: %s", err)
+	}
+}
+
+func paramOrBlank(params []string, i int) string {
+	if i < len(params) {
+		return params[i]
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Test that we understand halfops (+h) from other servers, and that halfops
+// may invite but not change modes.
+func TestHalfops(t *testing.T) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	peer, err := NewPeer("irc.example.net", "001", "testing")
+	if err != nil {
+		t.Fatalf("error starting peer: %s", err)
+	}
+	defer peer.Stop()
+
+	if err := terrarium.linkPeer(peer); err != nil {
+		t.Fatalf("error linking to peer: %s", err)
+	}
+
+	if err := peer.Accept(); err != nil {
+		t.Fatalf("error accepting link: %s", err)
+	}
+
+	uid, err := peer.IntroduceUser("remote1", "AAAAAB", time.Now().Unix())
+	if err != nil {
+		t.Fatalf("error introducing user: %s", err)
+	}
+
+	channelTS := fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix())
+
+	if err := peer.Send(irc.Message{
+		Prefix:  peer.SID,
+		Command: "SJOIN",
+		Params:  []string{channelTS, "#test", "+ns", "@%" + uid},
+	}); err != nil {
+		t.Fatalf("error sending burst: %s", err)
+	}
+
+	if err := peer.EndBurst(); err != nil {
+		t.Fatalf("error ending burst: %s", err)
+	}
+
+	if _, err := peer.WaitFor("PONG"); err != nil {
+		t.Fatalf("error waiting for end of burst: %s", err)
+	}
+
+	client1 := NewClient("client1", "127.0.0.1", terrarium.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", terrarium.Port)
+	recvChan2, _, _, err := client2.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client2.Stop()
+
+	if waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client1.GetNick()) == nil {
+		t.Fatalf("client1 did not get welcome")
+	}
+	if waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client2.GetNick()) == nil {
+		t.Fatalf("client2 did not get welcome")
+	}
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+
+	// NAMES shows the highest status.
+	m := waitForMessage(t, recvChan1, irc.Message{Command: "353"},
+		"NAMES for %s", client1.GetNick())
+	if m == nil {
+		t.Fatalf("client1 did not get NAMES")
+	}
+	if !strings.Contains(m.Params[len(m.Params)-1], "@remote1") {
+		t.Errorf("NAMES does not show remote1 as op: %s", m)
+	}
+
+	join, err := peer.WaitFor("JOIN")
+	if err != nil {
+		t.Fatalf("error waiting for JOIN: %s", err)
+	}
+	client1UID := join.Prefix
+
+	// The peer makes client1 a halfop.
+	if err := peer.Send(irc.Message{
+		Prefix:  uid,
+		Command: "TMODE",
+		Params:  []string{channelTS, "#test", "+h", client1UID},
+	}); err != nil {
+		t.Fatalf("error sending TMODE: %s", err)
+	}
+
+	m = waitForMessage(t, recvChan1, irc.Message{Command: "MODE"},
+		"MODE for %s", client1.GetNick())
+	if m == nil {
+		t.Fatalf("client1 did not see MODE")
+	}
+	if m.Params[1] != "+h" || m.Params[2] != "client1" {
+		t.Fatalf("unexpected MODE: %s", m)
+	}
+
+	// Halfops may invite.
+	sendChan1 <- irc.Message{Command: "INVITE", Params: []string{"client2",
+		"#test"}}
+	if waitForMessage(t, recvChan1, irc.Message{Command: "341"},
+		"%s invited client2", client1.GetNick()) == nil {
+		t.Fatalf("client1 could not invite")
+	}
+	if waitForMessage(t, recvChan2, irc.Message{Command: "INVITE"},
+		"%s invited", client2.GetNick()) == nil {
+		t.Fatalf("client2 did not get invite")
+	}
+
+	// Halfops may not change modes.
+	sendChan1 <- irc.Message{Command: "MODE", Params: []string{"#test", "+i"}}
+	if waitForMessage(t, recvChan1, irc.Message{Command: "482"},
+		"%s refused MODE", client1.GetNick()) == nil {
+		t.Fatalf("client1 was not refused")
+	}
+}
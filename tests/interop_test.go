@@ -0,0 +1,453 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Interoperability tests. These link terrarium to real TS6 servers (ircd-ratbox,
+// charybdis, and solanum) and run a scripted suite against each. The scripted
+// Peer checks what we think the protocol is. These check what other servers
+// actually do.
+//
+// They are off by default as they need docker and images of the servers. To
+// run them, set TERRARIUM_INTEROP to a comma separated list of
+// <implementation>=<image>. For example:
+//
+//   TERRARIUM_INTEROP=ratbox=ratbox:3.0.10,solanum=solanum:latest \
+//     go test -v -run Interop ./tests
+//
+// make interop does the same.
+//
+// Each image must have the ircd on the PATH as ircd. We run it on the host
+// network with the config we generate mounted at /interop.
+//
+// The suite covers:
+// - Burst: users and channels on each side before linking show up on the
+//   other.
+// - TB: a topic set before linking reaches terrarium.
+// - TMODE: a mode change on the other server reaches terrarium.
+// - SAVE: we do not offer SAVE, so a nick collision must be resolved some other
+//   way (KILL). Both sides must agree on the outcome and stay linked.
+// - BAN: we do not offer BAN, so a network wide K-Line must reach us some other
+//   way (ENCAP KLINE).
+
+// interopImpl describes how to configure one implementation.
+type interopImpl struct {
+	// Config for the connect block for terrarium, after the common settings.
+	connectExtra string
+
+	// Config granting the operator privileges.
+	operator string
+}
+
+var interopImpls = map[string]interopImpl{
+	"ratbox": {
+		connectExtra: "flags = topicburst;",
+		operator: `operator "oper" {
+	user = "*@*";
+	password = "testing";
+	flags = global_kill, remote, kline, ~encrypted;
+};`,
+	},
+	"charybdis": {
+		connectExtra: "flags = topicburst;",
+		operator: `privset "interop" {
+	privs = oper:local_kill, oper:global_kill, oper:routing, oper:kline,
+		oper:remoteban;
+};
+operator "oper" {
+	user = "*@*";
+	password = "testing";
+	privset = "interop";
+	flags = ~encrypted;
+};`,
+	},
+	"solanum": {
+		operator: `privset "interop" {
+	privs = oper:general, oper:local_kill, oper:global_kill, oper:routing,
+		oper:kline, oper:remoteban;
+};
+operator "oper" {
+	user = "*@*";
+	password = "testing";
+	privset = "interop";
+	flags = ~encrypted;
+};`,
+	},
+}
+
+// interopServer is another implementation's server running in a container.
+type interopServer struct {
+	Impl        string
+	Name        string
+	SID         string
+	Port        uint16
+	ConfigDir   string
+	ContainerID string
+}
+
+func TestInterop(t *testing.T) {
+	setting := os.Getenv("TERRARIUM_INTEROP")
+	if setting == "" {
+		t.Skip("TERRARIUM_INTEROP is not set")
+	}
+
+	for _, pair := range strings.Split(setting, ",") {
+		pieces := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(pieces) != 2 {
+			t.Fatalf("invalid TERRARIUM_INTEROP entry: %s", pair)
+		}
+		impl, image := pieces[0], pieces[1]
+
+		if _, ok := interopImpls[impl]; !ok {
+			t.Fatalf("unknown implementation: %s", impl)
+		}
+
+		t.Run(impl, func(t *testing.T) {
+			runInteropSuite(t, impl, image)
+		})
+	}
+}
+
+func runInteropSuite(t *testing.T, impl, image string) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	remote, err := startInteropServer(impl, image, "remote.example.net", "1AB",
+		terrarium.Name, terrarium.Port)
+	if err != nil {
+		t.Fatalf("error starting %s: %s", impl, err)
+	}
+	defer remote.stop()
+
+	// Set up state on each side before linking so it goes in the burst.
+
+	remoteClient := NewClient("remote1", "127.0.0.1", remote.Port)
+	remoteRecv, remoteSend, _, err := remoteClient.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer remoteClient.Stop()
+
+	localClient := NewClient("local1", "127.0.0.1", terrarium.Port)
+	localRecv, localSend, _, err := localClient.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer localClient.Stop()
+
+	remoteCollider := NewClient("collider", "127.0.0.1", remote.Port)
+	remoteColliderRecv, _, _, err := remoteCollider.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer remoteCollider.Stop()
+
+	localCollider := NewClient("collider", "127.0.0.1", terrarium.Port)
+	localColliderRecv, _, _, err := localCollider.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer localCollider.Stop()
+
+	for _, ch := range []<-chan irc.Message{remoteRecv, localRecv,
+		remoteColliderRecv, localColliderRecv} {
+		if waitForMessage(t, ch, irc.Message{Command: irc.ReplyWelcome},
+			"welcome") == nil {
+			t.Fatalf("client did not get welcome")
+		}
+	}
+
+	remoteSend <- irc.Message{Command: "JOIN", Params: []string{"#interop"}}
+	if waitForMessage(t, remoteRecv, irc.Message{Command: "JOIN"},
+		"remote1 joined") == nil {
+		t.Fatalf("remote1 did not join")
+	}
+	remoteSend <- irc.Message{Command: "TOPIC",
+		Params: []string{"#interop", "interop topic"}}
+	if waitForMessage(t, remoteRecv, irc.Message{Command: "TOPIC"},
+		"remote1 set topic") == nil {
+		t.Fatalf("remote1 did not set topic")
+	}
+
+	// Join later than the remote user so our channel is newer.
+	time.Sleep(time.Second)
+
+	localSend <- irc.Message{Command: "JOIN", Params: []string{"#interop"}}
+	if waitForMessage(t, localRecv, irc.Message{Command: "JOIN"},
+		"local1 joined") == nil {
+		t.Fatalf("local1 did not join")
+	}
+
+	if err := terrarium.linkRemote(remote.Name, remote.Port,
+		"testing"); err != nil {
+		t.Fatalf("error linking: %s", err)
+	}
+
+	// Burst.
+	if waitForMatch(t, localRecv, "remote1 to join", func(m irc.Message) bool {
+		return m.Command == "JOIN" && m.SourceNick() == "remote1"
+	}) == nil {
+		t.Fatalf("local1 did not see remote1 join")
+	}
+	if waitForMatch(t, remoteRecv, "local1 to join", func(m irc.Message) bool {
+		return m.Command == "JOIN" && m.SourceNick() == "local1"
+	}) == nil {
+		t.Fatalf("remote1 did not see local1 join")
+	}
+
+	// TB.
+	m := waitForMatch(t, localRecv, "topic", func(m irc.Message) bool {
+		return m.Command == "TOPIC"
+	})
+	if m == nil {
+		t.Fatalf("local1 did not get the topic")
+	}
+	if m.Params[len(m.Params)-1] != "interop topic" {
+		t.Errorf("local1 got topic %q, wanted interop topic",
+			m.Params[len(m.Params)-1])
+	}
+
+	// TMODE.
+	remoteSend <- irc.Message{Command: "MODE", Params: []string{"#interop",
+		"+i"}}
+	m = waitForMatch(t, localRecv, "MODE +i", func(m irc.Message) bool {
+		return m.Command == "MODE" && len(m.Params) >= 2 && m.Params[1] == "+i"
+	})
+	if m == nil {
+		t.Errorf("local1 did not see MODE +i")
+	}
+
+	// SAVE. Both sides must agree where collider is, if anywhere.
+	localServer := whoisServer(t, localSend, localRecv, "collider")
+	remoteServer := whoisServer(t, remoteSend, remoteRecv, "collider")
+	if localServer != remoteServer {
+		t.Errorf("servers disagree about collider: terrarium says %q, %s says %q",
+			localServer, impl, remoteServer)
+	}
+
+	// BAN.
+	remoteSend <- irc.Message{Command: "OPER", Params: []string{"oper",
+		"testing"}}
+	if waitForMessage(t, remoteRecv, irc.Message{Command: "381"},
+		"remote1 opered") == nil {
+		t.Fatalf("remote1 could not oper")
+	}
+	remoteSend <- irc.Message{Command: "KLINE", Params: []string{"0",
+		"*@interop.invalid", "ON", "*", "interop"}}
+	if !waitForLog(terrarium.LogChan, regexp.MustCompile(
+		`added K-Line for \[\*@interop\.invalid\]`)) {
+		t.Errorf("terrarium did not get the K-Line")
+	}
+
+	// The link must still be up.
+	remoteSend <- irc.Message{Command: "PRIVMSG", Params: []string{"local1",
+		"still linked"}}
+	if waitForMatch(t, localRecv, "PRIVMSG", func(m irc.Message) bool {
+		return m.Command == "PRIVMSG" && m.SourceNick() == "remote1"
+	}) == nil {
+		t.Errorf("local1 did not get PRIVMSG from remote1")
+	}
+}
+
+// startInteropServer writes a config for the implementation and starts it in
+// a container. It links with the terrarium listening on terrariumPort.
+func startInteropServer(
+	impl,
+	image,
+	name,
+	sid,
+	terrariumName string,
+	terrariumPort uint16,
+) (*interopServer, error) {
+	ln, port, err := getRandomPort()
+	if err != nil {
+		return nil, err
+	}
+	// The server opens the port itself.
+	_ = ln.Close()
+
+	tmpDir, err := ioutil.TempDir("", "boxcat-interop-")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving a temporary directory: %s", err)
+	}
+
+	conf := fmt.Sprintf(`serverinfo {
+	name = "%s";
+	sid = "%s";
+	description = "interop test";
+	network_name = "interop";
+	hub = yes;
+};
+
+admin {
+	name = "interop";
+	description = "interop test";
+	email = "interop@example.com";
+};
+
+class "users" {
+	ping_time = 2 minutes;
+	number_per_ip = 100;
+	max_number = 100;
+	sendq = 100 kbytes;
+};
+
+class "server" {
+	ping_time = 5 minutes;
+	connectfreq = 5 minutes;
+	max_number = 5;
+	sendq = 2 megabytes;
+};
+
+listen {
+	host = "127.0.0.1";
+	port = %d;
+};
+
+auth {
+	user = "*@*";
+	class = "users";
+};
+
+connect "%s" {
+	host = "127.0.0.1";
+	send_password = "testing";
+	accept_password = "testing";
+	port = %d;
+	class = "server";
+	%s
+};
+
+%s
+`,
+		name, sid, port, terrariumName, terrariumPort,
+		interopImpls[impl].connectExtra, interopImpls[impl].operator)
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "ircd.conf"),
+		[]byte(conf), 0644); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("error writing conf: %s", err)
+	}
+
+	cmd := exec.Command("docker", "run", "-d", "--rm", "--network", "host",
+		"-v", tmpDir+":/interop", image,
+		"ircd", "-foreground", "-configfile", "/interop/ircd.conf")
+
+	log.Printf("Running %s...", cmd.Args)
+	output, err := cmd.Output()
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("error starting container: %s", err)
+	}
+
+	s := &interopServer{
+		Impl:        impl,
+		Name:        name,
+		SID:         sid,
+		Port:        port,
+		ConfigDir:   tmpDir,
+		ContainerID: strings.TrimSpace(string(output)),
+	}
+
+	// Wait for it to listen.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			_ = conn.Close()
+			return s, nil
+		}
+
+		if time.Now().After(deadline) {
+			s.stop()
+			return nil, fmt.Errorf("%s did not start listening: %s", impl, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stop logs the server's output and removes its container.
+func (s *interopServer) stop() {
+	output, err := exec.Command("docker", "logs", s.ContainerID).
+		CombinedOutput()
+	if err != nil {
+		log.Printf("error retrieving %s logs: %s", s.Impl, err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			log.Printf("%s: %s", s.Impl, line)
+		}
+	}
+
+	if err := exec.Command("docker", "rm", "-f",
+		s.ContainerID).Run(); err != nil {
+		log.Printf("error removing %s container: %s", s.Impl, err)
+	}
+
+	if err := os.RemoveAll(s.ConfigDir); err != nil {
+		log.Printf("error cleaning up temporary directory: %s", err)
+	}
+}
+
+// waitForMatch waits for a message the function matches. Unlike
+// waitForMessage() it can look at more than the command.
+func waitForMatch(
+	t *testing.T,
+	ch <-chan irc.Message,
+	description string,
+	match func(irc.Message) bool,
+) *irc.Message {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Logf("timeout waiting for %s", description)
+			return nil
+		case m := <-ch:
+			if match(m) {
+				return &m
+			}
+		}
+	}
+}
+
+// whoisServer asks which server a nick is on. It is blank if there is no such
+// nick.
+func whoisServer(
+	t *testing.T,
+	send chan<- irc.Message,
+	recv <-chan irc.Message,
+	nick string,
+) string {
+	send <- irc.Message{Command: "WHOIS", Params: []string{nick}}
+
+	server := ""
+	m := waitForMatch(t, recv, "end of WHOIS", func(m irc.Message) bool {
+		// 312 RPL_WHOISSERVER
+		if m.Command == "312" && len(m.Params) >= 3 {
+			server = m.Params[2]
+		}
+		// 318 RPL_ENDOFWHOIS
+		return m.Command == "318"
+	})
+	if m == nil {
+		t.Errorf("no reply to WHOIS %s", nick)
+	}
+	return server
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Test that invite exceptions we hear about in burst let matching users join
+// an invite only channel.
+func TestInviteExceptionBurst(t *testing.T) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+	defer terrarium.stop()
+
+	peer, err := NewPeer("irc.example.net", "001", "testing")
+	if err != nil {
+		t.Fatalf("error starting peer: %s", err)
+	}
+	defer peer.Stop()
+	peer.Capabs = "QS ENCAP TB IE"
+
+	if err := terrarium.linkPeer(peer); err != nil {
+		t.Fatalf("error linking to peer: %s", err)
+	}
+
+	if err := peer.Accept(); err != nil {
+		t.Fatalf("error accepting link: %s", err)
+	}
+
+	uid, err := peer.IntroduceUser("remote1", "AAAAAB", time.Now().Unix())
+	if err != nil {
+		t.Fatalf("error introducing user: %s", err)
+	}
+
+	channelTS := fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix())
+
+	for _, m := range []irc.Message{
+		{
+			Prefix:  peer.SID,
+			Command: "SJOIN",
+			Params:  []string{channelTS, "#test", "+ins", "@" + uid},
+		},
+		{
+			Prefix:  peer.SID,
+			Command: "BMASK",
+			Params:  []string{channelTS, "#test", "I", "client1!*@*"},
+		},
+	} {
+		if err := peer.Send(m); err != nil {
+			t.Fatalf("error sending burst: %s", err)
+		}
+	}
+
+	if err := peer.EndBurst(); err != nil {
+		t.Fatalf("error ending burst: %s", err)
+	}
+
+	if _, err := peer.WaitFor("PONG"); err != nil {
+		t.Fatalf("error waiting for end of burst: %s", err)
+	}
+
+	client1 := NewClient("client1", "127.0.0.1", terrarium.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", terrarium.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client2.Stop()
+
+	if waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client1.GetNick()) == nil {
+		t.Fatalf("client1 did not get welcome")
+	}
+	if waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client2.GetNick()) == nil {
+		t.Fatalf("client2 did not get welcome")
+	}
+
+	// client1 matches the exception.
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	if waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+		"%s joined #test", client1.GetNick()) == nil {
+		t.Fatalf("client1 did not join")
+	}
+
+	m, err := peer.WaitFor("JOIN")
+	if err != nil {
+		t.Fatalf("error waiting for JOIN: %s", err)
+	}
+	if m.Params[0] != channelTS || m.Params[1] != "#test" {
+		t.Errorf("unexpected JOIN: %s", m)
+	}
+
+	// client2 does not.
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	if waitForMessage(t, recvChan2, irc.Message{Command: "473"},
+		"%s refused from #test", client2.GetNick()) == nil {
+		t.Fatalf("client2 was not refused")
+	}
+}
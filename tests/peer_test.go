@@ -0,0 +1,520 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Peer is a scripted TS6 server. It speaks just enough of the protocol to
+// link to a harnessed terrarium. Tests control everything it sends, so we can
+// check how terrarium reacts to other servers without running two full
+// instances.
+//
+// A Peer listens on a random port. Configure terrarium to link to it (see
+// Catbox.linkPeer()), then call Accept() to complete the link.
+//
+// Peer is not safe for concurrent use.
+type Peer struct {
+	Name string
+	SID  string
+	Pass string
+	Port uint16
+
+	// The capabilities we send in CAPAB.
+	Capabs string
+
+	// The SID of the terrarium we linked to.
+	RemoteSID string
+
+	listener net.Listener
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+}
+
+// NewPeer creates a Peer and starts it listening.
+func NewPeer(name, sid, pass string) (*Peer, error) {
+	ln, port, err := getRandomPort()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Peer{
+		Name:     name,
+		SID:      sid,
+		Pass:     pass,
+		Port:     port,
+		Capabs:   "QS ENCAP TB",
+		listener: ln,
+	}, nil
+}
+
+// Accept waits for terrarium to connect and runs the link handshake. When
+// it returns, terrarium considers us linked and is sending its burst. We have
+// not ended our burst. Send any burst messages and then call EndBurst().
+func (p *Peer) Accept() error {
+	if tcpLN, ok := p.listener.(*net.TCPListener); ok {
+		if err := tcpLN.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+			return fmt.Errorf("error setting accept deadline: %s", err)
+		}
+	}
+
+	conn, err := p.listener.Accept()
+	if err != nil {
+		return fmt.Errorf("error accepting connection: %s", err)
+	}
+	p.conn = conn
+	p.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	// terrarium initiated, so it sends PASS, CAPAB, SERVER first.
+	pass, err := p.WaitFor("PASS")
+	if err != nil {
+		return err
+	}
+	if len(pass.Params) < 4 || pass.Params[0] != p.Pass {
+		return fmt.Errorf("unexpected PASS: %s", pass)
+	}
+	p.RemoteSID = pass.Params[3]
+
+	if _, err := p.WaitFor("SERVER"); err != nil {
+		return err
+	}
+
+	for _, m := range []irc.Message{
+		{Command: "PASS", Params: []string{p.Pass, "TS", "6", p.SID}},
+		{Command: "CAPAB", Params: []string{p.Capabs}},
+		{Command: "SERVER", Params: []string{p.Name, "1", "Scripted peer"}},
+	} {
+		if err := p.Send(m); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.WaitFor("SVINFO"); err != nil {
+		return err
+	}
+
+	return p.Send(irc.Message{
+		Command: "SVINFO",
+		Params: []string{
+			"6", "6", "0", strconv.FormatInt(time.Now().Unix(), 10),
+		},
+	})
+}
+
+// EndBurst tells terrarium we're done bursting. We do this by sending PING.
+func (p *Peer) EndBurst() error {
+	return p.Send(irc.Message{
+		Prefix:  p.SID,
+		Command: "PING",
+		Params:  []string{p.Name, p.RemoteSID},
+	})
+}
+
+// IntroduceUser sends a UID command telling terrarium about a user on our
+// server. id is the part of the UID after our SID, such as AAAAAB. It returns
+// the user's UID.
+func (p *Peer) IntroduceUser(nick, id string, nickTS int64) (string, error) {
+	uid := p.SID + id
+	return uid, p.Send(irc.Message{
+		Prefix:  p.SID,
+		Command: "UID",
+		Params: []string{
+			nick,
+			"1",
+			strconv.FormatInt(nickTS, 10),
+			"+i",
+			"~" + nick,
+			"peer.example.com",
+			"0",
+			uid,
+			nick,
+		},
+	})
+}
+
+// Send sends a message to terrarium.
+func (p *Peer) Send(m irc.Message) error {
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+
+	if err := p.conn.SetWriteDeadline(time.Now().Add(
+		10 * time.Second)); err != nil {
+		return fmt.Errorf("unable to set deadline: %s", err)
+	}
+
+	if _, err := p.rw.WriteString(buf); err != nil {
+		return err
+	}
+
+	if err := p.rw.Flush(); err != nil {
+		return fmt.Errorf("flush error: %s", err)
+	}
+
+	log.Printf("peer %s: sent: %s", p.Name, strings.TrimRight(buf, "\r\n"))
+	return nil
+}
+
+// WaitFor reads messages until we see one with the given command. We answer
+// PINGs from terrarium while we wait.
+func (p *Peer) WaitFor(command string) (*irc.Message, error) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		if err := p.conn.SetReadDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("unable to set deadline: %s", err)
+		}
+
+		line, err := p.rw.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error waiting for %s: %s", command, err)
+		}
+
+		log.Printf("peer %s: read: %s", p.Name, strings.TrimRight(line, "\r\n"))
+
+		m, err := irc.ParseMessage(line)
+		if err != nil && err != irc.ErrTruncated {
+			return nil, fmt.Errorf("unable to parse message: %s: %s", line, err)
+		}
+
+		if m.Command == command {
+			return &m, nil
+		}
+
+		// :<SID> PONG <name> <their SID>
+		if m.Command == "PING" {
+			if err := p.Send(irc.Message{
+				Prefix:  p.SID,
+				Command: "PONG",
+				Params:  []string{p.Name, m.Params[0]},
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Stop closes the peer's connection and listener.
+func (p *Peer) Stop() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+	}
+	_ = p.listener.Close()
+}
+
+// linkPeer harnesses a terrarium and links a Peer to it. The peer tells it
+// about a user, remote1, in its burst. It returns the user's UID. Stop the
+// terrarium and the peer when done.
+func linkPeer(t *testing.T) (*Catbox, *Peer, string) {
+	terrarium, err := harnessCatbox("irc.example.org", "000")
+	if err != nil {
+		t.Fatalf("error harnessing terrarium: %s", err)
+	}
+
+	peer, err := NewPeer("irc.example.net", "001", "testing")
+	if err != nil {
+		terrarium.stop()
+		t.Fatalf("error starting peer: %s", err)
+	}
+
+	if err := terrarium.linkPeer(peer); err != nil {
+		peer.Stop()
+		terrarium.stop()
+		t.Fatalf("error linking to peer: %s", err)
+	}
+
+	if err := peer.Accept(); err != nil {
+		peer.Stop()
+		terrarium.stop()
+		t.Fatalf("error accepting link: %s", err)
+	}
+
+	uid, err := peer.IntroduceUser("remote1", "AAAAAB", time.Now().Unix())
+	if err != nil {
+		peer.Stop()
+		terrarium.stop()
+		t.Fatalf("error introducing user: %s", err)
+	}
+
+	if err := peer.EndBurst(); err != nil {
+		peer.Stop()
+		terrarium.stop()
+		t.Fatalf("error ending burst: %s", err)
+	}
+
+	// terrarium answers our PING once it has processed our burst.
+	if _, err := peer.WaitFor("PONG"); err != nil {
+		peer.Stop()
+		terrarium.stop()
+		t.Fatalf("error waiting for end of burst: %s", err)
+	}
+
+	return terrarium, peer, uid
+}
+
+// waitForClientMessage waits for the client to receive a message that
+// matches.
+func waitForClientMessage(t *testing.T, ch <-chan irc.Message,
+	match func(irc.Message) bool, what string) *irc.Message {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-ch:
+			if match(m) {
+				return &m
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", what)
+			return nil
+		}
+	}
+}
+
+// Test a local client messaging a user on a linked server.
+func TestPeerPRIVMSG(t *testing.T) {
+	terrarium, peer, uid := linkPeer(t)
+	defer terrarium.stop()
+	defer peer.Stop()
+
+	client := NewClient("client1", "127.0.0.1", terrarium.Port)
+	recvChan, sendChan, _, err := client.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	if waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client.GetNick()) == nil {
+		t.Fatalf("client did not get welcome")
+	}
+
+	sendChan <- irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"remote1", "hi there"},
+	}
+
+	m, err := peer.WaitFor("PRIVMSG")
+	if err != nil {
+		t.Fatalf("error waiting for PRIVMSG: %s", err)
+	}
+
+	if m.Params[0] != uid || m.Params[1] != "hi there" {
+		t.Errorf("unexpected PRIVMSG: %s", m)
+	}
+	if !strings.HasPrefix(m.Prefix, terrarium.SID) {
+		t.Errorf("PRIVMSG is not from a user on %s: %s", terrarium.SID, m)
+	}
+}
+
+// An SJOIN with an older channel TS wins: we drop our ops and modes and take
+// theirs. One with a newer TS adds its members without their ops.
+func TestPeerSJOINTS(t *testing.T) {
+	terrarium, peer, uid := linkPeer(t)
+	defer terrarium.stop()
+	defer peer.Stop()
+
+	client := NewClient("client1", "127.0.0.1", terrarium.Port)
+	recvChan, sendChan, _, err := client.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	if waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client.GetNick()) == nil {
+		t.Fatalf("client did not get welcome")
+	}
+
+	sendChan <- irc.Message{Command: "JOIN", Params: []string{"#ts"}}
+	sjoin, err := peer.WaitFor("SJOIN")
+	if err != nil {
+		t.Fatalf("error waiting for SJOIN: %s", err)
+	}
+	channelTS, err := strconv.ParseInt(sjoin.Params[0], 10, 64)
+	if err != nil {
+		t.Fatalf("invalid channel TS in %s: %s", sjoin, err)
+	}
+
+	if err := peer.Send(irc.Message{
+		Prefix:  peer.SID,
+		Command: "SJOIN",
+		Params: []string{strconv.FormatInt(channelTS-100, 10), "#ts", "+n",
+			"@" + uid},
+	}); err != nil {
+		t.Fatalf("error sending SJOIN: %s", err)
+	}
+
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "MODE" && len(m.Params) == 3 && m.Params[1] == "-o" &&
+			m.Params[2] == client.GetNick()
+	}, "client to lose ops")
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "MODE" && len(m.Params) == 3 && m.Params[1] == "+o" &&
+			m.Params[2] == "remote1"
+	}, "remote1 to get ops")
+
+	uid2, err := peer.IntroduceUser("remote2", "AAAAAC", time.Now().Unix())
+	if err != nil {
+		t.Fatalf("error introducing user: %s", err)
+	}
+	if err := peer.Send(irc.Message{
+		Prefix:  peer.SID,
+		Command: "SJOIN",
+		Params: []string{strconv.FormatInt(channelTS+100, 10), "#ts", "+s",
+			"@" + uid2},
+	}); err != nil {
+		t.Fatalf("error sending SJOIN: %s", err)
+	}
+
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "JOIN" && strings.HasPrefix(m.Prefix, "remote2!")
+	}, "remote2 to join")
+
+	sendChan <- irc.Message{Command: "NAMES", Params: []string{"#ts"}}
+	names := waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "353"
+	}, "NAMES")
+	members := strings.Fields(names.Params[len(names.Params)-1])
+	sort.Strings(members)
+	if want := []string{"@remote1", client.GetNick(), "remote2"}; !reflect.DeepEqual(members, want) {
+		t.Errorf("#ts has %v, wanted %v", members, want)
+	}
+
+	sendChan <- irc.Message{Command: "MODE", Params: []string{"#ts"}}
+	modes := waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "324"
+	}, "channel modes")
+	if modes.Params[2] != "+n" {
+		t.Errorf("#ts has modes %s, wanted +n", modes.Params[2])
+	}
+}
+
+// A KILL from another server disconnects our user and frees their nick.
+func TestPeerKILL(t *testing.T) {
+	terrarium, peer, _ := linkPeer(t)
+	defer terrarium.stop()
+	defer peer.Stop()
+
+	client := NewClient("client1", "127.0.0.1", terrarium.Port)
+	recvChan, _, _, err := client.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	if waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client.GetNick()) == nil {
+		t.Fatalf("client did not get welcome")
+	}
+
+	introduction, err := peer.WaitFor("UID")
+	if err != nil {
+		t.Fatalf("error waiting for UID: %s", err)
+	}
+	if introduction.Params[0] != client.GetNick() {
+		t.Fatalf("unexpected UID: %s", introduction)
+	}
+
+	if err := peer.Send(irc.Message{
+		Prefix:  peer.SID,
+		Command: "KILL",
+		Params: []string{introduction.Params[7],
+			peer.Name + " (go away)"},
+	}); err != nil {
+		t.Fatalf("error sending KILL: %s", err)
+	}
+
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "ERROR" &&
+			strings.Contains(m.Params[0], "Killed (irc.example.net (go away))")
+	}, "client to be killed")
+
+	again := NewClient(client.GetNick(), "127.0.0.1", terrarium.Port)
+	againRecv, _, _, err := again.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer again.Stop()
+
+	if waitForMessage(t, againRecv, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", again.GetNick()) == nil {
+		t.Fatalf("killed user's nick was not freed")
+	}
+}
+
+// When a server behind the peer splits, our users see its users quit.
+func TestPeerSQUIT(t *testing.T) {
+	terrarium, peer, _ := linkPeer(t)
+	defer terrarium.stop()
+	defer peer.Stop()
+
+	leafUID := "002AAAAAB"
+	for _, m := range []irc.Message{
+		{Prefix: peer.SID, Command: "SID",
+			Params: []string{"irc.leaf.net", "2", "002", "Leaf"}},
+		{Prefix: "002", Command: "UID", Params: []string{"leaf1", "2",
+			strconv.FormatInt(time.Now().Unix(), 10), "+i", "~leaf1",
+			"leaf.example.com", "0", leafUID, "leaf1"}},
+	} {
+		if err := peer.Send(m); err != nil {
+			t.Fatalf("error sending %s: %s", m.Command, err)
+		}
+	}
+
+	client := NewClient("client1", "127.0.0.1", terrarium.Port)
+	recvChan, sendChan, _, err := client.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	if waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+		"welcome from %s", client.GetNick()) == nil {
+		t.Fatalf("client did not get welcome")
+	}
+
+	sendChan <- irc.Message{Command: "JOIN", Params: []string{"#split"}}
+	sjoin, err := peer.WaitFor("SJOIN")
+	if err != nil {
+		t.Fatalf("error waiting for SJOIN: %s", err)
+	}
+
+	if err := peer.Send(irc.Message{
+		Prefix:  "002",
+		Command: "SJOIN",
+		Params:  []string{sjoin.Params[0], "#split", "+", leafUID},
+	}); err != nil {
+		t.Fatalf("error sending SJOIN: %s", err)
+	}
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "JOIN" && strings.HasPrefix(m.Prefix, "leaf1!")
+	}, "leaf1 to join")
+
+	if err := peer.Send(irc.Message{
+		Prefix:  peer.SID,
+		Command: "SQUIT",
+		Params:  []string{"002", "leaf went away"},
+	}); err != nil {
+		t.Fatalf("error sending SQUIT: %s", err)
+	}
+
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "QUIT" && strings.HasPrefix(m.Prefix, "leaf1!")
+	}, "leaf1 to quit")
+
+	sendChan <- irc.Message{Command: "WHOIS", Params: []string{"leaf1"}}
+	waitForClientMessage(t, recvChan, func(m irc.Message) bool {
+		return m.Command == "401"
+	}, "leaf1 to be gone")
+}
@@ -0,0 +1,300 @@
+package terrarium
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/horgh/irc"
+)
+
+// TRACE lets operators see the connections on a server and the route to it.
+// ETRACE shows more about the users on this server.
+//
+// We have no connection classes. We give the kind of listener a client
+// connected on (such as tls or i2p) as its class, or "default" if we don't
+// know it.
+
+// traceClass is the class we show for a client in TRACE and ETRACE.
+func traceClass(c *LocalClient) string {
+	if c.Listener == "" {
+		return "default"
+	}
+	return listenerKind(c.Listener)
+}
+
+// TRACE shows the connections on a server. Without a target, or with our name,
+// it's us. With a nick, it's that user. We show a link line for each server on
+// the way to the target.
+//
+// Parameters: [<server or nick>]
+func (u *LocalUser) traceCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) == 0 || m.Params[0] == "" ||
+		m.Params[0] == u.Catbox.Config.ServerName {
+		for _, msg := range u.Catbox.createTRACEResponse(u.User, nil, false) {
+			u.maybeQueueMessage(msg)
+		}
+		return
+	}
+	target := m.Params[0]
+
+	if uid, exists := u.Catbox.Nicks[canonicalizeNick(target)]; exists {
+		user := u.Catbox.Users[uid]
+		if user.isLocal() {
+			for _, msg := range u.Catbox.createTRACEResponse(u.User, user,
+				false) {
+				u.maybeQueueMessage(msg)
+			}
+			return
+		}
+		u.Catbox.forwardTrace(u.User, string(user.UID), user.Server)
+		return
+	}
+
+	server := u.Catbox.getServerByName(target)
+	if server == nil {
+		// 402 ERR_NOSUCHSERVER
+		u.messageFromServer("402", []string{target, "No such server"})
+		return
+	}
+	u.Catbox.forwardTrace(u.User, string(server.SID), server)
+}
+
+// A remote user traces a server or user. The target is a SID or UID. If it's
+// us or our user, we answer. Otherwise we pass it on toward the target.
+//
+// Params: <SID or UID>
+func (s *LocalServer) traceCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"TRACE", "Not enough parameters"})
+		return
+	}
+
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		log.Printf("TRACE from unknown user %s", m.Prefix)
+		return
+	}
+
+	target := m.Params[0]
+
+	if TS6SID(target) == s.Catbox.Config.TS6SID {
+		for _, msg := range s.Catbox.createTRACEResponse(sourceUser, nil, true) {
+			sourceUser.ClosestServer.maybeQueueMessage(msg)
+		}
+		return
+	}
+
+	if user, exists := s.Catbox.Users[TS6UID(target)]; exists {
+		if user.isLocal() {
+			for _, msg := range s.Catbox.createTRACEResponse(sourceUser, user,
+				true) {
+				sourceUser.ClosestServer.maybeQueueMessage(msg)
+			}
+			return
+		}
+		s.Catbox.forwardTrace(sourceUser, target, user.Server)
+		return
+	}
+
+	server, exists := s.Catbox.Servers[TS6SID(target)]
+	if !exists {
+		// 402 ERR_NOSUCHSERVER
+		sourceUser.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "402",
+			Params:  []string{string(sourceUser.UID), target, "No such server"},
+		})
+		return
+	}
+	s.Catbox.forwardTrace(sourceUser, target, server)
+}
+
+// forwardTrace tells the user we're passing their TRACE on and passes it
+// toward the server. target is the SID or UID being traced.
+func (cb *Catbox) forwardTrace(source *User, target string, server *Server) {
+	next := server.LocalServer
+	if next == nil {
+		next = server.ClosestServer
+	}
+
+	// 200 RPL_TRACELINK
+	link := irc.Message{
+		Prefix:  cb.Config.ServerName,
+		Command: "200",
+		Params: []string{source.DisplayNick, "Link", cb.version(), server.Name,
+			next.Server.Name},
+	}
+	if source.isLocal() {
+		source.LocalUser.maybeQueueMessage(link)
+	} else {
+		link.Prefix = string(cb.Config.TS6SID)
+		link.Params[0] = string(source.UID)
+		source.ClosestServer.maybeQueueMessage(link)
+	}
+
+	next.maybeQueueMessage(irc.Message{
+		Prefix:  string(source.UID),
+		Command: "TRACE",
+		Params:  []string{target},
+	})
+}
+
+// Build the replies to TRACE. If target is set, we show only that local user.
+// Otherwise we show every connection to us: unregistered clients, users, and
+// servers. If the reply is going to a remote user, set useIDs so the replies
+// use IDs for us and the user.
+func (cb *Catbox) createTRACEResponse(replyUser, target *User,
+	useIDs bool) []irc.Message {
+	from := cb.Config.ServerName
+	to := replyUser.DisplayNick
+	if useIDs {
+		from = string(cb.Config.TS6SID)
+		to = string(replyUser.UID)
+	}
+
+	var msgs []irc.Message
+	add := func(command string, params ...string) {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: command,
+			Params:  append([]string{to}, params...),
+		})
+	}
+
+	addUser := func(user *User) {
+		who := fmt.Sprintf("%s[%s@%s] (%s)", user.DisplayNick, user.Username,
+			user.Hostname, cb.publicIP(user))
+		class := traceClass(user.LocalUser.LocalClient)
+		if user.isOperator() {
+			// 204 RPL_TRACEOPERATOR
+			add("204", "Oper", class, who)
+			return
+		}
+		// 205 RPL_TRACEUSER
+		add("205", "User", class, who)
+	}
+
+	if target != nil {
+		addUser(target)
+	} else {
+		var ids []uint64
+		for id := range cb.LocalClients {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			client := cb.LocalClients[id]
+			ip := client.ip().String()
+			if cb.Config.PrivacyProfile == PrivacyProfileAnonymous {
+				ip = "0"
+			}
+			// 203 RPL_TRACEUNKNOWN
+			add("203", "????", traceClass(client), fmt.Sprintf("[%s]", ip))
+		}
+
+		for _, user := range cb.sortedLocalUsers() {
+			addUser(user)
+		}
+
+		for _, ls := range cb.sortedLocalServers() {
+			servers, users := cb.countBehind(ls)
+			// 206 RPL_TRACESERVER
+			add("206", "Serv", traceClass(ls.LocalClient),
+				fmt.Sprintf("%dS", servers), fmt.Sprintf("%dC", users),
+				ls.Server.Name, "*!*@"+ls.Server.Name)
+		}
+	}
+
+	// 262 RPL_TRACEEND
+	add("262", cb.Config.ServerName, cb.version(), "End of TRACE")
+	return msgs
+}
+
+// ETRACE shows the users on this server with their user, host, IP, whether
+// they use TLS, and real name. With a nick, it shows only that user.
+//
+// Parameters: [<nick>]
+func (u *LocalUser) etraceCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	users := u.Catbox.sortedLocalUsers()
+	if len(m.Params) > 0 && m.Params[0] != "" {
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(m.Params[0])]
+		if !exists || !u.Catbox.Users[uid].isLocal() {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{m.Params[0], "No such nick/channel"})
+			return
+		}
+		users = []*User{u.Catbox.Users[uid]}
+	}
+
+	for _, user := range users {
+		kind := "User"
+		if user.isOperator() {
+			kind = "Oper"
+		}
+		tls := "plain"
+		if user.LocalUser.isTLS() {
+			tls = "tls"
+		}
+		// 709 RPL_ETRACE
+		u.messageFromServer("709", []string{kind,
+			traceClass(user.LocalUser.LocalClient), user.DisplayNick, user.Username,
+			user.Hostname, u.Catbox.publicIP(user), tls, user.RealName})
+	}
+
+	// 262 RPL_TRACEEND
+	u.messageFromServer("262", []string{u.Catbox.Config.ServerName,
+		u.Catbox.version(), "End of ETRACE"})
+}
+
+// sortedLocalUsers returns our users ordered by nick.
+func (cb *Catbox) sortedLocalUsers() []*User {
+	var users []*User
+	for _, lu := range cb.LocalUsers {
+		users = append(users, lu.User)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return canonicalizeNick(users[i].DisplayNick) <
+			canonicalizeNick(users[j].DisplayNick)
+	})
+	return users
+}
+
+// sortedLocalServers returns the servers linked to us ordered by name.
+func (cb *Catbox) sortedLocalServers() []*LocalServer {
+	var servers []*LocalServer
+	for _, ls := range cb.LocalServers {
+		servers = append(servers, ls)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Server.Name < servers[j].Server.Name
+	})
+	return servers
+}
+
+// countBehind counts the servers we reach through a link, including the one
+// linked to us, and the users on them.
+func (cb *Catbox) countBehind(ls *LocalServer) (int, int) {
+	servers, users := 0, 0
+	for _, server := range cb.Servers {
+		if server.LocalServer != ls && server.ClosestServer != ls {
+			continue
+		}
+		servers++
+		users += server.UserCount
+	}
+	return servers, users
+}
@@ -0,0 +1,62 @@
+package terrarium
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// Operators may TRACE this server or another. ETRACE shows our users.
+func TestMemNetworkTrace(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com", "c.example.com")
+	a := n.servers["a.example.com"]
+	c := n.servers["c.example.com"]
+
+	oper := a.connectUser("oper", "oper")
+	c.connectUser("carol", "carol")
+
+	n.link("a.example.com", "b.example.com")
+	n.link("b.example.com", "c.example.com")
+	n.waitForConverged(2)
+
+	oper.send(irc.Message{Command: "TRACE"})
+	n.waitFor("oper to be refused", func() bool { return oper.hasMessage("481") })
+
+	a.makeOper("oper")
+	oper.send(irc.Message{Command: "TRACE"})
+	n.waitFor("oper to get the trace", func() bool {
+		return oper.hasMessage("262")
+	})
+	if !oper.hasMessageContaining("204", "oper[~oper@") {
+		t.Errorf("TRACE did not show oper as an operator")
+	}
+	if m := oper.lastMessage("206"); m == nil || m.Params[3] != "2S" ||
+		m.Params[4] != "1C" || m.Params[5] != "b.example.com" {
+		t.Errorf("TRACE showed the link to b as %v, wanted 2S 1C", m)
+	}
+
+	oper.send(irc.Message{Command: "TRACE", Params: []string{"carol"}})
+	n.waitFor("oper to get carol's trace", func() bool {
+		return oper.hasMessageContaining("205", "carol[~carol@")
+	})
+	var links []string
+	oper.mutex.Lock()
+	for _, m := range oper.messages {
+		if m.Command == "200" {
+			links = append(links, m.Prefix+" "+m.Params[4])
+		}
+	}
+	oper.mutex.Unlock()
+	want := "a.example.com b.example.com, b.example.com c.example.com"
+	if got := strings.Join(links, ", "); got != want {
+		t.Errorf("TRACE carol gave links %s, wanted %s", got, want)
+	}
+
+	oper.send(irc.Message{Command: "ETRACE"})
+	n.waitFor("oper to get the etrace", func() bool {
+		m := oper.lastMessage("709")
+		return m != nil && m.Params[1] == "Oper" && m.Params[3] == "oper" &&
+			m.Params[7] == "plain"
+	})
+}
@@ -0,0 +1,104 @@
+package terrarium
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// An untrusted link is one we mark untrusted in the servers config. Its users
+// and channels are part of the network like any other's, but we don't let it
+// act on the rest of the network: it may not kill our users, add or remove
+// K-Lines, delink servers other than those behind it, or send most ENCAP
+// commands. If a leaf server is compromised, this limits what it can do.
+//
+// Everything from servers behind the link comes through it, so the same goes
+// for them.
+
+// untrustedEncapCommands are the ENCAP subcommands we accept from an untrusted
+// link.
+var untrustedEncapCommands = map[string]struct{}{
+	"GCAP":     {},
+	"RELAY":    {},
+	"RELAYMSG": {},
+}
+
+// trustAllows decides whether to act on a message from an untrusted link. If
+// not, we refuse it here.
+func (s *LocalServer) trustAllows(m irc.Message) bool {
+	switch m.Command {
+	case "KILL":
+		if len(m.Params) == 0 {
+			return true
+		}
+		user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+		if !exists || !user.isLocal() {
+			return true
+		}
+
+		// It already forgot the user. Tell it about them again.
+		s.trustRefused(m, fmt.Sprintf("KILL of %s", user.DisplayNick))
+		s.reintroduceUser(user)
+		return false
+	case "SQUIT":
+		if len(m.Params) == 0 {
+			return true
+		}
+		server, exists := s.Catbox.Servers[TS6SID(m.Params[0])]
+		if !exists || server.LocalServer == s || server.ClosestServer == s {
+			return true
+		}
+		s.trustRefused(m, fmt.Sprintf("SQUIT of %s", server.Name))
+		return false
+	case "ENCAP":
+		if len(m.Params) < 2 {
+			return true
+		}
+		subCommand := strings.ToUpper(m.Params[1])
+		if _, ok := untrustedEncapCommands[subCommand]; ok {
+			return true
+		}
+		// We don't pass it on either.
+		s.trustRefused(m, fmt.Sprintf("ENCAP %s", subCommand))
+		return false
+	}
+
+	return true
+}
+
+// trustRefused tells operators we refused something from an untrusted link.
+func (s *LocalServer) trustRefused(m irc.Message, what string) {
+	source := m.Prefix
+	if server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]; exists {
+		source = server.Name
+	}
+	if user, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+		source = user.DisplayNick
+	}
+
+	s.Catbox.noticeLocalOpers(fmt.Sprintf(
+		"Refused %s from %s through untrusted link %s", what, source,
+		s.Server.Name))
+}
+
+// reintroduceUser tells the server about one of our users and the channels
+// they are in, after it forgot them.
+func (s *LocalServer) reintroduceUser(user *User) {
+	s.sendUser(user)
+
+	for _, channel := range user.Channels {
+		// :<SID> SJOIN <channel TS> <channel name> <modes> :<UIDs>
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "SJOIN",
+			Params: []string{
+				fmt.Sprintf("%d", channel.TS),
+				channel.Name,
+				"+",
+				channel.memberPrefixes(user, s.Server.hasCapability("HOPS")) +
+					string(user.UID),
+			},
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package terrarium
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+// An untrusted link may not kill our users. We tell it about them again.
+func TestMemNetworkUntrustedLink(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.Servers = map[string]*ServerDefinition{}
+		for name, link := range a.cb.Config.Servers {
+			untrusted := *link
+			untrusted.Untrusted = true
+			cfg.Servers[name] = &untrusted
+		}
+		a.cb.setConfig(&cfg)
+	})
+
+	watcher := a.connectUser("watcher", "watcher")
+	a.makeOper("watcher")
+	alice := a.connectUser("alice", "alice")
+	alice.send(irc.Message{Command: "JOIN", Params: []string{"#chan"}})
+	oper := b.connectUser("oper", "oper")
+	userB := b.connectUser("userb", "userb")
+
+	// Each has an operator who may kill users on other servers.
+	for _, op := range []struct {
+		server *memServer
+		nick   string
+	}{{a, "alice"}, {b, "oper"}} {
+		op.server.makeOper(op.nick)
+		s := op.server
+		nick := op.nick
+		s.call(func() {
+			cfg := *s.cb.Config
+			cfg.OperPrivileges = map[string]map[string]struct{}{
+				"killer": {"remote-kill": {}}}
+			s.cb.setConfig(&cfg)
+			s.cb.Users[s.cb.Nicks[nick]].LocalUser.OperName = "killer"
+		})
+	}
+
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(4)
+
+	oper.send(irc.Message{Command: "KILL", Params: []string{"alice", "bye"}})
+	n.waitFor("the KILL to be refused", func() bool {
+		return watcher.hasMessageContaining("NOTICE",
+			"Refused KILL of alice from oper through untrusted link b.example.com")
+	})
+
+	n.waitFor("b to know alice again", func() bool {
+		return b.userServer("alice") == "a.example.com" &&
+			len(b.channelMembers("#chan")) == 1
+	})
+	if alice.hasMessage("ERROR") {
+		t.Errorf("alice was killed")
+	}
+
+	// Our users may still kill theirs.
+	alice.send(irc.Message{Command: "KILL", Params: []string{"userb", "bye"}})
+	n.waitFor("userb to be killed", func() bool {
+		return userB.hasMessage("ERROR")
+	})
+}
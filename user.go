@@ -2,7 +2,8 @@ package terrarium
 
 import (
 	"fmt"
-	"log"
+	"sort"
+	"strings"
 )
 
 // User holds information about a user. It may be remote or local.
@@ -16,7 +17,7 @@ type User struct {
 	// The user's nick's TS. This changes on registration and NICK.
 	NickTS int64
 
-	// The user's modes. Currently +i, +o, +C supported.
+	// The user's modes. Currently +i, +o, +p, +C supported.
 	Modes map[byte]struct{}
 
 	// The user's username.
@@ -26,7 +27,8 @@ type User struct {
 	Hostname string
 
 	// The user's IP. Not always a valid looking IP (e.g. may be 0 if a spoofed
-	// user sent to us from a different server).
+	// user sent to us from a different server). Use publicIP() for the IP to
+	// show or send others.
 	IP string
 
 	// Each user has a network wide unique identifier. This is part of TS6.
@@ -39,6 +41,15 @@ type User struct {
 	// Away message. If blank, they're not away.
 	AwayMessage string
 
+	// The account the user is logged in to. Services tell us this. If blank,
+	// they're not logged in.
+	Account string
+
+	// Whether they may relay messages for users of another network, such as
+	// when they are a bridge to Matrix. See RELAYMSG. Their server tells others
+	// with ENCAP RELAY.
+	Relay bool
+
 	// Channel name (canonicalized) to Channel. The channels it is in.
 	Channels map[string]*Channel
 
@@ -72,6 +83,33 @@ func (u *User) isOperator() bool {
 	return exists
 }
 
+// Invisible users (+i) are left out of NAMES unless they share a channel with
+// the user asking.
+func (u *User) isInvisible() bool {
+	_, exists := u.Modes['i']
+	return exists
+}
+
+// Private users (+p) hide their channels in WHOIS from non-operators who don't
+// share them.
+func (u *User) isPrivate() bool {
+	_, exists := u.Modes['p']
+	return exists
+}
+
+// Bots (+B) say so in WHOIS and WHO.
+func (u *User) isBot() bool {
+	_, exists := u.Modes['B']
+	return exists
+}
+
+// Caller ID users (+g) take private messages only from users on their ACCEPT
+// list.
+func (u *User) isCallerID() bool {
+	_, exists := u.Modes['g']
+	return exists
+}
+
 // Is the user on the given channel?
 func (u *User) onChannel(channel *Channel) bool {
 	_, exists := u.Channels[channel.Name]
@@ -80,11 +118,12 @@ func (u *User) onChannel(channel *Channel) bool {
 
 // Make a string of their user modes. + if no modes.
 func (u *User) modesString() string {
-	s := "+"
+	var modes []string
 	for m := range u.Modes {
-		s += string(m)
+		modes = append(modes, string(m))
 	}
-	return s
+	sort.Strings(modes)
+	return "+" + strings.Join(modes, "")
 }
 
 func (u *User) isLocal() bool {
@@ -107,22 +146,13 @@ func (u *User) isFloodExempt() bool {
 // Determine if our user mask (Username@Hostname) matches the given mask.
 //
 // If there are no wildcards in the mask, then it must match our user@host.
+// The host mask may match our IP instead, so masks of IPs match users whatever
+// their hostname, even a cloaked one.
 //
 // We support glob style (*) wildcards and ? to match any single char.
 func (u *User) matchesMask(userMask, hostMask string) bool {
-	userRE, err := maskToRegex(userMask)
-	if err != nil {
-		log.Printf("matchesMask: %s", err)
-		return false
-	}
-	if !userRE.MatchString(u.Username) {
-		return false
-	}
-
-	hostRE, err := maskToRegex(hostMask)
-	if err != nil {
-		log.Printf("matchesMask: %s", err)
+	if !matchMask(userMask, u.Username) {
 		return false
 	}
-	return hostRE.MatchString(u.Hostname)
+	return matchMask(hostMask, u.Hostname) || matchMask(hostMask, u.IP)
 }
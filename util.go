@@ -71,6 +71,30 @@ func canonicalizeChannel(c string) string {
 	return strings.ToLower(c)
 }
 
+// canonicalizeChannelMask converts a mask for a channel list (such as +I) to
+// its canonical nick!user@host form. We fill in missing parts with *, so foo
+// becomes foo!*@* and foo@bar becomes *!foo@bar. We case fold the same way as
+// nicks.
+//
+// It returns a blank string if the mask is not usable.
+func canonicalizeChannelMask(mask string) string {
+	if mask == "" || mask[0] == ':' || strings.ContainsAny(mask, " ,") {
+		return ""
+	}
+
+	if !strings.Contains(mask, "!") {
+		if strings.Contains(mask, "@") {
+			mask = "*!" + mask
+		} else {
+			mask += "!*@*"
+		}
+	} else if !strings.Contains(mask, "@") {
+		mask += "@*"
+	}
+
+	return canonicalizeNick(mask)
+}
+
 // isValidNick checks if a nickname is valid.
 //
 // To be compatible with ratbox, I try to accept the same characters and apply
@@ -131,6 +155,17 @@ func isValidNick(maxLen int, n string) bool {
 	return true
 }
 
+// isValidRelayNick checks a nick a relay sends a message as (RELAYMSG). It
+// must look like name/network, where each part is a valid nick. The / keeps it
+// from looking like one of our users.
+func isValidRelayNick(maxLen int, n string) bool {
+	i := strings.Index(n, "/")
+	if i == -1 {
+		return false
+	}
+	return isValidNick(maxLen, n[:i]) && isValidNick(maxLen, n[i+1:])
+}
+
 // isValidUser checks if a user (USER command) is valid
 //
 // See valid_username() in ratbox's match.c to see what ratbox accepts. This
@@ -324,6 +359,10 @@ func isValidSID(s string) bool {
 	return matched
 }
 
+// maxTS6IDs is how many TS6 IDs there are. The first character must be
+// [A-Z], the remaining 5 are [A-Z0-9], hence 26*36**5.
+const maxTS6IDs = 26 * 36 * 36 * 36 * 36 * 36
+
 // Make TS6 ID. 6 characters long, [A-Z][A-Z0-9]{5}. Must be unique on this
 // server.
 // I already assign clients a unique integer ID per server. Use this to generate
@@ -335,7 +374,7 @@ func makeTS6ID(id uint64) (TS6ID, error) {
 	// hence 36**5 vs. 26.
 	// This is also the maximum number of connections we can have per run.
 	// 1,572,120,576
-	if id >= 1572120576 {
+	if id >= maxTS6IDs {
 		return "", fmt.Errorf("TS6 ID overflow")
 	}
 
@@ -372,20 +411,67 @@ func makeTS6ID(id uint64) (TS6ID, error) {
 	return TS6ID(ts6id), nil
 }
 
-// Convert a mask to a regexp.
-// This quotes all regexp metachars, and then turns "*" into ".*", and "?"
-// into ".".
-func maskToRegex(mask string) (*regexp.Regexp, error) {
-	regex := regexp.QuoteMeta(mask)
-	regex = strings.Replace(regex, "\\*", ".*", -1)
-	regex = strings.Replace(regex, "\\?", ".", -1)
+// matchMask reports whether s matches the glob style mask.
+//
+// "*" matches any run of characters (including none) and "?" matches any
+// single character. Everything else must match exactly. The whole of s must
+// match, not only a substring of it.
+//
+// This used to compile a regexp for every call. We check masks against every
+// user when applying K-Lines, so we match directly instead. It does not
+// allocate.
+//
+// The approach is the usual backtracking one: remember where we saw the last
+// "*" and, on a mismatch, retry with that "*" consuming one more character.
+func matchMask(mask, s string) bool {
+	maskIdx := 0
+	sIdx := 0
+
+	// Position of the most recent * in the mask, and where in s we were when we
+	// saw it. -1 means we have not seen one.
+	starIdx := -1
+	starSIdx := 0
+
+	for sIdx < len(s) {
+		if maskIdx < len(mask) {
+			c := mask[maskIdx]
+
+			if c == '*' {
+				starIdx = maskIdx
+				starSIdx = sIdx
+				maskIdx++
+				continue
+			}
+
+			if c == '?' || c == s[sIdx] {
+				maskIdx++
+				sIdx++
+				continue
+			}
+		}
+
+		// Mismatch. Let the last * swallow one more character if we have one.
+		if starIdx == -1 {
+			return false
+		}
 
-	re, err := regexp.Compile(regex)
-	if err != nil {
-		return nil, err
+		starSIdx++
+		maskIdx = starIdx + 1
+		sIdx = starSIdx
 	}
 
-	return re, nil
+	// Any trailing *s match the empty string.
+	for maskIdx < len(mask) && mask[maskIdx] == '*' {
+		maskIdx++
+	}
+
+	return maskIdx == len(mask)
+}
+
+// isLiteralMask reports whether a mask has no wildcards. Such a mask matches
+// only the exact string.
+func isLiteralMask(mask string) bool {
+	return !strings.ContainsAny(mask, "*?")
 }
 
 var resolver = net.Resolver{
@@ -550,13 +636,15 @@ func parseAndResolveUmodeChanges(modes string,
 	unknownModes := make(map[byte]struct{})
 
 	for mode := range requestSetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if mode != 'g' && mode != 'i' && mode != 'o' && mode != 'p' &&
+			mode != 'B' && mode != 'C' {
 			delete(requestSetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
 	}
 	for mode := range requestUnsetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if mode != 'g' && mode != 'i' && mode != 'o' && mode != 'p' &&
+			mode != 'B' && mode != 'C' {
 			delete(requestUnsetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
@@ -624,7 +712,7 @@ func parseAndResolveUmodeChanges(modes string,
 			}
 		}
 
-		if mode == 'i' {
+		if mode == 'g' || mode == 'i' || mode == 'p' || mode == 'B' {
 			currentModes[mode] = struct{}{}
 			setModes[mode] = struct{}{}
 			continue
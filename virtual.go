@@ -0,0 +1,218 @@
+package terrarium
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/horgh/irc"
+)
+
+// Parts of the server, such as the bridge, may run users of their own. These
+// are virtual users. Each is a client we connect to ourself in memory. It
+// registers and sends commands like any other client, so it has its own UID,
+// and what it does reaches other servers as it would from a real client.
+//
+// Virtual users' client IDs come from a range reserved for them, so their UIDs
+// look like <SID>Z?????. Real clients never get these.
+
+// virtualClientIDBase is the first client ID we give virtual users. It is the
+// first TS6 ID starting with Z. Real clients' IDs stay below it.
+const virtualClientIDBase = 25 * 36 * 36 * 36 * 36 * 36
+
+// VirtualUser is a user we run ourself. Use it from goroutines other than
+// the server goroutine. Its methods block until the server reads what they
+// send.
+type VirtualUser struct {
+	cb   *Catbox
+	conn net.Conn
+
+	// Called with each message the user receives, other than PINGs, which we
+	// answer. It runs on the user's reader goroutine. It may be nil.
+	handler func(irc.Message)
+
+	// Closed once the user registers and once it disconnects.
+	registered chan struct{}
+	done       chan struct{}
+
+	// Guards writing to conn and uid.
+	mutex sync.Mutex
+	uid   TS6UID
+}
+
+// isVirtual tells whether the client is one of our virtual users. They connect
+// on no listener and we trust them, so client passwords and challenges don't
+// apply to them.
+func (c *LocalClient) isVirtual() bool {
+	return c.ID >= virtualClientIDBase
+}
+
+// getVirtualClientID generates a client ID for a virtual user.
+func (cb *Catbox) getVirtualClientID() uint64 {
+	cb.NextClientIDLock.Lock()
+	defer cb.NextClientIDLock.Unlock()
+
+	id := virtualClientIDBase + cb.NextVirtualClientID
+	if id >= maxTS6IDs {
+		log.Fatalf("Virtual client id overflow")
+	}
+	cb.NextVirtualClientID++
+
+	return id
+}
+
+// NewVirtualUser connects a virtual user and starts it registering. It is
+// flood exempt. Wait for Registered() before relying on it.
+//
+// handler, if not nil, gets every message the user receives.
+func (cb *Catbox) NewVirtualUser(nick, username, realName string,
+	handler func(irc.Message)) *VirtualUser {
+	ours, theirs := net.Pipe()
+
+	v := &VirtualUser{
+		cb:         cb,
+		conn:       ours,
+		handler:    handler,
+		registered: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	cb.introduceClientWithID(cb.getVirtualClientID(), theirs, "")
+
+	cb.WG.Add(1)
+	go v.readLoop(nick, username, realName)
+
+	return v
+}
+
+// Registered is closed once the user has registered.
+func (v *VirtualUser) Registered() <-chan struct{} {
+	return v.registered
+}
+
+// Done is closed once the user is disconnected.
+func (v *VirtualUser) Done() <-chan struct{} {
+	return v.done
+}
+
+// UID is the user's UID. It is blank until the user registers.
+func (v *VirtualUser) UID() TS6UID {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.uid
+}
+
+// Send sends a command as the user, such as a JOIN.
+func (v *VirtualUser) Send(m irc.Message) error {
+	buf, err := m.Encode()
+	if err != nil {
+		return err
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	_, err = v.conn.Write([]byte(buf))
+	return err
+}
+
+// Join has the user join a channel.
+func (v *VirtualUser) Join(channel string) error {
+	return v.Send(irc.Message{Command: "JOIN", Params: []string{channel}})
+}
+
+// Privmsg has the user send a PRIVMSG to a channel or nick.
+func (v *VirtualUser) Privmsg(target, text string) error {
+	return v.Send(irc.Message{Command: "PRIVMSG", Params: []string{target, text}})
+}
+
+// Quit disconnects the user.
+func (v *VirtualUser) Quit(reason string) error {
+	return v.Send(irc.Message{Command: "QUIT", Params: []string{reason}})
+}
+
+// readLoop registers the user and then reads what the server sends it until
+// the server drops it or we shut down.
+func (v *VirtualUser) readLoop(nick, username, realName string) {
+	defer v.cb.WG.Done()
+	defer close(v.done)
+
+	// The server closes the connection when it drops the user. Close it
+	// ourself if we shut down first so we don't block.
+	v.cb.WG.Add(1)
+	go func() {
+		defer v.cb.WG.Done()
+		select {
+		case <-v.done:
+		case <-v.cb.ShutdownChan:
+		}
+		_ = v.conn.Close()
+	}()
+
+	if err := v.Send(irc.Message{Command: "NICK",
+		Params: []string{nick}}); err != nil {
+		return
+	}
+	if err := v.Send(irc.Message{Command: "USER",
+		Params: []string{username, "0", "*", realName}}); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(v.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			log.Printf("Virtual user %s: Disconnected: %s", nick, err)
+			return
+		}
+
+		m, err := irc.ParseMessage(line)
+		if err != nil && err != irc.ErrTruncated {
+			continue
+		}
+
+		switch m.Command {
+		case "PING":
+			if err := v.Send(irc.Message{Command: "PONG",
+				Params: m.Params}); err != nil {
+				return
+			}
+			continue
+		case "042":
+			// 042 RPL_YOURID tells us our UID. We're registered.
+			if len(m.Params) >= 2 {
+				v.registeredAs(TS6UID(m.Params[1]))
+			}
+		case "433":
+			// 433 ERR_NICKNAMEINUSE
+			if v.UID() == "" {
+				log.Printf("Virtual user %s: Nick is in use", nick)
+				return
+			}
+		}
+
+		if v.handler != nil {
+			v.handler(m)
+		}
+	}
+}
+
+// registeredAs records that the user registered with the UID.
+func (v *VirtualUser) registeredAs(uid TS6UID) {
+	v.mutex.Lock()
+	v.uid = uid
+	v.mutex.Unlock()
+
+	// Whoever runs the user may have it send several messages at once, such as
+	// the bridge posting several lines.
+	v.cb.newEvent(Event{
+		Type: CallEvent,
+		Func: func() {
+			if u, exists := v.cb.Users[uid]; exists {
+				u.FloodExempt = true
+			}
+		},
+	})
+
+	close(v.registered)
+}
@@ -0,0 +1,85 @@
+package terrarium
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// A virtual user gets a UID from the reserved range, and the rest of the
+// network sees what it does as it would a real user's.
+func TestVirtualUser(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+
+	bob := b.connectUser("bob", "bob")
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(1)
+
+	var mutex sync.Mutex
+	var got []irc.Message
+	v := a.cb.NewVirtualUser("svc", "svc", "A service", func(m irc.Message) {
+		mutex.Lock()
+		got = append(got, m)
+		mutex.Unlock()
+	})
+
+	select {
+	case <-v.Registered():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("virtual user did not register")
+	}
+
+	uid := string(v.UID())
+	if !strings.HasPrefix(uid, string(a.cb.Config.TS6SID)+"Z") {
+		t.Errorf("virtual user has UID %s, wanted one in the reserved range", uid)
+	}
+	n.waitFor("b to see the virtual user", func() bool {
+		return b.userServer("svc") == "a.example.com"
+	})
+
+	joinAll("#chan", bob)
+	if err := v.Join("#chan"); err != nil {
+		t.Fatalf("joining: %s", err)
+	}
+	n.waitFor("the virtual user to join", func() bool {
+		return len(b.channelMembers("#chan")) == 2
+	})
+
+	if err := v.Privmsg("#chan", "hello from svc"); err != nil {
+		t.Fatalf("sending: %s", err)
+	}
+	n.waitFor("bob to get the message", func() bool {
+		return bob.hasMessageContaining("PRIVMSG", "hello from svc")
+	})
+
+	bob.send(irc.Message{Command: "PRIVMSG", Params: []string{"svc", "hi svc"}})
+	n.waitFor("the virtual user to get bob's message", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, m := range got {
+			if m.Command == "PRIVMSG" && len(m.Params) == 2 &&
+				m.Params[1] == "hi svc" {
+				return true
+			}
+		}
+		return false
+	})
+
+	if err := v.Quit("bye"); err != nil {
+		t.Fatalf("quitting: %s", err)
+	}
+	select {
+	case <-v.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("virtual user did not disconnect")
+	}
+	n.waitFor("b to see the virtual user quit", func() bool {
+		return b.userServer("svc") == "" &&
+			len(b.channelMembers("#chan")) == 1
+	})
+}
@@ -0,0 +1,163 @@
+package terrarium
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Web gateways connect to us on behalf of their users, so every user of one
+// would otherwise look like they come from the gateway. A gateway we trust
+// may instead send WEBIRC before registering to tell us where its user
+// connects from. We then treat the user as coming from there: K-Lines match
+// it, we show it, and we send the IP to other servers in UID. If the gateway
+// doesn't give a hostname, we look one up for the IP.
+//
+// We trust gateways listed in webirc-config, each with a password and the
+// host mask they connect from.
+
+// WebIRCGateway is a web gateway we trust to tell us where its users connect
+// from.
+type WebIRCGateway struct {
+	Name string
+
+	Password string
+
+	// The gateway must connect from an IP or hostname matching this.
+	HostMask string
+}
+
+// parseWebIRCGateway parses a gateway in webirc-config.
+//
+// Format: <password>,<host mask>
+func parseWebIRCGateway(name, s string) (WebIRCGateway, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) != 2 {
+		return WebIRCGateway{}, fmt.Errorf("unexpected number of fields")
+	}
+
+	password := strings.TrimSpace(pieces[0])
+	if password == "" {
+		return WebIRCGateway{}, fmt.Errorf("password is blank")
+	}
+
+	hostMask := strings.TrimSpace(pieces[1])
+	if !isValidHostMask(hostMask) {
+		return WebIRCGateway{}, fmt.Errorf("invalid host mask")
+	}
+
+	return WebIRCGateway{
+		Name:     name,
+		Password: password,
+		HostMask: hostMask,
+	}, nil
+}
+
+// webircCommand handles WEBIRC from a gateway before the user registers.
+//
+// Parameters: <password> <gateway> <hostname> <ip> [<options>]
+func (c *LocalClient) webircCommand(m irc.Message) {
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	// It must come first. We may already have acted on where they connect from.
+	if c.WebIRCGateway != "" || c.PreRegDisplayNick != "" || c.PreRegUser != "" {
+		c.quit("WEBIRC must come before registering")
+		return
+	}
+
+	gateway := c.Catbox.webircGateway(c, m.Params[0])
+	if gateway == nil {
+		c.Catbox.noticeLocalOpersAbout("connects", fmt.Sprintf(
+			"Refused WEBIRC from %s: No matching gateway", c.String()))
+		c.quit("WEBIRC not authorized")
+		return
+	}
+
+	ip := net.ParseIP(m.Params[3])
+	if ip == nil {
+		c.quit("WEBIRC IP is invalid")
+		return
+	}
+
+	log.Printf("Client %s: WEBIRC from gateway %s (%s): %s (%s)", c,
+		gateway.Name, m.Params[1], ip, m.Params[2])
+
+	c.WebIRCGateway = gateway.Name
+	c.WebIRCIP = ip
+	c.Hostname = ""
+
+	// The gateway looked up their hostname. Use it if it looks right.
+	hostname := m.Params[2]
+	if isValidHostname(hostname) && net.ParseIP(hostname) == nil {
+		c.Hostname = hostname
+		return
+	}
+
+	// Under the anonymous privacy profile we cloak everyone. Don't ask DNS
+	// about them.
+	if c.Catbox.Config.PrivacyProfile == PrivacyProfileAnonymous {
+		return
+	}
+
+	c.WebIRCLookup = true
+	c.Catbox.WG.Add(1)
+	go func() {
+		defer c.Catbox.WG.Done()
+		hostname := lookupHostname(context.TODO(), ip)
+		c.Catbox.newEvent(Event{
+			Type: CallEvent,
+			Func: func() { c.webircLookupDone(hostname) },
+		})
+	}()
+}
+
+// webircLookupDone records the hostname we looked up for the IP a gateway
+// gave, and carries on registering the client.
+func (c *LocalClient) webircLookupDone(hostname string) {
+	// They may have left, and someone else may have their ID now.
+	if c.Catbox.LocalClients[c.ID] != c {
+		return
+	}
+
+	c.Hostname = hostname
+	c.WebIRCLookup = false
+	if len(c.PreRegDisplayNick) > 0 && len(c.PreRegUser) > 0 {
+		c.maybeRegisterUser()
+	}
+}
+
+// ip is where the client connects from: the IP a gateway gave with WEBIRC, or
+// else the IP of the connection.
+func (c *LocalClient) ip() net.IP {
+	if c.WebIRCIP != nil {
+		return c.WebIRCIP
+	}
+	return c.Conn.IP
+}
+
+// webircGateway finds the gateway the client connects from, if the password
+// is right.
+func (cb *Catbox) webircGateway(c *LocalClient, password string) *WebIRCGateway {
+	for i := range cb.Config.WebIRCGateways {
+		gateway := &cb.Config.WebIRCGateways[i]
+		if !matchMask(gateway.HostMask, c.ip().String()) &&
+			(c.Hostname == "" || !matchMask(gateway.HostMask, c.Hostname)) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(password),
+			[]byte(gateway.Password)) != 1 {
+			continue
+		}
+		return gateway
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package terrarium
+
+import (
+	"net"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestMemNetworkWebIRC(t *testing.T) {
+	n := newMemNetwork(t, "a.example.com", "b.example.com")
+	a := n.servers["a.example.com"]
+	b := n.servers["b.example.com"]
+	n.link("a.example.com", "b.example.com")
+	n.waitForConverged(0)
+
+	a.call(func() {
+		cfg := *a.cb.Config
+		cfg.WebIRCGateways = []WebIRCGateway{
+			{Name: "web", Password: "secret", HostMask: "127.0.0.*"},
+		}
+		a.cb.setConfig(&cfg)
+		a.cb.KLines = append(a.cb.KLines, KLine{UserMask: "*",
+			HostMask: "banned.example.net", Reason: "banned"})
+	})
+
+	connect := func(password, hostname, ip string) *memClient {
+		ours, theirs := net.Pipe()
+		c := &memClient{conn: ours}
+		go c.readLoop()
+		a.cb.introduceClient(theirs, "")
+		c.send(irc.Message{Command: "WEBIRC",
+			Params: []string{password, "web", hostname, ip}})
+		c.send(irc.Message{Command: "NICK", Params: []string{"webuser"}})
+		c.send(irc.Message{Command: "USER", Params: []string{"user", "0", "*", "user"}})
+		return c
+	}
+
+	refused := connect("wrong", "user.example.net", "192.0.2.1")
+	n.waitFor("wrong password to be refused", func() bool {
+		return refused.hasMessageContaining("ERROR", "WEBIRC not authorized")
+	})
+
+	banned := connect("secret", "banned.example.net", "192.0.2.2")
+	n.waitFor("K-Line to match the gateway's user", func() bool {
+		return banned.hasMessage("465")
+	})
+
+	c := connect("secret", "user.example.net", "192.0.2.3")
+	n.waitFor("registration", func() bool {
+		return c.hasMessage(irc.ReplyWelcome)
+	})
+	n.waitForConverged(1)
+	b.call(func() {
+		user := b.cb.Users[b.cb.Nicks["webuser"]]
+		if user.Hostname != "user.example.net" || user.IP != "192.0.2.3" {
+			t.Errorf("user is from %s (%s), wanted user.example.net (192.0.2.3)",
+				user.Hostname, user.IP)
+		}
+	})
+
+	// Without a hostname from the gateway, we look one up before registering
+	// them.
+	c.send(irc.Message{Command: "QUIT"})
+	n.waitForConverged(0)
+	c = connect("secret", "0", "127.0.0.2")
+	n.waitFor("registration after the lookup", func() bool {
+		return c.hasMessage(irc.ReplyWelcome)
+	})
+	n.waitForConverged(1)
+	b.call(func() {
+		if user := b.cb.Users[b.cb.Nicks["webuser"]]; user.IP != "127.0.0.2" {
+			t.Errorf("user's IP is %s, wanted 127.0.0.2", user.IP)
+		}
+	})
+}